@@ -0,0 +1,177 @@
+package avro
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testSchema = `{
+	"type": "record",
+	"name": "Event",
+	"namespace": "ik.test",
+	"fields": [
+		{"name": "a", "type": "long"},
+		{"name": "b", "type": "string"},
+		{"name": "level", "type": {"type": "enum", "name": "Level", "symbols": ["INFO", "ERROR"]}, "default": "INFO"},
+		{"name": "tags", "type": {"type": "array", "items": "string"}, "default": []},
+		{"name": "labels", "type": {"type": "map", "values": ["null", "string", "long"]}, "default": {}},
+		{"name": "latency", "type": ["null", "double"]},
+		{"name": "inner", "type": ["null", {"type": "record", "name": "Inner", "fields": [{"name": "level", "type": "Level"}]}], "default": null},
+		{"name": "id", "type": {"type": "fixed", "name": "Id", "size": 2}, "default": "\u0000\u0000"},
+		{"name": "ok", "type": "boolean", "default": true},
+		{"name": "ratio", "type": "float", "default": 0.5},
+		{"name": "payload", "type": "bytes", "default": ""},
+		{"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}, "default": 0}
+	]
+}`
+
+func TestSchema_Marshal(t *testing.T) {
+	schema, err := ParseSchema([]byte(`{"type": "record", "name": "R", "fields": [{"name": "a", "type": "long"}, {"name": "b", "type": "string"}]}`))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the example of the specification
+	b, err := schema.Marshal(map[string]interface{}{"a": 27.0, "b": "foo", "c": 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(b, []byte{0x36, 0x06, 'f', 'o', 'o'}) {
+		t.Fatalf("%x", b)
+	}
+	for _, data := range []map[string]interface{}{
+		{"a": 1},
+		{"a": 1.5, "b": "x"},
+		{"a": "1", "b": "x"},
+		{"a": 1, "b": 2},
+	} {
+		_, err := schema.Marshal(data)
+		if err == nil {
+			t.Logf("%v accepted", data)
+			t.Fail()
+		}
+	}
+}
+
+func TestSchema_roundTrip(t *testing.T) {
+	schema, err := ParseSchema([]byte(testSchema))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data := map[string]interface{}{
+		"a":         int64(-1),
+		"b":         "hello",
+		"level":     "ERROR",
+		"tags":      []interface{}{"x", "y"},
+		"labels":    map[string]interface{}{"k": "v", "n": int64(3), "z": nil},
+		"latency":   0.25,
+		"inner":     map[string]interface{}{"level": "INFO"},
+		"id":        []byte{1, 2},
+		"ok":        false,
+		"ratio":     0.75,
+		"payload":   []byte("p"),
+		"timestamp": int64(1400000000000),
+	}
+	b, err := schema.Marshal(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decoded, err := schema.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(decoded, data) {
+		t.Fatalf("%v", decoded)
+	}
+
+	// the missing fields are taken from the defaults, or null
+	b, err = schema.Marshal(map[string]interface{}{"a": 1, "b": "x"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decoded, err = schema.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if decoded["level"] != "INFO" || decoded["latency"] != nil || decoded["inner"] != nil || decoded["ok"] != true || decoded["ratio"] != 0.5 || !bytes.Equal(decoded["id"].([]byte), []byte{0, 0}) {
+		t.Fatalf("%v", decoded)
+	}
+	_, err = schema.Unmarshal(b[:len(b)-1])
+	if err == nil {
+		t.Fatal("a truncated datum was accepted")
+	}
+}
+
+func TestParseSchema_invalid(t *testing.T) {
+	for _, s := range []string{
+		`"date"`,
+		`{"type": "record", "name": "R"}`,
+		`{"type": "record", "name": "R", "fields": [{"name": "a", "type": "Unknown"}]}`,
+		`{"type": "enum", "name": "E", "symbols": []}`,
+		`[["null"]]`,
+		`{`,
+	} {
+		_, err := ParseSchema([]byte(s))
+		if err == nil {
+			t.Logf("%s accepted", s)
+			t.Fail()
+		}
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests++
+		user, password, _ := req.BasicAuth()
+		if user != "user" || password != "pass" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		schema := `{"type": "record", "name": "R", "fields": [{"name": "a", "type": "long"}]}`
+		switch req.URL.Path {
+		case "/subjects/app-value/versions/latest":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"subject": "app-value", "version": 2, "id": 7, "schema": schema})
+		case "/schemas/ids/8":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"schema": schema})
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+			resp.Write([]byte(`{"error_code": 40403, "message": "Schema not found"}`))
+		}
+	}))
+	defer server.Close()
+	registry := NewRegistry("http://user:pass@"+server.Listener.Addr().String()+"/", time.Second)
+	id, schema, err := registry.Latest("app-value")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if id != 7 || schema.Name != "R" {
+		t.Fatalf("%d %v", id, schema)
+	}
+	cached, err := registry.Schema(7)
+	if err != nil || cached != schema || requests != 1 {
+		t.Fatal("the schema was not remembered")
+	}
+	_, err = registry.Schema(8)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = registry.Schema(9)
+	if err == nil {
+		t.Fatal("an unknown schema was found")
+	}
+
+	framed := Frame(7, []byte{0x36})
+	id, datum, err := Unframe(framed)
+	if err != nil || id != 7 || !bytes.Equal(datum, []byte{0x36}) {
+		t.Fatalf("%x", framed)
+	}
+	_, _, err = Unframe([]byte{1, 0, 0, 0, 7})
+	if err == nil {
+		t.Fatal("an unframed datum was accepted")
+	}
+}
@@ -0,0 +1,447 @@
+package avro
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+)
+
+var errTruncated = errors.New("truncated datum")
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	}
+	i, ok := toInt64(value)
+	return float64(i), ok
+}
+
+func toInt64(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int:
+		return int64(value), true
+	case int8:
+		return int64(value), true
+	case int16:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case uint:
+		return int64(value), true
+	case uint8:
+		return int64(value), true
+	case uint16:
+		return int64(value), true
+	case uint32:
+		return int64(value), true
+	case uint64:
+		return int64(value), value <= math.MaxInt64
+	case json.Number:
+		i, err := value.Int64()
+		return i, err == nil
+	case float64:
+		// JSON makes floats of all numbers
+		if value != math.Trunc(value) || value < math.MinInt64 || value >= math.MaxInt64 {
+			return 0, false
+		}
+		return int64(value), true
+	}
+	return 0, false
+}
+
+type datumEncoder struct {
+	buf []byte
+}
+
+func (encoder *datumEncoder) putLong(v int64) {
+	u := uint64((v << 1) ^ (v >> 63))
+	for u >= 0x80 {
+		encoder.buf = append(encoder.buf, byte(u)|0x80)
+		u >>= 7
+	}
+	encoder.buf = append(encoder.buf, byte(u))
+}
+
+func (encoder *datumEncoder) putBytes(b []byte) {
+	encoder.putLong(int64(len(b)))
+	encoder.buf = append(encoder.buf, b...)
+}
+
+// matches tells whether value can be encoded as schema, which picks the
+// branch of a union.
+func matches(schema *Schema, value interface{}) bool {
+	switch schema.Type {
+	case "null":
+		return value == nil
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "int":
+		i, ok := toInt64(value)
+		return ok && i >= math.MinInt32 && i <= math.MaxInt32
+	case "long":
+		_, ok := toInt64(value)
+		return ok
+	case "float", "double":
+		_, ok := toFloat64(value)
+		return ok
+	case "string", "bytes":
+		switch value.(type) {
+		case string, []byte:
+			return true
+		}
+	case "fixed":
+		switch value := value.(type) {
+		case string:
+			return len(value) == schema.Size
+		case []byte:
+			return len(value) == schema.Size
+		}
+	case "enum":
+		s, ok := value.(string)
+		if ok {
+			_, ok = schema.symbols[s]
+		}
+		return ok
+	case "array":
+		_, ok := value.([]interface{})
+		return ok
+	case "map", "record":
+		_, ok := value.(map[string]interface{})
+		return ok
+	}
+	return false
+}
+
+func valueError(path string, schema *Schema, value interface{}) error {
+	type_ := schema.Type
+	if schema.Name != "" {
+		type_ = schema.Name
+	}
+	return errors.New(fmt.Sprintf("%s: %v (%T) is not %s", path, value, value, type_))
+}
+
+func (encoder *datumEncoder) encode(path string, schema *Schema, value interface{}) error {
+	if schema.Type != "union" && !matches(schema, value) {
+		return valueError(path, schema, value)
+	}
+	switch schema.Type {
+	case "null":
+	case "boolean":
+		if value.(bool) {
+			encoder.buf = append(encoder.buf, 1)
+		} else {
+			encoder.buf = append(encoder.buf, 0)
+		}
+	case "int", "long":
+		i, _ := toInt64(value)
+		encoder.putLong(i)
+	case "float":
+		f, _ := toFloat64(value)
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], math.Float32bits(float32(f)))
+		encoder.buf = append(encoder.buf, b[:]...)
+	case "double":
+		f, _ := toFloat64(value)
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(f))
+		encoder.buf = append(encoder.buf, b[:]...)
+	case "string", "bytes":
+		switch value := value.(type) {
+		case string:
+			encoder.putBytes([]byte(value))
+		case []byte:
+			encoder.putBytes(value)
+		}
+	case "fixed":
+		switch value := value.(type) {
+		case string:
+			encoder.buf = append(encoder.buf, value...)
+		case []byte:
+			encoder.buf = append(encoder.buf, value...)
+		}
+	case "enum":
+		encoder.putLong(int64(schema.symbols[value.(string)]))
+	case "array":
+		items := value.([]interface{})
+		if len(items) > 0 {
+			encoder.putLong(int64(len(items)))
+			for i, item := range items {
+				err := encoder.encode(fmt.Sprintf("%s[%d]", path, i), schema.Items, item)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		encoder.putLong(0)
+	case "map":
+		entries := value.(map[string]interface{})
+		keys := make([]string, 0, len(entries))
+		for key := range entries {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		if len(keys) > 0 {
+			encoder.putLong(int64(len(keys)))
+			for _, key := range keys {
+				encoder.putBytes([]byte(key))
+				err := encoder.encode(path+"."+key, schema.Items, entries[key])
+				if err != nil {
+					return err
+				}
+			}
+		}
+		encoder.putLong(0)
+	case "record":
+		return encoder.encodeRecord(path, schema, value.(map[string]interface{}))
+	case "union":
+		for i, branch := range schema.Branches {
+			if matches(branch, value) {
+				encoder.putLong(int64(i))
+				return encoder.encode(path, branch, value)
+			}
+		}
+		return errors.New(fmt.Sprintf("%s: %v (%T) matches none of the union", path, value, value))
+	}
+	return nil
+}
+
+// encodeRecord takes a field missing from data from its default, or as
+// null if it may be one.
+func (encoder *datumEncoder) encodeRecord(path string, schema *Schema, data map[string]interface{}) error {
+	for _, field := range schema.Fields {
+		value, ok := data[field.Name]
+		if !ok {
+			if field.HasDefault {
+				value = field.Default
+				// the default of a union is of its first branch
+				if field.Schema.Type == "union" {
+					encoder.putLong(0)
+					err := encoder.encode(path+"."+field.Name, field.Schema.Branches[0], value)
+					if err != nil {
+						return err
+					}
+					continue
+				}
+			} else if !matches(field.Schema, nil) && !(field.Schema.Type == "union" && unionHasNull(field.Schema)) {
+				return errors.New(fmt.Sprintf("%s: %s is required", path, field.Name))
+			}
+		}
+		err := encoder.encode(path+"."+field.Name, field.Schema, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func unionHasNull(schema *Schema) bool {
+	for _, branch := range schema.Branches {
+		if branch.Type == "null" {
+			return true
+		}
+	}
+	return false
+}
+
+// Marshal encodes a record with the schema, which has to be of a record.
+// The values that are not fields of the record are ignored.
+func (schema *Schema) Marshal(data map[string]interface{}) ([]byte, error) {
+	if schema.Type != "record" {
+		return nil, errors.New("the schema is not of a record")
+	}
+	encoder := &datumEncoder{}
+	err := encoder.encodeRecord(schema.Name, schema, data)
+	if err != nil {
+		return nil, err
+	}
+	return encoder.buf, nil
+}
+
+type datumDecoder struct {
+	buf    []byte
+	offset int
+}
+
+func (decoder *datumDecoder) long() (int64, error) {
+	var u uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if decoder.offset >= len(decoder.buf) {
+			return 0, errTruncated
+		}
+		b := decoder.buf[decoder.offset]
+		decoder.offset++
+		u |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return int64(u>>1) ^ -int64(u&1), nil
+		}
+	}
+	return 0, errors.New("long overflows")
+}
+
+func (decoder *datumDecoder) take(n int64) ([]byte, error) {
+	if n < 0 || n > int64(len(decoder.buf)-decoder.offset) {
+		return nil, errTruncated
+	}
+	b := decoder.buf[decoder.offset : decoder.offset+int(n)]
+	decoder.offset += int(n)
+	return b, nil
+}
+
+// blockCount reads the count of the next block of an array or a map; a
+// negative one is followed by the size of the block, which is not needed.
+func (decoder *datumDecoder) blockCount() (int64, error) {
+	n, err := decoder.long()
+	if err != nil || n >= 0 {
+		return n, err
+	}
+	_, err = decoder.long()
+	return -n, err
+}
+
+func (decoder *datumDecoder) decode(schema *Schema) (interface{}, error) {
+	switch schema.Type {
+	case "null":
+		return nil, nil
+	case "boolean":
+		b, err := decoder.take(1)
+		if err != nil {
+			return nil, err
+		}
+		return b[0] != 0, nil
+	case "int", "long":
+		return decoder.long()
+	case "float":
+		b, err := decoder.take(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(b))), nil
+	case "double":
+		b, err := decoder.take(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(binary.LittleEndian.Uint64(b)), nil
+	case "string", "bytes":
+		n, err := decoder.long()
+		if err != nil {
+			return nil, err
+		}
+		b, err := decoder.take(n)
+		if err != nil {
+			return nil, err
+		}
+		if schema.Type == "string" {
+			return string(b), nil
+		}
+		return append([]byte{}, b...), nil
+	case "fixed":
+		b, err := decoder.take(int64(schema.Size))
+		if err != nil {
+			return nil, err
+		}
+		return append([]byte{}, b...), nil
+	case "enum":
+		i, err := decoder.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(schema.Symbols)) {
+			return nil, errors.New(fmt.Sprintf("%s: no symbol %d", schema.Name, i))
+		}
+		return schema.Symbols[i], nil
+	case "array":
+		items := make([]interface{}, 0)
+		for {
+			n, err := decoder.blockCount()
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				return items, nil
+			}
+			for ; n > 0; n-- {
+				item, err := decoder.decode(schema.Items)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+		}
+	case "map":
+		entries := make(map[string]interface{})
+		for {
+			n, err := decoder.blockCount()
+			if err != nil {
+				return nil, err
+			}
+			if n == 0 {
+				return entries, nil
+			}
+			for ; n > 0; n-- {
+				l, err := decoder.long()
+				if err != nil {
+					return nil, err
+				}
+				key, err := decoder.take(l)
+				if err != nil {
+					return nil, err
+				}
+				value, err := decoder.decode(schema.Items)
+				if err != nil {
+					return nil, err
+				}
+				entries[string(key)] = value
+			}
+		}
+	case "record":
+		data := make(map[string]interface{}, len(schema.Fields))
+		for _, field := range schema.Fields {
+			value, err := decoder.decode(field.Schema)
+			if err != nil {
+				return nil, err
+			}
+			data[field.Name] = value
+		}
+		return data, nil
+	case "union":
+		i, err := decoder.long()
+		if err != nil {
+			return nil, err
+		}
+		if i < 0 || i >= int64(len(schema.Branches)) {
+			return nil, errors.New(fmt.Sprintf("no branch %d in the union", i))
+		}
+		return decoder.decode(schema.Branches[i])
+	}
+	return nil, errors.New("unsupported type: " + schema.Type)
+}
+
+// Unmarshal decodes a record encoded with the schema.  Ints and longs are
+// int64s, floats and doubles float64s, and enums their symbols.
+func (schema *Schema) Unmarshal(b []byte) (map[string]interface{}, error) {
+	if schema.Type != "record" {
+		return nil, errors.New("the schema is not of a record")
+	}
+	decoder := &datumDecoder{buf: b}
+	data, err := decoder.decode(schema)
+	if err != nil {
+		return nil, err
+	}
+	if decoder.offset != len(b) {
+		return nil, errors.New("trailing bytes after the datum")
+	}
+	return data.(map[string]interface{}), nil
+}
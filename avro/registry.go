@@ -0,0 +1,119 @@
+package avro
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The first byte of a datum framed the way the serializers of Confluent
+// do, which is followed by the id of the schema in 4 bytes.
+const confluentMagic = 0
+
+// Frame prefixes the datum with the magic byte and the id of its schema.
+func Frame(id int32, datum []byte) []byte {
+	b := make([]byte, 5, 5+len(datum))
+	b[0] = confluentMagic
+	binary.BigEndian.PutUint32(b[1:5], uint32(id))
+	return append(b, datum...)
+}
+
+// Unframe splits a framed datum into the id of its schema and the datum.
+func Unframe(b []byte) (int32, []byte, error) {
+	if len(b) < 5 || b[0] != confluentMagic {
+		return 0, nil, errors.New("not a framed datum")
+	}
+	return int32(binary.BigEndian.Uint32(b[1:5])), b[5:], nil
+}
+
+// Registry fetches the schemas from a Confluent schema registry, and
+// remembers them by id, which never changes the schema it stands for.  The
+// basic auth credentials are taken from the URL if it has any.
+type Registry struct {
+	endpoint string
+	client   *http.Client
+	schemas  map[int32]*Schema
+	mtx      sync.Mutex
+}
+
+func NewRegistry(endpoint string, timeout time.Duration) *Registry {
+	return &Registry{
+		endpoint: strings.TrimRight(endpoint, "/"),
+		client:   &http.Client{Timeout: timeout},
+		schemas:  make(map[int32]*Schema),
+	}
+}
+
+type registrySchema struct {
+	Id     int32  `json:"id"`
+	Schema string `json:"schema"`
+}
+
+func (registry *Registry) get(path string) (*registrySchema, error) {
+	req, err := http.NewRequest("GET", registry.endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.schemaregistry.v1+json")
+	resp, err := registry.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, errors.New(fmt.Sprintf("schema registry returned %s: %s", resp.Status, strings.TrimSpace(string(message))))
+	}
+	retval := &registrySchema{}
+	err = json.NewDecoder(resp.Body).Decode(retval)
+	if err != nil {
+		return nil, err
+	}
+	return retval, nil
+}
+
+// Latest fetches the latest version of the schema of subject.
+func (registry *Registry) Latest(subject string) (int32, *Schema, error) {
+	fetched, err := registry.get("/subjects/" + url.PathEscape(subject) + "/versions/latest")
+	if err != nil {
+		return 0, nil, err
+	}
+	schema, err := ParseSchema([]byte(fetched.Schema))
+	if err != nil {
+		return 0, nil, err
+	}
+	registry.mtx.Lock()
+	registry.schemas[fetched.Id] = schema
+	registry.mtx.Unlock()
+	return fetched.Id, schema, nil
+}
+
+// Schema returns the schema of id, which is fetched the first time.
+func (registry *Registry) Schema(id int32) (*Schema, error) {
+	registry.mtx.Lock()
+	schema, ok := registry.schemas[id]
+	registry.mtx.Unlock()
+	if ok {
+		return schema, nil
+	}
+	fetched, err := registry.get(fmt.Sprintf("/schemas/ids/%d", id))
+	if err != nil {
+		return nil, err
+	}
+	schema, err = ParseSchema([]byte(fetched.Schema))
+	if err != nil {
+		return nil, err
+	}
+	registry.mtx.Lock()
+	registry.schemas[id] = schema
+	registry.mtx.Unlock()
+	return schema, nil
+}
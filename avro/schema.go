@@ -0,0 +1,203 @@
+// Package avro encodes records into the binary encoding of Apache Avro and
+// decodes them back, given the schema in its JSON form, and fetches the
+// schemas from a Confluent schema registry.
+package avro
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type Field struct {
+	Name       string
+	Schema     *Schema
+	Default    interface{}
+	HasDefault bool
+}
+
+// Schema is a parsed schema.  Type is the name of a primitive type, or
+// one of "record", "enum", "array", "map", "fixed" and "union".  A named
+// type referred to by name shares the same Schema.
+type Schema struct {
+	Type     string
+	Name     string // the full name of a named type
+	Fields   []*Field
+	Symbols  []string
+	Items    *Schema // of an array, or the values of a map
+	Size     int
+	Branches []*Schema
+	symbols  map[string]int
+}
+
+var primitiveTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"int":     true,
+	"long":    true,
+	"float":   true,
+	"double":  true,
+	"bytes":   true,
+	"string":  true,
+}
+
+type schemaParser struct {
+	named map[string]*Schema
+}
+
+func fullName(name string, namespace string) string {
+	if strings.Contains(name, ".") || namespace == "" {
+		return name
+	}
+	return namespace + "." + name
+}
+
+func (parser *schemaParser) reference(name string, namespace string) (*Schema, error) {
+	if primitiveTypes[name] {
+		return &Schema{Type: name}, nil
+	}
+	schema, ok := parser.named[fullName(name, namespace)]
+	if !ok {
+		schema, ok = parser.named[name]
+	}
+	if !ok {
+		return nil, errors.New("unknown type: " + name)
+	}
+	return schema, nil
+}
+
+func (parser *schemaParser) parse(v interface{}, namespace string) (*Schema, error) {
+	switch v := v.(type) {
+	case string:
+		return parser.reference(v, namespace)
+	case []interface{}:
+		schema := &Schema{Type: "union"}
+		for _, branch := range v {
+			branchSchema, err := parser.parse(branch, namespace)
+			if err != nil {
+				return nil, err
+			}
+			if branchSchema.Type == "union" {
+				return nil, errors.New("a union cannot hold a union")
+			}
+			schema.Branches = append(schema.Branches, branchSchema)
+		}
+		return schema, nil
+	case map[string]interface{}:
+		return parser.parseComplex(v, namespace)
+	}
+	return nil, errors.New(fmt.Sprintf("invalid schema: %v", v))
+}
+
+func (parser *schemaParser) define(schema *Schema, v map[string]interface{}, namespace string) (string, error) {
+	name, _ := v["name"].(string)
+	if name == "" {
+		return "", errors.New(fmt.Sprintf("%s requires a name", schema.Type))
+	}
+	if ns, ok := v["namespace"].(string); ok && !strings.Contains(name, ".") {
+		namespace = ns
+	}
+	schema.Name = fullName(name, namespace)
+	if i := strings.LastIndex(schema.Name, "."); i >= 0 {
+		namespace = schema.Name[:i]
+	}
+	if _, ok := parser.named[schema.Name]; ok {
+		return "", errors.New("redefined type: " + schema.Name)
+	}
+	parser.named[schema.Name] = schema
+	return namespace, nil
+}
+
+func (parser *schemaParser) parseComplex(v map[string]interface{}, namespace string) (*Schema, error) {
+	type_, ok := v["type"].(string)
+	if !ok {
+		// {"type": {"type": "array", ...}} and the like
+		return parser.parse(v["type"], namespace)
+	}
+	schema := &Schema{Type: type_}
+	var err error
+	switch type_ {
+	case "record", "error":
+		schema.Type = "record"
+		namespace, err = parser.define(schema, v, namespace)
+		if err != nil {
+			return nil, err
+		}
+		fields, ok := v["fields"].([]interface{})
+		if !ok {
+			return nil, errors.New(schema.Name + " requires fields")
+		}
+		for _, f := range fields {
+			f_, ok := f.(map[string]interface{})
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("%s: invalid field: %v", schema.Name, f))
+			}
+			field := &Field{}
+			field.Name, _ = f_["name"].(string)
+			if field.Name == "" {
+				return nil, errors.New(schema.Name + ": a field requires a name")
+			}
+			field.Schema, err = parser.parse(f_["type"], namespace)
+			if err != nil {
+				return nil, errors.New(fmt.Sprintf("%s.%s: %s", schema.Name, field.Name, err.Error()))
+			}
+			field.Default, field.HasDefault = f_["default"]
+			schema.Fields = append(schema.Fields, field)
+		}
+	case "enum":
+		_, err = parser.define(schema, v, namespace)
+		if err != nil {
+			return nil, err
+		}
+		symbols, ok := v["symbols"].([]interface{})
+		if !ok || len(symbols) == 0 {
+			return nil, errors.New(schema.Name + " requires symbols")
+		}
+		schema.symbols = make(map[string]int)
+		for i, symbol := range symbols {
+			s, ok := symbol.(string)
+			if !ok {
+				return nil, errors.New(fmt.Sprintf("%s: invalid symbol: %v", schema.Name, symbol))
+			}
+			schema.Symbols = append(schema.Symbols, s)
+			schema.symbols[s] = i
+		}
+	case "fixed":
+		_, err = parser.define(schema, v, namespace)
+		if err != nil {
+			return nil, err
+		}
+		size, ok := v["size"].(float64)
+		if !ok || size < 0 {
+			return nil, errors.New(schema.Name + " requires a size")
+		}
+		schema.Size = int(size)
+	case "array":
+		schema.Items, err = parser.parse(v["items"], namespace)
+	case "map":
+		schema.Items, err = parser.parse(v["values"], namespace)
+	default:
+		if !primitiveTypes[type_] {
+			// a reference to a named type, with attributes
+			return parser.reference(type_, namespace)
+		}
+		// logical types are encoded as the types they annotate
+		return &Schema{Type: type_}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// ParseSchema parses a schema in its JSON form.
+func ParseSchema(b []byte) (*Schema, error) {
+	var v interface{}
+	err := json.Unmarshal(b, &v)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to parse the schema: %s", err.Error()))
+	}
+	parser := &schemaParser{named: make(map[string]*Schema)}
+	return parser.parse(v, "")
+}
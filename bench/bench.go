@@ -0,0 +1,164 @@
+// Package bench has what the benchmarks of ik share: records made up in
+// bulk, a port timing the records on their way to it, and the loops that
+// drive journals.  It is imported by tests only.
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// SentAtKey is the field the generated records carry the time they were
+// made at in, in nanoseconds, for the Sink to tell how long they took.
+const SentAtKey = "_bench_sent_at"
+
+// the values are drawn from a fixed set, so that making them up does not
+// weigh on what is being measured
+const generatorValues = 64
+
+// Generator makes up records of the given number of fields, each holding a
+// string of ValueSize letters, under the tags in turn.
+type Generator struct {
+	Tags      []string
+	Fields    int
+	ValueSize int
+	keys      []string
+	values    []string
+	rand      *rand.Rand
+	next      int
+}
+
+func (generator *Generator) Record() ik.TinyFluentRecord {
+	data := make(map[string]interface{}, generator.Fields+1)
+	for _, key := range generator.keys {
+		data[key] = generator.values[generator.rand.Intn(len(generator.values))]
+	}
+	now := time.Now()
+	data[SentAtKey] = now.UnixNano()
+	return ik.TinyFluentRecord{Timestamp: uint64(now.Unix()), Data: data}
+}
+
+// RecordSets makes up n records, grouped by tag.
+func (generator *Generator) RecordSets(n int) []ik.FluentRecordSet {
+	recordSets := make([]ik.FluentRecordSet, len(generator.Tags))
+	for i, tag := range generator.Tags {
+		recordSets[i] = ik.FluentRecordSet{Tag: tag, Records: make([]ik.TinyFluentRecord, 0, n/len(generator.Tags)+1)}
+	}
+	for i := 0; i < n; i++ {
+		recordSet := &recordSets[generator.next]
+		recordSet.Records = append(recordSet.Records, generator.Record())
+		generator.next = (generator.next + 1) % len(recordSets)
+	}
+	retval := make([]ik.FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		if len(recordSet.Records) > 0 {
+			retval = append(retval, recordSet)
+		}
+	}
+	return retval
+}
+
+func NewGenerator(seed int64, tags []string, fields int, valueSize int) *Generator {
+	if len(tags) == 0 {
+		tags = []string{"bench"}
+	}
+	rand_ := rand.New(rand.NewSource(seed))
+	keys := make([]string, fields)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("field%d", i)
+	}
+	values := make([]string, generatorValues)
+	for i := range values {
+		value := make([]byte, valueSize)
+		for j := range value {
+			value[j] = byte('a' + rand_.Intn(26))
+		}
+		values[i] = string(value)
+	}
+	return &Generator{
+		Tags:      tags,
+		Fields:    fields,
+		ValueSize: valueSize,
+		keys:      keys,
+		values:    values,
+		rand:      rand_,
+	}
+}
+
+// Sink is a port that counts the records emitted at it and observes the
+// time each of them took since it was generated.
+type Sink struct {
+	Latencies *ik.LatencyWindow
+	count     int64
+	mtx       sync.Mutex
+	notify    chan struct{}
+}
+
+func sentAt(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int64:
+		return value, true
+	case uint64:
+		return int64(value), true
+	case float64:
+		return int64(value), true
+	}
+	return 0, false
+}
+
+func (sink *Sink) Emit(recordSets []ik.FluentRecordSet) error {
+	now := time.Now()
+	count := 0
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			sent, ok := sentAt(record.Data[SentAtKey])
+			if ok {
+				sink.Latencies.Observe(now.Sub(time.Unix(0, sent)))
+			}
+		}
+		count += len(recordSet.Records)
+	}
+	sink.mtx.Lock()
+	sink.count += int64(count)
+	sink.mtx.Unlock()
+	select {
+	case sink.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (sink *Sink) Count() int64 {
+	sink.mtx.Lock()
+	defer sink.mtx.Unlock()
+	return sink.count
+}
+
+// Wait waits until n records in all have been emitted at the sink.
+func (sink *Sink) Wait(n int64, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		count := sink.Count()
+		if count >= n {
+			return nil
+		}
+		select {
+		case <-sink.notify:
+		case <-timer.C:
+			return errors.New(fmt.Sprintf("%d of %d records arrived in %s", count, n, timeout.String()))
+		}
+	}
+}
+
+func NewSink() *Sink {
+	return &Sink{
+		// the window outlasts any benchmark so that nothing expires
+		Latencies: ik.NewLatencyWindow(24*time.Hour, 24, ik.SystemClock),
+		notify:    make(chan struct{}, 1),
+	}
+}
@@ -0,0 +1,65 @@
+package bench
+
+import (
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestGenerator(t *testing.T) {
+	generator := NewGenerator(0, []string{"a", "b"}, 3, 8)
+	recordSets := generator.RecordSets(5)
+	if len(recordSets) != 2 || recordSets[0].Tag != "a" || len(recordSets[0].Records) != 3 || len(recordSets[1].Records) != 2 {
+		t.Fatalf("%v", recordSets)
+	}
+	data := recordSets[0].Records[0].Data
+	if len(data) != 4 || len(data["field0"].(string)) != 8 {
+		t.Fatalf("%v", data)
+	}
+	// the tags go on in turn from where the last record sets left off
+	recordSets = generator.RecordSets(1)
+	if len(recordSets) != 1 || recordSets[0].Tag != "b" {
+		t.Fatalf("%v", recordSets)
+	}
+}
+
+func TestSink(t *testing.T) {
+	sink := NewSink()
+	generator := NewGenerator(0, nil, 1, 1)
+	if sink.Wait(1, 10*time.Millisecond) == nil {
+		t.Fail()
+	}
+	go sink.Emit(generator.RecordSets(2))
+	err := sink.Wait(2, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if sink.Latencies.Percentiles(50) == nil {
+		t.Fail()
+	}
+}
+
+func benchmarkJournalWrite(b *testing.B, maxSize int64, size int) {
+	dir, err := ioutil.TempDir("", "ik.bench")
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	group, err := NewJournalGroup(logging.MustGetLogger("ik"), dir, maxSize)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	defer group.Dispose()
+	RunJournalWrite(b, group.GetJournal("bench"), size)
+}
+
+func BenchmarkJournalWrite(b *testing.B) {
+	benchmarkJournalWrite(b, 1<<30, 256)
+}
+
+// a chunk is rolled over every 64 records
+func BenchmarkJournalWrite_RollOver(b *testing.B) {
+	benchmarkJournalWrite(b, 64*256, 256)
+}
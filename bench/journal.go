@@ -0,0 +1,61 @@
+package bench
+
+import (
+	"github.com/moriyoshi/ik"
+	jnl "github.com/moriyoshi/ik/journal"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+type benchPlugin struct{}
+
+func (*benchPlugin) Name() string                    { return "bench" }
+func (*benchPlugin) BindScorekeeper(*ik.Scorekeeper) {}
+
+type benchPluginInstance struct{}
+
+func (*benchPluginInstance) Run() error         { return nil }
+func (*benchPluginInstance) Shutdown() error    { return nil }
+func (*benchPluginInstance) Factory() ik.Plugin { return &benchPlugin{} }
+
+// NewJournalGroup creates a file journal group in dir whose chunks are
+// rolled over at maxSize bytes.
+func NewJournalGroup(logger ik.Logger, dir string, maxSize int64) (*jnl.FileJournalGroup, error) {
+	factory := jnl.NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		ik.SystemClock,
+		".log",
+		os.FileMode(0644),
+		maxSize,
+	)
+	return factory.GetJournalGroup(filepath.Join(dir, "bench.*.log"), &benchPluginInstance{})
+}
+
+// RunJournalWrite writes b.N records of size bytes to the journal, and
+// reports the chunks it made per record on top of the throughput.
+func RunJournalWrite(b *testing.B, journal ik.Journal, size int) {
+	chunks := int64(0)
+	journal.AddNewChunkListener(func(ik.JournalChunk) error {
+		atomic.AddInt64(&chunks, 1)
+		return nil
+	})
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte('a' + i%26)
+	}
+	data[size-1] = '\n'
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := journal.Write(data)
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(atomic.LoadInt64(&chunks))/float64(b.N), "chunks/op")
+}
@@ -0,0 +1,66 @@
+package ik
+
+import (
+	"time"
+)
+
+// Ticker is what Clock.NewTicker gives, the counterpart of time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer is what Clock.NewTimer gives, the counterpart of time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// Clock tells the time and makes the tickers and the timers the engine and
+// the plugins wait on, so that the tests can move it by hand rather than
+// sleep.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+type systemClock struct{}
+
+type systemTicker struct {
+	*time.Ticker
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+// SystemClock is the clock of the host, which the engine uses unless
+// another one is set.
+var SystemClock Clock = systemClock{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{time.NewTicker(d)}
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (ticker systemTicker) C() <-chan time.Time {
+	return ticker.Ticker.C
+}
+
+func (timer systemTimer) C() <-chan time.Time {
+	return timer.Timer.C
+}
+
+// After waits for d on the clock, as time.After does.
+func After(clock Clock, d time.Duration) <-chan time.Time {
+	return clock.NewTimer(d).C()
+}
@@ -2,6 +2,8 @@ package ik
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
@@ -9,6 +11,8 @@ import (
 	"net/url"
 	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -50,7 +54,7 @@ type DefaultOpener http.Dir
 var (
 	stripCommentRegexp = regexp.MustCompile("\\s*(?:#.*)?$")
 	startTagRegexp     = regexp.MustCompile("^<([a-zA-Z0-9_]+)\\s*(.+?)?>$")
-	attrRegExp         = regexp.MustCompile("^([a-zA-Z0-9_]+)\\s+(.*)$")
+	attrRegExp         = regexp.MustCompile("^(@?[a-zA-Z0-9_]+)\\s+(.*)$")
 )
 
 func (reader *DefaultLineReader) Next() (string, error) {
@@ -240,57 +244,321 @@ func ParseConfig(opener Opener, filename string) (*Config, error) {
 	return &Config{Root: makeConfigElementFromContext(context)}, nil
 }
 
+func (elem *ConfigElement) writeCanonical(out io.Writer) {
+	fmt.Fprintf(out, "<%q %q>\n", elem.Name, elem.Args)
+	names := make([]string, 0, len(elem.Attrs))
+	for name, _ := range elem.Attrs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "%q %q\n", name, elem.Attrs[name])
+	}
+	for _, child := range elem.Elems {
+		child.writeCanonical(out)
+	}
+	fmt.Fprintf(out, "</%q>\n", elem.Name)
+}
+
+// Digest returns the hex-encoded SHA-256 digest of the configuration, which
+// doesn't change with comments, indentation or the order of attributes.
+func (config *Config) Digest() string {
+	h := sha256.New()
+	config.Root.writeCanonical(h)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 type FluentConfigurer struct {
 	logger                Logger
 	router                *FluentRouter
 	inputFactoryRegistry  InputFactoryRegistry
 	outputFactoryRegistry OutputFactoryRegistry
+	filterFactoryRegistry FilterFactoryRegistry
 }
 
-func (configurer *FluentConfigurer) Configure(engine Engine, config *Config) error {
+// pluginInstanceId returns the @id attribute of an element, or its type
+// followed by its ordinal among the elements of the same type.
+func pluginInstanceId(config *ConfigElement, ordinal int) string {
+	id, ok := config.Attrs["@id"]
+	if ok {
+		return id
+	}
+	return config.Attrs["type"] + "#" + strconv.Itoa(ordinal)
+}
+
+// build instantiates the plugins described in the configuration and adds
+// the routes of the outputs to the router, without launching any of them.
+func (configurer *FluentConfigurer) build(engine Engine, config *Config, router *FluentRouter) ([]Input, []Output, error) {
+	inputs := make([]Input, 0)
+	outputs := make([]Output, 0)
+	provenance, err := ParseProvenance(config, engine.Clock())
+	if err != nil {
+		return inputs, outputs, err
+	}
+	recordIds, err := ParseRecordIds(config, engine.Clock())
+	if err != nil {
+		return inputs, outputs, err
+	}
+	tenants, err := ParseTenants(config)
+	if err != nil {
+		return inputs, outputs, err
+	}
+	// the buffered outputs tell the tenants of the records by those of the
+	// engine
+	engine.Tenants().replace(tenants)
+	// the labels are made first for the elements before them to refer to
+	for _, v := range config.Root.Elems {
+		if v.Name != "label" {
+			continue
+		}
+		if v.Args == "" {
+			return inputs, outputs, errors.New("<label> requires a name")
+		}
+		if router.LookupLabel(v.Args) != nil {
+			return inputs, outputs, errors.New("duplicate label: " + v.Args)
+		}
+		router.Label(v.Args)
+	}
+	ordinals := make(map[string]int)
 	for _, v := range config.Root.Elems {
 		switch v.Name {
 		case "source":
 			type_ := v.Attrs["type"]
 			inputFactory := configurer.inputFactoryRegistry.LookupInputFactory(type_)
 			if inputFactory == nil {
-				return errors.New("Could not find input factory: " + type_)
+				return inputs, outputs, errors.New("Could not find input factory: " + type_)
 			}
-			input, err := inputFactory.New(engine, v)
+			injection, err := ParseInjection(v)
 			if err != nil {
-				return err
+				return inputs, outputs, err
 			}
-			err = engine.Launch(input)
+			label, err := resolveLabel(router, v)
 			if err != nil {
-				return err
+				return inputs, outputs, err
 			}
-			configurer.logger.Info("Input plugin loaded: %s", inputFactory.Name())
-		case "match":
-			type_ := v.Attrs["type"]
-			outputFactory := configurer.outputFactoryRegistry.LookupOutputFactory(type_)
-			if outputFactory == nil {
-				return errors.New("Could not find output factory: " + type_)
+			inputEngine := engine
+			if label != nil {
+				inputEngine = labelEngine(inputEngine, label)
+			}
+			tenant, ok := v.Attrs["@tenant"]
+			if ok {
+				if tenants == nil {
+					return inputs, outputs, errors.New("@tenant requires <tenants>")
+				}
+				if !tenantNamePattern.MatchString(tenant) {
+					return inputs, outputs, errors.New("invalid tenant name: " + tenant)
+				}
+				inputEngine = engine.Tenants().wrapEngine(inputEngine, tenant)
+			}
+			if injection != nil {
+				inputEngine = injection.wrapEngine(inputEngine)
+			}
+			if provenance != nil {
+				inputEngine = provenance.wrapEngine(inputEngine, pluginInstanceId(v, ordinals[type_]))
 			}
-			output, err := outputFactory.New(engine, v)
+			// the trace id is stamped after the record id, which it would
+			// otherwise change if hashed
+			if engine.Tracer().Enabled() {
+				inputEngine = engine.Tracer().wrapEngine(inputEngine, pluginInstanceId(v, ordinals[type_]))
+			}
+			if recordIds != nil {
+				inputEngine = recordIds.wrapEngine(inputEngine)
+			}
+			ordinals[type_] += 1
+			input, err := inputFactory.New(inputEngine, v)
 			if err != nil {
-				return err
+				return inputs, outputs, err
 			}
-			configurer.router.AddRule(v.Args, output)
-			err = engine.Launch(output)
+			inputs = append(inputs, input)
+			configurer.logger.Info("Input plugin loaded: %s", inputFactory.Name())
+		case "match", "filter":
+			outputs_, err := configurer.buildRoute(engine, v, router)
+			outputs = append(outputs, outputs_...)
 			if err != nil {
-				return err
+				return inputs, outputs, err
+			}
+		case "label":
+			label := router.LookupLabel(v.Args)
+			for _, w := range v.Elems {
+				if w.Name != "match" && w.Name != "filter" {
+					return inputs, outputs, errors.New(fmt.Sprintf("unexpected <%s> in <label %s>", w.Name, v.Args))
+				}
+				outputs_, err := configurer.buildRoute(engine, w, label)
+				outputs = append(outputs, outputs_...)
+				for _, output := range outputs_ {
+					label.addMember(output)
+				}
+				if err != nil {
+					return inputs, outputs, err
+				}
 			}
-			configurer.logger.Info("Output plugin loaded: %s, with Args '%s'", outputFactory.Name(), v.Args)
 		}
 	}
-	return nil
+	return inputs, outputs, nil
+}
+
+// buildRoute builds the output of a <match> element or the filter of a
+// <filter> element, and adds its route to the router, which may be a label.
+// A <match> having a @label is built to emit at that label.
+func (configurer *FluentConfigurer) buildRoute(engine Engine, v *ConfigElement, router *FluentRouter) ([]Output, error) {
+	outputs := make([]Output, 0)
+	switch v.Name {
+	case "match":
+		label, err := resolveLabel(router, v)
+		if err != nil {
+			return outputs, err
+		}
+		if label != nil {
+			engine = labelEngine(engine, label)
+		}
+		outputs_, err := configurer.buildOutput(engine, v)
+		outputs = append(outputs, outputs_...)
+		if err != nil {
+			return outputs, err
+		}
+		err = router.AddRule(v.Args, outputs_[len(outputs_)-1])
+		if err != nil {
+			return outputs, err
+		}
+		configurer.logger.Info("Output plugin loaded: %s, with Args '%s'", v.Attrs["type"], v.Args)
+	case "filter":
+		type_ := v.Attrs["type"]
+		var filterFactory FilterFactory
+		if configurer.filterFactoryRegistry != nil {
+			filterFactory = configurer.filterFactoryRegistry.LookupFilterFactory(type_)
+		}
+		if filterFactory == nil {
+			return outputs, errors.New("Could not find filter factory: " + type_)
+		}
+		workers, err := ParseWorkers(v)
+		if err != nil {
+			return outputs, err
+		}
+		filter, err := router.AddFilter(v.Args, func(next Port) (Filter, error) {
+			if workers == 1 {
+				return filterFactory.New(engine, v, next)
+			}
+			filters, workers_, err := buildWorkers(engine.Logger(), v, workers, func(config *ConfigElement) ([]Output, error) {
+				filter, err := filterFactory.New(engine, config, next)
+				if err != nil {
+					return nil, err
+				}
+				return []Output{filter}, nil
+			})
+			outputs = append(outputs, filters...)
+			if err != nil {
+				return nil, err
+			}
+			return workers_, nil
+		})
+		if err != nil {
+			return outputs, err
+		}
+		// a filter is launched and terminated along with the outputs
+		outputs = append(outputs, filter)
+		configurer.logger.Info("Filter plugin loaded: %s, with Args '%s'", type_, v.Args)
+	}
+	return outputs, nil
+}
+
+// resolveLabel returns the label named by the @label attribute of an
+// element, or nil if it has none.  The labels are those of the router the
+// label the element is in belongs to.
+func resolveLabel(router *FluentRouter, config *ConfigElement) (*FluentRouter, error) {
+	name, ok := config.Attrs["@label"]
+	if !ok {
+		return nil, nil
+	}
+	label := router.root().LookupLabel(name)
+	if label == nil {
+		return nil, errors.New("unknown label: " + name)
+	}
+	return label, nil
+}
+
+// buildOutput builds the output described by a <match> or <store> element.
+// The output itself comes last in the returned slice, after the outputs it
+// emits at.
+func (configurer *FluentConfigurer) buildOutput(engine Engine, config *ConfigElement) ([]Output, error) {
+	workers, err := ParseWorkers(config)
+	if err != nil {
+		return nil, err
+	}
+	if workers > 1 {
+		outputs, output, err := buildWorkers(engine.Logger(), config, workers, func(config *ConfigElement) ([]Output, error) {
+			return configurer.buildOutput(engine, config)
+		})
+		if err != nil {
+			return outputs, err
+		}
+		return append(outputs, output), nil
+	}
+	type_ := config.Attrs["type"]
+	if type_ == CopyPlugin.Name() {
+		outputs, output, err := buildCopyOutput(engine.Logger(), config, func(config *ConfigElement) ([]Output, error) {
+			return configurer.buildOutput(engine, config)
+		})
+		if err != nil {
+			return outputs, err
+		}
+		return append(outputs, output), nil
+	}
+	if type_ == RoundRobinPlugin.Name() {
+		outputs, output, err := buildRoundRobinOutput(config, func(config *ConfigElement) ([]Output, error) {
+			return configurer.buildOutput(engine, config)
+		})
+		if err != nil {
+			return outputs, err
+		}
+		return append(outputs, output), nil
+	}
+	outputFactory := configurer.outputFactoryRegistry.LookupOutputFactory(type_)
+	if outputFactory == nil {
+		return nil, errors.New("Could not find output factory: " + type_)
+	}
+	output, err := outputFactory.New(engine, config)
+	if err != nil {
+		return nil, err
+	}
+	return []Output{output}, nil
+}
+
+// launch launches the outputs before the inputs so that no input emits a
+// record at an output that is not running yet.
+func (configurer *FluentConfigurer) launch(engine Engine, inputs []Input, outputs []Output) ([]PluginInstance, error) {
+	launched := make([]PluginInstance, 0, len(inputs)+len(outputs))
+	for _, output := range outputs {
+		err := engine.Launch(output)
+		if err != nil {
+			return launched, err
+		}
+		launched = append(launched, output)
+	}
+	for _, input := range inputs {
+		err := engine.Launch(input)
+		if err != nil {
+			return launched, err
+		}
+		launched = append(launched, input)
+	}
+	return launched, nil
+}
+
+func (configurer *FluentConfigurer) Configure(engine Engine, config *Config) error {
+	inputs, outputs, err := configurer.build(engine, config, configurer.router)
+	if err != nil {
+		return err
+	}
+	_, err = configurer.launch(engine, inputs, outputs)
+	return err
 }
 
-func NewFluentConfigurer(logger Logger, inputFactoryRegistry InputFactoryRegistry, outputFactoryRegistry OutputFactoryRegistry, router *FluentRouter) *FluentConfigurer {
+func NewFluentConfigurer(logger Logger, inputFactoryRegistry InputFactoryRegistry, outputFactoryRegistry OutputFactoryRegistry, filterFactoryRegistry FilterFactoryRegistry, router *FluentRouter) *FluentConfigurer {
 	return &FluentConfigurer{
 		logger:                logger,
 		router:                router,
 		inputFactoryRegistry:  inputFactoryRegistry,
 		outputFactoryRegistry: outputFactoryRegistry,
+		filterFactoryRegistry: filterFactoryRegistry,
 	}
 }
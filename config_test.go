@@ -56,4 +56,20 @@ func TestParseConfig(t *testing.T) {
 	}
 }
 
+func TestConfig_Digest(t *testing.T) {
+	a := &Config{Root: &ConfigElement{Name: "(root)", Elems: []*ConfigElement{
+		{Name: "match", Args: "**", Attrs: map[string]string{"type": "stdout", "flush_interval": "1s"}},
+	}}}
+	b := &Config{Root: &ConfigElement{Name: "(root)", Elems: []*ConfigElement{
+		{Name: "match", Args: "**", Attrs: map[string]string{"flush_interval": "1s", "type": "stdout"}},
+	}}}
+	if a.Digest() != b.Digest() {
+		t.Fail()
+	}
+	b.Root.Elems[0].Args = "*"
+	if a.Digest() == b.Digest() {
+		t.Fail()
+	}
+}
+
 // vim: sts=4 sw=4 ts=4 noet
@@ -0,0 +1,202 @@
+// Package conformance runs parsers and packers against golden files, so
+// that an implementation can show it behaves like its fluentd counterpart.
+//
+// A golden file is a JSON array of cases.  Running the tests with -update
+// rewrites the expected results in the golden files with the actual ones.
+package conformance
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files with the actual results")
+
+// Record is a record in a golden file.  When Time is omitted from an
+// expected record, the time of the actual record is not looked at.
+type Record struct {
+	Tag    string                 `json:"tag,omitempty"`
+	Time   *uint64                `json:"time,omitempty"`
+	Record map[string]interface{} `json:"record"`
+}
+
+// ParserCase feeds each line of Input to a parser built with Config.
+type ParserCase struct {
+	Name     string            `json:"name"`
+	Config   map[string]string `json:"config"`
+	Input    string            `json:"input"`
+	Expected []Record          `json:"expected"`
+}
+
+// PackerCase packs Input with a packer built with Config.  The expected
+// bytes are given as text in Expected, or in hex in ExpectedHex if they
+// are not valid UTF-8.
+type PackerCase struct {
+	Name        string            `json:"name"`
+	Config      map[string]string `json:"config"`
+	Input       Record            `json:"input"`
+	Expected    string            `json:"expected,omitempty"`
+	ExpectedHex string            `json:"expected_hex,omitempty"`
+}
+
+func readGoldenFile(t *testing.T, goldenFile string, cases interface{}) {
+	b, err := ioutil.ReadFile(goldenFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = json.Unmarshal(b, cases)
+	if err != nil {
+		t.Fatalf("%s: %s", goldenFile, err.Error())
+	}
+}
+
+func writeGoldenFile(t *testing.T, goldenFile string, cases interface{}) {
+	b := &bytes.Buffer{}
+	encoder := json.NewEncoder(b)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(cases)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = ioutil.WriteFile(goldenFile, b.Bytes(), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func newConfigElement(name string, attrs map[string]string) *ik.ConfigElement {
+	if attrs == nil {
+		attrs = make(map[string]string)
+	}
+	return &ik.ConfigElement{Name: name, Attrs: attrs, Elems: []*ik.ConfigElement{}}
+}
+
+// normalize makes a record comparable with one read from JSON.
+func normalize(data map[string]interface{}) interface{} {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return data
+	}
+	var retval interface{}
+	json.Unmarshal(b, &retval)
+	return retval
+}
+
+func equalRecords(expected Record, actual Record) bool {
+	if expected.Tag != actual.Tag {
+		return false
+	}
+	if expected.Time != nil && *expected.Time != *actual.Time {
+		return false
+	}
+	return reflect.DeepEqual(normalize(expected.Record), normalize(actual.Record))
+}
+
+// RunParserSuite runs the cases in the golden file against the parsers
+// built by the given factory.
+func RunParserSuite(t *testing.T, engine ik.Engine, factoryFactory ik.LineParserFactoryFactory, goldenFile string) {
+	cases := make([]ParserCase, 0)
+	readGoldenFile(t, goldenFile, &cases)
+	for i, case_ := range cases {
+		factory, err := factoryFactory(engine, newConfigElement("source", case_.Config))
+		if err != nil {
+			t.Errorf("%s: %s", case_.Name, err.Error())
+			continue
+		}
+		actual := make([]Record, 0)
+		parser, err := factory.New(func(record ik.FluentRecord) error {
+			timestamp := record.Timestamp
+			actual = append(actual, Record{Tag: record.Tag, Time: &timestamp, Record: record.Data})
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: %s", case_.Name, err.Error())
+			continue
+		}
+		for _, line := range strings.Split(strings.TrimSuffix(case_.Input, "\n"), "\n") {
+			err := parser.Feed(line)
+			if err != nil {
+				t.Errorf("%s: %s", case_.Name, err.Error())
+			}
+		}
+		if *update {
+			// keep the times only where the golden file had them
+			for j, _ := range actual {
+				if j >= len(case_.Expected) || case_.Expected[j].Time == nil {
+					actual[j].Time = nil
+				}
+			}
+			cases[i].Expected = actual
+			continue
+		}
+		if len(actual) != len(case_.Expected) {
+			t.Errorf("%s: expected %d records, got %d", case_.Name, len(case_.Expected), len(actual))
+			continue
+		}
+		for j, record := range actual {
+			if !equalRecords(case_.Expected[j], record) {
+				expected, _ := json.Marshal(case_.Expected[j])
+				actual_, _ := json.Marshal(record)
+				t.Errorf("%s: record #%d: expected %s, got %s", case_.Name, j+1, string(expected), string(actual_))
+			}
+		}
+	}
+	if *update {
+		writeGoldenFile(t, goldenFile, cases)
+	}
+}
+
+// RunPackerSuite runs the cases in the golden file against the packers
+// returned by newPacker.
+func RunPackerSuite(t *testing.T, newPacker func(config *ik.ConfigElement) (ik.RecordPacker, error), goldenFile string) {
+	cases := make([]PackerCase, 0)
+	readGoldenFile(t, goldenFile, &cases)
+	for i, case_ := range cases {
+		packer, err := newPacker(newConfigElement("match", case_.Config))
+		if err != nil {
+			t.Errorf("%s: %s", case_.Name, err.Error())
+			continue
+		}
+		timestamp := uint64(0)
+		if case_.Input.Time != nil {
+			timestamp = *case_.Input.Time
+		}
+		actual, err := packer.Pack(ik.FluentRecord{Tag: case_.Input.Tag, Timestamp: timestamp, Data: case_.Input.Record})
+		if err != nil {
+			t.Errorf("%s: %s", case_.Name, err.Error())
+			continue
+		}
+		if *update {
+			cases[i].Expected, cases[i].ExpectedHex = "", ""
+			if utf8.Valid(actual) {
+				cases[i].Expected = string(actual)
+			} else {
+				cases[i].ExpectedHex = hex.EncodeToString(actual)
+			}
+			continue
+		}
+		expected := []byte(case_.Expected)
+		if case_.ExpectedHex != "" {
+			expected, err = hex.DecodeString(case_.ExpectedHex)
+			if err != nil {
+				t.Errorf("%s: %s", case_.Name, err.Error())
+				continue
+			}
+		}
+		if string(actual) != string(expected) {
+			t.Errorf("%s: expected %q, got %q", case_.Name, string(expected), string(actual))
+		}
+	}
+	if *update {
+		writeGoldenFile(t, goldenFile, cases)
+	}
+}
@@ -0,0 +1,169 @@
+package ik
+
+import (
+	"errors"
+	"strconv"
+)
+
+type copyPlugin struct{}
+
+func (*copyPlugin) Name() string                 { return "copy" }
+func (*copyPlugin) BindScorekeeper(*Scorekeeper) {}
+
+// CopyPlugin is the factory of the outputs built from <match> elements of
+// type copy.  Those are built by the configurer itself, as they need the
+// output factory registry to build the outputs in their <store> elements.
+var CopyPlugin Plugin = &copyPlugin{}
+
+const (
+	CopyModeNoCopy  = "no_copy"
+	CopyModeShallow = "shallow"
+	CopyModeDeep    = "deep"
+)
+
+type copyStore struct {
+	output      Output
+	ignoreError bool
+}
+
+// CopyOutput emits every record set at each of its stores in turn.
+type CopyOutput struct {
+	logger Logger
+	stores []copyStore
+	mode   string
+	cancel chan bool
+}
+
+func copyValue(value interface{}) interface{} {
+	switch value_ := value.(type) {
+	case map[string]interface{}:
+		retval := make(map[string]interface{}, len(value_))
+		for k, v := range value_ {
+			retval[k] = copyValue(v)
+		}
+		return retval
+	case []interface{}:
+		retval := make([]interface{}, len(value_))
+		for i, v := range value_ {
+			retval[i] = copyValue(v)
+		}
+		return retval
+	case []byte:
+		return append([]byte(nil), value_...)
+	}
+	return value
+}
+
+func (output *CopyOutput) copyRecordSets(recordSets []FluentRecordSet) []FluentRecordSet {
+	retval := make([]FluentRecordSet, len(recordSets))
+	for i, recordSet := range recordSets {
+		records := make([]TinyFluentRecord, len(recordSet.Records))
+		for j, record := range recordSet.Records {
+			data := record.Data
+			if output.mode == CopyModeDeep {
+				data = copyValue(data).(map[string]interface{})
+			} else if data != nil {
+				data = make(map[string]interface{}, len(record.Data))
+				for k, v := range record.Data {
+					data[k] = v
+				}
+			}
+			records[j] = TinyFluentRecord{Timestamp: record.Timestamp, Data: data}
+		}
+		retval[i] = FluentRecordSet{Tag: recordSet.Tag, Records: records}
+	}
+	return retval
+}
+
+// emit stops at the first store failing unless the store is marked with
+// ignore_error, in which case the error is logged and the rest of the
+// stores are emitted at regardless.  Every store but the last one is given
+// its own copy of the records unless copy_mode is no_copy.
+func (output *CopyOutput) emit(recordSets []FluentRecordSet, emit func(Port, []FluentRecordSet) error) error {
+	for i, store := range output.stores {
+		recordSets_ := recordSets
+		if output.mode != CopyModeNoCopy && i < len(output.stores)-1 {
+			recordSets_ = output.copyRecordSets(recordSets)
+		}
+		err := emit(store.output, recordSets_)
+		if err != nil {
+			if !store.ignoreError {
+				return err
+			}
+			output.logger.Error("store #%d of copy failed: %s", i+1, err.Error())
+		}
+	}
+	return nil
+}
+
+func (output *CopyOutput) Emit(recordSets []FluentRecordSet) error {
+	return output.emit(recordSets, func(port Port, recordSets []FluentRecordSet) error {
+		return port.Emit(recordSets)
+	})
+}
+
+func (output *CopyOutput) EmitDurably(recordSets []FluentRecordSet) error {
+	return output.emit(recordSets, EmitDurably)
+}
+
+func (output *CopyOutput) Factory() Plugin {
+	return CopyPlugin
+}
+
+func (output *CopyOutput) Run() error {
+	<-output.cancel
+	return nil
+}
+
+func (output *CopyOutput) Shutdown() error {
+	output.cancel <- true
+	return nil
+}
+
+func (output *CopyOutput) Dispose() {
+	output.Shutdown()
+}
+
+// buildCopyOutput builds the outputs in the <store> elements with the given
+// function, and returns them along with the copy output emitting at them.
+func buildCopyOutput(logger Logger, config *ConfigElement, build func(*ConfigElement) ([]Output, error)) ([]Output, *CopyOutput, error) {
+	mode, ok := config.Attrs["copy_mode"]
+	if !ok {
+		mode = CopyModeNoCopy
+	}
+	if mode != CopyModeNoCopy && mode != CopyModeShallow && mode != CopyModeDeep {
+		return nil, nil, errors.New("unsupported copy_mode: " + mode)
+	}
+	outputs := make([]Output, 0)
+	stores := make([]copyStore, 0)
+	for _, v := range config.Elems {
+		if v.Name != "store" {
+			continue
+		}
+		ignoreError := false
+		ignoreErrorStr, ok := v.Attrs["ignore_error"]
+		if ok {
+			var err error
+			ignoreError, err = strconv.ParseBool(ignoreErrorStr)
+			if err != nil {
+				return outputs, nil, err
+			}
+		}
+		outputs_, err := build(v)
+		outputs = append(outputs, outputs_...)
+		if err != nil {
+			return outputs, nil, err
+		}
+		// the last one built is the store itself
+		stores = append(stores, copyStore{outputs_[len(outputs_)-1], ignoreError})
+	}
+	if len(stores) == 0 {
+		return outputs, nil, errors.New("copy requires at least one <store>")
+	}
+	return outputs, &CopyOutput{
+		logger: logger,
+		stores: stores,
+		mode:   mode,
+		cancel: make(chan bool, 1),
+	}, nil
+}
@@ -0,0 +1,69 @@
+package ik
+
+import (
+	"errors"
+	"github.com/op/go-logging"
+	"testing"
+)
+
+type copyTestOutput struct {
+	recordSets []FluentRecordSet
+	err        error
+}
+
+func (output *copyTestOutput) Emit(recordSets []FluentRecordSet) error {
+	if output.err != nil {
+		return output.err
+	}
+	output.recordSets = append(output.recordSets, recordSets...)
+	return nil
+}
+
+func (output *copyTestOutput) Factory() Plugin { return nil }
+func (output *copyTestOutput) Run() error      { return nil }
+func (output *copyTestOutput) Shutdown() error { return nil }
+func (output *copyTestOutput) Dispose()        {}
+
+func newCopyTestOutput(t *testing.T, attrs map[string]string, stores []*copyTestOutput, ignoreErrors []string) ([]Output, *CopyOutput) {
+	config := &ConfigElement{Name: "match", Attrs: attrs, Elems: []*ConfigElement{}}
+	for i, _ := range stores {
+		config.Elems = append(config.Elems, &ConfigElement{Name: "store", Attrs: map[string]string{"ignore_error": ignoreErrors[i]}})
+	}
+	i := 0
+	outputs, output, err := buildCopyOutput(logging.MustGetLogger("ik"), config, func(*ConfigElement) ([]Output, error) {
+		i += 1
+		return []Output{stores[i-1]}, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return outputs, output
+}
+
+func TestCopyOutput_Emit(t *testing.T) {
+	stores := []*copyTestOutput{{}, {err: errors.New("failure")}, {}}
+	outputs, output := newCopyTestOutput(t, map[string]string{"copy_mode": "deep"}, stores, []string{"false", "true", "false"})
+	if len(outputs) != 3 {
+		t.Fail()
+	}
+	data := map[string]interface{}{"a": map[string]interface{}{"b": 1}}
+	err := output.Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 1, Data: data}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(stores[0].recordSets) != 1 || len(stores[2].recordSets) != 1 {
+		t.FailNow()
+	}
+	// only the last store shares the records with the caller
+	stores[0].recordSets[0].Records[0].Data["a"].(map[string]interface{})["b"] = 2
+	if data["a"].(map[string]interface{})["b"] != 1 || stores[2].recordSets[0].Records[0].Data["a"].(map[string]interface{})["b"] != 1 {
+		t.Fail()
+	}
+
+	stores = []*copyTestOutput{{err: errors.New("failure")}, {}}
+	_, output = newCopyTestOutput(t, map[string]string{}, stores, []string{"false", "false"})
+	err = output.Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 1, Data: data}}}})
+	if err == nil || len(stores[1].recordSets) != 0 {
+		t.Fail()
+	}
+}
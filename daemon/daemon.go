@@ -0,0 +1,136 @@
+// Package daemon provides what running ik as a service takes: handling the
+// signals that stop, reload and inspect it, a PID file, and a log file that
+// can be reopened once it has been rotated.
+package daemon
+
+import (
+	"github.com/moriyoshi/ik"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+)
+
+type action int
+
+const (
+	actionShutdown action = iota
+	actionReload
+	actionReopenLogs
+	actionDumpStats
+)
+
+// Handlers are what the signals are turned into.  Any of them may be nil,
+// in which case the signal is only logged.
+//
+//	SIGTERM, SIGINT  Shutdown
+//	SIGHUP           Reload
+//	SIGUSR1          ReopenLogs
+//	SIGUSR2          DumpStats
+//
+// Only SIGTERM and SIGINT are handled on Windows.
+type Handlers struct {
+	Shutdown   func() error
+	Reload     func() error
+	ReopenLogs func() error
+	DumpStats  func() error
+}
+
+// Signals is a Spawnee that receives the signals for as long as it is
+// spawned.  Shutdown is run in a goroutine of its own, since disposing the
+// engine kills this spawnee as well.
+type Signals struct {
+	logger   ik.Logger
+	handlers Handlers
+	signals  chan os.Signal
+	cancel   chan bool
+}
+
+func (signals *Signals) handle(sig os.Signal) {
+	action, ok := signalActions[sig]
+	if !ok {
+		return
+	}
+	var handler func() error
+	switch action {
+	case actionShutdown:
+		handler = signals.handlers.Shutdown
+	case actionReload:
+		handler = signals.handlers.Reload
+	case actionReopenLogs:
+		handler = signals.handlers.ReopenLogs
+	case actionDumpStats:
+		handler = signals.handlers.DumpStats
+	}
+	signals.logger.Notice("received %s", sig.String())
+	if handler == nil {
+		return
+	}
+	run := func() {
+		err := handler()
+		if err != nil {
+			signals.logger.Error("%s: %s", sig.String(), err.Error())
+		}
+	}
+	if action == actionShutdown {
+		go run()
+	} else {
+		run()
+	}
+}
+
+func (signals *Signals) Run() error {
+	select {
+	case <-signals.cancel:
+		return nil
+	case sig := <-signals.signals:
+		signals.handle(sig)
+	}
+	return ik.Continue
+}
+
+func (signals *Signals) Shutdown() error {
+	signal.Stop(signals.signals)
+	signals.cancel <- true
+	return nil
+}
+
+// NewSignals starts receiving the signals, which are then queued until the
+// returned Spawnee is spawned.
+func NewSignals(logger ik.Logger, handlers Handlers) *Signals {
+	signals := &Signals{
+		logger:   logger,
+		handlers: handlers,
+		signals:  make(chan os.Signal, 4),
+		cancel:   make(chan bool, 1),
+	}
+	notified := make([]os.Signal, 0, len(signalActions))
+	for sig := range signalActions {
+		notified = append(notified, sig)
+	}
+	signal.Notify(signals.signals, notified...)
+	return signals
+}
+
+// DumpStats logs the topics of the engine and of each plugin instance, such
+// as how much the outputs hold in their buffers.
+func DumpStats(engine ik.Engine) {
+	logger := engine.Logger()
+	scorekeeper := engine.Scorekeeper()
+	dump := func(name string, plugin ik.Plugin, pluginInstance ik.PluginInstance) {
+		values := make([]string, 0)
+		for _, topic := range scorekeeper.GetTopics(plugin) {
+			value, err := topic.Fetcher.PlainText(pluginInstance)
+			if err != nil {
+				continue
+			}
+			values = append(values, topic.Name+"="+value)
+		}
+		sort.Strings(values)
+		logger.Notice("stats: %s: %s", name, strings.Join(values, ", "))
+	}
+	dump("engine", ik.EnginePlugin, nil)
+	for _, pluginInstance := range engine.PluginInstances() {
+		dump(pluginInstance.Factory().Name(), pluginInstance.Factory(), pluginInstance)
+	}
+}
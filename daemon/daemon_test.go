@@ -0,0 +1,117 @@
+package daemon
+
+import (
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignals_handle(t *testing.T) {
+	called := make(chan action, 1)
+	handler := func(action_ action) func() error {
+		return func() error {
+			called <- action_
+			return nil
+		}
+	}
+	signals := &Signals{
+		logger: logging.MustGetLogger("ik"),
+		handlers: Handlers{
+			Shutdown:   handler(actionShutdown),
+			Reload:     handler(actionReload),
+			ReopenLogs: handler(actionReopenLogs),
+			DumpStats:  handler(actionDumpStats),
+		},
+	}
+	for sig, expected := range signalActions {
+		signals.handle(sig)
+		select {
+		case action_ := <-called:
+			if action_ != expected {
+				t.Logf("%s: expected %d, got %d", sig.String(), expected, action_)
+				t.Fail()
+			}
+		case <-time.After(time.Second):
+			t.Logf("%s: not handled", sig.String())
+			t.Fail()
+		}
+	}
+	// a missing handler leaves the signal logged only
+	signals.handlers = Handlers{}
+	for sig := range signalActions {
+		signals.handle(sig)
+	}
+}
+
+func TestCreatePidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ik-daemon")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path_ := path.Join(dir, "ik.pid")
+	err = ioutil.WriteFile(path_, []byte("123456789\n"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	pidFile, err := CreatePidFile(path_)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	content, _ := ioutil.ReadFile(path_)
+	if strings.TrimSpace(string(content)) != strconv.Itoa(os.Getpid()) {
+		t.Logf("%q", content)
+		t.Fail()
+	}
+	if runtime.GOOS != "windows" {
+		_, err = CreatePidFile(path_)
+		if err == nil {
+			t.Log("the locked PID file was taken over")
+			t.Fail()
+		}
+	}
+	err = pidFile.Remove()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := os.Stat(path_); !os.IsNotExist(err) {
+		t.Fail()
+	}
+}
+
+func TestLogFile_Reopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ik-daemon")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path_ := path.Join(dir, "ik.log")
+	logFile, err := OpenLogFile(path_)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer logFile.Close()
+	logFile.Write([]byte("a\n"))
+	err = os.Rename(path_, path_+".1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	logFile.Write([]byte("b\n"))
+	err = logFile.Reopen()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	logFile.Write([]byte("c\n"))
+	rotated, _ := ioutil.ReadFile(path_ + ".1")
+	current, _ := ioutil.ReadFile(path_)
+	if string(rotated) != "a\nb\n" || string(current) != "c\n" {
+		t.Logf("%q, %q", rotated, current)
+		t.Fail()
+	}
+}
@@ -0,0 +1,46 @@
+package daemon
+
+import (
+	"os"
+	"sync"
+)
+
+// LogFile is a Writer appending to the file at a path, which Reopen opens
+// again, after logrotate or the like has moved the file away.
+type LogFile struct {
+	path string
+	file *os.File
+	mtx  sync.Mutex
+}
+
+func (logFile *LogFile) Write(p []byte) (int, error) {
+	logFile.mtx.Lock()
+	defer logFile.mtx.Unlock()
+	return logFile.file.Write(p)
+}
+
+func (logFile *LogFile) Reopen() error {
+	file, err := os.OpenFile(logFile.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	logFile.mtx.Lock()
+	defer logFile.mtx.Unlock()
+	logFile.file.Close()
+	logFile.file = file
+	return nil
+}
+
+func (logFile *LogFile) Close() error {
+	logFile.mtx.Lock()
+	defer logFile.mtx.Unlock()
+	return logFile.file.Close()
+}
+
+func OpenLogFile(path string) (*LogFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &LogFile{path: path, file: file}, nil
+}
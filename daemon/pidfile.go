@@ -0,0 +1,51 @@
+package daemon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// PidFile holds the PID file locked for as long as the process runs, so
+// that a second ik given the same file refuses to start.
+type PidFile struct {
+	path string
+	file *os.File
+}
+
+func (pidFile *PidFile) Path() string {
+	return pidFile.path
+}
+
+// Remove unlinks the PID file and releases the lock.
+func (pidFile *PidFile) Remove() error {
+	return removePidFile(pidFile.file, pidFile.path)
+}
+
+// CreatePidFile writes the PID of the process to path and locks it.  A file
+// left behind by a process that is gone is taken over, as its lock went
+// with the process.
+func CreatePidFile(path string) (*PidFile, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	err = lockPidFile(file)
+	if err != nil {
+		file.Close()
+		return nil, errors.New(fmt.Sprintf("%s is held by another process: %s", path, err.Error()))
+	}
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &PidFile{path, file}, nil
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockPidFile(file *os.File) error {
+	return syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+// removePidFile unlinks the file before it lets go of the lock, lest
+// another process locks the file that is about to be unlinked.
+func removePidFile(file *os.File, path string) error {
+	err := os.Remove(path)
+	file.Close()
+	return err
+}
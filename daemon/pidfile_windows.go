@@ -0,0 +1,19 @@
+//go:build windows
+// +build windows
+
+package daemon
+
+import (
+	"os"
+)
+
+// The PID file is not locked on Windows.
+func lockPidFile(file *os.File) error {
+	return nil
+}
+
+// removePidFile closes the file first, as an open file cannot be removed.
+func removePidFile(file *os.File, path string) error {
+	file.Close()
+	return os.Remove(path)
+}
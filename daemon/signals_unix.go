@@ -0,0 +1,17 @@
+//go:build !windows
+// +build !windows
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+var signalActions = map[os.Signal]action{
+	syscall.SIGTERM: actionShutdown,
+	syscall.SIGINT:  actionShutdown,
+	syscall.SIGHUP:  actionReload,
+	syscall.SIGUSR1: actionReopenLogs,
+	syscall.SIGUSR2: actionDumpStats,
+}
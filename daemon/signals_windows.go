@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package daemon
+
+import (
+	"os"
+	"syscall"
+)
+
+var signalActions = map[os.Signal]action{
+	syscall.SIGTERM: actionShutdown,
+	os.Interrupt:    actionShutdown,
+}
@@ -0,0 +1,136 @@
+package ik
+
+import (
+	"strconv"
+	"sync/atomic"
+)
+
+type deadLetterCountFetcher struct {
+	engine *engineImpl
+}
+
+func (fetcher *deadLetterCountFetcher) Markup(pluginInstance PluginInstance) (Markup, error) {
+	text, err := fetcher.PlainText(pluginInstance)
+	if err != nil {
+		return Markup{}, err
+	}
+	return Markup{[]MarkupChunk{{Text: text}}}, nil
+}
+
+func (fetcher *deadLetterCountFetcher) PlainText(_ PluginInstance) (string, error) {
+	return strconv.FormatInt(atomic.LoadInt64(&fetcher.engine.deadLetters), 10), nil
+}
+
+// ParseDeadLetterTag reads the tag attribute of the <dead_letter> element of
+// the configuration, and returns "" if there is none.
+func ParseDeadLetterTag(config *Config) string {
+	for _, v := range config.Root.Elems {
+		if v.Name == "dead_letter" {
+			return v.Attrs["tag"]
+		}
+	}
+	return ""
+}
+
+// DeadLetterLines hands the lines the plugin could not make records of over
+// to the dead-letter queue, each as a record with the line in "message".
+func DeadLetterLines(engine Engine, plugin interface{}, cause error, lines []string) {
+	now := uint64(engine.Clock().Now().Unix())
+	records := make([]TinyFluentRecord, len(lines))
+	for i, line := range lines {
+		records[i] = TinyFluentRecord{
+			Timestamp: now,
+			Data:      map[string]interface{}{"message": line},
+		}
+	}
+	engine.DeadLetter(plugin, cause, []FluentRecordSet{{Tag: "", Records: records}})
+}
+
+// DeadLetterTag returns the tag the dead letters are emitted under, or "" if
+// they are only logged.
+func (engine *engineImpl) DeadLetterTag() string {
+	engine.deadLetterTagMtx.Lock()
+	defer engine.deadLetterTagMtx.Unlock()
+	return engine.deadLetterTag
+}
+
+func (engine *engineImpl) setDeadLetterTag(tag string) {
+	engine.deadLetterTagMtx.Lock()
+	defer engine.deadLetterTagMtx.Unlock()
+	engine.deadLetterTag = tag
+}
+
+// DeadLetter emits the records at the @ERROR label as they are if there is
+// one, or else wraps each of them with the tag it had, the plugin and the
+// cause, and emits them under the dead letter tag.  The plugin logs the
+// failure itself, so nothing more is done without either.  The records
+// that were already dead letters, i.e. that a plugin of the @ERROR label or
+// an output of the dead letter tag failed on, are dropped, so that they do
+// not keep going round.
+func (engine *engineImpl) DeadLetter(plugin interface{}, cause error, recordSets []FluentRecordSet) {
+	if engine.router != nil {
+		errorLabel := engine.router.LookupLabel(ErrorLabel)
+		if errorLabel != nil {
+			engine.deadLetterAtLabel(errorLabel, plugin, cause, recordSets)
+			return
+		}
+	}
+	tag := engine.DeadLetterTag()
+	if tag == "" {
+		return
+	}
+	name := pluginName(plugin)
+	letters := make([]TinyFluentRecord, 0)
+	for _, recordSet := range recordSets {
+		if recordSet.Tag == tag {
+			engine.logger.Error("%s dropped %d dead letters: %s", name, len(recordSet.Records), cause.Error())
+			continue
+		}
+		for _, record := range recordSet.Records {
+			letters = append(letters, TinyFluentRecord{
+				Timestamp: record.Timestamp,
+				Data: map[string]interface{}{
+					"tag":    recordSet.Tag,
+					"record": record.Data,
+					"plugin": name,
+					"error":  cause.Error(),
+				},
+			})
+		}
+	}
+	if len(letters) == 0 {
+		return
+	}
+	atomic.AddInt64(&engine.deadLetters, int64(len(letters)))
+	// an output may dead-letter from within its own delivery, which the
+	// route back to the same output would wait for
+	go func() {
+		err := engine.defaultPort.Emit([]FluentRecordSet{{Tag: tag, Records: letters}})
+		if err != nil {
+			engine.logger.Error("failed to emit the dead letters: %s", err.Error())
+		}
+	}()
+}
+
+func (engine *engineImpl) deadLetterAtLabel(errorLabel *FluentRouter, plugin interface{}, cause error, recordSets []FluentRecordSet) {
+	name := pluginName(plugin)
+	count := 0
+	for _, recordSet := range recordSets {
+		count += len(recordSet.Records)
+	}
+	if count == 0 {
+		return
+	}
+	if errorLabel.owns(plugin) {
+		engine.logger.Error("%s dropped %d dead letters: %s", name, count, cause.Error())
+		return
+	}
+	atomic.AddInt64(&engine.deadLetters, int64(count))
+	recordSets = append([]FluentRecordSet{}, recordSets...)
+	go func() {
+		err := errorLabel.Emit(recordSets)
+		if err != nil {
+			engine.logger.Error("failed to emit the dead letters at %s: %s", ErrorLabel, err.Error())
+		}
+	}()
+}
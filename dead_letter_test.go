@@ -0,0 +1,71 @@
+package ik
+
+import (
+	"errors"
+	"github.com/op/go-logging"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeadLetter(t *testing.T) {
+	data := `<dead_letter>
+  tag ik.dlq
+</dead_letter>
+<match ik.dlq>
+  type sink
+</match>`
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sinkFactory := &testSinkFactory{}
+	pipeline, err := NewPipeline(logging.MustGetLogger("ik"), myOpener(data), func(registry *MultiFactoryRegistry) error {
+		return registry.RegisterPlugins([]Plugin{sinkFactory})
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pipeline.Dispose()
+	err = pipeline.Load(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	engine := pipeline.engine
+	engine.DeadLetter(sinkFactory, errors.New("rejected"), []FluentRecordSet{
+		{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}},
+		// a dead letter failing again is not sent round
+		{Tag: "ik.dlq", Records: []TinyFluentRecord{{Timestamp: 2, Data: map[string]interface{}{"b": 2}}}},
+	})
+	var recordSets []FluentRecordSet
+	for i := 0; i < 100 && len(recordSets) == 0; i += 1 {
+		time.Sleep(10 * time.Millisecond)
+		recordSets = sinkFactory.outputs[0].RecordSets()
+	}
+	if len(recordSets) != 1 || recordSets[0].Tag != "ik.dlq" || len(recordSets[0].Records) != 1 {
+		t.Fatalf("%v", recordSets)
+	}
+	record := recordSets[0].Records[0]
+	if record.Timestamp != 1 || record.Data["tag"] != "test" || record.Data["plugin"] != "sink" || record.Data["error"] != "rejected" || record.Data["record"].(map[string]interface{})["a"] != 1 {
+		t.Fatalf("%v", record)
+	}
+	DeadLetterLines(engine, sinkFactory, errors.New("unparsed line"), []string{"garbage"})
+	for i := 0; i < 100 && len(recordSets) == 1; i += 1 {
+		time.Sleep(10 * time.Millisecond)
+		recordSets = sinkFactory.outputs[0].RecordSets()
+	}
+	if len(recordSets) != 2 || recordSets[1].Records[0].Data["record"].(map[string]interface{})["message"] != "garbage" {
+		t.Fatalf("%v", recordSets)
+	}
+	if atomic.LoadInt64(&engine.deadLetters) != 2 {
+		t.Fail()
+	}
+
+	// nothing is emitted without the tag
+	engine.setDeadLetterTag("")
+	engine.DeadLetter(sinkFactory, errors.New("rejected"), recordSets[0:1])
+	time.Sleep(20 * time.Millisecond)
+	if len(sinkFactory.outputs[0].RecordSets()) != 2 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,223 @@
+package ik
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// DebugOptions is what the <debug> element of the configuration asks for.
+// Listen is the address net/http/pprof is served at, or "" for none, and
+// the runtime statistics are sampled every StatsInterval unless it is zero.
+type DebugOptions struct {
+	Listen        string
+	StatsInterval time.Duration
+}
+
+// ParseDebugOptions reads the <debug> element of the configuration, and
+// returns nil if there is none.
+func ParseDebugOptions(config *Config) (*DebugOptions, error) {
+	for _, v := range config.Root.Elems {
+		if v.Name != "debug" {
+			continue
+		}
+		options := &DebugOptions{
+			Listen:        v.Attrs["listen"],
+			StatsInterval: time.Minute,
+		}
+		value, ok := v.Attrs["stats_interval"]
+		if ok {
+			var err error
+			options.StatsInterval, err = time.ParseDuration(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return options, nil
+	}
+	return nil, nil
+}
+
+// DebugServer serves the profiles of net/http/pprof under /debug/pprof/.
+// The handlers are on a mux of its own rather than http.DefaultServeMux, so
+// they are not exposed by any other listener of the process.
+type DebugServer struct {
+	logger   Logger
+	listener net.Listener
+	server   http.Server
+}
+
+func (server *DebugServer) Run() error {
+	err := server.server.Serve(server.listener)
+	if err != nil {
+		server.logger.Warning("%s", err.Error())
+	}
+	return err
+}
+
+func (server *DebugServer) Shutdown() error {
+	return server.listener.Close()
+}
+
+func NewDebugServer(logger Logger, listen string) (*DebugServer, error) {
+	listener, err := Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return &DebugServer{
+		logger:   logger,
+		listener: listener,
+		server:   http.Server{Addr: listen, Handler: mux},
+	}, nil
+}
+
+// RuntimeSample is what RuntimeStats took of the runtime at a time.
+// MaxGCPause is the longest of the collections since the sample before.
+type RuntimeSample struct {
+	Goroutines  int
+	HeapAlloc   uint64
+	HeapSys     uint64
+	NumGC       uint32
+	LastGCPause time.Duration
+	MaxGCPause  time.Duration
+}
+
+// RuntimeStats logs a sample of the runtime every interval, and keeps the
+// last one for the runtime topics of the engine.
+type RuntimeStats struct {
+	logger   Logger
+	ticker   Ticker
+	cancel   chan bool
+	sample   RuntimeSample
+	memStats runtime.MemStats
+	mtx      sync.Mutex
+}
+
+type runtimeStatsFetcher struct {
+	stats *RuntimeStats
+	text  func(sample RuntimeSample) string
+}
+
+func (fetcher *runtimeStatsFetcher) Markup(pluginInstance PluginInstance) (Markup, error) {
+	text, err := fetcher.PlainText(pluginInstance)
+	if err != nil {
+		return Markup{}, err
+	}
+	return Markup{[]MarkupChunk{{Text: text}}}, nil
+}
+
+func (fetcher *runtimeStatsFetcher) PlainText(_ PluginInstance) (string, error) {
+	return fetcher.text(fetcher.stats.Sample()), nil
+}
+
+// Sample returns the last sample taken.
+func (stats *RuntimeStats) Sample() RuntimeSample {
+	stats.mtx.Lock()
+	defer stats.mtx.Unlock()
+	return stats.sample
+}
+
+// Take samples the runtime.  runtime.ReadMemStats stops the world for a
+// moment, which is why it is not done on every fetch of a topic.
+func (stats *RuntimeStats) Take() RuntimeSample {
+	stats.mtx.Lock()
+	defer stats.mtx.Unlock()
+	lastNumGC := stats.memStats.NumGC
+	runtime.ReadMemStats(&stats.memStats)
+	sample := RuntimeSample{
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  stats.memStats.HeapAlloc,
+		HeapSys:    stats.memStats.HeapSys,
+		NumGC:      stats.memStats.NumGC,
+	}
+	if sample.NumGC > 0 {
+		sample.LastGCPause = time.Duration(stats.memStats.PauseNs[(sample.NumGC+255)%256])
+	}
+	// PauseNs only holds the last 256 pauses
+	n := sample.NumGC - lastNumGC
+	if n > 256 {
+		n = 256
+	}
+	for i := uint32(0); i < n; i++ {
+		pause := time.Duration(stats.memStats.PauseNs[(sample.NumGC-i+255)%256])
+		if pause > sample.MaxGCPause {
+			sample.MaxGCPause = pause
+		}
+	}
+	stats.sample = sample
+	return sample
+}
+
+func (stats *RuntimeStats) Run() error {
+	select {
+	case <-stats.cancel:
+		return nil
+	case <-stats.ticker.C():
+	}
+	sample := stats.Take()
+	stats.logger.Info(
+		"runtime: goroutines=%d, heap_alloc=%d, heap_sys=%d, num_gc=%d, max_gc_pause=%s",
+		sample.Goroutines,
+		sample.HeapAlloc,
+		sample.HeapSys,
+		sample.NumGC,
+		sample.MaxGCPause.String(),
+	)
+	return Continue
+}
+
+func (stats *RuntimeStats) Shutdown() error {
+	stats.ticker.Stop()
+	stats.cancel <- true
+	return nil
+}
+
+// NewRuntimeStats takes the first sample and adds the runtime topics to the
+// scorekeeper.  The samples are taken every interval on clock.
+func NewRuntimeStats(logger Logger, scorekeeper *Scorekeeper, interval time.Duration, clock Clock) *RuntimeStats {
+	stats := &RuntimeStats{
+		logger: logger,
+		ticker: clock.NewTicker(interval),
+		cancel: make(chan bool, 1),
+	}
+	stats.Take()
+	scorekeeper.AddTopic(ScorekeeperTopic{
+		Plugin:      EnginePlugin,
+		Name:        "goroutines",
+		DisplayName: "Goroutines",
+		Description: "Number of goroutines at the last sample",
+		Fetcher: &runtimeStatsFetcher{stats, func(sample RuntimeSample) string {
+			return strconv.Itoa(sample.Goroutines)
+		}},
+	})
+	scorekeeper.AddTopic(ScorekeeperTopic{
+		Plugin:      EnginePlugin,
+		Name:        "heap",
+		DisplayName: "Heap",
+		Description: "Bytes of the heap allocated and obtained from the OS at the last sample",
+		Fetcher: &runtimeStatsFetcher{stats, func(sample RuntimeSample) string {
+			return fmt.Sprintf("%d / %d", sample.HeapAlloc, sample.HeapSys)
+		}},
+	})
+	scorekeeper.AddTopic(ScorekeeperTopic{
+		Plugin:      EnginePlugin,
+		Name:        "gc_pause",
+		DisplayName: "GC pause",
+		Description: "Longest GC pause between the last two samples, and the last one",
+		Fetcher: &runtimeStatsFetcher{stats, func(sample RuntimeSample) string {
+			return fmt.Sprintf("%s (last %s)", sample.MaxGCPause.String(), sample.LastGCPause.String())
+		}},
+	})
+	return stats
+}
@@ -0,0 +1,83 @@
+package ik
+
+import (
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseDebugOptions(t *testing.T) {
+	config, err := ParseConfig(myOpener("<debug>\n  listen 127.0.0.1:0\n  stats_interval 10s\n</debug>"), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	options, err := ParseDebugOptions(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if options == nil || options.Listen != "127.0.0.1:0" || options.StatsInterval != 10*time.Second {
+		t.Logf("%v", options)
+		t.Fail()
+	}
+	config, _ = ParseConfig(myOpener("<debug>\n</debug>"), "test.cfg")
+	options, _ = ParseDebugOptions(config)
+	if options == nil || options.Listen != "" || options.StatsInterval != time.Minute {
+		t.Logf("%v", options)
+		t.Fail()
+	}
+	config, _ = ParseConfig(myOpener("<match **>\n  type stdout\n</match>"), "test.cfg")
+	options, _ = ParseDebugOptions(config)
+	if options != nil {
+		t.Fail()
+	}
+	config, _ = ParseConfig(myOpener("<debug>\n  stats_interval often\n</debug>"), "test.cfg")
+	_, err = ParseDebugOptions(config)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestRuntimeStats(t *testing.T) {
+	scorekeeper := NewScorekeeper(logging.MustGetLogger("ik"))
+	stats := NewRuntimeStats(logging.MustGetLogger("ik"), scorekeeper, time.Hour, SystemClock)
+	defer stats.ticker.Stop()
+	runtime.GC()
+	sample := stats.Take()
+	if sample.Goroutines == 0 || sample.HeapSys == 0 || sample.NumGC == 0 || sample.MaxGCPause < sample.LastGCPause {
+		t.Logf("%v", sample)
+		t.Fail()
+	}
+	for _, name := range []string{"goroutines", "heap", "gc_pause"} {
+		fetcher, err := scorekeeper.Fetch(EnginePlugin, name)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		text, err := fetcher.PlainText(nil)
+		if err != nil || text == "" {
+			t.Logf("%s: %q", name, text)
+			t.Fail()
+		}
+	}
+}
+
+func TestDebugServer(t *testing.T) {
+	server, err := NewDebugServer(logging.MustGetLogger("ik"), "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go server.Run()
+	defer server.Shutdown()
+	resp, err := http.Get("http://" + server.listener.Addr().String() + "/debug/pprof/goroutine?debug=1")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != 200 || len(body) == 0 {
+		t.Logf("%d: %s", resp.StatusCode, body)
+		t.Fail()
+	}
+}
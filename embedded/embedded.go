@@ -0,0 +1,310 @@
+// Package embedded wires up an engine the way the ik binary does, for the
+// programs embedding ik to run a configuration of their own:
+//
+//	engine, err := embedded.NewEngine(
+//		embedded.WithConfigFile("/etc/myapp/ik.conf"),
+//		embedded.WithSignals(),
+//	)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer engine.Dispose()
+//	engine.Start()
+//
+// The plugins, parsers and formatters of this tree are registered unless
+// WithoutDefaultPlugins is given.
+package embedded
+
+import (
+	"context"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/daemon"
+	"github.com/moriyoshi/ik/formatters"
+	"github.com/moriyoshi/ik/parsers"
+	"github.com/moriyoshi/ik/plugins"
+	"github.com/op/go-logging"
+	"path"
+	"sync"
+	"time"
+)
+
+type engineOptions struct {
+	logger          ik.Logger
+	opener          ik.Opener
+	clock           ik.Clock
+	configFile      string
+	config          *ik.Config
+	defaultPlugins  bool
+	plugins         []ik.Plugin
+	lineParsers     []ik.LineParserPlugin
+	formatters      []ik.FormatterPlugin
+	scoreboards     []ik.ScoreboardFactory
+	signals         bool
+	shutdownTimeout time.Duration
+}
+
+// Option configures the engine NewEngine creates.
+type Option func(options *engineOptions) error
+
+// WithLogger makes the engine log to logger instead of the "ik" logger of
+// go-logging.
+func WithLogger(logger ik.Logger) Option {
+	return func(options *engineOptions) error {
+		options.logger = logger
+		return nil
+	}
+}
+
+// WithOpener makes the engine open the files the configuration refers to
+// with opener, which WithConfigFile sets to the directory of the file.
+func WithOpener(opener ik.Opener) Option {
+	return func(options *engineOptions) error {
+		options.opener = opener
+		return nil
+	}
+}
+
+// WithClock makes the engine and the plugins tell the time by and wait on
+// clock instead of the clock of the host.
+func WithClock(clock ik.Clock) Option {
+	return func(options *engineOptions) error {
+		options.clock = clock
+		return nil
+	}
+}
+
+// WithConfigFile makes the engine load the configuration in the file.
+func WithConfigFile(configFile string) Option {
+	return func(options *engineOptions) error {
+		options.configFile = configFile
+		return nil
+	}
+}
+
+// WithConfig makes the engine load the configuration.
+func WithConfig(config *ik.Config) Option {
+	return func(options *engineOptions) error {
+		options.config = config
+		return nil
+	}
+}
+
+// WithoutDefaultPlugins leaves the plugins, parsers and formatters of this
+// tree unregistered, so that only those given by the other options are.
+func WithoutDefaultPlugins() Option {
+	return func(options *engineOptions) error {
+		options.defaultPlugins = false
+		return nil
+	}
+}
+
+// WithPlugins registers the input, output and filter factories along with
+// those of this tree.
+func WithPlugins(plugins ...ik.Plugin) Option {
+	return func(options *engineOptions) error {
+		options.plugins = append(options.plugins, plugins...)
+		return nil
+	}
+}
+
+// WithLineParsers registers the line parsers along with those of this
+// tree.
+func WithLineParsers(lineParsers ...ik.LineParserPlugin) Option {
+	return func(options *engineOptions) error {
+		options.lineParsers = append(options.lineParsers, lineParsers...)
+		return nil
+	}
+}
+
+// WithFormatters registers the formatters along with those of this tree.
+func WithFormatters(formatters ...ik.FormatterPlugin) Option {
+	return func(options *engineOptions) error {
+		options.formatters = append(options.formatters, formatters...)
+		return nil
+	}
+}
+
+// WithScoreboards registers the scoreboard factories, which none are by
+// default.
+func WithScoreboards(scoreboards ...ik.ScoreboardFactory) Option {
+	return func(options *engineOptions) error {
+		options.scoreboards = append(options.scoreboards, scoreboards...)
+		return nil
+	}
+}
+
+// WithSignals makes the engine handle the signals as the ik binary does,
+// shutting down on SIGTERM and SIGINT, reloading the configuration file on
+// SIGHUP and logging the statistics on SIGUSR2.
+func WithSignals() Option {
+	return func(options *engineOptions) error {
+		options.signals = true
+		return nil
+	}
+}
+
+// WithShutdownTimeout makes Dispose give up waiting for the flushes in
+// flight after timeout, which it waits for by default.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(options *engineOptions) error {
+		if timeout < 0 {
+			return errors.New("negative shutdown timeout: " + timeout.String())
+		}
+		options.shutdownTimeout = timeout
+		return nil
+	}
+}
+
+// RegisterDefaultPlugins registers the plugins, parsers and formatters of
+// this tree.
+func RegisterDefaultPlugins(registry *ik.MultiFactoryRegistry) error {
+	err := registry.RegisterPlugins(plugins.GetPlugins())
+	if err != nil {
+		return err
+	}
+	err = registry.RegisterLineParserPlugins(parsers.GetPlugins())
+	if err != nil {
+		return err
+	}
+	return registry.RegisterFormatterPlugins(formatters.GetPlugins())
+}
+
+// Engine is a pipeline running a configuration, disposed once.
+type Engine struct {
+	*ik.Pipeline
+	options     *engineOptions
+	disposeOnce sync.Once
+	disposeErr  error
+}
+
+func (options *engineOptions) register(registry *ik.MultiFactoryRegistry) error {
+	if options.defaultPlugins {
+		err := RegisterDefaultPlugins(registry)
+		if err != nil {
+			return err
+		}
+	}
+	err := registry.RegisterPlugins(options.plugins)
+	if err != nil {
+		return err
+	}
+	err = registry.RegisterLineParserPlugins(options.lineParsers)
+	if err != nil {
+		return err
+	}
+	err = registry.RegisterFormatterPlugins(options.formatters)
+	if err != nil {
+		return err
+	}
+	for _, scoreboard := range options.scoreboards {
+		err = registry.RegisterScoreboardFactory(scoreboard)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readConfig parses the configuration file, if any.
+func (options *engineOptions) readConfig() (*ik.Config, error) {
+	if options.configFile == "" {
+		return options.config, nil
+	}
+	return ik.ParseConfig(options.opener, path.Base(options.configFile))
+}
+
+// NewEngine creates an engine with the plugins of this tree registered,
+// and loads the configuration given by WithConfigFile or WithConfig along
+// with its scoreboards.  Without either, the configuration is loaded with
+// Load afterwards.
+func NewEngine(options_ ...Option) (*Engine, error) {
+	options := &engineOptions{defaultPlugins: true}
+	for _, option := range options_ {
+		err := option(options)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if options.configFile != "" && options.config != nil {
+		return nil, errors.New("both a configuration file and a configuration are given")
+	}
+	if options.logger == nil {
+		options.logger = logging.MustGetLogger("ik")
+	}
+	if options.opener == nil {
+		options.opener = ik.DefaultOpener(path.Dir(options.configFile))
+	}
+	config, err := options.readConfig()
+	if err != nil {
+		return nil, err
+	}
+	pipeline, err := ik.NewPipeline(options.logger, options.opener, options.register)
+	if err != nil {
+		return nil, err
+	}
+	if options.clock != nil {
+		pipeline.SetClock(options.clock)
+	}
+	engine := &Engine{Pipeline: pipeline, options: options}
+	err = engine.start(config)
+	if err != nil {
+		engine.Dispose()
+		return nil, err
+	}
+	return engine, nil
+}
+
+func (engine *Engine) start(config *ik.Config) error {
+	if config != nil {
+		err := engine.Load(config)
+		if err != nil {
+			return err
+		}
+		err = engine.ConfigureScoreboards(config)
+		if err != nil {
+			return err
+		}
+	}
+	if !engine.options.signals {
+		return nil
+	}
+	pipelineEngine := engine.Pipeline.Engine()
+	return pipelineEngine.Spawn(daemon.NewSignals(engine.options.logger, daemon.Handlers{
+		Shutdown: engine.Dispose,
+		Reload:   engine.Reload,
+		DumpStats: func() error {
+			daemon.DumpStats(pipelineEngine)
+			return nil
+		},
+	}))
+}
+
+// Reload loads the configuration file over again.  It fails if the
+// configuration was not given by WithConfigFile.
+func (engine *Engine) Reload() error {
+	if engine.options.configFile == "" {
+		return errors.New("no configuration file to reload")
+	}
+	config, err := engine.options.readConfig()
+	if err != nil {
+		return err
+	}
+	return engine.Load(config)
+}
+
+// Dispose shuts the engine down, giving up waiting for the flushes in
+// flight after the shutdown timeout if there is one.  It may be called more
+// than once.
+func (engine *Engine) Dispose() error {
+	engine.disposeOnce.Do(func() {
+		if engine.options.shutdownTimeout <= 0 {
+			engine.disposeErr = engine.Pipeline.Dispose()
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), engine.options.shutdownTimeout)
+		defer cancel()
+		engine.disposeErr = engine.Pipeline.Engine().DisposeContext(ctx)
+	})
+	return engine.disposeErr
+}
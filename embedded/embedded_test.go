@@ -0,0 +1,75 @@
+package embedded
+
+import (
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+type testSinkFactory struct {
+	outputs []*ik.CaptureOutput
+}
+
+func (factory *testSinkFactory) Name() string                    { return "test_sink" }
+func (factory *testSinkFactory) BindScorekeeper(*ik.Scorekeeper) {}
+
+func (factory *testSinkFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	output := &ik.CaptureOutput{Id: config.Attrs["@id"], Type: "test_sink"}
+	factory.outputs = append(factory.outputs, output)
+	return output, nil
+}
+
+func TestNewEngine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "embedded")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	configFile := path.Join(dir, "ik.conf")
+	err = ioutil.WriteFile(configFile, []byte("<match **>\n  type test_sink\n</match>\n"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	factory := &testSinkFactory{}
+	engine, err := NewEngine(WithConfigFile(configFile), WithPlugins(factory))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Dispose()
+	if engine.Registry().LookupOutputFactory("forward") == nil || engine.Registry().LookupLineParserFactoryFactory("regexp") == nil {
+		t.Fatal("the plugins of the tree are not registered")
+	}
+	err = engine.Router().Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(factory.outputs) != 1 || len(factory.outputs[0].RecordSets()) != 1 {
+		t.Fatalf("%v", factory.outputs)
+	}
+	err = engine.Reload()
+	if err != nil || len(factory.outputs) != 2 {
+		t.Fatalf("%v", err)
+	}
+	if engine.Dispose() != nil || engine.Dispose() != nil {
+		t.Fail()
+	}
+
+	engine, err = NewEngine(WithoutDefaultPlugins())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer engine.Dispose()
+	if engine.Registry().LookupOutputFactory("forward") != nil || engine.Reload() == nil {
+		t.Fail()
+	}
+	config, err := ik.ParseConfig(ik.DefaultOpener(dir), "ik.conf")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = NewEngine(WithConfigFile(configFile), WithConfig(config), WithoutDefaultPlugins())
+	if err == nil {
+		t.Fail()
+	}
+}
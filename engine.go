@@ -1,11 +1,69 @@
 package ik
 
 import (
+	"context"
 	"github.com/moriyoshi/ik/task"
 	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+type enginePlugin struct{}
+
+func (*enginePlugin) Name() string                 { return "engine" }
+func (*enginePlugin) BindScorekeeper(*Scorekeeper) {}
+
+// EnginePlugin is the plugin under which the engine registers its own
+// scorekeeper topics.  The fetchers of those topics don't look at the plugin
+// instance passed to them.
+var EnginePlugin Plugin = &enginePlugin{}
+
+// RetryReporter is implemented by outputs that retry failed deliveries.
+type RetryReporter interface {
+	RetryCount() int64
+}
+
+// DuplicateDeliveryReporter is implemented by outputs that refuse to
+// deliver a chunk while it is being delivered.
+type DuplicateDeliveryReporter interface {
+	DuplicateDeliveryCount() int64
+}
+
+// LatencyReporter is implemented by outputs that measure how long their
+// emits and flushes take.
+type LatencyReporter interface {
+	EmitLatency() *LatencyWindow
+	FlushLatency() *LatencyWindow
+}
+
+type emitCountingPort struct {
+	engine *engineImpl
+	inner  Port
+}
+
+type emitCountFetcher struct {
+	engine *engineImpl
+}
+
+type retryCountFetcher struct{}
+
+type duplicateDeliveryCountFetcher struct{}
+
+type latencyFetcher struct {
+	flush bool
+}
+
+type tagFlowFetcher struct {
+	engine *engineImpl
+}
+
+type portFlowFetcher struct {
+	engine *engineImpl
+}
+
 type recurringTaskDaemon struct {
 	engine   *engineImpl
 	shutdown bool
@@ -16,7 +74,7 @@ func (daemon *recurringTaskDaemon) Run() error {
 	if daemon.shutdown {
 		return nil
 	}
-	time.Sleep(1000000000)
+	<-After(daemon.engine.clock, time.Second)
 	return Continue
 }
 
@@ -30,13 +88,223 @@ type engineImpl struct {
 	logger                   Logger
 	opener                   Opener
 	lineParserPluginRegistry LineParserPluginRegistry
+	formatterPluginRegistry  FormatterPluginRegistry
 	randSource               rand.Source
 	scorekeeper              *Scorekeeper
 	defaultPort              Port
+	router                   *FluentRouter
 	spawner                  *Spawner
 	pluginInstances          []PluginInstance
+	pluginInstancesMtx       sync.Mutex
 	taskRunner               task.TaskRunner
 	recurringTaskScheduler   *task.RecurringTaskScheduler
+	clock                    Clock
+	emitCounts               map[string]*int64
+	emitCountsMtx            sync.Mutex
+	tagFlows                 *FlowMeter
+	portFlows                *FlowMeter
+	panics                   int64
+	panicTag                 string
+	panicTagMtx              sync.Mutex
+	deadLetters              int64
+	deadLetterTag            string
+	deadLetterTagMtx         sync.Mutex
+	tracer                   *Tracer
+	tenants                  *Tenants
+}
+
+func (port *emitCountingPort) count(recordSets []FluentRecordSet) {
+	for _, recordSet := range recordSets {
+		atomic.AddInt64(port.engine.emitCounter(recordSet.Tag), int64(len(recordSet.Records)))
+	}
+	port.engine.tagFlows.CountByTag(recordSets)
+}
+
+func (port *emitCountingPort) Emit(recordSets []FluentRecordSet) error {
+	port.count(recordSets)
+	return port.inner.Emit(recordSets)
+}
+
+func (port *emitCountingPort) EmitContext(ctx context.Context, recordSets []FluentRecordSet) error {
+	port.count(recordSets)
+	return EmitContext(ctx, port.inner, recordSets)
+}
+
+func (port *emitCountingPort) EmitDurably(recordSets []FluentRecordSet) error {
+	port.count(recordSets)
+	return EmitDurably(port.inner, recordSets)
+}
+
+func (port *emitCountingPort) EmitWithResult(recordSets []FluentRecordSet) []error {
+	port.count(recordSets)
+	return EmitWithResult(port.inner, recordSets)
+}
+
+func (engine *engineImpl) emitCounter(tag string) *int64 {
+	engine.emitCountsMtx.Lock()
+	defer engine.emitCountsMtx.Unlock()
+	counter, ok := engine.emitCounts[tag]
+	if !ok {
+		counter = new(int64)
+		engine.emitCounts[tag] = counter
+	}
+	return counter
+}
+
+// EmitCounts returns the number of records emitted to the default port so
+// far, per tag.
+func (engine *engineImpl) EmitCounts() map[string]int64 {
+	engine.emitCountsMtx.Lock()
+	defer engine.emitCountsMtx.Unlock()
+	retval := make(map[string]int64, len(engine.emitCounts))
+	for tag, counter := range engine.emitCounts {
+		retval[tag] = atomic.LoadInt64(counter)
+	}
+	return retval
+}
+
+func (fetcher *emitCountFetcher) Markup(_ PluginInstance) (Markup, error) {
+	emitCounts := fetcher.engine.EmitCounts()
+	tags := make([]string, 0, len(emitCounts))
+	for tag := range emitCounts {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	chunks := make([]MarkupChunk, 0, len(tags)*2)
+	for i, tag := range tags {
+		text := tag
+		if i > 0 {
+			text = ", " + text
+		}
+		chunks = append(chunks, MarkupChunk{Attrs: Embolden, Text: text})
+		chunks = append(chunks, MarkupChunk{Text: ": " + strconv.FormatInt(emitCounts[tag], 10)})
+	}
+	return Markup{chunks}, nil
+}
+
+func (fetcher *emitCountFetcher) PlainText(pluginInstance PluginInstance) (string, error) {
+	markup, err := fetcher.Markup(pluginInstance)
+	if err != nil {
+		return "", err
+	}
+	text := ""
+	for _, chunk := range markup.Chunks {
+		text += chunk.Text
+	}
+	return text, nil
+}
+
+func (fetcher *retryCountFetcher) Markup(pluginInstance PluginInstance) (Markup, error) {
+	text, err := fetcher.PlainText(pluginInstance)
+	if err != nil {
+		return Markup{}, err
+	}
+	return Markup{[]MarkupChunk{{Text: text}}}, nil
+}
+
+func (fetcher *retryCountFetcher) PlainText(pluginInstance PluginInstance) (string, error) {
+	reporter, ok := pluginInstance.(RetryReporter)
+	if !ok {
+		return "-", nil
+	}
+	return strconv.FormatInt(reporter.RetryCount(), 10), nil
+}
+
+func (fetcher *duplicateDeliveryCountFetcher) Markup(pluginInstance PluginInstance) (Markup, error) {
+	text, err := fetcher.PlainText(pluginInstance)
+	if err != nil {
+		return Markup{}, err
+	}
+	return Markup{[]MarkupChunk{{Text: text}}}, nil
+}
+
+func (fetcher *duplicateDeliveryCountFetcher) PlainText(pluginInstance PluginInstance) (string, error) {
+	reporter, ok := pluginInstance.(DuplicateDeliveryReporter)
+	if !ok {
+		return "-", nil
+	}
+	return strconv.FormatInt(reporter.DuplicateDeliveryCount(), 10), nil
+}
+
+func (fetcher *latencyFetcher) Markup(pluginInstance PluginInstance) (Markup, error) {
+	text, err := fetcher.PlainText(pluginInstance)
+	if err != nil {
+		return Markup{}, err
+	}
+	return Markup{[]MarkupChunk{{Text: text}}}, nil
+}
+
+func (fetcher *latencyFetcher) PlainText(pluginInstance PluginInstance) (string, error) {
+	reporter, ok := pluginInstance.(LatencyReporter)
+	if !ok {
+		return "-", nil
+	}
+	if fetcher.flush {
+		return reporter.FlushLatency().String(), nil
+	}
+	return reporter.EmitLatency().String(), nil
+}
+
+// TagFlows returns the meter of the records emitted to the default port,
+// per tag.
+func (engine *engineImpl) TagFlows() *FlowMeter {
+	return engine.tagFlows
+}
+
+// PortFlows returns the meter of the records emitted at each filter and
+// output, per plugin instance.
+func (engine *engineImpl) PortFlows() *FlowMeter {
+	return engine.portFlows
+}
+
+func (fetcher *tagFlowFetcher) Markup(_ PluginInstance) (Markup, error) {
+	flows := fetcher.engine.tagFlows
+	tags := make([]string, 0)
+	for _, key := range flows.Keys() {
+		tags = append(tags, key.(string))
+	}
+	sort.Strings(tags)
+	chunks := make([]MarkupChunk, 0, len(tags)*2)
+	for i, tag := range tags {
+		text := tag
+		if i > 0 {
+			text = "; " + text
+		}
+		chunks = append(chunks, MarkupChunk{Attrs: Embolden, Text: text})
+		chunks = append(chunks, MarkupChunk{Text: " " + flows.Counter(tag).String()})
+	}
+	if len(chunks) == 0 {
+		chunks = append(chunks, MarkupChunk{Text: "-"})
+	}
+	return Markup{chunks}, nil
+}
+
+func (fetcher *tagFlowFetcher) PlainText(pluginInstance PluginInstance) (string, error) {
+	markup, err := fetcher.Markup(pluginInstance)
+	if err != nil {
+		return "", err
+	}
+	text := ""
+	for _, chunk := range markup.Chunks {
+		text += chunk.Text
+	}
+	return text, nil
+}
+
+func (fetcher *portFlowFetcher) Markup(pluginInstance PluginInstance) (Markup, error) {
+	text, err := fetcher.PlainText(pluginInstance)
+	if err != nil {
+		return Markup{}, err
+	}
+	return Markup{[]MarkupChunk{{Text: text}}}, nil
+}
+
+func (fetcher *portFlowFetcher) PlainText(pluginInstance PluginInstance) (string, error) {
+	counter := fetcher.engine.portFlows.Counter(pluginInstance)
+	if counter == nil {
+		return "-", nil
+	}
+	return counter.String(), nil
 }
 
 func (engine *engineImpl) Logger() Logger {
@@ -51,6 +319,10 @@ func (engine *engineImpl) LineParserPluginRegistry() LineParserPluginRegistry {
 	return engine.lineParserPluginRegistry
 }
 
+func (engine *engineImpl) FormatterPluginRegistry() FormatterPluginRegistry {
+	return engine.formatterPluginRegistry
+}
+
 func (engine *engineImpl) RandSource() rand.Source {
 	return engine.randSource
 }
@@ -59,6 +331,46 @@ func (engine *engineImpl) Scorekeeper() *Scorekeeper {
 	return engine.scorekeeper
 }
 
+func (engine *engineImpl) Tracer() *Tracer {
+	return engine.tracer
+}
+
+func (engine *engineImpl) Clock() Clock {
+	return engine.clock
+}
+
+func (engine *engineImpl) Tenants() *Tenants {
+	return engine.tenants
+}
+
+// SetClock makes the engine and the plugins created afterwards use clock.
+// It is to be called before any configuration is loaded.
+func (engine *engineImpl) SetClock(clock Clock) {
+	engine.clock = clock
+}
+
+func (engine *engineImpl) now() time.Time {
+	return engine.clock.Now()
+}
+
+// engineClock is the clock of the engine as of each call, for what is made
+// before SetClock.
+type engineClock struct {
+	engine *engineImpl
+}
+
+func (clock engineClock) Now() time.Time {
+	return clock.engine.clock.Now()
+}
+
+func (clock engineClock) NewTicker(d time.Duration) Ticker {
+	return clock.engine.clock.NewTicker(d)
+}
+
+func (clock engineClock) NewTimer(d time.Duration) Timer {
+	return clock.engine.clock.NewTimer(d)
+}
+
 func (engine *engineImpl) SpawneeStatuses() ([]SpawneeStatus, error) {
 	return engine.spawner.GetSpawneeStatuses()
 }
@@ -68,12 +380,16 @@ func (engine *engineImpl) DefaultPort() Port {
 }
 
 func (engine *engineImpl) Dispose() error {
+	return engine.DisposeContext(context.Background())
+}
+
+func (engine *engineImpl) DisposeContext(ctx context.Context) error {
 	spawnees, err := engine.spawner.GetRunningSpawnees()
 	if err != nil {
 		return err
 	}
 	for _, spawnee := range spawnees {
-		engine.spawner.Kill(spawnee)
+		engine.spawner.KillContext(ctx, spawnee)
 	}
 	engine.spawner.PollMultiple(spawnees)
 	return nil
@@ -92,11 +408,81 @@ func (engine *engineImpl) Launch(pluginInstance PluginInstance) error {
 			return err
 		}
 	}
+	engine.pluginInstancesMtx.Lock()
 	engine.pluginInstances = append(engine.pluginInstances, pluginInstance)
+	engine.pluginInstancesMtx.Unlock()
+	if _, ok := pluginInstance.(RetryReporter); ok {
+		engine.scorekeeper.AddTopic(ScorekeeperTopic{
+			Plugin:      pluginInstance.Factory(),
+			Name:        "retries",
+			DisplayName: "Retries",
+			Description: "Number of deliveries that failed and are to be retried",
+			Fetcher:     &retryCountFetcher{},
+		})
+	}
+	if _, ok := pluginInstance.(DuplicateDeliveryReporter); ok {
+		engine.scorekeeper.AddTopic(ScorekeeperTopic{
+			Plugin:      pluginInstance.Factory(),
+			Name:        "duplicate_deliveries",
+			DisplayName: "Duplicate deliveries",
+			Description: "Number of deliveries of chunks already being delivered that were prevented",
+			Fetcher:     &duplicateDeliveryCountFetcher{},
+		})
+	}
+	if _, ok := pluginInstance.(Port); ok && pluginInstance.Factory() != nil {
+		engine.scorekeeper.AddTopic(ScorekeeperTopic{
+			Plugin:      pluginInstance.Factory(),
+			Name:        "flow",
+			DisplayName: "Flow",
+			Description: "Records and bytes per second emitted at the plugin instance over the last 1, 5 and 15 minutes",
+			Fetcher:     &portFlowFetcher{engine},
+		})
+	}
+	if _, ok := pluginInstance.(LatencyReporter); ok {
+		engine.scorekeeper.AddTopic(ScorekeeperTopic{
+			Plugin:      pluginInstance.Factory(),
+			Name:        "emit_latency",
+			DisplayName: "Emit latency",
+			Description: "Percentiles of the time emits took in the last minute",
+			Fetcher:     &latencyFetcher{false},
+		})
+		engine.scorekeeper.AddTopic(ScorekeeperTopic{
+			Plugin:      pluginInstance.Factory(),
+			Name:        "flush_latency",
+			DisplayName: "Flush latency",
+			Description: "Percentiles of the time flushes took in the last minute",
+			Fetcher:     &latencyFetcher{true},
+		})
+	}
+	return nil
+}
+
+// Terminate shuts down the plugin instance, waits for it to stop and
+// forgets about it.
+func (engine *engineImpl) Terminate(pluginInstance PluginInstance) error {
+	_, err := engine.spawner.Kill(pluginInstance)
+	if err != nil {
+		return err
+	}
+	err = engine.spawner.Poll(pluginInstance)
+	if err != nil && err != NotFound {
+		return err
+	}
+	engine.portFlows.Forget(pluginInstance)
+	engine.pluginInstancesMtx.Lock()
+	defer engine.pluginInstancesMtx.Unlock()
+	for i, pluginInstance_ := range engine.pluginInstances {
+		if pluginInstance_ == pluginInstance {
+			engine.pluginInstances = append(engine.pluginInstances[0:i], engine.pluginInstances[i+1:]...)
+			break
+		}
+	}
 	return nil
 }
 
 func (engine *engineImpl) PluginInstances() []PluginInstance {
+	engine.pluginInstancesMtx.Lock()
+	defer engine.pluginInstancesMtx.Unlock()
 	retval := make([]PluginInstance, len(engine.pluginInstances))
 	copy(retval, engine.pluginInstances)
 	return retval
@@ -114,24 +500,73 @@ func (engine *engineImpl) Start() error {
 	return engine.spawner.PollMultiple(spawnees)
 }
 
-func NewEngine(logger Logger, opener Opener, lineParserPluginRegistry LineParserPluginRegistry, scorekeeper *Scorekeeper, defaultPort Port) *engineImpl {
+func NewEngine(logger Logger, opener Opener, lineParserPluginRegistry LineParserPluginRegistry, formatterPluginRegistry FormatterPluginRegistry, scorekeeper *Scorekeeper, defaultPort Port) *engineImpl {
 	taskRunner := &task.SimpleTaskRunner{}
-	recurringTaskScheduler := task.NewRecurringTaskScheduler(
-		func() time.Time { return time.Now() },
-		taskRunner,
-	)
 	engine := &engineImpl{
 		logger: logger,
 		opener: opener,
 		lineParserPluginRegistry: lineParserPluginRegistry,
+		formatterPluginRegistry:  formatterPluginRegistry,
 		randSource:               NewRandSourceWithTimestampSeed(),
 		scorekeeper:              scorekeeper,
-		defaultPort:              defaultPort,
 		spawner:                  NewSpawner(),
 		pluginInstances:          make([]PluginInstance, 0),
+		pluginInstancesMtx:       sync.Mutex{},
 		taskRunner:               taskRunner,
-		recurringTaskScheduler:   recurringTaskScheduler,
+		clock:                    SystemClock,
+		emitCounts:               make(map[string]*int64),
+		emitCountsMtx:            sync.Mutex{},
+		tenants:                  &Tenants{},
+	}
+	// the tasks and the traces follow a clock set afterwards
+	engine.recurringTaskScheduler = task.NewRecurringTaskScheduler(engine.now, taskRunner)
+	engine.tracer = NewTracer(logger, engineClock{engine})
+	engine.tagFlows = NewFlowMeter(engineClock{engine})
+	engine.portFlows = NewFlowMeter(engineClock{engine})
+	engine.defaultPort = &emitCountingPort{engine, defaultPort}
+	// the @ERROR label is looked up in the router the records are emitted at
+	engine.router, _ = defaultPort.(*FluentRouter)
+	if engine.router != nil {
+		engine.router.SetFlowMeter(engine.portFlows)
 	}
+	scorekeeper.AddTopic(ScorekeeperTopic{
+		Plugin:      EnginePlugin,
+		Name:        "emits",
+		DisplayName: "Emitted records",
+		Description: "Number of records emitted so far, per tag",
+		Fetcher:     &emitCountFetcher{engine},
+	})
+	scorekeeper.AddTopic(ScorekeeperTopic{
+		Plugin:      EnginePlugin,
+		Name:        "flows",
+		DisplayName: "Flows",
+		Description: "Records and bytes per second emitted over the last 1, 5 and 15 minutes, per tag",
+		Fetcher:     &tagFlowFetcher{engine},
+	})
+	scorekeeper.AddTopic(ScorekeeperTopic{
+		Plugin:      EnginePlugin,
+		Name:        "tenant_overflows",
+		DisplayName: "Tenant overflows",
+		Description: "Number of records each tenant went over its quotas by so far",
+		Fetcher:     &tenantFetcher{engine},
+	})
+	scorekeeper.AddTopic(ScorekeeperTopic{
+		Plugin:      EnginePlugin,
+		Name:        "panics",
+		DisplayName: "Panics",
+		Description: "Number of times a plugin panicked so far",
+		Fetcher:     &panicCountFetcher{engine},
+	})
+	scorekeeper.AddTopic(ScorekeeperTopic{
+		Plugin:      EnginePlugin,
+		Name:        "dead_letters",
+		DisplayName: "Dead letters",
+		Description: "Number of records sent to the dead-letter queue so far",
+		Fetcher:     &deadLetterCountFetcher{engine},
+	})
+	engine.spawner.SetPanicHandler(func(spawnee Spawnee, panicked *Panicked) {
+		engine.reportPanic(spawnee, panicked, nil)
+	})
 	engine.Spawn(&recurringTaskDaemon{engine, false})
 	return engine
 }
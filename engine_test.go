@@ -0,0 +1,71 @@
+package ik
+
+import (
+	"github.com/moriyoshi/ik/task"
+	"testing"
+	"time"
+)
+
+// engineTestClock hands the timers made to the test, which fires them.
+type engineTestClock struct {
+	Clock
+	timers chan *engineTestTimer
+}
+
+type engineTestTimer struct {
+	c chan time.Time
+	d time.Duration
+}
+
+func (clock *engineTestClock) NewTimer(d time.Duration) Timer {
+	timer := &engineTestTimer{make(chan time.Time, 1), d}
+	clock.timers <- timer
+	return timer
+}
+
+func (timer *engineTestTimer) C() <-chan time.Time {
+	return timer.c
+}
+
+func (timer *engineTestTimer) Stop() bool {
+	return true
+}
+
+func (timer *engineTestTimer) Reset(d time.Duration) bool {
+	timer.d = d
+	return true
+}
+
+func TestRecurringTaskDaemon(t *testing.T) {
+	clock := &engineTestClock{Clock: SystemClock, timers: make(chan *engineTestTimer, 1)}
+	engine := &engineImpl{clock: clock}
+	engine.recurringTaskScheduler = task.NewRecurringTaskScheduler(engine.now, &task.SimpleTaskRunner{})
+	daemon := &recurringTaskDaemon{engine, false}
+	engine.recurringTaskScheduler.NoOp()
+	result := make(chan error, 1)
+	go func() {
+		result <- daemon.Run()
+	}()
+	// the daemon waits on the clock of the engine after the event
+	timer := <-clock.timers
+	if timer.d != time.Second {
+		t.Fatalf("%s", timer.d)
+	}
+	select {
+	case <-result:
+		t.Fatal("returned before the clock moved")
+	default:
+	}
+	timer.c <- time.Unix(1, 0)
+	if err := <-result; err != Continue {
+		t.Fatalf("%v", err)
+	}
+	// the daemon being shut down returns right after the event
+	go func() {
+		result <- daemon.Run()
+	}()
+	daemon.Shutdown()
+	if err := <-result; err != nil {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	jnl "github.com/moriyoshi/ik/journal"
+	"os"
+	"time"
+)
+
+func bufferUsage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage of %s buffer: %s buffer ls [-json] path...\n", os.Args[0], os.Args[0])
+	flags.PrintDefaults()
+}
+
+func printInspectReport(report *jnl.InspectReport) {
+	fmt.Printf("%s*%s\n", report.PathPrefix, report.PathSuffix)
+	for _, journal := range report.Journals {
+		fmt.Printf("  %s: %d chunks, %d bytes\n", journal.Key, len(journal.Chunks), journal.Size)
+		for _, chunk := range journal.Chunks {
+			type_ := "rest"
+			if chunk.Type == jnl.Head {
+				type_ = "head"
+			}
+			sealed := ""
+			if chunk.KeyId != "" {
+				sealed = " sealed with " + chunk.KeyId
+			}
+			fmt.Printf("    %s %s %d%s\t%s\n", type_, chunk.Timestamp.Format(time.RFC3339), chunk.Size, sealed, chunk.Path)
+		}
+		for _, anomaly := range journal.Anomalies {
+			fmt.Printf("    ! %s\n", anomaly)
+		}
+	}
+	for _, anomaly := range report.Anomalies {
+		fmt.Printf("  ! %s\n", anomaly)
+	}
+}
+
+// runBuffer lists the chunks in the buffers at the buffer_path given on
+// the command line, and returns the exit status, which is 2 if anything is
+// found wrong with them.
+func runBuffer(args []string) int {
+	var asJSON bool
+	flags := flag.NewFlagSet("buffer", flag.ContinueOnError)
+	flags.BoolVar(&asJSON, "json", false, "print the reports in JSON")
+	flags.Usage = func() { bufferUsage(flags) }
+	if len(args) == 0 || args[0] != "ls" {
+		bufferUsage(flags)
+		return 255
+	}
+	err := flags.Parse(args[1:])
+	if err != nil || flags.NArg() == 0 {
+		bufferUsage(flags)
+		return 255
+	}
+
+	status := 0
+	encoder := json.NewEncoder(os.Stdout)
+	for _, path := range flags.Args() {
+		report, err := jnl.Inspect(path, ".log")
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			status = 1
+			continue
+		}
+		if asJSON {
+			encoder.Encode(report)
+		} else {
+			printInspectReport(report)
+		}
+		if status == 0 && report.Count() > 0 {
+			status = 2
+		}
+	}
+	return status
+}
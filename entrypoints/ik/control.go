@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/op/go-logging"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// controlHandler serves the control API given by -control-listen.  The
+// requests and the responses are JSON:
+//
+//	GET  /plugins            the plugin instances with their statuses and topics
+//	GET  /engine             the topics of the engine
+//	GET  /flows              the flow rates per tag and per plugin instance
+//	POST /flush[?id=<id>]    delivers what the outputs have buffered
+//	POST /drain[?id=<id>]    delivers what the outputs have buffered, refusing more
+//	POST /ready[?id=<id>]    ends the warm-up of the outputs warming up
+//	GET  /traces[?id=<id>]   the traces of the records kept, or one of them
+//	GET  /log_level          {"level": "INFO"}
+//	PUT  /log_level          sets the level given the same way
+//	POST /reload             loads the configuration again
+//	POST /upgrade            hands off to the binary on disk, see ik.Handoff
+//	POST /shutdown           shuts down gracefully
+//
+// The requests are authorized by auth: the GET endpoints require the scope
+// "read", so that monitoring can be granted alone, and the others require
+// "control".  Without auth every request is turned down.
+type controlHandler struct {
+	logger   ik.Logger
+	engine   ik.Engine
+	auth     *ik.HTTPAuth
+	reload   func() error
+	upgrade  func() error
+	shutdown func()
+}
+
+var controlScopes = map[string]string{
+	"GET /plugins":   "read",
+	"GET /engine":    "read",
+	"GET /flows":     "read",
+	"GET /traces":    "read",
+	"GET /log_level": "read",
+	"POST /flush":    "control",
+	"POST /drain":    "control",
+	"POST /ready":    "control",
+	"PUT /log_level": "control",
+	"POST /reload":   "control",
+	"POST /upgrade":  "control",
+	"POST /shutdown": "control",
+}
+
+func writeControlResponse(resp http.ResponseWriter, status int, v interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(v)
+}
+
+func writeControlError(resp http.ResponseWriter, status int, err error) {
+	writeControlResponse(resp, status, map[string]string{"error": err.Error()})
+}
+
+// authorize returns nil if the request is granted the scope of its
+// endpoint, the endpoints unknown requiring "control".
+func (handler *controlHandler) authorize(req *http.Request) error {
+	if handler.auth == nil {
+		return &ik.HTTPAuthError{Status: http.StatusUnauthorized, Message: "no authentication is configured for the control API"}
+	}
+	scope, ok := controlScopes[req.Method+" "+req.URL.Path]
+	if !ok {
+		scope = "control"
+	}
+	_, err := handler.auth.Authorize(req, scope)
+	return err
+}
+
+// selectPluginInstances returns the plugin instances by id, or only the
+// one with the given id if it is not empty.
+func (handler *controlHandler) selectPluginInstances(id string) (map[int]ik.PluginInstance, error) {
+	_, pluginInstances, err := describePluginInstances(handler.engine)
+	if err != nil {
+		return nil, err
+	}
+	if id != "" {
+		id_, err := strconv.Atoi(id)
+		if err != nil {
+			return nil, errors.New("invalid id: " + id)
+		}
+		pluginInstance, ok := pluginInstances[id_]
+		if !ok {
+			return nil, errors.New("no such plugin instance: " + id)
+		}
+		pluginInstances = map[int]ik.PluginInstance{id_: pluginInstance}
+	}
+	return pluginInstances, nil
+}
+
+// flush flushes the outputs that can be, or only the one with the given id
+// if it is not empty, and returns the ids of those flushed.
+func (handler *controlHandler) flush(id string) ([]int, error) {
+	pluginInstances, err := handler.selectPluginInstances(id)
+	if err != nil {
+		return nil, err
+	}
+	flushed := make([]int, 0)
+	for id_, pluginInstance := range pluginInstances {
+		flusher, ok := pluginInstance.(ik.Flusher)
+		if !ok {
+			continue
+		}
+		err := flusher.Flush()
+		if err != nil {
+			return flushed, err
+		}
+		flushed = append(flushed, id_)
+	}
+	return flushed, nil
+}
+
+// drain drains the outputs that can be, or only the one with the given id,
+// all at once, and returns the ids of those drained.
+func (handler *controlHandler) drain(id string) ([]int, error) {
+	pluginInstances, err := handler.selectPluginInstances(id)
+	if err != nil {
+		return nil, err
+	}
+	drained := make([]int, 0)
+	errs := make(chan error, len(pluginInstances))
+	for id_, pluginInstance := range pluginInstances {
+		drainer, ok := pluginInstance.(ik.Drainer)
+		if !ok {
+			continue
+		}
+		go func(drainer ik.Drainer) {
+			errs <- drainer.Drain()
+		}(drainer)
+		drained = append(drained, id_)
+	}
+	for range drained {
+		err_ := <-errs
+		if err_ != nil {
+			err = err_
+		}
+	}
+	return drained, err
+}
+
+// ready ends the warm-up of the outputs warming up, or only of the one with
+// the given id, and returns the ids of those that were.
+func (handler *controlHandler) ready(id string) ([]int, error) {
+	pluginInstances, err := handler.selectPluginInstances(id)
+	if err != nil {
+		return nil, err
+	}
+	readied := make([]int, 0)
+	for id_, pluginInstance := range pluginInstances {
+		warmUpper, ok := pluginInstance.(ik.WarmUpper)
+		if !ok || warmUpper.Ready() {
+			continue
+		}
+		warmUpper.SetReady()
+		readied = append(readied, id_)
+	}
+	return readied, nil
+}
+
+// flowRates keys the rates by their windows, e.g. "1m".
+func flowRates(counter *ik.FlowCounter) map[string]ik.FlowRate {
+	rates := counter.Rates()
+	retval := make(map[string]ik.FlowRate, len(rates))
+	for _, rate := range rates {
+		retval[strconv.FormatInt(int64(rate.Window/time.Minute), 10)+"m"] = rate
+	}
+	return retval
+}
+
+// flows returns the flow rates of the records emitted by the inputs per
+// tag, and of those emitted at each filter and output by id.
+func (handler *controlHandler) flows() (map[string]interface{}, error) {
+	meters, ok := handler.engine.(interface {
+		TagFlows() *ik.FlowMeter
+		PortFlows() *ik.FlowMeter
+	})
+	if !ok {
+		return nil, errors.New("the engine keeps no flow rates")
+	}
+	tags := make(map[string]map[string]ik.FlowRate)
+	for _, key := range meters.TagFlows().Keys() {
+		tag := key.(string)
+		tags[tag] = flowRates(meters.TagFlows().Counter(tag))
+	}
+	_, pluginInstances, err := describePluginInstances(handler.engine)
+	if err != nil {
+		return nil, err
+	}
+	plugins := make(map[string]map[string]ik.FlowRate)
+	for id, pluginInstance := range pluginInstances {
+		counter := meters.PortFlows().Counter(pluginInstance)
+		if counter != nil {
+			plugins[strconv.Itoa(id)] = flowRates(counter)
+		}
+	}
+	return map[string]interface{}{"tags": tags, "plugins": plugins}, nil
+}
+
+func (handler *controlHandler) setLogLevel(req *http.Request) (string, error) {
+	body := struct {
+		Level string `json:"level"`
+	}{}
+	err := json.NewDecoder(req.Body).Decode(&body)
+	if err != nil {
+		return "", err
+	}
+	level, err := logging.LogLevel(body.Level)
+	if err != nil {
+		return "", err
+	}
+	logging.SetLevel(level, "ik")
+	return level.String(), nil
+}
+
+func (handler *controlHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	err := handler.authorize(req)
+	if err != nil {
+		authErr := err.(*ik.HTTPAuthError)
+		if authErr.Status == http.StatusUnauthorized && handler.auth != nil {
+			handler.auth.Challenge(resp)
+		}
+		writeControlError(resp, authErr.Status, err)
+		return
+	}
+	route := req.Method + " " + req.URL.Path
+	switch route {
+	case "GET /plugins":
+		plugins, _, err := describePluginInstances(handler.engine)
+		if err != nil {
+			writeControlError(resp, http.StatusInternalServerError, err)
+			return
+		}
+		writeControlResponse(resp, http.StatusOK, plugins)
+	case "GET /engine":
+		writeControlResponse(resp, http.StatusOK, fetchPlainTextTopics(handler.engine, ik.EnginePlugin, nil))
+	case "GET /flows":
+		flows, err := handler.flows()
+		if err != nil {
+			writeControlError(resp, http.StatusInternalServerError, err)
+			return
+		}
+		writeControlResponse(resp, http.StatusOK, flows)
+	case "POST /flush":
+		flushed, err := handler.flush(req.URL.Query().Get("id"))
+		if err != nil {
+			writeControlError(resp, http.StatusInternalServerError, err)
+			return
+		}
+		writeControlResponse(resp, http.StatusOK, map[string]interface{}{"flushed": flushed})
+	case "POST /drain":
+		drained, err := handler.drain(req.URL.Query().Get("id"))
+		if err != nil {
+			writeControlError(resp, http.StatusInternalServerError, err)
+			return
+		}
+		writeControlResponse(resp, http.StatusOK, map[string]interface{}{"drained": drained})
+	case "POST /ready":
+		readied, err := handler.ready(req.URL.Query().Get("id"))
+		if err != nil {
+			writeControlError(resp, http.StatusInternalServerError, err)
+			return
+		}
+		writeControlResponse(resp, http.StatusOK, map[string]interface{}{"ready": readied})
+	case "GET /traces":
+		id := req.URL.Query().Get("id")
+		if id == "" {
+			writeControlResponse(resp, http.StatusOK, handler.engine.Tracer().Traces())
+			return
+		}
+		trace := handler.engine.Tracer().Trace(id)
+		if trace == nil {
+			writeControlError(resp, http.StatusNotFound, errors.New("no such trace: "+id))
+			return
+		}
+		writeControlResponse(resp, http.StatusOK, trace)
+	case "GET /log_level":
+		writeControlResponse(resp, http.StatusOK, map[string]string{"level": logging.GetLevel("ik").String()})
+	case "PUT /log_level":
+		level, err := handler.setLogLevel(req)
+		if err != nil {
+			writeControlError(resp, http.StatusBadRequest, err)
+			return
+		}
+		handler.logger.Notice("log level set to %s", level)
+		writeControlResponse(resp, http.StatusOK, map[string]string{"level": level})
+	case "POST /reload":
+		err := handler.reload()
+		if err != nil {
+			writeControlError(resp, http.StatusInternalServerError, err)
+			return
+		}
+		writeControlResponse(resp, http.StatusOK, map[string]string{})
+	case "POST /upgrade":
+		// the new process is ready by the time it returns
+		err := handler.upgrade()
+		if err != nil {
+			writeControlError(resp, http.StatusInternalServerError, err)
+			return
+		}
+		writeControlResponse(resp, http.StatusAccepted, map[string]string{})
+	case "POST /shutdown":
+		handler.logger.Notice("shutting down on request")
+		// the response goes out before the engine stops
+		go handler.shutdown()
+		writeControlResponse(resp, http.StatusAccepted, map[string]string{})
+	default:
+		writeControlError(resp, http.StatusNotFound, errors.New("no such endpoint: "+route))
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"github.com/moriyoshi/ik"
+	"github.com/op/go-logging"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestControlHandler_Authorize(t *testing.T) {
+	shutdown := make(chan struct{}, 1)
+	handler := &controlHandler{
+		logger:   logging.MustGetLogger("ik"),
+		shutdown: func() { shutdown <- struct{}{} },
+	}
+	serve := func(method string, path string, token string) int {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp := httptest.NewRecorder()
+		handler.ServeHTTP(resp, req)
+		return resp.Code
+	}
+	// a handler given no authentication turns down every request
+	if status := serve("POST", "/shutdown", ""); status != http.StatusUnauthorized {
+		t.Fatalf("%d", status)
+	}
+	if status := serve("GET", "/engine", "secret"); status != http.StatusUnauthorized {
+		t.Fatalf("%d", status)
+	}
+	handler.auth = ik.NewHTTPAuth("ik")
+	handler.auth.Add(ik.NewAPIKeyAuthenticator("secret", []string{"*"}))
+	if status := serve("POST", "/shutdown", "wrong"); status != http.StatusUnauthorized {
+		t.Fatalf("%d", status)
+	}
+	select {
+	case <-shutdown:
+		t.Fatal("shut down unauthorized")
+	default:
+	}
+	if status := serve("POST", "/shutdown", "secret"); status != http.StatusAccepted {
+		t.Fatalf("%d", status)
+	}
+	<-shutdown
+}
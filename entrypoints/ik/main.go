@@ -1,106 +1,471 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"github.com/moriyoshi/ik"
-	"github.com/moriyoshi/ik/parsers"
-	"github.com/moriyoshi/ik/plugins"
+	"github.com/moriyoshi/ik/daemon"
+	"github.com/moriyoshi/ik/embedded"
 	"github.com/op/go-logging"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 	flag.PrintDefaults()
+	fmt.Fprintf(os.Stderr, "\nTo run the test cases of a configuration: %s test -h\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "To replay the buffer of an output: %s replay -h\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "To list the chunks in the buffer of an output: %s buffer ls path...\n", os.Args[0])
 	os.Exit(255)
 }
 
-func configureScoreboards(logger ik.Logger, registry *MultiFactoryRegistry, engine ik.Engine, config *ik.Config) error {
-	for _, v := range config.Root.Elems {
-		switch v.Name {
-		case "scoreboard":
-			type_ := v.Attrs["type"]
-			scoreboardFactory := registry.LookupScoreboardFactory(type_)
-			if scoreboardFactory == nil {
-				return errors.New("Could not find scoreboard factory: " + type_)
-			}
-			scoreboard, err := scoreboardFactory.New(engine, registry, v)
-			if err != nil {
-				return err
-			}
-			err = engine.Launch(scoreboard)
-			if err != nil {
-				return err
-			}
-			logger.Info("Scoreboard plugin loaded: %s", scoreboardFactory.Name())
+func registerPlugins(registry *ik.MultiFactoryRegistry) error {
+	err := embedded.RegisterDefaultPlugins(registry)
+	if err != nil {
+		return err
+	}
+	err = registry.RegisterScoreboardFactory(&HTMLHTTPScoreboardFactory{})
+	if err != nil {
+		return err
+	}
+	return registry.RegisterScoreboardFactory(&HeartbeatScoreboardFactory{})
+}
+
+// newVerifier builds the verifier given by the -<prefix>-hmac-key or
+// -<prefix>-public-key flag.
+func newVerifier(prefix string, hmacKeyFile string, publicKeyFile string, insecure bool) (ik.ConfigVerifier, error) {
+	if hmacKeyFile != "" {
+		key, err := ioutil.ReadFile(hmacKeyFile)
+		if err != nil {
+			return nil, err
 		}
+		return ik.NewHMACConfigVerifier(key), nil
+	} else if publicKeyFile != "" {
+		pem, err := ioutil.ReadFile(publicKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return ik.NewPublicKeyConfigVerifier(pem)
+	} else if !insecure {
+		return nil, errors.New(fmt.Sprintf("either -%s-hmac-key or -%s-public-key must be specified", prefix, prefix))
 	}
-	return nil
+	return ik.InsecureConfigVerifier, nil
 }
 
 func main() {
 	logger := logging.MustGetLogger("ik")
 
+	if len(os.Args) > 1 && os.Args[1] == "test" {
+		os.Exit(runTests(logger, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(logger, os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "buffer" {
+		os.Exit(runBuffer(os.Args[2:]))
+	}
+
 	var config_file string
+	var remoteConfig string
+	var remoteConfigInterval time.Duration
+	var remoteConfigMaxSize int64
+	var remoteConfigCache string
+	var remoteConfigHMACKey string
+	var remoteConfigPublicKey string
+	var remoteConfigInsecure bool
+	var remoteConfigWebhook string
+	var selfUpdate string
+	var selfUpdateInterval time.Duration
+	var selfUpdateHMACKey string
+	var selfUpdatePublicKey string
+	var shutdownTimeout time.Duration
+	var handoffTimeout time.Duration
+	var controlListen string
+	var controlToken string
+	var controlConfig string
+	var pidFilePath string
+	var logFilePath string
+	var dryRun bool
+	var version bool
 	var help bool
 	flag.StringVar(&config_file, "c", "/etc/fluent/fluent.conf", "config file path (default: /etc/fluent/fluent.conf)")
+	flag.StringVar(&remoteConfig, "remote-config", "", "fetch the configuration from an http(s) URL or git+<url>#<ref>:<path> instead of the config file")
+	flag.DurationVar(&remoteConfigInterval, "remote-config-interval", 5*time.Minute, "interval to poll the remote configuration at (0 to disable)")
+	flag.Int64Var(&remoteConfigMaxSize, "remote-config-max-size", 1<<20, "largest size in bytes of the remote configuration to accept")
+	flag.StringVar(&remoteConfigCache, "remote-config-cache", "/var/lib/ik/remote-config", "directory to keep the last fetched remote configuration in")
+	flag.StringVar(&remoteConfigHMACKey, "remote-config-hmac-key", "", "file containing the key to verify HMAC-SHA256 signatures of the remote configuration with")
+	flag.StringVar(&remoteConfigPublicKey, "remote-config-public-key", "", "PEM file containing the public key to verify signatures of the remote configuration with")
+	flag.BoolVar(&remoteConfigInsecure, "remote-config-insecure", false, "apply the remote configuration without verifying its signature")
+	flag.StringVar(&remoteConfigWebhook, "remote-config-webhook", "", "address to accept POST requests triggering a fetch of the remote configuration at")
+	flag.StringVar(&selfUpdate, "self-update", "", "URL of the signed release manifest to update the binary from")
+	flag.DurationVar(&selfUpdateInterval, "self-update-interval", time.Hour, "interval to check the release manifest at")
+	flag.StringVar(&selfUpdateHMACKey, "self-update-hmac-key", "", "file containing the key to verify HMAC-SHA256 signatures of the release manifest with")
+	flag.StringVar(&selfUpdatePublicKey, "self-update-public-key", "", "PEM file containing the public key to verify signatures of the release manifest with")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", 0, "time to wait for the flushes in flight on shutdown before cancelling them (0 to wait for them)")
+	flag.DurationVar(&handoffTimeout, "handoff-timeout", 30*time.Second, "time to wait for the new binary to get ready on an upgrade before keeping on with the current one")
+	flag.StringVar(&controlListen, "control-listen", "", "address to serve the control API at, which requires -control-token or an <auth> element in -control-config")
+	flag.StringVar(&controlToken, "control-token", "", "file containing the bearer token the control API requires")
+	flag.StringVar(&controlConfig, "control-config", "", "config file of the control API, with an <auth> element and tls_cert, tls_key and tls_client_ca")
+	flag.StringVar(&pidFilePath, "pid-file", "", "file to write the PID to, which is locked while ik runs")
+	flag.StringVar(&logFilePath, "log-file", "", "file to log to instead of stderr, reopened on SIGUSR1")
+	flag.BoolVar(&dryRun, "dry-run", false, "check the configuration, reporting every error found, and exit")
+	flag.BoolVar(&version, "version", false, "show version")
 	flag.BoolVar(&help, "h", false, "show help")
 	flag.Parse()
 
-	if help || config_file == "" {
-		usage()
-	}
-
-	dir, file := path.Split(config_file)
-	opener := ik.DefaultOpener(dir)
-	config, err := ik.ParseConfig(opener, file)
-	if err != nil {
-		println(err.Error())
+	if version {
+		fmt.Println(ik.Version)
 		return
 	}
 
-	scorekeeper := ik.NewScorekeeper(logger)
+	if help || (config_file == "" && remoteConfig == "") {
+		usage()
+	}
 
-	registry := NewMultiFactoryRegistry(scorekeeper)
+	var logFile *daemon.LogFile
+	if logFilePath != "" {
+		var err error
+		logFile, err = daemon.OpenLogFile(logFilePath)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		defer logFile.Close()
+		logging.SetBackend(logging.NewLogBackend(logFile, "", log.LstdFlags))
+	}
+	// a process taking over from another creates the PID file once the
+	// other has let go of it
+	takeover := ik.NewTakeover()
+	var pidFile *daemon.PidFile
+	defer func() {
+		if pidFile != nil {
+			pidFile.Remove()
+		}
+	}()
+	if pidFilePath != "" && !dryRun && takeover == nil {
+		var err error
+		pidFile, err = daemon.CreatePidFile(pidFilePath)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+	}
 
-	for _, _plugin := range plugins.GetPlugins() {
-		switch plugin := _plugin.(type) {
-		case ik.InputFactory:
-			registry.RegisterInputFactory(plugin)
-		case ik.OutputFactory:
-			registry.RegisterOutputFactory(plugin)
+	var opener ik.Opener
+	var config *ik.Config
+	var watcher *ik.RemoteConfigWatcher
+	var err error
+	var reloader *ik.ConfigReloader
+	if remoteConfig != "" {
+		verifier, err := newVerifier("remote-config", remoteConfigHMACKey, remoteConfigPublicKey, remoteConfigInsecure)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		source, err := ik.NewRemoteConfigSource(logger, remoteConfig, path.Join(remoteConfigCache, "git"), 30*time.Second, remoteConfigMaxSize)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		// the reloader is not there until the engine is; the watcher only
+		// touches it once polling starts
+		watcher, err = ik.NewRemoteConfigWatcher(logger, source, verifier, nil, remoteConfigCache, remoteConfigInterval, ik.SystemClock)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		config, err = watcher.Initial()
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		opener = ik.DefaultOpener(remoteConfigCache)
+	} else {
+		dir, file := path.Split(config_file)
+		opener = ik.DefaultOpener(dir)
+		config, err = ik.ParseConfig(opener, file)
+		if err != nil {
+			println(err.Error())
+			return
 		}
 	}
 
-	for _, _plugin := range parsers.GetPlugins() {
-		registry.RegisterLineParserPlugin(_plugin)
+	if dryRun {
+		registry := ik.NewMultiFactoryRegistry(ik.NewScorekeeper(logger))
+		err = registerPlugins(registry)
+		if err != nil {
+			println(err.Error())
+			os.Exit(1)
+		}
+		errs := ik.ValidateOnly(logger, opener, registry, config)
+		for _, err := range errs {
+			fmt.Fprintln(os.Stderr, err.Error())
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		return
 	}
 
-	registry.RegisterScoreboardFactory(&HTMLHTTPScoreboardFactory{})
+	if takeover != nil {
+		// the journals are opened only once the process handing off has
+		// closed them
+		err = takeover.Ready()
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		if pidFilePath != "" {
+			pidFile, err = daemon.CreatePidFile(pidFilePath)
+			if err != nil {
+				println(err.Error())
+				return
+			}
+		}
+	}
 
-	router := ik.NewFluentRouter()
-	engine := ik.NewEngine(logger, opener, registry, scorekeeper, router)
+	pipeline, err := ik.NewPipeline(logger, opener, registerPlugins)
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	engine := pipeline.Engine()
+	// the engine is disposed before handing off to another process, and
+	// again on return
+	disposeOnce := sync.Once{}
+	dispose := func() error {
+		var err error
+		disposeOnce.Do(func() {
+			if shutdownTimeout <= 0 {
+				err = engine.Dispose()
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			err = engine.DisposeContext(ctx)
+		})
+		return err
+	}
 	defer func() {
-		err := engine.Dispose()
+		err := dispose()
 		if err != nil {
 			engine.Logger().Error("%s", err.Error())
 		}
 	}()
 
-	err = ik.NewFluentConfigurer(logger, registry, registry, router).Configure(engine, config)
+	reloader = pipeline.Reloader()
+	err = reloader.Load(config)
 	if err != nil {
 		println(err.Error())
 		return
 	}
-	err = configureScoreboards(logger, registry, engine, config)
+	err = pipeline.ConfigureScoreboards(config)
 	if err != nil {
 		println(err.Error())
 		return
 	}
-	engine.Start()
+	if watcher != nil {
+		watcher.SetReloader(reloader)
+		err = engine.Spawn(watcher)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		if remoteConfigWebhook != "" {
+			// listened on through ik.Listen to be handed off as well
+			listener, err := ik.Listen("tcp", remoteConfigWebhook)
+			if err != nil {
+				println(err.Error())
+				return
+			}
+			go func() {
+				err := http.Serve(listener, watcher)
+				if err != nil {
+					logger.Error("%s", err.Error())
+				}
+			}()
+		}
+	}
+	executable, err := os.Executable()
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	handoff := make(chan *ik.Handoff, 1)
+	var upgrading int32
+	// upgrade starts the executable to take over from the current process,
+	// and disposes of the engine once it is ready; on failure the current
+	// one keeps on
+	upgrade := func(executable string) error {
+		if !atomic.CompareAndSwapInt32(&upgrading, 0, 1) {
+			return errors.New("an upgrade is already in progress")
+		}
+		// take the sockets before the inputs close them
+		handover, err := ik.PrepareListenerHandover()
+		if err != nil {
+			atomic.StoreInt32(&upgrading, 0)
+			return err
+		}
+		handoff_, err := ik.StartHandoff(executable, os.Args, handover, handoffTimeout)
+		handover.Close()
+		if err != nil {
+			atomic.StoreInt32(&upgrading, 0)
+			return err
+		}
+		logger.Notice("Handing off to %s (pid %d)", executable, handoff_.Pid())
+		handoff <- handoff_
+		go func() {
+			err := dispose()
+			if err != nil {
+				logger.Error("%s", err.Error())
+			}
+		}()
+		return nil
+	}
+	if selfUpdate != "" {
+		verifier, err := newVerifier("self-update", selfUpdateHMACKey, selfUpdatePublicKey, false)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		updater, err := ik.NewSelfUpdater(logger, selfUpdate, verifier, selfUpdateInterval, engine.Clock())
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		err = engine.Spawn(updater)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		go func() {
+			<-updater.Updated()
+			err := upgrade(updater.Executable())
+			if err != nil {
+				logger.Error("keeping on with the current binary: %s", err.Error())
+			}
+		}()
+	}
+	reload := func() error {
+		if watcher != nil {
+			watcher.Trigger()
+			return nil
+		}
+		config, err := ik.ParseConfig(opener, path.Base(config_file))
+		if err != nil {
+			return err
+		}
+		return reloader.Load(config)
+	}
+	handlers := daemon.Handlers{
+		Shutdown: dispose,
+		Reload:   reload,
+		DumpStats: func() error {
+			daemon.DumpStats(engine)
+			return nil
+		},
+	}
+	if logFile != nil {
+		handlers.ReopenLogs = logFile.Reopen
+	}
+	err = engine.Spawn(daemon.NewSignals(logger, handlers))
+	if err != nil {
+		println(err.Error())
+		return
+	}
+	if controlListen != "" {
+		handler := &controlHandler{
+			logger: logger,
+			engine: engine,
+			reload: reload,
+			upgrade: func() error {
+				return upgrade(executable)
+			},
+			shutdown: func() {
+				err := dispose()
+				if err != nil {
+					logger.Error("%s", err.Error())
+				}
+			},
+		}
+		server := &http.Server{Handler: handler}
+		if controlConfig != "" {
+			dir, file := path.Split(controlConfig)
+			controlConfig_, err := ik.ParseConfig(ik.DefaultOpener(dir), file)
+			if err != nil {
+				println(err.Error())
+				return
+			}
+			handler.auth, err = ik.ParseHTTPAuth(controlConfig_.Root)
+			if err != nil {
+				println(err.Error())
+				return
+			}
+			server.TLSConfig, err = ik.ParseTLSServerConfig(controlConfig_.Root)
+			if err != nil {
+				println(err.Error())
+				return
+			}
+		}
+		if controlToken != "" {
+			token, err := ioutil.ReadFile(controlToken)
+			if err != nil {
+				println(err.Error())
+				return
+			}
+			// the token is granted everything, as it was before the scopes
+			if handler.auth == nil {
+				handler.auth = ik.NewHTTPAuth("ik")
+			}
+			handler.auth.Add(ik.NewAPIKeyAuthenticator(strings.TrimSpace(string(token)), []string{"*"}))
+		}
+		if handler.auth == nil {
+			println("-control-listen requires -control-token or an <auth> element in -control-config")
+			return
+		}
+		listener, err := ik.Listen("tcp", controlListen)
+		if err != nil {
+			println(err.Error())
+			return
+		}
+		go func() {
+			var err error
+			if server.TLSConfig != nil {
+				err = server.ServeTLS(listener, "", "")
+			} else {
+				err = server.Serve(listener)
+			}
+			if err != nil {
+				logger.Error("%s", err.Error())
+			}
+		}()
+	}
+	if takeover != nil {
+		takeover.Running()
+	}
+	pipeline.Start()
+	select {
+	case handoff_ := <-handoff:
+		if pidFile != nil {
+			pidFile.Remove()
+			pidFile = nil
+		}
+		err = handoff_.Release()
+		if err != nil {
+			logger.Error("%s", err.Error())
+		}
+	default:
+	}
 }
 
 // vim: sts=4 sw=4 ts=4 noet
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	jnl "github.com/moriyoshi/ik/journal"
+	"github.com/moriyoshi/ik/plugins"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+func replayUsage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage of %s replay: %s replay -buffer-path path [-forward host:port] [options]\n", os.Args[0], os.Args[0])
+	flags.PrintDefaults()
+}
+
+// printPort writes the records to the standard output, a JSON object of
+// the tag, the time and the record a line.
+type printPort struct {
+	encoder *json.Encoder
+}
+
+func (port *printPort) Emit(recordSets []ik.FluentRecordSet) error {
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			err := port.encoder.Encode(map[string]interface{}{
+				"tag":    recordSet.Tag,
+				"time":   record.Timestamp,
+				"record": record.Data,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func parseReplayTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// runReplay replays the buffer of an output to a forward input, or prints
+// the records if no -forward is given, and returns the exit status.
+func runReplay(logger ik.Logger, args []string) int {
+	params := plugins.ReplayParams{}
+	var since, until, forward, keyPath string
+	var requireAck bool
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	flags.StringVar(&params.BufferPath, "buffer-path", "", "buffer_path of the output")
+	flags.StringVar(&params.Format, "format", "json", "how the records are packed: json, kafka or msgpack")
+	flags.StringVar(&params.Tag, "tag", "", "tag of the records (default: the key of the chunk)")
+	flags.StringVar(&params.TagKey, "tag-key", "", "field to take the tag from")
+	flags.StringVar(&params.TimeKey, "time-key", "", "field to take the time from")
+	flags.StringVar(&params.Pattern, "match", "", "replay only the tags matching the pattern")
+	flags.StringVar(&since, "since", "", "replay only the records at or after the time (RFC 3339)")
+	flags.StringVar(&until, "until", "", "replay only the records before the time (RFC 3339)")
+	flags.StringVar(&forward, "forward", "", "host:port of the forward input to replay to")
+	flags.BoolVar(&requireAck, "require-ack", false, "wait for the forward input to acknowledge each chunk")
+	flags.StringVar(&keyPath, "encryption-key-path", "", "file of the buffer_encryption_keys the chunks are sealed with")
+	flags.Usage = func() { replayUsage(flags) }
+	err := flags.Parse(args)
+	if err != nil || params.BufferPath == "" || flags.NArg() != 0 {
+		replayUsage(flags)
+		return 255
+	}
+	params.Since, err = parseReplayTime(since)
+	if err == nil {
+		params.Until, err = parseReplayTime(until)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 255
+	}
+	if keyPath != "" {
+		keys, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+		params.Encryption, err = jnl.ParseChunkEncryptionKeys(string(keys))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			return 1
+		}
+	}
+
+	var count int
+	if forward != "" {
+		count, err = plugins.ReplayBufferToForward(logger, params, forward, requireAck)
+	} else {
+		count, err = plugins.ReplayBuffer(logger, params, &printPort{json.NewEncoder(os.Stdout)})
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%d records replayed\n", count)
+	return 0
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type heartbeatPluginInstance struct {
+	Plugin    string            `json:"plugin"`
+	Type      string            `json:"type"`
+	Id        int               `json:"id"`
+	Status    string            `json:"status"`
+	State     string            `json:"state,omitempty"`
+	StartedAt *time.Time        `json:"started_at,omitempty"`
+	Restarts  int               `json:"restarts"`
+	Panics    int               `json:"panics"`
+	LastError string            `json:"last_error,omitempty"`
+	Health    string            `json:"health,omitempty"`
+	Topics    map[string]string `json:"topics"`
+}
+
+type heartbeatRegistration struct {
+	AgentId      string            `json:"agent_id"`
+	Hostname     string            `json:"hostname"`
+	Version      string            `json:"version"`
+	OS           string            `json:"os"`
+	Arch         string            `json:"arch"`
+	Pid          int               `json:"pid"`
+	StartedAt    time.Time         `json:"started_at"`
+	ConfigDigest string            `json:"config_digest"`
+	Metadata     map[string]string `json:"metadata"`
+}
+
+type heartbeat struct {
+	AgentId      string                    `json:"agent_id"`
+	Time         time.Time                 `json:"time"`
+	ConfigDigest string                    `json:"config_digest"`
+	Engine       map[string]string         `json:"engine"`
+	Plugins      []heartbeatPluginInstance `json:"plugins"`
+}
+
+// HeartbeatScoreboard registers the agent with a central endpoint and then
+// reports the scorekeeper topics of the engine and of every plugin instance
+// on the interval.
+type HeartbeatScoreboard struct {
+	factory    *HeartbeatScoreboardFactory
+	logger     ik.Logger
+	engine     ik.Engine
+	client     *http.Client
+	endpoint   string
+	authToken  string
+	agentId    string
+	hostname   string
+	metadata   map[string]string
+	startedAt  time.Time
+	registered bool
+	interval   time.Duration
+	ticker     *time.Ticker
+	kick       chan bool
+	cancel     chan bool
+	failures   int64
+}
+
+type HeartbeatScoreboardFactory struct {
+}
+
+type heartbeatFailureCountFetcher struct{}
+
+func (fetcher *heartbeatFailureCountFetcher) Markup(scoreboard_ ik.PluginInstance) (ik.Markup, error) {
+	text, err := fetcher.PlainText(scoreboard_)
+	if err != nil {
+		return ik.Markup{}, err
+	}
+	return ik.Markup{[]ik.MarkupChunk{{Attrs: 0, Text: text}}}, nil
+}
+
+func (fetcher *heartbeatFailureCountFetcher) PlainText(scoreboard_ ik.PluginInstance) (string, error) {
+	scoreboard := scoreboard_.(*HeartbeatScoreboard)
+	return fmt.Sprintf("%d", atomic.LoadInt64(&scoreboard.failures)), nil
+}
+
+func (scoreboard *HeartbeatScoreboard) configDigest() string {
+	fetcher, err := scoreboard.engine.Scorekeeper().Fetch(ik.EnginePlugin, "config_digest")
+	if err != nil {
+		return ""
+	}
+	digest, err := fetcher.PlainText(nil)
+	if err != nil {
+		return ""
+	}
+	return digest
+}
+
+func fetchPlainTextTopics(engine ik.Engine, plugin ik.Plugin, pluginInstance ik.PluginInstance) map[string]string {
+	topics := engine.Scorekeeper().GetTopics(plugin)
+	retval := make(map[string]string, len(topics))
+	for _, topic := range topics {
+		value, err := topic.Fetcher.PlainText(pluginInstance)
+		if err != nil {
+			value = "Error: " + err.Error()
+		}
+		retval[topic.Name] = value
+	}
+	return retval
+}
+
+// describePluginInstances returns the plugin instances of the engine with
+// their statuses and topics, along with the instances by their ids.
+func describePluginInstances(engine ik.Engine) ([]heartbeatPluginInstance, map[int]ik.PluginInstance, error) {
+	spawneeStatuses, err := engine.SpawneeStatuses()
+	if err != nil {
+		return nil, nil, err
+	}
+	statuses := make(map[ik.Spawnee]ik.SpawneeStatus, len(spawneeStatuses))
+	for _, spawneeStatus := range spawneeStatuses {
+		statuses[spawneeStatus.Spawnee] = spawneeStatus
+	}
+	pluginInstances := engine.PluginInstances()
+	retval := make([]heartbeatPluginInstance, 0, len(pluginInstances))
+	byId := make(map[int]ik.PluginInstance, len(pluginInstances))
+	for _, pluginInstance := range pluginInstances {
+		plugin := pluginInstance.Factory()
+		entry := heartbeatPluginInstance{
+			Plugin: plugin.Name(),
+			Type:   renderPluginType(plugin),
+			Status: "unknown",
+			Topics: fetchPlainTextTopics(engine, plugin, pluginInstance),
+		}
+		spawneeStatus, ok := statuses[pluginInstance]
+		if ok {
+			entry.Id = spawneeStatus.Id
+			entry.Status = renderExitStatusLabel(spawneeStatus.ExitStatus)
+			entry.State = spawneeStatus.State
+			entry.StartedAt = &spawneeStatus.StartedAt
+			entry.Restarts = spawneeStatus.Restarts
+			entry.Panics = spawneeStatus.Panics
+			if spawneeStatus.LastError != nil {
+				entry.LastError = spawneeStatus.LastError.Error()
+			}
+			if spawneeStatus.HealthChecked {
+				entry.Health = renderHealthLabel(spawneeStatus.Health)
+			}
+			byId[entry.Id] = pluginInstance
+		}
+		retval = append(retval, entry)
+	}
+	return retval, byId, nil
+}
+
+func (scoreboard *HeartbeatScoreboard) buildHeartbeat() (*heartbeat, error) {
+	plugins, _, err := describePluginInstances(scoreboard.engine)
+	if err != nil {
+		return nil, err
+	}
+	return &heartbeat{
+		AgentId:      scoreboard.agentId,
+		Time:         time.Now(),
+		ConfigDigest: scoreboard.configDigest(),
+		Engine:       fetchPlainTextTopics(scoreboard.engine, ik.EnginePlugin, nil),
+		Plugins:      plugins,
+	}, nil
+}
+
+func (scoreboard *HeartbeatScoreboard) post(path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", scoreboard.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if scoreboard.authToken != "" {
+		req.Header.Set("Authorization", "Bearer "+scoreboard.authToken)
+	}
+	resp, err := scoreboard.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New(fmt.Sprintf("%s returned %s: %s", scoreboard.endpoint+path, resp.Status, strings.TrimSpace(string(message))))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+func (scoreboard *HeartbeatScoreboard) register() error {
+	return scoreboard.post("/register", &heartbeatRegistration{
+		AgentId:      scoreboard.agentId,
+		Hostname:     scoreboard.hostname,
+		Version:      ik.Version,
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Pid:          os.Getpid(),
+		StartedAt:    scoreboard.startedAt,
+		ConfigDigest: scoreboard.configDigest(),
+		Metadata:     scoreboard.metadata,
+	})
+}
+
+// beat registers the agent first if it has not been registered yet, so that
+// the registration is retried on every tick until it succeeds.
+func (scoreboard *HeartbeatScoreboard) beat() error {
+	if !scoreboard.registered {
+		err := scoreboard.register()
+		if err != nil {
+			return err
+		}
+		scoreboard.registered = true
+		scoreboard.logger.Info("Registered as %s at %s", scoreboard.agentId, scoreboard.endpoint)
+	}
+	heartbeat, err := scoreboard.buildHeartbeat()
+	if err != nil {
+		return err
+	}
+	return scoreboard.post("/heartbeat", heartbeat)
+}
+
+func (scoreboard *HeartbeatScoreboard) Run() error {
+	select {
+	case <-scoreboard.cancel:
+		return nil
+	case <-scoreboard.kick:
+	case <-scoreboard.ticker.C:
+	}
+	err := scoreboard.beat()
+	if err != nil {
+		atomic.AddInt64(&scoreboard.failures, 1)
+		scoreboard.logger.Error("%s", err.Error())
+	}
+	return ik.Continue
+}
+
+func (scoreboard *HeartbeatScoreboard) Shutdown() error {
+	scoreboard.ticker.Stop()
+	scoreboard.cancel <- true
+	return nil
+}
+
+func (scoreboard *HeartbeatScoreboard) Factory() ik.Plugin {
+	return scoreboard.factory
+}
+
+func (factory *HeartbeatScoreboardFactory) Name() string {
+	return "heartbeat"
+}
+
+func (factory *HeartbeatScoreboardFactory) New(engine ik.Engine, registry ik.PluginRegistry, config *ik.ConfigElement) (ik.Scoreboard, error) {
+	endpoint, ok := config.Attrs["endpoint"]
+	if !ok {
+		return nil, errors.New("required attribute `endpoint' is not specified")
+	}
+	interval := time.Duration(60 * time.Second)
+	intervalStr, ok := config.Attrs["interval"]
+	if ok {
+		var err error
+		interval, err = time.ParseDuration(intervalStr)
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, errors.New("invalid interval: " + intervalStr)
+		}
+	}
+	timeout := time.Duration(10 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	agentId, ok := config.Attrs["agent_id"]
+	if !ok {
+		agentId = hostname
+	}
+	metadata := make(map[string]string)
+	for _, elem := range config.Elems {
+		if elem.Name == "metadata" {
+			for name, value := range elem.Attrs {
+				metadata[name] = value
+			}
+		}
+	}
+	// kick off the first beat without waiting for the interval
+	kick := make(chan bool, 1)
+	kick <- true
+	return &HeartbeatScoreboard{
+		factory:    factory,
+		logger:     engine.Logger(),
+		engine:     engine,
+		client:     &http.Client{Timeout: timeout},
+		endpoint:   strings.TrimRight(endpoint, "/"),
+		authToken:  config.Attrs["auth_token"],
+		agentId:    agentId,
+		hostname:   hostname,
+		metadata:   metadata,
+		startedAt:  time.Now(),
+		registered: false,
+		interval:   interval,
+		ticker:     time.NewTicker(interval),
+		kick:       kick,
+		cancel:     make(chan bool),
+		failures:   0,
+	}, nil
+}
+
+func (factory *HeartbeatScoreboardFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+	scorekeeper.AddTopic(ik.ScorekeeperTopic{
+		Plugin:      factory,
+		Name:        "failures",
+		DisplayName: "Failures",
+		Description: "Number of registrations and heartbeats that failed",
+		Fetcher:     &heartbeatFailureCountFetcher{},
+	})
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -127,6 +128,35 @@ h1 {
 {{end}}
 </dd>
 </dl>
+<h2>Engine</h2>
+{{if len .EngineTopics}}
+<table class="table">
+  <thead>
+    <tr>
+      <th>Name</th>
+      <th>Value</th>
+      {{range $.HistoryWindows}}
+      <th>{{.}}</th>
+      {{end}}
+      <th>Description</th>
+    </tr>
+  </thead>
+  <tbody>
+    {{range .EngineTopics}}
+    <tr>
+      <th>{{.DisplayName}} ({{.Name}})</th>
+      <td>{{renderMarkup .Value}}</td>
+      {{range .Trends}}
+      <td class="trend">{{.}}</td>
+      {{end}}
+      <td>{{.Description}}</td>
+    </tr>
+    {{end}}
+  </tbody>
+</table>
+{{else}}
+No topics available
+{{end}}
 <h2>Plugin Statuses</h2>
 {{range $plugin, $pluginInstanceStatuses := .PluginInstanceStatusesPerPlugin}}
 <h3>{{renderPluginName $plugin}}</h3>
@@ -143,6 +173,34 @@ h1 {
       <th>Status</th>
       <td class="exitStatus {{renderExitStatusStyle .ExitStatus}}">{{renderExitStatusLabel .ExitStatus}}</td>
     </tr>
+    <tr>
+      <th>State</th>
+      <td>{{.State}}</td>
+    </tr>
+    <tr>
+      <th>Started at</th>
+      <td>{{.StartedAt.Format "2006-01-02T15:04:05Z07:00"}}</td>
+    </tr>
+    <tr>
+      <th>Restarts</th>
+      <td>{{.Restarts}}</td>
+    </tr>
+    <tr>
+      <th>Panics</th>
+      <td>{{.Panics}}</td>
+    </tr>
+    {{with .LastError}}
+    <tr>
+      <th>Last error</th>
+      <td>{{.Error}}</td>
+    </tr>
+    {{end}}
+    {{if .HealthChecked}}
+    <tr>
+      <th>Health</th>
+      <td class="exitStatus {{renderHealthStyle .Health}}">{{renderHealthLabel .Health}}</td>
+    </tr>
+    {{end}}
   </tbody>
 </table>
 {{end}}
@@ -153,6 +211,9 @@ h1 {
     <tr>
       <th>Name</th>
       <th>Value</th>
+      {{range $.HistoryWindows}}
+      <th>{{.}}</th>
+      {{end}}
       <th>Description</th>
     </tr>
   </thead>
@@ -161,6 +222,9 @@ h1 {
     <tr>
       <th>{{.DisplayName}} ({{.Name}})</th>
       <td>{{renderMarkup .Value}}</td>
+      {{range .Trends}}
+      <td class="trend">{{.}}</td>
+      {{end}}
       <td>{{.Description}}</td>
     </tr>
     {{end}}
@@ -195,6 +259,9 @@ type pluginInstanceStatusTopic struct {
 	DisplayName string
 	Description string
 	Value       ik.Markup
+	// Trends are the deltas and the rates over ik.ScoreHistoryWindows,
+	// empty if the topic has no history.
+	Trends []string
 }
 
 type pluginInstanceStatus struct {
@@ -209,8 +276,10 @@ type viewModel struct {
 	OutputPlugins                   []ik.OutputFactory
 	ScoreboardPlugins               []ik.ScoreboardFactory
 	Plugins                         []ik.Plugin
+	EngineTopics                    []pluginInstanceStatusTopic
 	PluginInstanceStatusesPerPlugin map[ik.Plugin][]pluginInstanceStatus
 	SpawneeStatuses                 map[ik.Spawnee]ik.SpawneeStatus
+	HistoryWindows                  []string
 }
 
 type requestCountFetcher struct{}
@@ -225,7 +294,7 @@ func (fetcher *requestCountFetcher) Markup(scoreboard_ ik.PluginInstance) (ik.Ma
 
 func (fetcher *requestCountFetcher) PlainText(scoreboard_ ik.PluginInstance) (string, error) {
 	scoreboard := scoreboard_.(*HTMLHTTPScoreboard)
-	return strconv.FormatInt(scoreboard.requests, 10), nil
+	return strconv.FormatInt(atomic.LoadInt64(&scoreboard.requests), 10), nil
 }
 
 func spawneeName(spawnee ik.Spawnee) string {
@@ -257,6 +326,20 @@ func renderExitStatusLabel(err error) string {
 	}
 }
 
+func renderHealthStyle(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "running"
+}
+
+func renderHealthLabel(err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	return "Healthy"
+}
+
 func renderMarkup(markup_ ik.Markup) template.HTML {
 	buf := &bytes.Buffer{}
 	renderer := &markup.HTMLRenderer{Out: buf}
@@ -303,6 +386,58 @@ func (factory *HTMLHTTPScoreboardFactory) Name() string {
 	return "html_http"
 }
 
+// renderHistoryWindow renders a window without the units of zero, as "1m"
+// rather than "1m0s".
+func renderHistoryWindow(window time.Duration) string {
+	text := window.String()
+	for strings.HasSuffix(text, "m0s") || strings.HasSuffix(text, "h0m") {
+		text = text[:len(text)-2]
+	}
+	return text
+}
+
+// renderTrend renders the delta and the rate of the history over the
+// window, as "+120 (2.00/s)".
+func renderTrend(history *ik.ScoreHistory, window time.Duration) string {
+	if history == nil {
+		return ""
+	}
+	delta, _, ok := history.Delta(window)
+	rate, ok_ := history.Rate(window)
+	if !ok || !ok_ {
+		return ""
+	}
+	sign := ""
+	if delta >= 0 {
+		sign = "+"
+	}
+	return fmt.Sprintf("%s%s (%s/s)", sign, strconv.FormatFloat(delta, 'f', -1, 64), strconv.FormatFloat(rate, 'f', 2, 64))
+}
+
+func (scoreboard *HTMLHTTPScoreboard) fetchTopics(plugin ik.Plugin, pluginInstance ik.PluginInstance) []pluginInstanceStatusTopic {
+	scorekeeper := scoreboard.engine.Scorekeeper()
+	topics_ := scorekeeper.GetTopics(plugin)
+	topics := make([]pluginInstanceStatusTopic, len(topics_))
+	for i, topic_ := range topics_ {
+		var err error
+		topics[i].Name = topic_.Name
+		topics[i].DisplayName = topic_.DisplayName
+		topics[i].Description = topic_.Description
+		history := scorekeeper.History(plugin, topic_.Name, pluginInstance)
+		topics[i].Trends = make([]string, len(ik.ScoreHistoryWindows))
+		for j, window := range ik.ScoreHistoryWindows {
+			topics[i].Trends[j] = renderTrend(history, window)
+		}
+		topics[i].Value, err = topic_.Fetcher.Markup(pluginInstance)
+		if err != nil {
+			errorMessage := err.Error()
+			scoreboard.logger.Error("%s", errorMessage)
+			topics[i].Value = ik.Markup{[]ik.MarkupChunk{{Attrs: ik.Embolden, Text: fmt.Sprintf("Error: %s", errorMessage)}}}
+		}
+	}
+	return topics
+}
+
 func (scoreboard *HTMLHTTPScoreboard) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	atomic.AddInt64(&scoreboard.requests, 1)
 	resp.Header().Set("Content-Type", "text/html; charset=utf-8")
@@ -328,23 +463,15 @@ func (scoreboard *HTMLHTTPScoreboard) ServeHTTP(resp http.ResponseWriter, req *h
 			scoreboardPlugins = append(scoreboardPlugins, plugin_)
 		}
 	}
+	historyWindows := make([]string, len(ik.ScoreHistoryWindows))
+	for i, window := range ik.ScoreHistoryWindows {
+		historyWindows[i] = renderHistoryWindow(window)
+	}
 	pluginInstances := scoreboard.engine.PluginInstances()
 	pluginInstanceStatusesPerPlugin := make(map[ik.Plugin][]pluginInstanceStatus)
 	for i, pluginInstance := range pluginInstances {
 		plugin := pluginInstance.Factory()
-		topics_ := scoreboard.engine.Scorekeeper().GetTopics(plugin)
-		topics := make([]pluginInstanceStatusTopic, len(topics_))
-		for i, topic_ := range topics_ {
-			topics[i].Name = topic_.Name
-			topics[i].DisplayName = topic_.DisplayName
-			topics[i].Description = topic_.Description
-			topics[i].Value, err = topic_.Fetcher.Markup(pluginInstance)
-			if err != nil {
-				errorMessage := err.Error()
-				scoreboard.logger.Error("%s", errorMessage)
-				topics[i].Value = ik.Markup{[]ik.MarkupChunk{{Attrs: ik.Embolden, Text: fmt.Sprintf("Error: %s", errorMessage)}}}
-			}
-		}
+		topics := scoreboard.fetchTopics(plugin, pluginInstance)
 		pluginInstanceStatus_ := pluginInstanceStatus{
 			Id:             i + 1,
 			PluginInstance: pluginInstance,
@@ -366,16 +493,20 @@ func (scoreboard *HTMLHTTPScoreboard) ServeHTTP(resp http.ResponseWriter, req *h
 		OutputPlugins:     outputPlugins,
 		ScoreboardPlugins: scoreboardPlugins,
 		Plugins:           plugins,
+		EngineTopics:      scoreboard.fetchTopics(ik.EnginePlugin, nil),
 		PluginInstanceStatusesPerPlugin: pluginInstanceStatusesPerPlugin,
 		SpawneeStatuses:                 spawneeStatuses,
+		HistoryWindows:                  historyWindows,
 	})
 }
 
-func newHTMLHTTPScoreboard(factory *HTMLHTTPScoreboardFactory, logger ik.Logger, engine ik.Engine, registry ik.PluginRegistry, bind string, readTimeout time.Duration, writeTimeout time.Duration) (*HTMLHTTPScoreboard, error) {
+func newHTMLHTTPScoreboard(factory *HTMLHTTPScoreboardFactory, logger ik.Logger, engine ik.Engine, registry ik.PluginRegistry, bind string, readTimeout time.Duration, writeTimeout time.Duration, handlerOptions *ik.HTTPHandlerOptions) (*HTMLHTTPScoreboard, error) {
 	template_, err := template.New("main").Funcs(template.FuncMap{
 		"spawneeName":           spawneeName,
 		"renderExitStatusStyle": renderExitStatusStyle,
 		"renderExitStatusLabel": renderExitStatusLabel,
+		"renderHealthStyle":     renderHealthStyle,
+		"renderHealthLabel":     renderHealthLabel,
 		"renderMarkup":          renderMarkup,
 		"renderPluginName":      renderPluginName,
 		"renderPluginType":      renderPluginType,
@@ -393,7 +524,7 @@ func newHTMLHTTPScoreboard(factory *HTMLHTTPScoreboardFactory, logger ik.Logger,
 		TLSConfig:      nil,
 		TLSNextProto:   nil,
 	}
-	listener, err := net.Listen("tcp", bind)
+	listener, err := ik.Listen("tcp", bind)
 	if err != nil {
 		logger.Error("%s", err.Error())
 		return nil, err
@@ -408,7 +539,7 @@ func newHTMLHTTPScoreboard(factory *HTMLHTTPScoreboardFactory, logger ik.Logger,
 		listener: listener,
 		requests: 0,
 	}
-	retval.server.Handler = retval
+	retval.server.Handler = ik.WrapHTTPHandler(retval, handlerOptions)
 	return retval, nil
 }
 
@@ -446,7 +577,12 @@ func (factory *HTMLHTTPScoreboardFactory) New(engine ik.Engine, registry ik.Plug
 			writeTimeout = time.Duration(value)
 		}
 	}
-	return newHTMLHTTPScoreboard(factory, engine.Logger(), engine, registry, bind, readTimeout, writeTimeout)
+	handlerOptions, err := ik.ParseHTTPHandlerOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	handlerOptions.AuthScope = "read"
+	return newHTMLHTTPScoreboard(factory, engine.Logger(), engine, registry, bind, readTimeout, writeTimeout, handlerOptions)
 }
 
 func (factory *HTMLHTTPScoreboardFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
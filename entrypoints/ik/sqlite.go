@@ -0,0 +1,9 @@
+//go:build cgo && !ik_nosqlite
+// +build cgo,!ik_nosqlite
+
+package main
+
+// The driver buffer_type sqlite and pos_store sqlite reach their databases
+// through by default ("sqlite3"); the builds tagged ik_nosqlite, or made
+// without cgo, leave it out and turn both down as the configuration is read.
+import _ "github.com/mattn/go-sqlite3"
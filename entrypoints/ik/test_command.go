@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// testRecord is a record in a test case.  Time is optional in the expected
+// records, in which case the time of the actual record is not looked at.
+type testRecord struct {
+	Input  string                 `json:"input"`
+	Tag    string                 `json:"tag"`
+	Time   *uint64                `json:"time"`
+	Record map[string]interface{} `json:"record"`
+}
+
+// testCase feeds the records in Feed to the inputs they name, or to the
+// router if they name none, and compares what reaches each of the outputs
+// listed in Expect, by id, with the records listed.  The fields listed in
+// IgnoreKeys are removed from the actual records before comparing.
+type testCase struct {
+	Feed       []testRecord            `json:"feed"`
+	Expect     map[string][]testRecord `json:"expect"`
+	IgnoreKeys []string                `json:"ignore_keys"`
+}
+
+func testUsage(flags *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage of %s test: %s test [-c config] case.json...\n", os.Args[0], os.Args[0])
+	flags.PrintDefaults()
+}
+
+// normalizeRecord makes a record comparable with one read from JSON.
+func normalizeRecord(data map[string]interface{}, ignoreKeys []string) (interface{}, error) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return nil, err
+	}
+	var retval map[string]interface{}
+	err = json.Unmarshal(b, &retval)
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range ignoreKeys {
+		delete(retval, key)
+	}
+	return retval, nil
+}
+
+func compareRecords(id string, expected []testRecord, recordSets []ik.FluentRecordSet, ignoreKeys []string) []string {
+	failures := make([]string, 0)
+	actual := make([]testRecord, 0)
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			timestamp := record.Timestamp
+			actual = append(actual, testRecord{Tag: recordSet.Tag, Time: &timestamp, Record: record.Data})
+		}
+	}
+	if len(actual) != len(expected) {
+		failures = append(failures, fmt.Sprintf("%s: expected %d records, got %d", id, len(expected), len(actual)))
+	}
+	for i, record := range actual {
+		if i >= len(expected) {
+			break
+		}
+		expected_ := expected[i]
+		data, err := normalizeRecord(record.Record, ignoreKeys)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: record #%d: %s", id, i+1, err.Error()))
+			continue
+		}
+		expectedData, _ := normalizeRecord(expected_.Record, nil)
+		if record.Tag != expected_.Tag {
+			failures = append(failures, fmt.Sprintf("%s: record #%d: expected tag %s, got %s", id, i+1, expected_.Tag, record.Tag))
+		}
+		if expected_.Time != nil && *record.Time != *expected_.Time {
+			failures = append(failures, fmt.Sprintf("%s: record #%d: expected time %d, got %d", id, i+1, *expected_.Time, *record.Time))
+		}
+		if !reflect.DeepEqual(data, expectedData) {
+			b, _ := json.Marshal(data)
+			expectedB, _ := json.Marshal(expectedData)
+			failures = append(failures, fmt.Sprintf("%s: record #%d: expected %s, got %s", id, i+1, string(expectedB), string(b)))
+		}
+	}
+	return failures
+}
+
+func runTestCase(logger ik.Logger, opener ik.Opener, registry *ik.MultiFactoryRegistry, config *ik.Config, testCase *testCase) ([]string, error) {
+	harness, err := ik.NewHarness(logger, opener, registry, registry, config)
+	if err != nil {
+		return nil, err
+	}
+	defer harness.Dispose()
+	now := uint64(time.Now().Unix())
+	for i, record := range testCase.Feed {
+		timestamp := now
+		if record.Time != nil {
+			timestamp = *record.Time
+		}
+		err := harness.Emit(record.Input, []ik.FluentRecordSet{{
+			Tag:     record.Tag,
+			Records: []ik.TinyFluentRecord{{Timestamp: timestamp, Data: record.Record}},
+		}})
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("feeding record #%d: %s", i+1, err.Error()))
+		}
+	}
+	ids := make([]string, 0, len(testCase.Expect))
+	for id, _ := range testCase.Expect {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	failures := make([]string, 0)
+	for _, id := range ids {
+		expected := testCase.Expect[id]
+		output := harness.Output(id)
+		if output == nil {
+			failures = append(failures, "no such output: "+id)
+			continue
+		}
+		failures = append(failures, compareRecords(id, expected, output.RecordSets(), testCase.IgnoreKeys)...)
+	}
+	return failures, nil
+}
+
+// runTests runs the test cases given on the command line against the
+// configuration, with every output replaced by one capturing the records,
+// and returns the exit status.
+func runTests(logger ik.Logger, args []string) int {
+	var config_file string
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.StringVar(&config_file, "c", "/etc/fluent/fluent.conf", "config file path (default: /etc/fluent/fluent.conf)")
+	flags.Usage = func() { testUsage(flags) }
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() == 0 {
+		testUsage(flags)
+		return 255
+	}
+
+	dir, file := path.Split(config_file)
+	opener := ik.DefaultOpener(dir)
+	config, err := ik.ParseConfig(opener, file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	registry := ik.NewMultiFactoryRegistry(ik.NewScorekeeper(logger))
+	err = registerPlugins(registry)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+
+	status := 0
+	for _, caseFile := range flags.Args() {
+		b, err := ioutil.ReadFile(caseFile)
+		if err != nil {
+			fmt.Printf("FAIL\t%s\n\t%s\n", caseFile, err.Error())
+			status = 1
+			continue
+		}
+		testCase := &testCase{}
+		err = json.Unmarshal(b, testCase)
+		if err != nil {
+			fmt.Printf("FAIL\t%s\n\t%s\n", caseFile, err.Error())
+			status = 1
+			continue
+		}
+		failures, err := runTestCase(logger, opener, registry, config, testCase)
+		if err != nil {
+			failures = []string{err.Error()}
+		}
+		if len(failures) == 0 {
+			fmt.Printf("ok\t%s\n", caseFile)
+			continue
+		}
+		status = 1
+		fmt.Printf("FAIL\t%s\n", caseFile)
+		for _, failure := range failures {
+			fmt.Printf("\t%s\n", failure)
+		}
+	}
+	return status
+}
@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package ik
+
+import (
+	"os"
+	"syscall"
+)
+
+func clearCloseOnExec(file *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_FCNTL, file.Fd(), syscall.F_SETFD, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func execProcess(executable string, args []string, env []string) error {
+	return syscall.Exec(executable, args, env)
+}
@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package ik
+
+import (
+	"errors"
+	"os"
+)
+
+func clearCloseOnExec(file *os.File) error {
+	return nil
+}
+
+func execProcess(executable string, args []string, env []string) error {
+	return errors.New("replacing the process is not supported on Windows")
+}
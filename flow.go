@@ -0,0 +1,188 @@
+package ik
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	flowSlotDuration = 5 * time.Second
+	flowSlots        = 180 // 15 minutes
+)
+
+// FlowWindows are the windows the flow rates are given over.
+var FlowWindows = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute}
+
+// FlowRate is the average flow over a window, in records and bytes per
+// second.  The bytes are those of the packed record sets, or the
+// approximate size of their records as told by RecordSize.
+type FlowRate struct {
+	Window  time.Duration `json:"-"`
+	Records float64       `json:"records_per_sec"`
+	Bytes   float64       `json:"bytes_per_sec"`
+}
+
+type flowSlot struct {
+	epoch   int64
+	records int64
+	bytes   int64
+}
+
+// FlowCounter counts the records and the bytes that flow through a point
+// of the pipeline within the last 15 minutes, in slots of 5 seconds that
+// expire one at a time.
+type FlowCounter struct {
+	slots [flowSlots]flowSlot
+	since time.Time
+	clock Clock
+	mtx   sync.Mutex
+}
+
+// FlowMeter keeps a FlowCounter per key, e.g. per tag or per port.
+type FlowMeter struct {
+	counters map[interface{}]*FlowCounter
+	clock    Clock
+	mtx      sync.Mutex
+}
+
+func newFlowCounter(clock Clock) *FlowCounter {
+	return &FlowCounter{since: clock.Now(), clock: clock}
+}
+
+func (counter *FlowCounter) Count(records int64, bytes int64) {
+	counter.mtx.Lock()
+	defer counter.mtx.Unlock()
+	epoch := counter.clock.Now().UnixNano() / int64(flowSlotDuration)
+	slot := &counter.slots[epoch%flowSlots]
+	if slot.epoch != epoch {
+		*slot = flowSlot{epoch: epoch}
+	}
+	slot.records += records
+	slot.bytes += bytes
+}
+
+// Rates returns the rates over each of FlowWindows.  A window longer than
+// the counter has been counting is averaged over the time it has.
+func (counter *FlowCounter) Rates() []FlowRate {
+	counter.mtx.Lock()
+	defer counter.mtx.Unlock()
+	now := counter.clock.Now()
+	current := now.UnixNano() / int64(flowSlotDuration)
+	retval := make([]FlowRate, len(FlowWindows))
+	for i, window := range FlowWindows {
+		slots := int64(window / flowSlotDuration)
+		records, bytes := int64(0), int64(0)
+		for j := range counter.slots {
+			slot := &counter.slots[j]
+			if current-slot.epoch < slots {
+				records += slot.records
+				bytes += slot.bytes
+			}
+		}
+		elapsed := now.Sub(counter.since)
+		if elapsed > window {
+			elapsed = window
+		}
+		if elapsed < flowSlotDuration {
+			elapsed = flowSlotDuration
+		}
+		retval[i] = FlowRate{
+			Window:  window,
+			Records: float64(records) / elapsed.Seconds(),
+			Bytes:   float64(bytes) / elapsed.Seconds(),
+		}
+	}
+	return retval
+}
+
+func (counter *FlowCounter) String() string {
+	text := ""
+	for i, rate := range counter.Rates() {
+		if i > 0 {
+			text += ", "
+		}
+		text += fmt.Sprintf("%s: %.1f rec/s %.1f B/s", shortDuration(rate.Window), rate.Records, rate.Bytes)
+	}
+	return text
+}
+
+func shortDuration(d time.Duration) string {
+	if d%time.Minute == 0 {
+		return fmt.Sprintf("%dm", int64(d/time.Minute))
+	}
+	return d.String()
+}
+
+func recordSetBytes(recordSet FluentRecordSet) int64 {
+	if recordSet.Packed != nil {
+		return int64(len(recordSet.Packed))
+	}
+	retval := int64(0)
+	for _, record := range recordSet.Records {
+		retval += RecordSize(record.Data)
+	}
+	return retval
+}
+
+// NewFlowMeter creates a meter telling the time by clock.
+func NewFlowMeter(clock Clock) *FlowMeter {
+	return &FlowMeter{
+		counters: make(map[interface{}]*FlowCounter),
+		clock:    clock,
+	}
+}
+
+func (meter *FlowMeter) counter(key interface{}) *FlowCounter {
+	meter.mtx.Lock()
+	defer meter.mtx.Unlock()
+	counter, ok := meter.counters[key]
+	if !ok {
+		counter = newFlowCounter(meter.clock)
+		meter.counters[key] = counter
+	}
+	return counter
+}
+
+// Count counts the records of the record sets and their bytes under key.
+func (meter *FlowMeter) Count(key interface{}, recordSets []FluentRecordSet) {
+	records, bytes := int64(0), int64(0)
+	for _, recordSet := range recordSets {
+		records += int64(len(recordSet.Records))
+		bytes += recordSetBytes(recordSet)
+	}
+	meter.counter(key).Count(records, bytes)
+}
+
+// CountByTag counts the records of each record set under its tag.
+func (meter *FlowMeter) CountByTag(recordSets []FluentRecordSet) {
+	for _, recordSet := range recordSets {
+		meter.counter(recordSet.Tag).Count(int64(len(recordSet.Records)), recordSetBytes(recordSet))
+	}
+}
+
+// Counter returns the counter of key, or nil if nothing was counted under
+// it.
+func (meter *FlowMeter) Counter(key interface{}) *FlowCounter {
+	meter.mtx.Lock()
+	defer meter.mtx.Unlock()
+	return meter.counters[key]
+}
+
+// Keys returns the keys something was counted under.
+func (meter *FlowMeter) Keys() []interface{} {
+	meter.mtx.Lock()
+	defer meter.mtx.Unlock()
+	retval := make([]interface{}, 0, len(meter.counters))
+	for key := range meter.counters {
+		retval = append(retval, key)
+	}
+	return retval
+}
+
+// Forget drops the counter of key, e.g. of a plugin instance terminated.
+func (meter *FlowMeter) Forget(key interface{}) {
+	meter.mtx.Lock()
+	defer meter.mtx.Unlock()
+	delete(meter.counters, key)
+}
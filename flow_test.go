@@ -0,0 +1,69 @@
+package ik
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFlowCounter(t *testing.T) {
+	clock := &tenantTestClock{now: time.Unix(1000, 0)}
+	counter := newFlowCounter(clock)
+	clock.now = clock.now.Add(10 * time.Second)
+	counter.Count(100, 1000)
+	// averaged over the 10 seconds counted so far
+	rates := counter.Rates()
+	if len(rates) != 3 || rates[0].Records != 10 || rates[0].Bytes != 100 || rates[2].Records != 10 {
+		t.Fatalf("%v", rates)
+	}
+	clock.now = clock.now.Add(20 * time.Minute)
+	counter.Count(600, 0)
+	rates = counter.Rates()
+	if rates[0].Records != 10 || rates[1].Records != 2 || rates[2].Records != 600./900. {
+		t.Fatalf("%v", rates)
+	}
+	if counter.String() != "1m: 10.0 rec/s 0.0 B/s, 5m: 2.0 rec/s 0.0 B/s, 15m: 0.7 rec/s 0.0 B/s" {
+		t.Fatalf("%s", counter.String())
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if rates = counter.Rates(); rates[0].Records != 0 || rates[1].Records != 2 {
+		t.Fatalf("%v", rates)
+	}
+}
+
+func TestFluentRouter_FlowMeter(t *testing.T) {
+	clock := &tenantTestClock{now: time.Unix(1000, 0)}
+	flows := NewFlowMeter(clock)
+	router := NewFluentRouter()
+	router.SetFlowMeter(flows)
+	label := router.Label("@x")
+	a, b := &recordingPort{}, &recordingPort{}
+	router.AddRule("a", a)
+	label.AddRule("**", b)
+	err := router.Emit([]FluentRecordSet{
+		{Tag: "a", Records: []TinyFluentRecord{{Data: map[string]interface{}{"message": "test"}}}},
+		{Tag: "b", Packed: []byte("0123456789"), Records: []TinyFluentRecord{{}, {}}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = label.Emit([]FluentRecordSet{{Tag: "b", Records: []TinyFluentRecord{{}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	clock.now = clock.now.Add(10 * time.Second)
+	rates := flows.Counter(a).Rates()
+	if rates[0].Records != 0.1 || rates[0].Bytes != 1.1 {
+		t.Fatalf("%v", rates)
+	}
+	// the labels count in the meter of the root
+	if rates := flows.Counter(b).Rates(); rates[0].Records != 0.1 {
+		t.Fatalf("%v", rates)
+	}
+	if len(flows.Keys()) != 2 {
+		t.Fatalf("%v", flows.Keys())
+	}
+	flows.Forget(a)
+	if flows.Counter(a) != nil {
+		t.Fail()
+	}
+}
@@ -1,7 +1,9 @@
 package ik
 
 import (
+	"context"
 	"regexp"
+	"sync"
 )
 
 type fluentRouterRule struct {
@@ -9,8 +11,30 @@ type fluentRouterRule struct {
 	port Port
 }
 
+// FluentRouter routes each record set through the filters matching its tag
+// in the order they were added, and then to every output matching it.  A
+// filter or an output panicking on emit makes the emit fail instead of
+// bringing down the goroutine of the emitter.  The records beyond the
+// limits are handed over to the reject handler instead of being routed.
 type FluentRouter struct {
-	rules []*fluentRouterRule
+	filters  []*fluentRouterRule
+	rules    []*fluentRouterRule
+	mtx      sync.RWMutex
+	onPanic  func(Port, *Panicked, []FluentRecordSet)
+	onReject func(error, []FluentRecordSet)
+	tracer   *Tracer
+	flows    *FlowMeter
+	limits   *Limits
+	labels   map[string]*FluentRouter
+	parent   *FluentRouter
+	members  []PluginInstance
+}
+
+// fluentRouterStage is the port a filter emits at, which routes the
+// record sets through the filters after it.
+type fluentRouterStage struct {
+	router *FluentRouter
+	start  int
 }
 
 type PatternError struct {
@@ -107,48 +131,415 @@ func BuildRegexpFromGlobPattern(pattern string) (string, error) {
 	return "^" + chunk + "$", nil
 }
 
-func (router *FluentRouter) AddRule(pattern string, port Port) error {
+func compileGlobPattern(pattern string) (*regexp.Regexp, error) {
 	chunk, err := BuildRegexpFromGlobPattern(pattern)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	re, err := regexp.Compile(chunk)
+	return regexp.Compile(chunk)
+}
+
+func (router *FluentRouter) AddRule(pattern string, port Port) error {
+	re, err := compileGlobPattern(pattern)
 	if err != nil {
 		return err
 	}
 	newRule := &fluentRouterRule{re, port}
+	router.mtx.Lock()
+	defer router.mtx.Unlock()
 	router.rules = append(router.rules, newRule)
 	return nil
 }
 
-func (router *FluentRouter) Emit(recordSets []FluentRecordSet) error {
+// AddFilter adds the filter created by newFilter after the filters added
+// so far.  newFilter is given the port the filter emits at.
+func (router *FluentRouter) AddFilter(pattern string, newFilter func(next Port) (Filter, error)) (Filter, error) {
+	re, err := compileGlobPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	router.mtx.RLock()
+	next := &fluentRouterStage{router, len(router.filters) + 1}
+	router.mtx.RUnlock()
+	filter, err := newFilter(next)
+	if err != nil {
+		return nil, err
+	}
+	router.mtx.Lock()
+	defer router.mtx.Unlock()
+	router.filters = append(router.filters, &fluentRouterRule{re, filter})
+	return filter, nil
+}
+
+// Replace atomically replaces the rules and the labels of the router with
+// those of another.
+func (router *FluentRouter) Replace(other *FluentRouter) {
+	other.mtx.RLock()
+	filters := make([]*fluentRouterRule, len(other.filters))
+	copy(filters, other.filters)
+	rules := make([]*fluentRouterRule, len(other.rules))
+	copy(rules, other.rules)
+	labels := make(map[string]*FluentRouter, len(other.labels))
+	for name, label := range other.labels {
+		labels[name] = label
+	}
+	other.mtx.RUnlock()
+	for _, label := range labels {
+		label.mtx.Lock()
+		label.parent = router
+		label.mtx.Unlock()
+	}
+	router.mtx.Lock()
+	defer router.mtx.Unlock()
+	router.filters = filters
+	router.rules = rules
+	router.labels = labels
+}
+
+// route maps the record sets to the first filter from start on matching
+// their tag, or else to the outputs.
+func (router *FluentRouter) route(start int, recordSets []FluentRecordSet) map[Port][]FluentRecordSet {
 	recordSetsMap := make(map[Port][]FluentRecordSet)
+	for port, indices := range router.routeIndices(start, recordSets) {
+		recordSetsMap[port] = pickRecordSets(recordSets, indices)
+	}
+	return recordSetsMap
+}
+
+// routeIndices is route giving the indices of the record sets.  The tag of
+// a batch of several record sets, such as one a filter split into tags,
+// is matched once however many record sets have it.
+func (router *FluentRouter) routeIndices(start int, recordSets []FluentRecordSet) map[Port][]int {
+	indicesMap := make(map[Port][]int)
+	var portsMap map[string][]Port
+	if len(recordSets) > 1 {
+		portsMap = make(map[string][]Port)
+	}
+	router.mtx.RLock()
 	for i := range recordSets {
-		recordSet := &recordSets[i]
-		for _, rule := range router.rules {
-			if rule.re.MatchString(recordSet.Tag) {
-				recordSetsForPort, ok := recordSetsMap[rule.port]
-				if !ok {
-					recordSetsForPort = make([]FluentRecordSet, 0)
-				} else {
-					lastRecordSets := &recordSetsForPort[len(recordSetsForPort)-1]
-					if &lastRecordSets.Records == &recordSet.Records {
-						continue
-					}
-				}
-				recordSetsMap[rule.port] = append(recordSetsForPort, *recordSet)
+		tag := recordSets[i].Tag
+		ports, ok := portsMap[tag]
+		if !ok {
+			ports = router.portsFor(start, tag)
+			if portsMap != nil {
+				portsMap[tag] = ports
 			}
 		}
+		for _, port := range ports {
+			indicesMap[port] = append(indicesMap[port], i)
+		}
+	}
+	router.mtx.RUnlock()
+	return indicesMap
+}
+
+// portsFor returns the first filter from start on matching the tag, or
+// else the outputs matching it.  mtx must be held.
+func (router *FluentRouter) portsFor(start int, tag string) []Port {
+	for j := start; j < len(router.filters); j += 1 {
+		filter := router.filters[j]
+		if filter.re.MatchString(tag) {
+			return []Port{filter.port}
+		}
+	}
+	ports := make([]Port, 0)
+	for _, rule := range router.rules {
+		if rule.re.MatchString(tag) {
+			ports = append(ports, rule.port)
+		}
+	}
+	return ports
+}
+
+func pickRecordSets(recordSets []FluentRecordSet, indices []int) []FluentRecordSet {
+	retval := make([]FluentRecordSet, len(indices))
+	for j, i := range indices {
+		retval[j] = recordSets[i]
+	}
+	return retval
+}
+
+// SetPanicHandler sets the function told of the port that panicked and of
+// the record sets it was given.
+func (router *FluentRouter) SetPanicHandler(handler func(Port, *Panicked, []FluentRecordSet)) {
+	router.mtx.Lock()
+	defer router.mtx.Unlock()
+	router.onPanic = handler
+}
+
+// SetRejectHandler sets the function given the records rejected by the
+// limits, along with why.
+func (router *FluentRouter) SetRejectHandler(handler func(error, []FluentRecordSet)) {
+	router.mtx.Lock()
+	defer router.mtx.Unlock()
+	router.onReject = handler
+}
+
+// SetLimits sets the limits the records emitted are held to, or none if
+// limits is nil.
+func (router *FluentRouter) SetLimits(limits *Limits) {
+	router.mtx.Lock()
+	defer router.mtx.Unlock()
+	router.limits = limits
+}
+
+// limit returns the record sets within the limits and the indices they
+// had, handing the records rejected over to the reject handler.  indices
+// is nil if every record set is kept as it is.
+func (router *FluentRouter) limit(recordSets []FluentRecordSet) ([]FluentRecordSet, []int) {
+	root := router.root()
+	root.mtx.RLock()
+	limits := root.limits
+	onReject := root.onReject
+	root.mtx.RUnlock()
+	if limits == nil {
+		return recordSets, nil
+	}
+	retval, indices, rejected := limits.enforce(recordSets)
+	if len(rejected) == 0 {
+		return recordSets, nil
+	}
+	if onReject != nil {
+		for _, rejected_ := range rejected {
+			onReject(rejected_.cause, rejected_.recordSets)
+		}
+	}
+	return retval, indices
+}
+
+// SetTracer sets the tracer told of the traced records going into and out
+// of the filters and into the outputs.
+func (router *FluentRouter) SetTracer(tracer *Tracer) {
+	router.mtx.Lock()
+	defer router.mtx.Unlock()
+	router.tracer = tracer
+}
+
+func (router *FluentRouter) getTracer() *Tracer {
+	root := router.root()
+	root.mtx.RLock()
+	defer root.mtx.RUnlock()
+	return root.tracer
+}
+
+// SetFlowMeter sets the meter the records emitted at each filter and
+// output are counted in, under the port.
+func (router *FluentRouter) SetFlowMeter(flows *FlowMeter) {
+	router.mtx.Lock()
+	defer router.mtx.Unlock()
+	router.flows = flows
+}
+
+func (router *FluentRouter) getFlowMeter() *FlowMeter {
+	root := router.root()
+	root.mtx.RLock()
+	defer root.mtx.RUnlock()
+	return root.flows
+}
+
+func (router *FluentRouter) isFilter(port Port) bool {
+	router.mtx.RLock()
+	defer router.mtx.RUnlock()
+	for _, filter := range router.filters {
+		if filter.port == port {
+			return true
+		}
 	}
-	for port, recordSets := range recordSetsMap {
-		err := port.Emit(recordSets)
-		if err != nil {
+	return false
+}
+
+// traced is guard recording the hops of the traced records, with the
+// latency of the emit at an output.
+func (router *FluentRouter) traced(tracer *Tracer, port Port, recordSets []FluentRecordSet, emit func(Port, []FluentRecordSet) error) error {
+	if router.isFilter(port) {
+		tracer.Hop(port, TraceFilterIn, recordSets, 0)
+		return router.guard(port, recordSets, emit)
+	}
+	start := tracer.clock.Now()
+	err := router.guard(port, recordSets, emit)
+	tracer.Hop(port, TraceOutput, recordSets, tracer.clock.Now().Sub(start))
+	return err
+}
+
+func (router *FluentRouter) guard(port Port, recordSets []FluentRecordSet, emit func(Port, []FluentRecordSet) error) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			panicked := NewPanicked(r)
+			root := router.root()
+			root.mtx.RLock()
+			onPanic := root.onPanic
+			root.mtx.RUnlock()
+			if onPanic != nil {
+				onPanic(port, panicked, recordSets)
+			}
+			err = panicked
+		}
+	}()
+	return emit(port, recordSets)
+}
+
+// emitEach emits the record sets at the ports they are routed to.  The
+// ports after one that panicked are emitted at all the same.
+func (router *FluentRouter) emitEach(start int, recordSets []FluentRecordSet, emit func(Port, []FluentRecordSet) error) error {
+	var panicked error
+	recordSets, _ = router.limit(recordSets)
+	tracer := router.getTracer()
+	if tracer != nil && !tracer.Enabled() {
+		tracer = nil
+	}
+	flows := router.getFlowMeter()
+	for port, recordSets := range router.route(start, recordSets) {
+		if flows != nil {
+			flows.Count(port, recordSets)
+		}
+		var err error
+		if tracer != nil {
+			err = router.traced(tracer, port, recordSets, emit)
+		} else {
+			err = router.guard(port, recordSets, emit)
+		}
+		if _, ok := err.(*Panicked); ok {
+			panicked = err
+		} else if err != nil {
 			return err
 		}
 	}
-	return nil
+	return panicked
+}
+
+// emitWithResult emits the record sets at every port they are routed to,
+// those after a port that failed included, and tells the error of each
+// record set, which is that of the first port that failed to store it.
+// The records rejected by the limits are dead letters, not failures.
+func (router *FluentRouter) emitWithResult(start int, recordSets []FluentRecordSet) []error {
+	limited, kept := router.limit(recordSets)
+	if kept != nil {
+		results := make([]error, len(recordSets))
+		for j, err := range router.emitEachWithResult(start, limited) {
+			results[kept[j]] = err
+		}
+		return results
+	}
+	return router.emitEachWithResult(start, recordSets)
+}
+
+func (router *FluentRouter) emitEachWithResult(start int, recordSets []FluentRecordSet) []error {
+	results := make([]error, len(recordSets))
+	tracer := router.getTracer()
+	if tracer != nil && !tracer.Enabled() {
+		tracer = nil
+	}
+	flows := router.getFlowMeter()
+	for port, indices := range router.routeIndices(start, recordSets) {
+		var portResults []error
+		emit := func(port Port, recordSets []FluentRecordSet) error {
+			portResults = EmitWithResult(port, recordSets)
+			return FirstError(portResults)
+		}
+		recordSets_ := pickRecordSets(recordSets, indices)
+		if flows != nil {
+			flows.Count(port, recordSets_)
+		}
+		var err error
+		if tracer != nil {
+			err = router.traced(tracer, port, recordSets_, emit)
+		} else {
+			err = router.guard(port, recordSets_, emit)
+		}
+		for j, i := range indices {
+			if results[i] != nil {
+				continue
+			}
+			if portResults != nil {
+				results[i] = portResults[j]
+			} else {
+				results[i] = err
+			}
+		}
+	}
+	return results
+}
+
+func (router *FluentRouter) emit(start int, recordSets []FluentRecordSet) error {
+	return router.emitEach(start, recordSets, func(port Port, recordSets []FluentRecordSet) error {
+		return port.Emit(recordSets)
+	})
+}
+
+func (router *FluentRouter) emitContext(ctx context.Context, start int, recordSets []FluentRecordSet) error {
+	return router.emitEach(start, recordSets, func(port Port, recordSets []FluentRecordSet) error {
+		return EmitContext(ctx, port, recordSets)
+	})
+}
+
+func (router *FluentRouter) emitDurably(start int, recordSets []FluentRecordSet) error {
+	return router.emitEach(start, recordSets, EmitDurably)
+}
+
+func (router *FluentRouter) Emit(recordSets []FluentRecordSet) error {
+	return router.emit(0, recordSets)
+}
+
+func (router *FluentRouter) EmitContext(ctx context.Context, recordSets []FluentRecordSet) error {
+	return router.emitContext(ctx, 0, recordSets)
+}
+
+// EmitDurably returns once every output the records are routed to has
+// stored them.  Outputs and filters that cannot tell are considered done on
+// Emit.
+func (router *FluentRouter) EmitDurably(recordSets []FluentRecordSet) error {
+	return router.emitDurably(0, recordSets)
+}
+
+// EmitWithResult is EmitDurably telling the error of each record set.
+func (router *FluentRouter) EmitWithResult(recordSets []FluentRecordSet) []error {
+	return router.emitWithResult(0, recordSets)
+}
+
+// traceOut records the traced records coming out of the filter the stage
+// comes after.
+func (stage *fluentRouterStage) traceOut(recordSets []FluentRecordSet) {
+	tracer := stage.router.getTracer()
+	if tracer == nil || !tracer.Enabled() {
+		return
+	}
+	stage.router.mtx.RLock()
+	var filter Port
+	if stage.start-1 < len(stage.router.filters) {
+		filter = stage.router.filters[stage.start-1].port
+	}
+	stage.router.mtx.RUnlock()
+	if filter != nil {
+		tracer.Hop(filter, TraceFilterOut, recordSets, 0)
+	}
+}
+
+func (stage *fluentRouterStage) Emit(recordSets []FluentRecordSet) error {
+	stage.traceOut(recordSets)
+	return stage.router.emit(stage.start, recordSets)
+}
+
+func (stage *fluentRouterStage) EmitContext(ctx context.Context, recordSets []FluentRecordSet) error {
+	stage.traceOut(recordSets)
+	return stage.router.emitContext(ctx, stage.start, recordSets)
+}
+
+func (stage *fluentRouterStage) EmitDurably(recordSets []FluentRecordSet) error {
+	stage.traceOut(recordSets)
+	return stage.router.emitDurably(stage.start, recordSets)
+}
+
+func (stage *fluentRouterStage) EmitWithResult(recordSets []FluentRecordSet) []error {
+	stage.traceOut(recordSets)
+	return stage.router.emitWithResult(stage.start, recordSets)
 }
 
 func NewFluentRouter() *FluentRouter {
-	return &FluentRouter{make([]*fluentRouterRule, 0)}
+	return &FluentRouter{
+		filters: make([]*fluentRouterRule, 0),
+		rules:   make([]*fluentRouterRule, 0),
+		mtx:     sync.RWMutex{},
+		labels:  make(map[string]*FluentRouter),
+	}
 }
@@ -1,6 +1,7 @@
 package ik
 
 import (
+	"errors"
 	"testing"
 )
 
@@ -54,3 +55,102 @@ func TestBuildRegexpFromGlobPattern_4(t *testing.T) {
 		t.Fail()
 	}
 }
+
+type appendingFilter struct {
+	next  Port
+	value string
+}
+
+func (filter *appendingFilter) Emit(recordSets []FluentRecordSet) error {
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			record.Data["trail"] = record.Data["trail"].(string) + filter.value
+		}
+	}
+	return filter.next.Emit(recordSets)
+}
+
+func (filter *appendingFilter) Factory() Plugin { return nil }
+func (filter *appendingFilter) Run() error      { return nil }
+func (filter *appendingFilter) Shutdown() error { return nil }
+
+func TestFluentRouter_filters(t *testing.T) {
+	router := NewFluentRouter()
+	for _, filter := range []struct{ pattern, value string }{{"**", "a"}, {"x.*", "b"}, {"**", "c"}} {
+		value := filter.value
+		_, err := router.AddFilter(filter.pattern, func(next Port) (Filter, error) {
+			return &appendingFilter{next, value}, nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	port := &recordingPort{}
+	router.AddRule("**", port)
+	err := router.Emit([]FluentRecordSet{
+		{Tag: "x.y", Records: []TinyFluentRecord{{Data: map[string]interface{}{"trail": ""}}}},
+		{Tag: "z", Records: []TinyFluentRecord{{Data: map[string]interface{}{"trail": ""}}}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	trails := make(map[string]interface{})
+	for _, recordSet := range port.recordSets {
+		trails[recordSet.Tag] = recordSet.Records[0].Data["trail"]
+	}
+	if len(port.recordSets) != 2 || trails["x.y"] != "abc" || trails["z"] != "ac" {
+		t.Fatalf("%v", trails)
+	}
+}
+
+type errorPort struct{}
+
+func (*errorPort) Emit(recordSets []FluentRecordSet) error {
+	return errors.New("failed")
+}
+
+// resultPort fails the record sets of the given tag.
+type resultPort struct {
+	recordingPort
+	failing string
+}
+
+func (port *resultPort) EmitDurably(recordSets []FluentRecordSet) error {
+	return FirstError(port.EmitWithResult(recordSets))
+}
+
+func (port *resultPort) EmitWithResult(recordSets []FluentRecordSet) []error {
+	results := make([]error, len(recordSets))
+	for i, recordSet := range recordSets {
+		if recordSet.Tag == port.failing {
+			results[i] = errors.New("journal full")
+		} else {
+			port.recordingPort.Emit([]FluentRecordSet{recordSet})
+		}
+	}
+	return results
+}
+
+func TestFluentRouter_EmitWithResult(t *testing.T) {
+	router := NewFluentRouter()
+	port := &resultPort{failing: "b"}
+	router.AddRule("{a,b}", port)
+	other := &recordingPort{}
+	router.AddRule("c", other)
+	results := router.EmitWithResult([]FluentRecordSet{
+		{Tag: "a"},
+		{Tag: "b"},
+		{Tag: "c"},
+	})
+	if len(results) != 3 || results[0] != nil || results[1] == nil || results[2] != nil {
+		t.Fatalf("%v", results)
+	}
+	if len(port.recordSets) != 1 || len(other.recordSets) != 1 {
+		t.Fatalf("%v %v", port.recordSets, other.recordSets)
+	}
+	// a port that cannot tell fails every record set given to it
+	results = EmitWithResult(&errorPort{}, []FluentRecordSet{{Tag: "a"}, {Tag: "b"}})
+	if results[0] == nil || results[1] == nil {
+		t.Fatalf("%v", results)
+	}
+}
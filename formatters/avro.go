@@ -0,0 +1,83 @@
+package formatters
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/avro"
+	"io/ioutil"
+	"time"
+)
+
+type AvroFormatterPlugin struct{}
+
+// AvroFormatter encodes each record as a datum of the record schema given
+// inline by schema, in the file at schema_path, or by the latest version
+// of subject in the schema registry at schema_registry_url.  The datums of
+// a schema from the registry are framed with its id the way the Confluent
+// serializers do, so that the consumers can look it up.
+type AvroFormatter struct {
+	schema   *avro.Schema
+	schemaId int32
+	framed   bool
+}
+
+func (formatter *AvroFormatter) Format(tag string, record ik.FluentRecord) ([]byte, error) {
+	b, err := formatter.schema.Marshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	if formatter.framed {
+		return avro.Frame(formatter.schemaId, b), nil
+	}
+	return b, nil
+}
+
+func (*AvroFormatterPlugin) Name() string {
+	return "avro"
+}
+
+func (plugin *AvroFormatterPlugin) OnRegistering(visitor func(name string, factory ik.FormatterFactory) error) error {
+	return visitor("avro", func(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *AvroFormatterPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+	endpoint, ok := config.Attrs["schema_registry_url"]
+	if ok {
+		subject, ok := config.Attrs["subject"]
+		if !ok {
+			return nil, errors.New("required attribute `subject' is not specified")
+		}
+		id, schema, err := avro.NewRegistry(endpoint, 30*time.Second).Latest(subject)
+		if err != nil {
+			return nil, err
+		}
+		return &AvroFormatter{schema: schema, schemaId: id, framed: true}, nil
+	}
+	var b []byte
+	schemaStr, ok := config.Attrs["schema"]
+	if ok {
+		b = []byte(schemaStr)
+	} else {
+		path, ok := config.Attrs["schema_path"]
+		if !ok {
+			return nil, errors.New("either schema, schema_path or schema_registry_url is required")
+		}
+		var err error
+		b, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	schema, err := avro.ParseSchema(b)
+	if err != nil {
+		return nil, err
+	}
+	if schema.Type != "record" {
+		return nil, errors.New("the schema is not of a record")
+	}
+	return &AvroFormatter{schema: schema}, nil
+}
+
+var _ = AddPlugin(&AvroFormatterPlugin{})
@@ -0,0 +1,81 @@
+package formatters
+
+import (
+	"bytes"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"strings"
+)
+
+type CSVFormatterPlugin struct{}
+
+type CSVFormatter struct {
+	fields      []string
+	delimiter   string
+	forceQuotes bool
+	addNewline  bool
+}
+
+func (formatter *CSVFormatter) quote(value string) string {
+	if !formatter.forceQuotes && !strings.ContainsAny(value, "\"\r\n") && !strings.Contains(value, formatter.delimiter) {
+		return value
+	}
+	return "\"" + strings.Replace(value, "\"", "\"\"", -1) + "\""
+}
+
+// Format writes the values of the fields in order, leaving those missing
+// from the record empty.
+func (formatter *CSVFormatter) Format(tag string, record ik.FluentRecord) ([]byte, error) {
+	b := &bytes.Buffer{}
+	for i, field := range formatter.fields {
+		if i > 0 {
+			b.WriteString(formatter.delimiter)
+		}
+		b.WriteString(formatter.quote(formatValue(record.Data[field])))
+	}
+	if formatter.addNewline {
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+func (*CSVFormatterPlugin) Name() string {
+	return "csv"
+}
+
+func (plugin *CSVFormatterPlugin) OnRegistering(visitor func(name string, factory ik.FormatterFactory) error) error {
+	return visitor("csv", func(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *CSVFormatterPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+	fieldsStr, ok := config.Attrs["fields"]
+	if !ok {
+		return nil, errors.New("required attribute `fields' is not specified")
+	}
+	fields := strings.Split(fieldsStr, ",")
+	for i, field := range fields {
+		fields[i] = strings.TrimSpace(field)
+	}
+	delimiter, ok := config.Attrs["delimiter"]
+	if !ok {
+		delimiter = ","
+	}
+	forceQuotes, err := parseBoolAttr(config, "force_quotes", true)
+	if err != nil {
+		return nil, err
+	}
+	addNewline, err := parseBoolAttr(config, "add_newline", true)
+	if err != nil {
+		return nil, err
+	}
+	return &CSVFormatter{
+		fields:      fields,
+		delimiter:   delimiter,
+		forceQuotes: forceQuotes,
+		addNewline:  addNewline,
+	}, nil
+}
+
+var _ = AddPlugin(&CSVFormatterPlugin{})
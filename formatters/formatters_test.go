@@ -0,0 +1,108 @@
+package formatters
+
+import (
+	"bytes"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/conformance"
+	"github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"reflect"
+	"testing"
+)
+
+type formatterPacker struct {
+	formatter ik.Formatter
+}
+
+func (packer *formatterPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	return packer.formatter.Format(record.Tag, record)
+}
+
+func newTestEngine(t *testing.T) ik.Engine {
+	logger := logging.MustGetLogger("ik")
+	scorekeeper := ik.NewScorekeeper(logger)
+	registry := ik.NewMultiFactoryRegistry(scorekeeper)
+	err := registry.RegisterFormatterPlugins(GetPlugins())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return ik.NewEngine(logger, nil, registry, registry, scorekeeper, nil)
+}
+
+// The formatter of each case is given by the type attribute of the case.
+func TestFormatters_conformance(t *testing.T) {
+	engine := newTestEngine(t)
+	defer engine.Dispose()
+	conformance.RunPackerSuite(t, func(config *ik.ConfigElement) (ik.RecordPacker, error) {
+		formatter, err := engine.FormatterPluginRegistry().LookupFormatterFactory(config.Attrs["type"])(engine, config)
+		if err != nil {
+			return nil, err
+		}
+		return &formatterPacker{formatter}, nil
+	}, "testdata/formatters.json")
+}
+
+func TestMsgpackFormatter(t *testing.T) {
+	formatter, err := (&MsgpackFormatterPlugin{}).New(nil, &ik.ConfigElement{Attrs: map[string]string{}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := formatter.Format("test", ik.FluentRecord{Tag: "test", Timestamp: 1400000000, Data: map[string]interface{}{"a": "x"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var data map[string]interface{}
+	err = codec.NewDecoder(bytes.NewReader(b), formatter.(*MsgpackFormatter).codec).Decode(&data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(data, map[string]interface{}{"a": []byte("x")}) {
+		t.Fatalf("%v", data)
+	}
+}
+
+func TestJSONFormatter_FormatTo(t *testing.T) {
+	record := ik.FluentRecord{Tag: "test", Timestamp: 1400000000, Data: map[string]interface{}{"a": "<x>", "b": 1}}
+	for _, addNewline := range []bool{true, false} {
+		formatter := &JSONFormatter{addNewline: addNewline}
+		expected, err := formatter.Format("test", record)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		buf := bytes.NewBufferString("previous")
+		err = formatter.FormatTo(buf, "test", record)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if buf.String() != "previous"+string(expected) {
+			t.Logf("expected %q, got %q", expected, buf.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestAvroFormatter(t *testing.T) {
+	schema := `{"type": "record", "name": "R", "fields": [{"name": "a", "type": "long"}, {"name": "b", "type": "string"}]}`
+	formatter, err := (&AvroFormatterPlugin{}).New(nil, &ik.ConfigElement{Attrs: map[string]string{"schema": schema}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, err := formatter.Format("test", ik.FluentRecord{Tag: "test", Timestamp: 1400000000, Data: map[string]interface{}{"a": 27, "b": "foo"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !bytes.Equal(b, []byte{0x36, 0x06, 'f', 'o', 'o'}) {
+		t.Fatalf("%x", b)
+	}
+	_, err = formatter.Format("test", ik.FluentRecord{Tag: "test", Data: map[string]interface{}{"a": 27}})
+	if err == nil {
+		t.Fatal("a record without a required field was formatted")
+	}
+	for _, attrs := range []map[string]string{{}, {"schema": `"string"`}, {"schema_path": "/nonexistent"}, {"schema_registry_url": "http://127.0.0.1:1"}} {
+		_, err = (&AvroFormatterPlugin{}).New(nil, &ik.ConfigElement{Attrs: attrs})
+		if err == nil {
+			t.Logf("%v accepted", attrs)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package formatters
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/moriyoshi/ik"
+)
+
+type JSONFormatterPlugin struct{}
+
+type JSONFormatter struct {
+	addNewline bool
+}
+
+func (formatter *JSONFormatter) Format(tag string, record ik.FluentRecord) ([]byte, error) {
+	b, err := json.Marshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	if formatter.addNewline {
+		b = append(b, '\n')
+	}
+	return b, nil
+}
+
+// FormatTo is Format writing onto buf.
+func (formatter *JSONFormatter) FormatTo(buf *bytes.Buffer, tag string, record ik.FluentRecord) error {
+	err := json.NewEncoder(buf).Encode(record.Data)
+	if err != nil {
+		return err
+	}
+	if !formatter.addNewline {
+		buf.Truncate(buf.Len() - 1)
+	}
+	return nil
+}
+
+func (*JSONFormatterPlugin) Name() string {
+	return "json"
+}
+
+func (plugin *JSONFormatterPlugin) OnRegistering(visitor func(name string, factory ik.FormatterFactory) error) error {
+	return visitor("json", func(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *JSONFormatterPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+	addNewline, err := parseBoolAttr(config, "add_newline", true)
+	if err != nil {
+		return nil, err
+	}
+	return &JSONFormatter{addNewline: addNewline}, nil
+}
+
+var _ = AddPlugin(&JSONFormatterPlugin{})
@@ -0,0 +1,70 @@
+package formatters
+
+import (
+	"bytes"
+	"github.com/moriyoshi/ik"
+	"sort"
+)
+
+type LTSVFormatterPlugin struct{}
+
+type LTSVFormatter struct {
+	delimiter      string
+	labelDelimiter string
+	addNewline     bool
+}
+
+// Format writes the pairs in the order of the labels, so that the same
+// record always comes out the same.
+func (formatter *LTSVFormatter) Format(tag string, record ik.FluentRecord) ([]byte, error) {
+	keys := make([]string, 0, len(record.Data))
+	for k, _ := range record.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	b := &bytes.Buffer{}
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(formatter.delimiter)
+		}
+		b.WriteString(k)
+		b.WriteString(formatter.labelDelimiter)
+		b.WriteString(formatValue(record.Data[k]))
+	}
+	if formatter.addNewline {
+		b.WriteByte('\n')
+	}
+	return b.Bytes(), nil
+}
+
+func (*LTSVFormatterPlugin) Name() string {
+	return "ltsv"
+}
+
+func (plugin *LTSVFormatterPlugin) OnRegistering(visitor func(name string, factory ik.FormatterFactory) error) error {
+	return visitor("ltsv", func(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *LTSVFormatterPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+	delimiter, ok := config.Attrs["delimiter"]
+	if !ok {
+		delimiter = "\t"
+	}
+	labelDelimiter, ok := config.Attrs["label_delimiter"]
+	if !ok {
+		labelDelimiter = ":"
+	}
+	addNewline, err := parseBoolAttr(config, "add_newline", true)
+	if err != nil {
+		return nil, err
+	}
+	return &LTSVFormatter{
+		delimiter:      delimiter,
+		labelDelimiter: labelDelimiter,
+		addNewline:     addNewline,
+	}, nil
+}
+
+var _ = AddPlugin(&LTSVFormatterPlugin{})
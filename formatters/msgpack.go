@@ -0,0 +1,48 @@
+package formatters
+
+import (
+	"bytes"
+	"github.com/moriyoshi/ik"
+	"github.com/ugorji/go/codec"
+	"reflect"
+)
+
+type MsgpackFormatterPlugin struct{}
+
+type MsgpackFormatter struct {
+	codec *codec.MsgpackHandle
+}
+
+// Format packs the record alone; a stream of them is not delimited by
+// anything, so it suits outputs that do not split chunks into lines.
+func (formatter *MsgpackFormatter) Format(tag string, record ik.FluentRecord) ([]byte, error) {
+	b := &bytes.Buffer{}
+	err := formatter.FormatTo(b, tag, record)
+	if err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func (formatter *MsgpackFormatter) FormatTo(buf *bytes.Buffer, tag string, record ik.FluentRecord) error {
+	return codec.NewEncoder(buf, formatter.codec).Encode(record.Data)
+}
+
+func (*MsgpackFormatterPlugin) Name() string {
+	return "msgpack"
+}
+
+func (plugin *MsgpackFormatterPlugin) OnRegistering(visitor func(name string, factory ik.FormatterFactory) error) error {
+	return visitor("msgpack", func(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *MsgpackFormatterPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
+	return &MsgpackFormatter{codec: &_codec}, nil
+}
+
+var _ = AddPlugin(&MsgpackFormatterPlugin{})
@@ -0,0 +1,95 @@
+package formatters
+
+import (
+	"bytes"
+	"encoding/json"
+	strftime "github.com/jehiah/go-strftime"
+	"github.com/moriyoshi/ik"
+	"time"
+)
+
+type OutFileFormatterPlugin struct{}
+
+// OutFileFormatter writes the time, the tag and the record in JSON, which
+// is what out_file writes unless told otherwise.
+type OutFileFormatter struct {
+	timeFormat string
+	delimiter  string
+	outputTime bool
+	outputTag  bool
+	location   *time.Location
+}
+
+func (formatter *OutFileFormatter) formatTime(timestamp uint64) string {
+	timestamp_ := time.Unix(int64(timestamp), 0).In(formatter.location)
+	if formatter.timeFormat == "" {
+		return timestamp_.Format(time.RFC3339)
+	} else {
+		return strftime.Format(formatter.timeFormat, timestamp_)
+	}
+}
+
+func (formatter *OutFileFormatter) Format(tag string, record ik.FluentRecord) ([]byte, error) {
+	data, err := json.Marshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	b := &bytes.Buffer{}
+	if formatter.outputTime {
+		b.WriteString(formatter.formatTime(record.Timestamp))
+		b.WriteString(formatter.delimiter)
+	}
+	if formatter.outputTag {
+		b.WriteString(tag)
+		b.WriteString(formatter.delimiter)
+	}
+	b.Write(data)
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+func (*OutFileFormatterPlugin) Name() string {
+	return "out_file"
+}
+
+func (plugin *OutFileFormatterPlugin) OnRegistering(visitor func(name string, factory ik.FormatterFactory) error) error {
+	return visitor("out_file", func(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *OutFileFormatterPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+	delimiter, ok := config.Attrs["delimiter"]
+	if !ok {
+		delimiter = "\t"
+	}
+	outputTime, err := parseBoolAttr(config, "output_time", true)
+	if err != nil {
+		return nil, err
+	}
+	outputTag, err := parseBoolAttr(config, "output_tag", true)
+	if err != nil {
+		return nil, err
+	}
+	location := time.Local
+	localtime, err := parseBoolAttr(config, "localtime", true)
+	if err != nil {
+		return nil, err
+	}
+	if !localtime {
+		location = time.UTC
+	}
+	location, err = ik.LocationFromConfig(config, location)
+	if err != nil {
+		return nil, err
+	}
+	return &OutFileFormatter{
+		timeFormat: config.Attrs["time_format"],
+		delimiter:  delimiter,
+		outputTime: outputTime,
+		outputTag:  outputTag,
+		location:   location,
+	}, nil
+}
+
+var _ = AddPlugin(&OutFileFormatterPlugin{})
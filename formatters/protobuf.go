@@ -0,0 +1,65 @@
+package formatters
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/protobuf"
+)
+
+type ProtobufFormatterPlugin struct{}
+
+// ProtobufFormatter serializes each record as the message_type message of
+// the descriptor set at descriptor_set, which protoc --descriptor_set_out
+// --include_imports makes.  The messages are prefixed with their length in
+// a varint if length_delimited is true, as writeDelimitedTo does, for the
+// outputs that write a stream of them.
+type ProtobufFormatter struct {
+	message         *protobuf.Message
+	lengthDelimited bool
+}
+
+func (formatter *ProtobufFormatter) Format(tag string, record ik.FluentRecord) ([]byte, error) {
+	b, err := formatter.message.Marshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	if !formatter.lengthDelimited {
+		return b, nil
+	}
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(len(b)))
+	return append(prefix[:n], b...), nil
+}
+
+func (*ProtobufFormatterPlugin) Name() string {
+	return "protobuf"
+}
+
+func (plugin *ProtobufFormatterPlugin) OnRegistering(visitor func(name string, factory ik.FormatterFactory) error) error {
+	return visitor("protobuf", func(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *ProtobufFormatterPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+	path, ok := config.Attrs["descriptor_set"]
+	if !ok {
+		return nil, errors.New("required attribute `descriptor_set' is not specified")
+	}
+	messageType, ok := config.Attrs["message_type"]
+	if !ok {
+		return nil, errors.New("required attribute `message_type' is not specified")
+	}
+	message, err := protobuf.LoadMessage(path, messageType)
+	if err != nil {
+		return nil, err
+	}
+	lengthDelimited, err := parseBoolAttr(config, "length_delimited", false)
+	if err != nil {
+		return nil, err
+	}
+	return &ProtobufFormatter{message: message, lengthDelimited: lengthDelimited}, nil
+}
+
+var _ = AddPlugin(&ProtobufFormatterPlugin{})
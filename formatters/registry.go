@@ -0,0 +1,14 @@
+package formatters
+
+import "github.com/moriyoshi/ik"
+
+var _plugins []ik.FormatterPlugin = make([]ik.FormatterPlugin, 0)
+
+func AddPlugin(plugin ik.FormatterPlugin) bool {
+	_plugins = append(_plugins, plugin)
+	return false
+}
+
+func GetPlugins() []ik.FormatterPlugin {
+	return _plugins
+}
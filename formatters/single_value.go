@@ -0,0 +1,46 @@
+package formatters
+
+import (
+	"github.com/moriyoshi/ik"
+)
+
+type SingleValueFormatterPlugin struct{}
+
+// SingleValueFormatter writes nothing but the value of message_key, e.g.
+// to write back the lines read by in_tail with format none.
+type SingleValueFormatter struct {
+	messageKey string
+	addNewline bool
+}
+
+func (formatter *SingleValueFormatter) Format(tag string, record ik.FluentRecord) ([]byte, error) {
+	b := []byte(formatValue(record.Data[formatter.messageKey]))
+	if formatter.addNewline {
+		b = append(b, '\n')
+	}
+	return b, nil
+}
+
+func (*SingleValueFormatterPlugin) Name() string {
+	return "single_value"
+}
+
+func (plugin *SingleValueFormatterPlugin) OnRegistering(visitor func(name string, factory ik.FormatterFactory) error) error {
+	return visitor("single_value", func(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *SingleValueFormatterPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.Formatter, error) {
+	messageKey, ok := config.Attrs["message_key"]
+	if !ok {
+		messageKey = "message"
+	}
+	addNewline, err := parseBoolAttr(config, "add_newline", true)
+	if err != nil {
+		return nil, err
+	}
+	return &SingleValueFormatter{messageKey: messageKey, addNewline: addNewline}, nil
+}
+
+var _ = AddPlugin(&SingleValueFormatterPlugin{})
@@ -0,0 +1,39 @@
+package formatters
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"strconv"
+)
+
+func parseBoolAttr(config *ik.ConfigElement, name string, defaultValue bool) (bool, error) {
+	valueStr, ok := config.Attrs[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	return strconv.ParseBool(valueStr)
+}
+
+// formatValue renders a value of a record as text; maps and arrays are
+// rendered in JSON and a missing value as the empty string.
+func formatValue(value interface{}) string {
+	switch value_ := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value_
+	case []byte:
+		return string(value_)
+	case float64:
+		return strconv.FormatFloat(value_, 'f', -1, 64)
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(value_)
+		if err != nil {
+			return fmt.Sprint(value_)
+		}
+		return string(b)
+	default:
+		return fmt.Sprint(value_)
+	}
+}
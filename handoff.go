@@ -0,0 +1,195 @@
+package ik
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// HandoffEnv names the environment variable through which a process
+// handing off to the one it starts passes the pipes they talk over, as the
+// fds of the one telling it is ready and of the one telling it to go on,
+// separated by a comma.
+const HandoffEnv = "IK_HANDOFF"
+
+// Handoff is a process started to take over from the current one, which
+// listens on the sockets handed over to it without a moment they are not
+// listened on.  It goes through:
+//
+//  1. the new process starts, reads its configuration and tells it is
+//     ready, while the current one keeps on ingesting;
+//  2. the current one stops its inputs, which leaves the connections to
+//     come queued by the sockets, delivers what it can of the buffers and
+//     closes the journals, and the rest of them stays there;
+//  3. it releases the new process, which opens the journals, picking up
+//     the chunks left, and starts ingesting, and then it exits.
+//
+// Handing off is not supported on Windows.
+type Handoff struct {
+	cmd     *exec.Cmd
+	ready   *bufio.Reader
+	file    *os.File
+	release *os.File
+	timeout time.Duration
+}
+
+// Takeover is the side of a handoff of the process taking over.
+type Takeover struct {
+	ready   *os.File
+	release *os.File
+}
+
+func readHandoffLine(reader *bufio.Reader, expected string, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			err = errors.New("the new process exited")
+		} else if err == nil && line != expected+"\n" {
+			err = errors.New(fmt.Sprintf("unexpected message from the new process: %q", line))
+		}
+		result <- err
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return errors.New(fmt.Sprintf("the new process did not get %s in %s", expected, timeout))
+	}
+}
+
+// StartHandoff starts the executable to take over from the current
+// process, passing the sockets in the handover to it, and waits for it to
+// tell it is ready for up to timeout, killing it if it does not.  The new
+// process then waits for Release.
+func StartHandoff(executable string, args []string, handover *ListenerHandover, timeout time.Duration) (*Handoff, error) {
+	if handover == nil {
+		handover = &ListenerHandover{}
+	}
+	readyR, readyW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	releaseR, releaseW, err := os.Pipe()
+	if err != nil {
+		readyR.Close()
+		readyW.Close()
+		return nil, err
+	}
+	// the files passed become the fds from 3 onwards in the new process
+	files := append(append([]*os.File{}, handover.files...), readyW, releaseR)
+	fds := make([]int, len(handover.files))
+	for i := range fds {
+		fds[i] = 3 + i
+	}
+	env := make([]string, 0, len(os.Environ())+2)
+	for _, entry := range os.Environ() {
+		if !strings.HasPrefix(entry, InheritedListenersEnv+"=") && !strings.HasPrefix(entry, HandoffEnv+"=") {
+			env = append(env, entry)
+		}
+	}
+	env = append(env, handover.envOf(fds), fmt.Sprintf("%s=%d,%d", HandoffEnv, 3+len(fds), 4+len(fds)))
+	cmd := &exec.Cmd{
+		Path:       executable,
+		Args:       args,
+		Env:        env,
+		Stdin:      os.Stdin,
+		Stdout:     os.Stdout,
+		Stderr:     os.Stderr,
+		ExtraFiles: files,
+	}
+	err = cmd.Start()
+	// the new process holds ends of its own
+	readyW.Close()
+	releaseR.Close()
+	if err != nil {
+		readyR.Close()
+		releaseW.Close()
+		return nil, err
+	}
+	handoff := &Handoff{cmd, bufio.NewReader(readyR), readyR, releaseW, timeout}
+	err = readHandoffLine(handoff.ready, "ready", timeout)
+	if err != nil {
+		handoff.Abort()
+		return nil, err
+	}
+	return handoff, nil
+}
+
+// Pid returns the PID of the new process.
+func (handoff *Handoff) Pid() int {
+	return handoff.cmd.Process.Pid
+}
+
+// Abort kills the new process, for the current one to keep on.
+func (handoff *Handoff) Abort() {
+	handoff.cmd.Process.Kill()
+	handoff.cmd.Wait()
+	handoff.file.Close()
+	handoff.release.Close()
+}
+
+// Release tells the new process to go on, once the current one has let go
+// of the journals and the PID file, and waits for it to tell it is running
+// for up to the timeout given to StartHandoff.  It is left running on its
+// own afterwards.
+func (handoff *Handoff) Release() error {
+	defer handoff.file.Close()
+	_, err := handoff.release.Write([]byte("go\n"))
+	handoff.release.Close()
+	if err != nil {
+		return err
+	}
+	err = readHandoffLine(handoff.ready, "running", handoff.timeout)
+	handoff.cmd.Process.Release()
+	return err
+}
+
+// NewTakeover returns the side of the handoff of the current process if it
+// is started by StartHandoff, and nil otherwise.
+func NewTakeover() *Takeover {
+	value := os.Getenv(HandoffEnv)
+	os.Unsetenv(HandoffEnv)
+	fds := strings.Split(value, ",")
+	if len(fds) != 2 {
+		return nil
+	}
+	ready, err := strconv.Atoi(fds[0])
+	if err != nil {
+		return nil
+	}
+	release, err := strconv.Atoi(fds[1])
+	if err != nil {
+		return nil
+	}
+	return &Takeover{os.NewFile(uintptr(ready), "ready"), os.NewFile(uintptr(release), "release")}
+}
+
+// Ready tells the process handing off that the current one is ready, and
+// waits for it to let go of the journals.  The process handing off going
+// away releases it as well.
+func (takeover *Takeover) Ready() error {
+	_, err := takeover.ready.Write([]byte("ready\n"))
+	if err != nil {
+		return err
+	}
+	_, err = bufio.NewReader(takeover.release).ReadString('\n')
+	takeover.release.Close()
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Running tells the process handing off that the current one is running,
+// for it to exit.
+func (takeover *Takeover) Running() {
+	takeover.ready.Write([]byte("running\n"))
+	takeover.ready.Close()
+}
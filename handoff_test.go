@@ -0,0 +1,86 @@
+package ik
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// TestHandoffHelper is the process taken over by TestStartHandoff, which
+// answers a connection on the socket handed over.
+func TestHandoffHelper(t *testing.T) {
+	address := os.Getenv("IK_TEST_HANDOFF_ADDRESS")
+	if address == "" {
+		t.Skip("run by TestStartHandoff")
+	}
+	takeover := NewTakeover()
+	if takeover == nil {
+		os.Exit(1)
+	}
+	if takeover.Ready() != nil {
+		os.Exit(1)
+	}
+	listener, err := Listen("tcp", address)
+	if err != nil {
+		os.Exit(1)
+	}
+	takeover.Running()
+	conn, err := listener.Accept()
+	if err != nil {
+		os.Exit(1)
+	}
+	conn.Write([]byte("taken over\n"))
+	conn.Close()
+	os.Exit(0)
+}
+
+func TestStartHandoff(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("handing off is not supported on Windows")
+	}
+	listener, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	address := listener.Addr().String()
+	handover, err := PrepareListenerHandover()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the key the new process listens by is the address given to Listen
+	os.Setenv("IK_TEST_HANDOFF_ADDRESS", "127.0.0.1:0")
+	defer os.Unsetenv("IK_TEST_HANDOFF_ADDRESS")
+	handoff, err := StartHandoff(os.Args[0], []string{os.Args[0], "-test.run=^TestHandoffHelper$"}, handover, 10*time.Second)
+	handover.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	listener.Close()
+	err = handoff.Release()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil || line != "taken over\n" {
+		t.Fatalf("%v %q", err, line)
+	}
+}
+
+func TestStartHandoff_exited(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("handing off is not supported on Windows")
+	}
+	// a process that exits before getting ready leaves the current one on
+	if _, err := StartHandoff("/bin/sh", []string{"sh", "-c", "exit 1"}, nil, 10*time.Second); err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,177 @@
+package ik
+
+import (
+	"errors"
+	"sync"
+)
+
+// Harness runs the routing of a configuration in process, for testing the
+// configuration itself.  No input is started; records are fed to the
+// harness instead, and the outputs are replaced by CaptureOutputs keeping
+// what reaches them.  Filters are run as they are.
+type Harness struct {
+	engine  *engineImpl
+	router  *FluentRouter
+	inputs  map[string]Port
+	outputs []*CaptureOutput
+}
+
+// CaptureOutput stands in for the output with the given id, which is its
+// @id attribute or its type followed by its ordinal.
+type CaptureOutput struct {
+	Id         string
+	Type       string
+	recordSets []FluentRecordSet
+	mtx        sync.Mutex
+}
+
+type harnessInput struct {
+	factory *harnessInputFactory
+	port    Port
+}
+
+type harnessRegistry struct {
+	harness        *Harness
+	inputOrdinals  map[string]int
+	outputOrdinals map[string]int
+}
+
+func (output *CaptureOutput) Emit(recordSets []FluentRecordSet) error {
+	output.mtx.Lock()
+	defer output.mtx.Unlock()
+	output.recordSets = append(output.recordSets, recordSets...)
+	return nil
+}
+
+// RecordSets returns the record sets emitted at the output so far.
+func (output *CaptureOutput) RecordSets() []FluentRecordSet {
+	output.mtx.Lock()
+	defer output.mtx.Unlock()
+	return append([]FluentRecordSet(nil), output.recordSets...)
+}
+
+func (output *CaptureOutput) Factory() Plugin { return nil }
+func (output *CaptureOutput) Run() error      { return nil }
+func (output *CaptureOutput) Shutdown() error { return nil }
+func (output *CaptureOutput) Dispose()        {}
+
+func (input *harnessInput) Factory() Plugin { return input.factory }
+func (input *harnessInput) Port() Port      { return input.port }
+func (input *harnessInput) Run() error      { return nil }
+func (input *harnessInput) Shutdown() error { return nil }
+
+func (registry *harnessRegistry) RegisterInputFactory(factory InputFactory) error {
+	return errors.New("not supported")
+}
+
+func (registry *harnessRegistry) LookupInputFactory(name string) InputFactory {
+	return &harnessInputFactory{registry, name}
+}
+
+func (registry *harnessRegistry) RegisterOutputFactory(factory OutputFactory) error {
+	return errors.New("not supported")
+}
+
+func (registry *harnessRegistry) LookupOutputFactory(name string) OutputFactory {
+	return &harnessOutputFactory{registry, name}
+}
+
+type harnessInputFactory struct {
+	registry *harnessRegistry
+	name     string
+}
+
+type harnessOutputFactory struct {
+	registry *harnessRegistry
+	name     string
+}
+
+func (factory *harnessInputFactory) Name() string                 { return factory.name }
+func (factory *harnessInputFactory) BindScorekeeper(*Scorekeeper) {}
+
+// New keeps the default port the input would emit at, which applies the
+// same provenance and record ids as the real one would, numbering the
+// inputs the same way the configurer does.
+func (factory *harnessInputFactory) New(engine Engine, config *ConfigElement) (Input, error) {
+	registry := factory.registry
+	id := pluginInstanceId(config, registry.inputOrdinals[factory.name])
+	registry.inputOrdinals[factory.name] += 1
+	port := engine.DefaultPort()
+	registry.harness.inputs[id] = port
+	return &harnessInput{factory, port}, nil
+}
+
+func (factory *harnessOutputFactory) Name() string                 { return factory.name }
+func (factory *harnessOutputFactory) BindScorekeeper(*Scorekeeper) {}
+
+func (factory *harnessOutputFactory) New(engine Engine, config *ConfigElement) (Output, error) {
+	registry := factory.registry
+	id := pluginInstanceId(config, registry.outputOrdinals[factory.name])
+	registry.outputOrdinals[factory.name] += 1
+	output := &CaptureOutput{Id: id, Type: factory.name}
+	registry.harness.outputs = append(registry.harness.outputs, output)
+	return output, nil
+}
+
+// Emit feeds the record sets to the router as if the input with the given
+// id emitted them, or straight to the router if the id is empty.
+func (harness *Harness) Emit(inputId string, recordSets []FluentRecordSet) error {
+	if inputId == "" {
+		return harness.router.Emit(recordSets)
+	}
+	port, ok := harness.inputs[inputId]
+	if !ok {
+		return errors.New("no such input: " + inputId)
+	}
+	return port.Emit(recordSets)
+}
+
+// Outputs returns the outputs in the order they appear in the configuration.
+func (harness *Harness) Outputs() []*CaptureOutput {
+	return harness.outputs
+}
+
+// Output returns the output with the given id, or nil if there is none.
+func (harness *Harness) Output(id string) *CaptureOutput {
+	for _, output := range harness.outputs {
+		if output.Id == id {
+			return output
+		}
+	}
+	return nil
+}
+
+func (harness *Harness) Dispose() error {
+	return harness.engine.Dispose()
+}
+
+func NewHarness(logger Logger, opener Opener, lineParserPluginRegistry LineParserPluginRegistry, filterFactoryRegistry FilterFactoryRegistry, config *Config) (*Harness, error) {
+	harness := &Harness{
+		router:  NewFluentRouter(),
+		inputs:  make(map[string]Port),
+		outputs: make([]*CaptureOutput, 0),
+	}
+	registry := &harnessRegistry{
+		harness:        harness,
+		inputOrdinals:  make(map[string]int),
+		outputOrdinals: make(map[string]int),
+	}
+	harness.engine = NewEngine(logger, opener, lineParserPluginRegistry, nil, NewScorekeeper(logger), harness.router)
+	configurer := NewFluentConfigurer(logger, registry, registry, filterFactoryRegistry, harness.router)
+	_, outputs, err := configurer.build(harness.engine, config, harness.router)
+	if err == nil {
+		for _, output := range outputs {
+			if _, ok := output.(*CaptureOutput); !ok {
+				err = harness.engine.Launch(output)
+				if err != nil {
+					break
+				}
+			}
+		}
+	}
+	if err != nil {
+		harness.Dispose()
+		return nil, err
+	}
+	return harness, nil
+}
@@ -0,0 +1,61 @@
+package ik
+
+import (
+	"github.com/op/go-logging"
+	"testing"
+)
+
+func TestHarness(t *testing.T) {
+	data := `<source>
+  type forward
+  @id forward_in
+</source>
+<provenance>
+  collector_id collector1
+</provenance>
+<match app.**>
+  type copy
+  <store>
+    type stdout
+  </store>
+  <store>
+    type file
+    @id archive
+  </store>
+</match>
+<match **>
+  type stdout
+</match>`
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	harness, err := NewHarness(logging.MustGetLogger("ik"), myOpener(data), nil, nil, config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer harness.Dispose()
+	if len(harness.Outputs()) != 3 || harness.Outputs()[0].Id != "stdout#0" || harness.Outputs()[2].Id != "stdout#1" {
+		t.FailNow()
+	}
+	err = harness.Emit("forward_in", []FluentRecordSet{{Tag: "app.access", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = harness.Emit("", []FluentRecordSet{{Tag: "other", Records: []TinyFluentRecord{{Timestamp: 2, Data: map[string]interface{}{"a": 2}}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if harness.Emit("nonexistent", nil) == nil {
+		t.Fail()
+	}
+	recordSets := harness.Output("archive").RecordSets()
+	if len(recordSets) != 1 || recordSets[0].Records[0].Data["_provenance"] == nil {
+		t.Fail()
+	}
+	// every rule matching gets the records
+	recordSets = harness.Output("stdout#1").RecordSets()
+	if len(recordSets) != 2 || recordSets[1].Tag != "other" || recordSets[1].Records[0].Data["_provenance"] != nil {
+		t.Fail()
+	}
+}
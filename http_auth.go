@@ -0,0 +1,319 @@
+package ik
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// HTTPAuthenticator tells who a request comes from and the scopes it is
+// granted by the credentials it carries, and false if it carries none the
+// authenticator accepts.
+type HTTPAuthenticator interface {
+	Authenticate(req *http.Request) (principal string, scopes []string, ok bool)
+}
+
+// HTTPAuth authorizes the requests to an HTTP endpoint, each of which
+// requires a scope: "emit" for in_http, "read" for the scoreboard and the
+// monitoring part of the control API, and "control" for its flushing,
+// reloading and shutting down.  "*" grants every scope.  It is configured
+// by an <auth> element:
+//
+//	<auth>
+//	  realm ik
+//	  <api_key>
+//	    key_file /etc/ik/monitoring.key    # or key
+//	    scopes read
+//	  </api_key>
+//	  <basic admin>
+//	    password_sha256 8c6976e5b541...    # or password, or password_file
+//	    scopes read,control
+//	  </basic>
+//	  <client_cert CN=collector1,O=Example> # or just the common name
+//	    scopes emit
+//	  </client_cert>
+//	</auth>
+//
+// An API key is given by the X-API-Key header or as a bearer token.  The
+// client certificates are those the TLS configuration of the endpoint
+// verified, as given by tls_client_ca.  A nil HTTPAuth authorizes every
+// request.
+type HTTPAuth struct {
+	Realm          string
+	authenticators []HTTPAuthenticator
+}
+
+// HTTPAuthError is why a request is not authorized, with the status to
+// answer it with.
+type HTTPAuthError struct {
+	Status  int
+	Message string
+}
+
+type apiKeyAuthenticator struct {
+	key    string
+	scopes []string
+}
+
+type basicAuthenticator struct {
+	user           string
+	passwordSHA256 []byte
+	scopes         []string
+}
+
+type clientCertAuthenticator struct {
+	subject string
+	scopes  []string
+}
+
+func (err *HTTPAuthError) Error() string {
+	return err.Message
+}
+
+// NewAPIKeyAuthenticator returns the authenticator granting scopes to the
+// requests carrying key.
+func NewAPIKeyAuthenticator(key string, scopes []string) HTTPAuthenticator {
+	return &apiKeyAuthenticator{key, scopes}
+}
+
+// NewBasicAuthenticator returns the authenticator granting scopes to user
+// by basic auth, with the SHA-256 digest of the password.
+func NewBasicAuthenticator(user string, passwordSHA256 []byte, scopes []string) HTTPAuthenticator {
+	return &basicAuthenticator{user, passwordSHA256, scopes}
+}
+
+// NewClientCertAuthenticator returns the authenticator granting scopes to
+// the verified client certificates of subject, which is either the whole
+// distinguished name or the common name.
+func NewClientCertAuthenticator(subject string, scopes []string) HTTPAuthenticator {
+	return &clientCertAuthenticator{subject, scopes}
+}
+
+func (authenticator *apiKeyAuthenticator) Authenticate(req *http.Request) (string, []string, bool) {
+	key := req.Header.Get("X-API-Key")
+	if key == "" {
+		authorization := req.Header.Get("Authorization")
+		if !strings.HasPrefix(authorization, "Bearer ") {
+			return "", nil, false
+		}
+		key = strings.TrimPrefix(authorization, "Bearer ")
+	}
+	if subtle.ConstantTimeCompare([]byte(key), []byte(authenticator.key)) != 1 {
+		return "", nil, false
+	}
+	return "api_key", authenticator.scopes, true
+}
+
+func (authenticator *basicAuthenticator) Authenticate(req *http.Request) (string, []string, bool) {
+	user, password, ok := req.BasicAuth()
+	if !ok {
+		return "", nil, false
+	}
+	digest := sha256.Sum256([]byte(password))
+	userOk := subtle.ConstantTimeCompare([]byte(user), []byte(authenticator.user))
+	passwordOk := subtle.ConstantTimeCompare(digest[:], authenticator.passwordSHA256)
+	if userOk&passwordOk != 1 {
+		return "", nil, false
+	}
+	return user, authenticator.scopes, true
+}
+
+func (authenticator *clientCertAuthenticator) Authenticate(req *http.Request) (string, []string, bool) {
+	if req.TLS == nil || len(req.TLS.VerifiedChains) == 0 || len(req.TLS.VerifiedChains[0]) == 0 {
+		return "", nil, false
+	}
+	subject := req.TLS.VerifiedChains[0][0].Subject
+	if strings.Contains(authenticator.subject, "=") {
+		if subject.String() != authenticator.subject {
+			return "", nil, false
+		}
+	} else if subject.CommonName != authenticator.subject {
+		return "", nil, false
+	}
+	return subject.String(), authenticator.scopes, true
+}
+
+// NewHTTPAuth returns an HTTPAuth that authorizes nothing until
+// authenticators are added.
+func NewHTTPAuth(realm string) *HTTPAuth {
+	return &HTTPAuth{Realm: realm, authenticators: make([]HTTPAuthenticator, 0)}
+}
+
+// Add adds an authenticator, tried after those added before.
+func (auth *HTTPAuth) Add(authenticator HTTPAuthenticator) {
+	auth.authenticators = append(auth.authenticators, authenticator)
+}
+
+// Authorize returns who the request comes from if it is granted scope by
+// any of the authenticators, and an HTTPAuthError otherwise.
+func (auth *HTTPAuth) Authorize(req *http.Request, scope string) (string, error) {
+	if auth == nil {
+		return "", nil
+	}
+	authenticated := false
+	for _, authenticator := range auth.authenticators {
+		principal, scopes, ok := authenticator.Authenticate(req)
+		if !ok {
+			continue
+		}
+		authenticated = true
+		for _, scope_ := range scopes {
+			if scope_ == "*" || scope_ == scope {
+				return principal, nil
+			}
+		}
+	}
+	if !authenticated {
+		return "", &HTTPAuthError{http.StatusUnauthorized, "unauthorized"}
+	}
+	return "", &HTTPAuthError{http.StatusForbidden, "the scope " + scope + " is not granted"}
+}
+
+// Challenge asks a client not authenticated for basic auth, if any user
+// can be authenticated that way.
+func (auth *HTTPAuth) Challenge(resp http.ResponseWriter) {
+	for _, authenticator := range auth.authenticators {
+		if _, ok := authenticator.(*basicAuthenticator); ok {
+			resp.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q", auth.Realm))
+			return
+		}
+	}
+}
+
+// Deny answers a request that is not authorized.
+func (auth *HTTPAuth) Deny(resp http.ResponseWriter, err error) {
+	status := http.StatusForbidden
+	authErr, ok := err.(*HTTPAuthError)
+	if ok {
+		status = authErr.Status
+	}
+	if status == http.StatusUnauthorized {
+		auth.Challenge(resp)
+	}
+	http.Error(resp, err.Error(), status)
+}
+
+func readSecret(config *ConfigElement, name string) (string, bool, error) {
+	value, ok := config.Attrs[name]
+	if ok {
+		return value, true, nil
+	}
+	file, ok := config.Attrs[name+"_file"]
+	if !ok {
+		return "", false, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", false, err
+	}
+	return strings.TrimSpace(string(data)), true, nil
+}
+
+func parseAuthenticator(config *ConfigElement) (HTTPAuthenticator, error) {
+	scopes := splitHeaderValues(config.Attrs["scopes"])
+	if len(scopes) == 0 {
+		return nil, errors.New(fmt.Sprintf("<%s> in <auth> requires scopes", config.Name))
+	}
+	switch config.Name {
+	case "api_key":
+		key, ok, err := readSecret(config, "key")
+		if err != nil {
+			return nil, err
+		}
+		if !ok || key == "" {
+			return nil, errors.New("<api_key> requires either key or key_file")
+		}
+		return NewAPIKeyAuthenticator(key, scopes), nil
+	case "basic":
+		if config.Args == "" {
+			return nil, errors.New("<basic> requires a user name")
+		}
+		digestStr, ok := config.Attrs["password_sha256"]
+		if ok {
+			digest, err := hex.DecodeString(digestStr)
+			if err != nil || len(digest) != sha256.Size {
+				return nil, errors.New("invalid password_sha256 of " + config.Args)
+			}
+			return NewBasicAuthenticator(config.Args, digest, scopes), nil
+		}
+		password, ok, err := readSecret(config, "password")
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, errors.New("<basic> requires either password, password_file or password_sha256")
+		}
+		digest := sha256.Sum256([]byte(password))
+		return NewBasicAuthenticator(config.Args, digest[:], scopes), nil
+	case "client_cert":
+		if config.Args == "" {
+			return nil, errors.New("<client_cert> requires a subject")
+		}
+		return NewClientCertAuthenticator(config.Args, scopes), nil
+	}
+	return nil, errors.New(fmt.Sprintf("unexpected <%s> in <auth>", config.Name))
+}
+
+// ParseHTTPAuth reads the <auth> element of the configuration of an
+// endpoint, and returns nil if there is none.
+func ParseHTTPAuth(config *ConfigElement) (*HTTPAuth, error) {
+	for _, v := range config.Elems {
+		if v.Name != "auth" {
+			continue
+		}
+		realm, ok := v.Attrs["realm"]
+		if !ok {
+			realm = "ik"
+		}
+		auth := NewHTTPAuth(realm)
+		for _, w := range v.Elems {
+			authenticator, err := parseAuthenticator(w)
+			if err != nil {
+				return nil, err
+			}
+			auth.Add(authenticator)
+		}
+		return auth, nil
+	}
+	return nil, nil
+}
+
+// ParseTLSServerConfig reads tls_cert, tls_key and tls_client_ca, and
+// returns nil if there is no tls_cert to serve over TLS with.  The client
+// certificates are verified by tls_client_ca if they are given, so that
+// the clients authenticated otherwise need none.
+func ParseTLSServerConfig(config *ConfigElement) (*tls.Config, error) {
+	certFile, ok := config.Attrs["tls_cert"]
+	if !ok {
+		return nil, nil
+	}
+	keyFile, ok := config.Attrs["tls_key"]
+	if !ok {
+		return nil, errors.New("required attribute `tls_key' is not specified")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	clientCAFile, ok := config.Attrs["tls_client_ca"]
+	if ok {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + clientCAFile)
+		}
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return tlsConfig, nil
+}
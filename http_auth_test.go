@@ -0,0 +1,115 @@
+package ik
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseHTTPAuth(t *testing.T) {
+	const data = "<auth>\n" +
+		"<api_key>\n" +
+		"key monitoring-key\n" +
+		"scopes read\n" +
+		"</api_key>\n" +
+		"<basic admin>\n" +
+		"password_sha256 8c6976e5b5410415bde908bd4dee15dfb167a9c873fc4bb8a81f6f2ab448a918\n" +
+		"scopes read, control\n" +
+		"</basic>\n" +
+		"<client_cert CN=collector1,O=Example>\n" +
+		"scopes *\n" +
+		"</client_cert>\n" +
+		"</auth>\n"
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	auth, err := ParseHTTPAuth(config.Root)
+	if err != nil || auth == nil || len(auth.authenticators) != 3 || auth.Realm != "ik" {
+		t.Fatalf("%v %v", err, auth)
+	}
+	authorize := func(scope string, prepare func(req *http.Request)) (string, int) {
+		req, _ := http.NewRequest("GET", "/", nil)
+		prepare(req)
+		principal, err := auth.Authorize(req, scope)
+		if err != nil {
+			return "", err.(*HTTPAuthError).Status
+		}
+		return principal, http.StatusOK
+	}
+	// read-only monitoring is granted apart from control
+	if _, status := authorize("read", func(req *http.Request) { req.Header.Set("X-API-Key", "monitoring-key") }); status != http.StatusOK {
+		t.Fail()
+	}
+	if _, status := authorize("control", func(req *http.Request) { req.Header.Set("Authorization", "Bearer monitoring-key") }); status != http.StatusForbidden {
+		t.Fail()
+	}
+	if principal, status := authorize("control", func(req *http.Request) { req.SetBasicAuth("admin", "admin") }); status != http.StatusOK || principal != "admin" {
+		t.Fail()
+	}
+	if _, status := authorize("read", func(req *http.Request) { req.SetBasicAuth("admin", "wrong") }); status != http.StatusUnauthorized {
+		t.Fail()
+	}
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "collector1", Organization: []string{"Example"}}}
+	if principal, status := authorize("emit", func(req *http.Request) {
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}); status != http.StatusOK || principal != "CN=collector1,O=Example" {
+		t.Fatalf("%s %d", principal, status)
+	}
+	// a certificate not verified is no credential
+	if _, status := authorize("emit", func(req *http.Request) {
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	}); status != http.StatusUnauthorized {
+		t.Fail()
+	}
+
+	for _, data := range []string{
+		"<auth>\n<api_key>\nkey a\n</api_key>\n</auth>\n",
+		"<auth>\n<basic>\npassword a\nscopes read\n</basic>\n</auth>\n",
+		"<auth>\n<basic a>\npassword_sha256 abc\nscopes read\n</basic>\n</auth>\n",
+		"<auth>\n<oauth>\nscopes read\n</oauth>\n</auth>\n",
+	} {
+		config, _ = ParseConfig(myOpener(data), "test.cfg")
+		if _, err = ParseHTTPAuth(config.Root); err == nil {
+			t.Fatalf("%s", data)
+		}
+	}
+}
+
+func Test_WrapHTTPHandler_auth(t *testing.T) {
+	auth := NewHTTPAuth("test")
+	digest := sha256.Sum256([]byte("password"))
+	auth.Add(NewBasicAuthenticator("user", digest[:], []string{"emit"}))
+	handler := WrapHTTPHandler(echoHandler{}, &HTTPHandlerOptions{
+		CORSAllowOrigins: []string{"*"},
+		Auth:             auth,
+		AuthScope:        "emit",
+	})
+	req, _ := http.NewRequest("POST", "/", strings.NewReader("abc"))
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnauthorized || resp.Header().Get("WWW-Authenticate") != `Basic realm="test"` {
+		t.Fatalf("%d %v", resp.Code, resp.Header())
+	}
+	req, _ = http.NewRequest("POST", "/", strings.NewReader("abc"))
+	req.SetBasicAuth("user", "password")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK || resp.Body.String() != "abc" {
+		t.Fatalf("%d %s", resp.Code, resp.Body.String())
+	}
+	// the preflight requests carry no credentials
+	req, _ = http.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNoContent {
+		t.Fail()
+	}
+}
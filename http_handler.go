@@ -0,0 +1,253 @@
+package ik
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// HTTPHandlerOptions configures what WrapHTTPHandler adds around a handler.
+// The requests are authorized by Auth for AuthScope, which the endpoint
+// sets.
+type HTTPHandlerOptions struct {
+	CORSAllowOrigins     []string
+	CORSAllowMethods     string
+	CORSAllowHeaders     string
+	CORSAllowCredentials bool
+	CORSMaxAge           int
+	CompressResponse     bool
+	Auth                 *HTTPAuth
+	AuthScope            string
+}
+
+type httpHandler struct {
+	handler http.Handler
+	options *HTTPHandlerOptions
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	writer *gzip.Writer
+}
+
+type readCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+func (rc *readCloser) Close() error {
+	return rc.closer.Close()
+}
+
+func (resp *gzipResponseWriter) Write(b []byte) (int, error) {
+	// keep net/http from sniffing the type of the compressed bytes
+	if resp.Header().Get("Content-Type") == "" {
+		resp.Header().Set("Content-Type", http.DetectContentType(b))
+	}
+	return resp.writer.Write(b)
+}
+
+func (resp *gzipResponseWriter) WriteHeader(status int) {
+	resp.Header().Del("Content-Length")
+	resp.ResponseWriter.WriteHeader(status)
+}
+
+func (resp *gzipResponseWriter) Flush() {
+	resp.writer.Flush()
+	flusher, ok := resp.ResponseWriter.(http.Flusher)
+	if ok {
+		flusher.Flush()
+	}
+}
+
+func splitHeaderValues(s string) []string {
+	retval := make([]string, 0)
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			retval = append(retval, v)
+		}
+	}
+	return retval
+}
+
+func (handler *httpHandler) allowedOrigin(origin string) string {
+	for _, allowed := range handler.options.CORSAllowOrigins {
+		if allowed == "*" && !handler.options.CORSAllowCredentials {
+			return "*"
+		}
+		if allowed == "*" || allowed == origin {
+			return origin
+		}
+	}
+	return ""
+}
+
+// setCORSHeaders returns true if the request is a preflight request, which
+// needs no further handling.
+func (handler *httpHandler) setCORSHeaders(resp http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" || len(handler.options.CORSAllowOrigins) == 0 {
+		return false
+	}
+	allowedOrigin := handler.allowedOrigin(origin)
+	if allowedOrigin == "" {
+		return false
+	}
+	header := resp.Header()
+	header.Set("Access-Control-Allow-Origin", allowedOrigin)
+	if allowedOrigin != "*" {
+		header.Add("Vary", "Origin")
+	}
+	if handler.options.CORSAllowCredentials {
+		header.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if req.Method != "OPTIONS" || req.Header.Get("Access-Control-Request-Method") == "" {
+		return false
+	}
+	header.Set("Access-Control-Allow-Methods", handler.options.CORSAllowMethods)
+	header.Set("Access-Control-Allow-Headers", handler.options.CORSAllowHeaders)
+	if handler.options.CORSMaxAge > 0 {
+		header.Set("Access-Control-Max-Age", strconv.Itoa(handler.options.CORSMaxAge))
+	}
+	resp.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+var supportedContentEncodings = map[string]bool{
+	"":         true,
+	"identity": true,
+	"gzip":     true,
+	"x-gzip":   true,
+	"deflate":  true,
+}
+
+func decompressRequestBody(req *http.Request, encoding string) error {
+	var reader io.Reader
+	switch encoding {
+	case "", "identity":
+		return nil
+	case "gzip", "x-gzip":
+		var err error
+		reader, err = gzip.NewReader(req.Body)
+		if err != nil {
+			return err
+		}
+	case "deflate":
+		// deflate is meant to be zlib-wrapped, but some clients send it raw
+		bufReader := bufio.NewReader(req.Body)
+		header, _ := bufReader.Peek(2)
+		if len(header) == 2 && header[0]&0x0f == 8 && (int(header[0])<<8|int(header[1]))%31 == 0 {
+			var err error
+			reader, err = zlib.NewReader(bufReader)
+			if err != nil {
+				return err
+			}
+		} else {
+			reader = flate.NewReader(bufReader)
+		}
+	}
+	req.Body = &readCloser{reader, req.Body}
+	req.Header.Del("Content-Encoding")
+	req.Header.Del("Content-Length")
+	req.ContentLength = -1
+	return nil
+}
+
+func acceptsGzip(req *http.Request) bool {
+	for _, v := range splitHeaderValues(req.Header.Get("Accept-Encoding")) {
+		if strings.TrimSpace(strings.SplitN(v, ";", 2)[0]) == "gzip" && !strings.HasSuffix(strings.Replace(v, " ", "", -1), ";q=0") {
+			return true
+		}
+	}
+	return false
+}
+
+func (handler *httpHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if handler.setCORSHeaders(resp, req) {
+		return
+	}
+	_, err := handler.options.Auth.Authorize(req, handler.options.AuthScope)
+	if err != nil {
+		handler.options.Auth.Deny(resp, err)
+		return
+	}
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get("Content-Encoding")))
+	if !supportedContentEncodings[encoding] {
+		http.Error(resp, "unsupported content encoding: "+encoding, http.StatusUnsupportedMediaType)
+		return
+	}
+	err = decompressRequestBody(req, encoding)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if handler.options.CompressResponse && acceptsGzip(req) {
+		resp.Header().Set("Content-Encoding", "gzip")
+		resp.Header().Add("Vary", "Accept-Encoding")
+		writer, _ := gzip.NewWriterLevel(resp, flate.DefaultCompression)
+		defer writer.Close()
+		resp = &gzipResponseWriter{resp, writer}
+	}
+	handler.handler.ServeHTTP(resp, req)
+}
+
+// WrapHTTPHandler returns a handler adding CORS headers, answering preflight
+// requests, authorizing the others, decompressing gzip or deflate request bodies and, if asked to,
+// compressing responses for the clients accepting gzip.
+func WrapHTTPHandler(handler http.Handler, options *HTTPHandlerOptions) http.Handler {
+	return &httpHandler{handler, options}
+}
+
+// ParseHTTPHandlerOptions reads the cors_* and compress_response attributes
+// and the <auth> element.
+func ParseHTTPHandlerOptions(config *ConfigElement) (*HTTPHandlerOptions, error) {
+	options := &HTTPHandlerOptions{
+		CORSAllowOrigins: splitHeaderValues(config.Attrs["cors_allow_origins"]),
+		CORSAllowMethods: "GET, POST, PUT, OPTIONS",
+		CORSAllowHeaders: "Content-Type, Content-Encoding, Authorization",
+	}
+	value, ok := config.Attrs["cors_allow_methods"]
+	if ok {
+		options.CORSAllowMethods = value
+	}
+	value, ok = config.Attrs["cors_allow_headers"]
+	if ok {
+		options.CORSAllowHeaders = value
+	}
+	value, ok = config.Attrs["cors_allow_credentials"]
+	if ok {
+		var err error
+		options.CORSAllowCredentials, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	value, ok = config.Attrs["cors_max_age"]
+	if ok {
+		var err error
+		options.CORSMaxAge, err = strconv.Atoi(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	value, ok = config.Attrs["compress_response"]
+	if ok {
+		var err error
+		options.CompressResponse, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	auth, err := ParseHTTPAuth(config)
+	if err != nil {
+		return nil, err
+	}
+	options.Auth = auth
+	return options, nil
+}
@@ -0,0 +1,87 @@
+package ik
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type echoHandler struct{}
+
+func (echoHandler) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	resp.Header().Set("Content-Type", "text/plain")
+	resp.Write(body)
+}
+
+func Test_WrapHTTPHandler_CORS(t *testing.T) {
+	handler := WrapHTTPHandler(echoHandler{}, &HTTPHandlerOptions{
+		CORSAllowOrigins: []string{"http://example.com"},
+		CORSAllowMethods: "POST",
+		CORSAllowHeaders: "Content-Type",
+		CORSMaxAge:       600,
+	})
+	req, _ := http.NewRequest("OPTIONS", "/", nil)
+	req.Header.Set("Origin", "http://example.com")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusNoContent || resp.Header().Get("Access-Control-Allow-Origin") != "http://example.com" || resp.Header().Get("Access-Control-Max-Age") != "600" {
+		t.Fail()
+	}
+	req, _ = http.NewRequest("POST", "/", bytes.NewReader([]byte("abc")))
+	req.Header.Set("Origin", "http://example.org")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Header().Get("Access-Control-Allow-Origin") != "" || resp.Body.String() != "abc" {
+		t.Fail()
+	}
+}
+
+func Test_WrapHTTPHandler_compression(t *testing.T) {
+	handler := WrapHTTPHandler(echoHandler{}, &HTTPHandlerOptions{CompressResponse: true})
+	body := &bytes.Buffer{}
+	writer := gzip.NewWriter(body)
+	writer.Write([]byte("gzipped"))
+	writer.Close()
+	req, _ := http.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatal(resp.Body.String())
+	}
+	reader, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decompressed, _ := ioutil.ReadAll(reader)
+	if string(decompressed) != "gzipped" {
+		t.Fail()
+	}
+
+	body = &bytes.Buffer{}
+	zwriter := zlib.NewWriter(body)
+	zwriter.Write([]byte("deflated"))
+	zwriter.Close()
+	req, _ = http.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Encoding", "deflate")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Header().Get("Content-Encoding") != "" || resp.Body.String() != "deflated" {
+		t.Fail()
+	}
+
+	req, _ = http.NewRequest("POST", "/", nil)
+	req.Header.Set("Content-Encoding", "br")
+	resp = httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnsupportedMediaType {
+		t.Fail()
+	}
+}
@@ -1,6 +1,7 @@
 package ik
 
 import (
+	"context"
 	"github.com/moriyoshi/ik/task"
 	"io"
 	"math/rand"
@@ -18,20 +19,67 @@ type TinyFluentRecord struct {
 	Data      map[string]interface{}
 }
 
+// FluentRecordSet is records of a tag.  Packed is the msgpack stream of
+// [time, record] entries the records were decoded from, if they came in
+// the PackedForward form, for out_forward to send on as they are.  It is
+// only kept while the records are not modified; whatever modifies them in
+// place must clear it.
 type FluentRecordSet struct {
 	Tag     string
 	Records []TinyFluentRecord
+	Packed  []byte
 }
 
 type Port interface {
 	Emit(recordSets []FluentRecordSet) error
 }
 
+// DurablePort is a Port that can tell when the records emitted through it
+// have been stored durably; EmitDurably does not return until then.
+type DurablePort interface {
+	Port
+	EmitDurably(recordSets []FluentRecordSet) error
+}
+
+// ContextPort is a Port whose emissions can be given up once ctx is done,
+// e.g. while the port is blocked on a queue that is full.
+type ContextPort interface {
+	Port
+	EmitContext(ctx context.Context, recordSets []FluentRecordSet) error
+}
+
+// ResultPort is a DurablePort that can tell which of the record sets
+// emitted through it could not be stored, so that an input can nack only
+// those.  EmitWithResult returns the error of each record set by index,
+// nil for the ones stored.
+type ResultPort interface {
+	DurablePort
+	EmitWithResult(recordSets []FluentRecordSet) []error
+}
+
 type Spawnee interface {
 	Run() error
 	Shutdown() error
 }
 
+// ContextSpawnee is a Spawnee whose work can be cancelled.  The spawner calls
+// RunContext in place of Run, with a context that is done once the spawnee
+// has been killed and the deadline given to KillContext has passed, and
+// ShutdownContext in place of Shutdown.  ShutdownContext should abandon what
+// it waits for, like a flush in flight, once ctx is done.
+type ContextSpawnee interface {
+	Spawnee
+	RunContext(ctx context.Context) error
+	ShutdownContext(ctx context.Context) error
+}
+
+// HealthChecker is implemented by spawnees that can tell whether they are
+// able to do their work, e.g. whether the last delivery of an output
+// succeeded.  CheckHealth returns nil if so, and should answer quickly.
+type HealthChecker interface {
+	CheckHealth() error
+}
+
 type PluginInstance interface {
 	Spawnee
 	Factory() Plugin
@@ -47,6 +95,28 @@ type Output interface {
 	Port
 }
 
+// Flusher is an Output that can be made to deliver what it has buffered
+// without waiting for its flush interval.
+type Flusher interface {
+	Flush() error
+}
+
+// Drainer is an Output that can be made to deliver everything it has
+// buffered and to refuse the records emitted through it from then on, e.g.
+// before the process is replaced.  Drain returns once the deliveries are
+// done, with the error one of them failed with, if any.
+type Drainer interface {
+	Drain() error
+}
+
+// WarmUpper is an Output that can start out warming up, buffering the
+// records it is given without delivering them until it is ready.  SetReady
+// ends the warm-up, if it has not ended already.
+type WarmUpper interface {
+	Ready() bool
+	SetReady()
+}
+
 type MarkupAttributes int
 
 const (
@@ -100,14 +170,33 @@ type Opener interface {
 
 type Engine interface {
 	Disposable
+	// DisposeContext is Dispose that gives up waiting for the spawnees to
+	// shut down gracefully once ctx is done.
+	DisposeContext(ctx context.Context) error
+	// ReportPanic tells the engine of a panic recovered in a goroutine of
+	// the plugin's own.
+	ReportPanic(plugin interface{}, panicked *Panicked)
+	// DeadLetter hands the records the plugin gave up on over to the
+	// dead-letter queue, or logs them if there is none.
+	DeadLetter(plugin interface{}, cause error, recordSets []FluentRecordSet)
 	Logger() Logger
 	Opener() Opener
 	LineParserPluginRegistry() LineParserPluginRegistry
+	FormatterPluginRegistry() FormatterPluginRegistry
 	RandSource() rand.Source
 	Scorekeeper() *Scorekeeper
+	// Tracer returns the tracer of the records, which records nothing
+	// unless tracing is enabled.
+	Tracer() *Tracer
+	// Clock returns the clock the plugins tell the time by and wait on.
+	Clock() Clock
+	// Tenants returns the tenants of the configuration, which has none
+	// unless it has a <tenants> element.
+	Tenants() *Tenants
 	DefaultPort() Port
 	Spawn(Spawnee) error
 	Launch(PluginInstance) error
+	Terminate(PluginInstance) error
 	SpawneeStatuses() ([]SpawneeStatus, error)
 	PluginInstances() []PluginInstance
 	RecurringTaskScheduler() *task.RecurringTaskScheduler
@@ -133,6 +222,23 @@ type OutputFactoryRegistry interface {
 	LookupOutputFactory(name string) OutputFactory
 }
 
+// Filter takes the records routed to it on their way to the outputs, and
+// emits what it makes of them at the port it was created with.
+type Filter interface {
+	PluginInstance
+	Port
+}
+
+type FilterFactory interface {
+	Plugin
+	New(engine Engine, config *ConfigElement, next Port) (Filter, error)
+}
+
+type FilterFactoryRegistry interface {
+	RegisterFilterFactory(factory FilterFactory) error
+	LookupFilterFactory(name string) FilterFactory
+}
+
 type PluginRegistry interface {
 	Plugins() []Plugin
 }
@@ -149,8 +255,40 @@ type ScoreboardFactory interface {
 type JournalChunk interface {
 	Disposable
 	GetReader() (io.Reader, error)
+	// GetNextChunk returns the next newer chunk, which the caller is to
+	// dispose of.  Chunks is the safer way to walk the chunks.
 	GetNextChunk() JournalChunk
 	TakeOwnership() bool
+	// UniqueId returns the id the chunk keeps for its life and across
+	// restarts, for the receivers to tell a chunk delivered again on a
+	// retry from a new one.
+	UniqueId() string
+}
+
+// SeekableJournalChunk is a chunk that can be read from a record on, a
+// record being what a single Write put in the journal, so that a delivery
+// failing partway resumes where it stopped.
+type SeekableJournalChunk interface {
+	JournalChunk
+	// GetReaderAt returns a reader starting at the latest record indexed
+	// at or before recordOffset, along with the offset of that record;
+	// the records from there on up to recordOffset are for the caller to
+	// skip.
+	GetReaderAt(recordOffset int64) (io.Reader, int64, error)
+}
+
+// JournalChunkIterator walks the chunks a journal had when it was created,
+// from the oldest on.  It holds a reference to each of them until it has
+// moved past it or is closed, so that none is purged under it; the chunk
+// Value returns is the iterator's, whose ownership may be taken but which
+// is not to be disposed of.
+type JournalChunkIterator interface {
+	// Next moves to the next chunk, and tells whether there is one.
+	Next() bool
+	Value() JournalChunk
+	// Close releases the chunks not moved past yet.  It may be called more
+	// than once.
+	Close() error
 }
 
 type JournalChunkListener func(JournalChunk) error
@@ -158,11 +296,18 @@ type JournalChunkListener func(JournalChunk) error
 type Journal interface {
 	Disposable
 	Key() string
+	// Write must not keep data after it returns.
 	Write(data []byte) error
 	GetTailChunk() JournalChunk
+	// Chunks returns an iterator over a snapshot of the chunks, which the
+	// caller is to close.
+	Chunks() JournalChunkIterator
 	AddNewChunkListener(JournalChunkListener)
 	AddFlushListener(JournalChunkListener)
 	Flush(func(JournalChunk) error) error
+	// FlushContext is Flush that stops visiting the chunks once ctx is done.
+	FlushContext(ctx context.Context, visitor func(JournalChunk) error) error
+	Sync() error
 }
 
 type JournalGroup interface {
@@ -187,6 +332,13 @@ type LineParserFactory interface {
 	New(receiver func(FluentRecord) error) (LineParser, error)
 }
 
+// PathLineParserFactory is a LineParserFactory whose parsers can be told the
+// path of the file the lines are read from, which in_tail does.
+type PathLineParserFactory interface {
+	LineParserFactory
+	NewForPath(path string, receiver func(FluentRecord) error) (LineParser, error)
+}
+
 type LineParserFactoryFactory func(engine Engine, config *ConfigElement) (LineParserFactory, error)
 
 type LineParserPlugin interface {
@@ -199,6 +351,22 @@ type LineParserPluginRegistry interface {
 	LookupLineParserFactoryFactory(name string) LineParserFactoryFactory
 }
 
+type Formatter interface {
+	Format(tag string, record FluentRecord) ([]byte, error)
+}
+
+type FormatterFactory func(engine Engine, config *ConfigElement) (Formatter, error)
+
+type FormatterPlugin interface {
+	Name() string
+	OnRegistering(func(name string, factory FormatterFactory) error) error
+}
+
+type FormatterPluginRegistry interface {
+	RegisterFormatterPlugin(plugin FormatterPlugin) error
+	LookupFormatterFactory(name string) FormatterFactory
+}
+
 type Logger interface {
 	Critical(format string, args ...interface{})
 	Error(format string, args ...interface{})
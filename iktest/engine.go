@@ -0,0 +1,246 @@
+package iktest
+
+import (
+	"context"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/task"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+// DeadLetter is what a plugin handed over to the dead-letter queue.
+type DeadLetter struct {
+	Plugin     interface{}
+	Cause      error
+	RecordSets []ik.FluentRecordSet
+}
+
+// ReportedPanic is a panic a plugin reported.
+type ReportedPanic struct {
+	Plugin   interface{}
+	Panicked *ik.Panicked
+}
+
+// Engine is an ik.Engine for the plugins under test.  Its default port is
+// a Port, its random source is seeded with 0, and the recurring tasks are
+// scheduled by its Clock.  Spawn and Launch only keep the spawnees, which
+// the test runs itself; Terminate and Dispose shut them down.  The dead
+// letters and the panics reported are kept as well.
+type Engine struct {
+	logger          ik.Logger
+	opener          ik.Opener
+	registry        *ik.MultiFactoryRegistry
+	scorekeeper     *ik.Scorekeeper
+	port            *Port
+	randSource      rand.Source
+	tracer          *ik.Tracer
+	tenants         *ik.Tenants
+	clock           *Clock
+	scheduler       *task.RecurringTaskScheduler
+	spawnees        []ik.Spawnee
+	pluginInstances []ik.PluginInstance
+	deadLetters     []DeadLetter
+	panics          []ReportedPanic
+	mtx             sync.Mutex
+}
+
+// NewEngine creates an engine logging to the test, whose clock is set to
+// the Unix epoch.
+func NewEngine(t testing.TB) *Engine {
+	logger := &TestLogger{t}
+	scorekeeper := ik.NewScorekeeper(logger)
+	clock := NewClock(time.Unix(0, 0))
+	return &Engine{
+		logger:          logger,
+		opener:          ik.DefaultOpener("."),
+		registry:        ik.NewMultiFactoryRegistry(scorekeeper),
+		scorekeeper:     scorekeeper,
+		port:            NewPort(),
+		randSource:      rand.NewSource(0),
+		tracer:          ik.NewTracer(logger, clock),
+		tenants:         &ik.Tenants{},
+		clock:           clock,
+		scheduler:       task.NewRecurringTaskScheduler(clock.Now, &task.SimpleTaskRunner{}),
+		spawnees:        make([]ik.Spawnee, 0),
+		pluginInstances: make([]ik.PluginInstance, 0),
+		deadLetters:     make([]DeadLetter, 0),
+		panics:          make([]ReportedPanic, 0),
+	}
+}
+
+// SetOpener makes the engine open the files the plugins refer to with
+// opener.
+func (engine *Engine) SetOpener(opener ik.Opener) {
+	engine.opener = opener
+}
+
+// Port returns the default port.
+func (engine *Engine) Port() *Port {
+	return engine.port
+}
+
+// FakeClock returns the clock the engine gives as its Clock.
+func (engine *Engine) FakeClock() *Clock {
+	return engine.clock
+}
+
+// Registry returns the registry the parsers and the formatters are looked
+// up in.
+func (engine *Engine) Registry() *ik.MultiFactoryRegistry {
+	return engine.registry
+}
+
+func (engine *Engine) Logger() ik.Logger {
+	return engine.logger
+}
+
+func (engine *Engine) Opener() ik.Opener {
+	return engine.opener
+}
+
+func (engine *Engine) LineParserPluginRegistry() ik.LineParserPluginRegistry {
+	return engine.registry
+}
+
+func (engine *Engine) FormatterPluginRegistry() ik.FormatterPluginRegistry {
+	return engine.registry
+}
+
+func (engine *Engine) RandSource() rand.Source {
+	return engine.randSource
+}
+
+func (engine *Engine) Scorekeeper() *ik.Scorekeeper {
+	return engine.scorekeeper
+}
+
+func (engine *Engine) Tracer() *ik.Tracer {
+	return engine.tracer
+}
+
+func (engine *Engine) Clock() ik.Clock {
+	return engine.clock
+}
+
+func (engine *Engine) Tenants() *ik.Tenants {
+	return engine.tenants
+}
+
+func (engine *Engine) DefaultPort() ik.Port {
+	return engine.port
+}
+
+func (engine *Engine) RecurringTaskScheduler() *task.RecurringTaskScheduler {
+	return engine.scheduler
+}
+
+func (engine *Engine) Spawn(spawnee ik.Spawnee) error {
+	engine.mtx.Lock()
+	defer engine.mtx.Unlock()
+	engine.spawnees = append(engine.spawnees, spawnee)
+	return nil
+}
+
+func (engine *Engine) Launch(pluginInstance ik.PluginInstance) error {
+	engine.mtx.Lock()
+	defer engine.mtx.Unlock()
+	engine.spawnees = append(engine.spawnees, pluginInstance)
+	engine.pluginInstances = append(engine.pluginInstances, pluginInstance)
+	return nil
+}
+
+func (engine *Engine) Terminate(pluginInstance ik.PluginInstance) error {
+	engine.mtx.Lock()
+	for i, pluginInstance_ := range engine.pluginInstances {
+		if pluginInstance_ == pluginInstance {
+			engine.pluginInstances = append(engine.pluginInstances[0:i:i], engine.pluginInstances[i+1:]...)
+			break
+		}
+	}
+	for i, spawnee := range engine.spawnees {
+		if spawnee == pluginInstance {
+			engine.spawnees = append(engine.spawnees[0:i:i], engine.spawnees[i+1:]...)
+			break
+		}
+	}
+	engine.mtx.Unlock()
+	return pluginInstance.Shutdown()
+}
+
+// Spawnees returns the spawnees spawned or launched and not terminated.
+func (engine *Engine) Spawnees() []ik.Spawnee {
+	engine.mtx.Lock()
+	defer engine.mtx.Unlock()
+	return append([]ik.Spawnee(nil), engine.spawnees...)
+}
+
+func (engine *Engine) SpawneeStatuses() ([]ik.SpawneeStatus, error) {
+	retval := make([]ik.SpawneeStatus, 0)
+	for i, spawnee := range engine.Spawnees() {
+		retval = append(retval, ik.SpawneeStatus{Id: i, Spawnee: spawnee, State: "Running"})
+	}
+	return retval, nil
+}
+
+func (engine *Engine) PluginInstances() []ik.PluginInstance {
+	engine.mtx.Lock()
+	defer engine.mtx.Unlock()
+	return append([]ik.PluginInstance(nil), engine.pluginInstances...)
+}
+
+func (engine *Engine) ReportPanic(plugin interface{}, panicked *ik.Panicked) {
+	engine.mtx.Lock()
+	defer engine.mtx.Unlock()
+	engine.panics = append(engine.panics, ReportedPanic{plugin, panicked})
+}
+
+// Panics returns the panics reported so far.
+func (engine *Engine) Panics() []ReportedPanic {
+	engine.mtx.Lock()
+	defer engine.mtx.Unlock()
+	return append([]ReportedPanic(nil), engine.panics...)
+}
+
+func (engine *Engine) DeadLetter(plugin interface{}, cause error, recordSets []ik.FluentRecordSet) {
+	engine.mtx.Lock()
+	defer engine.mtx.Unlock()
+	engine.deadLetters = append(engine.deadLetters, DeadLetter{plugin, cause, recordSets})
+}
+
+// DeadLetters returns what was handed over to the dead-letter queue so
+// far.
+func (engine *Engine) DeadLetters() []DeadLetter {
+	engine.mtx.Lock()
+	defer engine.mtx.Unlock()
+	return append([]DeadLetter(nil), engine.deadLetters...)
+}
+
+func (engine *Engine) Dispose() error {
+	return engine.DisposeContext(context.Background())
+}
+
+// DisposeContext shuts every spawnee down, the last spawned first, and
+// returns the first error.
+func (engine *Engine) DisposeContext(ctx context.Context) error {
+	engine.mtx.Lock()
+	spawnees := engine.spawnees
+	engine.spawnees = make([]ik.Spawnee, 0)
+	engine.pluginInstances = make([]ik.PluginInstance, 0)
+	engine.mtx.Unlock()
+	var retval error
+	for i := len(spawnees) - 1; i >= 0; i -= 1 {
+		var err error
+		contextSpawnee, ok := spawnees[i].(ik.ContextSpawnee)
+		if ok {
+			err = contextSpawnee.ShutdownContext(ctx)
+		} else {
+			err = spawnees[i].Shutdown()
+		}
+		if err != nil && retval == nil {
+			retval = err
+		}
+	}
+	return retval
+}
@@ -0,0 +1,248 @@
+// Package iktest has test doubles for the plugins out of this tree to be
+// unit tested with, needing neither the file journal nor listeners: an
+// Engine handing out a capturing Port, an in-memory JournalGroup whose
+// writes and syncs can be made to fail, a Clock moved by hand, and
+// helpers asserting what was emitted.
+//
+//	engine := iktest.NewEngine(t)
+//	output, err := (&MyOutputFactory{}).New(engine, config)
+//	...
+//	iktest.ExpectRecords(t, engine.Port().RecordSets(), "app.web", map[string]interface{}{"message": "hello"})
+package iktest
+
+import (
+	"encoding/json"
+	"github.com/moriyoshi/ik"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestLogger logs to the log of the test.
+type TestLogger struct {
+	T testing.TB
+}
+
+func (logger *TestLogger) Critical(format string, args ...interface{}) {
+	logger.T.Logf("CRITICAL: "+format, args...)
+}
+
+func (logger *TestLogger) Error(format string, args ...interface{}) {
+	logger.T.Logf("ERROR: "+format, args...)
+}
+
+func (logger *TestLogger) Warning(format string, args ...interface{}) {
+	logger.T.Logf("WARNING: "+format, args...)
+}
+
+func (logger *TestLogger) Notice(format string, args ...interface{}) {
+	logger.T.Logf("NOTICE: "+format, args...)
+}
+
+func (logger *TestLogger) Info(format string, args ...interface{}) {
+	logger.T.Logf("INFO: "+format, args...)
+}
+
+func (logger *TestLogger) Debug(format string, args ...interface{}) {
+	logger.T.Logf("DEBUG: "+format, args...)
+}
+
+// Clock is an ik.Clock telling the time it is set to, which only changes
+// by Set and Advance.  Its tickers and timers fire as it is moved past
+// their time, dropping the ticks not received as those of the time package
+// do.
+type Clock struct {
+	now     time.Time
+	waiters []*waiter
+	mtx     sync.Mutex
+}
+
+// waiter is a ticker if it has a period, and a timer otherwise.
+type waiter struct {
+	clock  *Clock
+	c      chan time.Time
+	when   time.Time
+	period time.Duration
+	active bool
+}
+
+type ticker struct {
+	*waiter
+}
+
+func NewClock(now time.Time) *Clock {
+	return &Clock{now: now, waiters: make([]*waiter, 0)}
+}
+
+func (clock *Clock) Now() time.Time {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	return clock.now
+}
+
+func (clock *Clock) Set(now time.Time) {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	clock.now = now
+	clock.fire()
+}
+
+// Advance moves the clock forward by d, and returns the time it is then.
+func (clock *Clock) Advance(d time.Duration) time.Time {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	clock.now = clock.now.Add(d)
+	clock.fire()
+	return clock.now
+}
+
+func (clock *Clock) NewTicker(d time.Duration) ik.Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	waiter := &waiter{clock: clock, c: make(chan time.Time, 1), period: d}
+	clock.start(waiter, d)
+	return ticker{waiter}
+}
+
+func (clock *Clock) NewTimer(d time.Duration) ik.Timer {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	waiter := &waiter{clock: clock, c: make(chan time.Time, 1)}
+	clock.start(waiter, d)
+	return waiter
+}
+
+// Waiters returns the number of the tickers and the timers waiting, which
+// tells the test that a plugin has started to wait.
+func (clock *Clock) Waiters() int {
+	clock.mtx.Lock()
+	defer clock.mtx.Unlock()
+	return len(clock.waiters)
+}
+
+func (clock *Clock) start(waiter *waiter, d time.Duration) {
+	waiter.when = clock.now.Add(d)
+	if !waiter.active {
+		waiter.active = true
+		clock.waiters = append(clock.waiters, waiter)
+	}
+	clock.fire()
+}
+
+func (clock *Clock) stop(waiter *waiter) bool {
+	if !waiter.active {
+		return false
+	}
+	waiter.active = false
+	for i, waiter_ := range clock.waiters {
+		if waiter_ == waiter {
+			clock.waiters = append(clock.waiters[0:i:i], clock.waiters[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+func (clock *Clock) fire() {
+	waiters := make([]*waiter, 0, len(clock.waiters))
+	for _, waiter := range clock.waiters {
+		if waiter.when.After(clock.now) {
+			waiters = append(waiters, waiter)
+			continue
+		}
+		select {
+		case waiter.c <- clock.now:
+		default:
+		}
+		if waiter.period > 0 {
+			for !waiter.when.After(clock.now) {
+				waiter.when = waiter.when.Add(waiter.period)
+			}
+			waiters = append(waiters, waiter)
+		} else {
+			waiter.active = false
+		}
+	}
+	clock.waiters = waiters
+}
+
+func (waiter *waiter) C() <-chan time.Time {
+	return waiter.c
+}
+
+func (waiter *waiter) Stop() bool {
+	waiter.clock.mtx.Lock()
+	defer waiter.clock.mtx.Unlock()
+	return waiter.clock.stop(waiter)
+}
+
+func (ticker ticker) Stop() {
+	ticker.waiter.Stop()
+}
+
+func (waiter *waiter) Reset(d time.Duration) bool {
+	waiter.clock.mtx.Lock()
+	defer waiter.clock.mtx.Unlock()
+	active := waiter.active
+	waiter.clock.start(waiter, d)
+	return active
+}
+
+// Records returns the records of the record sets of the given tag, in the
+// order they were emitted.
+func Records(recordSets []ik.FluentRecordSet, tag string) []ik.TinyFluentRecord {
+	retval := make([]ik.TinyFluentRecord, 0)
+	for _, recordSet := range recordSets {
+		if recordSet.Tag == tag {
+			retval = append(retval, recordSet.Records...)
+		}
+	}
+	return retval
+}
+
+// sameData compares the data of records by their JSON encodings, so that
+// the numbers of different types a decoder may give, e.g. int64(1) and
+// uint64(1), are alike.
+func sameData(a map[string]interface{}, b map[string]interface{}) bool {
+	a_, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	b_, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return string(a_) == string(b_)
+}
+
+// ExpectRecords fails the test unless the data of the records of the given
+// tag are those given, in order.
+func ExpectRecords(t testing.TB, recordSets []ik.FluentRecordSet, tag string, data ...map[string]interface{}) {
+	t.Helper()
+	records := Records(recordSets, tag)
+	if len(records) != len(data) {
+		t.Errorf("expected %d records of %s, got %d: %v", len(data), tag, len(records), records)
+		return
+	}
+	for i, record := range records {
+		if !sameData(record.Data, data[i]) {
+			t.Errorf("record #%d of %s: expected %v, got %v", i, tag, data[i], record.Data)
+		}
+	}
+}
+
+// ExpectRecordCount fails the test unless there are n records in the
+// record sets.
+func ExpectRecordCount(t testing.TB, recordSets []ik.FluentRecordSet, n int) {
+	t.Helper()
+	count := 0
+	for _, recordSet := range recordSets {
+		count += len(recordSet.Records)
+	}
+	if count != n {
+		t.Errorf("expected %d records, got %d: %v", n, count, recordSets)
+	}
+}
@@ -0,0 +1,137 @@
+package iktest
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+type testSpawnee struct {
+	shutdowns int
+}
+
+func (spawnee *testSpawnee) Run() error         { return nil }
+func (spawnee *testSpawnee) Shutdown() error    { spawnee.shutdowns += 1; return nil }
+func (spawnee *testSpawnee) Factory() ik.Plugin { return nil }
+
+func TestEngine(t *testing.T) {
+	var engine_ ik.Engine = NewEngine(t)
+	engine := engine_.(*Engine)
+	spawnee := &testSpawnee{}
+	engine.Launch(spawnee)
+	if len(engine.PluginInstances()) != 1 {
+		t.Fail()
+	}
+	engine.DeadLetter(spawnee, errors.New("rejected"), []ik.FluentRecordSet{{Tag: "test"}})
+	if len(engine.DeadLetters()) != 1 || engine.DeadLetters()[0].Cause.Error() != "rejected" {
+		t.Fail()
+	}
+	engine.Dispose()
+	if spawnee.shutdowns != 1 || len(engine.Spawnees()) != 0 {
+		t.Fail()
+	}
+	if engine.FakeClock().Advance(time.Minute) != time.Unix(60, 0) || !engine.Clock().Now().Equal(time.Unix(60, 0)) {
+		t.Fail()
+	}
+}
+
+func TestPort(t *testing.T) {
+	port := NewPort()
+	recordSets := []ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": int64(1)}}}}}
+	port.FailNext(1, errors.New("failed"))
+	if port.Emit(recordSets) == nil || port.EmitDurably(recordSets) != nil {
+		t.Fail()
+	}
+	port.SetError(errors.New("down"))
+	if ik.FirstError(port.EmitWithResult(recordSets)) == nil {
+		t.Fail()
+	}
+	if port.Emits() != 3 {
+		t.Fail()
+	}
+	ExpectRecords(t, port.RecordSets(), "test", map[string]interface{}{"a": 1})
+	ExpectRecordCount(t, port.RecordSets(), 1)
+}
+
+func TestJournalGroup(t *testing.T) {
+	group := NewJournalGroup(4)
+	journal := group.GetJournal("a")
+	flushed := make([]string, 0)
+	journal.AddFlushListener(func(chunk ik.JournalChunk) error {
+		r, _ := chunk.GetReader()
+		data, _ := ioutil.ReadAll(r)
+		flushed = append(flushed, string(data))
+		return nil
+	})
+	for _, data := range []string{"ab", "cd", "ef"} {
+		err := journal.Write([]byte(data))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(flushed) != 1 || flushed[0] != "abcd" || len(journal.(*Journal).ChunkList()) != 2 {
+		t.Fatalf("%v", flushed)
+	}
+	// the chunks taken are gone once disposed of
+	err := journal.Flush(func(chunk ik.JournalChunk) error {
+		if chunk.TakeOwnership() {
+			return chunk.Dispose()
+		}
+		return nil
+	})
+	if err != nil || len(journal.(*Journal).ChunkList()) != 0 || journal.GetTailChunk() != nil {
+		t.Fatalf("%v", err)
+	}
+	journal.Write([]byte("gh"))
+	if string(journal.(*Journal).ChunkList()[0].Bytes()) != "gh" {
+		t.Fail()
+	}
+	group.SetWriteError(errors.New("no space left on device"))
+	group.SetSyncError(errors.New("I/O error"))
+	if journal.Write([]byte("ij")) == nil || journal.Sync() == nil {
+		t.Fail()
+	}
+	if keys := group.GetJournalKeys(); len(keys) != 1 || keys[0] != "a" {
+		t.Fail()
+	}
+}
+
+func TestClock(t *testing.T) {
+	clock := NewClock(time.Unix(0, 0))
+	ticker := clock.NewTicker(time.Second)
+	timer := clock.NewTimer(3 * time.Second)
+	if clock.Waiters() != 2 {
+		t.Fail()
+	}
+	clock.Advance(500 * time.Millisecond)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticked early")
+	default:
+	}
+	// the ticks not received are dropped
+	clock.Advance(2 * time.Second)
+	if now := <-ticker.C(); !now.Equal(time.Unix(2, 500000000)) {
+		t.Fatalf("%v", now)
+	}
+	select {
+	case <-ticker.C():
+		t.Fatal("ticked twice")
+	default:
+	}
+	clock.Advance(500 * time.Millisecond)
+	<-ticker.C()
+	<-timer.C()
+	if timer.Stop() || clock.Waiters() != 1 {
+		t.Fail()
+	}
+	if timer.Reset(time.Second) || !timer.Stop() {
+		t.Fail()
+	}
+	ticker.Stop()
+	if clock.Waiters() != 0 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,328 @@
+package iktest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"sort"
+	"sync"
+)
+
+// JournalGroup keeps the journals in memory.  A journal starts a new chunk
+// once the one being written would exceed the chunk limit, calling the
+// flush listeners with the one it leaves.  The chunks are numbered for
+// their unique ids in the order they are created.  The writes and the syncs
+// of every journal can be made to fail.  It is a JournalGroupFactory giving
+// itself.
+type JournalGroup struct {
+	chunkLimit int64
+	chunks     int64
+	journals   map[string]*Journal
+	writeErr   error
+	syncErr    error
+	mtx        sync.Mutex
+}
+
+// Journal is a journal of a JournalGroup.  The chunk being written, if
+// any, is the last one.
+type Journal struct {
+	group             *JournalGroup
+	key               string
+	chunks            []*JournalChunk
+	head              *JournalChunk
+	newChunkListeners []ik.JournalChunkListener
+	flushListeners    []ik.JournalChunkListener
+	mtx               sync.Mutex
+}
+
+type chunkIterator struct {
+	chunks  []*JournalChunk
+	current *JournalChunk
+}
+
+// JournalChunk is a chunk of a Journal.  It is removed from the journal
+// once disposed of after its ownership was taken.  Every record, which is
+// what a Write wrote, is indexed.
+type JournalChunk struct {
+	journal *Journal
+	id      string
+	data    []byte
+	offsets []int64
+	owned   bool
+}
+
+// NewJournalGroup creates a group whose chunks hold up to chunkLimit bytes,
+// or any number if chunkLimit is 0.
+func NewJournalGroup(chunkLimit int64) *JournalGroup {
+	return &JournalGroup{
+		chunkLimit: chunkLimit,
+		journals:   make(map[string]*Journal),
+	}
+}
+
+// SetWriteError makes every write fail with err from then on, or none if
+// err is nil.
+func (group *JournalGroup) SetWriteError(err error) {
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	group.writeErr = err
+}
+
+// SetSyncError makes every sync fail with err from then on, or none if err
+// is nil.
+func (group *JournalGroup) SetSyncError(err error) {
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	group.syncErr = err
+}
+
+func (group *JournalGroup) failures() (error, error) {
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	return group.writeErr, group.syncErr
+}
+
+func (group *JournalGroup) newChunkId() string {
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	group.chunks += 1
+	return fmt.Sprintf("%016x", group.chunks)
+}
+
+func (group *JournalGroup) GetJournalGroup() ik.JournalGroup {
+	return group
+}
+
+func (group *JournalGroup) GetJournal(key string) ik.Journal {
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	journal, ok := group.journals[key]
+	if !ok {
+		journal = &Journal{group: group, key: key}
+		group.journals[key] = journal
+	}
+	return journal
+}
+
+func (group *JournalGroup) GetJournalKeys() []string {
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	retval := make([]string, 0, len(group.journals))
+	for key := range group.journals {
+		retval = append(retval, key)
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+func (group *JournalGroup) Dispose() error {
+	return nil
+}
+
+func (journal *Journal) Key() string {
+	return journal.key
+}
+
+func (journal *Journal) Write(data []byte) error {
+	writeErr, _ := journal.group.failures()
+	if writeErr != nil {
+		return writeErr
+	}
+	journal.mtx.Lock()
+	var newChunk, flushed *JournalChunk
+	if journal.head != nil && journal.group.chunkLimit > 0 && len(journal.head.data) > 0 && int64(len(journal.head.data)+len(data)) > journal.group.chunkLimit {
+		flushed = journal.head
+		journal.head = nil
+	}
+	if journal.head == nil {
+		newChunk = &JournalChunk{journal: journal, id: journal.group.newChunkId()}
+		journal.chunks = append(journal.chunks, newChunk)
+		journal.head = newChunk
+	}
+	journal.head.offsets = append(journal.head.offsets, int64(len(journal.head.data)))
+	journal.head.data = append(journal.head.data, data...)
+	newChunkListeners := append([]ik.JournalChunkListener(nil), journal.newChunkListeners...)
+	flushListeners := append([]ik.JournalChunkListener(nil), journal.flushListeners...)
+	journal.mtx.Unlock()
+	if newChunk != nil {
+		for _, listener := range newChunkListeners {
+			listener(newChunk)
+		}
+	}
+	if flushed != nil {
+		for _, listener := range flushListeners {
+			listener(flushed)
+		}
+	}
+	return nil
+}
+
+func (journal *Journal) GetTailChunk() ik.JournalChunk {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	if len(journal.chunks) == 0 {
+		return nil
+	}
+	return journal.chunks[0]
+}
+
+func (journal *Journal) AddNewChunkListener(listener ik.JournalChunkListener) {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	journal.newChunkListeners = append(journal.newChunkListeners, listener)
+}
+
+func (journal *Journal) AddFlushListener(listener ik.JournalChunkListener) {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	journal.flushListeners = append(journal.flushListeners, listener)
+}
+
+func (journal *Journal) Flush(visitor func(ik.JournalChunk) error) error {
+	return journal.FlushContext(context.Background(), visitor)
+}
+
+// FlushContext visits the chunks from the oldest on, the one being written
+// included.
+func (journal *Journal) FlushContext(ctx context.Context, visitor func(ik.JournalChunk) error) error {
+	journal.mtx.Lock()
+	chunks := append([]*JournalChunk(nil), journal.chunks...)
+	journal.mtx.Unlock()
+	for _, chunk := range chunks {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		err = visitor(chunk)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Chunks returns an iterator over the chunks from the oldest on.  A chunk
+// whose ownership was taken is removed once the iterator moves past it.
+func (journal *Journal) Chunks() ik.JournalChunkIterator {
+	return &chunkIterator{chunks: journal.ChunkList()}
+}
+
+func (journal *Journal) Sync() error {
+	_, syncErr := journal.group.failures()
+	return syncErr
+}
+
+func (journal *Journal) Dispose() error {
+	return nil
+}
+
+// ChunkList returns the chunks of the journal, the oldest first.
+func (journal *Journal) ChunkList() []*JournalChunk {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	return append([]*JournalChunk(nil), journal.chunks...)
+}
+
+// Bytes returns the contents of the chunk.
+func (chunk *JournalChunk) Bytes() []byte {
+	chunk.journal.mtx.Lock()
+	defer chunk.journal.mtx.Unlock()
+	return append([]byte(nil), chunk.data...)
+}
+
+func (chunk *JournalChunk) GetReader() (io.Reader, error) {
+	return bytes.NewReader(chunk.Bytes()), nil
+}
+
+// GetReaderAt returns a reader starting at the record at recordOffset, or
+// at the end if there are not as many records.
+func (chunk *JournalChunk) GetReaderAt(recordOffset int64) (io.Reader, int64, error) {
+	if recordOffset < 0 {
+		return nil, 0, errors.New("negative record offset")
+	}
+	chunk.journal.mtx.Lock()
+	defer chunk.journal.mtx.Unlock()
+	if recordOffset >= int64(len(chunk.offsets)) {
+		return bytes.NewReader(nil), int64(len(chunk.offsets)), nil
+	}
+	return bytes.NewReader(append([]byte(nil), chunk.data[chunk.offsets[recordOffset]:]...)), recordOffset, nil
+}
+
+func (chunk *JournalChunk) GetNextChunk() ik.JournalChunk {
+	journal := chunk.journal
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	for i, chunk_ := range journal.chunks {
+		if chunk_ == chunk && i+1 < len(journal.chunks) {
+			return journal.chunks[i+1]
+		}
+	}
+	return nil
+}
+
+func (chunk *JournalChunk) UniqueId() string {
+	return chunk.id
+}
+
+func (chunk *JournalChunk) TakeOwnership() bool {
+	chunk.journal.mtx.Lock()
+	defer chunk.journal.mtx.Unlock()
+	if chunk.owned {
+		return false
+	}
+	chunk.owned = true
+	return true
+}
+
+// Dispose removes the chunk from the journal if its ownership was taken.
+// The chunk being written makes way for a new one.
+func (chunk *JournalChunk) Dispose() error {
+	journal := chunk.journal
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	if !chunk.owned {
+		return nil
+	}
+	for i, chunk_ := range journal.chunks {
+		if chunk_ == chunk {
+			journal.chunks = append(journal.chunks[0:i:i], journal.chunks[i+1:]...)
+			if journal.head == chunk {
+				journal.head = nil
+			}
+			return nil
+		}
+	}
+	return errors.New("already disposed")
+}
+
+func (iterator *chunkIterator) Next() bool {
+	if iterator.current != nil {
+		iterator.current.Dispose()
+		iterator.current = nil
+	}
+	if len(iterator.chunks) == 0 {
+		return false
+	}
+	iterator.current = iterator.chunks[0]
+	iterator.chunks = iterator.chunks[1:]
+	return true
+}
+
+func (iterator *chunkIterator) Value() ik.JournalChunk {
+	if iterator.current == nil {
+		return nil
+	}
+	return iterator.current
+}
+
+func (iterator *chunkIterator) Close() error {
+	if iterator.current != nil {
+		iterator.current.Dispose()
+		iterator.current = nil
+	}
+	iterator.chunks = nil
+	return nil
+}
@@ -0,0 +1,104 @@
+package iktest
+
+import (
+	"context"
+	"github.com/moriyoshi/ik"
+	"sync"
+)
+
+// Port keeps the record sets emitted through it.  It is a ResultPort and a
+// ContextPort; the emissions can be made to fail with FailNext, or all of
+// them with SetError, in which case nothing is kept.
+type Port struct {
+	recordSets []ik.FluentRecordSet
+	emits      int
+	err        error
+	failures   []error
+	mtx        sync.Mutex
+}
+
+func NewPort() *Port {
+	return &Port{recordSets: make([]ik.FluentRecordSet, 0)}
+}
+
+// SetError makes every emission fail with err from then on, or none if err
+// is nil.
+func (port *Port) SetError(err error) {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	port.err = err
+}
+
+// FailNext makes the next n emissions fail with err, before those made to
+// fail so far have.
+func (port *Port) FailNext(n int, err error) {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	for i := 0; i < n; i += 1 {
+		port.failures = append(port.failures, err)
+	}
+}
+
+func (port *Port) emit(recordSets []ik.FluentRecordSet) error {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	port.emits += 1
+	if len(port.failures) > 0 {
+		err := port.failures[0]
+		port.failures = port.failures[1:]
+		return err
+	}
+	if port.err != nil {
+		return port.err
+	}
+	port.recordSets = append(port.recordSets, recordSets...)
+	return nil
+}
+
+func (port *Port) Emit(recordSets []ik.FluentRecordSet) error {
+	return port.emit(recordSets)
+}
+
+func (port *Port) EmitDurably(recordSets []ik.FluentRecordSet) error {
+	return port.emit(recordSets)
+}
+
+func (port *Port) EmitContext(ctx context.Context, recordSets []ik.FluentRecordSet) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return port.emit(recordSets)
+}
+
+// EmitWithResult fails all the record sets alike.
+func (port *Port) EmitWithResult(recordSets []ik.FluentRecordSet) []error {
+	err := port.emit(recordSets)
+	results := make([]error, len(recordSets))
+	for i := range results {
+		results[i] = err
+	}
+	return results
+}
+
+// RecordSets returns the record sets kept so far.
+func (port *Port) RecordSets() []ik.FluentRecordSet {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	return append([]ik.FluentRecordSet(nil), port.recordSets...)
+}
+
+// Emits returns the number of emissions so far, the failed ones included.
+func (port *Port) Emits() int {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	return port.emits
+}
+
+// Reset forgets the record sets kept so far.
+func (port *Port) Reset() {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	port.recordSets = make([]ik.FluentRecordSet, 0)
+	port.emits = 0
+}
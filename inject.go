@@ -0,0 +1,163 @@
+package ik
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"os"
+)
+
+// Injection adds the fields named by the add_hostname, add_tag_field,
+// add_source_address and add_uuid attributes of a <source> element to
+// every record the input emits, each attribute giving the key of its
+// field.  The source address is only known to the inputs that take
+// records from a peer, which hand it over through PortForSource.
+type Injection struct {
+	HostnameKey      string
+	TagKey           string
+	SourceAddressKey string
+	UUIDKey          string
+	hostname         string
+	entropy          io.Reader
+}
+
+// SourcePort is a Port that can stamp the records with the address of the
+// peer they came from.
+type SourcePort interface {
+	Port
+	ForSource(address string) Port
+}
+
+// PortForSource returns the port to emit the records received from the
+// peer at address through.  It is the port itself unless the port is a
+// SourcePort.
+func PortForSource(port Port, address string) Port {
+	sourcePort, ok := port.(SourcePort)
+	if !ok {
+		return port
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err == nil {
+		address = host
+	}
+	return sourcePort.ForSource(address)
+}
+
+type injectionPort struct {
+	port          Port
+	injection     *Injection
+	sourceAddress string
+}
+
+func (injection *Injection) uuid() (string, error) {
+	var id [16]byte
+	_, err := io.ReadFull(injection.entropy, id[:])
+	if err != nil {
+		return "", err
+	}
+	// version 4, variant 1
+	id[6] = id[6]&0x0f | 0x40
+	id[8] = id[8]&0x3f | 0x80
+	s := hex.EncodeToString(id[:])
+	return s[0:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:32], nil
+}
+
+func (port *injectionPort) inject(recordSets []FluentRecordSet) error {
+	injection := port.injection
+	for i, recordSet := range recordSets {
+		recordSets[i].Packed = nil
+		for _, record := range recordSet.Records {
+			if record.Data == nil {
+				continue
+			}
+			if injection.HostnameKey != "" {
+				record.Data[injection.HostnameKey] = injection.hostname
+			}
+			if injection.TagKey != "" {
+				record.Data[injection.TagKey] = recordSet.Tag
+			}
+			if injection.SourceAddressKey != "" && port.sourceAddress != "" {
+				record.Data[injection.SourceAddressKey] = port.sourceAddress
+			}
+			if injection.UUIDKey != "" {
+				id, err := injection.uuid()
+				if err != nil {
+					return err
+				}
+				record.Data[injection.UUIDKey] = id
+			}
+		}
+	}
+	return nil
+}
+
+func (port *injectionPort) Emit(recordSets []FluentRecordSet) error {
+	err := port.inject(recordSets)
+	if err != nil {
+		return err
+	}
+	return port.port.Emit(recordSets)
+}
+
+func (port *injectionPort) EmitContext(ctx context.Context, recordSets []FluentRecordSet) error {
+	err := port.inject(recordSets)
+	if err != nil {
+		return err
+	}
+	return EmitContext(ctx, port.port, recordSets)
+}
+
+func (port *injectionPort) EmitDurably(recordSets []FluentRecordSet) error {
+	err := port.inject(recordSets)
+	if err != nil {
+		return err
+	}
+	return EmitDurably(port.port, recordSets)
+}
+
+func (port *injectionPort) EmitWithResult(recordSets []FluentRecordSet) []error {
+	err := port.inject(recordSets)
+	if err != nil {
+		return resultsOf(len(recordSets), err)
+	}
+	return EmitWithResult(port.port, recordSets)
+}
+
+func (port *injectionPort) ForSource(address string) Port {
+	return &injectionPort{port.port, port.injection, address}
+}
+
+// wrapEngine returns the engine to create the input with.  The fields are
+// injected after the record ids are generated, lest a uuid make every id of
+// the hash type differ.
+func (injection *Injection) wrapEngine(engine Engine) Engine {
+	return &portEngine{
+		Engine: engine,
+		port:   &injectionPort{engine.DefaultPort(), injection, ""},
+	}
+}
+
+// ParseInjection reads the injection attributes of a <source> element, and
+// returns nil if there is none.
+func ParseInjection(config *ConfigElement) (*Injection, error) {
+	injection := &Injection{
+		HostnameKey:      config.Attrs["add_hostname"],
+		TagKey:           config.Attrs["add_tag_field"],
+		SourceAddressKey: config.Attrs["add_source_address"],
+		UUIDKey:          config.Attrs["add_uuid"],
+		entropy:          rand.Reader,
+	}
+	if injection.HostnameKey == "" && injection.TagKey == "" && injection.SourceAddressKey == "" && injection.UUIDKey == "" {
+		return nil, nil
+	}
+	if injection.HostnameKey != "" {
+		var err error
+		injection.hostname, err = os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return injection, nil
+}
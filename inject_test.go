@@ -0,0 +1,74 @@
+package ik
+
+import (
+	"os"
+	"regexp"
+	"testing"
+)
+
+func TestParseInjection(t *testing.T) {
+	injection, err := ParseInjection(&ConfigElement{Attrs: map[string]string{"type": "forward"}})
+	if err != nil || injection != nil {
+		t.Fail()
+	}
+	injection, err = ParseInjection(&ConfigElement{Attrs: map[string]string{
+		"add_hostname":       "host",
+		"add_tag_field":      "tag",
+		"add_source_address": "peer",
+		"add_uuid":           "uuid",
+	}})
+	if err != nil || injection == nil {
+		t.FailNow()
+	}
+	hostname, _ := os.Hostname()
+	if injection.HostnameKey != "host" || injection.TagKey != "tag" || injection.SourceAddressKey != "peer" || injection.UUIDKey != "uuid" || injection.hostname != hostname {
+		t.Fail()
+	}
+}
+
+func TestInjectionPort(t *testing.T) {
+	injection, _ := ParseInjection(&ConfigElement{Attrs: map[string]string{
+		"add_hostname":       "host",
+		"add_tag_field":      "tag",
+		"add_source_address": "peer",
+		"add_uuid":           "uuid",
+	}})
+	port := &recordingPort{}
+	engine := injection.wrapEngine(&portEngine{port: port})
+	recordIds := &RecordIds{Key: "_record_id", Generator: HashRecordIdGenerator{}}
+	engine = recordIds.wrapEngine(engine)
+	record := func() TinyFluentRecord {
+		return TinyFluentRecord{Timestamp: 1, Data: map[string]interface{}{"a": 1}}
+	}
+
+	// the address reaches the injection through the other ports
+	PortForSource(engine.DefaultPort(), "192.0.2.1:24224").Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{record(), record()}}})
+	engine.DefaultPort().Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{record()}}})
+	if len(port.recordSets) != 2 {
+		t.FailNow()
+	}
+	uuidRegExp := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	first := port.recordSets[0].Records[0].Data
+	second := port.recordSets[0].Records[1].Data
+	if first["host"] != injection.hostname || first["tag"] != "test" || first["peer"] != "192.0.2.1" {
+		t.Logf("%v", first)
+		t.Fail()
+	}
+	uuid, _ := first["uuid"].(string)
+	if !uuidRegExp.MatchString(uuid) || first["uuid"] == second["uuid"] {
+		t.Logf("%v %v", first["uuid"], second["uuid"])
+		t.Fail()
+	}
+	// the record ids are generated before the uuids are added
+	if first["_record_id"] != second["_record_id"] {
+		t.Fail()
+	}
+	if _, ok := port.recordSets[1].Records[0].Data["peer"]; ok {
+		t.Fail()
+	}
+	// the entries no longer match the records
+	engine.DefaultPort().Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{record()}, Packed: []byte{0x92}}})
+	if len(port.recordSets) != 3 || port.recordSets[2].Packed != nil {
+		t.Fail()
+	}
+}
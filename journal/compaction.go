@@ -0,0 +1,256 @@
+package journal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+const compactionSuffix = ".compacting"
+
+// SetCompaction makes the journal groups created afterwards merge the
+// Rest chunks smaller than threshold bytes as Compact is called.
+// threshold <= 0 means no compaction.
+func (factory *FileJournalGroupFactory) SetCompaction(threshold int64) {
+	factory.compactThreshold = threshold
+}
+
+// Compacted returns the number of chunks merged into others so far.
+func (journalGroup *FileJournalGroup) Compacted() int64 {
+	return atomic.LoadInt64(&journalGroup.compacted)
+}
+
+// Compact merges each run of consecutive Rest chunks of a journal smaller
+// than the compaction threshold, sealed with the same key, into one chunk
+// no larger than the chunk limit, and returns how many chunks it merged
+// away.  The merged chunk takes the place of the run, with the timestamp
+// of its oldest chunk and an id of its own, as it is not the same chunk
+// for the receivers telling retries by the id.  The chunks referenced
+// apart from the journal, such as those being delivered, are left alone.
+// The merged chunk is written aside and renamed into place before the run
+// is removed, so that a crash in between leaves the records twice rather
+// than losing them.
+func (journalGroup *FileJournalGroup) Compact() (int, error) {
+	if journalGroup.compactThreshold <= 0 {
+		return 0, nil
+	}
+	journalGroup.mtx.Lock()
+	journals := make([]*FileJournal, 0, len(journalGroup.journals)+len(journalGroup.idle))
+	for _, journal := range journalGroup.journals {
+		journals = append(journals, journal)
+	}
+	for _, journal := range journalGroup.idle {
+		journals = append(journals, journal)
+	}
+	journalGroup.mtx.Unlock()
+
+	compacted := 0
+	var err error
+	for _, journal := range journals {
+		n, err_ := journal.compact()
+		compacted += n
+		if err_ != nil && err == nil {
+			err = err_
+		}
+	}
+	atomic.AddInt64(&journalGroup.compacted, int64(compacted))
+	return compacted, err
+}
+
+// compactionRuns returns the runs of chunks to merge, each from the oldest
+// on.  The caller holds the lock of the chunks.
+func (journal *FileJournal) compactionRuns() ([][]*FileJournalChunk, error) {
+	group := journal.group
+	runs := make([][]*FileJournalChunk, 0)
+	run := make([]*FileJournalChunk, 0)
+	runKeyId := ""
+	runSize := int64(0)
+	flush := func() {
+		if len(run) > 1 {
+			runs = append(runs, run)
+		}
+		run = make([]*FileJournalChunk, 0)
+		runSize = 0
+	}
+	// the head is never merged, being written or the newest
+	for chunk := journal.chunks.last; chunk != nil && chunk != journal.chunks.first; chunk = chunk.head.prev {
+		size := atomic.LoadInt64(&chunk.Size)
+		// only the journal references the chunks not in use
+		if chunk.Type != Rest || size >= group.compactThreshold || atomic.LoadInt32(&chunk.refcount) != 1 || atomic.LoadInt32(&chunk.owned) != 0 {
+			flush()
+			continue
+		}
+		keyId, err := chunkKeyIdOf(chunk.Path)
+		if err != nil {
+			return nil, err
+		}
+		headerSize := int64(0)
+		if keyId != "" {
+			headerSize = int64(len(chunkHeader(keyId)))
+		}
+		if len(run) > 0 && (keyId != runKeyId || (group.maxSize > 0 && runSize+size-headerSize > group.maxSize)) {
+			flush()
+		}
+		if len(run) == 0 {
+			runKeyId = keyId
+			runSize = headerSize
+		}
+		run = append(run, chunk)
+		runSize += size - headerSize
+	}
+	flush()
+	return runs, nil
+}
+
+// writeMergedChunk writes the contents of the run to path, the frames of a
+// sealed run following a single header.
+func writeMergedChunk(path string, run []*FileJournalChunk, fileMode os.FileMode) (int64, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, chunkFileMode(fileMode))
+	if err != nil {
+		return 0, err
+	}
+	size := int64(0)
+	for i, chunk := range run {
+		src, err := os.Open(chunk.Path)
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+		keyId, err := readChunkKeyId(src)
+		if err == nil && keyId != "" && i > 0 {
+			_, err = src.Seek(int64(len(chunkHeader(keyId))), io.SeekStart)
+		}
+		var n int64
+		if err == nil {
+			n, err = io.Copy(file, src)
+		}
+		src.Close()
+		if err != nil {
+			file.Close()
+			return 0, err
+		}
+		size += n
+	}
+	err = file.Sync()
+	err_ := file.Close()
+	if err == nil {
+		err = err_
+	}
+	return size, err
+}
+
+// compact merges the runs of the journal.  The journal is locked all
+// along, and so are its chunks for no wrapper to be taken of the chunks
+// of a run while they are merged.  A reference is taken on each of them
+// besides, so that none is removed under the merge; the references go
+// with the chunks merged, and are released otherwise.
+func (journal *FileJournal) compact() (int, error) {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	journal.chunks.mtx.Lock()
+	runs, err := journal.compactionRuns()
+	compacted := 0
+	released := make([]*FileJournalChunk, 0)
+	for _, run := range runs {
+		held := make([]*FileJournalChunk, 0, len(run))
+		for _, chunk := range run {
+			if !atomic.CompareAndSwapInt32(&chunk.refcount, 1, 2) {
+				break
+			}
+			held = append(held, chunk)
+		}
+		merged := false
+		if err == nil && len(held) == len(run) {
+			merged, err = journal.mergeRun(run)
+		}
+		if merged {
+			compacted += len(run) - 1
+		} else {
+			released = append(released, held...)
+		}
+	}
+	journal.chunks.mtx.Unlock()
+	for _, chunk := range released {
+		journal.deleteRef(chunk)
+	}
+	return compacted, err
+}
+
+// mergeRun merges the run into a chunk taking its place, and tells whether
+// it did.  It does not if a chunk of the run was let go of meanwhile.
+func (journal *FileJournal) mergeRun(run []*FileJournalChunk) (bool, error) {
+	group := journal.group
+	oldest := run[0]
+	newest := run[len(run)-1]
+	info := BuildJournalPath(journal.key, Rest, chunkTime(oldest), group.rand.Int63n(0xfff))
+	for info.TSuffix == oldest.TSuffix {
+		info = BuildJournalPath(journal.key, Rest, chunkTime(oldest), group.rand.Int63n(0xfff))
+	}
+	path := group.pathPrefix + info.VariablePortion + group.pathSuffix
+	size, err := writeMergedChunk(path+compactionSuffix, run, group.fileMode)
+	if err == nil {
+		err = renameChunkFile(path+compactionSuffix, path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		os.Remove(path + compactionSuffix)
+		return false, errors.New(fmt.Sprintf("failed to compact %d chunks of %s: %s", len(run), journal.key, err.Error()))
+	}
+	for _, chunk := range run {
+		if atomic.LoadInt32(&chunk.refcount) != 2 || atomic.LoadInt32(&chunk.owned) != 0 {
+			return false, removeChunkFile(path)
+		}
+	}
+	merged := &FileJournalChunk{
+		head:      FileJournalChunkDequeueHead{oldest.head.next, newest.head.prev},
+		Path:      path,
+		Type:      Rest,
+		TSuffix:   info.TSuffix,
+		Timestamp: oldest.Timestamp,
+		UniqueId:  info.UniqueId,
+		Size:      size,
+		refcount:  1,
+	}
+	if oldest.head.next != nil {
+		oldest.head.next.head.prev = merged
+	} else {
+		journal.chunks.last = merged
+	}
+	// the newest of the run is older than the head
+	newest.head.prev.head.next = merged
+	journal.chunks.count -= len(run) - 1
+	for _, chunk := range run {
+		err_ := removeChunkFile(chunk.Path)
+		if err_ != nil && err == nil {
+			err = err_
+		}
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+	if err != nil {
+		group.logger.Error("failed to remove the chunks compacted into %s, whose records are left twice: %s", path, err.Error())
+	}
+	return true, nil
+}
+
+// removeCompactionLeftovers removes the merged chunks a crash left before
+// they were renamed into place.
+func removeCompactionLeftovers(pathPrefix string) error {
+	leftovers, err := filepath.Glob(pathPrefix + "*" + compactionSuffix)
+	if err != nil {
+		return err
+	}
+	for _, leftover := range leftovers {
+		err := os.Remove(leftover)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
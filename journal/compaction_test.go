@@ -0,0 +1,156 @@
+package journal
+
+import (
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readJournalContents(t *testing.T, journal *FileJournal) []string {
+	contents := make([]string, 0)
+	chunks := journal.Chunks()
+	defer chunks.Close()
+	for chunks.Next() {
+		reader, err := chunks.Value().GetReader()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		data, _ := ioutil.ReadAll(reader)
+		contents = append(contents, string(data))
+	}
+	return contents
+}
+
+func Test_JournalGroup_Compact(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	newFactory := func() *FileJournalGroupFactory {
+		factory := NewFileJournalGroupFactory(
+			logger,
+			rand.NewSource(0),
+			newTestClock(func() time.Time { return now }),
+			".log",
+			os.FileMode(0644),
+			1024,
+		)
+		factory.SetCompaction(4)
+		return factory
+	}
+	journalGroup, err := newFactory().GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	for _, data := range []string{"a", "b", "cdefgh", "i", "j", "k", "l"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+		journal.mtx.Lock()
+		if data != "l" {
+			_, err = journal.newChunk()
+		}
+		journal.mtx.Unlock()
+		if err != nil {
+			t.FailNow()
+		}
+		now = now.Add(time.Second)
+	}
+	// the chunk being delivered is left alone, and so is the head
+	tail := journal.GetTailChunk()
+	uniqueId := tail.UniqueId()
+	delivering := tail
+	for i := 0; i < 3; i++ {
+		next := delivering.GetNextChunk()
+		delivering.Dispose()
+		delivering = next
+	}
+	n, err := journalGroup.Compact()
+	if err != nil || n != 2 || journalGroup.Compacted() != 2 {
+		t.Fatalf("%d %v", n, err)
+	}
+	delivering.Dispose()
+	contents := readJournalContents(t, journal)
+	if strings.Join(contents, ",") != "ab,cdefgh,i,jk,l" {
+		t.Fatalf("%v", contents)
+	}
+	files, err := readChunkDir(tempDir)
+	if err != nil || len(files) != 5 || journal.chunks.count != 5 {
+		t.Fatalf("%d files, %d chunks", len(files), journal.chunks.count)
+	}
+	tail = journal.GetTailChunk()
+	if tail.UniqueId() == uniqueId {
+		t.Fail()
+	}
+	tail.Dispose()
+
+	// the merged chunks come in the same order on the next run
+	journalGroup.Dispose()
+	journalGroup, err = newFactory().GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	defer journalGroup.Dispose()
+	journal = journalGroup.GetFileJournal("key")
+	contents = readJournalContents(t, journal)
+	if strings.Join(contents, ",") != "ab,cdefgh,i,jk,l" {
+		t.Fatalf("%v", contents)
+	}
+	delivered := make([]string, 0)
+	err = journal.Flush(func(chunk ik.JournalChunk) error {
+		defer chunk.Dispose()
+		reader, err := chunk.GetReader()
+		if err != nil {
+			return err
+		}
+		data, _ := ioutil.ReadAll(reader)
+		delivered = append(delivered, string(data))
+		chunk.TakeOwnership()
+		return nil
+	})
+	if err != nil || len(delivered) != 5 {
+		t.Fatalf("%v %v", err, delivered)
+	}
+}
+
+func Test_JournalGroup_Compact_encrypted(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	journalGroup := newEncryptingJournalGroup(t, 0, tempDir+"/test", "a:MDEyMzQ1Njc4OWFiY2RlZg==")
+	defer journalGroup.Dispose()
+	journalGroup.compactThreshold = 64
+	journal := journalGroup.GetFileJournal("key")
+	for _, data := range []string{"test1", "test2", "test3"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+		journal.mtx.Lock()
+		_, err = journal.newChunk()
+		journal.mtx.Unlock()
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	// the frames of the chunks merged follow a single header
+	n, err := journalGroup.Compact()
+	if err != nil || n != 2 {
+		t.Fatalf("%d %v", n, err)
+	}
+	contents := readJournalContents(t, journal)
+	if len(contents) != 2 || contents[0] != "test1test2test3" || contents[1] != "" {
+		t.Fatalf("%q", contents)
+	}
+}
@@ -0,0 +1,159 @@
+package journal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DiskSpaceWatchdog checks the free space on the filesystem hosting a
+// buffer every interval, and tells when it has fallen below minFree, so
+// that the writers can wait for the space to be freed by the deliveries,
+// or the journals can drop the newest writes, instead of running into
+// ENOSPC in the middle of a chunk.
+type DiskSpaceWatchdog struct {
+	logger    ik.Logger
+	dir       string
+	minFree   int64
+	interval  time.Duration
+	clock     ik.Clock
+	free      int64 // must be accessed atomically
+	low       bool
+	recovered chan struct{}
+	err       error
+	stop      chan struct{}
+	mtx       sync.Mutex
+	freeSpace func(dir string) (int64, error)
+}
+
+// NewDiskSpaceWatchdog returns a watchdog of the filesystem hosting the
+// chunks at the given buffer path, which is checked once right away and
+// then every interval on clock.
+func NewDiskSpaceWatchdog(logger ik.Logger, path string, minFree int64, interval time.Duration, clock ik.Clock) *DiskSpaceWatchdog {
+	pathPrefix, _ := splitJournalGroupPath(path, "")
+	watchdog := &DiskSpaceWatchdog{
+		logger:    logger,
+		dir:       filepath.Dir(pathPrefix),
+		minFree:   minFree,
+		interval:  interval,
+		clock:     clock,
+		free:      -1,
+		stop:      make(chan struct{}),
+		freeSpace: freeSpace,
+	}
+	watchdog.Check()
+	return watchdog
+}
+
+// Check checks the free space, and returns whether it is low.  The space
+// is taken for enough if it cannot be told.
+func (watchdog *DiskSpaceWatchdog) Check() bool {
+	free, err := watchdog.freeSpace(watchdog.dir)
+	watchdog.mtx.Lock()
+	defer watchdog.mtx.Unlock()
+	if err != nil {
+		if watchdog.err == nil {
+			watchdog.logger.Warning("failed to check the free space of %s: %s", watchdog.dir, err.Error())
+		}
+		watchdog.err = err
+		free = -1
+	} else {
+		watchdog.err = nil
+	}
+	atomic.StoreInt64(&watchdog.free, free)
+	low := free >= 0 && free < watchdog.minFree
+	if low && !watchdog.low {
+		watchdog.logger.Error("%d bytes left on the filesystem of %s, below %d bytes", free, watchdog.dir, watchdog.minFree)
+		watchdog.recovered = make(chan struct{})
+	} else if !low && watchdog.low {
+		watchdog.logger.Notice("%d bytes left on the filesystem of %s again", free, watchdog.dir)
+		close(watchdog.recovered)
+	}
+	watchdog.low = low
+	return low
+}
+
+// Start checks the free space every interval until Stop is called.
+func (watchdog *DiskSpaceWatchdog) Start() {
+	ticker := watchdog.clock.NewTicker(watchdog.interval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-watchdog.stop:
+				return
+			case <-ticker.C():
+				watchdog.Check()
+			}
+		}
+	}()
+}
+
+func (watchdog *DiskSpaceWatchdog) Stop() {
+	close(watchdog.stop)
+}
+
+// Free returns the free space found by the last check, or -1 if it could
+// not be told.
+func (watchdog *DiskSpaceWatchdog) Free() int64 {
+	return atomic.LoadInt64(&watchdog.free)
+}
+
+func (watchdog *DiskSpaceWatchdog) Low() bool {
+	watchdog.mtx.Lock()
+	defer watchdog.mtx.Unlock()
+	return watchdog.low
+}
+
+// Err returns an error describing the shortage while the space is low, or
+// nil.
+func (watchdog *DiskSpaceWatchdog) Err() error {
+	watchdog.mtx.Lock()
+	defer watchdog.mtx.Unlock()
+	if !watchdog.low {
+		return nil
+	}
+	return errors.New(fmt.Sprintf("%d bytes left on the filesystem of %s, below %d bytes", watchdog.Free(), watchdog.dir, watchdog.minFree))
+}
+
+// Wait returns once the space is no longer low, or ctx is done.
+func (watchdog *DiskSpaceWatchdog) Wait(ctx context.Context) error {
+	watchdog.mtx.Lock()
+	low, recovered := watchdog.low, watchdog.recovered
+	watchdog.mtx.Unlock()
+	if !low {
+		return nil
+	}
+	select {
+	case <-recovered:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SetDiskSpaceWatchdog makes the journal groups created afterwards report
+// the free space found by the watchdog, and drop the writes while it is
+// low if dropNewest is true.
+func (factory *FileJournalGroupFactory) SetDiskSpaceWatchdog(watchdog *DiskSpaceWatchdog, dropNewest bool) {
+	factory.watchdog = watchdog
+	factory.dropNewest = dropNewest
+}
+
+// Dropped returns the number of writes dropped for the lack of space.
+func (journalGroup *FileJournalGroup) Dropped() int64 {
+	return atomic.LoadInt64(&journalGroup.dropped)
+}
+
+func (journalGroup *FileJournalGroup) dropsNewest() bool {
+	return journalGroup.dropNewest && journalGroup.watchdog != nil && journalGroup.watchdog.Low()
+}
+
+func noSpaceError(pathPrefix string, err error) error {
+	return errors.New(fmt.Sprintf("no space left for the buffer at %s: %s", pathPrefix, err.Error()))
+}
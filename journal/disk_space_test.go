@@ -0,0 +1,82 @@
+package journal
+
+import (
+	"context"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_DiskSpaceWatchdog(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	watchdog := NewDiskSpaceWatchdog(logger, tempDir+"/test", 100, time.Hour, ik.SystemClock)
+	if watchdog.Free() < 0 || watchdog.dir != tempDir {
+		t.Fatalf("%d bytes free in %s", watchdog.Free(), watchdog.dir)
+	}
+	free := int64(50)
+	watchdog.freeSpace = func(string) (int64, error) { return free, nil }
+	if !watchdog.Check() || watchdog.Err() == nil {
+		t.Fatal("the space is not low")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if watchdog.Wait(ctx) == nil {
+		t.Fatal("Wait returned while the space is low")
+	}
+	waited := make(chan error)
+	go func() { waited <- watchdog.Wait(context.Background()) }()
+	free = 200
+	if watchdog.Check() || watchdog.Err() != nil || <-waited != nil {
+		t.Fatal("the space is still low")
+	}
+
+	// the space is taken for enough if it cannot be told
+	watchdog.freeSpace = func(string) (int64, error) { return 0, errors.New("failed") }
+	if watchdog.Check() || watchdog.Free() != -1 {
+		t.Fail()
+	}
+}
+
+func Test_Journal_DropNewest(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	watchdog := NewDiskSpaceWatchdog(logger, tempDir+"/test", 100, time.Hour, ik.SystemClock)
+	watchdog.freeSpace = func(string) (int64, error) { return 50, nil }
+	watchdog.Check()
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	factory.SetDiskSpaceWatchdog(watchdog, true)
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	defer journalGroup.Dispose()
+	journal := journalGroup.GetFileJournal("key")
+	err = journal.Write([]byte("test1"))
+	if err != nil {
+		t.FailNow()
+	}
+	stats := journalGroup.Stats()
+	if stats.Chunks != 0 || stats.Dropped != 1 || stats.FreeSpace != 50 {
+		t.Fatalf("%v", stats)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+// +build !windows
+
+package journal
+
+import (
+	"os"
+	"syscall"
+)
+
+func freeSpace(dir string) (int64, error) {
+	stat := syscall.Statfs_t{}
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+func isNoSpace(err error) bool {
+	err_, ok := err.(*os.PathError)
+	if ok {
+		err = err_.Err
+	}
+	return err == syscall.ENOSPC
+}
@@ -0,0 +1,38 @@
+//go:build windows
+// +build windows
+
+package journal
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	errorHandleDiskFull = syscall.Errno(39)
+	errorDiskFull       = syscall.Errno(112)
+)
+
+var procGetDiskFreeSpaceExW = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func freeSpace(dir string) (int64, error) {
+	dir_, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	free := uint64(0)
+	r, _, err := procGetDiskFreeSpaceExW.Call(uintptr(unsafe.Pointer(dir_)), uintptr(unsafe.Pointer(&free)), 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	return int64(free), nil
+}
+
+func isNoSpace(err error) bool {
+	err_, ok := err.(*os.PathError)
+	if ok {
+		err = err_.Err
+	}
+	return err == errorDiskFull || err == errorHandleDiskFull
+}
@@ -0,0 +1,288 @@
+package journal
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// An encrypted chunk starts with the magic followed by the length of the
+// id of the key and the id itself.  Each write to the chunk follows as a
+// frame made of its length, the nonce and the sealed data.
+const chunkEncryptionMagic = "IKJE\x01"
+
+// ChunkEncryption seals the contents of the chunks with AES-GCM.  New
+// chunks are sealed with the active key, while the chunks sealed with any
+// of the other keys can still be read, so that keys can be rotated.
+type ChunkEncryption struct {
+	activeKeyId string
+	aeads       map[string]cipher.AEAD
+}
+
+type decryptingReader struct {
+	file           *os.File
+	reader         *bufio.Reader
+	aead           cipher.AEAD
+	header         []byte
+	buf            []byte
+	maxFrameLength int64 // 0 if unbounded
+	writing        bool  // the chunk may end with a frame being written
+}
+
+// ParseChunkEncryptionKeys reads keys given as entries separated by
+// newlines or commas, each of which is a base64-encoded AES key optionally
+// preceded by its id and a colon.  The id defaults to a digest of the key.
+// The last entry is the active key.
+func ParseChunkEncryptionKeys(text string) (*ChunkEncryption, error) {
+	keys := make(map[string][]byte)
+	activeKeyId := ""
+	for _, entry := range strings.FieldsFunc(text, func(c rune) bool { return c == '\n' || c == ',' }) {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		var keyId string
+		pair := strings.SplitN(entry, ":", 2)
+		if len(pair) == 2 {
+			keyId, entry = pair[0], pair[1]
+		}
+		key, err := base64.StdEncoding.DecodeString(entry)
+		if err != nil {
+			return nil, errors.New("invalid encryption key: " + err.Error())
+		}
+		if keyId == "" {
+			digest := sha256.Sum256(key)
+			keyId = hex.EncodeToString(digest[0:4])
+		}
+		keys[keyId] = key
+		activeKeyId = keyId
+	}
+	return NewChunkEncryption(keys, activeKeyId)
+}
+
+func NewChunkEncryption(keys map[string][]byte, activeKeyId string) (*ChunkEncryption, error) {
+	aeads := make(map[string]cipher.AEAD, len(keys))
+	for keyId, key := range keys {
+		if len(keyId) == 0 || len(keyId) > 255 {
+			return nil, errors.New(fmt.Sprintf("invalid key id: %s", keyId))
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		aeads[keyId] = aead
+	}
+	if _, ok := aeads[activeKeyId]; !ok {
+		return nil, errors.New("no encryption key is given")
+	}
+	return &ChunkEncryption{activeKeyId: activeKeyId, aeads: aeads}, nil
+}
+
+func chunkHeader(keyId string) []byte {
+	return append(append([]byte(chunkEncryptionMagic), byte(len(keyId))), keyId...)
+}
+
+// seal makes a frame of data.  The header of the chunk is authenticated
+// along with each frame, so that a frame cannot be moved to a chunk sealed
+// with another key.
+func (encryption *ChunkEncryption) seal(header []byte, data []byte) ([]byte, error) {
+	aead := encryption.aeads[encryption.activeKeyId]
+	frame := make([]byte, 4+aead.NonceSize(), 4+aead.NonceSize()+len(data)+aead.Overhead())
+	_, err := io.ReadFull(rand.Reader, frame[4:])
+	if err != nil {
+		return nil, err
+	}
+	frame = aead.Seal(frame, frame[4:], data, header)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(frame)-4))
+	return frame, nil
+}
+
+// frameOverhead is how many bytes sealing a write adds to it.
+func (encryption *ChunkEncryption) frameOverhead() int {
+	aead := encryption.aeads[encryption.activeKeyId]
+	return 4 + aead.NonceSize() + aead.Overhead()
+}
+
+// readChunkKeyId returns the id of the key the chunk is sealed with, or
+// the empty string if the chunk is in plaintext.
+func readChunkKeyId(file *os.File) (string, error) {
+	header := make([]byte, len(chunkEncryptionMagic)+1+255)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	header = header[0:n]
+	if len(header) <= len(chunkEncryptionMagic) || string(header[0:len(chunkEncryptionMagic)]) != chunkEncryptionMagic {
+		return "", nil
+	}
+	keyIdLength := int(header[len(chunkEncryptionMagic)])
+	if len(header) < len(chunkEncryptionMagic)+1+keyIdLength {
+		return "", errors.New(fmt.Sprintf("%s: truncated chunk header", file.Name()))
+	}
+	return string(header[len(chunkEncryptionMagic)+1 : len(chunkEncryptionMagic)+1+keyIdLength]), nil
+}
+
+func chunkKeyIdOf(path string) (string, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return readChunkKeyId(file)
+}
+
+// openChunk opens a chunk for reading, decrypting it if it is sealed.
+// encryption may be nil as long as the chunk is in plaintext.  No frame of
+// a sealed chunk may hold more than maxSize bytes unless maxSize is 0, and
+// only a chunk still being written may end with an incomplete frame.
+func openChunk(path string, encryption *ChunkEncryption, maxSize int64, writing bool) (io.Reader, error) {
+	return openChunkAt(path, encryption, maxSize, writing, 0)
+}
+
+// openChunkAt is openChunk reading from offset on, which is where a write
+// began unless it is 0.
+func openChunkAt(path string, encryption *ChunkEncryption, maxSize int64, writing bool, offset int64) (io.Reader, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return nil, err
+	}
+	keyId, err := readChunkKeyId(file)
+	if err != nil || keyId == "" {
+		if err == nil && offset > 0 {
+			_, err = file.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return file, nil
+	}
+	var aead cipher.AEAD
+	if encryption != nil {
+		aead = encryption.aeads[keyId]
+	}
+	if aead == nil {
+		file.Close()
+		return nil, errors.New(fmt.Sprintf("%s is encrypted with key %s, which is not given", path, keyId))
+	}
+	header := chunkHeader(keyId)
+	if offset < int64(len(header)) {
+		offset = int64(len(header))
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(file)
+	maxFrameLength := int64(0)
+	if maxSize > 0 {
+		maxFrameLength = maxSize + int64(aead.NonceSize()+aead.Overhead())
+	}
+	return &decryptingReader{
+		file:           file,
+		reader:         reader,
+		aead:           aead,
+		header:         header,
+		maxFrameLength: maxFrameLength,
+		writing:        writing,
+	}, nil
+}
+
+// completeFramesLength returns the length of the sealed chunk up to the end
+// of its last complete frame, which is shorter than the file if a write
+// was cut short.
+func completeFramesLength(path string, keyId string) (int64, error) {
+	file, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	offset := int64(len(chunkHeader(keyId)))
+	_, err = reader.Discard(int(offset))
+	if err != nil {
+		return 0, err
+	}
+	for {
+		var length [4]byte
+		_, err := io.ReadFull(reader, length[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return offset, nil
+		} else if err != nil {
+			return 0, err
+		}
+		n := int64(binary.BigEndian.Uint32(length[:]))
+		discarded, err := reader.Discard(int(n))
+		if int64(discarded) < n {
+			if err == io.EOF {
+				return offset, nil
+			}
+			return 0, err
+		}
+		offset += 4 + n
+	}
+}
+
+// truncated is the error for a chunk that ends in the middle of a frame,
+// which means the end of the contents if the frame is being written.
+func (reader *decryptingReader) truncated() error {
+	if reader.writing {
+		return io.EOF
+	}
+	return errors.New(reader.file.Name() + ": truncated frame")
+}
+
+// Read ends at a frame being written, which is not complete yet, if the
+// chunk is the head.
+func (reader *decryptingReader) Read(p []byte) (int, error) {
+	for len(reader.buf) == 0 {
+		var length [4]byte
+		_, err := io.ReadFull(reader.reader, length[:])
+		if err == io.ErrUnexpectedEOF {
+			return 0, reader.truncated()
+		} else if err != nil {
+			return 0, err
+		}
+		frameLength := binary.BigEndian.Uint32(length[:])
+		if reader.maxFrameLength > 0 && int64(frameLength) > reader.maxFrameLength {
+			return 0, errors.New(fmt.Sprintf("%s: frame of %d bytes exceeds the chunk limit", reader.file.Name(), frameLength))
+		}
+		frame := make([]byte, frameLength)
+		_, err = io.ReadFull(reader.reader, frame)
+		if err == io.ErrUnexpectedEOF || err == io.EOF {
+			return 0, reader.truncated()
+		} else if err != nil {
+			return 0, err
+		}
+		nonceSize := reader.aead.NonceSize()
+		if len(frame) < nonceSize {
+			return 0, errors.New(reader.file.Name() + ": corrupted frame")
+		}
+		reader.buf, err = reader.aead.Open(frame[nonceSize:nonceSize], frame[0:nonceSize], frame[nonceSize:], reader.header)
+		if err != nil {
+			return 0, errors.New(reader.file.Name() + ": " + err.Error())
+		}
+	}
+	n := copy(p, reader.buf)
+	reader.buf = reader.buf[n:]
+	return n, nil
+}
+
+func (reader *decryptingReader) Close() error {
+	return reader.file.Close()
+}
@@ -0,0 +1,246 @@
+package journal
+
+import (
+	"bytes"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func newEncryptingJournalGroup(t *testing.T, seed int64, path string, keys string) *FileJournalGroup {
+	logger := newTestLogger()
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(seed),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		".log",
+		os.FileMode(0644),
+		1024,
+	)
+	if keys != "" {
+		encryption, err := ParseChunkEncryptionKeys(keys)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		factory.SetEncryption(encryption)
+	}
+	journalGroup, err := factory.GetJournalGroup(path, &DummyPluginInstance{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return journalGroup
+}
+
+func Test_FileJournal_Encryption(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	keyA := "a:MDEyMzQ1Njc4OWFiY2RlZg=="
+	keyB := "b:ZmVkY2JhOTg3NjU0MzIxMA=="
+
+	journal := newEncryptingJournalGroup(t, 0, tempDir+"/test", "").GetFileJournal("key")
+	err = journal.Write([]byte("test0"))
+	if err != nil {
+		t.FailNow()
+	}
+	journal.Dispose()
+
+	// the plaintext chunk is left as it is
+	journal = newEncryptingJournalGroup(t, 1, tempDir+"/test", keyA).GetFileJournal("key")
+	for _, data := range []string{"test1", "test2"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	tail := journal.GetTailChunk().(*FileJournalChunkWrapper)
+	blob, err := ioutil.ReadFile(tail.chunk.Path)
+	if err != nil {
+		t.FailNow()
+	}
+	if bytes.Contains(blob, []byte("test1")) {
+		t.Fail()
+	}
+	tail.Dispose()
+	journal.Dispose()
+
+	// rotated to b, under which a is still readable
+	journal = newEncryptingJournalGroup(t, 2, tempDir+"/test", keyA+"\n"+keyB).GetFileJournal("key")
+	err = journal.Write([]byte("test3"))
+	if err != nil {
+		t.FailNow()
+	}
+	if journal.chunks.count != 3 {
+		t.Logf("%d chunks", journal.chunks.count)
+		t.Fail()
+	}
+	expected := map[string]string{"test0": "", "test1test2": "a", "test3": "b"}
+	err = journal.Flush(func(chunk ik.JournalChunk) error {
+		reader, err := chunk.GetReader()
+		if err != nil {
+			return err
+		}
+		defer reader.(interface {
+			Close() error
+		}).Close()
+		content, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		keyId, err := chunkKeyIdOf(chunk.(*FileJournalChunkWrapper).chunk.Path)
+		if err != nil {
+			return err
+		}
+		expectedKeyId, ok := expected[string(content)]
+		if !ok || keyId != expectedKeyId {
+			t.Logf("%s sealed with %s", string(content), keyId)
+			t.Fail()
+		}
+		delete(expected, string(content))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(expected) != 0 {
+		t.Fail()
+	}
+}
+
+func Test_ParseChunkEncryptionKeys(t *testing.T) {
+	encryption, err := ParseChunkEncryptionKeys("MDEyMzQ1Njc4OWFiY2RlZg==,\nb:ZmVkY2JhOTg3NjU0MzIxMA==\n")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if encryption.activeKeyId != "b" || len(encryption.aeads) != 2 {
+		t.Fail()
+	}
+	_, err = ParseChunkEncryptionKeys("a:MDEy")
+	if err == nil {
+		t.Fail()
+	}
+	_, err = ParseChunkEncryptionKeys("")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func readEncryptedChunk(t *testing.T, path string, journalGroup *FileJournalGroup, writing bool) (string, error) {
+	reader, err := openChunk(path, journalGroup.encryption, journalGroup.maxSize, writing)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer reader.(interface {
+		Close() error
+	}).Close()
+	content, err := ioutil.ReadAll(reader)
+	return string(content), err
+}
+
+func Test_FileJournal_EncryptedFrames(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	journalGroup := newEncryptingJournalGroup(t, 0, tempDir+"/test", "a:MDEyMzQ1Njc4OWFiY2RlZg==")
+	journal := journalGroup.GetFileJournal("key")
+	defer journal.Dispose()
+
+	// the frame overhead counts against the chunk limit
+	record := bytes.Repeat([]byte("x"), 480)
+	for i := 0; i < 2; i++ {
+		err = journal.Write(record)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if journal.chunks.count != 2 {
+		t.Logf("%d chunks", journal.chunks.count)
+		t.Fail()
+	}
+	for chunk := journal.chunks.first; chunk != nil; chunk = chunk.head.next {
+		if chunk.Size > journalGroup.maxSize {
+			t.Logf("%d bytes in %s", chunk.Size, chunk.Path)
+			t.Fail()
+		}
+	}
+	err = journal.Write(bytes.Repeat([]byte("x"), 1025))
+	if err == nil {
+		t.Fail()
+	}
+
+	// an incomplete frame ends only the chunk being written
+	path := journal.chunks.last.Path
+	info, err := os.Stat(path)
+	if err != nil {
+		t.FailNow()
+	}
+	err = os.Truncate(path, info.Size()-1)
+	if err != nil {
+		t.FailNow()
+	}
+	content, err := readEncryptedChunk(t, path, journalGroup, true)
+	if err != nil || content != "" {
+		t.Fail()
+	}
+	_, err = readEncryptedChunk(t, path, journalGroup, false)
+	if err == nil {
+		t.Fail()
+	}
+
+	// a frame length beyond the limit is not trusted
+	blob := append(chunkHeader("a"), 0xff, 0xff, 0xff, 0xf0)
+	err = ioutil.WriteFile(path, blob, 0644)
+	if err != nil {
+		t.FailNow()
+	}
+	_, err = readEncryptedChunk(t, path, journalGroup, true)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func Test_FileJournal_EncryptedRecovery(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	keys := "a:MDEyMzQ1Njc4OWFiY2RlZg=="
+	journal := newEncryptingJournalGroup(t, 0, tempDir+"/test", keys).GetFileJournal("key")
+	for _, data := range []string{"test1", "test2"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	path := journal.chunks.first.Path
+	journal.Dispose()
+
+	// a write cut short by a crash
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.FailNow()
+	}
+	file.Write([]byte{0, 0, 0, 100, 1, 2, 3})
+	file.Close()
+
+	journalGroup := newEncryptingJournalGroup(t, 1, tempDir+"/test", keys)
+	journal = journalGroup.GetFileJournal("key")
+	defer journal.Dispose()
+	err = journal.Write([]byte("test3"))
+	if err != nil {
+		t.FailNow()
+	}
+	content, err := readEncryptedChunk(t, path, journalGroup, false)
+	if err != nil || content != "test1test2test3" {
+		t.Logf("%q, %v", content, err)
+		t.Fail()
+	}
+}
@@ -0,0 +1,75 @@
+package journal
+
+import (
+	"sync/atomic"
+)
+
+// SetMaxJournals makes the journal groups created afterwards keep no more
+// than max journals open, evicting the least recently used ones as others
+// are opened.  An evicted journal has its writer closed, and its chunks are
+// left on disk; it is kept aside until they have been flushed, and opened
+// again if asked for meanwhile.  max <= 0 means no limit.
+func (factory *FileJournalGroupFactory) SetMaxJournals(max int) {
+	factory.maxJournals = max
+}
+
+// Evictions returns the number of journals evicted so far.
+func (journalGroup *FileJournalGroup) Evictions() int64 {
+	return atomic.LoadInt64(&journalGroup.evictions)
+}
+
+// touch marks the journal as the most recently used one.  The caller holds
+// the lock of the group.
+func (journalGroup *FileJournalGroup) touch(journal *FileJournal) {
+	if journal.element == nil {
+		journal.element = journalGroup.lru.PushFront(journal)
+	} else {
+		journalGroup.lru.MoveToFront(journal.element)
+	}
+}
+
+// evict sets aside the least recently used journals beyond max_journals,
+// and returns them for their writers to be closed once the lock of the
+// group, which the caller holds, is released.
+func (journalGroup *FileJournalGroup) evict() []*FileJournal {
+	evicted := make([]*FileJournal, 0)
+	if journalGroup.maxJournals <= 0 {
+		return evicted
+	}
+	for len(journalGroup.journals) > journalGroup.maxJournals {
+		journal := journalGroup.lru.Remove(journalGroup.lru.Back()).(*FileJournal)
+		journal.element = nil
+		delete(journalGroup.journals, journal.key)
+		journalGroup.idle[journal.key] = journal
+		evicted = append(evicted, journal)
+	}
+	atomic.AddInt64(&journalGroup.evictions, int64(len(evicted)))
+	return evicted
+}
+
+func (journalGroup *FileJournalGroup) closeEvicted(evicted []*FileJournal) {
+	for _, journal := range evicted {
+		err := journal.Dispose()
+		if err != nil {
+			journalGroup.logger.Error("failed to close the evicted journal %s: %s", journal.key, err.Error())
+		}
+	}
+	if len(evicted) > 0 {
+		journalGroup.mtx.Lock()
+		journalGroup.forgetFlushedIdle()
+		journalGroup.mtx.Unlock()
+	}
+}
+
+// forgetFlushedIdle forgets the evicted journals whose chunks have all been
+// flushed.  The caller holds the lock of the group.
+func (journalGroup *FileJournalGroup) forgetFlushedIdle() {
+	for key, journal := range journalGroup.idle {
+		journal.chunks.mtx.Lock()
+		count := journal.chunks.count
+		journal.chunks.mtx.Unlock()
+		if count == 0 {
+			delete(journalGroup.idle, key)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package journal
+
+import (
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func Test_JournalGroup_MaxJournals(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		".log",
+		os.FileMode(0644),
+		1024,
+	)
+	factory.SetMaxJournals(2)
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	defer journalGroup.Dispose()
+	a := journalGroup.GetFileJournal("a")
+	err = a.Write([]byte("a"))
+	if err != nil {
+		t.FailNow()
+	}
+	journalGroup.GetFileJournal("b")
+	journalGroup.GetFileJournal("a")
+	journalGroup.GetFileJournal("c")
+	// b is the least recently used one, and has nothing to keep
+	keys := journalGroup.GetJournalKeys()
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "c" || journalGroup.Evictions() != 1 {
+		t.Fatalf("%v %d", keys, journalGroup.Evictions())
+	}
+	journalGroup.GetFileJournal("d")
+	// a is closed, but kept aside until its chunk has been flushed
+	if a.writer != nil || journalGroup.Stats().Journals != 2 || journalGroup.Stats().Chunks != 1 {
+		t.Fatalf("%v", journalGroup.Stats())
+	}
+	keys = journalGroup.GetJournalKeys()
+	sort.Strings(keys)
+	if len(keys) != 3 || keys[0] != "a" {
+		t.Fatalf("%v", keys)
+	}
+	delivered := ""
+	err = journalGroup.GetFileJournal("a").Flush(func(chunk ik.JournalChunk) error {
+		defer chunk.Dispose()
+		reader, err := chunk.GetReader()
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(reader)
+		if err != nil {
+			return err
+		}
+		delivered += string(b)
+		chunk.TakeOwnership()
+		return nil
+	})
+	if err != nil || delivered != "a" {
+		t.Fatalf("%q %v", delivered, err)
+	}
+	// a was opened again, evicting c
+	if journalGroup.Evictions() != 3 {
+		t.Fatalf("%d", journalGroup.Evictions())
+	}
+	journalGroup.GetFileJournal("e")
+	keys = journalGroup.GetJournalKeys()
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "a" || keys[1] != "e" {
+		t.Fatalf("%v", keys)
+	}
+}
@@ -1,13 +1,16 @@
 package journal
 
 import (
+	"container/list"
+	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/moriyoshi/ik"
 	"io"
 	"math/rand"
 	"os"
-	"path"
+	"path/filepath"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -34,7 +37,14 @@ type FileJournalChunk struct {
 	TSuffix   string
 	Timestamp int64
 	UniqueId  []byte
+	Size      int64 // must be accessed atomically
 	refcount  int32
+	owned     int32 // must be accessed atomically
+	// the offsets of every indexInterval-th record, known only of the
+	// chunks written from the start by this process
+	indexed bool
+	records int64
+	index   []int64
 }
 
 type FileJournal struct {
@@ -43,33 +53,68 @@ type FileJournal struct {
 	chunks            FileJournalChunkDequeue
 	writer            io.WriteCloser
 	position          int64
+	writerKeyId       string
 	newChunkListeners map[uintptr]ik.JournalChunkListener
 	flushListeners    map[uintptr]ik.JournalChunkListener
+	element           *list.Element // in the LRU of the group, nil once evicted
 	mtx               sync.Mutex
 }
 
 type FileJournalGroup struct {
-	factory        *FileJournalGroupFactory
-	pluginInstance ik.PluginInstance
-	timeGetter     func() time.Time
-	logger         ik.Logger
-	rand           *rand.Rand
-	fileMode       os.FileMode
-	maxSize        int64
-	pathPrefix     string
-	pathSuffix     string
-	journals       map[string]*FileJournal
-	mtx            sync.Mutex
+	factory           *FileJournalGroupFactory
+	pluginInstance    ik.PluginInstance
+	clock             ik.Clock
+	logger            ik.Logger
+	rand              *rand.Rand
+	fileMode          os.FileMode
+	maxSize           int64
+	pathPrefix        string
+	pathSuffix        string
+	journals          map[string]*FileJournal
+	idle              map[string]*FileJournal
+	lru               *list.List
+	maxJournals       int
+	evictions         int64
+	encryption        *ChunkEncryption
+	hooks             *ChunkHooks
+	indexInterval     int
+	timeSlice         time.Duration
+	timeSliceLocation *time.Location
+	lock              *bufferLock
+	watchdog          *DiskSpaceWatchdog
+	dropNewest        bool
+	dropped           int64
+	writeErrors       int64
+	maxAge            time.Duration
+	maxTotalBytes     int64
+	expired           int64
+	compactThreshold  int64
+	compacted         int64
+	topics            []*journalGroupTopic
+	mtx               sync.Mutex
 }
 
 type FileJournalGroupFactory struct {
 	logger            ik.Logger
+	scorekeeper       *ik.Scorekeeper
 	paths             map[string]*FileJournalGroup
 	randSource        rand.Source
-	timeGetter        func() time.Time
+	clock             ik.Clock
 	defaultPathSuffix string
 	defaultFileMode   os.FileMode
 	maxSize           int64
+	encryption        *ChunkEncryption
+	hooks             *ChunkHooks
+	indexInterval     int
+	timeSlice         time.Duration
+	timeSliceLocation *time.Location
+	maxJournals       int
+	takeOverStaleLock bool
+	watchdog          *DiskSpaceWatchdog
+	dropNewest        bool
+	maxAge            time.Duration
+	maxTotalBytes     int64
+	compactThreshold  int64
 }
 
 type FileJournalChunkWrapper struct {
@@ -82,12 +127,28 @@ func (wrapper *FileJournalChunkWrapper) Path() string {
 	return wrapper.chunk.Path
 }
 
-func (wrapper *FileJournalChunkWrapper) GetReader() (io.Reader, error) {
+func (wrapper *FileJournalChunkWrapper) Size() int64 {
 	chunk := (*FileJournalChunk)(atomic.LoadPointer((*unsafe.Pointer)((unsafe.Pointer)(&wrapper.chunk))))
+	if chunk == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&chunk.Size)
+}
+
+func (wrapper *FileJournalChunkWrapper) loadChunk() *FileJournalChunk {
+	return (*FileJournalChunk)(atomic.LoadPointer((*unsafe.Pointer)((unsafe.Pointer)(&wrapper.chunk))))
+}
+
+func (wrapper *FileJournalChunkWrapper) GetReader() (io.Reader, error) {
+	chunk := wrapper.loadChunk()
 	if chunk == nil {
 		return nil, errors.New("already disposed")
 	}
-	return chunk.getReader()
+	journal := wrapper.journal
+	journal.chunks.mtx.Lock()
+	writing := journal.chunks.first == chunk
+	journal.chunks.mtx.Unlock()
+	return openChunk(chunk.Path, journal.group.encryption, journal.group.maxSize, writing)
 }
 
 func (wrapper *FileJournalChunkWrapper) GetNextChunk() ik.JournalChunk {
@@ -104,17 +165,29 @@ func (wrapper *FileJournalChunkWrapper) GetNextChunk() ik.JournalChunk {
 	return retval
 }
 
+func (wrapper *FileJournalChunkWrapper) UniqueId() string {
+	chunk := wrapper.loadChunk()
+	if chunk == nil {
+		return ""
+	}
+	return hex.EncodeToString(chunk.UniqueId)
+}
+
 func (wrapper *FileJournalChunkWrapper) TakeOwnership() bool {
 	chunk := (*FileJournalChunk)(atomic.LoadPointer((*unsafe.Pointer)((unsafe.Pointer)(&wrapper.chunk))))
 	if chunk == nil {
 		return false
 	}
-	if atomic.CompareAndSwapInt64(&wrapper.ownershipTaken, 0, 1) {
-		wrapper.journal.deleteRef((*FileJournalChunk)(chunk))
-		return true
-	} else {
+	if !atomic.CompareAndSwapInt64(&wrapper.ownershipTaken, 0, 1) {
+		return false
+	}
+	// the reference held by the older chunk, or by the journal for the
+	// oldest, is given up once however many wrappers take the ownership
+	if !atomic.CompareAndSwapInt32(&chunk.owned, 0, 1) {
 		return false
 	}
+	wrapper.journal.deleteRef((*FileJournalChunk)(chunk))
+	return true
 }
 
 func (wrapper *FileJournalChunkWrapper) Dispose() error {
@@ -122,19 +195,8 @@ func (wrapper *FileJournalChunkWrapper) Dispose() error {
 	if chunk == nil {
 		return errors.New("already disposed")
 	}
-	err, destroyed := wrapper.journal.deleteRef((*FileJournalChunk)(chunk))
-	if err != nil {
-		return err
-	}
-	if destroyed && wrapper.ownershipTaken != 0 && chunk.head.next == nil {
-		// increment the refcount of the last chunk
-		// to rehold the reference
-		prevChunk := chunk.head.prev
-		if prevChunk != nil {
-			atomic.AddInt32(&prevChunk.refcount, 1)
-		}
-	}
-	return nil
+	err, _ := wrapper.journal.deleteRef((*FileJournalChunk)(chunk))
+	return err
 }
 
 func (journal *FileJournal) newChunkWrapper(chunk *FileJournalChunk) *FileJournalChunkWrapper {
@@ -145,8 +207,10 @@ func (journal *FileJournal) newChunkWrapper(chunk *FileJournalChunk) *FileJourna
 func (journal *FileJournal) deleteRef(chunk *FileJournalChunk) (error, bool) {
 	refcount := atomic.AddInt32(&chunk.refcount, -1)
 	if refcount == 0 {
-		// first propagate to newer chunk
-		if prevChunk := chunk.head.prev; prevChunk != nil {
+		// first propagate to newer chunk, unless the reference the chunk
+		// holds on it passes on to the older one, or to the journal, as the
+		// chunk was taken, or it was given up as the newer one was
+		if prevChunk := chunk.head.prev; prevChunk != nil && atomic.LoadInt32(&chunk.owned) == 0 && atomic.LoadInt32(&prevChunk.owned) == 0 {
 			err, _ := journal.deleteRef(prevChunk)
 			if err != nil {
 				// undo the change
@@ -154,7 +218,7 @@ func (journal *FileJournal) deleteRef(chunk *FileJournalChunk) (error, bool) {
 				return err, false
 			}
 		}
-		err := os.Remove(chunk.Path)
+		err := removeChunkFile(chunk.Path)
 		if err != nil {
 			// undo the change
 			atomic.AddInt32(&chunk.refcount, 1)
@@ -177,6 +241,7 @@ func (journal *FileJournal) deleteRef(chunk *FileJournalChunk) (error, bool) {
 			journal.chunks.count -= 1
 			journal.chunks.mtx.Unlock()
 		}
+		journal.callPurgeHook(chunk)
 		return nil, true
 	} else if refcount < 0 {
 		// should never happen
@@ -185,18 +250,28 @@ func (journal *FileJournal) deleteRef(chunk *FileJournalChunk) (error, bool) {
 	return nil, false
 }
 
-func (chunk *FileJournalChunk) getReader() (io.Reader, error) {
-	return os.OpenFile(chunk.Path, os.O_RDONLY, 0)
-}
-
 func (journal *FileJournal) Key() string {
 	return journal.key
 }
 
+// callListener turns a panic of the listener into an error, as the locks
+// held by the caller would be left locked otherwise.
+func (journal *FileJournal) callListener(listener ik.JournalChunkListener, chunk *FileJournalChunk) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			panicked := ik.NewPanicked(r)
+			journal.group.logger.Critical("listener panicked: %s\n%s", panicked.Error(), string(panicked.Stack()))
+			err = panicked
+		}
+	}()
+	return listener(journal.newChunkWrapper(chunk))
+}
+
 func (journal *FileJournal) notifyFlushListeners(chunk *FileJournalChunk) {
 	// lock for listener container must be acquired by caller
 	for _, listener := range journal.flushListeners {
-		err := listener(journal.newChunkWrapper(chunk))
+		err := journal.callListener(listener, chunk)
 		if err != nil {
 			journal.group.logger.Error("error occurred during notifying flush event: %s", err.Error())
 		}
@@ -206,7 +281,7 @@ func (journal *FileJournal) notifyFlushListeners(chunk *FileJournalChunk) {
 func (journal *FileJournal) notifyNewChunkListeners(chunk *FileJournalChunk) {
 	// lock for listener container must be acquired by caller
 	for _, listener := range journal.newChunkListeners {
-		err := listener(journal.newChunkWrapper(chunk))
+		err := journal.callListener(listener, chunk)
 		if err != nil {
 			journal.group.logger.Error("error occurred during notifying flush event: %s", err.Error())
 		}
@@ -221,12 +296,20 @@ func (journal *FileJournal) finalizeChunk(chunk *FileJournalChunk) error {
 		chunk.TSuffix,
 	)
 	newPath := group.pathPrefix + variablePortion + group.pathSuffix
-	err := os.Rename(chunk.Path, newPath)
+	err := renameChunkFile(chunk.Path, newPath)
+	if err == nil {
+		err = syncDir(filepath.Dir(newPath))
+	}
 	if err != nil {
 		return err
 	}
 	chunk.Type = Rest
 	chunk.Path = newPath
+	err = removeRollOver(rollOverPath(group.pathPrefix, journal.key))
+	if err != nil {
+		return err
+	}
+	journal.callRestHook(chunk)
 	journal.notifyFlushListeners(chunk)
 	return nil
 }
@@ -235,17 +318,32 @@ func (journal *FileJournal) Purge() error {
 	journal.mtx.Lock()
 	defer journal.mtx.Unlock()
 	lastChunk := (*FileJournalChunk)(nil)
+	head := (*FileJournalChunk)(nil)
 	{
 		journal.chunks.mtx.Lock()
 		lastChunk = journal.chunks.last
+		head = journal.chunks.first
 		journal.chunks.mtx.Unlock()
 	}
-	// initiate GC
-	if lastChunk != nil {
-		err, _ := journal.deleteRef(lastChunk)
-		if err != nil {
+	// the reference of the journal on the oldest chunk is gone if it was
+	// taken, which is removed as the last holder lets go of it
+	if lastChunk == nil {
+		return nil
+	}
+	if atomic.LoadInt32(&lastChunk.owned) != 0 {
+		// a taken chunk being written that nothing else holds is done
+		// with, and the next write goes to a new one
+		if lastChunk == head && atomic.LoadInt32(&lastChunk.refcount) == 1 && journal.writer != nil {
+			journal.closeWriter()
+			err, _ := journal.deleteRef(lastChunk) // writer-holding ref
 			return err
 		}
+		return nil
+	}
+	// initiate GC
+	err, _ := journal.deleteRef(lastChunk)
+	if err != nil {
+		return err
 	}
 	// journal.chunks can change during the call to deleteRef()
 	{
@@ -253,31 +351,35 @@ func (journal *FileJournal) Purge() error {
 		lastChunk = journal.chunks.last
 		journal.chunks.mtx.Unlock()
 	}
-	if lastChunk != nil {
+	if lastChunk != nil && atomic.LoadInt32(&lastChunk.owned) == 0 {
 		atomic.AddInt32(&lastChunk.refcount, 1)
 	}
 	return nil
 }
 
 func (journal *FileJournal) Flush(visitor func(ik.JournalChunk) error) error {
+	return journal.FlushContext(context.Background(), visitor)
+}
 
+// FlushContext leaves the chunks not visited yet when ctx is done, to be
+// flushed next time.
+func (journal *FileJournal) FlushContext(ctx context.Context, visitor func(ik.JournalChunk) error) error {
 	if visitor != nil {
-		chunks := make([]*FileJournalChunk, journal.chunks.count)
-		{
-			journal.chunks.mtx.Lock()
-			i := 0
-			for chunk := journal.chunks.last; chunk != nil; chunk = chunk.head.prev {
-				chunks[i] = chunk
-				i += 1
+		// the snapshot keeps the chunks not visited yet from being purged
+		chunks := journal.snapshot()
+		for chunks.Next() {
+			err := ctx.Err()
+			if err != nil {
+				chunks.Close()
+				return err
 			}
-			journal.chunks.mtx.Unlock()
-		}
-		for _, chunk := range chunks {
-			err := visitor(journal.newChunkWrapper(chunk))
+			err = visitor(chunks.take())
 			if err != nil {
+				chunks.Close()
 				return err
 			}
 		}
+		chunks.Close()
 	}
 	journal.Purge()
 	return nil
@@ -288,32 +390,63 @@ func (journal *FileJournal) newChunk() (*FileJournalChunk, error) {
 	info := BuildJournalPath(
 		journal.key,
 		Head,
-		group.timeGetter(),
+		group.clock.Now(),
 		group.rand.Int63n(0xfff),
 	)
 	chunk := &FileJournalChunk{
-		head:     FileJournalChunkDequeueHead{journal.chunks.first, nil},
-		Path:     (group.pathPrefix + info.VariablePortion + group.pathSuffix),
-		Type:     info.Type,
-		TSuffix:  info.TSuffix,
-		UniqueId: info.UniqueId,
-		refcount: 1,
-	}
-	file, err := os.OpenFile(chunk.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, journal.group.fileMode)
+		head:      FileJournalChunkDequeueHead{journal.chunks.first, nil},
+		Path:      (group.pathPrefix + info.VariablePortion + group.pathSuffix),
+		Type:      info.Type,
+		TSuffix:   info.TSuffix,
+		Timestamp: info.Timestamp,
+		UniqueId:  info.UniqueId,
+		refcount:  1,
+		indexed:   true,
+	}
+	// the writer-holding reference of the old head is gone once the
+	// journal has been disposed
+	writerHeld := journal.writer != nil
+
+	oldHead := (*FileJournalChunk)(nil)
+	{
+		journal.chunks.mtx.Lock()
+		oldHead = journal.chunks.first
+		journal.chunks.mtx.Unlock()
+	}
+	walPath := rollOverPath(group.pathPrefix, journal.key)
+	if oldHead != nil {
+		err := writeRollOver(walPath, oldHead.TSuffix, chunk.TSuffix, group.fileMode)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// the new chunk is opened before the writer is closed, so that the
+	// journal keeps writing to the old head if it cannot be
+	file, err := os.OpenFile(chunk.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_EXCL, chunkFileMode(journal.group.fileMode))
 	if err != nil {
+		if oldHead != nil {
+			removeRollOver(walPath)
+		}
 		return nil, err
 	}
-	if journal.writer != nil {
-		err := journal.writer.Close()
+	abandon := func() {
+		file.Close()
+		os.Remove(chunk.Path)
+		if oldHead != nil {
+			removeRollOver(walPath)
+		}
+	}
+	if writerHeld {
+		err := journal.closeWriter()
 		if err != nil {
+			abandon()
+			journal.deleteRef(oldHead) // writer-holding ref
 			return nil, err
 		}
 	}
 
-	oldHead := (*FileJournalChunk)(nil)
 	{
 		journal.chunks.mtx.Lock()
-		oldHead = journal.chunks.first
 		if oldHead != nil {
 			oldHead.head.prev = chunk
 		} else {
@@ -329,24 +462,50 @@ func (journal *FileJournal) newChunk() (*FileJournalChunk, error) {
 	if oldHead != nil {
 		err := journal.finalizeChunk(oldHead)
 		if err != nil {
-			file.Close()
-			os.Remove(chunk.Path)
+			journal.chunks.mtx.Lock()
+			oldHead.head.prev = nil
+			journal.chunks.first = oldHead
+			journal.chunks.count -= 1
+			journal.chunks.mtx.Unlock()
+			abandon()
+			if writerHeld {
+				journal.deleteRef(oldHead)
+			}
 			return nil, err
 		}
-		err, _ = journal.deleteRef(oldHead) // writer-holding ref
-		if err != nil {
-			file.Close()
-			os.Remove(chunk.Path)
-			return nil, err
+		if writerHeld {
+			err, _ = journal.deleteRef(oldHead) // writer-holding ref
+			if err != nil {
+				group.logger.Error("failed to release chunk %s: %s", oldHead.Path, err.Error())
+			}
 		}
 	}
 
 	journal.writer = file
 	journal.position = 0
+	journal.writerKeyId = ""
 	journal.notifyNewChunkListeners(chunk)
 	return chunk, nil
 }
 
+// closeWriter syncs and closes the writer.  The writer is gone even if it
+// fails, in which case the next write opens a new chunk.
+func (journal *FileJournal) closeWriter() error {
+	var err error
+	syncer, ok := journal.writer.(interface {
+		Sync() error
+	})
+	if ok {
+		err = syncer.Sync()
+	}
+	err_ := journal.writer.Close()
+	if err == nil {
+		err = err_
+	}
+	journal.writer = nil
+	return err
+}
+
 func (journal *FileJournal) AddFlushListener(listener ik.JournalChunkListener) {
 	journal.mtx.Lock()
 	defer journal.mtx.Unlock()
@@ -362,25 +521,69 @@ func (journal *FileJournal) AddNewChunkListener(listener ik.JournalChunkListener
 }
 
 func (journal *FileJournal) Write(data []byte) error {
+	if journal.group.dropsNewest() {
+		atomic.AddInt64(&journal.group.dropped, 1)
+		return nil
+	}
+	err := journal.write(data)
+	if err != nil {
+		atomic.AddInt64(&journal.group.writeErrors, 1)
+		if isNoSpace(err) {
+			err = noSpaceError(journal.group.pathPrefix, err)
+		}
+	}
+	return err
+}
+
+func (journal *FileJournal) write(data []byte) error {
 	journal.mtx.Lock()
 	defer journal.mtx.Unlock()
 
+	encryption := journal.group.encryption
+	keyId := ""
+	required := int64(len(data))
+	if encryption != nil {
+		keyId = encryption.activeKeyId
+		// a frame larger than the limit would be taken for a corrupted one
+		if journal.group.maxSize > 0 && required > journal.group.maxSize {
+			return errors.New(fmt.Sprintf("%d bytes exceed the chunk limit of %d bytes", required, journal.group.maxSize))
+		}
+		required += int64(encryption.frameOverhead())
+	}
 	if journal.writer == nil {
-		if journal.chunks.first == nil {
+		_, err := journal.newChunk()
+		if err != nil {
+			return err
+		}
+	} else {
+		// a chunk is sealed with a single key from the start; the
+		// contents go in the next one if the key has changed since
+		if journal.group.maxSize-journal.position < required || (journal.position > 0 && journal.writerKeyId != keyId) {
 			_, err := journal.newChunk()
 			if err != nil {
 				return err
 			}
 		}
-	} else {
-		if journal.group.maxSize-journal.position < int64(len(data)) {
-			_, err := journal.newChunk()
+	}
+
+	if encryption != nil {
+		if journal.position == 0 {
+			header := chunkHeader(keyId)
+			_, err := journal.writer.Write(header)
 			if err != nil {
 				return err
 			}
+			journal.position += int64(len(header))
+			journal.writerKeyId = keyId
+		}
+		var err error
+		data, err = encryption.seal(chunkHeader(keyId), data)
+		if err != nil {
+			return err
 		}
 	}
 
+	offset := journal.position
 	n, err := journal.writer.Write(data)
 	if err != nil {
 		return err
@@ -389,9 +592,24 @@ func (journal *FileJournal) Write(data []byte) error {
 		return errors.New("not all data could be written")
 	}
 	journal.position += int64(n)
+	atomic.StoreInt64(&journal.chunks.first.Size, journal.position)
+	journal.indexRecord(journal.chunks.first, offset)
 	return nil
 }
 
+// Sync commits the chunk being written to stable storage.
+func (journal *FileJournal) Sync() error {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	syncer, ok := journal.writer.(interface {
+		Sync() error
+	})
+	if !ok {
+		return nil
+	}
+	return syncer.Sync()
+}
+
 func (journal *FileJournal) GetTailChunk() ik.JournalChunk {
 	retval := (*FileJournalChunkWrapper)(nil)
 	{
@@ -404,6 +622,9 @@ func (journal *FileJournal) GetTailChunk() ik.JournalChunk {
 	return retval
 }
 
+// Dispose closes the writer and releases the reference it holds on the
+// head chunk, so that a head chunk whose ownership has already been taken
+// is removed as well.
 func (journal *FileJournal) Dispose() error {
 	journal.mtx.Lock()
 	defer journal.mtx.Unlock()
@@ -413,24 +634,58 @@ func (journal *FileJournal) Dispose() error {
 			return err
 		}
 		journal.writer = nil
+		head := (*FileJournalChunk)(nil)
+		{
+			journal.chunks.mtx.Lock()
+			head = journal.chunks.first
+			journal.chunks.mtx.Unlock()
+		}
+		if head != nil {
+			err, _ := journal.deleteRef(head)
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
 func (journalGroup *FileJournalGroup) Dispose() error {
+	unbindJournalGroupTopics(journalGroup)
 	for _, journal := range journalGroup.journals {
 		journal.Dispose()
 	}
-	return nil
+	for _, journal := range journalGroup.idle {
+		journal.Dispose()
+	}
+	lock := journalGroup.lock
+	journalGroup.lock = nil
+	if lock == nil {
+		return nil
+	}
+	return lock.release()
 }
 
 func (journalGroup *FileJournalGroup) GetFileJournal(key string) *FileJournal {
 	journalGroup.mtx.Lock()
-	defer journalGroup.mtx.Unlock()
+	journal, evicted := journalGroup.getFileJournal(key)
+	journalGroup.mtx.Unlock()
+	journalGroup.closeEvicted(evicted)
+	return journal
+}
 
+func (journalGroup *FileJournalGroup) getFileJournal(key string) (*FileJournal, []*FileJournal) {
 	journal, ok := journalGroup.journals[key]
 	if ok {
-		return journal
+		journalGroup.touch(journal)
+		return journal, nil
+	}
+	journal, ok = journalGroup.idle[key]
+	if ok {
+		delete(journalGroup.idle, key)
+		journalGroup.journals[key] = journal
+		journalGroup.touch(journal)
+		return journal, journalGroup.evict()
 	}
 	journal = &FileJournal{
 		group:             journalGroup,
@@ -441,7 +696,8 @@ func (journalGroup *FileJournalGroup) GetFileJournal(key string) *FileJournal {
 		flushListeners:    make(map[uintptr]ik.JournalChunkListener),
 	}
 	journalGroup.journals[key] = journal
-	return journal
+	journalGroup.touch(journal)
+	return journal, journalGroup.evict()
 }
 
 func (journalGroup *FileJournalGroup) GetJournal(key string) ik.Journal {
@@ -452,11 +708,36 @@ func (journalGroup *FileJournalGroup) GetJournalKeys() []string {
 	journalGroup.mtx.Lock()
 	defer journalGroup.mtx.Unlock()
 
-	retval := make([]string, len(journalGroup.journals))
-	i := 0
+	journalGroup.forgetFlushedIdle()
+	retval := make([]string, 0, len(journalGroup.journals)+len(journalGroup.idle))
 	for k := range journalGroup.journals {
-		retval[i] = k
-		i += 1
+		retval = append(retval, k)
+	}
+	for k := range journalGroup.idle {
+		retval = append(retval, k)
+	}
+	return retval
+}
+
+// KeySizes returns the bytes the chunks of each journal take, delivered or
+// not, without reopening the idle journals.
+func (journalGroup *FileJournalGroup) KeySizes() map[string]int64 {
+	journalGroup.mtx.Lock()
+	journals := make([]*FileJournal, 0, len(journalGroup.journals)+len(journalGroup.idle))
+	for _, journal := range journalGroup.journals {
+		journals = append(journals, journal)
+	}
+	for _, journal := range journalGroup.idle {
+		journals = append(journals, journal)
+	}
+	journalGroup.mtx.Unlock()
+	retval := make(map[string]int64, len(journals))
+	for _, journal := range journals {
+		journal.chunks.mtx.Lock()
+		for chunk := journal.chunks.first; chunk != nil; chunk = chunk.head.next {
+			retval[journal.key] += atomic.LoadInt64(&chunk.Size)
+		}
+		journal.chunks.mtx.Unlock()
 	}
 	return retval
 }
@@ -550,38 +831,68 @@ func validateChunks(chunks *FileJournalChunkDequeue) error {
 }
 
 func scanJournals(logger ik.Logger, pathPrefix string, pathSuffix string) (map[string]*FileJournal, error) {
+	journals, unexpected, err := scanChunkFiles(pathPrefix, pathSuffix)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range unexpected {
+		logger.Warning("warning: unexpected file under the designated directory space (%s) - %s", filepath.Dir(file), filepath.Base(file))
+	}
+	for _, journalProto := range journals {
+		err := validateChunks(&journalProto.chunks)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return journals, nil
+}
+
+// scanChunkFiles collects the chunks at the path by key, sorted but not
+// validated, and the paths of the files there whose names it could not
+// make out.
+func scanChunkFiles(pathPrefix string, pathSuffix string) (map[string]*FileJournal, []string, error) {
 	journals := make(map[string]*FileJournal)
-	dirname, basename := path.Split(pathPrefix)
+	unexpected := make([]string, 0)
+	dirname, basename := filepath.Split(pathPrefix)
 	if dirname == "" {
 		dirname = "."
 	}
 	d, err := os.OpenFile(dirname, os.O_RDONLY, 0)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
+	defer d.Close()
 	finfo, err := d.Stat()
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	if !finfo.IsDir() {
-		return nil, errors.New(fmt.Sprintf("%s is not a directory", dirname))
+		return nil, nil, errors.New(fmt.Sprintf("%s is not a directory", dirname))
 	}
 	for {
 		files_, err := d.Readdirnames(100)
 		if err == io.EOF {
 			break
 		} else if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		for _, file := range files_ {
-			if !strings.HasSuffix(file, pathSuffix) {
+			if strings.HasSuffix(file, rollOverSuffix) || strings.HasSuffix(file, lockSuffix) || !strings.HasPrefix(file, basename) || !strings.HasSuffix(file, pathSuffix) || len(file) < len(basename)+len(pathSuffix) {
 				continue
 			}
 			variablePortion := file[len(basename) : len(file)-len(pathSuffix)]
 			info, err := DecodeJournalPath(variablePortion)
 			if err != nil {
-				logger.Warning("warning: unexpected file under the designated directory space (%s) - %s", dirname, file)
+				unexpected = append(unexpected, filepath.Join(dirname, file))
+				continue
+			}
+			chunkPath := pathPrefix + info.VariablePortion + pathSuffix
+			chunkInfo, err := os.Stat(chunkPath)
+			if os.IsNotExist(err) {
+				// delivered since it was listed
 				continue
+			} else if err != nil {
+				return nil, nil, err
 			}
 			journalProto, ok := journals[info.Key]
 			if !ok {
@@ -595,10 +906,11 @@ func scanJournals(logger ik.Logger, pathPrefix string, pathSuffix string) (map[s
 			chunk := &FileJournalChunk{
 				head:      FileJournalChunkDequeueHead{nil, journalProto.chunks.last},
 				Type:      info.Type,
-				Path:      pathPrefix + info.VariablePortion + pathSuffix,
+				Path:      chunkPath,
 				TSuffix:   info.TSuffix,
 				Timestamp: info.Timestamp,
 				UniqueId:  info.UniqueId,
+				Size:      chunkInfo.Size(),
 				refcount:  1,
 			}
 			if journalProto.chunks.last == nil {
@@ -612,12 +924,18 @@ func scanJournals(logger ik.Logger, pathPrefix string, pathSuffix string) (map[s
 	}
 	for _, journalProto := range journals {
 		sortChunksByTimestamp(&journalProto.chunks)
-		err := validateChunks(&journalProto.chunks)
-		if err != nil {
-			return nil, err
-		}
 	}
-	return journals, nil
+	return journals, unexpected, nil
+}
+
+// splitJournalGroupPath splits a buffer path at the asterisk, which stands
+// for the key and the time suffix of each chunk.
+func splitJournalGroupPath(path string, defaultPathSuffix string) (string, string) {
+	pos := strings.Index(path, "*")
+	if pos >= 0 {
+		return path[0:pos], path[pos+1:]
+	}
+	return path + ".", defaultPathSuffix
 }
 
 func (factory *FileJournalGroupFactory) GetJournalGroup(path string, pluginInstance ik.PluginInstance) (*FileJournalGroup, error) {
@@ -634,35 +952,51 @@ func (factory *FileJournalGroupFactory) GetJournalGroup(path string, pluginInsta
 		}
 	}
 
-	var pathPrefix string
-	var pathSuffix string
-
-	pos := strings.Index(path, "*")
-	if pos >= 0 {
-		pathPrefix = path[0:pos]
-		pathSuffix = path[pos+1:]
-	} else {
-		pathPrefix = path + "."
-		pathSuffix = factory.defaultPathSuffix
+	pathPrefix, pathSuffix := splitJournalGroupPath(path, factory.defaultPathSuffix)
+	lock, err := acquireBufferLock(factory.logger, pathPrefix, factory.defaultFileMode, factory.takeOverStaleLock)
+	if err != nil {
+		return nil, err
+	}
+	err = recoverRollOvers(factory.logger, pathPrefix, pathSuffix, factory.defaultFileMode)
+	if err == nil {
+		err = removeCompactionLeftovers(pathPrefix)
+	}
+	if err != nil {
+		lock.release()
+		return nil, err
 	}
-
 	journals, err := scanJournals(factory.logger, pathPrefix, pathSuffix)
 	if err != nil {
+		lock.release()
 		return nil, err
 	}
 
 	journalGroup := &FileJournalGroup{
-		factory:        factory,
-		pluginInstance: pluginInstance,
-		timeGetter:     factory.timeGetter,
-		logger:         factory.logger,
-		rand:           rand.New(factory.randSource),
-		fileMode:       factory.defaultFileMode,
-		maxSize:        factory.maxSize,
-		pathPrefix:     pathPrefix,
-		pathSuffix:     pathSuffix,
-		journals:       journals,
-		mtx:            sync.Mutex{},
+		factory:           factory,
+		pluginInstance:    pluginInstance,
+		clock:             factory.clock,
+		logger:            factory.logger,
+		rand:              rand.New(factory.randSource),
+		fileMode:          factory.defaultFileMode,
+		maxSize:           factory.maxSize,
+		pathPrefix:        pathPrefix,
+		pathSuffix:        pathSuffix,
+		journals:          journals,
+		idle:              make(map[string]*FileJournal),
+		lru:               list.New(),
+		maxJournals:       factory.maxJournals,
+		lock:              lock,
+		watchdog:          factory.watchdog,
+		dropNewest:        factory.dropNewest,
+		encryption:        factory.encryption,
+		hooks:             factory.hooks,
+		indexInterval:     factory.indexInterval,
+		timeSlice:         factory.timeSlice,
+		timeSliceLocation: factory.timeSliceLocation,
+		maxAge:            factory.maxAge,
+		maxTotalBytes:     factory.maxTotalBytes,
+		compactThreshold:  factory.compactThreshold,
+		mtx:               sync.Mutex{},
 	}
 	for _, journal := range journals {
 		journal.group = journalGroup
@@ -680,19 +1014,59 @@ func (factory *FileJournalGroupFactory) GetJournalGroup(path string, pluginInsta
 			journalGroup.Dispose()
 			return nil, err
 		}
+		keyId, err := chunkKeyIdOf(chunk.Path)
+		if err != nil {
+			file.Close()
+			journalGroup.Dispose()
+			return nil, err
+		}
+		if keyId != "" {
+			// drop the frame a crash left incomplete, lest the
+			// writes appended to the chunk be read as part of it
+			length, err := completeFramesLength(chunk.Path, keyId)
+			if err == nil && length < position {
+				factory.logger.Warning("%s: discarding an incomplete frame of %d bytes", chunk.Path, position-length)
+				err = file.Truncate(length)
+				position = length
+			}
+			if err != nil {
+				file.Close()
+				journalGroup.Dispose()
+				return nil, err
+			}
+		}
 		chunk.refcount += 1 // for writer
+		chunk.Size = position
 		journal.writer = file
 		journal.position = position
+		journal.writerKeyId = keyId
+		journalGroup.touch(journal)
 	}
+	journalGroup.closeEvicted(journalGroup.evict())
 	factory.logger.Info("Path %s is designated to PluginInstance %s", path, pluginInstance.Factory().Name())
 	factory.paths[path] = journalGroup
+	if factory.scorekeeper != nil {
+		bindJournalGroupTopics(factory.scorekeeper, journalGroup)
+	}
 	return journalGroup, nil
 }
 
+// BindScorekeeper makes the journal groups created afterwards register
+// their statistics as topics of the plugin that owns them.
+func (factory *FileJournalGroupFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+	factory.scorekeeper = scorekeeper
+}
+
+// SetEncryption makes the journal groups created afterwards encrypt the
+// chunks they write.
+func (factory *FileJournalGroupFactory) SetEncryption(encryption *ChunkEncryption) {
+	factory.encryption = encryption
+}
+
 func NewFileJournalGroupFactory(
 	logger ik.Logger,
 	randSource rand.Source,
-	timeGetter func() time.Time,
+	clock ik.Clock,
 	defaultPathSuffix string,
 	defaultFileMode os.FileMode,
 	maxSize int64,
@@ -701,9 +1075,10 @@ func NewFileJournalGroupFactory(
 		logger:            logger,
 		paths:             make(map[string]*FileJournalGroup),
 		randSource:        randSource,
-		timeGetter:        timeGetter,
+		clock:             clock,
 		defaultPathSuffix: defaultPathSuffix,
 		defaultFileMode:   defaultFileMode,
 		maxSize:           maxSize,
+		indexInterval:     DefaultIndexInterval,
 	}
 }
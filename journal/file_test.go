@@ -7,6 +7,7 @@ import (
 	"log"
 	"math/rand"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -22,8 +23,70 @@ func (*DummyPluginInstance) Run() error         { return nil }
 func (*DummyPluginInstance) Shutdown() error    { return nil }
 func (*DummyPluginInstance) Factory() ik.Plugin { return &DummyPlugin{} }
 
+// testLogger is the ik.Logger the journal groups of the tests log to
+// stderr with.
+type testLogger struct{ *log.Logger }
+
+func newTestLogger() ik.Logger {
+	return testLogger{log.New(os.Stderr, "[journal] ", 0)}
+}
+
+func (logger testLogger) Critical(format string, args ...interface{}) {
+	logger.Printf(format, args...)
+}
+
+func (logger testLogger) Error(format string, args ...interface{}) {
+	logger.Printf(format, args...)
+}
+
+func (logger testLogger) Warning(format string, args ...interface{}) {
+	logger.Printf(format, args...)
+}
+
+func (logger testLogger) Notice(format string, args ...interface{}) {
+	logger.Printf(format, args...)
+}
+
+func (logger testLogger) Info(format string, args ...interface{}) {
+	logger.Printf(format, args...)
+}
+
+func (logger testLogger) Debug(format string, args ...interface{}) {
+	logger.Printf(format, args...)
+}
+
+// testClock tells the time the tests give it by now.
+type testClock struct {
+	ik.Clock
+	now func() time.Time
+}
+
+func newTestClock(now func() time.Time) ik.Clock {
+	return testClock{ik.SystemClock, now}
+}
+
+func (clock testClock) Now() time.Time {
+	return clock.now()
+}
+
+// readChunkDir lists the files in dir but the lock of a journal group still
+// open there.
+func readChunkDir(dir string) ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]os.FileInfo, 0, len(files))
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), lockSuffix) {
+			retval = append(retval, file)
+		}
+	}
+	return retval, nil
+}
+
 func Test_GetJournalGroup(t *testing.T) {
-	logger := log.New(os.Stderr, "[journal] ", 0)
+	logger := newTestLogger()
 	tempDir, err := ioutil.TempDir("", "ik.journal")
 	if err != nil {
 		t.FailNow()
@@ -31,7 +94,7 @@ func Test_GetJournalGroup(t *testing.T) {
 	factory := NewFileJournalGroupFactory(
 		logger,
 		rand.NewSource(0),
-		func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) },
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
 		".log",
 		os.FileMode(0644),
 		0,
@@ -61,7 +124,7 @@ func Test_GetJournalGroup(t *testing.T) {
 }
 
 func Test_Journal_GetJournal(t *testing.T) {
-	logger := log.New(os.Stderr, "[journal] ", 0)
+	logger := newTestLogger()
 	tempDir, err := ioutil.TempDir("", "ik.journal")
 	if err != nil {
 		t.FailNow()
@@ -69,7 +132,7 @@ func Test_Journal_GetJournal(t *testing.T) {
 	factory := NewFileJournalGroupFactory(
 		logger,
 		rand.NewSource(0),
-		func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) },
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
 		".log",
 		os.FileMode(0644),
 		0,
@@ -94,7 +157,7 @@ func Test_Journal_GetJournal(t *testing.T) {
 }
 
 func Test_Journal_EmitVeryFirst(t *testing.T) {
-	logger := log.New(os.Stderr, "[journal] ", 0)
+	logger := newTestLogger()
 	tempDir, err := ioutil.TempDir("", "ik.journal")
 	if err != nil {
 		t.FailNow()
@@ -102,7 +165,7 @@ func Test_Journal_EmitVeryFirst(t *testing.T) {
 	factory := NewFileJournalGroupFactory(
 		logger,
 		rand.NewSource(0),
-		func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) },
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
 		".log",
 		os.FileMode(0644),
 		10,
@@ -127,7 +190,7 @@ func Test_Journal_EmitVeryFirst(t *testing.T) {
 }
 
 func Test_Journal_EmitTwice(t *testing.T) {
-	logger := log.New(os.Stderr, "[journal] ", 0)
+	logger := newTestLogger()
 	tempDir, err := ioutil.TempDir("", "ik.journal")
 	if err != nil {
 		t.FailNow()
@@ -135,7 +198,7 @@ func Test_Journal_EmitTwice(t *testing.T) {
 	factory := NewFileJournalGroupFactory(
 		logger,
 		rand.NewSource(0),
-		func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) },
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
 		".log",
 		os.FileMode(0644),
 		10,
@@ -164,7 +227,7 @@ func Test_Journal_EmitTwice(t *testing.T) {
 }
 
 func Test_Journal_EmitRotating(t *testing.T) {
-	logger := log.New(os.Stderr, "[journal] ", 0)
+	logger := newTestLogger()
 	tempDir, err := ioutil.TempDir("", "ik.journal")
 	if err != nil {
 		t.FailNow()
@@ -172,7 +235,7 @@ func Test_Journal_EmitRotating(t *testing.T) {
 	factory := NewFileJournalGroupFactory(
 		logger,
 		rand.NewSource(0),
-		func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) },
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
 		".log",
 		os.FileMode(0644),
 		8,
@@ -222,7 +285,7 @@ func shuffle(x []string) {
 }
 
 func Test_Journal_Scanning_Ok(t *testing.T) {
-	logger := log.New(os.Stderr, "[journal] ", 0)
+	logger := newTestLogger()
 	tm := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
 
 	for i := 1; i < 100; i++ {
@@ -263,7 +326,7 @@ func Test_Journal_Scanning_Ok(t *testing.T) {
 		factory := NewFileJournalGroupFactory(
 			logger,
 			rand.NewSource(0),
-			func() time.Time { return tm },
+			newTestClock(func() time.Time { return tm }),
 			suffix,
 			os.FileMode(0644),
 			8,
@@ -293,7 +356,7 @@ func Test_Journal_Scanning_Ok(t *testing.T) {
 }
 
 func Test_Journal_Scanning_MultipleHead(t *testing.T) {
-	logger := log.New(os.Stderr, "[journal] ", 0)
+	logger := newTestLogger()
 	tempDir, err := ioutil.TempDir("", "ik.journal")
 	if err != nil {
 		t.FailNow()
@@ -349,7 +412,7 @@ func Test_Journal_Scanning_MultipleHead(t *testing.T) {
 	factory := NewFileJournalGroupFactory(
 		logger,
 		rand.NewSource(0),
-		func() time.Time { return tm },
+		newTestClock(func() time.Time { return tm }),
 		suffix,
 		os.FileMode(0644),
 		8,
@@ -366,7 +429,7 @@ func Test_Journal_Scanning_MultipleHead(t *testing.T) {
 }
 
 func Test_Journal_FlushListener(t *testing.T) {
-	logger := log.New(os.Stderr, "[journal] ", 0)
+	logger := newTestLogger()
 	tempDir, err := ioutil.TempDir("", "ik.journal")
 	if err != nil {
 		t.FailNow()
@@ -374,7 +437,7 @@ func Test_Journal_FlushListener(t *testing.T) {
 	factory := NewFileJournalGroupFactory(
 		logger,
 		rand.NewSource(0),
-		func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) },
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
 		".log",
 		os.FileMode(0644),
 		8,
@@ -463,3 +526,198 @@ func Test_Journal_FlushListener(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_Journal_DisposeAfterFlush(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	dummyPluginInstance := &DummyPluginInstance{}
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", dummyPluginInstance)
+	if err != nil {
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	for _, data := range []string{"test1", "test2", "test3"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	visited := 0
+	err = journal.Flush(func(chunk ik.JournalChunk) error {
+		defer chunk.Dispose()
+		visited += 1
+		chunk.TakeOwnership()
+		return nil
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if visited != 3 {
+		t.Fail()
+	}
+	err = journal.Dispose()
+	if err != nil {
+		t.FailNow()
+	}
+	files, err := readChunkDir(tempDir)
+	if err != nil {
+		t.FailNow()
+	}
+	if len(files) != 0 {
+		t.Logf("%d files left", len(files))
+		t.Fail()
+	}
+	err = journal.Write([]byte("test4"))
+	if err != nil {
+		t.FailNow()
+	}
+	if journal.chunks.count != 1 {
+		t.Fail()
+	}
+	if journal.chunks.first.Type != JournalFileType('b') {
+		t.Fail()
+	}
+}
+
+func Test_JournalGroup_Stats(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	dummyPluginInstance := &DummyPluginInstance{}
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", dummyPluginInstance)
+	if err != nil {
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	defer journal.Dispose()
+	for _, data := range []string{"test1", "test2", "test3"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	stats := journalGroup.Stats()
+	if stats.Journals != 1 {
+		t.Fail()
+	}
+	if stats.Chunks != 3 {
+		t.Logf("%d chunks", stats.Chunks)
+		t.Fail()
+	}
+	if stats.BufferedBytes != 15 {
+		t.Logf("%d bytes", stats.BufferedBytes)
+		t.Fail()
+	}
+	if !stats.OldestChunkTime.Equal(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Log(stats.OldestChunkTime)
+		t.Fail()
+	}
+	if stats.WriteErrors != 0 {
+		t.Fail()
+	}
+}
+
+type topicPluginInstance struct{ plugin ik.Plugin }
+
+func (*topicPluginInstance) Run() error                  { return nil }
+func (*topicPluginInstance) Shutdown() error             { return nil }
+func (instance *topicPluginInstance) Factory() ik.Plugin { return instance.plugin }
+
+func Test_JournalGroup_TopicsUnboundOnDispose(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		".log",
+		os.FileMode(0644),
+		0,
+	)
+	scorekeeper := ik.NewScorekeeper(logger)
+	factory.BindScorekeeper(scorekeeper)
+	pluginInstance := &topicPluginInstance{&DummyPlugin{}}
+	journalGroup1, err := factory.GetJournalGroup(tempDir+"/test1", pluginInstance)
+	if err != nil {
+		t.FailNow()
+	}
+	journalGroup2, err := factory.GetJournalGroup(tempDir+"/test2", pluginInstance)
+	if err != nil {
+		t.FailNow()
+	}
+	fetcher, err := scorekeeper.Fetch(pluginInstance.plugin, "chunks")
+	if err != nil {
+		t.FailNow()
+	}
+	text, err := fetcher.PlainText(pluginInstance)
+	if err != nil || text != "0, 0" {
+		t.Logf("%q", text)
+		t.Fail()
+	}
+	journalGroup1.Dispose()
+	text, err = fetcher.PlainText(pluginInstance)
+	if err != nil || text != "0" {
+		t.Logf("%q", text)
+		t.Fail()
+	}
+	journalGroup2.Dispose()
+	_, err = fetcher.PlainText(pluginInstance)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func Test_FileJournal_UniqueId(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	journalGroup := newIndexingJournalGroup(t, tempDir+"/test")
+	journal := journalGroup.GetFileJournal("key")
+	err = journal.Write([]byte("test"))
+	if err != nil {
+		t.FailNow()
+	}
+	chunk := journal.GetTailChunk()
+	uniqueId := chunk.UniqueId()
+	chunk.Dispose()
+	journalGroup.Dispose()
+	if len(uniqueId) != 32 {
+		t.Fatalf("%s", uniqueId)
+	}
+
+	// the chunk keeps its id across restarts
+	journalGroup = newIndexingJournalGroup(t, tempDir+"/test")
+	chunk = journalGroup.GetFileJournal("key").GetTailChunk()
+	defer chunk.Dispose()
+	if chunk.UniqueId() != uniqueId {
+		t.Fatalf("%s != %s", chunk.UniqueId(), uniqueId)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+// +build !windows
+
+package journal
+
+import (
+	"os"
+)
+
+func renameChunkFile(oldPath string, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+func removeChunkFile(path string) error {
+	return os.Remove(path)
+}
+
+func chunkFileMode(mode os.FileMode) os.FileMode {
+	return mode
+}
+
+// syncDir makes the entries created in or removed from the directory
+// durable.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
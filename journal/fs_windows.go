@@ -0,0 +1,62 @@
+//go:build windows
+// +build windows
+
+package journal
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	errorSharingViolation = syscall.Errno(32)
+	errorLockViolation    = syscall.Errno(33)
+)
+
+// A file cannot be renamed or removed on Windows while another handle to
+// it, e.g. of a reader of the chunk, is open, which usually is closed soon.
+const chunkFileRetries = 10
+
+func isSharingViolation(err error) bool {
+	switch err_ := err.(type) {
+	case *os.LinkError:
+		err = err_.Err
+	case *os.PathError:
+		err = err_.Err
+	}
+	errno, ok := err.(syscall.Errno)
+	return ok && (errno == errorSharingViolation || errno == errorLockViolation || errno == syscall.ERROR_ACCESS_DENIED)
+}
+
+func retryOnSharingViolation(op func() error) error {
+	wait := 10 * time.Millisecond
+	for i := 0; ; i += 1 {
+		err := op()
+		if err == nil || i >= chunkFileRetries || !isSharingViolation(err) {
+			return err
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+func renameChunkFile(oldPath string, newPath string) error {
+	return retryOnSharingViolation(func() error { return os.Rename(oldPath, newPath) })
+}
+
+func removeChunkFile(path string) error {
+	return retryOnSharingViolation(func() error { return os.Remove(path) })
+}
+
+// chunkFileMode keeps the owner's write permission, which is all Windows
+// honours of the mode, so that the chunk can be removed once delivered.
+func chunkFileMode(mode os.FileMode) os.FileMode {
+	return mode | 0200
+}
+
+// syncDir does nothing, as a directory cannot be opened to sync on Windows,
+// where NTFS journals the changes to the entries anyway.
+func syncDir(path string) error {
+	return nil
+}
@@ -0,0 +1,70 @@
+package journal
+
+import (
+	"encoding/hex"
+	"sync/atomic"
+	"time"
+)
+
+// ChunkEvent describes the chunk a hook is called for.  The timestamp is
+// that of the creation of the chunk.
+type ChunkEvent struct {
+	Path      string
+	Key       string
+	Timestamp time.Time
+	UniqueId  string
+	Size      int64
+}
+
+// ChunkHooks are called as the chunks of the journal groups go through
+// their life, e.g. to archive every chunk independently of the output.
+// OnRest is called once a chunk has been finalized into a rest chunk,
+// before it is handed to the flush listeners, so the file is there to be
+// copied until OnRest returns; the journal is not written to meanwhile.
+// OnPurge is called after the file of a chunk has been removed.  OnExpire
+// is called for a chunk given up undelivered by the retention policy,
+// before it is removed, so it can be archived.  Any of them may be nil.
+type ChunkHooks struct {
+	OnRest   func(event ChunkEvent)
+	OnPurge  func(event ChunkEvent)
+	OnExpire func(event ChunkEvent)
+}
+
+func (journal *FileJournal) chunkEvent(chunk *FileJournalChunk) ChunkEvent {
+	return ChunkEvent{
+		Path:      chunk.Path,
+		Key:       journal.key,
+		Timestamp: time.Unix(0, chunk.Timestamp*int64(time.Microsecond)),
+		UniqueId:  hex.EncodeToString(chunk.UniqueId),
+		Size:      atomic.LoadInt64(&chunk.Size),
+	}
+}
+
+func (journal *FileJournal) callRestHook(chunk *FileJournalChunk) {
+	hooks := journal.group.hooks
+	if hooks == nil || hooks.OnRest == nil {
+		return
+	}
+	hooks.OnRest(journal.chunkEvent(chunk))
+}
+
+func (journal *FileJournal) callPurgeHook(chunk *FileJournalChunk) {
+	hooks := journal.group.hooks
+	if hooks == nil || hooks.OnPurge == nil {
+		return
+	}
+	hooks.OnPurge(journal.chunkEvent(chunk))
+}
+
+func (journal *FileJournal) callExpireHook(chunk *FileJournalChunk) {
+	hooks := journal.group.hooks
+	if hooks == nil || hooks.OnExpire == nil {
+		return
+	}
+	hooks.OnExpire(journal.chunkEvent(chunk))
+}
+
+// SetChunkHooks makes the journal groups created afterwards call the hooks.
+func (factory *FileJournalGroupFactory) SetChunkHooks(hooks *ChunkHooks) {
+	factory.hooks = hooks
+}
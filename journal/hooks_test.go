@@ -0,0 +1,74 @@
+package journal
+
+import (
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_Journal_ChunkHooks(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	rested := make([]ChunkEvent, 0)
+	purged := make([]ChunkEvent, 0)
+	factory.SetChunkHooks(&ChunkHooks{
+		OnRest: func(event ChunkEvent) {
+			// the file is still there to be archived
+			data, err := ioutil.ReadFile(event.Path)
+			if err != nil || string(data) != "test1" {
+				t.Errorf("%q: %v", data, err)
+			}
+			rested = append(rested, event)
+		},
+		OnPurge: func(event ChunkEvent) {
+			if _, err := os.Stat(event.Path); !os.IsNotExist(err) {
+				t.Errorf("%s is still there", event.Path)
+			}
+			purged = append(purged, event)
+		},
+	})
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	for _, data := range []string{"test1", "test2"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	if len(rested) != 1 || len(purged) != 0 {
+		t.Fatalf("%v %v", rested, purged)
+	}
+	event := rested[0]
+	if event.Key != "key" || event.Size != 5 || event.UniqueId == "" || !event.Timestamp.Equal(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("%v", event)
+	}
+	err = journal.Flush(func(chunk ik.JournalChunk) error {
+		defer chunk.Dispose()
+		chunk.TakeOwnership()
+		return nil
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	if len(purged) != 2 || purged[0].Path != event.Path {
+		t.Fatalf("%v", purged)
+	}
+}
@@ -0,0 +1,69 @@
+package journal
+
+import (
+	"errors"
+	"io"
+)
+
+// DefaultIndexInterval is how many records apart the offsets the chunks
+// are indexed at are by default.
+const DefaultIndexInterval = 64
+
+// SetIndexInterval makes the journal groups created afterwards index the
+// chunks they write every interval records, so that a chunk can be read
+// from a record on.  The chunks left by a previous run are not indexed.
+// interval <= 0 means no index.
+func (factory *FileJournalGroupFactory) SetIndexInterval(interval int) {
+	factory.indexInterval = interval
+}
+
+// indexRecord counts the record just written at offset in the chunk, and
+// indexes it if it is due.
+func (journal *FileJournal) indexRecord(chunk *FileJournalChunk, offset int64) {
+	interval := int64(journal.group.indexInterval)
+	journal.chunks.mtx.Lock()
+	defer journal.chunks.mtx.Unlock()
+	if chunk.indexed && interval > 0 && chunk.records > 0 && chunk.records%interval == 0 {
+		chunk.index = append(chunk.index, offset)
+	}
+	chunk.records += 1
+}
+
+// seek returns the byte offset of the latest record indexed at or before
+// recordOffset, along with the offset of that record.
+func (journal *FileJournal) seek(chunk *FileJournalChunk, recordOffset int64) (int64, int64) {
+	interval := int64(journal.group.indexInterval)
+	journal.chunks.mtx.Lock()
+	defer journal.chunks.mtx.Unlock()
+	if !chunk.indexed || interval <= 0 || recordOffset < interval || len(chunk.index) == 0 {
+		return 0, 0
+	}
+	i := recordOffset/interval - 1
+	if i >= int64(len(chunk.index)) {
+		i = int64(len(chunk.index)) - 1
+	}
+	return chunk.index[i], (i + 1) * interval
+}
+
+// GetReaderAt returns a reader starting at the latest record indexed at or
+// before recordOffset, and the offset of that record, which is 0 for a
+// chunk that has no index.
+func (wrapper *FileJournalChunkWrapper) GetReaderAt(recordOffset int64) (io.Reader, int64, error) {
+	chunk := wrapper.loadChunk()
+	if chunk == nil {
+		return nil, 0, errors.New("already disposed")
+	}
+	if recordOffset < 0 {
+		return nil, 0, errors.New("negative record offset")
+	}
+	journal := wrapper.journal
+	offset, recordOffset_ := journal.seek(chunk, recordOffset)
+	journal.chunks.mtx.Lock()
+	writing := journal.chunks.first == chunk
+	journal.chunks.mtx.Unlock()
+	reader, err := openChunkAt(chunk.Path, journal.group.encryption, journal.group.maxSize, writing, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	return reader, recordOffset_, nil
+}
@@ -0,0 +1,116 @@
+package journal
+
+import (
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func readAt(t *testing.T, chunk ik.JournalChunk, recordOffset int64) (string, int64) {
+	reader, recordOffset_, err := ik.GetChunkReaderAt(chunk, recordOffset)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if closer, ok := reader.(interface{ Close() error }); ok {
+		closer.Close()
+	}
+	return string(data), recordOffset_
+}
+
+func newIndexingJournalGroup(t *testing.T, path string) *FileJournalGroup {
+	logger := newTestLogger()
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		".log",
+		os.FileMode(0644),
+		1024,
+	)
+	factory.SetIndexInterval(4)
+	journalGroup, err := factory.GetJournalGroup(path, &DummyPluginInstance{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return journalGroup
+}
+
+func Test_FileJournal_GetReaderAt(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	journalGroup := newIndexingJournalGroup(t, tempDir+"/test")
+	journal := journalGroup.GetFileJournal("key")
+	for i := 0; i < 10; i += 1 {
+		err = journal.Write([]byte(fmt.Sprintf("%d", i)))
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	chunk := journal.GetTailChunk()
+	for _, c := range []struct {
+		recordOffset int64
+		data         string
+		at           int64
+	}{
+		{0, "0123456789", 0},
+		{3, "0123456789", 0},
+		{4, "456789", 4},
+		{9, "89", 8},
+		{100, "89", 8},
+	} {
+		data, at := readAt(t, chunk, c.recordOffset)
+		if data != c.data || at != c.at {
+			t.Errorf("%d: %s at %d", c.recordOffset, data, at)
+		}
+	}
+	chunk.Dispose()
+	journalGroup.Dispose()
+
+	// the chunk left by the previous run is read from the start
+	journalGroup = newIndexingJournalGroup(t, tempDir+"/test")
+	journal = journalGroup.GetFileJournal("key")
+	chunk_ := journal.GetTailChunk()
+	defer chunk_.Dispose()
+	data, at := readAt(t, chunk_, 9)
+	if data != "0123456789" || at != 0 {
+		t.Errorf("%s at %d", data, at)
+	}
+}
+
+func Test_FileJournal_GetReaderAt_Encrypted(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	journalGroup := newEncryptingJournalGroup(t, 0, tempDir+"/test", "a:MDEyMzQ1Njc4OWFiY2RlZg==")
+	journalGroup.indexInterval = 2
+	journal := journalGroup.GetFileJournal("key")
+	for _, data := range []string{"test0", "test1", "test2", "test3", "test4"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	chunk := journal.GetTailChunk()
+	defer chunk.Dispose()
+	data, at := readAt(t, chunk, 3)
+	if data != "test2test3test4" || at != 2 {
+		t.Errorf("%s at %d", data, at)
+	}
+	data, at = readAt(t, chunk, 1)
+	if data != "test0test1test2test3test4" || at != 0 {
+		t.Errorf("%s at %d", data, at)
+	}
+}
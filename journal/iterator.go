@@ -0,0 +1,96 @@
+package journal
+
+import (
+	"github.com/moriyoshi/ik"
+	"sync/atomic"
+)
+
+// fileJournalChunkIterator holds a reference to each chunk of the snapshot
+// not moved past yet, and one to the current chunk through its wrapper.
+type fileJournalChunkIterator struct {
+	journal *FileJournal
+	chunks  []*FileJournalChunk
+	current *FileJournalChunkWrapper
+}
+
+// tryRef takes a reference to the chunk unless it has none left, in which
+// case it is being purged and must not be brought back.
+func tryRef(chunk *FileJournalChunk) bool {
+	for {
+		refcount := atomic.LoadInt32(&chunk.refcount)
+		if refcount <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&chunk.refcount, refcount, refcount+1) {
+			return true
+		}
+	}
+}
+
+func (journal *FileJournal) snapshot() *fileJournalChunkIterator {
+	iterator := &fileJournalChunkIterator{
+		journal: journal,
+		chunks:  make([]*FileJournalChunk, 0),
+	}
+	journal.chunks.mtx.Lock()
+	defer journal.chunks.mtx.Unlock()
+	for chunk := journal.chunks.last; chunk != nil; chunk = chunk.head.prev {
+		if tryRef(chunk) {
+			iterator.chunks = append(iterator.chunks, chunk)
+		}
+	}
+	return iterator
+}
+
+// Chunks returns an iterator over the chunks from the oldest on, the one
+// being written included.
+func (journal *FileJournal) Chunks() ik.JournalChunkIterator {
+	return journal.snapshot()
+}
+
+func (iterator *fileJournalChunkIterator) release() error {
+	if iterator.current == nil {
+		return nil
+	}
+	err := iterator.current.Dispose()
+	iterator.current = nil
+	return err
+}
+
+func (iterator *fileJournalChunkIterator) Next() bool {
+	iterator.release()
+	if len(iterator.chunks) == 0 {
+		return false
+	}
+	// the reference taken by the snapshot passes on to the wrapper
+	iterator.current = &FileJournalChunkWrapper{iterator.journal, iterator.chunks[0], 0}
+	iterator.chunks = iterator.chunks[1:]
+	return true
+}
+
+func (iterator *fileJournalChunkIterator) Value() ik.JournalChunk {
+	if iterator.current == nil {
+		return nil
+	}
+	return iterator.current
+}
+
+// take hands the current chunk over to the caller, who is to dispose of it
+// as one given by GetTailChunk.
+func (iterator *fileJournalChunkIterator) take() *FileJournalChunkWrapper {
+	retval := iterator.current
+	iterator.current = nil
+	return retval
+}
+
+func (iterator *fileJournalChunkIterator) Close() error {
+	err := iterator.release()
+	for _, chunk := range iterator.chunks {
+		err_, _ := iterator.journal.deleteRef(chunk)
+		if err_ != nil && err == nil {
+			err = err_
+		}
+	}
+	iterator.chunks = nil
+	return err
+}
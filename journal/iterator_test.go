@@ -0,0 +1,122 @@
+package journal
+
+import (
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_Journal_Chunks(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	for _, data := range []string{"test1", "test2", "test3"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	chunks := journal.Chunks()
+	// a flush taking every chunk purges none of those the iterator holds
+	err = journal.Flush(func(chunk ik.JournalChunk) error {
+		defer chunk.Dispose()
+		chunk.TakeOwnership()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	contents := make([]string, 0)
+	for chunks.Next() {
+		reader, err := chunks.Value().GetReader()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		data, err := ioutil.ReadAll(reader)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		contents = append(contents, string(data))
+	}
+	if chunks.Value() != nil || len(contents) != 3 || contents[0] != "test1" || contents[2] != "test3" {
+		t.Fatalf("%v", contents)
+	}
+	if chunks.Close() != nil || chunks.Close() != nil {
+		t.Fail()
+	}
+	// only the chunk being written is left once the iterator has let go
+	files, err := readChunkDir(tempDir)
+	if err != nil {
+		t.FailNow()
+	}
+	if len(files) != 1 || journal.chunks.count != 1 {
+		t.Fatalf("%d files, %d chunks", len(files), journal.chunks.count)
+	}
+}
+
+func Test_Journal_Chunks_Close(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	for _, data := range []string{"test1", "test2", "test3"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	// the ownership of the oldest chunk is taken through the iterator, and
+	// the others are left unvisited
+	chunks := journal.Chunks()
+	if !chunks.Next() || !chunks.Value().TakeOwnership() {
+		t.FailNow()
+	}
+	if chunks.Close() != nil {
+		t.Fail()
+	}
+	if journal.chunks.count != 2 {
+		t.Fatalf("%d chunks", journal.chunks.count)
+	}
+	reader, err := journal.GetTailChunk().GetReader()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := ioutil.ReadAll(reader)
+	if string(data) != "test2" {
+		t.Fatalf("%s", data)
+	}
+}
@@ -0,0 +1,128 @@
+package journal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The chunks at a path are owned by the process holding the lock on a file
+// next to them, which names the process, so that two processes, or one
+// lingering after a crash, do not both append to the same head chunk.  The
+// file is removed as the lock is released; a process that has locked the
+// file only to find it removed or replaced meanwhile tries again.  The
+// journal groups of the process opened at the same path share the lock.
+const lockSuffix = ".lock"
+
+var heldLocks = struct {
+	locks map[string]*bufferLock
+	mtx   sync.Mutex
+}{
+	locks: make(map[string]*bufferLock),
+}
+
+var errBufferLocked = errors.New("locked")
+
+func lockPath(pathPrefix string) string {
+	return pathPrefix + "owner" + lockSuffix
+}
+
+type bufferLock struct {
+	file     *os.File
+	path     string
+	refcount int
+}
+
+// readLockOwner returns the process id recorded in the lock file, or 0 if
+// it cannot be told.
+func readLockOwner(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+// acquireBufferLock locks the chunks at the path for the process.  If
+// takeOver is true and the process recorded as the owner is gone, the lock
+// is taken over from whichever process, e.g. a child of the owner, is
+// holding it still.
+func acquireBufferLock(logger ik.Logger, pathPrefix string, fileMode os.FileMode, takeOver bool) (*bufferLock, error) {
+	path, err := filepath.Abs(lockPath(pathPrefix))
+	if err != nil {
+		return nil, err
+	}
+	heldLocks.mtx.Lock()
+	defer heldLocks.mtx.Unlock()
+	lock, ok := heldLocks.locks[path]
+	if ok {
+		lock.refcount += 1
+		return lock, nil
+	}
+	file, err := openLockFile(path, fileMode)
+	if err == errBufferLocked {
+		owner := readLockOwner(path)
+		if !takeOver || owner <= 0 || processAlive(owner) {
+			if owner > 0 {
+				return nil, errors.New(fmt.Sprintf("the buffer at %s is locked by process %d; is another instance using the same buffer_path?", pathPrefix, owner))
+			}
+			return nil, errors.New(fmt.Sprintf("the buffer at %s is locked by another process; is another instance using the same buffer_path?", pathPrefix))
+		}
+		logger.Warning("taking over the buffer at %s from process %d, which is gone", pathPrefix, owner)
+		err = os.Remove(path)
+		if err != nil {
+			return nil, err
+		}
+		file, err = openLockFile(path, fileMode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = file.Truncate(0)
+	if err == nil {
+		_, err = file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	lock = &bufferLock{file: file, path: path, refcount: 1}
+	heldLocks.locks[path] = lock
+	return lock, nil
+}
+
+// SetTakeOverStaleLock makes the journal groups created afterwards take
+// over the lock on their chunks if the process recorded as holding it is
+// gone.
+func (factory *FileJournalGroupFactory) SetTakeOverStaleLock(takeOver bool) {
+	factory.takeOverStaleLock = takeOver
+}
+
+func (lock *bufferLock) release() error {
+	heldLocks.mtx.Lock()
+	defer heldLocks.mtx.Unlock()
+	lock.refcount -= 1
+	if lock.refcount > 0 {
+		return nil
+	}
+	delete(heldLocks.locks, lock.path)
+	// removed while still locked, lest another process lock the file
+	// just before it goes
+	err := removeLockFile(lock.path)
+	err_ := lock.file.Close()
+	lock.file = nil
+	if err == nil || os.IsNotExist(err) {
+		err = err_
+	}
+	return err
+}
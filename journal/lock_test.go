@@ -0,0 +1,84 @@
+package journal
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_GetJournalGroup_Locked(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	newFactory := func() *FileJournalGroupFactory {
+		return NewFileJournalGroupFactory(
+			logger,
+			rand.NewSource(0),
+			newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+			".log",
+			os.FileMode(0644),
+			8,
+		)
+	}
+	// the groups of the process share the lock
+	journalGroup, err := newFactory().GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	journalGroup_, err := newFactory().GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	journalGroup_.Dispose()
+	journalGroup.Dispose()
+	if _, err := os.Stat(lockPath(tempDir + "/test.")); !os.IsNotExist(err) {
+		t.Fatal("the lock is left behind")
+	}
+
+	// as if another process held it
+	path := lockPath(tempDir + "/test.")
+	file, err := openLockFile(path, os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+	_, err = newFactory().GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err == nil {
+		t.Fatal("the buffer was opened while locked")
+	}
+	if runtime.GOOS == "windows" {
+		// the owner cannot be read while the file is locked
+		return
+	}
+	err = ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		t.FailNow()
+	}
+	factory := newFactory()
+	factory.SetTakeOverStaleLock(true)
+	_, err = factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err == nil || !strings.Contains(err.Error(), "process "+strconv.Itoa(os.Getpid())) {
+		t.Fatalf("%v", err)
+	}
+	// the owner is gone, but the lock is still held, e.g. by its child
+	err = ioutil.WriteFile(path, []byte("1073741824\n"), 0644)
+	if err != nil {
+		t.FailNow()
+	}
+	journalGroup, err = factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer journalGroup.Dispose()
+	if readLockOwner(path) != os.Getpid() {
+		t.Fail()
+	}
+}
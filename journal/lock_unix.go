@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package journal
+
+import (
+	"os"
+	"syscall"
+)
+
+func openLockFile(path string, fileMode os.FileMode) (*os.File, error) {
+	for {
+		file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, fileMode)
+		if err != nil {
+			return nil, err
+		}
+		err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err != nil {
+			file.Close()
+			if err == syscall.EWOULDBLOCK {
+				return nil, errBufferLocked
+			}
+			return nil, err
+		}
+		locked, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err == nil && os.SameFile(locked, current) {
+			return file, nil
+		}
+		file.Close()
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+}
+
+func removeLockFile(path string) error {
+	return os.Remove(path)
+}
+
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
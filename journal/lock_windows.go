@@ -0,0 +1,50 @@
+//go:build windows
+// +build windows
+
+package journal
+
+import (
+	"os"
+	"syscall"
+)
+
+const fileFlagDeleteOnClose = 0x04000000
+
+// A file opened with no sharing allowed stays locked until it is closed,
+// when it is removed as well.
+func openLockFile(path string, fileMode os.FileMode) (*os.File, error) {
+	path_, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := syscall.CreateFile(
+		path_,
+		syscall.GENERIC_READ|syscall.GENERIC_WRITE,
+		0,
+		nil,
+		syscall.OPEN_ALWAYS,
+		syscall.FILE_ATTRIBUTE_NORMAL|fileFlagDeleteOnClose,
+		0,
+	)
+	if err != nil {
+		if err == errorSharingViolation {
+			return nil, errBufferLocked
+		}
+		return nil, &os.PathError{Op: "open", Path: path, Err: err}
+	}
+	return os.NewFile(uintptr(handle), path), nil
+}
+
+func removeLockFile(path string) error {
+	return nil
+}
+
+func processAlive(pid int) bool {
+	const processQueryLimitedInformation = 0x1000
+	handle, err := syscall.OpenProcess(processQueryLimitedInformation, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	syscall.CloseHandle(handle)
+	return true
+}
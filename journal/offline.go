@@ -0,0 +1,180 @@
+package journal
+
+import (
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ChunkInfo describes a chunk found by ListChunks.
+type ChunkInfo struct {
+	Key       string
+	Path      string
+	Type      JournalFileType
+	Timestamp time.Time
+	Size      int64
+}
+
+// ChunkReport is a chunk in an InspectReport.  KeyId is the id of the key
+// the chunk is sealed with, or "" if it is not encrypted.
+type ChunkReport struct {
+	ChunkInfo
+	KeyId string
+}
+
+// JournalReport lists the chunks of a key from the oldest, and what is
+// wrong with them.
+type JournalReport struct {
+	Key       string
+	Chunks    []ChunkReport
+	Size      int64
+	Anomalies []string
+}
+
+// InspectReport is what Inspect found at a buffer path.  Anomalies are the
+// ones of the files that belong to no key.
+type InspectReport struct {
+	PathPrefix string
+	PathSuffix string
+	Journals   []JournalReport
+	Anomalies  []string
+}
+
+// Count returns the number of anomalies found in all.
+func (report *InspectReport) Count() int {
+	retval := len(report.Anomalies)
+	for _, journal := range report.Journals {
+		retval += len(journal.Anomalies)
+	}
+	return retval
+}
+
+func chunkInfoOf(key string, chunk *FileJournalChunk) ChunkInfo {
+	return ChunkInfo{
+		Key:       key,
+		Path:      chunk.Path,
+		Type:      chunk.Type,
+		Timestamp: time.Unix(chunk.Timestamp/1000000, (chunk.Timestamp%1000000)*1000),
+		Size:      chunk.Size,
+	}
+}
+
+func sortedKeys(journals map[string]*FileJournal) []string {
+	keys := make([]string, 0, len(journals))
+	for key, _ := range journals {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ListChunks returns the chunks of the buffer at path, given as the
+// buffer_path of the output, by key and from the oldest, which is the order
+// they would be delivered in.  Nothing is opened for writing, so that the
+// buffer of a stopped output can be looked into; a roll-over left behind
+// is not completed.
+func ListChunks(logger ik.Logger, path string, defaultPathSuffix string) ([]ChunkInfo, error) {
+	pathPrefix, pathSuffix := splitJournalGroupPath(path, defaultPathSuffix)
+	journals, err := scanJournals(logger, pathPrefix, pathSuffix)
+	if err != nil {
+		return nil, err
+	}
+	retval := make([]ChunkInfo, 0)
+	for _, key := range sortedKeys(journals) {
+		for chunk := journals[key].chunks.last; chunk != nil; chunk = chunk.head.prev {
+			retval = append(retval, chunkInfoOf(key, chunk))
+		}
+	}
+	return retval, nil
+}
+
+// OpenChunkInfo opens the chunk for reading, decrypting it with the keys
+// of encryption if it is sealed.  The chunk may end with a write cut short
+// if it is the head.  The reader is to be closed by the caller.
+func OpenChunkInfo(chunk ChunkInfo, encryption *ChunkEncryption) (io.ReadCloser, error) {
+	reader, err := openChunk(chunk.Path, encryption, 0, chunk.Type == Head)
+	if err != nil {
+		return nil, err
+	}
+	return reader.(io.ReadCloser), nil
+}
+
+// Inspect reports the chunks of the buffer at path as ListChunks does, and
+// what a restart of the output would find wrong with them or have to
+// repair, instead of failing on it.  Nothing is modified.
+func Inspect(path string, defaultPathSuffix string) (*InspectReport, error) {
+	pathPrefix, pathSuffix := splitJournalGroupPath(path, defaultPathSuffix)
+	return inspect(pathPrefix, pathSuffix)
+}
+
+func inspect(pathPrefix string, pathSuffix string) (*InspectReport, error) {
+	journals, unexpected, err := scanChunkFiles(pathPrefix, pathSuffix)
+	if err != nil {
+		return nil, err
+	}
+	report := &InspectReport{
+		PathPrefix: pathPrefix,
+		PathSuffix: pathSuffix,
+		Journals:   make([]JournalReport, 0, len(journals)),
+		Anomalies:  make([]string, 0),
+	}
+	for _, file := range unexpected {
+		report.Anomalies = append(report.Anomalies, fmt.Sprintf("%s: unexpected file", file))
+	}
+	rollOvers, err := filepath.Glob(pathPrefix + "*" + rollOverSuffix)
+	if err != nil {
+		return nil, err
+	}
+	for _, rollOver := range rollOvers {
+		report.Anomalies = append(report.Anomalies, fmt.Sprintf("%s: interrupted roll-over", rollOver))
+	}
+	for _, key := range sortedKeys(journals) {
+		report.Journals = append(report.Journals, inspectJournal(key, journals[key]))
+	}
+	return report, nil
+}
+
+func inspectJournal(key string, journal *FileJournal) JournalReport {
+	retval := JournalReport{
+		Key:       key,
+		Chunks:    make([]ChunkReport, 0, journal.chunks.count),
+		Anomalies: make([]string, 0),
+	}
+	heads := 0
+	for chunk := journal.chunks.last; chunk != nil; chunk = chunk.head.prev {
+		keyId, err := chunkKeyIdOf(chunk.Path)
+		if os.IsNotExist(err) {
+			// delivered since it was listed
+			continue
+		}
+		chunkReport := ChunkReport{ChunkInfo: chunkInfoOf(key, chunk)}
+		retval.Size += chunk.Size
+		if chunk.Type == Head {
+			heads += 1
+		}
+		if err != nil {
+			retval.Anomalies = append(retval.Anomalies, err.Error())
+		} else if keyId != "" {
+			chunkReport.KeyId = keyId
+			length, err := completeFramesLength(chunk.Path, keyId)
+			if err != nil {
+				retval.Anomalies = append(retval.Anomalies, fmt.Sprintf("%s: %s", chunk.Path, err.Error()))
+			} else if length < chunk.Size {
+				retval.Anomalies = append(retval.Anomalies, fmt.Sprintf("%s: incomplete frame of %d bytes", chunk.Path, chunk.Size-length))
+			}
+		}
+		retval.Chunks = append(retval.Chunks, chunkReport)
+	}
+	if heads == 0 {
+		retval.Anomalies = append(retval.Anomalies, "no chunk head")
+	} else if heads > 1 {
+		retval.Anomalies = append(retval.Anomalies, fmt.Sprintf("%d chunk heads", heads))
+	} else if journal.chunks.first.Type != Head {
+		retval.Anomalies = append(retval.Anomalies, "chunk head does not have the newest timestamp")
+	}
+	return retval
+}
@@ -0,0 +1,172 @@
+package journal
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_ListChunks(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { now = now.Add(time.Second); return now }),
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	for _, key := range []string{"b", "a"} {
+		journal := journalGroup.GetFileJournal(key)
+		for _, data := range []string{"test1", "test2", "test3"} {
+			err = journal.Write([]byte(key + data))
+			if err != nil {
+				t.FailNow()
+			}
+		}
+	}
+
+	chunks, err := ListChunks(logger, tempDir+"/test", ".log")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(chunks) != 6 {
+		t.Fatalf("expected 6 chunks, got %d", len(chunks))
+	}
+	for i, chunk := range chunks {
+		key := "a"
+		if i >= 3 {
+			key = "b"
+		}
+		expectedType := Rest
+		if i%3 == 2 {
+			expectedType = Head
+		}
+		if chunk.Key != key || chunk.Type != expectedType || chunk.Size != 6 {
+			t.Logf("#%d: %v", i, chunk)
+			t.Fail()
+		}
+		if i%3 != 0 && !chunk.Timestamp.After(chunks[i-1].Timestamp) {
+			t.Logf("#%d: %v is not newer than %v", i, chunk.Timestamp, chunks[i-1].Timestamp)
+			t.Fail()
+		}
+		reader, err := OpenChunkInfo(chunk, nil)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		b, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil || string(b) != key+[]string{"test1", "test2", "test3"}[i%3] {
+			t.Logf("#%d: %q", i, string(b))
+			t.Fail()
+		}
+	}
+	journalGroup.Dispose()
+}
+
+func Test_Inspect(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	tm := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	prefix := tempDir + "/test."
+	createFile := func(key string, type_ JournalFileType, o int) {
+		path := prefix + BuildJournalPath(key, type_, tm.Add(time.Duration(-o*1e9)), 0).VariablePortion + ".log"
+		err := ioutil.WriteFile(path, []byte("test"), os.FileMode(0644))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	createFile("a", Head, 0)
+	createFile("a", Head, 1)
+	createFile("b", Head, 0)
+	createFile("b", Rest, 1)
+	createFile("c", Rest, 0)
+	createFile("c", Head, 1)
+	createFile("d", Rest, 0)
+	err = ioutil.WriteFile(prefix+"zzz.log", nil, os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = ioutil.WriteFile(rollOverPath(prefix, "b"), nil, os.FileMode(0644))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	report, err := Inspect(tempDir+"/test", ".log")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(report.Journals) != 4 || len(report.Anomalies) != 2 || report.Count() != 5 {
+		t.Logf("%v", report)
+		t.FailNow()
+	}
+	expected := []int{1, 0, 1, 1}
+	for i, journal := range report.Journals {
+		if len(journal.Anomalies) != expected[i] {
+			t.Logf("%s: %v", journal.Key, journal.Anomalies)
+			t.Fail()
+		}
+	}
+	b := report.Journals[1]
+	if b.Key != "b" || len(b.Chunks) != 2 || b.Size != 8 || b.Chunks[0].Type != Rest || b.Chunks[1].Type != Head {
+		t.Logf("%v", b)
+		t.Fail()
+	}
+
+	// nothing was repaired
+	files, _ := ioutil.ReadDir(tempDir)
+	if len(files) != 9 {
+		t.Fail()
+	}
+}
+
+func Test_Inspect_IncompleteFrame(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	journalGroup := newEncryptingJournalGroup(t, 0, tempDir+"/test", "a:MDEyMzQ1Njc4OWFiY2RlZg==")
+	err = journalGroup.GetFileJournal("key").Write([]byte("test"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	report, err := inspect(journalGroup.pathPrefix, journalGroup.pathSuffix)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Count() != 0 || report.Journals[0].Chunks[0].KeyId != "a" {
+		t.Logf("%v", report)
+		t.Fail()
+	}
+	file, err := os.OpenFile(report.Journals[0].Chunks[0].Path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	file.Write([]byte{0, 0, 1, 0, 1, 2})
+	file.Close()
+	report, err = inspect(journalGroup.pathPrefix, journalGroup.pathSuffix)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if report.Count() != 1 || report.Journals[0].Anomalies[0] != report.Journals[0].Chunks[0].Path+": incomplete frame of 6 bytes" {
+		t.Logf("%v", report)
+		t.Fail()
+	}
+	journalGroup.Dispose()
+}
@@ -22,7 +22,7 @@ type JournalPathInfo struct {
 	Type            JournalFileType
 	VariablePortion string
 	TSuffix         string
-	Timestamp       int64 // elapsed time in msec since epoch
+	Timestamp       int64 // elapsed time in usec since epoch
 	UniqueId        []byte
 }
 
@@ -100,7 +100,7 @@ func IsValidJournalPathInfo(info JournalPathInfo) bool {
 }
 
 func BuildJournalPathWithTSuffix(key string, bq JournalFileType, tSuffix string) string {
-	encodedKey := encodeKey(key)
+	encodedKey := encodeJournalKey(key)
 	return fmt.Sprintf(
 		"%s.%c%s",
 		encodedKey,
@@ -126,7 +126,7 @@ func BuildJournalPath(key string, bq JournalFileType, time_ time.Time, randValue
 		Type:            bq,
 		VariablePortion: BuildJournalPathWithTSuffix(key, bq, tSuffix),
 		TSuffix:         tSuffix,
-		Timestamp:       timestamp,
+		Timestamp:       timestamp / 1000,
 		UniqueId:        uniqueId,
 	}
 }
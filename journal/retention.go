@@ -0,0 +1,97 @@
+package journal
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// SetRetention makes the journal groups created afterwards give up the
+// chunks older than maxAge, and then the oldest chunks for the buffer to
+// hold no more than maxTotalBytes, delivered or not, as Expire is called.
+// Either <= 0 means no limit.
+func (factory *FileJournalGroupFactory) SetRetention(maxAge time.Duration, maxTotalBytes int64) {
+	factory.maxAge = maxAge
+	factory.maxTotalBytes = maxTotalBytes
+}
+
+// Expired returns the number of chunks given up undelivered so far.
+func (journalGroup *FileJournalGroup) Expired() int64 {
+	return atomic.LoadInt64(&journalGroup.expired)
+}
+
+func chunkTime(chunk *FileJournalChunk) time.Time {
+	return time.Unix(0, chunk.Timestamp*int64(time.Microsecond))
+}
+
+// Expire removes the chunks beyond the retention limits, the oldest of
+// every journal first, and returns how many it removed.  A chunk being
+// delivered is left to the delivery, though counted as gone for the total
+// size.  The expire hook is called for each chunk before it is removed.
+func (journalGroup *FileJournalGroup) Expire() (int, error) {
+	if journalGroup.maxAge <= 0 && journalGroup.maxTotalBytes <= 0 {
+		return 0, nil
+	}
+	journalGroup.mtx.Lock()
+	journals := make([]*FileJournal, 0, len(journalGroup.journals)+len(journalGroup.idle))
+	for _, journal := range journalGroup.journals {
+		journals = append(journals, journal)
+	}
+	for _, journal := range journalGroup.idle {
+		journals = append(journals, journal)
+	}
+	journalGroup.mtx.Unlock()
+
+	candidates := make([]*FileJournalChunkWrapper, 0)
+	total := int64(0)
+	for _, journal := range journals {
+		chunks := journal.snapshot()
+		for chunks.Next() {
+			wrapper := chunks.take()
+			total += wrapper.Size()
+			candidates = append(candidates, wrapper)
+		}
+		chunks.Close()
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].chunk.Timestamp < candidates[j].chunk.Timestamp
+	})
+	now := journalGroup.clock.Now()
+	expired := 0
+	for _, wrapper := range candidates {
+		chunk := wrapper.chunk
+		tooOld := journalGroup.maxAge > 0 && now.Sub(chunkTime(chunk)) > journalGroup.maxAge
+		tooLarge := journalGroup.maxTotalBytes > 0 && total > journalGroup.maxTotalBytes
+		if !tooOld && !tooLarge {
+			break
+		}
+		size := wrapper.Size()
+		total -= size
+		if !wrapper.TakeOwnership() {
+			continue
+		}
+		wrapper.journal.callExpireHook(chunk)
+		journalGroup.logger.Warning("expired the undelivered chunk %s of %d bytes", chunk.Path, size)
+		expired += 1
+	}
+	atomic.AddInt64(&journalGroup.expired, int64(expired))
+	var err error
+	for _, wrapper := range candidates {
+		err_ := wrapper.Dispose()
+		if err_ != nil && err == nil {
+			err = err_
+		}
+	}
+	if expired > 0 {
+		for _, journal := range journals {
+			err_ := journal.Purge()
+			if err_ != nil && err == nil {
+				err = err_
+			}
+		}
+		journalGroup.mtx.Lock()
+		journalGroup.forgetFlushedIdle()
+		journalGroup.mtx.Unlock()
+	}
+	return expired, err
+}
@@ -0,0 +1,116 @@
+package journal
+
+import (
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_JournalGroup_Expire(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return now }),
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	factory.SetRetention(90*time.Second, 0)
+	expired := make([]string, 0)
+	factory.SetChunkHooks(&ChunkHooks{
+		OnExpire: func(event ChunkEvent) {
+			// the file is still there to be archived
+			data, err := ioutil.ReadFile(event.Path)
+			if err != nil {
+				t.Error(err.Error())
+			}
+			expired = append(expired, string(data))
+		},
+	})
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	defer journalGroup.Dispose()
+	journal := journalGroup.GetFileJournal("key")
+	for _, data := range []string{"test1", "test2", "test3"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+		now = now.Add(time.Minute)
+	}
+	// the chunk of test2 is being delivered, and left to the delivery
+	tail := journal.GetTailChunk()
+	chunk := tail.GetNextChunk()
+	tail.Dispose()
+	if !chunk.TakeOwnership() {
+		t.FailNow()
+	}
+	n, err := journalGroup.Expire()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n != 1 || len(expired) != 1 || expired[0] != "test1" || journalGroup.Expired() != 1 {
+		t.Fatalf("%d %v", n, expired)
+	}
+	chunk.Dispose()
+	journal.Purge()
+	files, err := readChunkDir(tempDir)
+	if err != nil {
+		t.FailNow()
+	}
+	if len(files) != 1 || journal.chunks.count != 1 {
+		t.Fatalf("%d files, %d chunks", len(files), journal.chunks.count)
+	}
+
+	// the oldest chunks go until the buffer holds no more than the limit,
+	// the one being written included
+	journalGroup.maxAge = 0
+	journalGroup.maxTotalBytes = 5
+	err = journal.Write([]byte("test4"))
+	if err != nil {
+		t.FailNow()
+	}
+	n, err = journalGroup.Expire()
+	if err != nil || n != 1 || expired[1] != "test3" {
+		t.Fatalf("%d %v %v", n, err, expired)
+	}
+	journalGroup.maxTotalBytes = 1
+	n, err = journalGroup.Expire()
+	if err != nil || n != 1 || expired[2] != "test4" || journal.chunks.count != 0 {
+		t.Fatalf("%d %v %v", n, err, expired)
+	}
+	// the next write goes to a new chunk
+	err = journal.Write([]byte("test5"))
+	if err != nil {
+		t.FailNow()
+	}
+	contents := make([]string, 0)
+	err = journal.Flush(func(chunk ik.JournalChunk) error {
+		defer chunk.Dispose()
+		reader, err := chunk.GetReader()
+		if err != nil {
+			return err
+		}
+		data, _ := ioutil.ReadAll(reader)
+		contents = append(contents, string(data))
+		return nil
+	})
+	if err != nil || len(contents) != 1 || contents[0] != "test5" {
+		t.Fatalf("%v %v", err, contents)
+	}
+	if journalGroup.Stats().Expired != 3 {
+		t.Fatalf("%v", journalGroup.Stats())
+	}
+}
@@ -0,0 +1,117 @@
+package journal
+
+import (
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// A roll-over of a journal from its head chunk to a new one is recorded
+// beforehand in a file next to the chunks, named after the key of the
+// journal, which holds the time suffixes of the old head and the new one.
+// A roll-over left behind by a crash is completed when the chunks are
+// scanned, so that the journal ends up with exactly one head either way.
+const rollOverSuffix = ".rollover"
+
+func rollOverPath(pathPrefix string, key string) string {
+	return pathPrefix + encodeKey(key) + rollOverSuffix
+}
+
+func writeRollOver(path string, oldTSuffix string, newTSuffix string, fileMode os.FileMode) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, chunkFileMode(fileMode))
+	if err != nil {
+		return err
+	}
+	_, err = file.Write([]byte(oldTSuffix + "\n" + newTSuffix + "\n"))
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func removeRollOver(path string) error {
+	err := removeChunkFile(path)
+	if err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func pathExists(path string) (bool, error) {
+	_, err := os.Stat(path)
+	if err == nil {
+		return true, nil
+	} else if os.IsNotExist(err) {
+		return false, nil
+	}
+	return false, err
+}
+
+func recoverRollOver(logger ik.Logger, path string, pathPrefix string, pathSuffix string, fileMode os.FileMode) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// nothing has been done yet unless the record is complete
+	lines := strings.Split(string(content), "\n")
+	if len(lines) == 3 && lines[2] == "" {
+		key, err := decodeKey(path[len(pathPrefix) : len(path)-len(rollOverSuffix)])
+		if err != nil {
+			return err
+		}
+		oldHeadPath := pathPrefix + BuildJournalPathWithTSuffix(key, Head, lines[0]) + pathSuffix
+		oldHeadExists, err := pathExists(oldHeadPath)
+		if err != nil {
+			return err
+		}
+		if oldHeadExists {
+			err = renameChunkFile(oldHeadPath, pathPrefix+BuildJournalPathWithTSuffix(key, Rest, lines[0])+pathSuffix)
+			if err != nil {
+				return err
+			}
+		}
+		newHeadPath := pathPrefix + BuildJournalPathWithTSuffix(key, Head, lines[1]) + pathSuffix
+		newHeadExists, err := pathExists(newHeadPath)
+		if err != nil {
+			return err
+		}
+		if !newHeadExists {
+			file, err := os.OpenFile(newHeadPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, chunkFileMode(fileMode))
+			if err != nil {
+				return err
+			}
+			file.Close()
+		}
+		err = syncDir(filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+		logger.Notice("completed the roll-over of the journal %s left behind", key)
+	}
+	return removeRollOver(path)
+}
+
+// recoverRollOvers completes the roll-overs left behind under pathPrefix.
+func recoverRollOvers(logger ik.Logger, pathPrefix string, pathSuffix string, fileMode os.FileMode) error {
+	paths, err := filepath.Glob(pathPrefix + "*" + rollOverSuffix)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		err := recoverRollOver(logger, path, pathPrefix, pathSuffix, fileMode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
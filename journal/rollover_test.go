@@ -0,0 +1,167 @@
+package journal
+
+import (
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Journal_RollOverRecovery(t *testing.T) {
+	logger := newTestLogger()
+	tm := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, case_ := range []struct {
+		name     string
+		newHead  bool
+		recorded bool
+	}{
+		{"crashed before creating the new head", false, true},
+		{"crashed before renaming the old head", true, true},
+		{"crashed while recording", false, false},
+	} {
+		tempDir, err := ioutil.TempDir("", "ik.journal")
+		if err != nil {
+			t.FailNow()
+		}
+		defer os.RemoveAll(tempDir)
+		prefix := tempDir + "/test."
+		oldHead := BuildJournalPath("key", Head, tm.Add(-time.Second), 0)
+		newHead := BuildJournalPath("key", Head, tm, 0)
+		err = ioutil.WriteFile(prefix+oldHead.VariablePortion+".log", []byte("data"), os.FileMode(0644))
+		if err != nil {
+			t.FailNow()
+		}
+		if case_.newHead {
+			err = ioutil.WriteFile(prefix+newHead.VariablePortion+".log", nil, os.FileMode(0644))
+			if err != nil {
+				t.FailNow()
+			}
+		}
+		record := oldHead.TSuffix + "\n"
+		if case_.recorded {
+			record += newHead.TSuffix + "\n"
+		}
+		err = ioutil.WriteFile(rollOverPath(prefix, "key"), []byte(record), os.FileMode(0644))
+		if err != nil {
+			t.FailNow()
+		}
+
+		factory := NewFileJournalGroupFactory(
+			logger,
+			rand.NewSource(0),
+			newTestClock(func() time.Time { return tm.Add(time.Second) }),
+			".log",
+			os.FileMode(0644),
+			1024,
+		)
+		journalGroup, err := factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+		if err != nil {
+			t.Fatalf("%s: %s", case_.name, err.Error())
+		}
+		journal := journalGroup.GetFileJournal("key")
+		if case_.recorded {
+			if journal.chunks.count != 2 || journal.chunks.first.TSuffix != newHead.TSuffix || journal.chunks.last.Type != Rest || journal.chunks.last.Size != 4 {
+				t.Errorf("%s: %d chunks", case_.name, journal.chunks.count)
+			}
+		} else {
+			if journal.chunks.count != 1 || journal.chunks.first.TSuffix != oldHead.TSuffix {
+				t.Errorf("%s: %d chunks", case_.name, journal.chunks.count)
+			}
+		}
+		_, err = os.Stat(rollOverPath(prefix, "key"))
+		if !os.IsNotExist(err) {
+			t.Errorf("%s: the roll-over is left", case_.name)
+		}
+		journal.Dispose()
+	}
+}
+
+func Test_Journal_RollOver(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		ik.SystemClock,
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	defer journal.Dispose()
+	for _, data := range []string{"test1", "test2", "test3"} {
+		err = journal.Write([]byte(data))
+		if err != nil {
+			t.FailNow()
+		}
+	}
+	files, err := readChunkDir(tempDir)
+	if err != nil {
+		t.FailNow()
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), rollOverSuffix) {
+			t.Errorf("%s is left", file.Name())
+		}
+	}
+	if len(files) != 3 || journal.chunks.count != 3 {
+		t.Fail()
+	}
+}
+
+func Test_Journal_RollOverFailure(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	factory := NewFileJournalGroupFactory(
+		logger,
+		rand.NewSource(0),
+		ik.SystemClock,
+		".log",
+		os.FileMode(0644),
+		8,
+	)
+	journalGroup, err := factory.GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	journal := journalGroup.GetFileJournal("key")
+	defer journal.Dispose()
+	err = journal.Write([]byte("test1"))
+	if err != nil {
+		t.FailNow()
+	}
+	// the roll-over cannot be recorded where a directory is in the way
+	walPath := rollOverPath(tempDir+"/test.", "key")
+	err = os.Mkdir(walPath, os.FileMode(0755))
+	if err != nil {
+		t.FailNow()
+	}
+	err = journal.Write([]byte("test2"))
+	if err == nil {
+		t.Fail()
+	}
+	os.Remove(walPath)
+	// the journal goes on from where it was
+	err = journal.Write([]byte("test2"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if journal.chunks.count != 2 || journal.chunks.last.Type != Rest {
+		t.Fail()
+	}
+}
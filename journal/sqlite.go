@@ -0,0 +1,628 @@
+package journal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+)
+
+// SQLiteJournalGroup keeps every journal of a buffer path in a single
+// SQLite database, reached through database/sql with the driver of the
+// given name, instead of a file per chunk.  A chunk is a row of the chunks
+// table and each record written to it a row of the records table; a write
+// starting a new chunk seals the previous one in the same transaction, and
+// a chunk delivered is deleted in a single transaction as well, so the
+// database never holds half a chunk.  The driver has to be linked into the
+// binary; the ik command links github.com/mattn/go-sqlite3 in unless built
+// with the ik_nosqlite tag or without cgo, and the buffered outputs turn
+// down buffer_type sqlite as the configuration is read if it is not.
+type SQLiteJournalGroup struct {
+	factory        *SQLiteJournalGroupFactory
+	pluginInstance ik.PluginInstance
+	path           string
+	db             *sql.DB
+	logger         ik.Logger
+	clock          ik.Clock
+	rand           *rand.Rand
+	maxSize        int64
+	journals       map[string]*SQLiteJournal
+	mtx            sync.Mutex
+}
+
+type SQLiteJournalGroupFactory struct {
+	logger     ik.Logger
+	driver     string
+	randSource rand.Source
+	clock      ik.Clock
+	maxSize    int64
+	paths      map[string]*SQLiteJournalGroup
+	mtx        sync.Mutex
+}
+
+// SQLiteJournal is a journal of a SQLiteJournalGroup.  The last chunk is
+// the one being written unless it is sealed; a chunk left unsealed by a
+// previous run or by Dispose is sealed by the next write.
+type SQLiteJournal struct {
+	group             *SQLiteJournalGroup
+	key               string
+	chunks            []*sqliteChunk
+	newChunkListeners []ik.JournalChunkListener
+	flushListeners    []ik.JournalChunkListener
+	writing           bool
+	mtx               sync.Mutex // for the writes
+	chunksMtx         sync.Mutex
+}
+
+type sqliteChunk struct {
+	journal   *SQLiteJournal
+	id        int64
+	uniqueId  []byte
+	timestamp int64
+	size      int64
+	records   int64
+	sealed    bool
+	owned     bool
+	removed   bool
+}
+
+// sqliteChunkWrapper is what the chunks are handed out as; only the wrapper
+// whose ownership was taken deletes the chunk when disposed of.
+type sqliteChunkWrapper struct {
+	chunk          *sqliteChunk
+	ownershipTaken bool
+	disposed       bool
+}
+
+type sqliteChunkIterator struct {
+	chunks  []*sqliteChunk
+	current *sqliteChunkWrapper
+}
+
+var sqliteJournalSchema = []string{
+	"CREATE TABLE IF NOT EXISTS chunks (id INTEGER PRIMARY KEY AUTOINCREMENT, journal TEXT NOT NULL, unique_id TEXT NOT NULL, timestamp INTEGER NOT NULL, sealed INTEGER NOT NULL)",
+	"CREATE TABLE IF NOT EXISTS records (chunk INTEGER NOT NULL, seq INTEGER NOT NULL, data BLOB NOT NULL, PRIMARY KEY (chunk, seq))",
+}
+
+// Path tells the chunk apart from the others for the failures counted
+// against it.
+func (wrapper *sqliteChunkWrapper) Path() string {
+	return fmt.Sprintf("%s#%d", wrapper.chunk.journal.group.path, wrapper.chunk.id)
+}
+
+func (wrapper *sqliteChunkWrapper) Size() int64 {
+	journal := wrapper.chunk.journal
+	journal.chunksMtx.Lock()
+	defer journal.chunksMtx.Unlock()
+	return wrapper.chunk.size
+}
+
+func (wrapper *sqliteChunkWrapper) GetReader() (io.Reader, error) {
+	reader, _, err := wrapper.GetReaderAt(0)
+	return reader, err
+}
+
+// GetReaderAt returns a reader starting exactly at the record at
+// recordOffset, as every record is a row of its own, or at the end if
+// there are not as many records.
+func (wrapper *sqliteChunkWrapper) GetReaderAt(recordOffset int64) (io.Reader, int64, error) {
+	if recordOffset < 0 {
+		return nil, 0, errors.New("negative record offset")
+	}
+	chunk := wrapper.chunk
+	journal := chunk.journal
+	journal.chunksMtx.Lock()
+	removed, records := chunk.removed, chunk.records
+	journal.chunksMtx.Unlock()
+	if wrapper.disposed || removed {
+		return nil, 0, errors.New("already disposed")
+	}
+	if recordOffset > records {
+		recordOffset = records
+	}
+	rows, err := journal.group.db.Query("SELECT data FROM records WHERE chunk = ? AND seq >= ? ORDER BY seq", chunk.id, recordOffset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	buf := &bytes.Buffer{}
+	for rows.Next() {
+		var data []byte
+		err = rows.Scan(&data)
+		if err != nil {
+			return nil, 0, err
+		}
+		buf.Write(data)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, 0, err
+	}
+	return buf, recordOffset, nil
+}
+
+func (wrapper *sqliteChunkWrapper) GetNextChunk() ik.JournalChunk {
+	journal := wrapper.chunk.journal
+	journal.chunksMtx.Lock()
+	defer journal.chunksMtx.Unlock()
+	for i, chunk := range journal.chunks {
+		if chunk == wrapper.chunk && i+1 < len(journal.chunks) {
+			return &sqliteChunkWrapper{chunk: journal.chunks[i+1]}
+		}
+	}
+	return nil
+}
+
+func (wrapper *sqliteChunkWrapper) UniqueId() string {
+	return hex.EncodeToString(wrapper.chunk.uniqueId)
+}
+
+func (wrapper *sqliteChunkWrapper) TakeOwnership() bool {
+	journal := wrapper.chunk.journal
+	journal.chunksMtx.Lock()
+	defer journal.chunksMtx.Unlock()
+	if wrapper.disposed || wrapper.chunk.owned {
+		return false
+	}
+	wrapper.chunk.owned = true
+	wrapper.ownershipTaken = true
+	return true
+}
+
+// Dispose deletes the chunk if the ownership was taken through the
+// wrapper.  The chunk being written makes way for a new one.
+func (wrapper *sqliteChunkWrapper) Dispose() error {
+	if wrapper.disposed {
+		return errors.New("already disposed")
+	}
+	wrapper.disposed = true
+	if !wrapper.ownershipTaken {
+		return nil
+	}
+	return wrapper.chunk.journal.remove(wrapper.chunk)
+}
+
+func (journal *SQLiteJournal) remove(chunk *sqliteChunk) error {
+	journal.chunksMtx.Lock()
+	defer journal.chunksMtx.Unlock()
+	if chunk.removed {
+		return nil
+	}
+	err := journal.group.inTransaction(func(tx *sql.Tx) error {
+		_, err := tx.Exec("DELETE FROM records WHERE chunk = ?", chunk.id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("DELETE FROM chunks WHERE id = ?", chunk.id)
+		return err
+	})
+	if err != nil {
+		// left for the next delivery to take
+		chunk.owned = false
+		return err
+	}
+	chunk.removed = true
+	for i, chunk_ := range journal.chunks {
+		if chunk_ == chunk {
+			journal.chunks = append(journal.chunks[0:i:i], journal.chunks[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (journal *SQLiteJournal) Key() string {
+	return journal.key
+}
+
+// callListener turns a panic of the listener into an error, as the lock
+// held by the writer would be left locked otherwise.
+func (journal *SQLiteJournal) callListener(listener ik.JournalChunkListener, chunk *sqliteChunk) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			panicked := ik.NewPanicked(r)
+			journal.group.logger.Critical("listener panicked: %s\n%s", panicked.Error(), string(panicked.Stack()))
+			err = panicked
+		}
+	}()
+	return listener(&sqliteChunkWrapper{chunk: chunk})
+}
+
+func (journal *SQLiteJournal) notify(listeners []ik.JournalChunkListener, chunk *sqliteChunk) {
+	for _, listener := range listeners {
+		err := journal.callListener(listener, chunk)
+		if err != nil {
+			journal.group.logger.Error("error occurred during notifying flush event: %s", err.Error())
+		}
+	}
+}
+
+// Write appends a record to the chunk being written, or starts a new chunk
+// if there is none or if it would exceed the chunk limit, sealing the
+// previous one in the same transaction.
+func (journal *SQLiteJournal) Write(data []byte) error {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	head, chunk, err := journal.write(data)
+	if err != nil {
+		return err
+	}
+	if head != nil {
+		journal.notify(journal.flushListeners, head)
+	}
+	if chunk != nil {
+		journal.notify(journal.newChunkListeners, chunk)
+	}
+	return nil
+}
+
+// write returns the chunk it sealed and the one it started, if any.  The
+// chunks are locked all along, lest the chunk being written be deleted
+// under the record appended to it.
+func (journal *SQLiteJournal) write(data []byte) (*sqliteChunk, *sqliteChunk, error) {
+	group := journal.group
+	journal.chunksMtx.Lock()
+	defer journal.chunksMtx.Unlock()
+	head := (*sqliteChunk)(nil)
+	if len(journal.chunks) > 0 {
+		head = journal.chunks[len(journal.chunks)-1]
+		if head.sealed {
+			head = nil
+		}
+	}
+	if head != nil && journal.writing && (group.maxSize <= 0 || head.size == 0 || head.size+int64(len(data)) <= group.maxSize) {
+		_, err := group.db.Exec("INSERT INTO records (chunk, seq, data) VALUES (?, ?, ?)", head.id, head.records, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		head.size += int64(len(data))
+		head.records += 1
+		return nil, nil, nil
+	}
+
+	info := BuildJournalPath(journal.key, Head, group.clock.Now(), group.rand.Int63n(0xfff))
+	chunk := &sqliteChunk{
+		journal:   journal,
+		uniqueId:  info.UniqueId,
+		timestamp: info.Timestamp,
+		size:      int64(len(data)),
+		records:   1,
+	}
+	err := group.inTransaction(func(tx *sql.Tx) error {
+		if head != nil {
+			_, err := tx.Exec("UPDATE chunks SET sealed = 1 WHERE id = ?", head.id)
+			if err != nil {
+				return err
+			}
+		}
+		result, err := tx.Exec(
+			"INSERT INTO chunks (journal, unique_id, timestamp, sealed) VALUES (?, ?, ?, 0)",
+			journal.key,
+			hex.EncodeToString(chunk.uniqueId),
+			chunk.timestamp,
+		)
+		if err != nil {
+			return err
+		}
+		chunk.id, err = result.LastInsertId()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("INSERT INTO records (chunk, seq, data) VALUES (?, 0, ?)", chunk.id, data)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if head != nil {
+		head.sealed = true
+	}
+	journal.chunks = append(journal.chunks, chunk)
+	journal.writing = true
+	return head, chunk, nil
+}
+
+func (journal *SQLiteJournal) snapshot() []*sqliteChunk {
+	journal.chunksMtx.Lock()
+	defer journal.chunksMtx.Unlock()
+	return append([]*sqliteChunk(nil), journal.chunks...)
+}
+
+func (journal *SQLiteJournal) GetTailChunk() ik.JournalChunk {
+	journal.chunksMtx.Lock()
+	defer journal.chunksMtx.Unlock()
+	if len(journal.chunks) == 0 {
+		return nil
+	}
+	return &sqliteChunkWrapper{chunk: journal.chunks[0]}
+}
+
+// Chunks returns an iterator over the chunks from the oldest on, the one
+// being written included.
+func (journal *SQLiteJournal) Chunks() ik.JournalChunkIterator {
+	return &sqliteChunkIterator{chunks: journal.snapshot()}
+}
+
+func (journal *SQLiteJournal) AddNewChunkListener(listener ik.JournalChunkListener) {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	journal.newChunkListeners = append(journal.newChunkListeners, listener)
+}
+
+func (journal *SQLiteJournal) AddFlushListener(listener ik.JournalChunkListener) {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	journal.flushListeners = append(journal.flushListeners, listener)
+}
+
+func (journal *SQLiteJournal) Flush(visitor func(ik.JournalChunk) error) error {
+	return journal.FlushContext(context.Background(), visitor)
+}
+
+// FlushContext visits the chunks from the oldest on, the one being written
+// included.  The visitor is to dispose of each chunk.
+func (journal *SQLiteJournal) FlushContext(ctx context.Context, visitor func(ik.JournalChunk) error) error {
+	for _, chunk := range journal.snapshot() {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+		err = visitor(&sqliteChunkWrapper{chunk: chunk})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Sync does nothing, as every write is committed by the time it returns.
+func (journal *SQLiteJournal) Sync() error {
+	return nil
+}
+
+// Dispose makes the next write start a new chunk.
+func (journal *SQLiteJournal) Dispose() error {
+	journal.mtx.Lock()
+	defer journal.mtx.Unlock()
+	journal.writing = false
+	return nil
+}
+
+func (iterator *sqliteChunkIterator) release() error {
+	if iterator.current == nil {
+		return nil
+	}
+	err := iterator.current.Dispose()
+	iterator.current = nil
+	return err
+}
+
+func (iterator *sqliteChunkIterator) Next() bool {
+	iterator.release()
+	for len(iterator.chunks) > 0 {
+		chunk := iterator.chunks[0]
+		iterator.chunks = iterator.chunks[1:]
+		journal := chunk.journal
+		journal.chunksMtx.Lock()
+		removed := chunk.removed
+		journal.chunksMtx.Unlock()
+		if !removed {
+			iterator.current = &sqliteChunkWrapper{chunk: chunk}
+			return true
+		}
+	}
+	return false
+}
+
+func (iterator *sqliteChunkIterator) Value() ik.JournalChunk {
+	if iterator.current == nil {
+		return nil
+	}
+	return iterator.current
+}
+
+func (iterator *sqliteChunkIterator) Close() error {
+	err := iterator.release()
+	iterator.chunks = nil
+	return err
+}
+
+func (group *SQLiteJournalGroup) inTransaction(f func(tx *sql.Tx) error) error {
+	tx, err := group.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = f(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (group *SQLiteJournalGroup) load() error {
+	for _, statement := range sqliteJournalSchema {
+		_, err := group.db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	rows, err := group.db.Query("SELECT id, journal, unique_id, timestamp, sealed FROM chunks ORDER BY id")
+	if err != nil {
+		return err
+	}
+	chunks := make(map[int64]*sqliteChunk)
+	for rows.Next() {
+		var id, timestamp, sealed int64
+		var key, uniqueId string
+		err = rows.Scan(&id, &key, &uniqueId, &timestamp, &sealed)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		uniqueId_, err := hex.DecodeString(uniqueId)
+		if err != nil {
+			rows.Close()
+			return errors.New(fmt.Sprintf("chunk %d: invalid unique id: %s", id, uniqueId))
+		}
+		journal := group.getJournal(key)
+		chunk := &sqliteChunk{
+			journal:   journal,
+			id:        id,
+			uniqueId:  uniqueId_,
+			timestamp: timestamp,
+			sealed:    sealed != 0,
+		}
+		journal.chunks = append(journal.chunks, chunk)
+		chunks[id] = chunk
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	rows, err = group.db.Query("SELECT chunk, COUNT(*), SUM(LENGTH(data)) FROM records GROUP BY chunk")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, records, size int64
+		err = rows.Scan(&id, &records, &size)
+		if err != nil {
+			return err
+		}
+		chunk, ok := chunks[id]
+		if ok {
+			chunk.records = records
+			chunk.size = size
+		}
+	}
+	return rows.Err()
+}
+
+func (group *SQLiteJournalGroup) getJournal(key string) *SQLiteJournal {
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	journal, ok := group.journals[key]
+	if !ok {
+		journal = &SQLiteJournal{
+			group:             group,
+			key:               key,
+			chunks:            make([]*sqliteChunk, 0),
+			newChunkListeners: make([]ik.JournalChunkListener, 0),
+			flushListeners:    make([]ik.JournalChunkListener, 0),
+		}
+		group.journals[key] = journal
+	}
+	return journal
+}
+
+func (group *SQLiteJournalGroup) GetJournal(key string) ik.Journal {
+	return group.getJournal(key)
+}
+
+func (group *SQLiteJournalGroup) GetJournalKeys() []string {
+	group.mtx.Lock()
+	defer group.mtx.Unlock()
+	retval := make([]string, 0, len(group.journals))
+	for key := range group.journals {
+		retval = append(retval, key)
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+// KeySizes returns the bytes the chunks of each journal hold.
+func (group *SQLiteJournalGroup) KeySizes() map[string]int64 {
+	group.mtx.Lock()
+	journals := make([]*SQLiteJournal, 0, len(group.journals))
+	for _, journal := range group.journals {
+		journals = append(journals, journal)
+	}
+	group.mtx.Unlock()
+	retval := make(map[string]int64, len(journals))
+	for _, journal := range journals {
+		journal.chunksMtx.Lock()
+		for _, chunk := range journal.chunks {
+			retval[journal.key] += chunk.size
+		}
+		journal.chunksMtx.Unlock()
+	}
+	return retval
+}
+
+// Dispose closes the database.  The chunks are kept in it for the next run.
+func (group *SQLiteJournalGroup) Dispose() error {
+	group.factory.mtx.Lock()
+	delete(group.factory.paths, group.path)
+	group.factory.mtx.Unlock()
+	return group.db.Close()
+}
+
+// GetJournalGroup opens the database at the buffer path, creating the
+// tables if there are none, and reads the chunks a previous run left.
+func (factory *SQLiteJournalGroupFactory) GetJournalGroup(path string, pluginInstance ik.PluginInstance) (*SQLiteJournalGroup, error) {
+	factory.mtx.Lock()
+	defer factory.mtx.Unlock()
+	registered, ok := factory.paths[path]
+	if ok {
+		if registered.pluginInstance == pluginInstance {
+			return registered, nil
+		} else {
+			return nil, errors.New(fmt.Sprintf(
+				"Other '%s' plugin already use same buffer_path: %s",
+				registered.pluginInstance.Factory().Name(),
+				path,
+			))
+		}
+	}
+	db, err := sql.Open(factory.driver, path)
+	if err != nil {
+		return nil, err
+	}
+	journalGroup := &SQLiteJournalGroup{
+		factory:        factory,
+		pluginInstance: pluginInstance,
+		path:           path,
+		db:             db,
+		logger:         factory.logger,
+		clock:          factory.clock,
+		rand:           rand.New(factory.randSource),
+		maxSize:        factory.maxSize,
+		journals:       make(map[string]*SQLiteJournal),
+	}
+	err = journalGroup.load()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	factory.logger.Info("Path %s is designated to PluginInstance %s", path, pluginInstance.Factory().Name())
+	factory.paths[path] = journalGroup
+	return journalGroup, nil
+}
+
+func NewSQLiteJournalGroupFactory(
+	logger ik.Logger,
+	driver string,
+	randSource rand.Source,
+	clock ik.Clock,
+	maxSize int64,
+) *SQLiteJournalGroupFactory {
+	return &SQLiteJournalGroupFactory{
+		logger:     logger,
+		driver:     driver,
+		randSource: randSource,
+		clock:      clock,
+		maxSize:    maxSize,
+		paths:      make(map[string]*SQLiteJournalGroup),
+	}
+}
@@ -0,0 +1,102 @@
+//go:build cgo && !ik_nosqlite
+// +build cgo,!ik_nosqlite
+
+package journal
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func newSQLite3JournalGroup(t *testing.T, path string) *SQLiteJournalGroup {
+	logger := newTestLogger()
+	factory := NewSQLiteJournalGroupFactory(
+		logger,
+		"sqlite3",
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		10,
+	)
+	journalGroup, err := factory.GetJournalGroup(path, &DummyPluginInstance{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return journalGroup
+}
+
+func Test_SQLiteJournal_SQLite3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	dbPath := path.Join(dir, "buffer.db")
+	journalGroup := newSQLite3JournalGroup(t, dbPath)
+	journal := journalGroup.GetJournal("key")
+	flushed := make([]string, 0)
+	journal.AddFlushListener(func(chunk ik.JournalChunk) error {
+		flushed = append(flushed, readSQLiteChunk(t, chunk))
+		return nil
+	})
+	for _, data := range []string{"test1", "test2", "test3", "test4", "test5"} {
+		err := journal.Write([]byte(data))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(flushed) != 2 || flushed[0] != "test1test2" || flushed[1] != "test3test4" {
+		t.Fatalf("%v", flushed)
+	}
+	// the oldest chunk is delivered and deleted
+	chunks := journal.Chunks()
+	if !chunks.Next() {
+		t.FailNow()
+	}
+	chunk := chunks.Value()
+	if readSQLiteChunk(t, chunk) != "test1test2" || !chunk.TakeOwnership() {
+		t.FailNow()
+	}
+	err = chunk.Dispose()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	chunks.Close()
+	err = journalGroup.Dispose()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the chunks committed are read back from the database by the next run
+	journalGroup = newSQLite3JournalGroup(t, dbPath)
+	defer journalGroup.Dispose()
+	if keys := journalGroup.GetJournalKeys(); len(keys) != 1 || keys[0] != "key" {
+		t.Fatalf("%v", keys)
+	}
+	journal = journalGroup.GetJournal("key")
+	err = journal.Write([]byte("test6"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	contents := make([]string, 0)
+	err = journal.Flush(func(chunk ik.JournalChunk) error {
+		defer chunk.Dispose()
+		contents = append(contents, readSQLiteChunk(t, chunk))
+		chunk.TakeOwnership()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(contents) != 3 || contents[0] != "test3test4" || contents[1] != "test5" || contents[2] != "test6" {
+		t.Fatalf("%v", contents)
+	}
+	if journal.GetTailChunk() != nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,349 @@
+package journal
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSQLiteDriver keeps the tables of a database per name, taking the
+// statements SQLiteJournalGroup makes for what they are.  The statements
+// of a transaction take effect on commit, which can be made to fail.
+type testSQLiteDriver struct {
+	dbs map[string]*testSQLiteDB
+	mtx sync.Mutex
+}
+
+type testSQLiteDB struct {
+	chunks    map[int64][]driver.Value
+	records   map[int64][][]byte
+	lastId    int64
+	commitErr error
+}
+
+type testSQLiteConn struct {
+	driver  *testSQLiteDriver
+	db      *testSQLiteDB
+	pending []func()
+}
+
+type testSQLiteStmt struct {
+	conn  *testSQLiteConn
+	query string
+}
+
+type testSQLiteRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (driver_ *testSQLiteDriver) Open(name string) (driver.Conn, error) {
+	driver_.mtx.Lock()
+	defer driver_.mtx.Unlock()
+	db, ok := driver_.dbs[name]
+	if !ok {
+		db = &testSQLiteDB{chunks: make(map[int64][]driver.Value), records: make(map[int64][][]byte)}
+		driver_.dbs[name] = db
+	}
+	return &testSQLiteConn{driver: driver_, db: db}, nil
+}
+
+func (conn *testSQLiteConn) Prepare(query string) (driver.Stmt, error) {
+	return &testSQLiteStmt{conn, query}, nil
+}
+
+func (conn *testSQLiteConn) Close() error {
+	return nil
+}
+
+func (conn *testSQLiteConn) Begin() (driver.Tx, error) {
+	conn.pending = make([]func(), 0)
+	return conn, nil
+}
+
+func (conn *testSQLiteConn) Commit() error {
+	conn.driver.mtx.Lock()
+	defer conn.driver.mtx.Unlock()
+	pending := conn.pending
+	conn.pending = nil
+	if conn.db.commitErr != nil {
+		return conn.db.commitErr
+	}
+	for _, f := range pending {
+		f()
+	}
+	return nil
+}
+
+func (conn *testSQLiteConn) Rollback() error {
+	conn.pending = nil
+	return nil
+}
+
+func (stmt *testSQLiteStmt) Close() error {
+	return nil
+}
+
+func (stmt *testSQLiteStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *testSQLiteStmt) Exec(args []driver.Value) (driver.Result, error) {
+	conn := stmt.conn
+	db := conn.db
+	conn.driver.mtx.Lock()
+	defer conn.driver.mtx.Unlock()
+	var f func()
+	var id int64
+	switch {
+	case strings.HasPrefix(stmt.query, "CREATE TABLE"):
+	case strings.HasPrefix(stmt.query, "INSERT INTO chunks "):
+		db.lastId += 1
+		id = db.lastId
+		f = func() { db.chunks[id] = []driver.Value{id, args[0], args[1], args[2], int64(0)} }
+	case strings.HasPrefix(stmt.query, "INSERT INTO records "):
+		data := args[len(args)-1].([]byte)
+		chunk := args[0].(int64)
+		f = func() { db.records[chunk] = append(db.records[chunk], append([]byte(nil), data...)) }
+	case strings.HasPrefix(stmt.query, "UPDATE chunks SET sealed = 1 "):
+		f = func() { db.chunks[args[0].(int64)][4] = int64(1) }
+	case strings.HasPrefix(stmt.query, "DELETE FROM records "):
+		f = func() { delete(db.records, args[0].(int64)) }
+	case strings.HasPrefix(stmt.query, "DELETE FROM chunks "):
+		f = func() { delete(db.chunks, args[0].(int64)) }
+	default:
+		return nil, errors.New("unexpected statement: " + stmt.query)
+	}
+	if f != nil {
+		if conn.pending != nil {
+			conn.pending = append(conn.pending, f)
+		} else {
+			f()
+		}
+	}
+	return testSQLiteResult(id), nil
+}
+
+type testSQLiteResult int64
+
+func (result testSQLiteResult) LastInsertId() (int64, error) {
+	return int64(result), nil
+}
+
+func (result testSQLiteResult) RowsAffected() (int64, error) {
+	return 1, nil
+}
+
+func (stmt *testSQLiteStmt) Query(args []driver.Value) (driver.Rows, error) {
+	db := stmt.conn.db
+	stmt.conn.driver.mtx.Lock()
+	defer stmt.conn.driver.mtx.Unlock()
+	rows := &testSQLiteRows{rows: make([][]driver.Value, 0)}
+	switch {
+	case strings.HasPrefix(stmt.query, "SELECT id, "):
+		rows.columns = []string{"id", "journal", "unique_id", "timestamp", "sealed"}
+		for _, id := range db.chunkIds() {
+			rows.rows = append(rows.rows, append([]driver.Value(nil), db.chunks[id]...))
+		}
+	case strings.HasPrefix(stmt.query, "SELECT chunk, COUNT(*), "):
+		rows.columns = []string{"chunk", "count", "size"}
+		for _, id := range db.chunkIds() {
+			size := int64(0)
+			for _, data := range db.records[id] {
+				size += int64(len(data))
+			}
+			rows.rows = append(rows.rows, []driver.Value{id, int64(len(db.records[id])), size})
+		}
+	case strings.HasPrefix(stmt.query, "SELECT data FROM records "):
+		rows.columns = []string{"data"}
+		for _, data := range db.records[args[0].(int64)][args[1].(int64):] {
+			rows.rows = append(rows.rows, []driver.Value{data})
+		}
+	default:
+		return nil, errors.New("unexpected query: " + stmt.query)
+	}
+	return rows, nil
+}
+
+func (db *testSQLiteDB) chunkIds() []int64 {
+	retval := make([]int64, 0, len(db.chunks))
+	for id := range db.chunks {
+		retval = append(retval, id)
+	}
+	sort.Slice(retval, func(i, j int) bool { return retval[i] < retval[j] })
+	return retval
+}
+
+func (rows *testSQLiteRows) Columns() []string {
+	return rows.columns
+}
+
+func (rows *testSQLiteRows) Close() error {
+	return nil
+}
+
+func (rows *testSQLiteRows) Next(dest []driver.Value) error {
+	if len(rows.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, rows.rows[0])
+	rows.rows = rows.rows[1:]
+	return nil
+}
+
+var testSQLite = &testSQLiteDriver{dbs: make(map[string]*testSQLiteDB)}
+
+func init() {
+	sql.Register("ik-test-sqlite", testSQLite)
+}
+
+func newSQLiteJournalGroup(t *testing.T, path string, maxSize int64) *SQLiteJournalGroup {
+	logger := newTestLogger()
+	factory := NewSQLiteJournalGroupFactory(
+		logger,
+		"ik-test-sqlite",
+		rand.NewSource(0),
+		newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+		maxSize,
+	)
+	journalGroup, err := factory.GetJournalGroup(path, &DummyPluginInstance{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return journalGroup
+}
+
+func readSQLiteChunk(t *testing.T, chunk ik.JournalChunk) string {
+	reader, err := chunk.GetReader()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return string(data)
+}
+
+func Test_SQLiteJournal(t *testing.T) {
+	journalGroup := newSQLiteJournalGroup(t, "Test_SQLiteJournal", 10)
+	journal := journalGroup.GetJournal("key")
+	flushed := make([]string, 0)
+	journal.AddFlushListener(func(chunk ik.JournalChunk) error {
+		flushed = append(flushed, readSQLiteChunk(t, chunk))
+		return chunk.Dispose()
+	})
+	for _, data := range []string{"test1", "test2", "test3", "test4", "test5"} {
+		err := journal.Write([]byte(data))
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(flushed) != 2 || flushed[0] != "test1test2" || flushed[1] != "test3test4" {
+		t.Fatalf("%v", flushed)
+	}
+	db := testSQLite.dbs["Test_SQLiteJournal"]
+	if len(db.chunks) != 3 || db.chunks[1][4] != int64(1) || db.chunks[3][4] != int64(0) {
+		t.Fatalf("%v", db.chunks)
+	}
+	chunk := journal.GetTailChunk()
+	uniqueId := chunk.UniqueId()
+	if len(uniqueId) != 32 {
+		t.Fatalf("%s", uniqueId)
+	}
+	reader, at, err := ik.GetChunkReaderAt(chunk, 1)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	data, _ := ioutil.ReadAll(reader)
+	if string(data) != "test2" || at != 1 {
+		t.Fatalf("%s at %d", data, at)
+	}
+	// the oldest chunk is delivered and deleted
+	if !chunk.TakeOwnership() {
+		t.FailNow()
+	}
+	err = chunk.Dispose()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(db.chunks) != 2 || db.records[1] != nil {
+		t.Fatalf("%v", db.chunks)
+	}
+	err = journalGroup.Dispose()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the chunks are read back by the next run, and the one left unsealed
+	// is sealed by the next write
+	journalGroup = newSQLiteJournalGroup(t, "Test_SQLiteJournal", 10)
+	defer journalGroup.Dispose()
+	if keys := journalGroup.GetJournalKeys(); len(keys) != 1 || keys[0] != "key" {
+		t.Fatalf("%v", keys)
+	}
+	journal = journalGroup.GetJournal("key")
+	flushed = make([]string, 0)
+	journal.AddFlushListener(func(chunk ik.JournalChunk) error {
+		flushed = append(flushed, readSQLiteChunk(t, chunk))
+		return chunk.Dispose()
+	})
+	err = journal.Write([]byte("test6"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(flushed) != 1 || flushed[0] != "test5" {
+		t.Fatalf("%v", flushed)
+	}
+	contents := make([]string, 0)
+	err = journal.Flush(func(chunk ik.JournalChunk) error {
+		defer chunk.Dispose()
+		contents = append(contents, readSQLiteChunk(t, chunk))
+		chunk.TakeOwnership()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(contents) != 3 || contents[0] != "test3test4" || contents[2] != "test6" {
+		t.Fatalf("%v", contents)
+	}
+	if len(db.chunks) != 0 || len(db.records) != 0 || journal.GetTailChunk() != nil {
+		t.Fatalf("%v %v", db.chunks, db.records)
+	}
+}
+
+func Test_SQLiteJournal_FailedCommit(t *testing.T) {
+	journalGroup := newSQLiteJournalGroup(t, "Test_SQLiteJournal_FailedCommit", 10)
+	defer journalGroup.Dispose()
+	journal := journalGroup.GetJournal("key")
+	err := journal.Write([]byte("test1"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	db := testSQLite.dbs["Test_SQLiteJournal_FailedCommit"]
+	db.commitErr = errors.New("disk I/O error")
+	// neither the new chunk nor the sealing of the old one is committed
+	err = journal.Write([]byte("test2test3"))
+	if err == nil {
+		t.FailNow()
+	}
+	db.commitErr = nil
+	if len(db.chunks) != 1 || db.chunks[1][4] != int64(0) {
+		t.Fatalf("%v", db.chunks)
+	}
+	chunks := journal.Chunks()
+	defer chunks.Close()
+	if !chunks.Next() || readSQLiteChunk(t, chunks.Value()) != "test1" || chunks.Next() {
+		t.Fail()
+	}
+}
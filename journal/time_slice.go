@@ -0,0 +1,68 @@
+package journal
+
+import (
+	"github.com/moriyoshi/ik"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The separator of the time slice of a journal key, which encodeKey always
+// escapes in the keys themselves.
+const timeSliceSeparator = "@"
+
+// TimeSlicedKey returns the key of the journal of the records of key that
+// fall into the time slice starting at slice.  The start of the slice is
+// kept in the file names of the chunks, as the Unix time in seconds.
+func TimeSlicedKey(key string, slice time.Time) string {
+	return key + timeSliceSeparator + strconv.FormatInt(slice.Unix(), 10)
+}
+
+// SplitTimeSlicedKey splits a key made by TimeSlicedKey into the key and
+// the start of the time slice.  ok is false if the key has no time slice.
+func SplitTimeSlicedKey(journalKey string) (key string, slice time.Time, ok bool) {
+	i := strings.LastIndex(journalKey, timeSliceSeparator)
+	if i < 0 {
+		return journalKey, time.Time{}, false
+	}
+	seconds, err := strconv.ParseInt(journalKey[i+1:], 10, 64)
+	if err != nil {
+		return journalKey, time.Time{}, false
+	}
+	return journalKey[0:i], time.Unix(seconds, 0), true
+}
+
+// encodeJournalKey encodes a key for a file name, leaving the separator of
+// the time slice as it is.
+func encodeJournalKey(journalKey string) string {
+	key, slice, ok := SplitTimeSlicedKey(journalKey)
+	if !ok {
+		return encodeKey(journalKey)
+	}
+	return encodeKey(key) + timeSliceSeparator + strconv.FormatInt(slice.Unix(), 10)
+}
+
+// TimeSlice returns the start of the time slice of the journal of the
+// chunk, if it has one.
+func (wrapper *FileJournalChunkWrapper) TimeSlice() (time.Time, bool) {
+	_, slice, ok := SplitTimeSlicedKey(wrapper.journal.key)
+	return slice, ok
+}
+
+// SetTimeSlice makes the journal groups created afterwards slice the keys
+// given to SliceKey by the given length of time.  The slices of a day
+// follow the days in location.
+func (factory *FileJournalGroupFactory) SetTimeSlice(timeSlice time.Duration, location *time.Location) {
+	factory.timeSlice = timeSlice
+	factory.timeSliceLocation = location
+}
+
+// SliceKey returns the key of the journal of the records of key that fall
+// into the same time slice as t, or key itself if the group has no time
+// slices.
+func (journalGroup *FileJournalGroup) SliceKey(key string, t time.Time) string {
+	if journalGroup.timeSlice <= 0 {
+		return key
+	}
+	return TimeSlicedKey(key, ik.TimeSlot(t.In(journalGroup.timeSliceLocation), journalGroup.timeSlice))
+}
@@ -0,0 +1,76 @@
+package journal
+
+import (
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func Test_SplitTimeSlicedKey(t *testing.T) {
+	slice := time.Date(2014, 1, 1, 0, 5, 0, 0, time.UTC)
+	key, slice_, ok := SplitTimeSlicedKey(TimeSlicedKey("a@b", slice))
+	if !ok || key != "a@b" || !slice_.Equal(slice) {
+		t.Fatalf("%s %v %v", key, slice_, ok)
+	}
+	key, _, ok = SplitTimeSlicedKey("a@b")
+	if ok || key != "a@b" {
+		t.Fatalf("%s %v", key, ok)
+	}
+}
+
+func Test_JournalGroup_TimeSlice(t *testing.T) {
+	logger := newTestLogger()
+	tempDir, err := ioutil.TempDir("", "ik.journal")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	newFactory := func() *FileJournalGroupFactory {
+		factory := NewFileJournalGroupFactory(
+			logger,
+			rand.NewSource(0),
+			newTestClock(func() time.Time { return time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC) }),
+			".log",
+			os.FileMode(0644),
+			1024,
+		)
+		factory.SetTimeSlice(5*time.Minute, time.UTC)
+		return factory
+	}
+	journalGroup, err := newFactory().GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	key := journalGroup.SliceKey("a@b", time.Date(2014, 1, 1, 0, 7, 0, 0, time.UTC))
+	if key != journalGroup.SliceKey("a@b", time.Date(2014, 1, 1, 0, 5, 0, 0, time.UTC)) || key == journalGroup.SliceKey("a@b", time.Date(2014, 1, 1, 0, 10, 0, 0, time.UTC)) {
+		t.Fatal(key)
+	}
+	journal := journalGroup.GetFileJournal(key)
+	err = journal.Write([]byte("test"))
+	if err != nil {
+		t.FailNow()
+	}
+	chunk := journal.newChunkWrapper(journal.chunks.first)
+	slice, ok := chunk.TimeSlice()
+	chunk.Dispose()
+	if !ok || !slice.Equal(time.Date(2014, 1, 1, 0, 5, 0, 0, time.UTC)) {
+		t.Fatalf("%v %v", slice, ok)
+	}
+	err = journalGroup.Dispose()
+	if err != nil {
+		t.FailNow()
+	}
+
+	// the slice is read back from the file name
+	journalGroup, err = newFactory().GetJournalGroup(tempDir+"/test", &DummyPluginInstance{})
+	if err != nil {
+		t.FailNow()
+	}
+	defer journalGroup.Dispose()
+	keys := journalGroup.GetJournalKeys()
+	if len(keys) != 1 || keys[0] != key {
+		t.Fatalf("%v", keys)
+	}
+}
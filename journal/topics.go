@@ -0,0 +1,256 @@
+package journal
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type FileJournalGroupStats struct {
+	Journals        int
+	Chunks          int
+	BufferedBytes   int64
+	OldestChunkTime time.Time // zero if there is no chunk
+	WriteErrors     int64
+	Evictions       int64
+	FreeSpace       int64 // -1 if unknown
+	Dropped         int64
+	Expired         int64
+	Compacted       int64
+}
+
+type journalGroupTopic struct {
+	render func(group *FileJournalGroup, stats FileJournalGroupStats) string
+	groups map[ik.PluginInstance][]*FileJournalGroup
+	mtx    sync.Mutex
+}
+
+func (journalGroup *FileJournalGroup) Stats() FileJournalGroupStats {
+	journalGroup.mtx.Lock()
+	journals := make([]*FileJournal, 0, len(journalGroup.journals)+len(journalGroup.idle))
+	for _, journal := range journalGroup.journals {
+		journals = append(journals, journal)
+	}
+	open := len(journals)
+	// the chunks of the evicted journals are still in the buffer
+	for _, journal := range journalGroup.idle {
+		journals = append(journals, journal)
+	}
+	journalGroup.mtx.Unlock()
+
+	stats := FileJournalGroupStats{
+		Journals:    open,
+		WriteErrors: atomic.LoadInt64(&journalGroup.writeErrors),
+		Evictions:   journalGroup.Evictions(),
+		FreeSpace:   -1,
+		Dropped:     journalGroup.Dropped(),
+		Expired:     journalGroup.Expired(),
+		Compacted:   journalGroup.Compacted(),
+	}
+	if journalGroup.watchdog != nil {
+		stats.FreeSpace = journalGroup.watchdog.Free()
+	}
+	oldest := int64(-1)
+	for _, journal := range journals {
+		journal.chunks.mtx.Lock()
+		for chunk := journal.chunks.first; chunk != nil; chunk = chunk.head.next {
+			stats.Chunks += 1
+			stats.BufferedBytes += atomic.LoadInt64(&chunk.Size)
+			if oldest < 0 || chunk.Timestamp < oldest {
+				oldest = chunk.Timestamp
+			}
+		}
+		journal.chunks.mtx.Unlock()
+	}
+	if oldest >= 0 {
+		stats.OldestChunkTime = time.Unix(oldest/1000000, (oldest%1000000)*1000)
+	}
+	return stats
+}
+
+func (topic *journalGroupTopic) add(pluginInstance ik.PluginInstance, journalGroup *FileJournalGroup) {
+	topic.mtx.Lock()
+	defer topic.mtx.Unlock()
+	topic.groups[pluginInstance] = append(topic.groups[pluginInstance], journalGroup)
+}
+
+func (topic *journalGroupTopic) remove(pluginInstance ik.PluginInstance, journalGroup *FileJournalGroup) {
+	topic.mtx.Lock()
+	defer topic.mtx.Unlock()
+	groups := topic.groups[pluginInstance]
+	for i, group := range groups {
+		if group == journalGroup {
+			groups = append(groups[:i:i], groups[i+1:]...)
+			break
+		}
+	}
+	if len(groups) == 0 {
+		delete(topic.groups, pluginInstance)
+	} else {
+		topic.groups[pluginInstance] = groups
+	}
+}
+
+func (topic *journalGroupTopic) PlainText(pluginInstance ik.PluginInstance) (string, error) {
+	topic.mtx.Lock()
+	groups := topic.groups[pluginInstance]
+	topic.mtx.Unlock()
+	if len(groups) == 0 {
+		return "", errors.New("no journal group is bound to the plugin instance")
+	}
+	text := ""
+	for i, group := range groups {
+		if i > 0 {
+			text += ", "
+		}
+		text += topic.render(group, group.Stats())
+	}
+	return text, nil
+}
+
+func (topic *journalGroupTopic) Markup(pluginInstance ik.PluginInstance) (ik.Markup, error) {
+	text, err := topic.PlainText(pluginInstance)
+	if err != nil {
+		return ik.Markup{}, err
+	}
+	return ik.Markup{[]ik.MarkupChunk{{Text: text}}}, nil
+}
+
+var journalGroupTopics = []struct {
+	name        string
+	displayName string
+	description string
+	render      func(group *FileJournalGroup, stats FileJournalGroupStats) string
+}{
+	{
+		"buffered_bytes",
+		"Buffered bytes",
+		"Total size of the chunks held in the buffer",
+		func(_ *FileJournalGroup, stats FileJournalGroupStats) string {
+			return strconv.FormatInt(stats.BufferedBytes, 10)
+		},
+	},
+	{
+		"chunks",
+		"Chunks",
+		"Number of chunks held in the buffer",
+		func(_ *FileJournalGroup, stats FileJournalGroupStats) string {
+			return strconv.Itoa(stats.Chunks)
+		},
+	},
+	{
+		"oldest_chunk_age",
+		"Oldest chunk age",
+		"Time elapsed since the oldest chunk in the buffer was created",
+		func(group *FileJournalGroup, stats FileJournalGroupStats) string {
+			if stats.OldestChunkTime.IsZero() {
+				return "-"
+			}
+			return group.clock.Now().Sub(stats.OldestChunkTime).String()
+		},
+	},
+	{
+		"anomalies",
+		"Anomalies",
+		"Number of problems found in the buffer directory, such as an interrupted roll-over or an incomplete frame",
+		func(group *FileJournalGroup, _ FileJournalGroupStats) string {
+			report, err := inspect(group.pathPrefix, group.pathSuffix)
+			if err != nil {
+				return err.Error()
+			}
+			return strconv.Itoa(report.Count())
+		},
+	},
+	{
+		"write_errors",
+		"Write errors",
+		"Number of writes to the buffer that failed",
+		func(_ *FileJournalGroup, stats FileJournalGroupStats) string {
+			return strconv.FormatInt(stats.WriteErrors, 10)
+		},
+	},
+	{
+		"journal_evictions",
+		"Journal evictions",
+		"Number of idle journals closed to keep no more than max_journals open",
+		func(_ *FileJournalGroup, stats FileJournalGroupStats) string {
+			return strconv.FormatInt(stats.Evictions, 10)
+		},
+	},
+	{
+		"free_space",
+		"Free space",
+		"Bytes left on the filesystem hosting the buffer, as last checked",
+		func(group *FileJournalGroup, stats FileJournalGroupStats) string {
+			if stats.FreeSpace < 0 {
+				return "-"
+			}
+			text := strconv.FormatInt(stats.FreeSpace, 10)
+			if group.watchdog.Low() {
+				text += " (low)"
+			}
+			return text
+		},
+	},
+	{
+		"dropped_writes",
+		"Dropped writes",
+		"Number of writes to the buffer dropped while the free space was low",
+		func(_ *FileJournalGroup, stats FileJournalGroupStats) string {
+			return strconv.FormatInt(stats.Dropped, 10)
+		},
+	},
+	{
+		"expired_chunks",
+		"Expired chunks",
+		"Number of chunks given up undelivered for being older than buffer_max_age or beyond buffer_max_total_bytes",
+		func(_ *FileJournalGroup, stats FileJournalGroupStats) string {
+			return strconv.FormatInt(stats.Expired, 10)
+		},
+	},
+	{
+		"compacted_chunks",
+		"Compacted chunks",
+		"Number of chunks smaller than buffer_compact_threshold merged into others",
+		func(_ *FileJournalGroup, stats FileJournalGroupStats) string {
+			return strconv.FormatInt(stats.Compacted, 10)
+		},
+	},
+}
+
+func bindJournalGroupTopics(scorekeeper *ik.Scorekeeper, journalGroup *FileJournalGroup) {
+	plugin := journalGroup.pluginInstance.Factory()
+	for _, spec := range journalGroupTopics {
+		// share a fetcher among every instance of the plugin, as topics
+		// are registered per plugin
+		fetcher := scorekeeper.AddTopicIfAbsent(ik.ScorekeeperTopic{
+			Plugin:      plugin,
+			Name:        spec.name,
+			DisplayName: spec.displayName,
+			Description: spec.description,
+			Fetcher: &journalGroupTopic{
+				render: spec.render,
+				groups: make(map[ik.PluginInstance][]*FileJournalGroup),
+				mtx:    sync.Mutex{},
+			},
+		})
+		topic, ok := fetcher.(*journalGroupTopic)
+		if !ok {
+			continue
+		}
+		topic.add(journalGroup.pluginInstance, journalGroup)
+		journalGroup.topics = append(journalGroup.topics, topic)
+	}
+}
+
+// unbindJournalGroupTopics stops the topics from reporting the group, so
+// that the groups replaced by a reload are not kept alive by them.
+func unbindJournalGroupTopics(journalGroup *FileJournalGroup) {
+	for _, topic := range journalGroup.topics {
+		topic.remove(journalGroup.pluginInstance, journalGroup)
+	}
+	journalGroup.topics = nil
+}
@@ -0,0 +1,79 @@
+package ik
+
+import (
+	"reflect"
+)
+
+// ErrorLabel is the label the records any plugin gave up on are emitted
+// at, with the tags they had, if the configuration has one.  It comes
+// before the dead letter tag.
+const ErrorLabel = "@ERROR"
+
+// Label returns the router of the label of the given name, which has
+// filters and outputs of its own, creating it if there is none yet.  A
+// label is given records by the inputs and outputs having it as their
+// @label, and shares the panic handler, the tracer, the flow meter and the
+// limits of the router it belongs to.
+func (router *FluentRouter) Label(name string) *FluentRouter {
+	router.mtx.Lock()
+	defer router.mtx.Unlock()
+	label, ok := router.labels[name]
+	if !ok {
+		label = NewFluentRouter()
+		label.parent = router
+		router.labels[name] = label
+	}
+	return label
+}
+
+// LookupLabel returns the router of the label of the given name, or nil if
+// there is none.
+func (router *FluentRouter) LookupLabel(name string) *FluentRouter {
+	router.mtx.RLock()
+	defer router.mtx.RUnlock()
+	return router.labels[name]
+}
+
+// root returns the router the label belongs to, or the router itself if it
+// is not a label.
+func (router *FluentRouter) root() *FluentRouter {
+	router.mtx.RLock()
+	parent := router.parent
+	router.mtx.RUnlock()
+	if parent == nil {
+		return router
+	}
+	return parent
+}
+
+// addMember records that the plugin instance routes records within the
+// label.
+func (router *FluentRouter) addMember(pluginInstance PluginInstance) {
+	router.mtx.Lock()
+	defer router.mtx.Unlock()
+	router.members = append(router.members, pluginInstance)
+}
+
+// owns tells whether the plugin routes records within the label.
+func (router *FluentRouter) owns(plugin interface{}) bool {
+	if plugin == nil || !reflect.TypeOf(plugin).Comparable() {
+		return false
+	}
+	router.mtx.RLock()
+	defer router.mtx.RUnlock()
+	for _, member := range router.members {
+		if member == plugin {
+			return true
+		}
+	}
+	return false
+}
+
+// labelEngine returns the engine to create a plugin with whose default
+// port is the label.
+func labelEngine(engine Engine, label *FluentRouter) Engine {
+	return &portEngine{
+		Engine: engine,
+		port:   label,
+	}
+}
@@ -0,0 +1,82 @@
+package ik
+
+import (
+	"errors"
+	"github.com/op/go-logging"
+	"testing"
+	"time"
+)
+
+func TestLabel(t *testing.T) {
+	data := `<source>
+  type forward
+  @id forward_in
+  @label @app
+</source>
+<match **>
+  type stdout
+  @id main
+</match>
+<label @app>
+  <match app.**>
+    type stdout
+    @id app
+  </match>
+</label>
+<label @ERROR>
+  <match **>
+    type file
+    @id errors
+  </match>
+</label>`
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	harness, err := NewHarness(logging.MustGetLogger("ik"), myOpener(data), nil, nil, config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer harness.Dispose()
+	recordSets := []FluentRecordSet{{Tag: "app.web", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}}}
+	err = harness.Emit("forward_in", recordSets)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(harness.Output("app").RecordSets()) != 1 || len(harness.Output("main").RecordSets()) != 0 {
+		t.Fatal("the records of the input did not go to its label only")
+	}
+
+	// the records given up on reach @ERROR with their tags
+	harness.engine.DeadLetter(harness.Output("app"), errors.New("rejected"), recordSets)
+	var errorRecordSets []FluentRecordSet
+	for i := 0; i < 100 && len(errorRecordSets) == 0; i += 1 {
+		time.Sleep(10 * time.Millisecond)
+		errorRecordSets = harness.Output("errors").RecordSets()
+	}
+	if len(errorRecordSets) != 1 || errorRecordSets[0].Tag != "app.web" || errorRecordSets[0].Records[0].Timestamp != 1 {
+		t.Fatalf("%v", errorRecordSets)
+	}
+	// but not again from within @ERROR
+	harness.engine.DeadLetter(harness.Output("errors"), errors.New("rejected"), recordSets)
+	time.Sleep(20 * time.Millisecond)
+	if len(harness.Output("errors").RecordSets()) != 1 {
+		t.Fail()
+	}
+
+	for _, data := range []string{
+		"<source>\ntype forward\n@label @none\n</source>\n",
+		"<label @app>\n</label>\n<label @app>\n</label>\n",
+		"<label @app>\n<source>\ntype forward\n</source>\n</label>\n",
+	} {
+		config, err := ParseConfig(myOpener(data), "test.cfg")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = NewHarness(logging.MustGetLogger("ik"), myOpener(data), nil, nil, config)
+		if err == nil {
+			t.Logf("%q accepted", data)
+			t.Fail()
+		}
+	}
+}
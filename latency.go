@@ -0,0 +1,140 @@
+package ik
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The latencies are counted in buckets the way HDR histograms do: each
+// power of two of microseconds is split into latencySubBuckets linear
+// buckets, which keeps the error of a percentile within 1/latencySubBuckets.
+const (
+	latencySubBits    = 3
+	latencySubBuckets = 1 << latencySubBits
+	latencyBuckets    = (64 - latencySubBits + 1) * latencySubBuckets
+)
+
+func latencyBucket(v uint64) int {
+	if v < latencySubBuckets {
+		return int(v)
+	}
+	e := uint(0)
+	for (v >> e) >= latencySubBuckets*2 {
+		e += 1
+	}
+	return int(e+1)*latencySubBuckets + int(v>>e) - latencySubBuckets
+}
+
+// latencyBucketUpperBound returns the largest value counted in the bucket.
+func latencyBucketUpperBound(i int) uint64 {
+	if i < latencySubBuckets {
+		return uint64(i)
+	}
+	e := uint(i/latencySubBuckets - 1)
+	m := uint64(i%latencySubBuckets + latencySubBuckets)
+	return ((m + 1) << e) - 1
+}
+
+type latencySlot struct {
+	epoch  int64
+	counts [latencyBuckets]uint64
+}
+
+// LatencyWindow keeps the distribution of the latencies observed within
+// the last window, which is divided into slots that expire one at a time.
+type LatencyWindow struct {
+	slotDuration time.Duration
+	slots        []latencySlot
+	clock        Clock
+	mtx          sync.Mutex
+}
+
+func (window *LatencyWindow) slot(now time.Time) *latencySlot {
+	epoch := now.UnixNano() / int64(window.slotDuration)
+	slot := &window.slots[epoch%int64(len(window.slots))]
+	if slot.epoch != epoch {
+		slot.epoch = epoch
+		slot.counts = [latencyBuckets]uint64{}
+	}
+	return slot
+}
+
+func (window *LatencyWindow) Observe(latency time.Duration) {
+	if latency < 0 {
+		latency = 0
+	}
+	window.mtx.Lock()
+	defer window.mtx.Unlock()
+	window.slot(window.clock.Now()).counts[latencyBucket(uint64(latency/time.Microsecond))] += 1
+}
+
+// Since observes the time elapsed since start, as told by the clock of
+// the window.
+func (window *LatencyWindow) Since(start time.Time) {
+	window.Observe(window.clock.Now().Sub(start))
+}
+
+// Percentiles returns the latencies below which the given percentages of
+// the latencies observed within the window fall, or nil if nothing has been
+// observed.
+func (window *LatencyWindow) Percentiles(percentages ...float64) []time.Duration {
+	window.mtx.Lock()
+	now := window.clock.Now()
+	current := window.slot(now).epoch
+	counts := [latencyBuckets]uint64{}
+	total := uint64(0)
+	for i, _ := range window.slots {
+		slot := &window.slots[i]
+		if current-slot.epoch >= int64(len(window.slots)) {
+			continue
+		}
+		for j, count := range slot.counts {
+			counts[j] += count
+			total += count
+		}
+	}
+	window.mtx.Unlock()
+	if total == 0 {
+		return nil
+	}
+	retval := make([]time.Duration, len(percentages))
+	for i, percentage := range percentages {
+		rank := uint64(percentage / 100. * float64(total))
+		if rank < 1 {
+			rank = 1
+		}
+		seen := uint64(0)
+		for j, count := range counts {
+			seen += count
+			if seen >= rank {
+				retval[i] = time.Duration(latencyBucketUpperBound(j)) * time.Microsecond
+				break
+			}
+		}
+	}
+	return retval
+}
+
+func (window *LatencyWindow) String() string {
+	percentiles := window.Percentiles(50, 95, 99)
+	if percentiles == nil {
+		return "-"
+	}
+	return fmt.Sprintf("p50=%s p95=%s p99=%s", percentiles[0].String(), percentiles[1].String(), percentiles[2].String())
+}
+
+// NewLatencyWindow creates a window of the given size divided into the
+// given number of slots, telling the time by clock.
+func NewLatencyWindow(window time.Duration, slots int, clock Clock) *LatencyWindow {
+	return &LatencyWindow{
+		slotDuration: window / time.Duration(slots),
+		slots:        make([]latencySlot, slots),
+		clock:        clock,
+	}
+}
+
+// NewDefaultLatencyWindow creates a window of the last minute.
+func NewDefaultLatencyWindow(clock Clock) *LatencyWindow {
+	return NewLatencyWindow(time.Minute, 6, clock)
+}
@@ -0,0 +1,55 @@
+package ik
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	last := -1
+	for _, v := range []uint64{0, 7, 8, 15, 16, 17, 1000, 1 << 40, ^uint64(0)} {
+		i := latencyBucket(v)
+		if i < last || i >= latencyBuckets {
+			t.Fatalf("%d: %d", v, i)
+		}
+		last = i
+		upper := latencyBucketUpperBound(i)
+		if upper < v || float64(upper-v) > float64(v)/latencySubBuckets {
+			t.Errorf("%d: %d", v, upper)
+		}
+	}
+}
+
+func TestLatencyWindow(t *testing.T) {
+	clock := &tenantTestClock{now: time.Unix(1000, 0)}
+	window := NewLatencyWindow(time.Minute, 6, clock)
+	if window.Percentiles(50) != nil || window.String() != "-" {
+		t.Fail()
+	}
+	for i := 1; i <= 100; i += 1 {
+		window.Observe(time.Duration(i) * time.Millisecond)
+	}
+	percentiles := window.Percentiles(50, 99)
+	if percentiles[0] < 50*time.Millisecond || percentiles[0] > 57*time.Millisecond {
+		t.Errorf("%s", percentiles[0].String())
+	}
+	if percentiles[1] < 99*time.Millisecond || percentiles[1] > 112*time.Millisecond {
+		t.Errorf("%s", percentiles[1].String())
+	}
+
+	// the tail observed later stays in the window after the rest expires
+	clock.now = clock.now.Add(30 * time.Second)
+	window.Observe(time.Second)
+	if window.Percentiles(100)[0] < time.Second {
+		t.Fail()
+	}
+	clock.now = clock.now.Add(40 * time.Second)
+	percentiles = window.Percentiles(50)
+	if percentiles[0] < time.Second {
+		t.Errorf("%s", percentiles[0].String())
+	}
+	clock.now = clock.now.Add(time.Minute)
+	if window.Percentiles(50) != nil {
+		t.Fail()
+	}
+}
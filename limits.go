@@ -0,0 +1,147 @@
+package ik
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Limits protect the pipeline from pathological records, e.g. a single log
+// line of several megabytes.  They are enforced by the router on every
+// emit, at the inputs and at the filters alike, by a <limits> element at
+// the top level of the configuration:
+//
+//	<limits>
+//	  max_record_size 1m           # the size of a record, 0 for no limit
+//	  max_records_per_emit 10000   # the records of an emit, 0 for no limit
+//	</limits>
+//
+// The records beyond the limits are not emitted but handed over to the
+// dead-letter queue.  A record too large is replaced there by its size.
+type Limits struct {
+	MaxRecordSize     int64
+	MaxRecordsPerEmit int
+}
+
+// RecordSize returns the approximate size of the data of a record, which
+// is that of its keys and strings plus 8 bytes for every other value.  It
+// does not encode the record, which would be as costly as the record is
+// large.
+func RecordSize(data map[string]interface{}) int64 {
+	retval := int64(0)
+	for k, v := range data {
+		retval += int64(len(k)) + valueSize(v)
+	}
+	return retval
+}
+
+func valueSize(v interface{}) int64 {
+	switch v_ := v.(type) {
+	case string:
+		return int64(len(v_))
+	case []byte:
+		return int64(len(v_))
+	case map[string]interface{}:
+		return RecordSize(v_)
+	case []interface{}:
+		retval := int64(0)
+		for _, elem := range v_ {
+			retval += valueSize(elem)
+		}
+		return retval
+	}
+	return 8
+}
+
+// rejectedRecords are the records the limits kept from being emitted,
+// along with why.
+type rejectedRecords struct {
+	cause      error
+	recordSets []FluentRecordSet
+}
+
+// enforce returns the record sets within the limits, the indices they had
+// among the ones given, and the records rejected.  A record set losing any
+// of its records loses its packed entries as well.
+func (limits *Limits) enforce(recordSets []FluentRecordSet) ([]FluentRecordSet, []int, []rejectedRecords) {
+	var tooLarge, tooMany []FluentRecordSet
+	retval := make([]FluentRecordSet, 0, len(recordSets))
+	indices := make([]int, 0, len(recordSets))
+	count := 0
+	for i, recordSet := range recordSets {
+		var kept []TinyFluentRecord
+		for j, record := range recordSet.Records {
+			var rejected *[]FluentRecordSet
+			if limits.MaxRecordsPerEmit > 0 && count >= limits.MaxRecordsPerEmit {
+				rejected = &tooMany
+			} else if limits.MaxRecordSize > 0 {
+				size := RecordSize(record.Data)
+				if size > limits.MaxRecordSize {
+					rejected = &tooLarge
+					record = TinyFluentRecord{Timestamp: record.Timestamp, Data: map[string]interface{}{"size": size}}
+				}
+			}
+			if rejected == nil {
+				count += 1
+				if kept != nil {
+					kept = append(kept, record)
+				}
+				continue
+			}
+			if kept == nil {
+				kept = append(make([]TinyFluentRecord, 0, len(recordSet.Records)), recordSet.Records[0:j]...)
+			}
+			if len(*rejected) == 0 || (*rejected)[len(*rejected)-1].Tag != recordSet.Tag {
+				*rejected = append(*rejected, FluentRecordSet{Tag: recordSet.Tag})
+			}
+			last := &(*rejected)[len(*rejected)-1]
+			last.Records = append(last.Records, record)
+		}
+		if kept != nil {
+			if len(kept) == 0 {
+				continue
+			}
+			recordSet.Records = kept
+			recordSet.Packed = nil
+		}
+		retval = append(retval, recordSet)
+		indices = append(indices, i)
+	}
+	rejected := make([]rejectedRecords, 0)
+	if len(tooLarge) > 0 {
+		rejected = append(rejected, rejectedRecords{errors.New(fmt.Sprintf("record exceeds max_record_size of %d bytes", limits.MaxRecordSize)), tooLarge})
+	}
+	if len(tooMany) > 0 {
+		rejected = append(rejected, rejectedRecords{errors.New(fmt.Sprintf("emit exceeds max_records_per_emit of %d records", limits.MaxRecordsPerEmit)), tooMany})
+	}
+	return retval, indices, rejected
+}
+
+// ParseLimits reads the <limits> element of the configuration, and returns
+// nil if there is none.
+func ParseLimits(config *Config) (*Limits, error) {
+	for _, v := range config.Root.Elems {
+		if v.Name != "limits" {
+			continue
+		}
+		limits := &Limits{}
+		maxRecordSizeStr, ok := v.Attrs["max_record_size"]
+		if ok {
+			var err error
+			limits.MaxRecordSize, err = ParseCapacityString(maxRecordSizeStr)
+			if err != nil || limits.MaxRecordSize < 0 {
+				return nil, errors.New(fmt.Sprintf("invalid max_record_size: %s", maxRecordSizeStr))
+			}
+		}
+		maxRecordsPerEmitStr, ok := v.Attrs["max_records_per_emit"]
+		if ok {
+			var err error
+			limits.MaxRecordsPerEmit, err = strconv.Atoi(maxRecordsPerEmitStr)
+			if err != nil || limits.MaxRecordsPerEmit < 0 {
+				return nil, errors.New(fmt.Sprintf("invalid max_records_per_emit: %s", maxRecordsPerEmitStr))
+			}
+		}
+		return limits, nil
+	}
+	return nil, nil
+}
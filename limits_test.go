@@ -0,0 +1,72 @@
+package ik
+
+import (
+	"testing"
+)
+
+func TestParseLimits(t *testing.T) {
+	config, err := ParseConfig(myOpener("<limits>\nmax_record_size 1k\nmax_records_per_emit 100\n</limits>\n"), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	limits, err := ParseLimits(config)
+	if err != nil || limits == nil || limits.MaxRecordSize != 1000 || limits.MaxRecordsPerEmit != 100 {
+		t.Fatalf("%v %v", limits, err)
+	}
+	for _, attrs := range []string{"max_record_size x\n", "max_records_per_emit -1\n"} {
+		config, err := ParseConfig(myOpener("<limits>\n"+attrs+"</limits>\n"), "test.cfg")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = ParseLimits(config)
+		if err == nil {
+			t.Logf("%q accepted", attrs)
+			t.Fail()
+		}
+	}
+}
+
+func TestRecordSize(t *testing.T) {
+	size := RecordSize(map[string]interface{}{"message": "hello", "n": 1, "tags": []interface{}{"a", "bc"}, "nested": map[string]interface{}{"k": []byte("vv")}})
+	if size != 7+5+1+8+4+3+6+1+2 {
+		t.Fatalf("%d", size)
+	}
+}
+
+func TestFluentRouter_Limits(t *testing.T) {
+	router := NewFluentRouter()
+	output := &recordingPort{}
+	router.AddRule("**", output)
+	rejected := make(map[string][]FluentRecordSet)
+	router.SetRejectHandler(func(cause error, recordSets []FluentRecordSet) {
+		rejected[cause.Error()] = append(rejected[cause.Error()], recordSets...)
+	})
+	router.SetLimits(&Limits{MaxRecordSize: 10, MaxRecordsPerEmit: 3})
+	large := map[string]interface{}{"message": "a line far too long"}
+	results := router.EmitWithResult([]FluentRecordSet{
+		{Tag: "a", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"m": "1"}}, {Timestamp: 2, Data: large}}, Packed: []byte("packed")},
+		{Tag: "b", Records: []TinyFluentRecord{{Timestamp: 3, Data: large}}},
+		{Tag: "c", Records: []TinyFluentRecord{{Timestamp: 4, Data: map[string]interface{}{"m": "4"}}, {Timestamp: 5, Data: map[string]interface{}{"m": "5"}}, {Timestamp: 6, Data: map[string]interface{}{"m": "6"}}}},
+	})
+	if len(results) != 3 || FirstError(results) != nil {
+		t.Fatalf("%v", results)
+	}
+	if len(output.recordSets) != 2 || output.recordSets[0].Tag != "a" || len(output.recordSets[0].Records) != 1 || output.recordSets[0].Packed != nil || output.recordSets[1].Tag != "c" || len(output.recordSets[1].Records) != 2 {
+		t.Fatalf("%v", output.recordSets)
+	}
+	tooLarge := rejected["record exceeds max_record_size of 10 bytes"]
+	if len(tooLarge) != 2 || tooLarge[0].Tag != "a" || tooLarge[1].Tag != "b" || tooLarge[1].Records[0].Data["size"] != int64(26) {
+		t.Fatalf("%v", rejected)
+	}
+	tooMany := rejected["emit exceeds max_records_per_emit of 3 records"]
+	if len(tooMany) != 1 || tooMany[0].Tag != "c" || tooMany[0].Records[0].Timestamp != 6 {
+		t.Fatalf("%v", rejected)
+	}
+
+	// the records within the limits are left as they are
+	router.SetLimits(nil)
+	router.Emit([]FluentRecordSet{{Tag: "b", Records: []TinyFluentRecord{{Timestamp: 7, Data: large}}}})
+	if len(output.recordSets) != 3 || len(output.recordSets[2].Records) != 1 {
+		t.Fatalf("%v", output.recordSets)
+	}
+}
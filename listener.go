@@ -0,0 +1,316 @@
+package ik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// InheritedListenersEnv names the environment variable through which a
+// process replacing itself, or handing off to another, passes its
+// listening sockets.  The value is a list of network/address=fd separated
+// by semicolons.
+const InheritedListenersEnv = "IK_INHERITED_LISTENERS"
+
+type registeredListener struct {
+	net.Listener
+	key string
+}
+
+// ListenAddress is where an input listens: a TCP address, of either or
+// both of the address families, or a unix domain socket, whose address
+// starts with "@" if it is an abstract one.  The socket is tuned by Options
+// unless it is nil.
+type ListenAddress struct {
+	Network    string
+	Address    string
+	SocketMode os.FileMode
+	Options    *SocketOptions
+}
+
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// ListenerHandover holds duplicates of the listening sockets, which stay
+// open after the listeners themselves are closed.
+type ListenerHandover struct {
+	keys  []string
+	files []*os.File
+}
+
+var listeners = struct {
+	once      sync.Once
+	inherited map[string]*os.File
+	active    map[string]*registeredListener
+	mtx       sync.Mutex
+}{
+	inherited: make(map[string]*os.File),
+	active:    make(map[string]*registeredListener),
+}
+
+func loadInheritedListeners() {
+	value := os.Getenv(InheritedListenersEnv)
+	os.Unsetenv(InheritedListenersEnv)
+	if value == "" {
+		return
+	}
+	for _, entry := range strings.Split(value, ";") {
+		i := strings.LastIndex(entry, "=")
+		if i < 0 {
+			continue
+		}
+		fd, err := strconv.Atoi(entry[i+1:])
+		if err != nil {
+			continue
+		}
+		listeners.inherited[entry[0:i]] = os.NewFile(uintptr(fd), entry[0:i])
+	}
+}
+
+func (listener *registeredListener) Close() error {
+	listeners.mtx.Lock()
+	if listeners.active[listener.key] == listener {
+		delete(listeners.active, listener.key)
+	}
+	listeners.mtx.Unlock()
+	return listener.Listener.Close()
+}
+
+// Listen is like net.Listen, except that it takes over the socket listening
+// on the same network and address left by the process it replaced, if any.
+func Listen(network string, address string) (net.Listener, error) {
+	return listen(network, address, nil)
+}
+
+// listen is Listen with the options of a new socket; the one taken over
+// keeps those it has.
+func listen(network string, address string, options *SocketOptions) (net.Listener, error) {
+	listeners.once.Do(loadInheritedListeners)
+	key := network + "/" + address
+	listeners.mtx.Lock()
+	defer listeners.mtx.Unlock()
+	var listener net.Listener
+	var err error
+	file, ok := listeners.inherited[key]
+	if ok {
+		delete(listeners.inherited, key)
+		listener, err = net.FileListener(file)
+		file.Close()
+		// the socket file is now this process's to remove
+		unixListener, ok := listener.(*net.UnixListener)
+		if ok {
+			unixListener.SetUnlinkOnClose(true)
+		}
+	} else {
+		listenConfig := options.listenConfig()
+		listener, err = listenConfig.Listen(context.Background(), network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	retval := &registeredListener{listener, key}
+	listeners.active[key] = retval
+	return retval, nil
+}
+
+func (address *ListenAddress) String() string {
+	if address.Network == "unix" {
+		return "unix:" + address.Address
+	}
+	return address.Address
+}
+
+// removeStaleSocket removes the socket file at path if nothing listens on
+// it, as when the process that did is gone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return errors.New("another process listens on " + path)
+	}
+	return os.Remove(path)
+}
+
+// ListenAt listens at address by Listen, with the socket options of the
+// address.  The file of a unix domain socket
+// left by a process that is gone is removed first, unless the socket is
+// handed over, and the new one is given the socket mode of the address.
+func ListenAt(address *ListenAddress) (net.Listener, error) {
+	unixPath := address.Network == "unix" && !strings.HasPrefix(address.Address, "@")
+	if unixPath {
+		listeners.once.Do(loadInheritedListeners)
+		listeners.mtx.Lock()
+		_, inherited := listeners.inherited[address.Network+"/"+address.Address]
+		listeners.mtx.Unlock()
+		if !inherited {
+			err := removeStaleSocket(address.Address)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	listener, err := listen(address.Network, address.Address, address.Options)
+	if err != nil {
+		return nil, err
+	}
+	if unixPath && address.SocketMode != 0 {
+		err = os.Chmod(address.Address, address.SocketMode)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	if address.Options != nil && address.Network != "unix" {
+		listener = &socketOptionsListener{listener, address.Options}
+	}
+	return listener, nil
+}
+
+// ParseListenAddress reads where an input listens from socket_path,
+// socket_mode and abstract_socket for a unix domain socket, or from the
+// host attribute, port and address_family (dual, ipv4 or ipv6) otherwise,
+// and the socket options as ParseSocketOptions does.  The host of an IPv6
+// address may be given with or without the brackets.
+func ParseListenAddress(config *ConfigElement, hostAttr string, defaultPort string) (*ListenAddress, error) {
+	options, err := ParseSocketOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	socketPath, ok := config.Attrs["socket_path"]
+	if ok {
+		if socketPath == "" {
+			return nil, errors.New("invalid socket_path")
+		}
+		retval := &ListenAddress{Network: "unix", Address: socketPath, Options: options}
+		abstract := false
+		abstractStr, ok := config.Attrs["abstract_socket"]
+		if ok {
+			abstract, err = strconv.ParseBool(abstractStr)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if abstract {
+			if runtime.GOOS != "linux" {
+				return nil, errors.New("abstract_socket is only supported on Linux")
+			}
+			retval.Address = "@" + socketPath
+		}
+		socketModeStr, ok := config.Attrs["socket_mode"]
+		if ok {
+			if abstract {
+				return nil, errors.New("an abstract socket has no socket_mode")
+			}
+			socketMode, err := strconv.ParseUint(socketModeStr, 8, 32)
+			if err != nil || socketMode > 0777 {
+				return nil, errors.New("invalid socket_mode: " + socketModeStr)
+			}
+			retval.SocketMode = os.FileMode(socketMode)
+		}
+		return retval, nil
+	}
+	port, ok := config.Attrs["port"]
+	if !ok {
+		port = defaultPort
+	}
+	network := "tcp"
+	family, ok := config.Attrs["address_family"]
+	if ok {
+		switch family {
+		case "dual":
+		case "ipv4":
+			network = "tcp4"
+		case "ipv6":
+			network = "tcp6"
+		default:
+			return nil, errors.New(fmt.Sprintf("unsupported address_family: %s", family))
+		}
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(config.Attrs[hostAttr], "["), "]")
+	return &ListenAddress{Network: network, Address: net.JoinHostPort(host, port), Options: options}, nil
+}
+
+// PrepareListenerHandover duplicates the sockets of the listeners currently
+// open to hand them to the next process.
+func PrepareListenerHandover() (*ListenerHandover, error) {
+	listeners.mtx.Lock()
+	defer listeners.mtx.Unlock()
+	retval := &ListenerHandover{}
+	for key, listener := range listeners.active {
+		listener_, ok := listener.Listener.(fileListener)
+		if !ok {
+			continue
+		}
+		// the socket file stays for the next process to listen on
+		unixListener, ok := listener.Listener.(*net.UnixListener)
+		if ok {
+			unixListener.SetUnlinkOnClose(false)
+		}
+		file, err := listener_.File()
+		if err != nil {
+			retval.Close()
+			return nil, err
+		}
+		retval.keys = append(retval.keys, key)
+		retval.files = append(retval.files, file)
+	}
+	return retval, nil
+}
+
+func (handover *ListenerHandover) env() string {
+	fds := make([]int, len(handover.files))
+	for i, file := range handover.files {
+		fds[i] = int(file.Fd())
+	}
+	return handover.envOf(fds)
+}
+
+// envOf returns the entry of the environment passing the sockets as the
+// fds they become in the next process.
+func (handover *ListenerHandover) envOf(fds []int) string {
+	entries := make([]string, len(handover.keys))
+	for i, key := range handover.keys {
+		entries[i] = key + "=" + strconv.Itoa(fds[i])
+	}
+	return InheritedListenersEnv + "=" + strings.Join(entries, ";")
+}
+
+func (handover *ListenerHandover) Close() {
+	for _, file := range handover.files {
+		file.Close()
+	}
+}
+
+// ReplaceProcess execs the executable in place of the current process,
+// passing the sockets in the handover to it.
+func ReplaceProcess(executable string, args []string, handover *ListenerHandover) error {
+	if handover == nil {
+		handover = &ListenerHandover{}
+	}
+	env := make([]string, 0, len(os.Environ())+1)
+	for _, entry := range os.Environ() {
+		if !strings.HasPrefix(entry, InheritedListenersEnv+"=") {
+			env = append(env, entry)
+		}
+	}
+	env = append(env, handover.env())
+	for _, file := range handover.files {
+		err := clearCloseOnExec(file)
+		if err != nil {
+			return errors.New("failed to pass " + file.Name() + ": " + err.Error())
+		}
+	}
+	return execProcess(executable, args, env)
+}
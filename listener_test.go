@@ -0,0 +1,74 @@
+package ik
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestParseListenAddress(t *testing.T) {
+	for _, c := range []struct {
+		attrs   map[string]string
+		network string
+		address string
+	}{
+		{map[string]string{}, "tcp", ":24224"},
+		{map[string]string{"listen": "::1", "port": "1234"}, "tcp", "[::1]:1234"},
+		{map[string]string{"listen": "[::]", "address_family": "ipv6"}, "tcp6", "[::]:24224"},
+		{map[string]string{"listen": "127.0.0.1", "address_family": "ipv4"}, "tcp4", "127.0.0.1:24224"},
+		{map[string]string{"socket_path": "/run/ik.sock", "socket_mode": "0660"}, "unix", "/run/ik.sock"},
+	} {
+		address, err := ParseListenAddress(&ConfigElement{Attrs: c.attrs}, "listen", "24224")
+		if err != nil || address.Network != c.network || address.Address != c.address {
+			t.Fatalf("%v: %v %v", c.attrs, err, address)
+		}
+	}
+	address, _ := ParseListenAddress(&ConfigElement{Attrs: map[string]string{"socket_path": "ik", "abstract_socket": "true"}}, "listen", "24224")
+	if runtime.GOOS == "linux" && (address == nil || address.Address != "@ik") {
+		t.Fatalf("%v", address)
+	}
+	for _, attrs := range []map[string]string{
+		{"address_family": "ipx"},
+		{"socket_path": "/run/ik.sock", "socket_mode": "rw"},
+		{"socket_path": "ik", "abstract_socket": "true", "socket_mode": "0600"},
+	} {
+		if _, err := ParseListenAddress(&ConfigElement{Attrs: attrs}, "listen", "24224"); err == nil {
+			t.Fatalf("%v", attrs)
+		}
+	}
+}
+
+func TestListenAt_unix(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.listener")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	path := tempDir + "/ik.sock"
+	// the socket left by a process that is gone is taken over
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	address := &ListenAddress{Network: "unix", Address: path, SocketMode: 0600}
+	listener, err := ListenAt(address)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModePerm != 0600 {
+		t.Fatalf("%v", info)
+	}
+	// but not the one a process listens on
+	if _, err := ListenAt(address); err == nil {
+		t.Fail()
+	}
+	listener.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,121 @@
+package ik
+
+import (
+	"reflect"
+	"strconv"
+	"sync/atomic"
+)
+
+type panicCountFetcher struct {
+	engine *engineImpl
+}
+
+func (fetcher *panicCountFetcher) Markup(pluginInstance PluginInstance) (Markup, error) {
+	text, err := fetcher.PlainText(pluginInstance)
+	if err != nil {
+		return Markup{}, err
+	}
+	return Markup{[]MarkupChunk{{Text: text}}}, nil
+}
+
+func (fetcher *panicCountFetcher) PlainText(_ PluginInstance) (string, error) {
+	return strconv.FormatInt(atomic.LoadInt64(&fetcher.engine.panics), 10), nil
+}
+
+func pluginName(plugin interface{}) string {
+	pluginInstance, ok := plugin.(PluginInstance)
+	if ok && pluginInstance.Factory() != nil {
+		return pluginInstance.Factory().Name()
+	}
+	named, ok := plugin.(interface {
+		Name() string
+	})
+	if ok {
+		return named.Name()
+	}
+	return typeName(reflect.TypeOf(plugin))
+}
+
+// ParsePanicTag reads the tag attribute of the <panic_report> element of
+// the configuration, and returns "" if there is none.
+func ParsePanicTag(config *Config) string {
+	for _, v := range config.Root.Elems {
+		if v.Name == "panic_report" {
+			return v.Attrs["tag"]
+		}
+	}
+	return ""
+}
+
+func (engine *engineImpl) ReportPanic(plugin interface{}, panicked *Panicked) {
+	engine.countPanic(plugin)
+	engine.reportPanic(plugin, panicked, nil)
+}
+
+// countPanic counts the panic in the status of the plugin instance, unless
+// the spawner already did because it was its Run that panicked.
+func (engine *engineImpl) countPanic(plugin interface{}) {
+	spawnee, ok := plugin.(Spawnee)
+	if ok && engine.spawner != nil {
+		engine.spawner.countPanic(spawnee)
+	}
+}
+
+// PanicTag returns the tag the panics are reported under, or "" if they are
+// only logged.
+func (engine *engineImpl) PanicTag() string {
+	engine.panicTagMtx.Lock()
+	defer engine.panicTagMtx.Unlock()
+	return engine.panicTag
+}
+
+func (engine *engineImpl) setPanicTag(tag string) {
+	engine.panicTagMtx.Lock()
+	defer engine.panicTagMtx.Unlock()
+	engine.panicTag = tag
+}
+
+// reportPanic logs the panic of a plugin with its stack trace, and emits a
+// record of it under the panic tag if there is one.  No record is emitted
+// for a panic on the records of the panic tag, lest a plugin panicking on
+// every record is fed with its own reports.  The record sets the plugin
+// panicked on, if any, go to the dead-letter queue, i.e. to @ERROR if there
+// is such a label.
+func (engine *engineImpl) reportPanic(plugin interface{}, panicked *Panicked, recordSets []FluentRecordSet) {
+	atomic.AddInt64(&engine.panics, 1)
+	name := pluginName(plugin)
+	engine.logger.Critical("%s panicked: %s\n%s", name, panicked.Error(), string(panicked.Stack()))
+	if recordSets != nil {
+		engine.countPanic(plugin)
+		engine.DeadLetter(plugin, panicked, recordSets)
+	}
+	tag := engine.PanicTag()
+	if tag == "" {
+		return
+	}
+	for _, recordSet := range recordSets {
+		if recordSet.Tag == tag {
+			return
+		}
+	}
+	report := FluentRecordSet{
+		Tag: tag,
+		Records: []TinyFluentRecord{
+			{
+				Timestamp: uint64(engine.clock.Now().Unix()),
+				Data: map[string]interface{}{
+					"plugin":  name,
+					"message": panicked.Error(),
+					"stack":   string(panicked.Stack()),
+				},
+			},
+		},
+	}
+	// the goroutine that panicked may still hold locks the route needs
+	go func() {
+		err := engine.defaultPort.Emit([]FluentRecordSet{report})
+		if err != nil {
+			engine.logger.Error("failed to emit the panic report: %s", err.Error())
+		}
+	}()
+}
@@ -0,0 +1,130 @@
+package ik
+
+import (
+	"github.com/op/go-logging"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type panickingOutputFactory struct{}
+
+type panickingOutput struct {
+	factory *panickingOutputFactory
+}
+
+func (factory *panickingOutputFactory) Name() string                 { return "panicking" }
+func (factory *panickingOutputFactory) BindScorekeeper(*Scorekeeper) {}
+
+func (factory *panickingOutputFactory) New(engine Engine, config *ConfigElement) (Output, error) {
+	return &panickingOutput{factory}, nil
+}
+
+func (output *panickingOutput) Emit(recordSets []FluentRecordSet) error {
+	panic("boom")
+}
+
+func (output *panickingOutput) Factory() Plugin { return output.factory }
+func (output *panickingOutput) Run() error      { return nil }
+func (output *panickingOutput) Shutdown() error { return nil }
+func (output *panickingOutput) Dispose()        {}
+
+func TestPipelinePanicReport(t *testing.T) {
+	data := `<panic_report>
+  tag ik.panic
+</panic_report>
+<match **>
+  type panicking
+</match>
+<match ik.panic>
+  type sink
+</match>`
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sinkFactory := &testSinkFactory{}
+	pipeline, err := NewPipeline(logging.MustGetLogger("ik"), myOpener(data), func(registry *MultiFactoryRegistry) error {
+		return registry.RegisterPlugins([]Plugin{sinkFactory, &panickingOutputFactory{}})
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pipeline.Dispose()
+	err = pipeline.Load(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = pipeline.Router().Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}}})
+	panicked, ok := err.(*Panicked)
+	if !ok || panicked.Error() != "boom" || len(panicked.Stack()) == 0 {
+		t.Fatalf("%v", err)
+	}
+	var recordSets []FluentRecordSet
+	for i := 0; i < 100 && len(recordSets) == 0; i += 1 {
+		time.Sleep(10 * time.Millisecond)
+		recordSets = sinkFactory.outputs[0].RecordSets()
+	}
+	// the report panics the output as well, but is not reported again
+	time.Sleep(10 * time.Millisecond)
+	recordSets = sinkFactory.outputs[0].RecordSets()
+	if len(recordSets) != 1 || recordSets[0].Tag != "ik.panic" || recordSets[0].Records[0].Data["plugin"] != "panicking" || recordSets[0].Records[0].Data["message"] != "boom" {
+		t.Fatalf("%v", recordSets)
+	}
+	if atomic.LoadInt64(&pipeline.engine.panics) != 2 {
+		t.Fail()
+	}
+}
+
+func TestPipelinePanicDeadLetter(t *testing.T) {
+	data := `<match **>
+  type panicking
+</match>
+<label @ERROR>
+  <match **>
+    type sink
+  </match>
+</label>`
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sinkFactory := &testSinkFactory{}
+	pipeline, err := NewPipeline(logging.MustGetLogger("ik"), myOpener(data), func(registry *MultiFactoryRegistry) error {
+		return registry.RegisterPlugins([]Plugin{sinkFactory, &panickingOutputFactory{}})
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pipeline.Dispose()
+	err = pipeline.Load(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = pipeline.Router().Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}}})
+	if _, ok := err.(*Panicked); !ok {
+		t.Fatalf("%v", err)
+	}
+	// the record set the output panicked on goes to @ERROR as it is
+	var recordSets []FluentRecordSet
+	for i := 0; i < 100 && len(recordSets) == 0; i += 1 {
+		time.Sleep(10 * time.Millisecond)
+		recordSets = sinkFactory.outputs[0].RecordSets()
+	}
+	if len(recordSets) != 1 || recordSets[0].Tag != "test" || recordSets[0].Records[0].Timestamp != 1 {
+		t.Fatalf("%v", recordSets)
+	}
+	spawneeStatuses, err := pipeline.Engine().SpawneeStatuses()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	panics := -1
+	for _, spawneeStatus := range spawneeStatuses {
+		if _, ok := spawneeStatus.Spawnee.(*panickingOutput); ok {
+			panics = spawneeStatus.Panics
+		}
+	}
+	if panics != 1 {
+		t.Fatalf("%d panics", panics)
+	}
+}
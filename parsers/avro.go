@@ -0,0 +1,68 @@
+package parsers
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/avro"
+	"io/ioutil"
+	"time"
+)
+
+// AvroLineParserPlugin parses the datums of the record schema given inline
+// by schema or in the file at schema_path, or the ones framed with the id
+// of their schema in the schema registry at schema_registry_url, which are
+// decoded with the schema they were encoded with.
+type AvroLineParserPlugin struct{}
+
+func (*AvroLineParserPlugin) Name() string {
+	return "avro"
+}
+
+func (plugin *AvroLineParserPlugin) OnRegistering(visitor func(name string, factoryFactory ik.LineParserFactoryFactory) error) error {
+	return visitor("avro", func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *AvroLineParserPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+	endpoint, ok := config.Attrs["schema_registry_url"]
+	if ok {
+		registry := avro.NewRegistry(endpoint, 30*time.Second)
+		return newBinaryLineParserFactory(plugin, engine, config, func(b []byte) (map[string]interface{}, error) {
+			id, datum, err := avro.Unframe(b)
+			if err != nil {
+				return nil, err
+			}
+			schema, err := registry.Schema(id)
+			if err != nil {
+				return nil, err
+			}
+			return schema.Unmarshal(datum)
+		})
+	}
+	var b []byte
+	schemaStr, ok := config.Attrs["schema"]
+	if ok {
+		b = []byte(schemaStr)
+	} else {
+		path, ok := config.Attrs["schema_path"]
+		if !ok {
+			return nil, errors.New("either schema, schema_path or schema_registry_url is required")
+		}
+		var err error
+		b, err = ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	schema, err := avro.ParseSchema(b)
+	if err != nil {
+		return nil, err
+	}
+	if schema.Type != "record" {
+		return nil, errors.New("the schema is not of a record")
+	}
+	return newBinaryLineParserFactory(plugin, engine, config, schema.Unmarshal)
+}
+
+var _ = AddPlugin(&AvroLineParserPlugin{})
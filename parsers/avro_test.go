@@ -0,0 +1,48 @@
+package parsers
+
+import (
+	"encoding/base64"
+	"github.com/moriyoshi/ik"
+	"github.com/op/go-logging"
+	"testing"
+)
+
+func TestAvroLineParser(t *testing.T) {
+	logger := logging.MustGetLogger("ik")
+	engine := ik.NewEngine(logger, nil, nil, nil, ik.NewScorekeeper(logger), nil)
+	defer engine.Dispose()
+	schema := `{"type": "record", "name": "R", "fields": [{"name": "time", "type": "long"}, {"name": "b", "type": "string"}]}`
+	for _, encoding := range []string{"binary", "base64"} {
+		factory, err := (&AvroLineParserPlugin{}).New(engine, &ik.ConfigElement{Attrs: map[string]string{"schema": schema, "message_encoding": encoding}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		records := make([]ik.FluentRecord, 0)
+		parser, err := factory.New(func(record ik.FluentRecord) error {
+			records = append(records, record)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		// 1400000000 and "foo"
+		datum := string([]byte{0x80, 0xb8, 0x92, 0xb7, 0x0a, 0x06, 'f', 'o', 'o'})
+		if encoding == "base64" {
+			datum = base64.StdEncoding.EncodeToString([]byte(datum))
+		}
+		for _, line := range []string{datum, "\x06"} {
+			err = parser.Feed(line)
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		// the one that cannot be decoded is dropped
+		if len(records) != 1 || records[0].Timestamp != 1400000000 || records[0].Data["b"] != "foo" || len(records[0].Data) != 1 {
+			t.Fatalf("%s: %v", encoding, records)
+		}
+	}
+	_, err := (&AvroLineParserPlugin{}).New(engine, &ik.ConfigElement{Attrs: map[string]string{"schema": schema, "message_encoding": "hex"}})
+	if err == nil {
+		t.Fatal("an unsupported message_encoding was accepted")
+	}
+}
@@ -0,0 +1,101 @@
+package parsers
+
+import (
+	"encoding/base64"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"time"
+)
+
+// BinaryLineParserFactory makes the parsers of the formats whose messages
+// are binary, which are fed a message at a time, or a message encoded in
+// base64 a line if message_encoding is base64, as in_tail reads them.
+type BinaryLineParserFactory struct {
+	plugin     ik.LineParserPlugin
+	engine     ik.Engine
+	logger     ik.Logger
+	decode     func(b []byte) (map[string]interface{}, error)
+	base64     bool
+	timeParser func(value string) (time.Time, error)
+	timeKey    string
+}
+
+type BinaryLineParser struct {
+	factory  *BinaryLineParserFactory
+	receiver func(ik.FluentRecord) error
+}
+
+// takeBinaryTime is takeTime but for the time given as the number of
+// seconds since the epoch, as the typed formats tend to have it.
+func takeBinaryTime(data map[string]interface{}, timeKey string, timeParser func(value string) (time.Time, error)) (time.Time, error) {
+	switch value := data[timeKey].(type) {
+	case int64:
+		delete(data, timeKey)
+		return time.Unix(value, 0), nil
+	case uint64:
+		delete(data, timeKey)
+		return time.Unix(int64(value), 0), nil
+	case float64:
+		delete(data, timeKey)
+		return time.Unix(0, int64(value*1e9)), nil
+	}
+	return takeTime(data, timeKey, timeParser)
+}
+
+func (parser *BinaryLineParser) Feed(line string) error {
+	factory := parser.factory
+	b := []byte(line)
+	if factory.base64 {
+		var err error
+		b, err = base64.StdEncoding.DecodeString(line)
+		if err != nil {
+			factory.logger.Error("Invalid base64 in line: " + line)
+			ik.DeadLetterLines(factory.engine, factory.plugin, err, []string{line})
+			return nil
+		}
+	}
+	data, err := factory.decode(b)
+	if err != nil {
+		factory.logger.Error("Failed to decode a %s message: %s", factory.plugin.Name(), err.Error())
+		ik.DeadLetterLines(factory.engine, factory.plugin, err, []string{line})
+		return nil
+	}
+	timestamp, err := takeBinaryTime(data, factory.timeKey, factory.timeParser)
+	if err != nil {
+		factory.logger.Error("Invalid time in a %s message", factory.plugin.Name())
+		ik.DeadLetterLines(factory.engine, factory.plugin, err, []string{line})
+		return nil
+	}
+	return parser.receiver(ik.FluentRecord{
+		Tag:       "",
+		Timestamp: uint64(timestamp.Unix()),
+		Data:      data,
+	})
+}
+
+func (factory *BinaryLineParserFactory) New(receiver func(ik.FluentRecord) error) (ik.LineParser, error) {
+	return &BinaryLineParser{
+		factory:  factory,
+		receiver: receiver,
+	}, nil
+}
+
+func newBinaryLineParserFactory(plugin ik.LineParserPlugin, engine ik.Engine, config *ik.ConfigElement, decode func(b []byte) (map[string]interface{}, error)) (*BinaryLineParserFactory, error) {
+	encoding, ok := config.Attrs["message_encoding"]
+	if !ok {
+		encoding = "binary"
+	}
+	if encoding != "binary" && encoding != "base64" {
+		return nil, errors.New("unsupported message_encoding: " + encoding)
+	}
+	timeParser, timeKey := newTimeParser(config)
+	return &BinaryLineParserFactory{
+		plugin:     plugin,
+		engine:     engine,
+		logger:     engine.Logger(),
+		decode:     decode,
+		base64:     encoding == "base64",
+		timeParser: timeParser,
+		timeKey:    timeKey,
+	}, nil
+}
@@ -0,0 +1,88 @@
+package parsers
+
+import (
+	"github.com/moriyoshi/ik"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// CannedLineParserPlugin provides the parsers of the well-known log formats
+// fluentd has built in.  They are regexp parsers with fixed expressions.
+type CannedLineParserPlugin struct {
+	regexpPlugin *RegexpLineParserPlugin
+}
+
+type cannedFormat struct {
+	name       string
+	regex      *regexp.Regexp
+	timeLayout string
+	converters map[string]func(value string) interface{}
+}
+
+// integerOrNil converts the numeric fields of access logs, in which "-"
+// stands for no value.
+func integerOrNil(value string) interface{} {
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil
+	}
+	return i
+}
+
+var accessLogConverters = map[string]func(value string) interface{}{
+	"code": integerOrNil,
+	"size": integerOrNil,
+}
+
+var cannedFormats = []cannedFormat{
+	{
+		"apache2",
+		regexp.MustCompile(`^(?P<host>[^ ]*) [^ ]* (?P<user>[^ ]*) \[(?P<time>[^\]]*)\] "(?P<method>\S+)(?: +(?P<path>[^ ]*) +\S*)?" (?P<code>[^ ]*) (?P<size>[^ ]*)(?: "(?P<referer>[^\"]*)" "(?P<agent>[^\"]*)")?$`),
+		"02/Jan/2006:15:04:05 -0700",
+		accessLogConverters,
+	},
+	{
+		"apache_error",
+		regexp.MustCompile(`^\[[^ ]* (?P<time>[^\]]*)\] \[(?P<level>[^\]]*)\](?: \[pid (?P<pid>[^\]]*)\])?(?: \[client (?P<client>[^\]]*)\])? (?P<message>.*)$`),
+		"Jan 02 15:04:05 2006",
+		nil,
+	},
+	{
+		"nginx",
+		regexp.MustCompile(`^(?P<remote>[^ ]*) (?P<host>[^ ]*) (?P<user>[^ ]*) \[(?P<time>[^\]]*)\] "(?P<method>\S+)(?: +(?P<path>[^\"]*?)(?: +\S*)?)?" (?P<code>[^ ]*) (?P<size>[^ ]*)(?: "(?P<referer>[^\"]*)" "(?P<agent>[^\"]*)"(?:\s+(?P<http_x_forwarded_for>[^ ]+))?)?$`),
+		"02/Jan/2006:15:04:05 -0700",
+		accessLogConverters,
+	},
+}
+
+func (*CannedLineParserPlugin) Name() string {
+	return "canned"
+}
+
+func (plugin *CannedLineParserPlugin) OnRegistering(visitor func(name string, factoryFactory ik.LineParserFactoryFactory) error) error {
+	for _, format := range cannedFormats {
+		format := format
+		err := visitor(format.name, func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+			return plugin.newFactory(engine, format)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (plugin *CannedLineParserPlugin) newFactory(engine ik.Engine, format cannedFormat) (ik.LineParserFactory, error) {
+	timeParser := func(value string) (time.Time, error) {
+		return time.Parse(format.timeLayout, value)
+	}
+	factory, err := plugin.regexpPlugin.newRegexpLineParserFactory(engine, timeParser, "time", format.regex)
+	if err != nil {
+		return nil, err
+	}
+	factory.converters = format.converters
+	return factory, nil
+}
+
+var _ = AddPlugin(&CannedLineParserPlugin{&RegexpLineParserPlugin{}})
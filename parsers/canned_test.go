@@ -0,0 +1,15 @@
+package parsers
+
+import (
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/conformance"
+	"github.com/op/go-logging"
+	"testing"
+)
+
+func TestCannedLineParser_conformance(t *testing.T) {
+	logger := logging.MustGetLogger("ik")
+	engine := ik.NewEngine(logger, nil, nil, nil, ik.NewScorekeeper(logger), nil)
+	defer engine.Dispose()
+	conformance.RunParserSuite(t, engine, lookupFactoryFactory(&CannedLineParserPlugin{&RegexpLineParserPlugin{}}), "testdata/canned.json")
+}
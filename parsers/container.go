@@ -0,0 +1,207 @@
+package parsers
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ContainerLineParserPlugin provides the parsers of the logs container
+// runtimes write: "docker" for the json-file driver of Docker, and "cri"
+// for containerd and CRI-O.  The lines a runtime splits are joined back,
+// and the container id, and with the file names of Kubernetes the pod,
+// the namespace and the container name, are taken from the path when
+// in_tail tells it.
+type ContainerLineParserPlugin struct{}
+
+type ContainerLineParserFactory struct {
+	plugin         *ContainerLineParserPlugin
+	engine         ik.Engine
+	logger         ik.Logger
+	cri            bool
+	messageKey     string
+	maxPartialSize int
+}
+
+// ContainerLineParser keeps the parts of a line by stream until the part
+// completing it comes, or until they have grown to max_partial_size.
+type ContainerLineParser struct {
+	factory  *ContainerLineParserFactory
+	receiver func(ik.FluentRecord) error
+	fields   map[string]interface{}
+	partials map[string][]string
+	sizes    map[string]int
+}
+
+// /var/log/containers/<pod>_<namespace>_<container>-<id>.log
+var kubernetesLogFileName = regexp.MustCompile(`^([^_]+)_([^_]+)_(.+)-([0-9a-f]{64})\.log$`)
+
+// /var/lib/docker/containers/<id>/<id>-json.log
+var dockerLogFileName = regexp.MustCompile(`^([0-9a-f]{64})-json\.log$`)
+
+// containerFields returns the fields the path of a log file tells.
+func containerFields(path string) map[string]interface{} {
+	fields := make(map[string]interface{})
+	name := filepath.Base(path)
+	if m := kubernetesLogFileName.FindStringSubmatch(name); m != nil {
+		fields["pod_name"] = m[1]
+		fields["namespace"] = m[2]
+		fields["container_name"] = m[3]
+		fields["container_id"] = m[4]
+	} else if m := dockerLogFileName.FindStringSubmatch(name); m != nil {
+		fields["container_id"] = m[1]
+	}
+	return fields
+}
+
+// parseDocker reads a line of the json-file driver, whose log ends with a
+// newline unless Docker split it.
+func parseDocker(line string) (map[string]interface{}, string, string, bool, time.Time, error) {
+	data := make(map[string]interface{})
+	err := json.Unmarshal([]byte(line), &data)
+	if err != nil {
+		return nil, "", "", false, time.Time{}, err
+	}
+	log, ok := data["log"].(string)
+	if !ok {
+		return nil, "", "", false, time.Time{}, errors.New("no log in the line")
+	}
+	stream, _ := data["stream"].(string)
+	timestamp := time.Now()
+	timeStr, ok := data["time"].(string)
+	if ok {
+		timestamp, err = time.Parse(time.RFC3339Nano, timeStr)
+		if err != nil {
+			return nil, "", "", false, time.Time{}, err
+		}
+	}
+	delete(data, "log")
+	delete(data, "stream")
+	delete(data, "time")
+	partial := !strings.HasSuffix(log, "\n")
+	return data, strings.TrimSuffix(log, "\n"), stream, partial, timestamp, nil
+}
+
+// parseCRI reads a line of "<time> <stream> <P|F> <log>", in which P marks
+// the parts of a line split by the runtime.
+func parseCRI(line string) (map[string]interface{}, string, string, bool, time.Time, error) {
+	fields := strings.SplitN(line, " ", 4)
+	if len(fields) < 3 {
+		return nil, "", "", false, time.Time{}, errors.New("malformed CRI log line")
+	}
+	timestamp, err := time.Parse(time.RFC3339Nano, fields[0])
+	if err != nil {
+		return nil, "", "", false, time.Time{}, err
+	}
+	log := ""
+	if len(fields) == 4 {
+		log = fields[3]
+	}
+	tags := strings.Split(fields[2], ":")
+	return map[string]interface{}{}, log, fields[1], tags[0] == "P", timestamp, nil
+}
+
+func (parser *ContainerLineParser) Feed(line string) error {
+	factory := parser.factory
+	line = strings.TrimRight(line, "\r\n")
+	var data map[string]interface{}
+	var log, stream string
+	var partial bool
+	var timestamp time.Time
+	var err error
+	if factory.cri {
+		data, log, stream, partial, timestamp, err = parseCRI(line)
+	} else {
+		data, log, stream, partial, timestamp, err = parseDocker(line)
+	}
+	if err != nil {
+		factory.logger.Error("Invalid container log line: " + line)
+		ik.DeadLetterLines(factory.engine, factory.plugin, err, []string{line})
+		return nil
+	}
+	if partial {
+		parser.partials[stream] = append(parser.partials[stream], log)
+		parser.sizes[stream] += len(log)
+		if parser.sizes[stream] < factory.maxPartialSize {
+			return nil
+		}
+	}
+	if parts, ok := parser.partials[stream]; ok {
+		if !partial {
+			parts = append(parts, log)
+		}
+		log = strings.Join(parts, "")
+		delete(parser.partials, stream)
+		delete(parser.sizes, stream)
+	}
+	for k, v := range parser.fields {
+		data[k] = v
+	}
+	data[factory.messageKey] = log
+	data["stream"] = stream
+	return parser.receiver(ik.FluentRecord{
+		Tag:       "",
+		Timestamp: uint64(timestamp.Unix()),
+		Data:      data,
+	})
+}
+
+func (*ContainerLineParserPlugin) Name() string {
+	return "container"
+}
+
+func (factory *ContainerLineParserFactory) New(receiver func(ik.FluentRecord) error) (ik.LineParser, error) {
+	return factory.NewForPath("", receiver)
+}
+
+func (factory *ContainerLineParserFactory) NewForPath(path string, receiver func(ik.FluentRecord) error) (ik.LineParser, error) {
+	return &ContainerLineParser{
+		factory:  factory,
+		receiver: receiver,
+		fields:   containerFields(path),
+		partials: make(map[string][]string),
+		sizes:    make(map[string]int),
+	}, nil
+}
+
+func (plugin *ContainerLineParserPlugin) OnRegistering(visitor func(name string, factoryFactory ik.LineParserFactoryFactory) error) error {
+	err := visitor("docker", func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config, false)
+	})
+	if err != nil {
+		return err
+	}
+	return visitor("cri", func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config, true)
+	})
+}
+
+func (plugin *ContainerLineParserPlugin) New(engine ik.Engine, config *ik.ConfigElement, cri bool) (ik.LineParserFactory, error) {
+	messageKey, ok := config.Attrs["message_key"]
+	if !ok {
+		messageKey = "log"
+	}
+	maxPartialSize := int64(1024 * 1024)
+	maxPartialSizeStr, ok := config.Attrs["max_partial_size"]
+	if ok {
+		var err error
+		maxPartialSize, err = ik.ParseCapacityString(maxPartialSizeStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ContainerLineParserFactory{
+		plugin:         plugin,
+		engine:         engine,
+		logger:         engine.Logger(),
+		cri:            cri,
+		messageKey:     messageKey,
+		maxPartialSize: int(maxPartialSize),
+	}, nil
+}
+
+var _ = AddPlugin(&ContainerLineParserPlugin{})
@@ -0,0 +1,62 @@
+package parsers
+
+import (
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/conformance"
+	"github.com/op/go-logging"
+	"strings"
+	"testing"
+)
+
+func TestContainerLineParser_conformance(t *testing.T) {
+	logger := logging.MustGetLogger("ik")
+	engine := ik.NewEngine(logger, nil, nil, nil, ik.NewScorekeeper(logger), nil)
+	defer engine.Dispose()
+	plugin := &ContainerLineParserPlugin{}
+	conformance.RunParserSuite(t, engine, func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config, false)
+	}, "testdata/docker.json")
+	conformance.RunParserSuite(t, engine, func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config, true)
+	}, "testdata/cri.json")
+}
+
+func TestContainerLineParser_NewForPath(t *testing.T) {
+	logger := logging.MustGetLogger("ik")
+	engine := ik.NewEngine(logger, nil, nil, nil, ik.NewScorekeeper(logger), nil)
+	defer engine.Dispose()
+	id := strings.Repeat("0123456789abcdef", 4)
+	cases := []struct {
+		path     string
+		expected map[string]string
+	}{
+		{"/var/log/containers/web-1_default_nginx-" + id + ".log", map[string]string{"pod_name": "web-1", "namespace": "default", "container_name": "nginx", "container_id": id}},
+		{"/var/lib/docker/containers/" + id + "/" + id + "-json.log", map[string]string{"container_id": id}},
+		{"/var/log/app.log", map[string]string{}},
+	}
+	factory, err := (&ContainerLineParserPlugin{}).New(engine, &ik.ConfigElement{Attrs: map[string]string{}}, true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, case_ := range cases {
+		var data map[string]interface{}
+		parser, err := factory.(ik.PathLineParserFactory).NewForPath(case_.path, func(record ik.FluentRecord) error {
+			data = record.Data
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		parser.Feed("2014-05-14T12:34:56Z stdout F hello")
+		if len(data) != len(case_.expected)+2 {
+			t.Logf("%s: %v", case_.path, data)
+			t.Fail()
+		}
+		for k, v := range case_.expected {
+			if data[k] != v {
+				t.Logf("%s: %s: expected %s, got %v", case_.path, k, v, data[k])
+				t.Fail()
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package parsers
+
+import (
+	"encoding/csv"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// CSVLineParserPlugin provides the csv parser, which understands quoting,
+// and the tsv parser, which splits lines at every tab.
+type CSVLineParserPlugin struct{}
+
+type CSVLineParserFactory struct {
+	plugin     *CSVLineParserPlugin
+	engine     ik.Engine
+	logger     ik.Logger
+	timeParser func(value string) (time.Time, error)
+	timeKey    string
+	delimiter  string
+	quoted     bool
+	keys       []string
+	header     bool
+}
+
+type CSVLineParser struct {
+	factory  *CSVLineParserFactory
+	receiver func(ik.FluentRecord) error
+	keys     []string
+}
+
+func (parser *CSVLineParser) split(line string) ([]string, error) {
+	factory := parser.factory
+	if !factory.quoted {
+		return strings.Split(line, factory.delimiter), nil
+	}
+	reader := csv.NewReader(strings.NewReader(line))
+	reader.Comma, _ = utf8.DecodeRuneInString(factory.delimiter)
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	return reader.Read()
+}
+
+// Feed names the fields of the line after the keys, or after the fields
+// of the first line fed if header is set.  The fields beyond the keys are
+// dropped.
+func (parser *CSVLineParser) Feed(line string) error {
+	factory := parser.factory
+	fields, err := parser.split(line)
+	if err != nil {
+		factory.logger.Error("Unparsed line: " + line)
+		ik.DeadLetterLines(factory.engine, factory.plugin, err, []string{line})
+		return nil
+	}
+	if parser.keys == nil {
+		parser.keys = fields
+		return nil
+	}
+	data := make(map[string]interface{})
+	for i, field := range fields {
+		if i >= len(parser.keys) {
+			break
+		}
+		data[parser.keys[i]] = field
+	}
+	timestamp, err := takeTime(data, factory.timeKey, factory.timeParser)
+	if err != nil {
+		factory.logger.Error("Invalid time in line: " + line)
+		ik.DeadLetterLines(factory.engine, factory.plugin, err, []string{line})
+		return nil
+	}
+	parser.receiver(ik.FluentRecord{
+		Tag:       "",
+		Timestamp: uint64(timestamp.Unix()),
+		Data:      data,
+	})
+	return nil
+}
+
+func (*CSVLineParserPlugin) Name() string {
+	return "csv"
+}
+
+func (factory *CSVLineParserFactory) New(receiver func(ik.FluentRecord) error) (ik.LineParser, error) {
+	parser := &CSVLineParser{
+		factory:  factory,
+		receiver: receiver,
+	}
+	if !factory.header {
+		parser.keys = factory.keys
+	}
+	return parser, nil
+}
+
+func (plugin *CSVLineParserPlugin) OnRegistering(visitor func(name string, factoryFactory ik.LineParserFactoryFactory) error) error {
+	err := visitor("csv", func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config, ",", true)
+	})
+	if err != nil {
+		return err
+	}
+	return visitor("tsv", func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config, "\t", false)
+	})
+}
+
+func (plugin *CSVLineParserPlugin) New(engine ik.Engine, config *ik.ConfigElement, defaultDelimiter string, quoted bool) (ik.LineParserFactory, error) {
+	timeParser, timeKey := newTimeParser(config)
+	delimiter, ok := config.Attrs["delimiter"]
+	if !ok {
+		delimiter = defaultDelimiter
+	}
+	if quoted && utf8.RuneCountInString(delimiter) != 1 {
+		return nil, errors.New("delimiter must be a single character: " + delimiter)
+	}
+	header := false
+	headerStr, ok := config.Attrs["header"]
+	if ok {
+		var err error
+		header, err = strconv.ParseBool(headerStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var keys []string
+	keysStr, ok := config.Attrs["keys"]
+	if ok {
+		keys = strings.Split(keysStr, ",")
+		for i, key := range keys {
+			keys[i] = strings.TrimSpace(key)
+		}
+	} else if !header {
+		return nil, errors.New("required attribute `keys' is not specified")
+	}
+	return &CSVLineParserFactory{
+		plugin:     plugin,
+		engine:     engine,
+		logger:     engine.Logger(),
+		timeParser: timeParser,
+		timeKey:    timeKey,
+		delimiter:  delimiter,
+		quoted:     quoted,
+		keys:       keys,
+		header:     header,
+	}, nil
+}
+
+var _ = AddPlugin(&CSVLineParserPlugin{})
@@ -0,0 +1,28 @@
+package parsers
+
+import (
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/conformance"
+	"github.com/op/go-logging"
+	"testing"
+)
+
+// lookupFactoryFactory picks the factory registered by the plugin under
+// the name given in the format attribute of the case.
+func lookupFactoryFactory(plugin ik.LineParserPlugin) ik.LineParserFactoryFactory {
+	factoryFactories := make(map[string]ik.LineParserFactoryFactory)
+	plugin.OnRegistering(func(name string, factoryFactory ik.LineParserFactoryFactory) error {
+		factoryFactories[name] = factoryFactory
+		return nil
+	})
+	return func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return factoryFactories[config.Attrs["format"]](engine, config)
+	}
+}
+
+func TestCSVLineParser_conformance(t *testing.T) {
+	logger := logging.MustGetLogger("ik")
+	engine := ik.NewEngine(logger, nil, nil, nil, ik.NewScorekeeper(logger), nil)
+	defer engine.Dispose()
+	conformance.RunParserSuite(t, engine, lookupFactoryFactory(&CSVLineParserPlugin{}), "testdata/csv.json")
+}
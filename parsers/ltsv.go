@@ -0,0 +1,90 @@
+package parsers
+
+import (
+	"github.com/moriyoshi/ik"
+	"strings"
+	"time"
+)
+
+type LTSVLineParserPlugin struct{}
+
+type LTSVLineParserFactory struct {
+	plugin         *LTSVLineParserPlugin
+	engine         ik.Engine
+	logger         ik.Logger
+	timeParser     func(value string) (time.Time, error)
+	timeKey        string
+	delimiter      string
+	labelDelimiter string
+}
+
+type LTSVLineParser struct {
+	factory  *LTSVLineParserFactory
+	receiver func(ik.FluentRecord) error
+}
+
+// Feed takes a line of label:value pairs separated by tabs.  Pairs without
+// the label delimiter are skipped.
+func (parser *LTSVLineParser) Feed(line string) error {
+	factory := parser.factory
+	data := make(map[string]interface{})
+	for _, pair := range strings.Split(line, factory.delimiter) {
+		kv := strings.SplitN(pair, factory.labelDelimiter, 2)
+		if len(kv) != 2 {
+			continue
+		}
+		data[kv[0]] = kv[1]
+	}
+	timestamp, err := takeTime(data, factory.timeKey, factory.timeParser)
+	if err != nil {
+		factory.logger.Error("Invalid time in line: " + line)
+		ik.DeadLetterLines(factory.engine, factory.plugin, err, []string{line})
+		return nil
+	}
+	parser.receiver(ik.FluentRecord{
+		Tag:       "",
+		Timestamp: uint64(timestamp.Unix()),
+		Data:      data,
+	})
+	return nil
+}
+
+func (*LTSVLineParserPlugin) Name() string {
+	return "ltsv"
+}
+
+func (factory *LTSVLineParserFactory) New(receiver func(ik.FluentRecord) error) (ik.LineParser, error) {
+	return &LTSVLineParser{
+		factory:  factory,
+		receiver: receiver,
+	}, nil
+}
+
+func (plugin *LTSVLineParserPlugin) OnRegistering(visitor func(name string, factoryFactory ik.LineParserFactoryFactory) error) error {
+	return visitor("ltsv", func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *LTSVLineParserPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+	timeParser, timeKey := newTimeParser(config)
+	delimiter, ok := config.Attrs["delimiter"]
+	if !ok {
+		delimiter = "\t"
+	}
+	labelDelimiter, ok := config.Attrs["label_delimiter"]
+	if !ok {
+		labelDelimiter = ":"
+	}
+	return &LTSVLineParserFactory{
+		plugin:         plugin,
+		engine:         engine,
+		logger:         engine.Logger(),
+		timeParser:     timeParser,
+		timeKey:        timeKey,
+		delimiter:      delimiter,
+		labelDelimiter: labelDelimiter,
+	}, nil
+}
+
+var _ = AddPlugin(&LTSVLineParserPlugin{})
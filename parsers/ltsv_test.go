@@ -0,0 +1,18 @@
+package parsers
+
+import (
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/conformance"
+	"github.com/op/go-logging"
+	"testing"
+)
+
+func TestLTSVLineParser_conformance(t *testing.T) {
+	logger := logging.MustGetLogger("ik")
+	engine := ik.NewEngine(logger, nil, nil, nil, ik.NewScorekeeper(logger), nil)
+	defer engine.Dispose()
+	plugin := &LTSVLineParserPlugin{}
+	conformance.RunParserSuite(t, engine, func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config)
+	}, "testdata/ltsv.json")
+}
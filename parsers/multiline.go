@@ -0,0 +1,190 @@
+package parsers
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type MultilineLineParserPlugin struct {
+	regexpPlugin *RegexpLineParserPlugin
+}
+
+type MultilineLineParserFactory struct {
+	plugin        *MultilineLineParserPlugin
+	logger        ik.Logger
+	firstline     *regexp.Regexp
+	continuation  *regexp.Regexp
+	maxLines      int
+	flushInterval time.Duration
+	messageKey    string
+	inner         *RegexpLineParserFactory
+}
+
+// MultilineLineParser joins the lines from one matching format_firstline up
+// to the next into a record.  If format_continuation is given, a line
+// matching neither makes a record by itself.  The lines are handed over
+// once max_lines are joined, or when no line follows within
+// flush_interval.
+type MultilineLineParser struct {
+	factory  *MultilineLineParserFactory
+	receiver func(ik.FluentRecord) error
+	inner    ik.LineParser
+	lines    []string
+	timer    *time.Timer
+	mtx      sync.Mutex
+}
+
+// flush hands over the lines joined so far.  mtx must be held.
+func (parser *MultilineLineParser) flush() error {
+	if parser.timer != nil {
+		parser.timer.Stop()
+		parser.timer = nil
+	}
+	if len(parser.lines) == 0 {
+		return nil
+	}
+	text := strings.Join(parser.lines, "\n")
+	parser.lines = nil
+	if parser.inner != nil {
+		return parser.inner.Feed(text)
+	}
+	return parser.receiver(ik.FluentRecord{
+		Tag:       "",
+		Timestamp: uint64(time.Now().Unix()),
+		Data:      map[string]interface{}{parser.factory.messageKey: text},
+	})
+}
+
+func (parser *MultilineLineParser) onTimeout() {
+	parser.mtx.Lock()
+	defer parser.mtx.Unlock()
+	err := parser.flush()
+	if err != nil {
+		parser.factory.logger.Error("%s", err.Error())
+	}
+}
+
+func (parser *MultilineLineParser) Feed(line string) error {
+	factory := parser.factory
+	parser.mtx.Lock()
+	defer parser.mtx.Unlock()
+	line = strings.TrimRight(line, "\r\n")
+	if factory.firstline.MatchString(line) {
+		err := parser.flush()
+		if err != nil {
+			return err
+		}
+	} else if len(parser.lines) == 0 || (factory.continuation != nil && !factory.continuation.MatchString(line)) {
+		err := parser.flush()
+		if err != nil {
+			return err
+		}
+		parser.lines = []string{line}
+		return parser.flush()
+	}
+	parser.lines = append(parser.lines, line)
+	if len(parser.lines) >= factory.maxLines {
+		return parser.flush()
+	}
+	if parser.timer == nil {
+		parser.timer = time.AfterFunc(factory.flushInterval, parser.onTimeout)
+	} else {
+		parser.timer.Reset(factory.flushInterval)
+	}
+	return nil
+}
+
+func (*MultilineLineParserPlugin) Name() string {
+	return "multiline"
+}
+
+func (factory *MultilineLineParserFactory) New(receiver func(ik.FluentRecord) error) (ik.LineParser, error) {
+	parser := &MultilineLineParser{
+		factory:  factory,
+		receiver: receiver,
+	}
+	if factory.inner != nil {
+		inner, err := factory.inner.New(receiver)
+		if err != nil {
+			return nil, err
+		}
+		parser.inner = inner
+	}
+	return parser, nil
+}
+
+func (plugin *MultilineLineParserPlugin) OnRegistering(visitor func(name string, factoryFactory ik.LineParserFactoryFactory) error) error {
+	return visitor("multiline", func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+// New builds a factory whose parsers make records by the regexp attribute
+// applied to the joined lines, in which (?s) lets . match the newlines, or
+// else put the joined lines in message_key.
+func (plugin *MultilineLineParserPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+	firstlineStr, ok := config.Attrs["format_firstline"]
+	if !ok {
+		return nil, errors.New("required attribute `format_firstline' is not specified")
+	}
+	firstline, err := regexp.Compile(firstlineStr)
+	if err != nil {
+		return nil, err
+	}
+	var continuation *regexp.Regexp
+	continuationStr, ok := config.Attrs["format_continuation"]
+	if ok {
+		continuation, err = regexp.Compile(continuationStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	maxLines := 1000
+	maxLinesStr, ok := config.Attrs["max_lines"]
+	if ok {
+		maxLines, err = strconv.Atoi(maxLinesStr)
+		if err != nil {
+			return nil, err
+		}
+		if maxLines <= 0 {
+			return nil, errors.New("invalid max_lines: " + maxLinesStr)
+		}
+	}
+	flushInterval := 5 * time.Second
+	flushIntervalStr, ok := config.Attrs["flush_interval"]
+	if ok {
+		flushInterval, err = time.ParseDuration(flushIntervalStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	messageKey, ok := config.Attrs["message_key"]
+	if !ok {
+		messageKey = "message"
+	}
+	var inner *RegexpLineParserFactory
+	if _, ok := config.Attrs["regexp"]; ok {
+		factory, err := plugin.regexpPlugin.New(engine, config)
+		if err != nil {
+			return nil, err
+		}
+		inner = factory.(*RegexpLineParserFactory)
+	}
+	return &MultilineLineParserFactory{
+		plugin:        plugin,
+		logger:        engine.Logger(),
+		firstline:     firstline,
+		continuation:  continuation,
+		maxLines:      maxLines,
+		flushInterval: flushInterval,
+		messageKey:    messageKey,
+		inner:         inner,
+	}, nil
+}
+
+var _ = AddPlugin(&MultilineLineParserPlugin{&RegexpLineParserPlugin{}})
@@ -0,0 +1,98 @@
+package parsers
+
+import (
+	"github.com/moriyoshi/ik"
+	"github.com/op/go-logging"
+	"sync"
+	"testing"
+	"time"
+)
+
+type multilineTestReceiver struct {
+	records []ik.FluentRecord
+	mtx     sync.Mutex
+}
+
+func (receiver *multilineTestReceiver) receive(record ik.FluentRecord) error {
+	receiver.mtx.Lock()
+	defer receiver.mtx.Unlock()
+	receiver.records = append(receiver.records, record)
+	return nil
+}
+
+func (receiver *multilineTestReceiver) messages(key string) []string {
+	receiver.mtx.Lock()
+	defer receiver.mtx.Unlock()
+	retval := make([]string, len(receiver.records))
+	for i, record := range receiver.records {
+		retval[i], _ = record.Data[key].(string)
+	}
+	return retval
+}
+
+func newTestMultilineParser(t *testing.T, attrs map[string]string) (ik.LineParser, *multilineTestReceiver) {
+	logger := logging.MustGetLogger("ik")
+	engine := ik.NewEngine(logger, nil, nil, nil, ik.NewScorekeeper(logger), nil)
+	plugin := &MultilineLineParserPlugin{&RegexpLineParserPlugin{}}
+	factory, err := plugin.New(engine, &ik.ConfigElement{Name: "source", Attrs: attrs})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	receiver := &multilineTestReceiver{}
+	parser, err := factory.New(receiver.receive)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return parser, receiver
+}
+
+func TestMultilineLineParser(t *testing.T) {
+	parser, receiver := newTestMultilineParser(t, map[string]string{
+		"format_firstline": `^\d{4}-`,
+		"max_lines":        "3",
+		"flush_interval":   "50ms",
+	})
+	for _, line := range []string{
+		"orphan",
+		"2014-05-14 ERROR boom",
+		"java.lang.RuntimeException: boom",
+		"\tat Foo.bar(Foo.java:1)",
+		"\tat Foo.main(Foo.java:2)",
+		"2014-05-14 INFO next",
+	} {
+		parser.Feed(line)
+	}
+	messages := receiver.messages("message")
+	if len(messages) != 3 || messages[0] != "orphan" || messages[1] != "2014-05-14 ERROR boom\njava.lang.RuntimeException: boom\n\tat Foo.bar(Foo.java:1)" || messages[2] != "\tat Foo.main(Foo.java:2)" {
+		t.Fatalf("%q", messages)
+	}
+	// the last one is held until flush_interval passes
+	time.Sleep(200 * time.Millisecond)
+	messages = receiver.messages("message")
+	if len(messages) != 4 || messages[3] != "2014-05-14 INFO next" {
+		t.Fatalf("%q", messages)
+	}
+}
+
+func TestMultilineLineParser_continuation(t *testing.T) {
+	parser, receiver := newTestMultilineParser(t, map[string]string{
+		"format_firstline":    `^Traceback`,
+		"format_continuation": `^(?:\s|\w+Error:)`,
+		"regexp":              `(?s)^Traceback[^\n]*\n(?P<trace>.*)\n(?P<error>\w+Error): (?P<message>[^\n]*)$`,
+	})
+	for _, line := range []string{
+		"Traceback (most recent call last):",
+		`  File "a.py", line 1, in <module>`,
+		"ZeroDivisionError: division by zero",
+		"unrelated",
+	} {
+		parser.Feed(line)
+	}
+	if len(receiver.records) != 1 {
+		t.Fatalf("%v", receiver.records)
+	}
+	data := receiver.records[0].Data
+	if data["error"] != "ZeroDivisionError" || data["message"] != "division by zero" || data["trace"] != `  File "a.py", line 1, in <module>` {
+		t.Fatalf("%v", data)
+	}
+}
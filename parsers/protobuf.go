@@ -0,0 +1,39 @@
+package parsers
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/protobuf"
+)
+
+// ProtobufLineParserPlugin parses the message_type messages of the
+// descriptor set at descriptor_set.
+type ProtobufLineParserPlugin struct{}
+
+func (*ProtobufLineParserPlugin) Name() string {
+	return "protobuf"
+}
+
+func (plugin *ProtobufLineParserPlugin) OnRegistering(visitor func(name string, factoryFactory ik.LineParserFactoryFactory) error) error {
+	return visitor("protobuf", func(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+		return plugin.New(engine, config)
+	})
+}
+
+func (plugin *ProtobufLineParserPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
+	path, ok := config.Attrs["descriptor_set"]
+	if !ok {
+		return nil, errors.New("required attribute `descriptor_set' is not specified")
+	}
+	messageType, ok := config.Attrs["message_type"]
+	if !ok {
+		return nil, errors.New("required attribute `message_type' is not specified")
+	}
+	message, err := protobuf.LoadMessage(path, messageType)
+	if err != nil {
+		return nil, err
+	}
+	return newBinaryLineParserFactory(plugin, engine, config, message.Unmarshal)
+}
+
+var _ = AddPlugin(&ProtobufLineParserPlugin{})
@@ -3,7 +3,6 @@ package parsers
 import (
 	"errors"
 	"github.com/moriyoshi/ik"
-	"github.com/pbnjay/strptime"
 	"regexp"
 	"time"
 )
@@ -12,9 +11,12 @@ type RegexpLineParserPlugin struct{}
 
 type RegexpLineParserFactory struct {
 	plugin     *RegexpLineParserPlugin
+	engine     ik.Engine
 	logger     ik.Logger
 	timeParser func(value string) (time.Time, error)
+	timeKey    string
 	regex      *regexp.Regexp
+	converters map[string]func(value string) interface{}
 }
 
 type RegexpLineParser struct {
@@ -24,18 +26,35 @@ type RegexpLineParser struct {
 
 func (parser *RegexpLineParser) Feed(line string) error {
 	regex := parser.factory.regex
-	g := regex.FindStringSubmatch(line)
+	g := regex.FindStringSubmatchIndex(line)
 	data := make(map[string]interface{})
 	if g == nil {
 		parser.factory.logger.Error("Unparsed line: " + line)
+		ik.DeadLetterLines(parser.factory.engine, parser.factory.plugin, errors.New("unparsed line"), []string{line})
 		return nil
 	}
 	for i, name := range regex.SubexpNames() {
-		data[name] = g[i]
+		// only the named groups that took part in the match make fields,
+		// as with fluentd
+		if name != "" && g[2*i] >= 0 {
+			data[name] = line[g[2*i]:g[2*i+1]]
+		}
+	}
+	for name, converter := range parser.factory.converters {
+		value, ok := data[name].(string)
+		if ok {
+			data[name] = converter(value)
+		}
+	}
+	timestamp, err := takeTime(data, parser.factory.timeKey, parser.factory.timeParser)
+	if err != nil {
+		parser.factory.logger.Error("Invalid time in line: " + line)
+		ik.DeadLetterLines(parser.factory.engine, parser.factory.plugin, err, []string{line})
+		return nil
 	}
 	parser.receiver(ik.FluentRecord{
 		Tag:       "",
-		Timestamp: 0,
+		Timestamp: uint64(timestamp.Unix()),
 		Data:      data,
 	})
 	return nil
@@ -58,28 +77,19 @@ func (plugin *RegexpLineParserPlugin) OnRegistering(visitor func(name string, fa
 	})
 }
 
-func (plugin *RegexpLineParserPlugin) newRegexpLineParserFactory(logger ik.Logger, timeParser func(value string) (time.Time, error), regex *regexp.Regexp) (*RegexpLineParserFactory, error) {
+func (plugin *RegexpLineParserPlugin) newRegexpLineParserFactory(engine ik.Engine, timeParser func(value string) (time.Time, error), timeKey string, regex *regexp.Regexp) (*RegexpLineParserFactory, error) {
 	return &RegexpLineParserFactory{
 		plugin:     plugin,
-		logger:     logger,
+		engine:     engine,
+		logger:     engine.Logger(),
 		timeParser: timeParser,
+		timeKey:    timeKey,
 		regex:      regex,
 	}, nil
 }
 
 func (plugin *RegexpLineParserPlugin) New(engine ik.Engine, config *ik.ConfigElement) (ik.LineParserFactory, error) {
-	timeFormatStr, ok := config.Attrs["time_format"]
-	var timeParser func(value string) (time.Time, error)
-	if ok {
-		timeParser = func(value string) (time.Time, error) {
-			return strptime.Parse(value, timeFormatStr)
-		}
-	} else {
-		timeParser = func(value string) (time.Time, error) {
-			// FIXME
-			return time.Parse(time.RFC3339, value)
-		}
-	}
+	timeParser, timeKey := newTimeParser(config)
 	regexStr, ok := config.Attrs["regexp"]
 	if !ok {
 		return nil, errors.New("Required attribute `regexp' not found")
@@ -88,7 +98,7 @@ func (plugin *RegexpLineParserPlugin) New(engine ik.Engine, config *ik.ConfigEle
 	if err != nil {
 		return nil, err
 	}
-	return plugin.newRegexpLineParserFactory(engine.Logger(), timeParser, regex)
+	return plugin.newRegexpLineParserFactory(engine, timeParser, timeKey, regex)
 }
 
 var _ = AddPlugin(&RegexpLineParserPlugin{})
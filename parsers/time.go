@@ -0,0 +1,46 @@
+package parsers
+
+import (
+	"github.com/moriyoshi/ik"
+	"github.com/pbnjay/strptime"
+	"time"
+)
+
+// newTimeParser returns the parser of the times given in the time_format
+// attribute, or of RFC 3339 times if there is none, along with the field
+// the time is taken from.
+func newTimeParser(config *ik.ConfigElement) (func(value string) (time.Time, error), string) {
+	timeFormatStr, ok := config.Attrs["time_format"]
+	var timeParser func(value string) (time.Time, error)
+	if ok {
+		timeParser = func(value string) (time.Time, error) {
+			return strptime.Parse(value, timeFormatStr)
+		}
+	} else {
+		timeParser = func(value string) (time.Time, error) {
+			// FIXME
+			return time.Parse(time.RFC3339, value)
+		}
+	}
+	timeKey, ok := config.Attrs["time_key"]
+	if !ok {
+		timeKey = "time"
+	}
+	return timeParser, timeKey
+}
+
+// takeTime removes the time field from the record and returns the time in
+// it, or the current time if there is no such field.  It fails if the
+// field does not hold a valid time.
+func takeTime(data map[string]interface{}, timeKey string, timeParser func(value string) (time.Time, error)) (time.Time, error) {
+	timeStr, ok := data[timeKey].(string)
+	if !ok {
+		return time.Now(), nil
+	}
+	timestamp, err := timeParser(timeStr)
+	if err != nil {
+		return timestamp, err
+	}
+	delete(data, timeKey)
+	return timestamp, nil
+}
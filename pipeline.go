@@ -0,0 +1,157 @@
+package ik
+
+import (
+	"errors"
+	"time"
+)
+
+// Pipeline is an engine together with the registry, the scorekeeper and
+// the router of its own.  A process embedding ik may run several isolated
+// pipelines, e.g. one per tenant, by creating a Pipeline for each.
+type Pipeline struct {
+	logger      Logger
+	scorekeeper *Scorekeeper
+	registry    *MultiFactoryRegistry
+	router      *FluentRouter
+	engine      *engineImpl
+	reloader    *ConfigReloader
+}
+
+func (pipeline *Pipeline) Engine() Engine {
+	return pipeline.engine
+}
+
+func (pipeline *Pipeline) Registry() *MultiFactoryRegistry {
+	return pipeline.registry
+}
+
+func (pipeline *Pipeline) Scorekeeper() *Scorekeeper {
+	return pipeline.scorekeeper
+}
+
+func (pipeline *Pipeline) Router() *FluentRouter {
+	return pipeline.router
+}
+
+func (pipeline *Pipeline) Reloader() *ConfigReloader {
+	return pipeline.reloader
+}
+
+// Load applies the configuration, replacing the one loaded before if any.
+func (pipeline *Pipeline) Load(config *Config) error {
+	return pipeline.reloader.Load(config)
+}
+
+// ConfigureScoreboards launches the scoreboards in the configuration, and
+// the debug listener and the runtime statistics if it has a <debug>
+// element.  Neither is affected by reloading the configuration.  The topics
+// are sampled into their histories every history_interval of the
+// scoreboards, the shortest of them, or every 10s by default.
+func (pipeline *Pipeline) ConfigureScoreboards(config *Config) error {
+	err := pipeline.configureDebug(config)
+	if err != nil {
+		return err
+	}
+	historyInterval := time.Duration(0)
+	for _, v := range config.Root.Elems {
+		switch v.Name {
+		case "scoreboard":
+			interval := 10 * time.Second
+			intervalStr, ok := v.Attrs["history_interval"]
+			if ok {
+				interval, err = time.ParseDuration(intervalStr)
+				if err != nil || interval <= 0 {
+					return errors.New("invalid history_interval: " + intervalStr)
+				}
+			}
+			if historyInterval == 0 || interval < historyInterval {
+				historyInterval = interval
+			}
+			type_ := v.Attrs["type"]
+			scoreboardFactory := pipeline.registry.LookupScoreboardFactory(type_)
+			if scoreboardFactory == nil {
+				return errors.New("Could not find scoreboard factory: " + type_)
+			}
+			scoreboard, err := scoreboardFactory.New(pipeline.engine, pipeline.registry, v)
+			if err != nil {
+				return err
+			}
+			err = pipeline.engine.Launch(scoreboard)
+			if err != nil {
+				return err
+			}
+			pipeline.logger.Info("Scoreboard plugin loaded: %s", scoreboardFactory.Name())
+		}
+	}
+	if historyInterval > 0 {
+		return pipeline.engine.Spawn(NewScoreSampler(pipeline.engine, historyInterval))
+	}
+	return nil
+}
+
+func (pipeline *Pipeline) configureDebug(config *Config) error {
+	options, err := ParseDebugOptions(config)
+	if err != nil || options == nil {
+		return err
+	}
+	if options.Listen != "" {
+		server, err := NewDebugServer(pipeline.logger, options.Listen)
+		if err != nil {
+			return err
+		}
+		err = pipeline.engine.Spawn(server)
+		if err != nil {
+			return err
+		}
+		pipeline.logger.Info("Serving pprof at %s", options.Listen)
+	}
+	if options.StatsInterval > 0 {
+		err = pipeline.engine.Spawn(NewRuntimeStats(pipeline.logger, pipeline.scorekeeper, options.StatsInterval, pipeline.engine.Clock()))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetClock makes the pipeline use clock, before any configuration is
+// loaded.
+func (pipeline *Pipeline) SetClock(clock Clock) {
+	pipeline.engine.SetClock(clock)
+}
+
+// Start blocks until every plugin instance of the pipeline has stopped.
+func (pipeline *Pipeline) Start() error {
+	return pipeline.engine.Start()
+}
+
+func (pipeline *Pipeline) Dispose() error {
+	return pipeline.engine.Dispose()
+}
+
+// NewPipeline creates a pipeline whose registry is populated by register.
+func NewPipeline(logger Logger, opener Opener, register func(registry *MultiFactoryRegistry) error) (*Pipeline, error) {
+	scorekeeper := NewScorekeeper(logger)
+	registry := NewMultiFactoryRegistry(scorekeeper)
+	err := register(registry)
+	if err != nil {
+		return nil, err
+	}
+	router := NewFluentRouter()
+	engine := NewEngine(logger, opener, registry, registry, scorekeeper, router)
+	router.SetPanicHandler(func(port Port, panicked *Panicked, recordSets []FluentRecordSet) {
+		engine.reportPanic(port, panicked, recordSets)
+	})
+	router.SetRejectHandler(func(cause error, recordSets []FluentRecordSet) {
+		engine.DeadLetter(EnginePlugin, cause, recordSets)
+	})
+	router.SetTracer(engine.Tracer())
+	return &Pipeline{
+		logger:      logger,
+		scorekeeper: scorekeeper,
+		registry:    registry,
+		router:      router,
+		engine:      engine,
+		reloader:    NewConfigReloader(logger, engine, registry, registry, registry, router),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package ik
+
+import (
+	"github.com/op/go-logging"
+	"testing"
+)
+
+type testSinkFactory struct {
+	outputs []*CaptureOutput
+}
+
+func (factory *testSinkFactory) Name() string                 { return "sink" }
+func (factory *testSinkFactory) BindScorekeeper(*Scorekeeper) {}
+
+func (factory *testSinkFactory) New(engine Engine, config *ConfigElement) (Output, error) {
+	output := &CaptureOutput{Id: config.Attrs["@id"], Type: "sink"}
+	factory.outputs = append(factory.outputs, output)
+	return output, nil
+}
+
+func TestPipelineIsolation(t *testing.T) {
+	data := `<match **>
+  type sink
+</match>`
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	factories := []*testSinkFactory{{}, {}}
+	pipelines := make([]*Pipeline, 0)
+	for _, factory := range factories {
+		factory := factory
+		pipeline, err := NewPipeline(logging.MustGetLogger("ik"), myOpener(data), func(registry *MultiFactoryRegistry) error {
+			return registry.RegisterPlugins([]Plugin{factory})
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		defer pipeline.Dispose()
+		err = pipeline.Load(config)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		pipelines = append(pipelines, pipeline)
+	}
+	if pipelines[0].Registry().LookupOutputFactory("sink") != factories[0] || pipelines[1].Registry().LookupOutputFactory("sink") != factories[1] {
+		t.FailNow()
+	}
+	if pipelines[0].Scorekeeper() == pipelines[1].Scorekeeper() {
+		t.FailNow()
+	}
+	err = pipelines[1].Router().Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(factories[0].outputs[0].RecordSets()) != 0 || len(factories[1].outputs[0].RecordSets()) != 1 {
+		t.Fail()
+	}
+}
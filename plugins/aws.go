@@ -0,0 +1,420 @@
+package plugins
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const awsTimeFormat = "20060102T150405Z"
+
+type awsCredentials struct {
+	accessKeyId     string
+	secretAccessKey string
+	sessionToken    string
+}
+
+type awsCredentialsProvider interface {
+	credentials() (awsCredentials, error)
+}
+
+type staticAWSCredentialsProvider struct {
+	value awsCredentials
+}
+
+// instanceProfileAWSCredentialsProvider obtains the credentials of the role
+// attached to the EC2 instance from the instance metadata service, and
+// caches them until shortly before they expire.
+type instanceProfileAWSCredentialsProvider struct {
+	client     *http.Client
+	endpoint   string
+	value      awsCredentials
+	expiration time.Time
+	mtx        sync.Mutex
+}
+
+type awsInstanceProfileCredentials struct {
+	AccessKeyId     string
+	SecretAccessKey string
+	Token           string
+	Expiration      time.Time
+}
+
+func (provider *staticAWSCredentialsProvider) credentials() (awsCredentials, error) {
+	return provider.value, nil
+}
+
+func (provider *instanceProfileAWSCredentialsProvider) get(path string, token string) ([]byte, error) {
+	req, err := http.NewRequest("GET", provider.endpoint+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token", token)
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("instance metadata service returned %s for %s", resp.Status, path))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (provider *instanceProfileAWSCredentialsProvider) fetch() (awsCredentials, time.Time, error) {
+	req, err := http.NewRequest("PUT", provider.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	req.Header.Set("X-Aws-Ec2-Metadata-Token-Ttl-Seconds", "21600")
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	token, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, time.Time{}, errors.New("instance metadata service returned " + resp.Status + " for a token")
+	}
+	roles, err := provider.get("/latest/meta-data/iam/security-credentials/", string(token))
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	role := strings.TrimSpace(strings.SplitN(string(roles), "\n", 2)[0])
+	if role == "" {
+		return awsCredentials{}, time.Time{}, errors.New("no role is attached to the instance")
+	}
+	body, err := provider.get("/latest/meta-data/iam/security-credentials/"+role, string(token))
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	credentials := awsInstanceProfileCredentials{}
+	err = json.Unmarshal(body, &credentials)
+	if err != nil {
+		return awsCredentials{}, time.Time{}, err
+	}
+	return awsCredentials{
+		accessKeyId:     credentials.AccessKeyId,
+		secretAccessKey: credentials.SecretAccessKey,
+		sessionToken:    credentials.Token,
+	}, credentials.Expiration, nil
+}
+
+func (provider *instanceProfileAWSCredentialsProvider) credentials() (awsCredentials, error) {
+	provider.mtx.Lock()
+	defer provider.mtx.Unlock()
+	if time.Now().Add(5 * time.Minute).Before(provider.expiration) {
+		return provider.value, nil
+	}
+	value, expiration, err := provider.fetch()
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	provider.value = value
+	provider.expiration = expiration
+	return value, nil
+}
+
+// containerAWSCredentialsProvider obtains the credentials of the task role
+// from the endpoint ECS and EKS Pod Identity tell through the environment.
+type containerAWSCredentialsProvider struct {
+	client     *http.Client
+	endpoint   string
+	token      string
+	value      awsCredentials
+	expiration time.Time
+	mtx        sync.Mutex
+}
+
+func (provider *containerAWSCredentialsProvider) credentials() (awsCredentials, error) {
+	provider.mtx.Lock()
+	defer provider.mtx.Unlock()
+	if time.Now().Add(5 * time.Minute).Before(provider.expiration) {
+		return provider.value, nil
+	}
+	req, err := http.NewRequest("GET", provider.endpoint, nil)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	if provider.token != "" {
+		req.Header.Set("Authorization", provider.token)
+	}
+	resp, err := provider.client.Do(req)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return awsCredentials{}, errors.New("container credentials endpoint returned " + resp.Status)
+	}
+	credentials := awsInstanceProfileCredentials{}
+	err = json.NewDecoder(resp.Body).Decode(&credentials)
+	if err != nil {
+		return awsCredentials{}, err
+	}
+	provider.value = awsCredentials{
+		accessKeyId:     credentials.AccessKeyId,
+		secretAccessKey: credentials.SecretAccessKey,
+		sessionToken:    credentials.Token,
+	}
+	provider.expiration = credentials.Expiration
+	return provider.value, nil
+}
+
+// readAWSSharedCredentials reads the profile out of a shared credentials
+// file, and tells whether the profile was there.
+func readAWSSharedCredentials(path string, profile string) (awsCredentials, bool, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return awsCredentials{}, false, err
+	}
+	credentials := awsCredentials{}
+	found := false
+	section := ""
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if line[0] == '[' && line[len(line)-1] == ']' {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			if section == profile {
+				found = true
+			}
+			continue
+		}
+		if section != profile {
+			continue
+		}
+		pair := strings.SplitN(line, "=", 2)
+		if len(pair) != 2 {
+			continue
+		}
+		value := strings.TrimSpace(pair[1])
+		switch strings.TrimSpace(pair[0]) {
+		case "aws_access_key_id":
+			credentials.accessKeyId = value
+		case "aws_secret_access_key":
+			credentials.secretAccessKey = value
+		case "aws_session_token":
+			credentials.sessionToken = value
+		}
+	}
+	if found && (credentials.accessKeyId == "" || credentials.secretAccessKey == "") {
+		return awsCredentials{}, true, errors.New(fmt.Sprintf("profile %s of %s has no keys", profile, path))
+	}
+	return credentials, found, nil
+}
+
+// awsRegion returns region or the region of the standard AWS environment
+// variables, or "" if none is given.
+func awsRegion(config *ik.ConfigElement) string {
+	region, ok := config.Attrs["region"]
+	if ok {
+		return region
+	}
+	region = os.Getenv("AWS_REGION")
+	if region != "" {
+		return region
+	}
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// newAWSCredentialsProvider looks for the credentials in the order the AWS
+// SDKs do: aws_key_id, aws_sec_key and aws_session_token, the standard AWS
+// environment variables, the profile of the shared credentials file given
+// by aws_profile or AWS_PROFILE, the container credentials endpoint, and
+// then the instance profile.
+func newAWSCredentialsProvider(config *ik.ConfigElement) (awsCredentialsProvider, error) {
+	credentials := awsCredentials{}
+	var ok bool
+	credentials.accessKeyId, ok = config.Attrs["aws_key_id"]
+	if ok {
+		credentials.secretAccessKey, ok = config.Attrs["aws_sec_key"]
+		if !ok {
+			return nil, errors.New("required attribute `aws_sec_key' is not specified")
+		}
+		credentials.sessionToken = config.Attrs["aws_session_token"]
+		return &staticAWSCredentialsProvider{credentials}, nil
+	}
+	credentials.accessKeyId = os.Getenv("AWS_ACCESS_KEY_ID")
+	credentials.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+	credentials.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	if credentials.accessKeyId != "" && credentials.secretAccessKey != "" {
+		return &staticAWSCredentialsProvider{credentials}, nil
+	}
+	profile, explicitProfile := config.Attrs["aws_profile"]
+	if !explicitProfile {
+		profile = os.Getenv("AWS_PROFILE")
+		explicitProfile = profile != ""
+		if !explicitProfile {
+			profile = "default"
+		}
+	}
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			path = filepath.Join(home, ".aws", "credentials")
+		}
+	}
+	if path != "" {
+		credentials, found, err := readAWSSharedCredentials(path, profile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if found {
+			return &staticAWSCredentialsProvider{credentials}, nil
+		}
+	}
+	if explicitProfile {
+		return nil, errors.New("no such profile in the shared credentials file: " + profile)
+	}
+	containerEndpoint := os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI")
+	relativeURI := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI")
+	if relativeURI != "" {
+		containerEndpoint = "http://169.254.170.2" + relativeURI
+	}
+	if containerEndpoint != "" {
+		token := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+		tokenFile := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE")
+		if tokenFile != "" {
+			b, err := ioutil.ReadFile(tokenFile)
+			if err != nil {
+				return nil, err
+			}
+			token = strings.TrimSpace(string(b))
+		}
+		return &containerAWSCredentialsProvider{
+			client:   &http.Client{Timeout: 5 * time.Second},
+			endpoint: containerEndpoint,
+			token:    token,
+			mtx:      sync.Mutex{},
+		}, nil
+	}
+	endpoint, ok := config.Attrs["instance_metadata_endpoint"]
+	if !ok {
+		endpoint = "http://169.254.169.254"
+	}
+	return &instanceProfileAWSCredentialsProvider{
+		client:   &http.Client{Timeout: 5 * time.Second},
+		endpoint: endpoint,
+		mtx:      sync.Mutex{},
+	}, nil
+}
+
+func awsHMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func awsHash(data []byte) string {
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])
+}
+
+func awsCanonicalQuery(req *http.Request) string {
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for key, _ := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			pairs = append(pairs, awsURIEncode(key, true)+"="+awsURIEncode(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// awsURIEncode percent-encodes everything but the unreserved characters as
+// required by Signature Version 4.
+func awsURIEncode(s string, encodeSlash bool) string {
+	retval := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' || c == '.' || c == '_' || c == '~' || (c == '/' && !encodeSlash) {
+			retval = append(retval, c)
+		} else {
+			retval = append(retval, '%', "0123456789ABCDEF"[c>>4], "0123456789ABCDEF"[c&15])
+		}
+	}
+	return string(retval)
+}
+
+// signAWSRequest signs the request in place with AWS Signature Version 4.
+// The request path must already be in the canonical form the service
+// expects; the headers set before the call are all signed.
+func signAWSRequest(req *http.Request, payload []byte, credentials awsCredentials, region string, service string, now time.Time) {
+	amzDate := now.UTC().Format(awsTimeFormat)
+	date := amzDate[0:8]
+	payloadHash := req.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		payloadHash = awsHash(payload)
+	}
+	req.Header.Set("X-Amz-Date", amzDate)
+	if credentials.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", credentials.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name, _ := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		awsCanonicalQuery(req),
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		awsHash([]byte(canonicalRequest)),
+	}, "\n")
+	key := awsHMAC([]byte("AWS4"+credentials.secretAccessKey), date)
+	key = awsHMAC(key, region)
+	key = awsHMAC(key, service)
+	key = awsHMAC(key, "aws4_request")
+	signature := hex.EncodeToString(awsHMAC(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+credentials.accessKeyId+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,103 @@
+package plugins
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_signAWSRequest(t *testing.T) {
+	// the example given in the Signature Version 4 documentation
+	req, err := http.NewRequest("GET", "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	if err != nil {
+		t.FailNow()
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(
+		req,
+		[]byte{},
+		awsCredentials{accessKeyId: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"},
+		"us-east-1",
+		"iam",
+		time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC),
+	)
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, SignedHeaders=content-type;host;x-amz-date, Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7"
+	if req.Header.Get("Authorization") != expected {
+		t.Log(req.Header.Get("Authorization"))
+		t.Fail()
+	}
+}
+
+func Test_readAWSSharedCredentials(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ik")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials")
+	err = ioutil.WriteFile(path, []byte("[default]\naws_access_key_id = AKID\naws_secret_access_key = SECRET\n\n# comment\n[other]\naws_access_key_id=OTHER\naws_secret_access_key=OTHERSECRET\naws_session_token=TOKEN\n[broken]\naws_access_key_id=X\n"), 0600)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cases := []struct {
+		profile  string
+		expected awsCredentials
+		found    bool
+	}{
+		{"default", awsCredentials{"AKID", "SECRET", ""}, true},
+		{"other", awsCredentials{"OTHER", "OTHERSECRET", "TOKEN"}, true},
+		{"missing", awsCredentials{}, false},
+	}
+	for _, case_ := range cases {
+		credentials, found, err := readAWSSharedCredentials(path, case_.profile)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if credentials != case_.expected || found != case_.found {
+			t.Logf("%s: %v %v", case_.profile, credentials, found)
+			t.Fail()
+		}
+	}
+	_, _, err = readAWSSharedCredentials(path, "broken")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func Test_containerAWSCredentialsProvider(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests += 1
+		if req.Header.Get("Authorization") != "secret" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(resp).Encode(map[string]interface{}{
+			"AccessKeyId":     "AKID",
+			"SecretAccessKey": "SECRET",
+			"Token":           "TOKEN",
+			"Expiration":      time.Now().Add(time.Hour),
+		})
+	}))
+	defer server.Close()
+	provider := &containerAWSCredentialsProvider{client: &http.Client{}, endpoint: server.URL, token: "secret"}
+	for i := 0; i < 2; i++ {
+		credentials, err := provider.credentials()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if credentials != (awsCredentials{"AKID", "SECRET", "TOKEN"}) {
+			t.Logf("%v", credentials)
+			t.Fail()
+		}
+	}
+	// the credentials are cached until they are about to expire
+	if requests != 1 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,1508 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	jnl "github.com/moriyoshi/ik/journal"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// bufferedOutput is the journal-backed buffer shared by the outputs that
+// deliver whole chunks to a remote destination.  The outputs embed it, for
+// its Emit, Run and Shutdown methods and the reporters to be theirs.
+// Records are written into a journal keyed by the flush interval slot they
+// arrived in; a chunk rotated by buffer_chunk_limit is delivered right away
+// from the flush listener and the rest of the slot is delivered once the
+// slot has passed.  A chunk is removed only after the deliverer has
+// returned successfully for it, so a failed chunk is retried on the next
+// tick.
+type bufferedOutput struct {
+	logger        ik.Logger
+	journalGroup  ik.JournalGroup
+	slicer        *ik.Slicer
+	flushInterval time.Duration
+	location      *time.Location
+	clock         ik.Clock
+	deliverer     func(ctx context.Context, subKey string, chunk ik.JournalChunk) error
+	// ctx is handed to the deliveries, and cancelled when the output is shut
+	// down with a deadline that has passed, leaving the chunks for the next
+	// run.
+	ctx   context.Context
+	abort context.CancelFunc
+	// subKeyer groups the records further for the outputs that need it; the
+	// key it returns is handed back to the deliverer along with the chunk.
+	subKeyer func(record ik.FluentRecord) string
+	// sliceKey journals the records of a slot further by the time slice of
+	// buffer_time_slice their timestamps fall into, which the file names of
+	// the chunks tell and the chunks give by TimeSlice.
+	sliceKey       func(key string, t time.Time) string
+	onPanic        func(panicked *ik.Panicked)
+	deadLetter     func(cause error, lines []string)
+	deadLetterSets func(cause error, recordSets []ik.FluentRecordSet)
+	tracer         *ik.Tracer
+	// forget is told of every chunk taken off the buffer, delivered or
+	// given up on, for the deliverers keeping state per chunk across the
+	// retries.
+	forget func(chunk ik.JournalChunk)
+	// watchdog holds off the emissions while the filesystem of the buffer
+	// has less than buffer_min_free_space left, and dropNewest drops them
+	// instead, as buffer_disk_full_action drop_newest does.
+	watchdog         *jnl.DiskSpaceWatchdog
+	dropNewest       bool
+	plugin           interface{}
+	fluentdBuffer    string
+	fluentdBufferTag string
+	fsync            string
+	c                chan bufferedOutputEmission
+	// stopped is closed on shutdown, for Run and whoever waits on it to
+	// return, and finished once Run has disposed of the journals with
+	// disposeError
+	stopped          chan bool
+	stopOnce         sync.Once
+	finished         chan bool
+	disposeError     error
+	flushes          chan chan struct{}
+	drains           chan chan struct{}
+	ticker           ik.Ticker
+	retries          int64
+	deliveryError    error
+	deliveryErrorMtx sync.Mutex
+	// retryLimit is the number of failed deliveries a chunk is given up
+	// after, or 0 for none.
+	retryLimit  int
+	failures    map[string]int
+	failedSince map[string]time.Time
+	failuresMtx sync.Mutex
+	// ordered has the chunks of a tenant and sub key delivered strictly
+	// oldest first, never past one that fails, and maxStall is how long one
+	// may stall them before it is given up.  The rotated chunks then wait
+	// for the flushes rather than being delivered by the flush listener.
+	ordered  bool
+	maxStall time.Duration
+	// flushThreads deliver the journals of the passed slots in parallel,
+	// carrying no more than max_in_flight_bytes of chunks at once.
+	flushThreads int
+	inFlight     *inFlightLimiter
+	emitLatency  *ik.LatencyWindow
+	flushLatency *ik.LatencyWindow
+	// warmUpUntil is what ends the warm-up, signal or delivery, during which
+	// the records are buffered without being delivered.
+	warmUpUntil string
+	ready       int32
+	draining    int32
+	// tenants have the records of each tenant go to journals of its own,
+	// whose keys are prefixed with the tenant and a colon.
+	tenants        *ik.Tenants
+	tenantBytes    map[string]int64
+	tenantBytesMtx sync.Mutex
+	// delivering holds the UniqueId of the chunks being delivered; a chunk is
+	// left to the delivery carrying it, which counts a duplicate prevented.
+	delivering    map[string]bool
+	deliveringMtx sync.Mutex
+	duplicates    int64
+}
+
+// errChunkInFlight is returned by deliver for a chunk another delivery is
+// still carrying.
+var errChunkInFlight = errors.New("the chunk is being delivered already")
+
+// bufferedOutputEmission carries records to the buffer; done is non-nil for
+// the emissions waiting for an acknowledgement, and results for those
+// waiting for the error of each record set as well.
+type bufferedOutputEmission struct {
+	recordSets []ik.FluentRecordSet
+	done       chan error
+	results    []error
+}
+
+type bufferedOutputParams struct {
+	bufferType       string
+	bufferPath       string
+	sqliteDriver     string
+	bufferChunkLimit int64
+	flushInterval    time.Duration
+	location         *time.Location
+	permission       os.FileMode
+	fsync            string
+	encryption       *jnl.ChunkEncryption
+	fluentdBuffer    string
+	fluentdBufferTag string
+	flushThreads     int
+	maxInFlightBytes int64
+	retryLimit       int
+	ordered          bool
+	maxStall         time.Duration
+	// chunkHooks runs buffer_chunk_rest_command and
+	// buffer_chunk_purge_command as the chunks come to rest and are purged.
+	chunkHooks *chunkHookCommands
+	timeSlice  time.Duration
+	// maxJournals is how many journals are kept open, the idle ones being
+	// closed with their chunks left to be delivered.
+	maxJournals int
+	// takeOverLock takes over the lock of the buffer path whose owner is
+	// gone, which otherwise keeps another process off it.
+	takeOverLock     bool
+	minFreeSpace     int64
+	maxAge           time.Duration
+	maxTotalBytes    int64
+	compactThreshold int64
+	diskFullAction   string
+	diskInterval     time.Duration
+	warmUpUntil      string
+	tenants          *ik.Tenants
+	clock            ik.Clock
+}
+
+// inFlightLimiter bounds the bytes of the chunks being delivered at once
+// by the flush threads.  A chunk larger than the bound is delivered alone.
+type inFlightLimiter struct {
+	max      int64
+	inFlight int64
+	released chan struct{} // closed and replaced on every release
+	mtx      sync.Mutex
+}
+
+func newInFlightLimiter(max int64) *inFlightLimiter {
+	return &inFlightLimiter{max: max, released: make(chan struct{})}
+}
+
+// acquire waits for n bytes to fit in the bound, and returns the error of
+// ctx if it is done first.
+func (limiter *inFlightLimiter) acquire(ctx context.Context, n int64) error {
+	for {
+		limiter.mtx.Lock()
+		if limiter.inFlight == 0 || limiter.inFlight+n <= limiter.max {
+			limiter.inFlight += n
+			limiter.mtx.Unlock()
+			return nil
+		}
+		released := limiter.released
+		limiter.mtx.Unlock()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-released:
+		}
+	}
+}
+
+func (limiter *inFlightLimiter) release(n int64) {
+	limiter.mtx.Lock()
+	defer limiter.mtx.Unlock()
+	limiter.inFlight -= n
+	close(limiter.released)
+	limiter.released = make(chan struct{})
+}
+
+func readChunk(chunk ik.JournalChunk, visitor func(io.Reader) error) error {
+	reader, err := chunk.GetReader()
+	if err != nil {
+		return err
+	}
+	closer, _ := reader.(io.Closer)
+	if closer != nil {
+		defer closer.Close()
+	}
+	return visitor(reader)
+}
+
+// slot returns the start of the flush interval slot, so that the slots of
+// a day follow the days in the timezone of the output.
+func (buffer *bufferedOutput) slot(now time.Time) int64 {
+	return ik.TimeSlot(now.In(buffer.location), buffer.flushInterval).UnixNano()
+}
+
+func (buffer *bufferedOutput) journalKey(record ik.FluentRecord) string {
+	key := strconv.FormatInt(buffer.slot(buffer.clock.Now()), 10)
+	if buffer.subKeyer != nil {
+		key += "/" + buffer.subKeyer(record)
+	}
+	if buffer.tenants != nil {
+		tenant := buffer.tenants.Of(record.Data)
+		if tenant != "" {
+			key = tenant + ":" + key
+		}
+	}
+	if buffer.sliceKey != nil {
+		key = buffer.sliceKey(key, time.Unix(int64(record.Timestamp), 0))
+	}
+	return key
+}
+
+// splitKey is splitBufferedOutputKey for the keys of the journals, which
+// may be time-sliced and namespaced by a tenant.
+func (buffer *bufferedOutput) splitKey(key string) (int64, string, error) {
+	if buffer.sliceKey != nil {
+		key, _, _ = jnl.SplitTimeSlicedKey(key)
+	}
+	_, key = splitTenantKey(key)
+	return splitBufferedOutputKey(key)
+}
+
+// splitTenantKey splits the tenant a journal key is namespaced by, if any,
+// off the key.
+func splitTenantKey(key string) (string, string) {
+	i := strings.Index(key, ":")
+	j := strings.Index(key, "/")
+	if i < 0 || (j >= 0 && j < i) {
+		return "", key
+	}
+	return key[0:i], key[i+1:]
+}
+
+func splitBufferedOutputKey(key string) (int64, string, error) {
+	pair := strings.SplitN(key, "/", 2)
+	slot, err := strconv.ParseInt(pair[0], 10, 64)
+	if err != nil {
+		return 0, "", err
+	}
+	if len(pair) == 1 {
+		return slot, "", nil
+	}
+	return slot, pair[1], nil
+}
+
+// startDelivery marks the chunk as being delivered, and returns false if
+// it already is.
+func (buffer *bufferedOutput) startDelivery(chunk ik.JournalChunk) bool {
+	id := chunk.UniqueId()
+	if id == "" {
+		return true
+	}
+	buffer.deliveringMtx.Lock()
+	defer buffer.deliveringMtx.Unlock()
+	if buffer.delivering[id] {
+		return false
+	}
+	buffer.delivering[id] = true
+	return true
+}
+
+func (buffer *bufferedOutput) endDelivery(chunk ik.JournalChunk) {
+	buffer.deliveringMtx.Lock()
+	defer buffer.deliveringMtx.Unlock()
+	delete(buffer.delivering, chunk.UniqueId())
+}
+
+func (buffer *bufferedOutput) deliver(subKey string, chunk ik.JournalChunk) error {
+	defer chunk.Dispose()
+	if !buffer.startDelivery(chunk) {
+		atomic.AddInt64(&buffer.duplicates, 1)
+		buffer.logger.Warning("chunk %s is being delivered already; not delivering it twice", chunk.UniqueId())
+		return errChunkInFlight
+	}
+	// the mark stays until the chunk is removed on success
+	defer buffer.endDelivery(chunk)
+	if buffer.inFlight != nil {
+		sized, ok := chunk.(interface {
+			Size() int64
+		})
+		if ok {
+			size := sized.Size()
+			// the chunk is left for the next run if the output is aborted
+			// while waiting
+			err := buffer.inFlight.acquire(buffer.ctx, size)
+			if err != nil {
+				return err
+			}
+			defer buffer.inFlight.release(size)
+		}
+	}
+	defer buffer.flushLatency.Since(buffer.clock.Now())
+	traced := buffer.tracedChunk(chunk)
+	if traced != nil {
+		buffer.tracer.HopChunk(buffer.plugin, ik.TraceChunkFlush, "", traced, 0)
+	}
+	start := buffer.clock.Now()
+	err := buffer.deliverer(buffer.ctx, subKey, chunk)
+	buffer.deliveryErrorMtx.Lock()
+	buffer.deliveryError = err
+	buffer.deliveryErrorMtx.Unlock()
+	if traced != nil && err == nil {
+		buffer.tracer.HopChunk(buffer.plugin, ik.TraceDelivery, "", traced, buffer.clock.Now().Sub(start))
+	}
+	if err != nil {
+		atomic.AddInt64(&buffer.retries, 1)
+		// nothing is given up on before the destination has been reached
+		if buffer.ctx.Err() != nil || !buffer.Ready() || !buffer.giveUp(chunk, err) {
+			return err
+		}
+	} else if buffer.retryLimit > 0 || buffer.maxStall > 0 {
+		buffer.countFailure(chunk, false)
+	}
+	if buffer.forget != nil {
+		buffer.forget(chunk)
+	}
+	chunk.TakeOwnership()
+	return nil
+}
+
+// tracedChunk returns the content of the chunk to look for the traced
+// records in, or nil if no record is being traced.
+func (buffer *bufferedOutput) tracedChunk(chunk ik.JournalChunk) []byte {
+	if buffer.tracer == nil || !buffer.tracer.Enabled() {
+		return nil
+	}
+	var data []byte
+	err := readChunk(chunk, func(reader io.Reader) error {
+		var err error
+		data, err = ioutil.ReadAll(reader)
+		return err
+	})
+	if err != nil {
+		buffer.logger.Warning("failed to read the chunk to trace: %s", err.Error())
+		return nil
+	}
+	return data
+}
+
+// countFailure counts a failed delivery of the chunk, or forgets about the
+// chunk once delivered, and returns the deliveries failed so far along with
+// how long they have been failing.
+func (buffer *bufferedOutput) countFailure(chunk ik.JournalChunk, failed bool) (int, time.Duration) {
+	pathed, ok := chunk.(interface {
+		Path() string
+	})
+	if !ok {
+		return 0, 0
+	}
+	buffer.failuresMtx.Lock()
+	defer buffer.failuresMtx.Unlock()
+	if !failed {
+		delete(buffer.failures, pathed.Path())
+		delete(buffer.failedSince, pathed.Path())
+		return 0, 0
+	}
+	now := buffer.clock.Now()
+	since, ok := buffer.failedSince[pathed.Path()]
+	if !ok {
+		since = now
+		buffer.failedSince[pathed.Path()] = now
+	}
+	buffer.failures[pathed.Path()] += 1
+	return buffer.failures[pathed.Path()], now.Sub(since)
+}
+
+// giveUp sends the records of the chunk to the dead-letter queue if it has
+// failed more than retry_limit deliveries, or has stalled the ordered
+// delivery for ordered_max_stall, and returns true if it has.  The output
+// the dead letters are routed to had better retry them for good, lest they
+// come back.
+func (buffer *bufferedOutput) giveUp(chunk ik.JournalChunk, cause error) bool {
+	if buffer.retryLimit <= 0 && buffer.maxStall <= 0 {
+		return false
+	}
+	failures, stalled := buffer.countFailure(chunk, true)
+	stalling := buffer.maxStall > 0 && stalled >= buffer.maxStall
+	if !stalling && (buffer.retryLimit <= 0 || failures <= buffer.retryLimit) {
+		return false
+	}
+	var data []byte
+	err := readChunk(chunk, func(reader io.Reader) error {
+		var err error
+		data, err = ioutil.ReadAll(reader)
+		return err
+	})
+	if err != nil {
+		buffer.logger.Error("failed to read the chunk to give up: %s", err.Error())
+		return false
+	}
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if stalling {
+		buffer.logger.Error("giving up %d records after stalling the ordered delivery for %s: %s", len(lines), stalled, cause.Error())
+	} else {
+		buffer.logger.Error("giving up %d records after %d failed deliveries: %s", len(lines), failures, cause.Error())
+	}
+	buffer.countFailure(chunk, false)
+	buffer.deadLetter(cause, lines)
+	return true
+}
+
+// reportTo makes the panics of the deliverer, the records given up on and
+// the hops of the traced records count as those of the plugin.
+func (buffer *bufferedOutput) reportTo(engine ik.Engine, plugin interface{}) {
+	buffer.tracer = engine.Tracer()
+	buffer.plugin = plugin
+	buffer.onPanic = func(panicked *ik.Panicked) {
+		engine.ReportPanic(plugin, panicked)
+	}
+	buffer.deadLetter = func(cause error, lines []string) {
+		ik.DeadLetterLines(engine, plugin, cause, lines)
+	}
+	buffer.deadLetterSets = func(cause error, recordSets []ik.FluentRecordSet) {
+		engine.DeadLetter(plugin, cause, recordSets)
+	}
+}
+
+func (buffer *bufferedOutput) attachListeners(journal ik.Journal) {
+	_, subKey, err := buffer.splitKey(journal.Key())
+	if err != nil {
+		buffer.logger.Warning("unexpected journal key: %s", journal.Key())
+		return
+	}
+	journal.AddFlushListener(func(chunk ik.JournalChunk) error {
+		if !buffer.Ready() || buffer.ordered {
+			// left to be delivered once warmed up, or after the older
+			// chunks
+			return chunk.Dispose()
+		}
+		err := buffer.deliver(subKey, chunk)
+		if err == errChunkInFlight {
+			return nil
+		}
+		return err
+	})
+}
+
+// flushJournal delivers the chunks of the journal, and returns the error
+// it stopped at, if it did not deliver them all.
+func (buffer *bufferedOutput) flushJournal(key string, subKey string) error {
+	journal := buffer.journalGroup.GetJournal(key)
+	err := journal.FlushContext(buffer.ctx, func(chunk ik.JournalChunk) error {
+		return buffer.deliver(subKey, chunk)
+	})
+	if err == errChunkInFlight {
+		// the rest is flushed once the delivery in flight is done
+		return err
+	}
+	if err != nil {
+		buffer.logger.Error("failed to flush journal %s: %s", key, err.Error())
+		return err
+	}
+	err = journal.Dispose()
+	if err != nil {
+		buffer.logger.Error("failed to dispose journal %s: %s", key, err.Error())
+	}
+	return nil
+}
+
+// flushJournalGuarded is flushJournal for the flush threads, where a
+// deliverer panicking would bring down the process; the chunk is left to be
+// retried instead.
+func (buffer *bufferedOutput) flushJournalGuarded(key string, subKey string) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			atomic.AddInt64(&buffer.retries, 1)
+			panicked := ik.NewPanicked(r)
+			buffer.onPanic(panicked)
+			err = panicked
+		}
+	}()
+	return buffer.flushJournal(key, subKey)
+}
+
+// streamOf returns what the deliveries of the journal of the key are
+// ordered within: its tenant and sub key, whatever the slot.
+func (buffer *bufferedOutput) streamOf(key string) string {
+	if buffer.sliceKey != nil {
+		key, _, _ = jnl.SplitTimeSlicedKey(key)
+	}
+	tenant, key := splitTenantKey(key)
+	_, subKey, _ := splitBufferedOutputKey(key)
+	return tenant + ":" + subKey
+}
+
+// expire gives up the chunks beyond the retention limits of the journal
+// group, if it has any.
+func (buffer *bufferedOutput) expire() {
+	expirer, ok := buffer.journalGroup.(interface {
+		Expire() (int, error)
+	})
+	if !ok {
+		return
+	}
+	_, err := expirer.Expire()
+	if err != nil {
+		buffer.logger.Error("failed to expire chunks: %s", err.Error())
+	}
+}
+
+// compact merges the runs of waiting chunks smaller than
+// buffer_compact_threshold on every tick, before the delivery.
+func (buffer *bufferedOutput) compact() {
+	compactor, ok := buffer.journalGroup.(interface {
+		Compact() (int, error)
+	})
+	if !ok {
+		return
+	}
+	_, err := compactor.Compact()
+	if err != nil {
+		buffer.logger.Error("failed to compact chunks: %s", err.Error())
+	}
+}
+
+// measureTenants sums up the bytes the chunks of each tenant take, on every
+// tick, for the max_buffered_bytes of the tenants.
+func (buffer *bufferedOutput) measureTenants() {
+	if buffer.tenants == nil || buffer.tenants.Key() == "" {
+		return
+	}
+	sizer, ok := buffer.journalGroup.(interface {
+		KeySizes() map[string]int64
+	})
+	if !ok {
+		return
+	}
+	tenantBytes := make(map[string]int64)
+	for key, size := range sizer.KeySizes() {
+		tenant, _ := splitTenantKey(key)
+		if tenant != "" {
+			tenantBytes[tenant] += size
+		}
+	}
+	buffer.tenantBytesMtx.Lock()
+	defer buffer.tenantBytesMtx.Unlock()
+	buffer.tenantBytes = tenantBytes
+}
+
+// countTenants adds the records written to the bytes of their tenants until
+// they are measured again.
+func (buffer *bufferedOutput) countTenants(recordSets []ik.FluentRecordSet) {
+	if buffer.tenants == nil || buffer.tenants.Key() == "" {
+		return
+	}
+	buffer.tenantBytesMtx.Lock()
+	defer buffer.tenantBytesMtx.Unlock()
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			tenant := buffer.tenants.Of(record.Data)
+			if tenant != "" {
+				buffer.tenantBytes[tenant] += ik.RecordSize(record.Data)
+			}
+		}
+	}
+}
+
+// overflowingTenant returns the tenant of a record if it is at its
+// max_buffered_bytes, or nil.
+func (buffer *bufferedOutput) overflowingTenant(data map[string]interface{}) *ik.Tenant {
+	name := buffer.tenants.Of(data)
+	if name == "" {
+		return nil
+	}
+	tenant := buffer.tenants.Lookup(name)
+	if tenant == nil || tenant.MaxBufferedBytes <= 0 {
+		return nil
+	}
+	buffer.tenantBytesMtx.Lock()
+	defer buffer.tenantBytesMtx.Unlock()
+	if buffer.tenantBytes[name] < tenant.MaxBufferedBytes {
+		return nil
+	}
+	return tenant
+}
+
+// holdToTenants takes the records of the tenants at their
+// max_buffered_bytes out of the record sets, which keep their places, and
+// drops them or hands them over to the dead-letter queue as the tenants
+// would have it.  It returns an error instead if one of the tenants blocks.
+func (buffer *bufferedOutput) holdToTenants(recordSets []ik.FluentRecordSet) ([]ik.FluentRecordSet, error) {
+	if buffer.tenants == nil || buffer.tenants.Key() == "" {
+		return recordSets, nil
+	}
+	var retval []ik.FluentRecordSet
+	overflowed := make(map[*ik.Tenant][]ik.FluentRecordSet)
+	for i, recordSet := range recordSets {
+		var kept []ik.TinyFluentRecord
+		for j, record := range recordSet.Records {
+			tenant := buffer.overflowingTenant(record.Data)
+			if tenant == nil {
+				if kept != nil {
+					kept = append(kept, record)
+				}
+				continue
+			}
+			if tenant.OverflowAction == "block" {
+				return nil, errors.New(fmt.Sprintf("tenant %s exceeds max_buffered_bytes of %d bytes", tenant.Name, tenant.MaxBufferedBytes))
+			}
+			if kept == nil {
+				kept = append(make([]ik.TinyFluentRecord, 0, len(recordSet.Records)), recordSet.Records[0:j]...)
+			}
+			recordSets_ := overflowed[tenant]
+			if len(recordSets_) == 0 || recordSets_[len(recordSets_)-1].Tag != recordSet.Tag {
+				recordSets_ = append(recordSets_, ik.FluentRecordSet{Tag: recordSet.Tag})
+			}
+			last := &recordSets_[len(recordSets_)-1]
+			last.Records = append(last.Records, record)
+			overflowed[tenant] = recordSets_
+		}
+		if kept != nil {
+			if retval == nil {
+				retval = append([]ik.FluentRecordSet(nil), recordSets...)
+			}
+			retval[i].Records = kept
+			retval[i].Packed = nil
+		}
+	}
+	for tenant, recordSets_ := range overflowed {
+		count := 0
+		for _, recordSet := range recordSets_ {
+			count += len(recordSet.Records)
+		}
+		tenant.Overflow(count)
+		if tenant.OverflowAction == "dead_letter" {
+			buffer.deadLetterSets(errors.New(fmt.Sprintf("tenant %s exceeds max_buffered_bytes of %d bytes", tenant.Name, tenant.MaxBufferedBytes)), recordSets_)
+		}
+	}
+	if retval == nil {
+		return recordSets, nil
+	}
+	return retval, nil
+}
+
+// flushExpired delivers the journals whose slot has passed, each by one of
+// the flush threads, and returns once all of them are done.
+func (buffer *bufferedOutput) flushExpired(now time.Time) {
+	buffer.flushSlotsBefore(buffer.slot(now))
+}
+
+// flushSlotsBefore delivers the journals of the slots before currentSlot
+// by the flush threads.  The journals are handed to them in batches, each
+// of which is flushed in order up to the first journal that fails: a batch
+// per journal, or with ordered_delivery, a batch per stream sorted by slot.
+func (buffer *bufferedOutput) flushSlotsBefore(currentSlot int64) {
+	batches := make(chan [][2]string)
+	wg := sync.WaitGroup{}
+	for i := 0; i < buffer.flushThreads || i == 0; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				for _, pair := range batch {
+					if buffer.flushJournalGuarded(pair[0], pair[1]) != nil {
+						break
+					}
+				}
+			}
+		}()
+	}
+	streams := make(map[string][][2]string)
+	slots := make(map[string]int64)
+	order := make([]string, 0)
+	for _, key := range buffer.journalGroup.GetJournalKeys() {
+		if buffer.ctx.Err() != nil {
+			break
+		}
+		slot, subKey, err := buffer.splitKey(key)
+		if err != nil {
+			buffer.logger.Warning("unexpected journal key: %s", key)
+			continue
+		}
+		if slot >= currentSlot {
+			continue
+		}
+		if !buffer.ordered {
+			batches <- [][2]string{{key, subKey}}
+			continue
+		}
+		stream := buffer.streamOf(key)
+		if _, ok := streams[stream]; !ok {
+			order = append(order, stream)
+		}
+		streams[stream] = append(streams[stream], [2]string{key, subKey})
+		slots[key] = slot
+	}
+	for _, stream := range order {
+		if buffer.ctx.Err() != nil {
+			break
+		}
+		batch := streams[stream]
+		sort.SliceStable(batch, func(i, j int) bool {
+			if slots[batch[i][0]] != slots[batch[j][0]] {
+				return slots[batch[i][0]] < slots[batch[j][0]]
+			}
+			return batch[i][0] < batch[j][0]
+		})
+		batches <- batch
+	}
+	close(batches)
+	wg.Wait()
+}
+
+// probe delivers the journal of the oldest slot passed that has chunks,
+// stopping at the first that fails, and tells whether one was delivered.
+func (buffer *bufferedOutput) probe(now time.Time) bool {
+	currentSlot := buffer.slot(now)
+	keys := make([]string, 0)
+	slots := make(map[string]int64)
+	for _, key := range buffer.journalGroup.GetJournalKeys() {
+		slot, _, err := buffer.splitKey(key)
+		if err == nil && slot < currentSlot {
+			keys = append(keys, key)
+			slots[key] = slot
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return slots[keys[i]] < slots[keys[j]] })
+	for _, key := range keys {
+		_, subKey, _ := buffer.splitKey(key)
+		delivered := false
+		journal := buffer.journalGroup.GetJournal(key)
+		err := journal.FlushContext(buffer.ctx, func(chunk ik.JournalChunk) error {
+			err := buffer.deliver(subKey, chunk)
+			if err == nil {
+				delivered = true
+			}
+			return err
+		})
+		if err != nil {
+			buffer.logger.Info("still warming up: %s", err.Error())
+			return false
+		}
+		err = journal.Dispose()
+		if err != nil {
+			buffer.logger.Error("failed to dispose journal %s: %s", key, err.Error())
+		}
+		if delivered {
+			return true
+		}
+	}
+	return false
+}
+
+// Ready tells whether the output is done warming up, which it is from the
+// start without warm_up_until.  With warm_up_until delivery, it is once a
+// delivery, tried with the oldest chunk on a flush, succeeds.
+func (buffer *bufferedOutput) Ready() bool {
+	return atomic.LoadInt32(&buffer.ready) != 0
+}
+
+// SetReady ends the warm-up of warm_up_until signal.
+func (buffer *bufferedOutput) SetReady() {
+	if atomic.CompareAndSwapInt32(&buffer.ready, 0, 1) {
+		buffer.logger.Notice("warmed up")
+	}
+}
+
+// Drain refuses the emissions from then on, and delivers every journal
+// with the records emitted before, warming up or not.  It returns the error
+// the last delivery failed with, if it did.
+func (buffer *bufferedOutput) Drain() error {
+	atomic.StoreInt32(&buffer.draining, 1)
+	done := make(chan struct{})
+	select {
+	case buffer.drains <- done:
+	case <-buffer.stopped:
+		return errors.New("the output has been shut down")
+	}
+	<-done
+	buffer.deliveryErrorMtx.Lock()
+	defer buffer.deliveryErrorMtx.Unlock()
+	return buffer.deliveryError
+}
+
+func (buffer *bufferedOutput) refuse() error {
+	if atomic.LoadInt32(&buffer.draining) != 0 {
+		return errors.New("the output is draining")
+	}
+	select {
+	case <-buffer.stopped:
+		return errors.New("the output has been shut down")
+	default:
+	}
+	return nil
+}
+
+// Flush delivers every journal, the one still being written to included,
+// and returns once they have been.  Nothing is delivered while the output
+// is warming up.
+func (buffer *bufferedOutput) Flush() error {
+	done := make(chan struct{})
+	select {
+	case buffer.flushes <- done:
+	case <-buffer.stopped:
+		return errors.New("the output has been shut down")
+	}
+	<-done
+	return nil
+}
+
+func (buffer *bufferedOutput) RetryCount() int64 {
+	return atomic.LoadInt64(&buffer.retries)
+}
+
+func (buffer *bufferedOutput) DuplicateDeliveryCount() int64 {
+	return atomic.LoadInt64(&buffer.duplicates)
+}
+
+// CheckHealth returns the error the last delivery failed with, or nil if it
+// succeeded, unless the free space of the buffer is low or the output is
+// warming up or draining.
+func (buffer *bufferedOutput) CheckHealth() error {
+	if atomic.LoadInt32(&buffer.draining) != 0 {
+		return errors.New("draining")
+	}
+	if !buffer.Ready() {
+		return errors.New("warming up")
+	}
+	if buffer.watchdog != nil {
+		err := buffer.watchdog.Err()
+		if err != nil {
+			return err
+		}
+	}
+	buffer.deliveryErrorMtx.Lock()
+	defer buffer.deliveryErrorMtx.Unlock()
+	return buffer.deliveryError
+}
+
+func (buffer *bufferedOutput) EmitLatency() *ik.LatencyWindow {
+	return buffer.emitLatency
+}
+
+func (buffer *bufferedOutput) FlushLatency() *ik.LatencyWindow {
+	return buffer.flushLatency
+}
+
+// waitForSpace holds off an emission while the free space of the buffer is
+// low, until the output is shut down or ctx is done.
+func (buffer *bufferedOutput) waitForSpace(ctx context.Context) error {
+	if buffer.watchdog == nil || buffer.dropNewest || !buffer.watchdog.Low() {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(buffer.ctx, cancel)
+	defer stop()
+	err := buffer.watchdog.Wait(ctx)
+	if err != nil {
+		return buffer.watchdog.Err()
+	}
+	return nil
+}
+
+func (buffer *bufferedOutput) Emit(recordSets []ik.FluentRecordSet) error {
+	defer buffer.emitLatency.Since(buffer.clock.Now())
+	err := buffer.refuse()
+	if err != nil {
+		return err
+	}
+	recordSets, err = buffer.holdToTenants(recordSets)
+	if err != nil {
+		return err
+	}
+	err = buffer.waitForSpace(context.Background())
+	if err != nil {
+		return err
+	}
+	select {
+	case buffer.c <- bufferedOutputEmission{recordSets, nil, nil}:
+		return nil
+	case <-buffer.stopped:
+		return errors.New("the output has been shut down")
+	}
+}
+
+func (buffer *bufferedOutput) EmitContext(ctx context.Context, recordSets []ik.FluentRecordSet) error {
+	defer buffer.emitLatency.Since(buffer.clock.Now())
+	err := buffer.refuse()
+	if err != nil {
+		return err
+	}
+	recordSets, err = buffer.holdToTenants(recordSets)
+	if err != nil {
+		return err
+	}
+	err = buffer.waitForSpace(ctx)
+	if err != nil {
+		return err
+	}
+	select {
+	case buffer.c <- bufferedOutputEmission{recordSets, nil, nil}:
+		return nil
+	case <-buffer.stopped:
+		return errors.New("the output has been shut down")
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// EmitDurably returns once the records are written, and fsync'ed unless
+// buffer_fsync is never.
+func (buffer *bufferedOutput) EmitDurably(recordSets []ik.FluentRecordSet) error {
+	return buffer.emitDurably(recordSets, nil)
+}
+
+// EmitWithResult is EmitDurably telling the error of each record set.
+func (buffer *bufferedOutput) EmitWithResult(recordSets []ik.FluentRecordSet) []error {
+	results := make([]error, len(recordSets))
+	err := buffer.emitDurably(recordSets, results)
+	if err != nil {
+		for i := range results {
+			results[i] = err
+		}
+	}
+	return results
+}
+
+// emitDurably returns an error if the emission has not gone through, and
+// leaves the error of each record set in results otherwise.
+func (buffer *bufferedOutput) emitDurably(recordSets []ik.FluentRecordSet, results []error) error {
+	defer buffer.emitLatency.Since(buffer.clock.Now())
+	err := buffer.refuse()
+	if err != nil {
+		return err
+	}
+	recordSets, err = buffer.holdToTenants(recordSets)
+	if err != nil {
+		return err
+	}
+	err = buffer.waitForSpace(context.Background())
+	if err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	select {
+	case buffer.c <- bufferedOutputEmission{recordSets, done, results}:
+	case <-buffer.stopped:
+		return errors.New("the output has been shut down")
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-buffer.stopped:
+		return errors.New("the output has been shut down")
+	}
+}
+
+func (buffer *bufferedOutput) sync() error {
+	for _, key := range buffer.journalGroup.GetJournalKeys() {
+		err := buffer.journalGroup.GetJournal(key).Sync()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (buffer *bufferedOutput) Run() error {
+	return buffer.RunContext(context.Background())
+}
+
+func (buffer *bufferedOutput) RunContext(ctx context.Context) error {
+	stop := context.AfterFunc(ctx, buffer.abort)
+	defer stop()
+	// imported once the output has set subKeyer
+	if buffer.fluentdBuffer != "" {
+		err := buffer.importFluentdBuffer(buffer.fluentdBuffer, buffer.fluentdBufferTag)
+		buffer.fluentdBuffer = ""
+		if err != nil {
+			return err
+		}
+	}
+	select {
+	case <-buffer.stopped:
+		buffer.abort()
+		buffer.disposeError = buffer.journalGroup.Dispose()
+		close(buffer.finished)
+		return nil
+	case emission := <-buffer.c:
+		err := buffer.accept(emission)
+		if err != nil {
+			return err
+		}
+	case now := <-buffer.ticker.C():
+		buffer.expire()
+		buffer.compact()
+		if !buffer.Ready() && buffer.warmUpUntil == "delivery" && buffer.probe(now) {
+			buffer.SetReady()
+		}
+		if buffer.Ready() {
+			buffer.flushExpired(now)
+		}
+		buffer.measureTenants()
+	case done := <-buffer.flushes:
+		if buffer.Ready() {
+			buffer.flushSlotsBefore(math.MaxInt64)
+		}
+		close(done)
+	case done := <-buffer.drains:
+		// the emissions that got in before the output began to drain
+	pending:
+		for {
+			select {
+			case emission := <-buffer.c:
+				err := buffer.accept(emission)
+				if err != nil {
+					close(done)
+					return err
+				}
+			default:
+				break pending
+			}
+		}
+		buffer.flushSlotsBefore(math.MaxInt64)
+		close(done)
+	}
+	return ik.Continue
+}
+
+// accept writes the records of the emission, and tells whoever waits for
+// them how it went.
+func (buffer *bufferedOutput) accept(emission bufferedOutputEmission) error {
+	err := buffer.write(emission)
+	if err == nil {
+		buffer.countTenants(emission.recordSets)
+	}
+	if err == nil && buffer.tracer != nil {
+		buffer.tracer.Hop(buffer.plugin, ik.TraceJournalWrite, emission.recordSets, 0)
+	}
+	if err == nil && (buffer.fsync == "always" || (buffer.fsync == "ack" && emission.done != nil)) {
+		err = buffer.sync()
+	}
+	if emission.results != nil {
+		for i := range emission.results {
+			if emission.results[i] == nil {
+				emission.results[i] = err
+			}
+		}
+	}
+	if emission.done != nil {
+		emission.done <- err
+	}
+	return err
+}
+
+// write writes the records of the emission into the journals.  The record
+// sets of an emission waiting for their results are written one by one, so
+// that one failing does not fail the others, and its results are left to
+// be told how the sync went.
+func (buffer *bufferedOutput) write(emission bufferedOutputEmission) error {
+	if emission.results == nil {
+		return buffer.slicer.Emit(emission.recordSets)
+	}
+	for i := range emission.recordSets {
+		emission.results[i] = buffer.slicer.Emit(emission.recordSets[i : i+1])
+	}
+	return nil
+}
+
+func (buffer *bufferedOutput) Shutdown() error {
+	return buffer.ShutdownContext(context.Background())
+}
+
+// ShutdownContext waits for Run to return and dispose of the journals.  If
+// ctx is done first, the delivery Run is blocked in is given up, and it
+// returns the error of ctx without waiting any longer, Run disposing of the
+// journals once it returns.
+func (buffer *bufferedOutput) ShutdownContext(ctx context.Context) error {
+	buffer.stopOnce.Do(func() { close(buffer.stopped) })
+	defer buffer.ticker.Stop()
+	if buffer.watchdog != nil {
+		defer buffer.watchdog.Stop()
+	}
+	select {
+	case <-buffer.finished:
+		return buffer.disposeError
+	case <-ctx.Done():
+		buffer.abort()
+		return ctx.Err()
+	}
+}
+
+func parseBufferedOutputParams(engine ik.Engine, config *ik.ConfigElement) (bufferedOutputParams, error) {
+	params := bufferedOutputParams{
+		clock:            engine.Clock(),
+		tenants:          engine.Tenants(),
+		bufferType:       "file",
+		bufferPath:       "",
+		sqliteDriver:     "sqlite3",
+		bufferChunkLimit: int64(8 * 1024 * 1024), // 8MB
+		flushInterval:    time.Duration(60 * time.Second),
+		location:         time.UTC,
+		permission:       os.FileMode(0644),
+		fsync:            "ack",
+		flushThreads:     1,
+		diskFullAction:   "block",
+		diskInterval:     5 * time.Second,
+	}
+	bufferPath, ok := config.Attrs["buffer_path"]
+	if !ok {
+		return params, errors.New("required attribute `buffer_path' is not specified")
+	}
+	params.bufferPath = bufferPath
+	bufferChunkLimitStr, ok := config.Attrs["buffer_chunk_limit"]
+	if ok {
+		var err error
+		params.bufferChunkLimit, err = ik.ParseCapacityString(bufferChunkLimitStr)
+		if err != nil {
+			return params, err
+		}
+	}
+	flushIntervalStr, ok := config.Attrs["flush_interval"]
+	if ok {
+		var err error
+		params.flushInterval, err = time.ParseDuration(flushIntervalStr)
+		if err != nil {
+			return params, err
+		}
+		if params.flushInterval <= 0 {
+			return params, errors.New(fmt.Sprintf("invalid flush_interval: %s", flushIntervalStr))
+		}
+	}
+	location, err := ik.LocationFromConfig(config, params.location)
+	if err != nil {
+		return params, err
+	}
+	params.location = location
+	timeSliceStr, ok := config.Attrs["buffer_time_slice"]
+	if ok {
+		params.timeSlice, err = time.ParseDuration(timeSliceStr)
+		if err != nil {
+			return params, err
+		}
+		if params.timeSlice <= 0 {
+			return params, errors.New(fmt.Sprintf("invalid buffer_time_slice: %s", timeSliceStr))
+		}
+	}
+	permissionStr, ok := config.Attrs["buffer_permission"]
+	if ok {
+		permission, err := strconv.ParseUint(permissionStr, 8, 32)
+		if err != nil {
+			return params, err
+		}
+		params.permission = os.FileMode(permission)
+	}
+	fsync, ok := config.Attrs["buffer_fsync"]
+	if ok {
+		if fsync != "never" && fsync != "ack" && fsync != "always" {
+			return params, errors.New("unsupported buffer_fsync: " + fsync)
+		}
+		params.fsync = fsync
+	}
+	minFreeSpaceStr, ok := config.Attrs["buffer_min_free_space"]
+	if ok {
+		var err error
+		params.minFreeSpace, err = ik.ParseCapacityString(minFreeSpaceStr)
+		if err != nil {
+			return params, err
+		}
+	}
+	maxAgeStr, ok := config.Attrs["buffer_max_age"]
+	if ok {
+		var err error
+		params.maxAge, err = time.ParseDuration(maxAgeStr)
+		if err != nil {
+			return params, err
+		}
+		if params.maxAge <= 0 {
+			return params, errors.New(fmt.Sprintf("invalid buffer_max_age: %s", maxAgeStr))
+		}
+	}
+	maxTotalBytesStr, ok := config.Attrs["buffer_max_total_bytes"]
+	if ok {
+		var err error
+		params.maxTotalBytes, err = ik.ParseCapacityString(maxTotalBytesStr)
+		if err != nil {
+			return params, err
+		}
+	}
+	compactThresholdStr, ok := config.Attrs["buffer_compact_threshold"]
+	if ok {
+		params.compactThreshold, err = ik.ParseCapacityString(compactThresholdStr)
+		if err != nil || params.compactThreshold <= 0 {
+			return params, errors.New("invalid buffer_compact_threshold: " + compactThresholdStr)
+		}
+	}
+	diskFullAction, ok := config.Attrs["buffer_disk_full_action"]
+	if ok {
+		if diskFullAction != "block" && diskFullAction != "drop_newest" {
+			return params, errors.New("unsupported buffer_disk_full_action: " + diskFullAction)
+		}
+		params.diskFullAction = diskFullAction
+	}
+	diskIntervalStr, ok := config.Attrs["buffer_disk_check_interval"]
+	if ok {
+		var err error
+		params.diskInterval, err = time.ParseDuration(diskIntervalStr)
+		if err != nil {
+			return params, err
+		}
+		if params.diskInterval <= 0 {
+			return params, errors.New(fmt.Sprintf("invalid buffer_disk_check_interval: %s", diskIntervalStr))
+		}
+	}
+	takeOverLockStr, ok := config.Attrs["buffer_take_over_stale_lock"]
+	if ok {
+		var err error
+		params.takeOverLock, err = strconv.ParseBool(takeOverLockStr)
+		if err != nil {
+			return params, err
+		}
+	}
+	// the keys are either in a file or in an environment variable, one per
+	// line or separated by commas, the last of which seals new chunks
+	keys := ""
+	keyPath, ok := config.Attrs["buffer_encryption_key_path"]
+	if ok {
+		blob, err := ioutil.ReadFile(keyPath)
+		if err != nil {
+			return params, err
+		}
+		keys = string(blob)
+	} else {
+		keyEnv, ok := config.Attrs["buffer_encryption_key_env"]
+		if ok {
+			keys = os.Getenv(keyEnv)
+			if keys == "" {
+				return params, errors.New(fmt.Sprintf("environment variable %s is not set", keyEnv))
+			}
+		}
+	}
+	if keys != "" {
+		var err error
+		params.encryption, err = jnl.ParseChunkEncryptionKeys(keys)
+		if err != nil {
+			return params, err
+		}
+	}
+	flushThreadCountStr, ok := config.Attrs["flush_thread_count"]
+	if ok {
+		var err error
+		params.flushThreads, err = strconv.Atoi(flushThreadCountStr)
+		if err != nil {
+			return params, err
+		}
+		if params.flushThreads <= 0 {
+			return params, errors.New("invalid flush_thread_count: " + flushThreadCountStr)
+		}
+	}
+	maxJournalsStr, ok := config.Attrs["max_journals"]
+	if ok {
+		var err error
+		params.maxJournals, err = strconv.Atoi(maxJournalsStr)
+		if err != nil {
+			return params, err
+		}
+		if params.maxJournals <= 0 {
+			return params, errors.New("invalid max_journals: " + maxJournalsStr)
+		}
+	}
+	retryLimitStr, ok := config.Attrs["retry_limit"]
+	if ok {
+		var err error
+		params.retryLimit, err = strconv.Atoi(retryLimitStr)
+		if err != nil {
+			return params, err
+		}
+		if params.retryLimit < 0 {
+			return params, errors.New("invalid retry_limit: " + retryLimitStr)
+		}
+	}
+	orderedStr, ok := config.Attrs["ordered_delivery"]
+	if ok {
+		params.ordered, err = strconv.ParseBool(orderedStr)
+		if err != nil {
+			return params, errors.New("invalid ordered_delivery: " + orderedStr)
+		}
+	}
+	maxStallStr, ok := config.Attrs["ordered_max_stall"]
+	if ok {
+		if !params.ordered {
+			return params, errors.New("ordered_max_stall requires ordered_delivery")
+		}
+		params.maxStall, err = time.ParseDuration(maxStallStr)
+		if err != nil || params.maxStall <= 0 {
+			return params, errors.New("invalid ordered_max_stall: " + maxStallStr)
+		}
+	}
+	maxInFlightBytesStr, ok := config.Attrs["max_in_flight_bytes"]
+	if ok {
+		var err error
+		params.maxInFlightBytes, err = ik.ParseCapacityString(maxInFlightBytesStr)
+		if err != nil {
+			return params, err
+		}
+	}
+	params.chunkHooks, err = parseChunkHookCommands(config)
+	if err != nil {
+		return params, err
+	}
+	params.fluentdBuffer = config.Attrs["fluentd_buffer_path"]
+	params.fluentdBufferTag = config.Attrs["fluentd_buffer_tag"]
+	warmUpUntil, ok := config.Attrs["warm_up_until"]
+	if ok {
+		if warmUpUntil != "signal" && warmUpUntil != "delivery" {
+			return params, errors.New("unsupported warm_up_until: " + warmUpUntil)
+		}
+		params.warmUpUntil = warmUpUntil
+	}
+	bufferType, ok := config.Attrs["buffer_type"]
+	if ok {
+		if bufferType != "file" && bufferType != "sqlite" {
+			return params, errors.New("unsupported buffer_type: " + bufferType)
+		}
+		params.bufferType = bufferType
+	}
+	sqliteDriver, ok := config.Attrs["buffer_sqlite_driver"]
+	if ok {
+		params.sqliteDriver = sqliteDriver
+	}
+	if params.bufferType == "sqlite" {
+		// the buffer path names the database rather than the chunk files
+		for _, name := range []string{"buffer_time_slice", "buffer_min_free_space", "buffer_max_age", "buffer_max_total_bytes", "buffer_compact_threshold", "buffer_encryption_key_path", "buffer_encryption_key_env", "max_journals", "fluentd_buffer_path"} {
+			_, ok := config.Attrs[name]
+			if ok {
+				return params, errors.New(fmt.Sprintf("`%s' is not supported by buffer_type sqlite", name))
+			}
+		}
+		if params.chunkHooks != nil && params.chunkHooks.chunkHooks() != nil {
+			return params, errors.New("chunk hooks are not supported by buffer_type sqlite")
+		}
+		err := checkSQLDriver("buffer_sqlite_driver", params.sqliteDriver)
+		if err != nil {
+			return params, errors.New("buffer_type sqlite is not available: " + err.Error())
+		}
+	}
+	return params, nil
+}
+
+func newBufferedOutput(logger ik.Logger, randSource rand.Source, scorekeeper *ik.Scorekeeper, pluginInstance ik.PluginInstance, params bufferedOutputParams, packer ik.RecordPacker, deliverer func(ctx context.Context, subKey string, chunk ik.JournalChunk) error) (*bufferedOutput, error) {
+	clock := params.clock
+	if clock == nil {
+		clock = ik.SystemClock
+	}
+	var journalGroup ik.JournalGroup
+	var fileJournalGroup *jnl.FileJournalGroup
+	watchdog := (*jnl.DiskSpaceWatchdog)(nil)
+	if params.bufferType == "sqlite" {
+		sqliteJournalGroup, err := jnl.NewSQLiteJournalGroupFactory(
+			logger,
+			params.sqliteDriver,
+			randSource,
+			clock,
+			params.bufferChunkLimit,
+		).GetJournalGroup(params.bufferPath, pluginInstance)
+		if err != nil {
+			return nil, err
+		}
+		journalGroup = sqliteJournalGroup
+	} else {
+		journalGroupFactory := jnl.NewFileJournalGroupFactory(
+			logger,
+			randSource,
+			clock,
+			".log",
+			params.permission,
+			params.bufferChunkLimit,
+		)
+		if scorekeeper != nil {
+			journalGroupFactory.BindScorekeeper(scorekeeper)
+		}
+		if params.encryption != nil {
+			journalGroupFactory.SetEncryption(params.encryption)
+		}
+		if params.chunkHooks != nil {
+			hookCommands := *params.chunkHooks
+			hookCommands.logger = logger
+			hooks := hookCommands.chunkHooks()
+			if hooks != nil {
+				journalGroupFactory.SetChunkHooks(hooks)
+			}
+		}
+		journalGroupFactory.SetTakeOverStaleLock(params.takeOverLock)
+		if params.minFreeSpace > 0 {
+			watchdog = jnl.NewDiskSpaceWatchdog(logger, params.bufferPath, params.minFreeSpace, params.diskInterval, clock)
+			journalGroupFactory.SetDiskSpaceWatchdog(watchdog, params.diskFullAction == "drop_newest")
+		}
+		if params.maxJournals > 0 {
+			journalGroupFactory.SetMaxJournals(params.maxJournals)
+		}
+		if params.timeSlice > 0 {
+			journalGroupFactory.SetTimeSlice(params.timeSlice, params.location)
+		}
+		journalGroupFactory.SetRetention(params.maxAge, params.maxTotalBytes)
+		journalGroupFactory.SetCompaction(params.compactThreshold)
+		var err error
+		fileJournalGroup, err = journalGroupFactory.GetJournalGroup(params.bufferPath, pluginInstance)
+		if err != nil {
+			return nil, err
+		}
+		journalGroup = fileJournalGroup
+	}
+	buffer := &bufferedOutput{
+		logger:           logger,
+		journalGroup:     journalGroup,
+		flushInterval:    params.flushInterval,
+		location:         params.location,
+		fluentdBuffer:    params.fluentdBuffer,
+		fluentdBufferTag: params.fluentdBufferTag,
+		flushThreads:     params.flushThreads,
+		retryLimit:       params.retryLimit,
+		failures:         make(map[string]int),
+		failedSince:      make(map[string]time.Time),
+		ordered:          params.ordered,
+		maxStall:         params.maxStall,
+		clock:            clock,
+		deliverer:        deliverer,
+		fsync:            params.fsync,
+		c:                make(chan bufferedOutputEmission, 100 /* FIXME */),
+		stopped:          make(chan bool),
+		finished:         make(chan bool),
+		flushes:          make(chan chan struct{}),
+		drains:           make(chan chan struct{}),
+		ticker:           clock.NewTicker(params.flushInterval),
+		emitLatency:      ik.NewDefaultLatencyWindow(clock),
+		flushLatency:     ik.NewDefaultLatencyWindow(clock),
+		warmUpUntil:      params.warmUpUntil,
+		tenants:          params.tenants,
+		tenantBytes:      make(map[string]int64),
+		delivering:       make(map[string]bool),
+	}
+	if params.warmUpUntil == "" {
+		buffer.ready = 1
+	}
+	if params.timeSlice > 0 {
+		buffer.sliceKey = fileJournalGroup.SliceKey
+	}
+	if watchdog != nil {
+		buffer.watchdog = watchdog
+		buffer.dropNewest = params.diskFullAction == "drop_newest"
+		watchdog.Start()
+	}
+	slicer := ik.NewSlicer(
+		journalGroup,
+		buffer.journalKey,
+		packer,
+		logger,
+	)
+	slicer.AddNewKeyEventListener(func(last ik.Journal, next ik.Journal) error {
+		if next != nil {
+			buffer.attachListeners(next)
+		}
+		return nil
+	})
+	for _, key := range journalGroup.GetJournalKeys() {
+		buffer.attachListeners(journalGroup.GetJournal(key))
+	}
+	buffer.ctx, buffer.abort = context.WithCancel(context.Background())
+	buffer.onPanic = func(panicked *ik.Panicked) {
+		logger.Critical("deliverer panicked: %s\n%s", panicked.Error(), string(panicked.Stack()))
+	}
+	buffer.deadLetter = func(cause error, lines []string) {}
+	buffer.deadLetterSets = func(cause error, recordSets []ik.FluentRecordSet) {}
+	if params.maxInFlightBytes > 0 {
+		buffer.inFlight = newInFlightLimiter(params.maxInFlightBytes)
+	}
+	buffer.slicer = slicer
+	buffer.measureTenants()
+	return buffer, nil
+}
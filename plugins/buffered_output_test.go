@@ -0,0 +1,1111 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/iktest"
+	jnl "github.com/moriyoshi/ik/journal"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testLogger struct{ t *testing.T }
+
+func (logger *testLogger) Critical(format string, args ...interface{}) {
+	logger.t.Logf(format, args...)
+}
+
+func (logger *testLogger) Error(format string, args ...interface{}) {
+	logger.t.Logf(format, args...)
+}
+
+func (logger *testLogger) Warning(format string, args ...interface{}) {
+	logger.t.Logf(format, args...)
+}
+
+func (logger *testLogger) Notice(format string, args ...interface{}) {
+	logger.t.Logf(format, args...)
+}
+
+func (logger *testLogger) Info(format string, args ...interface{}) {
+	logger.t.Logf(format, args...)
+}
+
+func (logger *testLogger) Debug(format string, args ...interface{}) {
+	logger.t.Logf(format, args...)
+}
+
+// testClock tells the time the tests give it by now, and waits on the
+// system clock.
+type testClock struct {
+	ik.Clock
+	now func() time.Time
+}
+
+func newTestClock(now func() time.Time) ik.Clock {
+	return testClock{ik.SystemClock, now}
+}
+
+func (clock testClock) Now() time.Time {
+	return clock.now()
+}
+
+type testPluginInstance struct{}
+
+func (*testPluginInstance) Run() error         { return nil }
+func (*testPluginInstance) Shutdown() error    { return nil }
+func (*testPluginInstance) Factory() ik.Plugin { return &StdoutOutputFactory{} }
+
+type testPacker struct{}
+
+func (*testPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	return []byte(record.Data["message"].(string)), nil
+}
+
+func Test_bufferedOutput_FlushExpired(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	delivered := make([]string, 0)
+	failing := true
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Minute,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+		},
+		&testPacker{},
+		func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+			if failing {
+				return errors.New("failed")
+			}
+			return readChunk(chunk, func(reader io.Reader) error {
+				b, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				delivered = append(delivered, string(b))
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	buffer.clock = newTestClock(func() time.Time { return now })
+	err = buffer.slicer.Emit([]ik.FluentRecordSet{
+		{
+			Tag: "test",
+			Records: []ik.TinyFluentRecord{
+				{Timestamp: 0, Data: map[string]interface{}{"message": "a"}},
+				{Timestamp: 0, Data: map[string]interface{}{"message": "b"}},
+			},
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	buffer.flushExpired(now)
+	if len(delivered) != 0 {
+		t.Fail()
+	}
+	buffer.flushExpired(now.Add(time.Minute))
+	if len(delivered) != 0 {
+		t.Fail()
+	}
+	failing = false
+	buffer.flushExpired(now.Add(time.Minute))
+	if len(delivered) != 1 || delivered[0] != "ab" {
+		t.Logf("%v", delivered)
+		t.Fail()
+	}
+	buffer.flushExpired(now.Add(2 * time.Minute))
+	if len(delivered) != 1 {
+		t.Fail()
+	}
+	files, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.FailNow()
+	}
+	// but the lock of the buffer, which is still open
+	if len(files) != 1 || !strings.HasSuffix(files[0].Name(), ".lock") {
+		t.Fail()
+	}
+}
+
+func Test_bufferedOutput_TimeSlice(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	delivered := make(map[int64]string)
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Minute,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+			timeSlice:        5 * time.Minute,
+		},
+		&testPacker{},
+		func(_ context.Context, subKey string, chunk ik.JournalChunk) error {
+			if subKey != "test" {
+				t.Errorf("unexpected sub key: %s", subKey)
+			}
+			slice, ok := chunk.(interface {
+				TimeSlice() (time.Time, bool)
+			}).TimeSlice()
+			if !ok {
+				t.Error("the chunk has no time slice")
+			}
+			return readChunk(chunk, func(reader io.Reader) error {
+				b, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				delivered[slice.Unix()] += string(b)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	buffer.subKeyer = func(record ik.FluentRecord) string { return record.Tag }
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	buffer.clock = newTestClock(func() time.Time { return now })
+	err = buffer.slicer.Emit([]ik.FluentRecordSet{
+		{
+			Tag: "test",
+			Records: []ik.TinyFluentRecord{
+				{Timestamp: 0, Data: map[string]interface{}{"message": "a"}},
+				{Timestamp: 400, Data: map[string]interface{}{"message": "b"}},
+				{Timestamp: 299, Data: map[string]interface{}{"message": "c"}},
+			},
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	buffer.flushExpired(now.Add(time.Minute))
+	if len(delivered) != 2 || delivered[0] != "ac" || delivered[300] != "b" {
+		t.Fatalf("%v", delivered)
+	}
+}
+
+func Test_bufferedOutput_MinFreeSpace(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	for _, action := range []string{"block", "drop_newest"} {
+		buffer, err := newBufferedOutput(
+			&testLogger{t},
+			rand.NewSource(0),
+			nil,
+			&testPluginInstance{},
+			bufferedOutputParams{
+				bufferPath:       tempDir + "/" + action,
+				bufferChunkLimit: 1024,
+				flushInterval:    time.Minute,
+				location:         time.UTC,
+				permission:       os.FileMode(0644),
+				minFreeSpace:     math.MaxInt64,
+				diskFullAction:   action,
+				diskInterval:     time.Hour,
+			},
+			&testPacker{},
+			func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+				return nil
+			},
+		)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		go func() {
+			for buffer.Run() == ik.Continue {
+			}
+		}()
+		if buffer.CheckHealth() == nil {
+			t.Errorf("%s: the output is healthy", action)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		err = buffer.EmitContext(ctx, []ik.FluentRecordSet{
+			{
+				Tag:     "test",
+				Records: []ik.TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"message": "a"}}},
+			},
+		})
+		cancel()
+		if (err == nil) != (action == "drop_newest") {
+			t.Errorf("%s: %v", action, err)
+		}
+		if action == "drop_newest" {
+			err = buffer.EmitDurably([]ik.FluentRecordSet{
+				{
+					Tag:     "test",
+					Records: []ik.TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"message": "b"}}},
+				},
+			})
+			if err != nil || buffer.journalGroup.(*jnl.FileJournalGroup).Stats().Chunks != 0 || buffer.journalGroup.(*jnl.FileJournalGroup).Dropped() != 2 {
+				t.Errorf("%s: %v", action, err)
+			}
+			buffer.Shutdown()
+		} else {
+			// the emission held off is let go on shutdown
+			done := make(chan error)
+			go func() {
+				done <- buffer.Emit([]ik.FluentRecordSet{{Tag: "test"}})
+			}()
+			time.Sleep(10 * time.Millisecond)
+			buffer.Shutdown()
+			if <-done == nil {
+				t.Errorf("%s: the emission went through", action)
+			}
+		}
+	}
+}
+
+// badTagPacker fails to pack the records tagged bad.
+type badTagPacker struct{ testPacker }
+
+func (packer *badTagPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	if record.Tag == "bad" {
+		return nil, errors.New("cannot pack")
+	}
+	return packer.testPacker.Pack(record)
+}
+
+func Test_bufferedOutput_EmitWithResult(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	delivered := make(chan string, 1)
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Hour,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+		},
+		&badTagPacker{},
+		func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+			return readChunk(chunk, func(reader io.Reader) error {
+				b, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				delivered <- string(b)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	go func() {
+		for buffer.Run() == ik.Continue {
+		}
+	}()
+	defer buffer.Shutdown()
+	results := buffer.EmitWithResult([]ik.FluentRecordSet{
+		{Tag: "good", Records: []ik.TinyFluentRecord{{Data: map[string]interface{}{"message": "a"}}}},
+		{Tag: "bad", Records: []ik.TinyFluentRecord{{Data: map[string]interface{}{"message": "b"}}}},
+		{Tag: "good", Records: []ik.TinyFluentRecord{{Data: map[string]interface{}{"message": "c"}}}},
+	})
+	if len(results) != 3 || results[0] != nil || results[1] == nil || results[2] != nil {
+		t.Fatalf("%v", results)
+	}
+	err = buffer.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if b := <-delivered; b != "ac" {
+		t.Fatal(b)
+	}
+}
+
+func Test_bufferedOutput_Flush(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	delivered := make(chan string, 1)
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Hour,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+		},
+		&testPacker{},
+		func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+			return readChunk(chunk, func(reader io.Reader) error {
+				b, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				delivered <- string(b)
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	go func() {
+		for buffer.Run() == ik.Continue {
+		}
+	}()
+	err = buffer.EmitDurably([]ik.FluentRecordSet{
+		{
+			Tag:     "test",
+			Records: []ik.TinyFluentRecord{{Timestamp: uint64(time.Now().Unix()), Data: map[string]interface{}{"message": "a"}}},
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	// the slot is still being written to
+	err = buffer.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case b := <-delivered:
+		if b != "a" {
+			t.Fail()
+		}
+	default:
+		t.Fail()
+	}
+	buffer.Shutdown()
+	if buffer.Flush() == nil {
+		t.Fail()
+	}
+}
+
+func Test_bufferedOutput_RetryLimit(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	attempts := 0
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Minute,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+			retryLimit:       2,
+		},
+		&testPacker{},
+		func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+			attempts += 1
+			return errors.New("failed")
+		},
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	var deadLetters []string
+	buffer.deadLetter = func(cause error, lines []string) {
+		deadLetters = append(deadLetters, lines...)
+	}
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	buffer.clock = newTestClock(func() time.Time { return now })
+	err = buffer.slicer.Emit([]ik.FluentRecordSet{
+		{
+			Tag: "test",
+			Records: []ik.TinyFluentRecord{
+				{Timestamp: 0, Data: map[string]interface{}{"message": "a\n"}},
+				{Timestamp: 0, Data: map[string]interface{}{"message": "b\n"}},
+			},
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	for i := 0; i < 2; i += 1 {
+		buffer.flushExpired(now.Add(time.Minute))
+		if len(deadLetters) != 0 {
+			t.FailNow()
+		}
+	}
+	buffer.flushExpired(now.Add(time.Minute))
+	if attempts != 3 || len(deadLetters) != 2 || deadLetters[0] != "a" || deadLetters[1] != "b" {
+		t.Logf("%d attempts, %v", attempts, deadLetters)
+		t.Fail()
+	}
+	if len(buffer.failures) != 0 {
+		t.Fail()
+	}
+	if err := buffer.CheckHealth(); err == nil || err.Error() != "failed" {
+		t.Fail()
+	}
+	buffer.flushExpired(now.Add(2 * time.Minute))
+	if attempts != 3 {
+		t.Fail()
+	}
+}
+
+func Test_bufferedOutput_OrderedDelivery(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	failing := true
+	delivered := []string{}
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Minute,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+			flushThreads:     4,
+			ordered:          true,
+			maxStall:         time.Hour,
+		},
+		&testPacker{},
+		func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+			return readChunk(chunk, func(reader io.Reader) error {
+				b, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				if failing && string(b) == "a\n" {
+					return errors.New("failed")
+				}
+				delivered = append(delivered, string(b))
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	var deadLetters []string
+	buffer.deadLetter = func(cause error, lines []string) {
+		deadLetters = append(deadLetters, lines...)
+	}
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	buffer.clock = newTestClock(func() time.Time { return now })
+	for _, message := range []string{"a\n", "b\n", "c\n"} {
+		err = buffer.slicer.Emit([]ik.FluentRecordSet{
+			{
+				Tag:     "test",
+				Records: []ik.TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"message": message}}},
+			},
+		})
+		if err != nil {
+			t.FailNow()
+		}
+		now = now.Add(time.Minute)
+	}
+	// the slots after the one failing wait for it
+	buffer.flushExpired(now)
+	if len(delivered) != 0 {
+		t.Fatalf("%v", delivered)
+	}
+	failing = false
+	buffer.flushExpired(now)
+	if strings.Join(delivered, "") != "a\nb\nc\n" {
+		t.Fatalf("%v", delivered)
+	}
+
+	// a chunk stalling the delivery for too long is given up
+	failing = true
+	delivered = []string{}
+	for _, message := range []string{"a\n", "b\n"} {
+		buffer.slicer.Emit([]ik.FluentRecordSet{
+			{
+				Tag:     "test",
+				Records: []ik.TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"message": message}}},
+			},
+		})
+		now = now.Add(time.Minute)
+	}
+	buffer.flushExpired(now)
+	now = now.Add(30 * time.Minute)
+	buffer.flushExpired(now)
+	if len(delivered) != 0 || len(deadLetters) != 0 {
+		t.Fatalf("%v %v", delivered, deadLetters)
+	}
+	now = now.Add(30 * time.Minute)
+	buffer.flushExpired(now)
+	if len(deadLetters) != 1 || deadLetters[0] != "a" || strings.Join(delivered, "") != "b\n" {
+		t.Fatalf("%v %v", delivered, deadLetters)
+	}
+}
+
+func Test_bufferedOutput_MaxInFlightBytes(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	inFlight, maxInFlight := int32(0), int32(0)
+	delivered := int32(0)
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Minute,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+			flushThreads:     4,
+			maxInFlightBytes: 3,
+		},
+		&testPacker{},
+		func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+			atomic.AddInt32(&delivered, 1)
+			return nil
+		},
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	buffer.clock = newTestClock(func() time.Time { return now })
+	buffer.subKeyer = func(record ik.FluentRecord) string { return record.Tag }
+	recordSets := []ik.FluentRecordSet{}
+	for _, tag := range []string{"a", "b", "c", "d"} {
+		recordSets = append(recordSets, ik.FluentRecordSet{
+			Tag:     tag,
+			Records: []ik.TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"message": "xx"}}},
+		})
+	}
+	err = buffer.slicer.Emit(recordSets)
+	if err != nil {
+		t.FailNow()
+	}
+	buffer.flushExpired(now.Add(time.Minute))
+	// two chunks of 2 bytes each exceed the bound
+	if delivered != 4 || maxInFlight != 1 {
+		t.Logf("delivered=%d, maxInFlight=%d", delivered, maxInFlight)
+		t.Fail()
+	}
+}
+
+func Test_inFlightLimiter(t *testing.T) {
+	limiter := newInFlightLimiter(3)
+	if limiter.acquire(context.Background(), 2) != nil {
+		t.FailNow()
+	}
+	// given up once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	acquired := make(chan error, 1)
+	go func() { acquired <- limiter.acquire(ctx, 2) }()
+	cancel()
+	if err := <-acquired; err != context.Canceled {
+		t.Fatalf("%v", err)
+	}
+	go func() { acquired <- limiter.acquire(context.Background(), 2) }()
+	limiter.release(2)
+	if err := <-acquired; err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func Test_bufferedOutput_DuplicateDelivery(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	deliveries := int32(0)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Minute,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+		},
+		&testPacker{},
+		func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+			if atomic.AddInt32(&deliveries, 1) == 1 {
+				close(started)
+				<-release
+			}
+			return nil
+		},
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	buffer.clock = newTestClock(func() time.Time { return now })
+	err = buffer.slicer.Emit([]ik.FluentRecordSet{
+		{
+			Tag:     "test",
+			Records: []ik.TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"message": "a"}}},
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	key := buffer.journalGroup.GetJournalKeys()[0]
+	_, subKey, _ := buffer.splitKey(key)
+	done := make(chan struct{})
+	go func() {
+		buffer.flushJournal(key, subKey)
+		close(done)
+	}()
+	<-started
+	// a flush coming upon the chunk being delivered leaves it alone
+	buffer.flushJournal(key, subKey)
+	if buffer.DuplicateDeliveryCount() != 1 {
+		t.Fail()
+	}
+	close(release)
+	<-done
+	buffer.flushJournal(key, subKey)
+	if deliveries != 1 {
+		t.Fatalf("delivered %d times", deliveries)
+	}
+}
+
+func Test_bufferedOutput_ShutdownContext(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	delivering := make(chan bool, 1)
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    10 * time.Millisecond,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+		},
+		&testPacker{},
+		// hangs up until it is cancelled
+		func(ctx context.Context, _ string, chunk ik.JournalChunk) error {
+			delivering <- true
+			<-ctx.Done()
+			return ctx.Err()
+		},
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	buffer.clock = newTestClock(func() time.Time { return now })
+	err = buffer.slicer.Emit([]ik.FluentRecordSet{
+		{
+			Tag:     "test",
+			Records: []ik.TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"message": "a"}}},
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	go func() {
+		for buffer.Run() == ik.Continue {
+		}
+	}()
+	<-delivering
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	// returns without waiting for Run past the deadline
+	err = buffer.ShutdownContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("%v", err)
+	}
+	<-buffer.finished
+	if buffer.RetryCount() != 1 {
+		t.Fail()
+	}
+	if buffer.Emit([]ik.FluentRecordSet{{Tag: "test"}}) == nil {
+		t.Fail()
+	}
+	// the chunk is left for the next run
+	files, err := ioutil.ReadDir(tempDir)
+	if err != nil {
+		t.FailNow()
+	}
+	if len(files) != 1 {
+		t.Fail()
+	}
+}
+
+func Test_bufferedOutput_FlushThreadPanic(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	panics := int32(0)
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Minute,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+			flushThreads:     2,
+		},
+		&testPacker{},
+		func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+			panic("boom")
+		},
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	buffer.onPanic = func(panicked *ik.Panicked) {
+		atomic.AddInt32(&panics, 1)
+	}
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	buffer.clock = newTestClock(func() time.Time { return now })
+	err = buffer.slicer.Emit([]ik.FluentRecordSet{
+		{
+			Tag:     "test",
+			Records: []ik.TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"message": "a"}}},
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	buffer.flushExpired(now.Add(time.Minute))
+	if panics != 1 || buffer.RetryCount() != 1 {
+		t.Fail()
+	}
+	// the chunk is kept for the next try
+	if len(buffer.journalGroup.GetJournalKeys()) != 1 {
+		t.Fail()
+	}
+}
+
+func Test_bufferedOutput_WarmUp(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	clock := iktest.NewClock(time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC))
+	delivered := make([]string, 0)
+	failing := true
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Minute,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+			retryLimit:       1,
+			warmUpUntil:      "delivery",
+			clock:            clock,
+		},
+		&testPacker{},
+		func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+			if failing {
+				return errors.New("failed")
+			}
+			return readChunk(chunk, func(reader io.Reader) error {
+				b, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				delivered = append(delivered, string(b))
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer buffer.journalGroup.Dispose()
+	if buffer.Ready() || buffer.CheckHealth() == nil || buffer.CheckHealth().Error() != "warming up" {
+		t.FailNow()
+	}
+	for _, message := range []string{"a", "b"} {
+		err = buffer.slicer.Emit([]ik.FluentRecordSet{
+			{Tag: "test", Records: []ik.TinyFluentRecord{{Data: map[string]interface{}{"message": message}}}},
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		clock.Advance(time.Minute)
+	}
+	// the oldest slot is tried, and kept past the retry limit
+	if buffer.Run() != ik.Continue || buffer.Ready() || len(delivered) != 0 || buffer.RetryCount() != 1 {
+		t.Fatalf("%v", delivered)
+	}
+	failing = false
+	clock.Advance(time.Minute)
+	if buffer.Run() != ik.Continue || !buffer.Ready() || buffer.CheckHealth() != nil {
+		t.FailNow()
+	}
+	if len(delivered) != 2 || delivered[0] != "a" || delivered[1] != "b" {
+		t.Fatalf("%v", delivered)
+	}
+}
+
+func Test_bufferedOutput_Drain(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	delivered := make([]string, 0)
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Hour,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+			warmUpUntil:      "signal",
+		},
+		&testPacker{},
+		func(_ context.Context, _ string, chunk ik.JournalChunk) error {
+			return readChunk(chunk, func(reader io.Reader) error {
+				b, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				delivered = append(delivered, string(b))
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets := []ik.FluentRecordSet{
+		{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: uint64(time.Now().Unix()), Data: map[string]interface{}{"message": "a"}}}},
+	}
+	// nothing is delivered while warming up, and no more is accepted once
+	// draining, the emissions queued before included
+	err = buffer.Emit(recordSets)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	go func() {
+		for buffer.Run() == ik.Continue {
+		}
+	}()
+	err = buffer.Flush()
+	if err != nil || len(delivered) != 0 {
+		t.Fatalf("%v %v", err, delivered)
+	}
+	err = buffer.Drain()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(delivered) != 1 || delivered[0] != "a" {
+		t.Fatalf("%v", delivered)
+	}
+	if buffer.Emit(recordSets) == nil || buffer.EmitDurably(recordSets) == nil {
+		t.Fail()
+	}
+	if err := buffer.CheckHealth(); err == nil || err.Error() != "draining" {
+		t.Fail()
+	}
+	buffer.SetReady()
+	if !buffer.Ready() {
+		t.Fail()
+	}
+	buffer.Shutdown()
+	if buffer.Drain() == nil {
+		t.Fail()
+	}
+}
+
+func Test_bufferedOutput_Tenants(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	tenants, err := ik.ParseTenants(&ik.Config{Root: &ik.ConfigElement{Elems: []*ik.ConfigElement{
+		{Name: "tenants", Attrs: map[string]string{}, Elems: []*ik.ConfigElement{
+			{Name: "tenant", Args: "team-a", Attrs: map[string]string{"max_buffered_bytes": "1", "overflow_action": "dead_letter"}},
+			{Name: "tenant", Args: "team-b", Attrs: map[string]string{"max_buffered_bytes": "1", "overflow_action": "block"}},
+		}},
+	}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	delivered := make([]string, 0)
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Hour,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+			tenants:          tenants,
+		},
+		&testPacker{},
+		func(_ context.Context, subKey string, chunk ik.JournalChunk) error {
+			return readChunk(chunk, func(reader io.Reader) error {
+				b, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				delivered = append(delivered, string(b))
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	deadLetters := make([]ik.FluentRecordSet, 0)
+	buffer.deadLetterSets = func(_ error, recordSets []ik.FluentRecordSet) {
+		deadLetters = append(deadLetters, recordSets...)
+	}
+	go func() {
+		for buffer.Run() == ik.Continue {
+		}
+	}()
+	defer buffer.Shutdown()
+	record := func(tenant string, message string) ik.TinyFluentRecord {
+		return ik.TinyFluentRecord{Timestamp: uint64(time.Now().Unix()), Data: map[string]interface{}{"tenant": tenant, "message": message}}
+	}
+	err = buffer.EmitDurably([]ik.FluentRecordSet{
+		{Tag: "test", Records: []ik.TinyFluentRecord{record("team-a", "a"), record("team-b", "b"), record("", "c")}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// each tenant has journals of its own
+	tenantKeys := 0
+	for _, key := range buffer.journalGroup.GetJournalKeys() {
+		tenant, _ := splitTenantKey(key)
+		if tenant == "team-a" || tenant == "team-b" {
+			tenantKeys += 1
+		}
+	}
+	if tenantKeys != 2 {
+		t.Fatalf("%v", buffer.journalGroup.GetJournalKeys())
+	}
+	// the tenants are over their quotas, and go over them each its own way
+	err = buffer.EmitDurably([]ik.FluentRecordSet{
+		{Tag: "test", Records: []ik.TinyFluentRecord{record("team-a", "d"), record("", "e")}},
+	})
+	if err != nil || len(deadLetters) != 1 || deadLetters[0].Records[0].Data["message"] != "d" {
+		t.Fatalf("%v %v", err, deadLetters)
+	}
+	if tenants.Lookup("team-a").Overflows() != 1 {
+		t.Fail()
+	}
+	err = buffer.EmitDurably([]ik.FluentRecordSet{
+		{Tag: "test", Records: []ik.TinyFluentRecord{record("team-b", "f")}},
+	})
+	if err == nil || err.Error() != "tenant team-b exceeds max_buffered_bytes of 1 bytes" {
+		t.Fatalf("%v", err)
+	}
+	// the quotas are back once the buffer is delivered and measured
+	err = buffer.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buffer.measureTenants()
+	err = buffer.EmitDurably([]ik.FluentRecordSet{
+		{Tag: "test", Records: []ik.TinyFluentRecord{record("team-b", "f")}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = buffer.Flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if all := strings.Join(delivered, ""); len(all) != 5 || !strings.Contains(all, "f") || strings.Contains(all, "d") {
+		t.Fatalf("%v", delivered)
+	}
+}
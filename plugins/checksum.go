@@ -0,0 +1,39 @@
+package plugins
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strings"
+)
+
+// The digests of the chunks sent to remotes are given in the format of the
+// Digest header of RFC 3230, i.e. SHA-256=<base64>.
+const chunkDigestAlgorithm = "SHA-256"
+
+func newChunkDigest() hash.Hash {
+	return sha256.New()
+}
+
+func formatChunkDigest(digest hash.Hash) string {
+	return chunkDigestAlgorithm + "=" + base64.StdEncoding.EncodeToString(digest.Sum(nil))
+}
+
+func chunkDigestOf(data []byte) string {
+	digest := newChunkDigest()
+	digest.Write(data)
+	return formatChunkDigest(digest)
+}
+
+// verifyChunkDigest fails if the data does not match the digest.
+func verifyChunkDigest(expected string, data []byte) error {
+	if !strings.HasPrefix(expected, chunkDigestAlgorithm+"=") {
+		return errors.New("unsupported checksum: " + expected)
+	}
+	actual := chunkDigestOf(data)
+	if actual != expected {
+		return errors.New("checksum mismatch: expected " + expected + ", got " + actual)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	jnl "github.com/moriyoshi/ik/journal"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// chunkHookCommands runs a shell command when a chunk of the buffer comes
+// to rest, another after it is purged and another when it expires
+// undelivered, given the chunk in the environment:
+//
+//	IK_CHUNK_EVENT      rest, purge or expire
+//	IK_CHUNK_PATH       the path of the chunk file
+//	IK_CHUNK_KEY        the key of the journal of the chunk
+//	IK_CHUNK_TIMESTAMP  when the chunk was created, in RFC 3339
+//	IK_CHUNK_UNIQUE_ID  the unique id of the chunk, in hex
+//	IK_CHUNK_SIZE       the size of the chunk file in bytes
+//
+// The rest command is waited for, so that it can copy the chunk before it
+// is delivered and removed, and blocks the buffer while it runs; so is the
+// expire command, for the chunk to be archived.  The purge command is run
+// in the background.  Any of them is killed after the timeout.
+type chunkHookCommands struct {
+	logger        ik.Logger
+	restCommand   string
+	purgeCommand  string
+	expireCommand string
+	timeout       time.Duration
+}
+
+func (hooks *chunkHookCommands) run(command string, eventName string, event jnl.ChunkEvent) error {
+	cmd := newShellCommand(command)
+	cmd.Env = append(os.Environ(),
+		"IK_CHUNK_EVENT="+eventName,
+		"IK_CHUNK_PATH="+event.Path,
+		"IK_CHUNK_KEY="+event.Key,
+		"IK_CHUNK_TIMESTAMP="+event.Timestamp.UTC().Format(time.RFC3339Nano),
+		"IK_CHUNK_UNIQUE_ID="+event.UniqueId,
+		"IK_CHUNK_SIZE="+strconv.FormatInt(event.Size, 10),
+	)
+	stderr := &cappedBuffer{limit: maxStderrSize}
+	cmd.Stderr = stderr
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+	timer := time.AfterFunc(hooks.timeout, func() {
+		killCommand(cmd)
+	})
+	err = cmd.Wait()
+	if !timer.Stop() {
+		return errors.New(fmt.Sprintf("`%s' timed out after %s", command, hooks.timeout.String()))
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("`%s' failed: %s: %s", command, err.Error(), strings.TrimSpace(stderr.String())))
+	}
+	return nil
+}
+
+func (hooks *chunkHookCommands) onRest(event jnl.ChunkEvent) {
+	err := hooks.run(hooks.restCommand, "rest", event)
+	if err != nil {
+		hooks.logger.Error("chunk hook on %s: %s", event.Path, err.Error())
+	}
+}
+
+func (hooks *chunkHookCommands) onPurge(event jnl.ChunkEvent) {
+	go func() {
+		err := hooks.run(hooks.purgeCommand, "purge", event)
+		if err != nil {
+			hooks.logger.Error("chunk hook on %s: %s", event.Path, err.Error())
+		}
+	}()
+}
+
+func (hooks *chunkHookCommands) onExpire(event jnl.ChunkEvent) {
+	err := hooks.run(hooks.expireCommand, "expire", event)
+	if err != nil {
+		hooks.logger.Error("chunk hook on %s: %s", event.Path, err.Error())
+	}
+}
+
+// chunkHooks returns the hooks running the commands, or nil if there are
+// none.
+func (hooks *chunkHookCommands) chunkHooks() *jnl.ChunkHooks {
+	if hooks.restCommand == "" && hooks.purgeCommand == "" && hooks.expireCommand == "" {
+		return nil
+	}
+	retval := &jnl.ChunkHooks{}
+	if hooks.restCommand != "" {
+		retval.OnRest = hooks.onRest
+	}
+	if hooks.purgeCommand != "" {
+		retval.OnPurge = hooks.onPurge
+	}
+	if hooks.expireCommand != "" {
+		retval.OnExpire = hooks.onExpire
+	}
+	return retval
+}
+
+// parseChunkHookCommands reads buffer_chunk_rest_command,
+// buffer_chunk_purge_command, buffer_chunk_expire_command and
+// buffer_chunk_hook_timeout, which defaults to a minute.
+func parseChunkHookCommands(config *ik.ConfigElement) (*chunkHookCommands, error) {
+	timeout, err := parseForwardDuration(config, "buffer_chunk_hook_timeout", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, errors.New("invalid buffer_chunk_hook_timeout: " + config.Attrs["buffer_chunk_hook_timeout"])
+	}
+	return &chunkHookCommands{
+		restCommand:   config.Attrs["buffer_chunk_rest_command"],
+		purgeCommand:  config.Attrs["buffer_chunk_purge_command"],
+		expireCommand: config.Attrs["buffer_chunk_expire_command"],
+		timeout:       timeout,
+	}, nil
+}
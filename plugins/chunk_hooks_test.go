@@ -0,0 +1,67 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	jnl "github.com/moriyoshi/ik/journal"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_chunkHookCommands(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the unix shell")
+	}
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	commands, err := parseChunkHookCommands(&ik.ConfigElement{Attrs: map[string]string{
+		"buffer_chunk_rest_command": "echo \"$IK_CHUNK_EVENT $IK_CHUNK_KEY $IK_CHUNK_SIZE $IK_CHUNK_TIMESTAMP\" > " + tempDir + "/out",
+		"buffer_chunk_hook_timeout": "100ms",
+	}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	commands.logger = &testLogger{t}
+	hooks := commands.chunkHooks()
+	if hooks == nil || hooks.OnRest == nil || hooks.OnPurge != nil {
+		t.FailNow()
+	}
+	hooks.OnRest(jnl.ChunkEvent{Path: "/chunk", Key: "key", Size: 5, Timestamp: time.Unix(1400000000, 0)})
+	out, err := ioutil.ReadFile(tempDir + "/out")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.TrimSpace(string(out)) != "rest key 5 2014-05-13T16:53:20Z" {
+		t.Fatalf("%q", out)
+	}
+
+	commands.restCommand = "sleep 10"
+	err = commands.run(commands.restCommand, "rest", jnl.ChunkEvent{})
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("%v", err)
+	}
+
+	commands, err = parseChunkHookCommands(&ik.ConfigElement{Attrs: map[string]string{"buffer_chunk_expire_command": "true"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	hooks = commands.chunkHooks()
+	if hooks == nil || hooks.OnExpire == nil || hooks.OnRest != nil {
+		t.FailNow()
+	}
+
+	commands, err = parseChunkHookCommands(&ik.ConfigElement{Attrs: map[string]string{}})
+	if err != nil || commands.chunkHooks() != nil {
+		t.Fail()
+	}
+	_, err = parseChunkHookCommands(&ik.ConfigElement{Attrs: map[string]string{"buffer_chunk_hook_timeout": "-1s"}})
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,664 @@
+package plugins
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"math"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clickHouseRevision is the revision of the native protocol spoken.  It is
+// older than LowCardinality, so that the server hands those columns as
+// their plain types.
+const clickHouseRevision = 54213
+
+const (
+	clickHouseClientHello = 0
+	clickHouseClientQuery = 1
+	clickHouseClientData  = 2
+)
+
+const (
+	clickHouseServerHello       = 0
+	clickHouseServerData        = 1
+	clickHouseServerException   = 2
+	clickHouseServerProgress    = 3
+	clickHouseServerEndOfStream = 5
+	clickHouseServerProfileInfo = 6
+)
+
+type clickHouseColumn struct {
+	name  string
+	type_ string
+}
+
+type clickHouseException struct {
+	code    int32
+	name    string
+	message string
+}
+
+func (err *clickHouseException) Error() string {
+	return fmt.Sprintf("ClickHouse returned code %d (%s): %s", err.code, err.name, err.message)
+}
+
+// A minimal client of the native protocol of ClickHouse, inserting the
+// rows of a chunk as a single block without compression.
+type clickHouseClient struct {
+	address       string
+	socketOptions *ik.SocketOptions
+	timeout       time.Duration
+	database      string
+	username      string
+	password      string
+	conn          net.Conn
+	reader        *bufio.Reader
+	writer        *bufio.Writer
+	revision      uint64
+}
+
+func (client *clickHouseClient) close() {
+	if client.conn != nil {
+		client.conn.Close()
+		client.conn = nil
+	}
+}
+
+func (client *clickHouseClient) writeUvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	client.writer.Write(b[0:binary.PutUvarint(b[:], v)])
+}
+
+func (client *clickHouseClient) writeString(s string) {
+	client.writeUvarint(uint64(len(s)))
+	client.writer.WriteString(s)
+}
+
+func (client *clickHouseClient) readUvarint() (uint64, error) {
+	return binary.ReadUvarint(client.reader)
+}
+
+func (client *clickHouseClient) readString() (string, error) {
+	n, err := client.readUvarint()
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(client.reader, b)
+	return string(b), err
+}
+
+func (client *clickHouseClient) readException() error {
+	var code int32
+	err := binary.Read(client.reader, binary.LittleEndian, &code)
+	if err != nil {
+		return err
+	}
+	name, err := client.readString()
+	if err != nil {
+		return err
+	}
+	message, err := client.readString()
+	if err != nil {
+		return err
+	}
+	// the stack trace, and whether a nested exception follows
+	_, err = client.readString()
+	if err != nil {
+		return err
+	}
+	nested, err := client.reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if nested != 0 {
+		err = client.readException()
+		if _, ok := err.(*clickHouseException); !ok {
+			return err
+		}
+	}
+	return &clickHouseException{code, name, message}
+}
+
+// skipPacket skips a progress or a profile info packet.
+func (client *clickHouseClient) skipPacket(packet uint64) error {
+	fields := "vvv"
+	if packet == clickHouseServerProfileInfo {
+		fields = "vvvbvb"
+	}
+	for _, field := range fields {
+		var err error
+		if field == 'v' {
+			_, err = client.readUvarint()
+		} else {
+			_, err = client.reader.ReadByte()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (client *clickHouseClient) connect() error {
+	if client.conn != nil {
+		return nil
+	}
+	conn, err := client.socketOptions.Dial("tcp", client.address, client.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(client.timeout))
+	client.conn = conn
+	client.reader = bufio.NewReader(conn)
+	client.writer = bufio.NewWriter(conn)
+	client.writeUvarint(clickHouseClientHello)
+	client.writeString("ik")
+	client.writeUvarint(1)
+	client.writeUvarint(0)
+	client.writeUvarint(clickHouseRevision)
+	client.writeString(client.database)
+	client.writeString(client.username)
+	client.writeString(client.password)
+	err = client.writer.Flush()
+	if err == nil {
+		err = client.readHello()
+	}
+	if err != nil {
+		client.close()
+		return err
+	}
+	return nil
+}
+
+func (client *clickHouseClient) readHello() error {
+	packet, err := client.readUvarint()
+	if err != nil {
+		return err
+	}
+	switch packet {
+	case clickHouseServerHello:
+	case clickHouseServerException:
+		return client.readException()
+	default:
+		return errors.New(fmt.Sprintf("unexpected packet from ClickHouse: %d", packet))
+	}
+	_, err = client.readString()
+	if err != nil {
+		return err
+	}
+	// the version, and the revision the server speaks
+	for i := 0; i < 3; i += 1 {
+		client.revision, err = client.readUvarint()
+		if err != nil {
+			return err
+		}
+	}
+	if client.revision > clickHouseRevision {
+		client.revision = clickHouseRevision
+	}
+	if client.revision >= 54058 {
+		// the time zone
+		_, err = client.readString()
+	}
+	return err
+}
+
+func (client *clickHouseClient) writeQuery(query string) {
+	client.writeUvarint(clickHouseClientQuery)
+	client.writeString("")
+	// the client info of an initial query over TCP
+	client.writer.WriteByte(1)
+	client.writeString("")
+	client.writeString("")
+	client.writeString("[::ffff:127.0.0.1]:0")
+	client.writer.WriteByte(1)
+	client.writeString("")
+	client.writeString("")
+	client.writeString("ik")
+	client.writeUvarint(1)
+	client.writeUvarint(0)
+	client.writeUvarint(clickHouseRevision)
+	if client.revision >= 54060 {
+		client.writeString("")
+	}
+	// no settings, which are given in the query
+	client.writeString("")
+	// processed to completion, without compression
+	client.writeUvarint(2)
+	client.writeUvarint(0)
+	client.writeString(query)
+}
+
+func (client *clickHouseClient) writeBlock(columns []clickHouseColumn, rows []map[string]interface{}) error {
+	client.writeUvarint(clickHouseClientData)
+	client.writeString("")
+	// the block info: not overflows, in no bucket
+	client.writeUvarint(1)
+	client.writer.WriteByte(0)
+	client.writeUvarint(2)
+	binary.Write(client.writer, binary.LittleEndian, int32(-1))
+	client.writeUvarint(0)
+	client.writeUvarint(uint64(len(columns)))
+	client.writeUvarint(uint64(len(rows)))
+	values := make([]interface{}, len(rows))
+	for _, column := range columns {
+		client.writeString(column.name)
+		client.writeString(column.type_)
+		for i, row := range rows {
+			values[i] = row[column.name]
+		}
+		err := writeClickHouseColumn(client.writer, column.type_, values)
+		if err != nil {
+			return errors.New(fmt.Sprintf("column %s: %s", column.name, err.Error()))
+		}
+	}
+	return nil
+}
+
+// readHeader reads the columns of the table the server expects the rows
+// of the INSERT in.
+func (client *clickHouseClient) readHeader() ([]clickHouseColumn, error) {
+	for {
+		packet, err := client.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		switch packet {
+		case clickHouseServerData:
+		case clickHouseServerException:
+			return nil, client.readException()
+		case clickHouseServerProgress, clickHouseServerProfileInfo:
+			err = client.skipPacket(packet)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		default:
+			return nil, errors.New(fmt.Sprintf("unexpected packet from ClickHouse: %d", packet))
+		}
+		_, err = client.readString()
+		if err != nil {
+			return nil, err
+		}
+		// the block info, up to the end marker
+		for {
+			field, err := client.readUvarint()
+			if err != nil {
+				return nil, err
+			}
+			if field == 0 {
+				break
+			} else if field == 1 {
+				_, err = client.reader.ReadByte()
+			} else {
+				_, err = io.ReadFull(client.reader, make([]byte, 4))
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		numColumns, err := client.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		numRows, err := client.readUvarint()
+		if err != nil {
+			return nil, err
+		}
+		if numRows != 0 {
+			return nil, errors.New("unexpected rows in the header of ClickHouse")
+		}
+		columns := make([]clickHouseColumn, numColumns)
+		for i := range columns {
+			columns[i].name, err = client.readString()
+			if err != nil {
+				return nil, err
+			}
+			columns[i].type_, err = client.readString()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return columns, nil
+	}
+}
+
+func (client *clickHouseClient) readEndOfStream() error {
+	for {
+		packet, err := client.readUvarint()
+		if err != nil {
+			return err
+		}
+		switch packet {
+		case clickHouseServerEndOfStream:
+			return nil
+		case clickHouseServerException:
+			return client.readException()
+		case clickHouseServerProgress, clickHouseServerProfileInfo:
+			err = client.skipPacket(packet)
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New(fmt.Sprintf("unexpected packet from ClickHouse: %d", packet))
+		}
+	}
+}
+
+// insert sends the query, which ends in VALUES, and the rows as the block
+// the server asks for.  The server applies the block as a whole.
+func (client *clickHouseClient) insert(query string, rows []map[string]interface{}) error {
+	err := client.connect()
+	if err != nil {
+		return err
+	}
+	client.conn.SetDeadline(time.Now().Add(client.timeout))
+	client.writeQuery(query)
+	// no external tables
+	client.writeBlock(nil, nil)
+	err = client.writer.Flush()
+	if err != nil {
+		client.close()
+		return err
+	}
+	columns, err := client.readHeader()
+	if err != nil {
+		client.close()
+		return err
+	}
+	err = client.writeBlock(columns, rows)
+	if err == nil {
+		client.writeBlock(nil, nil)
+		err = client.writer.Flush()
+	}
+	if err == nil {
+		err = client.readEndOfStream()
+	}
+	if err != nil {
+		// the rest of the exchange is unknown
+		client.close()
+		return err
+	}
+	return nil
+}
+
+// clickHouseTypeArgs returns what is in the parentheses of a parametric
+// type of the given name.
+func clickHouseTypeArgs(type_ string, name string) (string, bool) {
+	if !strings.HasPrefix(type_, name+"(") || !strings.HasSuffix(type_, ")") {
+		return "", false
+	}
+	return type_[len(name)+1 : len(type_)-1], true
+}
+
+var clickHouseEnumValueRegexp = regexp.MustCompile(`'((?:[^'\\]|\\.)*)'\s*=\s*(-?\d+)`)
+
+func writeClickHouseFixed(writer *bufio.Writer, v uint64, size int) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	writer.Write(b[0:size])
+}
+
+// writeClickHouseColumn writes the values in the native format of the
+// column type.  A missing value is written as the zero of the type rather
+// than the default of the column, and as NULL if it is Nullable.
+func writeClickHouseColumn(writer *bufio.Writer, type_ string, values []interface{}) error {
+	if inner, ok := clickHouseTypeArgs(type_, "Nullable"); ok {
+		for _, value := range values {
+			if value == nil {
+				writer.WriteByte(1)
+			} else {
+				writer.WriteByte(0)
+			}
+		}
+		return writeClickHouseColumn(writer, inner, values)
+	}
+	if inner, ok := clickHouseTypeArgs(type_, "Array"); ok {
+		elements := make([]interface{}, 0)
+		for _, value := range values {
+			if value != nil {
+				array, ok := value.([]interface{})
+				if !ok {
+					return errors.New(fmt.Sprintf("not an array: %v", value))
+				}
+				elements = append(elements, array...)
+			}
+			writeClickHouseFixed(writer, uint64(len(elements)), 8)
+		}
+		return writeClickHouseColumn(writer, inner, elements)
+	}
+	if arg, ok := clickHouseTypeArgs(type_, "FixedString"); ok {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return err
+		}
+		for _, value := range values {
+			s := clickHouseString(value)
+			if len(s) > n {
+				return errors.New(fmt.Sprintf("%q is longer than %s", s, type_))
+			}
+			writer.WriteString(s)
+			writer.Write(make([]byte, n-len(s)))
+		}
+		return nil
+	}
+	if args, ok := clickHouseTypeArgs(type_, "DateTime64"); ok {
+		precision, err := strconv.Atoi(strings.TrimSpace(strings.SplitN(args, ",", 2)[0]))
+		if err != nil || precision < 0 || precision > 9 {
+			return errors.New("invalid precision: " + type_)
+		}
+		for _, value := range values {
+			t, err := clickHouseTime(value)
+			if err != nil {
+				return err
+			}
+			writeClickHouseFixed(writer, uint64(t.UnixNano()/int64(math.Pow10(9-precision))), 8)
+		}
+		return nil
+	}
+	if _, ok := clickHouseTypeArgs(type_, "DateTime"); ok {
+		type_ = "DateTime"
+	}
+	for _, name := range []string{"Enum8", "Enum16"} {
+		args, ok := clickHouseTypeArgs(type_, name)
+		if !ok {
+			continue
+		}
+		enum := make(map[string]int64)
+		for _, match := range clickHouseEnumValueRegexp.FindAllStringSubmatch(args, -1) {
+			enum[match[1]], _ = strconv.ParseInt(match[2], 10, 16)
+		}
+		size := 1
+		if name == "Enum16" {
+			size = 2
+		}
+		for _, value := range values {
+			s, ok := value.(string)
+			if !ok {
+				n, err := clickHouseInt(value)
+				if err != nil {
+					return err
+				}
+				writeClickHouseFixed(writer, uint64(n), size)
+				continue
+			}
+			n, ok := enum[s]
+			if !ok {
+				return errors.New(fmt.Sprintf("%q is not a value of %s", s, type_))
+			}
+			writeClickHouseFixed(writer, uint64(n), size)
+		}
+		return nil
+	}
+	for _, value := range values {
+		switch type_ {
+		case "String":
+			s := clickHouseString(value)
+			var b [binary.MaxVarintLen64]byte
+			writer.Write(b[0:binary.PutUvarint(b[:], uint64(len(s)))])
+			writer.WriteString(s)
+		case "Int8", "Int16", "Int32", "Int64":
+			n, err := clickHouseInt(value)
+			if err != nil {
+				return err
+			}
+			size, _ := strconv.Atoi(type_[3:])
+			writeClickHouseFixed(writer, uint64(n), size/8)
+		case "UInt8", "UInt16", "UInt32", "UInt64", "Bool":
+			n, err := clickHouseUint(value)
+			if err != nil {
+				return err
+			}
+			size := 8
+			if type_ != "Bool" {
+				size, _ = strconv.Atoi(type_[4:])
+			}
+			writeClickHouseFixed(writer, n, size/8)
+		case "Float32", "Float64":
+			f, err := clickHouseFloat(value)
+			if err != nil {
+				return err
+			}
+			if type_ == "Float32" {
+				writeClickHouseFixed(writer, uint64(math.Float32bits(float32(f))), 4)
+			} else {
+				writeClickHouseFixed(writer, math.Float64bits(f), 8)
+			}
+		case "Date", "Date32", "DateTime":
+			t, err := clickHouseTime(value)
+			if err != nil {
+				return err
+			}
+			days := t.Unix() / 86400
+			if t.Unix() < 0 && t.Unix()%86400 != 0 {
+				days -= 1
+			}
+			switch type_ {
+			case "Date":
+				writeClickHouseFixed(writer, uint64(days), 2)
+			case "Date32":
+				writeClickHouseFixed(writer, uint64(days), 4)
+			default:
+				writeClickHouseFixed(writer, uint64(t.Unix()), 4)
+			}
+		case "UUID":
+			s := strings.Replace(clickHouseString(value), "-", "", -1)
+			if value == nil {
+				s = strings.Repeat("0", 32)
+			}
+			b, err := hex.DecodeString(s)
+			if err != nil || len(b) != 16 {
+				return errors.New(fmt.Sprintf("not a UUID: %v", value))
+			}
+			writeClickHouseFixed(writer, binary.BigEndian.Uint64(b[0:8]), 8)
+			writeClickHouseFixed(writer, binary.BigEndian.Uint64(b[8:16]), 8)
+		default:
+			return errors.New("unsupported column type: " + type_)
+		}
+	}
+	return nil
+}
+
+// clickHouseString renders a value as the rows in JSONEachRow would have
+// it, the objects and the arrays in JSON.
+func clickHouseString(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return value
+	case json.Number:
+		return value.String()
+	case bool:
+		return strconv.FormatBool(value)
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+func clickHouseInt(value interface{}) (int64, error) {
+	switch value := value.(type) {
+	case nil:
+		return 0, nil
+	case bool:
+		if value {
+			return 1, nil
+		}
+		return 0, nil
+	case json.Number:
+		n, err := value.Int64()
+		if err != nil {
+			f, err := value.Float64()
+			return int64(f), err
+		}
+		return n, nil
+	case string:
+		return strconv.ParseInt(value, 10, 64)
+	}
+	return 0, errors.New(fmt.Sprintf("not an integer: %v", value))
+}
+
+func clickHouseUint(value interface{}) (uint64, error) {
+	switch value := value.(type) {
+	case json.Number:
+		n, err := strconv.ParseUint(value.String(), 10, 64)
+		if err != nil {
+			f, err := value.Float64()
+			return uint64(f), err
+		}
+		return n, nil
+	case string:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return clickHouseUint(b)
+		}
+		return strconv.ParseUint(value, 10, 64)
+	}
+	n, err := clickHouseInt(value)
+	return uint64(n), err
+}
+
+func clickHouseFloat(value interface{}) (float64, error) {
+	switch value := value.(type) {
+	case json.Number:
+		return value.Float64()
+	case string:
+		return strconv.ParseFloat(value, 64)
+	}
+	n, err := clickHouseInt(value)
+	return float64(n), err
+}
+
+// clickHouseTime takes the seconds since the epoch, or the time in RFC 3339
+// or the formats ClickHouse writes the dates and the times in.
+func clickHouseTime(value interface{}) (time.Time, error) {
+	switch value := value.(type) {
+	case json.Number:
+		f, err := value.Float64()
+		if err != nil {
+			return time.Time{}, err
+		}
+		seconds, fraction := math.Modf(f)
+		return time.Unix(int64(seconds), int64(fraction*1e9)), nil
+	case string:
+		for _, layout := range []string{time.RFC3339Nano, "2006-01-02 15:04:05.999999999", "2006-01-02"} {
+			t, err := time.Parse(layout, value)
+			if err == nil {
+				return t, nil
+			}
+		}
+		return clickHouseTime(json.Number(value))
+	}
+	n, err := clickHouseInt(value)
+	return time.Unix(n, 0), err
+}
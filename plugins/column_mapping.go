@@ -0,0 +1,39 @@
+package plugins
+
+import (
+	"errors"
+	"strings"
+)
+
+// The fields column_mapping maps the tag and the time of a record from.
+const (
+	columnTagField  = "@tag"
+	columnTimeField = "@time"
+)
+
+type outputColumn struct {
+	name  string
+	field string
+}
+
+// parseColumnMapping reads a column_mapping of comma-separated "column" or
+// "column:field" entries.
+func parseColumnMapping(s string) ([]outputColumn, error) {
+	comps := splitAndStrip(s)
+	retval := make([]outputColumn, 0, len(comps))
+	for _, comp := range comps {
+		if comp == "" {
+			continue
+		}
+		pair := strings.SplitN(comp, ":", 2)
+		column := outputColumn{name: pair[0], field: pair[0]}
+		if len(pair) == 2 {
+			column.field = pair[1]
+		}
+		if column.name == "" || column.field == "" {
+			return nil, errors.New("invalid column_mapping entry: " + comp)
+		}
+		retval = append(retval, column)
+	}
+	return retval, nil
+}
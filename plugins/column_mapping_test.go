@@ -0,0 +1,23 @@
+package plugins
+
+import (
+	"testing"
+)
+
+func Test_parseColumnMapping(t *testing.T) {
+	columns, err := parseColumnMapping("a, b:c,,")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(columns) != 2 || columns[0] != (outputColumn{"a", "a"}) || columns[1] != (outputColumn{"b", "c"}) {
+		t.Logf("%v", columns)
+		t.Fail()
+	}
+	for _, s := range []string{":a", "a:"} {
+		_, err = parseColumnMapping(s)
+		if err == nil {
+			t.Logf("%s accepted", s)
+			t.Fail()
+		}
+	}
+}
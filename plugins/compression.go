@@ -0,0 +1,45 @@
+package plugins
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io/ioutil"
+)
+
+func gzipCompress(data []byte) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	writer := gzip.NewWriter(buf)
+	_, err := writer.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipDecompress decompresses data made of one or more gzip members, as
+// the compressed messages of the forward protocol may concatenate them.
+func gzipDecompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// newZstdCompressFunc returns a function compressing a batch into a single
+// zstd frame; the encoder is shared by the batches compressed at once.
+func newZstdCompressFunc() (func(data []byte) ([]byte, error), error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	return func(data []byte) ([]byte, error) {
+		return encoder.EncodeAll(data, nil), nil
+	}, nil
+}
@@ -0,0 +1,26 @@
+package plugins
+
+import (
+	"github.com/klauspost/compress/zstd"
+	"testing"
+)
+
+func Test_newZstdCompressFunc(t *testing.T) {
+	compress, err := newZstdCompressFunc()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	compressed, err := compress([]byte("{\"message\":\"test\"}\n"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decoder, err := zstd.NewReader(nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer decoder.Close()
+	data, err := decoder.DecodeAll(compressed, nil)
+	if err != nil || string(data) != "{\"message\":\"test\"}\n" {
+		t.Fatalf("%v %q", err, data)
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows
+// +build !windows
+
+package plugins
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// newShellCommand runs the command in a process group of its own, so that
+// killCommand also gets the children the shell forks.
+func newShellCommand(command string) *exec.Cmd {
+	return newCommand("/bin/sh", "-c", command)
+}
+
+func newCommand(name string, args ...string) *exec.Cmd {
+	cmd := exec.Command(name, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return cmd
+}
+
+func killCommand(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
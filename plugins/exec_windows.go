@@ -0,0 +1,20 @@
+//go:build windows
+// +build windows
+
+package plugins
+
+import (
+	"os/exec"
+)
+
+func newShellCommand(command string) *exec.Cmd {
+	return newCommand("cmd", "/C", command)
+}
+
+func newCommand(name string, args ...string) *exec.Cmd {
+	return exec.Command(name, args...)
+}
+
+func killCommand(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,422 @@
+package plugins
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"github.com/ugorji/go/codec"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// The external plugins run a command of their own that speaks the forward
+// protocol over its standard input and output, so that a source or a
+// destination can be added without rebuilding ik.  The command is given
+// the attributes of the element other than type and command as a JSON
+// object in IK_PLUGIN_CONFIG, and what it writes to its standard error is
+// logged.
+//
+// An external input writes messages on its standard output, and is sent
+// {"ack": chunk} on its standard input for those with a chunk option once
+// the records are stored.  An external output is sent a [tag, entries,
+// {"chunk": chunk}] message for each record set, and is to answer with the
+// ack of the chunk.
+
+type externalProcess struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *os.File
+	exited chan struct{}
+}
+
+func externalPluginEnv(config *ik.ConfigElement) ([]string, error) {
+	attrs := make(map[string]string)
+	for k, v := range config.Attrs {
+		if k != "type" && k != "command" {
+			attrs[k] = v
+		}
+	}
+	b, err := json.Marshal(attrs)
+	if err != nil {
+		return nil, err
+	}
+	return append(os.Environ(), "IK_PLUGIN_CONFIG="+string(b)), nil
+}
+
+func startExternalProcess(logger ik.Logger, command string, env []string) (*externalProcess, error) {
+	cmd := newShellCommand(command)
+	cmd.Env = env
+	return startProcess(logger, command, cmd)
+}
+
+// startProcess starts cmd, logging what it writes to its standard error
+// under name.
+func startProcess(logger ik.Logger, name string, cmd *exec.Cmd) (*externalProcess, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Wait would close a pipe of exec's before the messages left in it
+	// are read
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout = stdoutWriter
+	err = cmd.Start()
+	stdoutWriter.Close()
+	if err != nil {
+		stdout.Close()
+		return nil, err
+	}
+	process := &externalProcess{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		exited: make(chan struct{}),
+	}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			logger.Warning("%s: %s", name, scanner.Text())
+		}
+		err := cmd.Wait()
+		if err != nil {
+			logger.Error("%s exited: %s", name, err.Error())
+		} else {
+			logger.Notice("%s exited", name)
+		}
+		close(process.exited)
+	}()
+	return process, nil
+}
+
+// kill kills the command if it has not exited, and waits for it.
+func (process *externalProcess) kill() {
+	select {
+	case <-process.exited:
+	default:
+		process.stdin.Close()
+		killCommand(process.cmd)
+		<-process.exited
+	}
+	process.stdout.Close()
+}
+
+type ExternalInput struct {
+	factory         *ExternalInputFactory
+	logger          ik.Logger
+	port            ik.Port
+	command         string
+	env             []string
+	restartInterval time.Duration
+	clock           ik.Clock
+	codec           *codec.MsgpackHandle
+	process         *externalProcess
+	shutdown        chan struct{}
+	shutdownOnce    sync.Once
+	mtx             sync.Mutex
+}
+
+type ExternalInputFactory struct {
+}
+
+func (input *ExternalInput) Factory() ik.Plugin {
+	return input.factory
+}
+
+func (input *ExternalInput) Port() ik.Port {
+	return input.port
+}
+
+// Run runs the command, and runs it again restart_interval after it exits
+// until the input is shut down.
+func (input *ExternalInput) Run() error {
+	input.mtx.Lock()
+	select {
+	case <-input.shutdown:
+		input.mtx.Unlock()
+		return nil
+	default:
+	}
+	process, err := startExternalProcess(input.logger, input.command, input.env)
+	input.process = process
+	input.mtx.Unlock()
+	if err != nil {
+		input.logger.Error("failed to run %s: %s", input.command, err.Error())
+	} else {
+		err = input.receive(process)
+		if err != nil && err != io.EOF {
+			input.logger.Error("%s: %s", input.command, err.Error())
+		}
+		process.kill()
+	}
+	select {
+	case <-input.shutdown:
+		return nil
+	case <-ik.After(input.clock, input.restartInterval):
+	}
+	return ik.Continue
+}
+
+func (input *ExternalInput) receive(process *externalProcess) error {
+	dec := codec.NewDecoder(bufio.NewReader(process.stdout), input.codec)
+	enc := codec.NewEncoder(process.stdin, input.codec)
+	for {
+		v := []interface{}{}
+		err := dec.Decode(&v)
+		if err != nil {
+			return err
+		}
+		recordSets, chunk, err := decodeForwardMessage(input.codec, v)
+		if err != nil {
+			return err
+		}
+		if chunk == "" {
+			err = input.port.Emit(recordSets)
+			if err != nil {
+				input.logger.Error("%s", err.Error())
+			}
+			continue
+		}
+		// left unacked on failure for the command to send it again
+		err = ik.EmitDurably(input.port, recordSets)
+		if err != nil {
+			input.logger.Error("%s", err.Error())
+			continue
+		}
+		err = enc.Encode(map[string]interface{}{"ack": chunk})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (input *ExternalInput) Shutdown() error {
+	input.shutdownOnce.Do(func() {
+		input.mtx.Lock()
+		close(input.shutdown)
+		process := input.process
+		input.mtx.Unlock()
+		if process != nil {
+			process.kill()
+		}
+	})
+	return nil
+}
+
+func (input *ExternalInput) Dispose() {
+	input.Shutdown()
+}
+
+func (factory *ExternalInputFactory) Name() string {
+	return "external"
+}
+
+func (factory *ExternalInputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Input, error) {
+	command, ok := config.Attrs["command"]
+	if !ok {
+		return nil, errors.New("required attribute `command' is not specified")
+	}
+	env, err := externalPluginEnv(config)
+	if err != nil {
+		return nil, err
+	}
+	restartInterval, err := parseForwardDuration(config, "restart_interval", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalInput{
+		factory:         factory,
+		logger:          engine.Logger(),
+		clock:           engine.Clock(),
+		port:            engine.DefaultPort(),
+		command:         command,
+		env:             env,
+		restartInterval: restartInterval,
+		codec:           newFluentdCodec(),
+		shutdown:        make(chan struct{}),
+	}, nil
+}
+
+func (factory *ExternalInputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+// ExternalOutput hands the record sets over to the command one at a time,
+// and returns from Emit once the command has acked them.  The command is
+// run again on the next Emit if it has exited, or has not acked within
+// ack_response_timeout.
+type ExternalOutput struct {
+	factory    *ExternalOutputFactory
+	logger     ik.Logger
+	command    string
+	env        []string
+	ackTimeout time.Duration
+	clock      ik.Clock
+	codec      *codec.MsgpackHandle
+	process    *externalProcess
+	acks       chan string
+	shutdown   bool
+	mtx        sync.Mutex
+}
+
+type ExternalOutputFactory struct {
+}
+
+func (output *ExternalOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *ExternalOutput) start() error {
+	if output.process != nil {
+		select {
+		case <-output.process.exited:
+			output.process.kill()
+		default:
+			return nil
+		}
+	}
+	process, err := startExternalProcess(output.logger, output.command, output.env)
+	if err != nil {
+		return err
+	}
+	acks := make(chan string, 1)
+	go func() {
+		defer close(acks)
+		dec := codec.NewDecoder(bufio.NewReader(process.stdout), output.codec)
+		for {
+			response := map[string]interface{}{}
+			err := dec.Decode(&response)
+			if err != nil {
+				return
+			}
+			switch ack := response["ack"].(type) {
+			case []byte:
+				acks <- string(ack)
+			case string:
+				acks <- ack
+			}
+		}
+	}()
+	output.process = process
+	output.acks = acks
+	return nil
+}
+
+func (output *ExternalOutput) send(recordSet ik.FluentRecordSet) error {
+	chunk, err := newForwardChunkId()
+	if err != nil {
+		return err
+	}
+	entries := make([]interface{}, len(recordSet.Records))
+	for i, record := range recordSet.Records {
+		entries[i] = []interface{}{record.Timestamp, record.Data}
+	}
+	err = codec.NewEncoder(output.process.stdin, output.codec).Encode([]interface{}{recordSet.Tag, entries, map[string]interface{}{"chunk": chunk}})
+	if err != nil {
+		return err
+	}
+	timer := output.clock.NewTimer(output.ackTimeout)
+	defer timer.Stop()
+	for {
+		select {
+		case ack, ok := <-output.acks:
+			if !ok {
+				return errors.New(output.command + " exited before it acked")
+			}
+			if ack == chunk {
+				return nil
+			}
+			output.logger.Warning("%s acked an unknown chunk: %s", output.command, ack)
+		case <-timer.C():
+			return errors.New(fmt.Sprintf("%s did not ack in %s", output.command, output.ackTimeout.String()))
+		}
+	}
+}
+
+func (output *ExternalOutput) Emit(recordSets []ik.FluentRecordSet) error {
+	output.mtx.Lock()
+	defer output.mtx.Unlock()
+	if output.shutdown {
+		return errors.New("the output has been shut down")
+	}
+	err := output.start()
+	if err != nil {
+		return err
+	}
+	for _, recordSet := range recordSets {
+		if len(recordSet.Records) == 0 {
+			continue
+		}
+		err = output.send(recordSet)
+		if err != nil {
+			// the acks that may still come would be taken for those of
+			// the next record sets
+			output.process.kill()
+			return err
+		}
+	}
+	return nil
+}
+
+func (output *ExternalOutput) Run() error {
+	<-ik.After(output.clock, time.Second)
+	return ik.Continue
+}
+
+func (output *ExternalOutput) Shutdown() error {
+	output.mtx.Lock()
+	defer output.mtx.Unlock()
+	output.shutdown = true
+	if output.process != nil {
+		output.process.kill()
+	}
+	return nil
+}
+
+func (output *ExternalOutput) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *ExternalOutputFactory) Name() string {
+	return "external"
+}
+
+func (factory *ExternalOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	command, ok := config.Attrs["command"]
+	if !ok {
+		return nil, errors.New("required attribute `command' is not specified")
+	}
+	env, err := externalPluginEnv(config)
+	if err != nil {
+		return nil, err
+	}
+	ackTimeout, err := parseForwardDuration(config, "ack_response_timeout", 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	return &ExternalOutput{
+		factory:    factory,
+		logger:     engine.Logger(),
+		clock:      engine.Clock(),
+		command:    command,
+		env:        env,
+		ackTimeout: ackTimeout,
+		codec:      newFluentdCodec(),
+	}, nil
+}
+
+func (factory *ExternalOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&ExternalInputFactory{})
+var _ = AddPlugin(&ExternalOutputFactory{})
@@ -0,0 +1,132 @@
+package plugins
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"github.com/ugorji/go/codec"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestExternalHelperProcess is the command of the external plugins under
+// test, doing what the mode in its configuration says.
+func TestExternalHelperProcess(t *testing.T) {
+	config := map[string]string{}
+	if json.Unmarshal([]byte(os.Getenv("IK_PLUGIN_CONFIG")), &config) != nil {
+		return
+	}
+	_codec := newFluentdCodec()
+	enc := codec.NewEncoder(os.Stdout, _codec)
+	dec := codec.NewDecoder(os.Stdin, _codec)
+	switch config["mode"] {
+	case "input":
+		enc.Encode([]interface{}{"a", 1, map[string]interface{}{"x": 1}})
+		enc.Encode([]interface{}{"b", []interface{}{[]interface{}{2, map[string]interface{}{"x": 2}}}, map[string]interface{}{"chunk": "c1"}})
+		ack := map[string]interface{}{}
+		dec.Decode(&ack)
+		enc.Encode([]interface{}{"acked", 3, map[string]interface{}{"ack": ack["ack"]}})
+	case "output":
+		for {
+			v := []interface{}{}
+			if dec.Decode(&v) != nil {
+				break
+			}
+			fmt.Fprintf(os.Stderr, "%s\n", v[0])
+			enc.Encode(map[string]interface{}{"ack": forwardOption(v, 2, "chunk")})
+		}
+	case "filter_json":
+		// doubles x, and answers a record with "crash" by exiting
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			line := execFilterLine{}
+			json.Unmarshal(scanner.Bytes(), &line)
+			if line.Record["crash"] != nil {
+				os.Exit(1)
+			}
+			x, _ := line.Record["x"].(float64)
+			b, _ := json.Marshal(map[string]interface{}{"time": line.Time, "record": map[string]interface{}{"y": x * 2}})
+			fmt.Printf("%s\nnot json\n", b)
+		}
+	case "filter_msgpack":
+		for {
+			v := []interface{}{}
+			if dec.Decode(&v) != nil {
+				break
+			}
+			record := v[2].(map[string]interface{})
+			record["seen"] = true
+			enc.Encode([]interface{}{"out." + string(v[0].([]byte)), v[1], record})
+		}
+	case "exit":
+	}
+	os.Exit(0)
+}
+
+func externalHelperCommand() string {
+	return fmt.Sprintf("exec %s -test.run=TestExternalHelperProcess", os.Args[0])
+}
+
+func Test_ExternalInput(t *testing.T) {
+	port := &testDurablePort{}
+	config := &ik.ConfigElement{Attrs: map[string]string{"command": externalHelperCommand(), "mode": "input"}}
+	env, err := externalPluginEnv(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input := &ExternalInput{
+		logger:          &testLogger{t},
+		port:            port,
+		command:         config.Attrs["command"],
+		env:             env,
+		restartInterval: time.Millisecond,
+		clock:           ik.SystemClock,
+		codec:           newFluentdCodec(),
+		shutdown:        make(chan struct{}),
+	}
+	if input.Run() != ik.Continue {
+		t.Fail()
+	}
+	if len(port.recordSets) != 3 || port.durable != 1 {
+		t.Fatalf("%v", port.recordSets)
+	}
+	if port.recordSets[0].Tag != "a" || port.recordSets[1].Tag != "b" || fmt.Sprintf("%s", port.recordSets[2].Records[0].Data["ack"]) != "c1" {
+		t.Fatalf("%v", port.recordSets)
+	}
+	input.Shutdown()
+	if input.Run() != nil {
+		t.Fail()
+	}
+}
+
+func Test_ExternalOutput(t *testing.T) {
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	defer engine.Dispose()
+	newOutput := func(mode string) *ExternalOutput {
+		output, err := (&ExternalOutputFactory{}).New(engine, &ik.ConfigElement{Attrs: map[string]string{"command": externalHelperCommand(), "mode": mode}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return output.(*ExternalOutput)
+	}
+	output := newOutput("output")
+	defer output.Shutdown()
+	for i := 0; i < 2; i++ {
+		err := output.Emit([]ik.FluentRecordSet{
+			{Tag: "a", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"x": 1}}}},
+			{Tag: "b", Records: []ik.TinyFluentRecord{{Timestamp: 2, Data: map[string]interface{}{"x": 2}}}},
+		})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	output = newOutput("exit")
+	defer output.Shutdown()
+	err := output.Emit([]ik.FluentRecordSet{{Tag: "a", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"x": 1}}}}})
+	if err == nil {
+		t.Fail()
+	}
+}
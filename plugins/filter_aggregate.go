@@ -0,0 +1,334 @@
+package plugins
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type aggregateSeries struct {
+	sum    float64
+	min    float64
+	max    float64
+	count  int64
+	values []float64 // kept only for the percentiles
+}
+
+type aggregateGroup struct {
+	fields map[string]interface{}
+	count  int64
+	series map[string]*aggregateSeries
+}
+
+// AggregateFilter sums up the records over tumbling windows of `window',
+// and emits a record for each group of them under `tag' as a window ends.
+// The records are grouped by the values of the fields of group_by, in which
+// @tag stands for the tag, and the summary has those values, the number of
+// records in count_key, and the sum, the minimum, the maximum, the mean and
+// the percentiles of each field of value_keys under the name of the field
+// suffixed with _sum, _min, _max, _mean and _p<percentile>.  The windows are
+// those of the time the records come, not that of the records, and the
+// records themselves are dropped unless pass_through is set.
+type AggregateFilter struct {
+	factory     *AggregateFilterFactory
+	logger      ik.Logger
+	next        ik.Port
+	tag         string
+	groupBy     []string
+	valueKeys   []string
+	percentiles []float64
+	countKey    string
+	passThrough bool
+	window      time.Duration
+	groups      map[string]*aggregateGroup
+	windowStart time.Time
+	clock       ik.Clock
+	mtx         sync.Mutex
+	cancel      chan struct{}
+	cancelOnce  sync.Once
+}
+
+type AggregateFilterFactory struct {
+}
+
+// aggregateNumber reads a value as a number, numeric strings included.
+func aggregateNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case int8:
+		return float64(value), true
+	case int16:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint:
+		return float64(value), true
+	case uint8:
+		return float64(value), true
+	case uint16:
+		return float64(value), true
+	case uint32:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return f, err == nil
+	case []byte:
+		f, err := strconv.ParseFloat(strings.TrimSpace(string(value)), 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+func aggregateFieldName(key string) string {
+	if key == columnTagField {
+		return "tag"
+	}
+	return key
+}
+
+func (filter *AggregateFilter) add(tag string, data map[string]interface{}) {
+	values := make([]interface{}, len(filter.groupBy))
+	for i, key := range filter.groupBy {
+		if key == columnTagField {
+			values[i] = tag
+			continue
+		}
+		switch value := data[key].(type) {
+		case []byte:
+			values[i] = string(value)
+		default:
+			values[i] = value
+		}
+	}
+	b, err := json.Marshal(values)
+	if err != nil {
+		filter.logger.Warning("%s", err.Error())
+		return
+	}
+	group, ok := filter.groups[string(b)]
+	if !ok {
+		group = &aggregateGroup{
+			fields: make(map[string]interface{}, len(filter.groupBy)),
+			series: make(map[string]*aggregateSeries, len(filter.valueKeys)),
+		}
+		for i, key := range filter.groupBy {
+			group.fields[aggregateFieldName(key)] = values[i]
+		}
+		filter.groups[string(b)] = group
+	}
+	group.count += 1
+	for _, key := range filter.valueKeys {
+		value, ok := aggregateNumber(data[key])
+		if !ok || math.IsNaN(value) {
+			continue
+		}
+		series, ok := group.series[key]
+		if !ok {
+			series = &aggregateSeries{min: value, max: value}
+			group.series[key] = series
+		}
+		series.sum += value
+		series.count += 1
+		series.min = math.Min(series.min, value)
+		series.max = math.Max(series.max, value)
+		if len(filter.percentiles) > 0 {
+			series.values = append(series.values, value)
+		}
+	}
+}
+
+func aggregatePercentileKey(key string, percentile float64) string {
+	return key + "_p" + strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+}
+
+// summarize makes the record of a group, taking a percentile to be the
+// smallest value that many percent of the values are not above.
+func (filter *AggregateFilter) summarize(group *aggregateGroup) map[string]interface{} {
+	data := make(map[string]interface{}, len(group.fields)+1+len(group.series)*(4+len(filter.percentiles)))
+	for name, value := range group.fields {
+		data[name] = value
+	}
+	data[filter.countKey] = group.count
+	for key, series := range group.series {
+		data[key+"_sum"] = series.sum
+		data[key+"_min"] = series.min
+		data[key+"_max"] = series.max
+		data[key+"_mean"] = series.sum / float64(series.count)
+		if len(series.values) == 0 {
+			continue
+		}
+		sort.Float64s(series.values)
+		for _, percentile := range filter.percentiles {
+			n := int(math.Ceil(percentile / 100 * float64(len(series.values))))
+			if n < 1 {
+				n = 1
+			}
+			data[aggregatePercentileKey(key, percentile)] = series.values[n-1]
+		}
+	}
+	return data
+}
+
+func (filter *AggregateFilter) Emit(recordSets []ik.FluentRecordSet) error {
+	filter.mtx.Lock()
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			filter.add(recordSet.Tag, record.Data)
+		}
+	}
+	filter.mtx.Unlock()
+	if filter.passThrough {
+		return filter.next.Emit(recordSets)
+	}
+	return nil
+}
+
+// flush emits the summaries of the window that has ended, timestamped with
+// the start of the window.
+func (filter *AggregateFilter) flush(now time.Time) error {
+	filter.mtx.Lock()
+	groups := filter.groups
+	windowStart := filter.windowStart
+	filter.groups = make(map[string]*aggregateGroup)
+	filter.windowStart = ik.TimeSlot(now, filter.window)
+	filter.mtx.Unlock()
+	if len(groups) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, len(groups))
+	for key := range groups {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	records := make([]ik.TinyFluentRecord, len(keys))
+	for i, key := range keys {
+		records[i] = ik.TinyFluentRecord{
+			Timestamp: uint64(windowStart.Unix()),
+			Data:      filter.summarize(groups[key]),
+		}
+	}
+	return filter.next.Emit([]ik.FluentRecordSet{{Tag: filter.tag, Records: records}})
+}
+
+func (filter *AggregateFilter) Factory() ik.Plugin {
+	return filter.factory
+}
+
+// Run waits for the window to end, and flushes it.
+func (filter *AggregateFilter) Run() error {
+	filter.mtx.Lock()
+	end := filter.windowStart.Add(filter.window)
+	filter.mtx.Unlock()
+	timer := filter.clock.NewTimer(end.Sub(filter.clock.Now()))
+	defer timer.Stop()
+	select {
+	case <-filter.cancel:
+		return filter.flush(filter.clock.Now())
+	case <-timer.C():
+	}
+	err := filter.flush(filter.clock.Now())
+	if err != nil {
+		filter.logger.Error("%s", err.Error())
+	}
+	return ik.Continue
+}
+
+func (filter *AggregateFilter) Shutdown() error {
+	filter.cancelOnce.Do(func() {
+		close(filter.cancel)
+	})
+	return nil
+}
+
+func (filter *AggregateFilter) Dispose() {
+	filter.Shutdown()
+}
+
+func (factory *AggregateFilterFactory) Name() string {
+	return "aggregate"
+}
+
+func (factory *AggregateFilterFactory) New(engine ik.Engine, config *ik.ConfigElement, next ik.Port) (ik.Filter, error) {
+	tag, ok := config.Attrs["tag"]
+	if !ok {
+		return nil, errors.New("required attribute `tag' is not specified")
+	}
+	fields := map[string][]string{"group_by": nil, "value_keys": nil}
+	for name := range fields {
+		fields[name] = make([]string, 0)
+		for _, key := range splitAndStrip(config.Attrs[name]) {
+			if key != "" {
+				fields[name] = append(fields[name], key)
+			}
+		}
+	}
+	countKey, ok := config.Attrs["count_key"]
+	if !ok {
+		countKey = "count"
+	}
+	percentiles := []float64{}
+	percentilesStr, ok := config.Attrs["percentiles"]
+	if ok {
+		var err error
+		percentiles, err = parsePercentiles(percentilesStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	passThrough := false
+	passThroughStr, ok := config.Attrs["pass_through"]
+	if ok {
+		var err error
+		passThrough, err = strconv.ParseBool(passThroughStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	window, err := parseForwardDuration(config, "window", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	if window <= 0 {
+		return nil, errors.New("invalid window: " + window.String())
+	}
+	clock := engine.Clock()
+	return &AggregateFilter{
+		factory:     factory,
+		logger:      engine.Logger(),
+		next:        next,
+		tag:         tag,
+		groupBy:     fields["group_by"],
+		valueKeys:   fields["value_keys"],
+		percentiles: percentiles,
+		countKey:    countKey,
+		passThrough: passThrough,
+		window:      window,
+		groups:      make(map[string]*aggregateGroup),
+		windowStart: ik.TimeSlot(clock.Now(), window),
+		clock:       clock,
+		cancel:      make(chan struct{}),
+	}, nil
+}
+
+func (factory *AggregateFilterFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&AggregateFilterFactory{})
@@ -0,0 +1,122 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	"testing"
+	"time"
+)
+
+func Test_AggregateFilter(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	now := time.Unix(1400000030, 0)
+	filter := &AggregateFilter{
+		logger:      &testLogger{t},
+		next:        port,
+		tag:         "metrics",
+		groupBy:     []string{"@tag", "status"},
+		valueKeys:   []string{"latency"},
+		percentiles: []float64{50, 90},
+		countKey:    "count",
+		window:      time.Minute,
+		groups:      make(map[string]*aggregateGroup),
+		windowStart: ik.TimeSlot(now, time.Minute),
+		clock:       newTestClock(func() time.Time { return now }),
+		cancel:      make(chan struct{}),
+	}
+	records := make([]ik.TinyFluentRecord, 0)
+	for i := 1; i <= 10; i++ {
+		records = append(records, ik.TinyFluentRecord{Data: map[string]interface{}{"status": 200, "latency": i}})
+	}
+	records = append(records, ik.TinyFluentRecord{Data: map[string]interface{}{"status": 500, "latency": "2.5"}})
+	records = append(records, ik.TinyFluentRecord{Data: map[string]interface{}{"status": 500, "latency": "-"}})
+	err := filter.Emit([]ik.FluentRecordSet{{Tag: "access", Records: records}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case <-port.c:
+		t.Fatal("the records were passed through")
+	default:
+	}
+
+	now = now.Add(time.Minute)
+	err = filter.flush(now)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets := <-port.c
+	if len(recordSets) != 1 || recordSets[0].Tag != "metrics" || len(recordSets[0].Records) != 2 {
+		t.Fatalf("%v", recordSets)
+	}
+	ok := recordSets[0].Records[0]
+	// the summary is of the window that has ended
+	if ok.Timestamp != uint64(ik.TimeSlot(time.Unix(1400000030, 0), time.Minute).Unix()) {
+		t.Logf("%d", ok.Timestamp)
+		t.Fail()
+	}
+	expected := map[string]interface{}{
+		"tag":         "access",
+		"status":      200,
+		"count":       int64(10),
+		"latency_sum": 55.0,
+		"latency_min": 1.0,
+		"latency_max": 10.0,
+		"latency_p50": 5.0,
+		"latency_p90": 9.0,
+	}
+	for name, value := range expected {
+		if ok.Data[name] != value {
+			t.Logf("%s: expected %v, got %v", name, value, ok.Data[name])
+			t.Fail()
+		}
+	}
+	failed := recordSets[0].Records[1].Data
+	// a value that is not a number counts the record but not the value
+	if failed["status"] != 500 || failed["count"] != int64(2) || failed["latency_mean"] != 2.5 {
+		t.Logf("%v", failed)
+		t.Fail()
+	}
+
+	// nothing is emitted for an empty window
+	err = filter.flush(now.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	select {
+	case recordSets := <-port.c:
+		t.Fatalf("%v", recordSets)
+	default:
+	}
+}
+
+func Test_AggregateFilter_passThrough(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	filter, err := (&AggregateFilterFactory{}).New(engine, &ik.ConfigElement{Attrs: map[string]string{"tag": "metrics", "pass_through": "true"}}, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets := []ik.FluentRecordSet{{Tag: "access", Records: []ik.TinyFluentRecord{{Data: map[string]interface{}{}}}}}
+	err = filter.Emit(recordSets)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if passed := <-port.c; passed[0].Tag != "access" {
+		t.Fail()
+	}
+	filter.Shutdown()
+	if filter.(*AggregateFilter).Run() != nil {
+		t.Fail()
+	}
+	if summary := <-port.c; summary[0].Tag != "metrics" || summary[0].Records[0].Data["count"] != int64(1) {
+		t.Logf("%v", summary)
+		t.Fail()
+	}
+	for _, attrs := range []map[string]string{{}, {"tag": "t", "window": "0s"}, {"tag": "t", "percentiles": "101"}} {
+		_, err = (&AggregateFilterFactory{}).New(engine, &ik.ConfigElement{Attrs: attrs}, port)
+		if err == nil {
+			t.Logf("%v accepted", attrs)
+			t.Fail()
+		}
+	}
+}
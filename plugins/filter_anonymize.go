@@ -0,0 +1,339 @@
+package plugins
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"net"
+	"regexp"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+var anonymizeEmailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9\-]+(?:\.[A-Za-z0-9\-]+)*\.[A-Za-z]{2,}`)
+var anonymizeCreditCardPattern = regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`)
+var anonymizeIPv4Pattern = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+var anonymizeIPv6Pattern = regexp.MustCompile(`(?:[0-9A-Fa-f]{0,4}:){2,7}(?:[0-9A-Fa-f]{1,4}|(?:\d{1,3}\.){3}\d{1,3})?`)
+
+// anonymizeMask replaces the matches of pattern in a string value with
+// what replace makes of them.
+type anonymizeMask struct {
+	pattern *regexp.Regexp
+	replace func(string) string
+}
+
+// AnonymizeFilter keeps personal data out of the records.  The values of
+// hash_keys are replaced with the hex SHA-256 digest of salt and the value,
+// so that they can still be told apart and joined on, the ones of
+// redact_keys with replacement, and the strings of truncate_keys are cut
+// to truncate_length characters.  Then the patterns given by mask are
+// looked for in the strings of mask_keys, or in every string of the record
+// if it is not given, nested ones included: "email" and "credit_card"
+// matches, as well as the ones of mask_pattern, are replaced with
+// replacement, and "ipv4" and "ipv6" addresses are masked to their first
+// ipv4_prefix_length or ipv6_prefix_length bits, so that the subnet is
+// kept.  The records are copied, never modified in place.
+type AnonymizeFilter struct {
+	factory        *AnonymizeFilterFactory
+	logger         ik.Logger
+	next           ik.Port
+	salt           string
+	hashKeys       []string
+	redactKeys     []string
+	truncateKeys   []string
+	truncateLength int
+	maskKeys       []string // nil for every field
+	masks          []anonymizeMask
+	replacement    string
+}
+
+type AnonymizeFilterFactory struct {
+}
+
+func (filter *AnonymizeFilter) hash(value interface{}) string {
+	var b []byte
+	switch value_ := value.(type) {
+	case []byte:
+		b = value_
+	case string:
+		b = []byte(value_)
+	default:
+		b = []byte(fmt.Sprint(value_))
+	}
+	h := sha256.New()
+	h.Write([]byte(filter.salt))
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (filter *AnonymizeFilter) truncate(value interface{}) interface{} {
+	s, ok := value.(string)
+	if !ok {
+		b, ok := value.([]byte)
+		if !ok {
+			return value
+		}
+		s = string(b)
+	}
+	if utf8.RuneCountInString(s) <= filter.truncateLength {
+		return value
+	}
+	return string([]rune(s)[:filter.truncateLength])
+}
+
+func (filter *AnonymizeFilter) maskString(s string) string {
+	for _, mask := range filter.masks {
+		s = mask.pattern.ReplaceAllStringFunc(s, mask.replace)
+	}
+	return s
+}
+
+// mask masks the strings in value, copying the maps and the slices that
+// hold any.
+func (filter *AnonymizeFilter) mask(value interface{}) interface{} {
+	switch value_ := value.(type) {
+	case string:
+		return filter.maskString(value_)
+	case []byte:
+		masked := filter.maskString(string(value_))
+		if masked == string(value_) {
+			return value
+		}
+		return masked
+	case map[string]interface{}:
+		retval := make(map[string]interface{}, len(value_))
+		for k, v := range value_ {
+			retval[k] = filter.mask(v)
+		}
+		return retval
+	case []interface{}:
+		retval := make([]interface{}, len(value_))
+		for i, v := range value_ {
+			retval[i] = filter.mask(v)
+		}
+		return retval
+	}
+	return value
+}
+
+func (filter *AnonymizeFilter) anonymize(data map[string]interface{}) map[string]interface{} {
+	retval := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		retval[k] = v
+	}
+	for _, key := range filter.hashKeys {
+		if value, ok := retval[key]; ok && value != nil {
+			retval[key] = filter.hash(value)
+		}
+	}
+	for _, key := range filter.redactKeys {
+		if _, ok := retval[key]; ok {
+			retval[key] = filter.replacement
+		}
+	}
+	for _, key := range filter.truncateKeys {
+		if value, ok := retval[key]; ok {
+			retval[key] = filter.truncate(value)
+		}
+	}
+	if len(filter.masks) == 0 {
+		return retval
+	}
+	if filter.maskKeys == nil {
+		for k, v := range retval {
+			retval[k] = filter.mask(v)
+		}
+	} else {
+		for _, key := range filter.maskKeys {
+			if value, ok := retval[key]; ok {
+				retval[key] = filter.mask(value)
+			}
+		}
+	}
+	return retval
+}
+
+func (filter *AnonymizeFilter) Emit(recordSets []ik.FluentRecordSet) error {
+	anonymized := make([]ik.FluentRecordSet, len(recordSets))
+	for i, recordSet := range recordSets {
+		records := make([]ik.TinyFluentRecord, len(recordSet.Records))
+		for j, record := range recordSet.Records {
+			records[j] = ik.TinyFluentRecord{Timestamp: record.Timestamp, Data: filter.anonymize(record.Data)}
+		}
+		anonymized[i] = ik.FluentRecordSet{Tag: recordSet.Tag, Records: records}
+	}
+	return filter.next.Emit(anonymized)
+}
+
+func (filter *AnonymizeFilter) Factory() ik.Plugin {
+	return filter.factory
+}
+
+func (filter *AnonymizeFilter) Run() error {
+	time.Sleep(1000000000)
+	return ik.Continue
+}
+
+func (filter *AnonymizeFilter) Shutdown() error {
+	return nil
+}
+
+// luhnValid tells whether the digits of s pass the check credit card
+// numbers have, so that other long numbers are left alone.
+func luhnValid(s string) bool {
+	sum := 0
+	double := false
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// maskIP zeroes all but the first prefixLength bits of the address in s,
+// or returns s as is if it is not an address of the family.
+func maskIP(s string, v4 bool, prefixLength int) string {
+	ip := net.ParseIP(s)
+	if ip == nil || (ip.To4() != nil) != v4 {
+		return s
+	}
+	if v4 {
+		return ip.Mask(net.CIDRMask(prefixLength, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(prefixLength, 128)).String()
+}
+
+func parsePrefixLength(config *ik.ConfigElement, name string, defaultValue int, bits int) (int, error) {
+	valueStr, ok := config.Attrs[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(valueStr)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Failed to parse %s: %s", name, err.Error()))
+	}
+	if value < 0 || value > bits {
+		return 0, errors.New(fmt.Sprintf("invalid %s: %s", name, valueStr))
+	}
+	return value, nil
+}
+
+func parseAnonymizeKeys(config *ik.ConfigElement, name string) []string {
+	keysStr, ok := config.Attrs[name]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0)
+	for _, key := range splitAndStrip(keysStr) {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (factory *AnonymizeFilterFactory) Name() string {
+	return "anonymize"
+}
+
+func (factory *AnonymizeFilterFactory) New(engine ik.Engine, config *ik.ConfigElement, next ik.Port) (ik.Filter, error) {
+	replacement, ok := config.Attrs["replacement"]
+	if !ok {
+		replacement = "[REDACTED]"
+	}
+	salt := config.Attrs["salt"]
+	hashKeys := parseAnonymizeKeys(config, "hash_keys")
+	if len(hashKeys) > 0 && salt == "" {
+		// an unsalted digest of an email or an IP address is easily reversed
+		engine.Logger().Warning("anonymize: hash_keys are hashed without salt")
+	}
+	truncateLength := 8
+	truncateLengthStr, ok := config.Attrs["truncate_length"]
+	if ok {
+		var err error
+		truncateLength, err = strconv.Atoi(truncateLengthStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse truncate_length: %s", err.Error()))
+		}
+		if truncateLength < 0 {
+			return nil, errors.New("invalid truncate_length: " + truncateLengthStr)
+		}
+	}
+	ipv4PrefixLength, err := parsePrefixLength(config, "ipv4_prefix_length", 24, 32)
+	if err != nil {
+		return nil, err
+	}
+	ipv6PrefixLength, err := parsePrefixLength(config, "ipv6_prefix_length", 48, 128)
+	if err != nil {
+		return nil, err
+	}
+	redact := func(string) string { return replacement }
+	masks := make([]anonymizeMask, 0)
+	for _, name := range parseAnonymizeKeys(config, "mask") {
+		switch name {
+		case "email":
+			masks = append(masks, anonymizeMask{anonymizeEmailPattern, redact})
+		case "credit_card":
+			masks = append(masks, anonymizeMask{anonymizeCreditCardPattern, func(s string) string {
+				if !luhnValid(s) {
+					return s
+				}
+				return replacement
+			}})
+		case "ipv4":
+			masks = append(masks, anonymizeMask{anonymizeIPv4Pattern, func(s string) string {
+				return maskIP(s, true, ipv4PrefixLength)
+			}})
+		case "ipv6":
+			masks = append(masks, anonymizeMask{anonymizeIPv6Pattern, func(s string) string {
+				return maskIP(s, false, ipv6PrefixLength)
+			}})
+		default:
+			return nil, errors.New("unsupported mask: " + name)
+		}
+	}
+	maskPatternStr, ok := config.Attrs["mask_pattern"]
+	if ok {
+		maskPattern, err := regexp.Compile(maskPatternStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to compile mask_pattern: %s", err.Error()))
+		}
+		masks = append(masks, anonymizeMask{maskPattern, redact})
+	}
+	filter := &AnonymizeFilter{
+		factory:        factory,
+		logger:         engine.Logger(),
+		next:           next,
+		salt:           salt,
+		hashKeys:       hashKeys,
+		redactKeys:     parseAnonymizeKeys(config, "redact_keys"),
+		truncateKeys:   parseAnonymizeKeys(config, "truncate_keys"),
+		truncateLength: truncateLength,
+		maskKeys:       parseAnonymizeKeys(config, "mask_keys"),
+		masks:          masks,
+		replacement:    replacement,
+	}
+	if len(filter.hashKeys) == 0 && len(filter.redactKeys) == 0 && len(filter.truncateKeys) == 0 && len(masks) == 0 {
+		return nil, errors.New("nothing to anonymize")
+	}
+	return filter, nil
+}
+
+func (factory *AnonymizeFilterFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&AnonymizeFilterFactory{})
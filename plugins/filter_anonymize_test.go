@@ -0,0 +1,120 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	"testing"
+)
+
+func newTestAnonymizeFilter(t *testing.T, port ik.Port, attrs map[string]string) *AnonymizeFilter {
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	filter, err := (&AnonymizeFilterFactory{}).New(engine, &ik.ConfigElement{Attrs: attrs}, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return filter.(*AnonymizeFilter)
+}
+
+func Test_AnonymizeFilter_keys(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	filter := newTestAnonymizeFilter(t, port, map[string]string{
+		"salt":            "pepper",
+		"hash_keys":       "user, id",
+		"redact_keys":     "password",
+		"truncate_keys":   "message, code",
+		"truncate_length": "5",
+	})
+	data := map[string]interface{}{"user": "alice", "id": 42, "password": "secret", "message": "héllo world", "code": 1}
+	err := filter.Emit([]ik.FluentRecordSet{{Tag: "a", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: data}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets := <-port.c
+	anonymized := recordSets[0].Records[0].Data
+	// the digests of "pepperalice" and "pepper42"
+	expected := map[string]interface{}{
+		"user":     "b1b68da447843a6519d8dd7a9c13c90aa1148805cbe55810f86712e6c294ff36",
+		"id":       "93ca73bec2907ec825519db1f7ee28cb033d71c83d14b76ef78b0c4e64566e6e",
+		"password": "[REDACTED]",
+		"message":  "héllo",
+		"code":     1,
+	}
+	for name, value := range expected {
+		if anonymized[name] != value {
+			t.Logf("%s: expected %v, got %v", name, value, anonymized[name])
+			t.Fail()
+		}
+	}
+	if data["user"] != "alice" || data["password"] != "secret" {
+		t.Fatal("the record was modified in place")
+	}
+}
+
+func Test_AnonymizeFilter_mask(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	filter := newTestAnonymizeFilter(t, port, map[string]string{
+		"mask":         "email, credit_card, ipv4, ipv6",
+		"mask_pattern": `token=\w+`,
+		"replacement":  "***",
+	})
+	cases := []struct {
+		value    interface{}
+		expected interface{}
+	}{
+		{"mail alice@example.co.jp now", "mail *** now"},
+		{"card 4111 1111 1111 1111, order 1234567890123", "card ***, order 1234567890123"},
+		{"from 192.168.10.23:8080", "from 192.168.10.0:8080"},
+		{"from 2001:db8:85a3:1234::8a2e:370:7334 at 12:30:45", "from 2001:db8:85a3:: at 12:30:45"},
+		{"version 1.2.3.400", "version 1.2.3.400"},
+		{"?token=abc&x=1", "?***&x=1"},
+		{[]byte("bob@example.com"), "***"},
+		{[]interface{}{"10.0.0.1", 1}, []interface{}{"10.0.0.0", 1}},
+		{map[string]interface{}{"to": "carol@example.com"}, map[string]interface{}{"to": "***"}},
+		{3, 3},
+	}
+	for _, case_ := range cases {
+		masked := filter.anonymize(map[string]interface{}{"v": case_.value})["v"]
+		switch expected := case_.expected.(type) {
+		case []interface{}:
+			masked_, ok := masked.([]interface{})
+			if !ok || len(masked_) != len(expected) || masked_[0] != expected[0] || masked_[1] != expected[1] {
+				t.Logf("%v: got %v", case_.value, masked)
+				t.Fail()
+			}
+		case map[string]interface{}:
+			masked_, ok := masked.(map[string]interface{})
+			if !ok || masked_["to"] != expected["to"] {
+				t.Logf("%v: got %v", case_.value, masked)
+				t.Fail()
+			}
+		default:
+			if masked != expected {
+				t.Logf("%v: expected %v, got %v", case_.value, expected, masked)
+				t.Fail()
+			}
+		}
+	}
+
+	filter = newTestAnonymizeFilter(t, port, map[string]string{"mask": "ipv4", "mask_keys": "client", "ipv4_prefix_length": "16"})
+	anonymized := filter.anonymize(map[string]interface{}{"client": "172.16.254.1", "server": "172.16.254.2"})
+	if anonymized["client"] != "172.16.0.0" || anonymized["server"] != "172.16.254.2" {
+		t.Logf("%v", anonymized)
+		t.Fail()
+	}
+}
+
+func Test_AnonymizeFilterFactory_New(t *testing.T) {
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	for _, attrs := range []map[string]string{
+		{},
+		{"mask": "phone"},
+		{"mask": "ipv4", "ipv4_prefix_length": "33"},
+		{"mask_pattern": "("},
+		{"truncate_keys": "a", "truncate_length": "-1"},
+	} {
+		_, err := (&AnonymizeFilterFactory{}).New(engine, &ik.ConfigElement{Attrs: attrs}, nil)
+		if err == nil {
+			t.Logf("%v accepted", attrs)
+			t.Fail()
+		}
+	}
+}
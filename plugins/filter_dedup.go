@@ -0,0 +1,168 @@
+package plugins
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type dedupEntry struct {
+	digest [sha1.Size]byte
+	seenAt time.Time
+}
+
+// DedupFilter drops a record if an identical one of the same tag was
+// passed less than window ago.  Records are compared by the digest of the
+// values of keys, or of their whole content if keys is not given.  At most
+// max_entries digests are remembered, the oldest being forgotten first.
+type DedupFilter struct {
+	factory    *DedupFilterFactory
+	logger     ik.Logger
+	next       ik.Port
+	keys       []string
+	window     time.Duration
+	maxEntries int
+	entries    map[[sha1.Size]byte]*list.Element
+	order      *list.List // from the newest
+	clock      ik.Clock
+	mtx        sync.Mutex
+}
+
+type DedupFilterFactory struct {
+}
+
+func (filter *DedupFilter) digest(tag string, data map[string]interface{}) ([sha1.Size]byte, error) {
+	subject := data
+	if len(filter.keys) > 0 {
+		subject = make(map[string]interface{}, len(filter.keys))
+		for _, key := range filter.keys {
+			subject[key] = data[key]
+		}
+	}
+	// the keys of a map are marshalled in order
+	b, err := json.Marshal(subject)
+	if err != nil {
+		return [sha1.Size]byte{}, err
+	}
+	return sha1.Sum(append([]byte(tag+"\x00"), b...)), nil
+}
+
+// expire forgets the digests that are out of the window or over the limit.
+func (filter *DedupFilter) expire(now time.Time) {
+	for elem := filter.order.Back(); elem != nil; elem = filter.order.Back() {
+		entry := elem.Value.(*dedupEntry)
+		if filter.order.Len() <= filter.maxEntries && now.Sub(entry.seenAt) < filter.window {
+			break
+		}
+		filter.order.Remove(elem)
+		delete(filter.entries, entry.digest)
+	}
+}
+
+func (filter *DedupFilter) Emit(recordSets []ik.FluentRecordSet) error {
+	filter.mtx.Lock()
+	now := filter.clock.Now()
+	filter.expire(now)
+	passed := make([]ik.FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		records := make([]ik.TinyFluentRecord, 0, len(recordSet.Records))
+		for _, record := range recordSet.Records {
+			digest, err := filter.digest(recordSet.Tag, record.Data)
+			if err != nil {
+				// pass what cannot be compared
+				filter.logger.Warning("%s", err.Error())
+				records = append(records, record)
+				continue
+			}
+			if _, ok := filter.entries[digest]; ok {
+				continue
+			}
+			filter.entries[digest] = filter.order.PushFront(&dedupEntry{digest, now})
+			filter.expire(now)
+			records = append(records, record)
+		}
+		if len(records) > 0 {
+			passed = append(passed, ik.FluentRecordSet{Tag: recordSet.Tag, Records: records})
+		}
+	}
+	filter.mtx.Unlock()
+	if len(passed) == 0 {
+		return nil
+	}
+	return filter.next.Emit(passed)
+}
+
+func (filter *DedupFilter) Factory() ik.Plugin {
+	return filter.factory
+}
+
+func (filter *DedupFilter) Run() error {
+	<-ik.After(filter.clock, time.Second)
+	return ik.Continue
+}
+
+func (filter *DedupFilter) Shutdown() error {
+	return nil
+}
+
+func (factory *DedupFilterFactory) Name() string {
+	return "dedup"
+}
+
+func (factory *DedupFilterFactory) New(engine ik.Engine, config *ik.ConfigElement, next ik.Port) (ik.Filter, error) {
+	keys := make([]string, 0)
+	keysStr, ok := config.Attrs["keys"]
+	if ok {
+		for _, key := range splitAndStrip(keysStr) {
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	window := time.Minute
+	windowStr, ok := config.Attrs["window"]
+	if ok {
+		var err error
+		window, err = time.ParseDuration(windowStr)
+		if err != nil {
+			return nil, err
+		}
+		if window <= 0 {
+			return nil, errors.New("invalid window: " + windowStr)
+		}
+	}
+	maxEntries := 10000
+	maxEntriesStr, ok := config.Attrs["max_entries"]
+	if ok {
+		var err error
+		maxEntries, err = strconv.Atoi(maxEntriesStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse max_entries: %s", err.Error()))
+		}
+		if maxEntries <= 0 {
+			return nil, errors.New("invalid max_entries: " + maxEntriesStr)
+		}
+	}
+	return &DedupFilter{
+		factory:    factory,
+		logger:     engine.Logger(),
+		next:       next,
+		keys:       keys,
+		window:     window,
+		maxEntries: maxEntries,
+		entries:    make(map[[sha1.Size]byte]*list.Element),
+		order:      list.New(),
+		clock:      engine.Clock(),
+	}, nil
+}
+
+func (factory *DedupFilterFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&DedupFilterFactory{})
@@ -0,0 +1,89 @@
+package plugins
+
+import (
+	"container/list"
+	"crypto/sha1"
+	"github.com/moriyoshi/ik"
+	"testing"
+	"time"
+)
+
+func newTestDedupFilter(t *testing.T, port ik.Port, keys []string, maxEntries int, now *time.Time) *DedupFilter {
+	return &DedupFilter{
+		logger:     &testLogger{t},
+		next:       port,
+		keys:       keys,
+		window:     10 * time.Second,
+		maxEntries: maxEntries,
+		entries:    make(map[[sha1.Size]byte]*list.Element),
+		order:      list.New(),
+		clock:      newTestClock(func() time.Time { return *now }),
+	}
+}
+
+func Test_DedupFilter(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	now := time.Unix(1000, 0)
+	filter := newTestDedupFilter(t, port, []string{"message"}, 100, &now)
+	record := func(seq int, message string) ik.TinyFluentRecord {
+		return ik.TinyFluentRecord{Data: map[string]interface{}{"message": message, "seq": seq}}
+	}
+	filter.Emit([]ik.FluentRecordSet{
+		{Tag: "a", Records: []ik.TinyFluentRecord{record(1, "x"), record(2, "y"), record(3, "x")}},
+		{Tag: "b", Records: []ik.TinyFluentRecord{record(4, "x")}},
+	})
+	recordSets := <-port.c
+	if len(recordSets) != 2 || len(recordSets[0].Records) != 2 || recordSets[0].Records[1].Data["seq"] != 2 || len(recordSets[1].Records) != 1 {
+		t.Fatalf("%v", recordSets)
+	}
+	now = now.Add(5 * time.Second)
+	filter.Emit([]ik.FluentRecordSet{{Tag: "a", Records: []ik.TinyFluentRecord{record(5, "x")}}})
+	if len(port.c) != 0 {
+		t.Fatal("a duplicate within the window was passed")
+	}
+	// the window starts at the record passed, not at the last duplicate
+	now = now.Add(5 * time.Second)
+	filter.Emit([]ik.FluentRecordSet{{Tag: "a", Records: []ik.TinyFluentRecord{record(6, "x")}}})
+	recordSets = <-port.c
+	if len(recordSets) != 1 || recordSets[0].Records[0].Data["seq"] != 6 {
+		t.Fatalf("%v", recordSets)
+	}
+}
+
+func Test_DedupFilter_maxEntries(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	now := time.Unix(1000, 0)
+	filter := newTestDedupFilter(t, port, nil, 2, &now)
+	record := func(seq int) ik.TinyFluentRecord {
+		return ik.TinyFluentRecord{Data: map[string]interface{}{"seq": seq}}
+	}
+	filter.Emit([]ik.FluentRecordSet{{Tag: "a", Records: []ik.TinyFluentRecord{record(1), record(2), record(3), record(3), record(1)}}})
+	recordSets := <-port.c
+	// 1 was forgotten to make room for 3
+	if len(recordSets[0].Records) != 4 || recordSets[0].Records[3].Data["seq"] != 1 {
+		t.Fatalf("%v", recordSets)
+	}
+	if filter.order.Len() != 2 || len(filter.entries) != 2 {
+		t.Fail()
+	}
+}
+
+func Test_DedupFilterFactory_New(t *testing.T) {
+	factory := &DedupFilterFactory{}
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	for _, attrs := range []map[string]string{{"window": "0s"}, {"window": "x"}, {"max_entries": "0"}} {
+		_, err := factory.New(engine, &ik.ConfigElement{Attrs: attrs}, nil)
+		if err == nil {
+			t.Logf("%v accepted", attrs)
+			t.Fail()
+		}
+	}
+	filter, err := factory.New(engine, &ik.ConfigElement{Attrs: map[string]string{"keys": "a, b", "window": "5s"}}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	dedup := filter.(*DedupFilter)
+	if len(dedup.keys) != 2 || dedup.window != 5*time.Second || dedup.maxEntries != 10000 {
+		t.Fail()
+	}
+}
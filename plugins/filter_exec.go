@@ -0,0 +1,315 @@
+package plugins
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"github.com/ugorji/go/codec"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ExecFilter streams the records to a command running alongside, and
+// emits what the command writes back, so that a transformation can be
+// written in any language.  The command reads the records on its standard
+// input and writes records on its standard output, either in JSON, a
+// {"tag": tag, "time": time, "record": record} object a line, or in
+// msgpack, as the messages of the forward protocol.  The command may write
+// any number of records for each one it reads, and at any time; those it
+// writes without a tag are given `tag'.
+//
+// The record sets wait for the command in a queue of max_in_flight record
+// sets, Emit failing once the queue has been full for emit_timeout.  The
+// command is run again restart_interval after it exits, and the record sets
+// it was given and had not answered by then are lost.
+type ExecFilter struct {
+	factory         *ExecFilterFactory
+	engine          ik.Engine
+	logger          ik.Logger
+	next            ik.Port
+	command         string
+	env             []string
+	inFormat        string
+	outFormat       string
+	tag             string
+	restartInterval time.Duration
+	emitTimeout     time.Duration
+	codec           *codec.MsgpackHandle
+	queue           chan ik.FluentRecordSet
+	process         *externalProcess
+	shutdown        chan struct{}
+	shutdownOnce    sync.Once
+	mtx             sync.Mutex
+}
+
+type ExecFilterFactory struct {
+}
+
+type execFilterLine struct {
+	Tag    string                 `json:"tag,omitempty"`
+	Time   *uint64                `json:"time,omitempty"`
+	Record map[string]interface{} `json:"record"`
+}
+
+func (filter *ExecFilter) Factory() ik.Plugin {
+	return filter.factory
+}
+
+func (filter *ExecFilter) Emit(recordSets []ik.FluentRecordSet) error {
+	var timer ik.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+	for _, recordSet := range recordSets {
+		if len(recordSet.Records) == 0 {
+			continue
+		}
+		select {
+		case filter.queue <- recordSet:
+			continue
+		default:
+		}
+		if timer == nil {
+			timer = filter.engine.Clock().NewTimer(filter.emitTimeout)
+		}
+		select {
+		case filter.queue <- recordSet:
+		case <-filter.shutdown:
+			return errors.New("the filter has been shut down")
+		case <-timer.C():
+			return errors.New(fmt.Sprintf("%s has not taken the records for %s", filter.command, filter.emitTimeout.String()))
+		}
+	}
+	return nil
+}
+
+// write feeds the command from the queue until it exits.
+func (filter *ExecFilter) write(process *externalProcess, done chan struct{}) {
+	defer close(done)
+	writer := bufio.NewWriter(process.stdin)
+	enc := codec.NewEncoder(writer, filter.codec)
+	for {
+		var recordSet ik.FluentRecordSet
+		select {
+		case recordSet = <-filter.queue:
+		case <-process.exited:
+			return
+		case <-filter.shutdown:
+			return
+		}
+		var err error
+		for _, record := range recordSet.Records {
+			if filter.inFormat == "json" {
+				var b []byte
+				timestamp := record.Timestamp
+				b, err = json.Marshal(execFilterLine{Tag: recordSet.Tag, Time: &timestamp, Record: record.Data})
+				if err == nil {
+					writer.Write(b)
+					err = writer.WriteByte('\n')
+				}
+			} else {
+				err = enc.Encode([]interface{}{recordSet.Tag, record.Timestamp, record.Data})
+			}
+			if err != nil {
+				break
+			}
+		}
+		// flushed whenever there is nothing more to write for now
+		if err == nil && len(filter.queue) == 0 {
+			err = writer.Flush()
+		}
+		if err != nil {
+			filter.logger.Error("failed to write %d records to %s: %s", len(recordSet.Records), filter.command, err.Error())
+			filter.engine.DeadLetter(filter, err, []ik.FluentRecordSet{recordSet})
+			return
+		}
+	}
+}
+
+func (filter *ExecFilter) decodeLine(line []byte) (ik.FluentRecordSet, error) {
+	decoded := execFilterLine{}
+	err := json.Unmarshal(line, &decoded)
+	if err != nil {
+		return ik.FluentRecordSet{}, err
+	}
+	if decoded.Record == nil {
+		return ik.FluentRecordSet{}, errors.New("no record in the line")
+	}
+	tag := decoded.Tag
+	if tag == "" {
+		tag = filter.tag
+	}
+	if tag == "" {
+		return ik.FluentRecordSet{}, errors.New("no tag in the line")
+	}
+	timestamp := uint64(filter.engine.Clock().Now().Unix())
+	if decoded.Time != nil {
+		timestamp = *decoded.Time
+	}
+	return ik.FluentRecordSet{Tag: tag, Records: []ik.TinyFluentRecord{{Timestamp: timestamp, Data: decoded.Record}}}, nil
+}
+
+// read emits what the command writes until it closes its standard output.
+func (filter *ExecFilter) read(process *externalProcess) error {
+	reader := bufio.NewReader(process.stdout)
+	if filter.outFormat == "json" {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(nil, 1<<30)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if len(line) == 0 {
+				continue
+			}
+			recordSet, err := filter.decodeLine(line)
+			if err != nil {
+				filter.logger.Error("%s: %s", filter.command, err.Error())
+				ik.DeadLetterLines(filter.engine, filter, err, []string{string(line)})
+				continue
+			}
+			filter.emit([]ik.FluentRecordSet{recordSet})
+		}
+		return scanner.Err()
+	}
+	dec := codec.NewDecoder(reader, filter.codec)
+	for {
+		v := []interface{}{}
+		err := dec.Decode(&v)
+		if err != nil {
+			return err
+		}
+		recordSets, _, err := decodeForwardMessage(filter.codec, v)
+		if err != nil {
+			return err
+		}
+		filter.emit(recordSets)
+	}
+}
+
+func (filter *ExecFilter) emit(recordSets []ik.FluentRecordSet) {
+	err := filter.next.Emit(recordSets)
+	if err != nil {
+		filter.logger.Error("%s", err.Error())
+	}
+}
+
+// Run runs the command, and runs it again restart_interval after it exits
+// until the filter is shut down.
+func (filter *ExecFilter) Run() error {
+	filter.mtx.Lock()
+	select {
+	case <-filter.shutdown:
+		filter.mtx.Unlock()
+		return nil
+	default:
+	}
+	process, err := startExternalProcess(filter.logger, filter.command, filter.env)
+	filter.process = process
+	filter.mtx.Unlock()
+	if err != nil {
+		filter.logger.Error("failed to run %s: %s", filter.command, err.Error())
+	} else {
+		written := make(chan struct{})
+		go filter.write(process, written)
+		err = filter.read(process)
+		if err != nil && err != io.EOF {
+			filter.logger.Error("%s: %s", filter.command, err.Error())
+		}
+		process.kill()
+		<-written
+	}
+	select {
+	case <-filter.shutdown:
+		return nil
+	case <-ik.After(filter.engine.Clock(), filter.restartInterval):
+	}
+	return ik.Continue
+}
+
+func (filter *ExecFilter) Shutdown() error {
+	filter.shutdownOnce.Do(func() {
+		filter.mtx.Lock()
+		close(filter.shutdown)
+		process := filter.process
+		filter.mtx.Unlock()
+		if process != nil {
+			process.kill()
+		}
+	})
+	return nil
+}
+
+func (filter *ExecFilter) Dispose() {
+	filter.Shutdown()
+}
+
+func (factory *ExecFilterFactory) Name() string {
+	return "exec_filter"
+}
+
+func (factory *ExecFilterFactory) New(engine ik.Engine, config *ik.ConfigElement, next ik.Port) (ik.Filter, error) {
+	command, ok := config.Attrs["command"]
+	if !ok {
+		return nil, errors.New("required attribute `command' is not specified")
+	}
+	formats := map[string]string{"in_format": "json", "out_format": "json"}
+	for name := range formats {
+		format, ok := config.Attrs[name]
+		if !ok {
+			continue
+		}
+		if format != "json" && format != "msgpack" {
+			return nil, errors.New(fmt.Sprintf("unsupported %s: %s", name, format))
+		}
+		formats[name] = format
+	}
+	env, err := externalPluginEnv(config)
+	if err != nil {
+		return nil, err
+	}
+	restartInterval, err := parseForwardDuration(config, "restart_interval", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	emitTimeout, err := parseForwardDuration(config, "emit_timeout", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	maxInFlight := 64
+	maxInFlightStr, ok := config.Attrs["max_in_flight"]
+	if ok {
+		maxInFlight, err = strconv.Atoi(maxInFlightStr)
+		if err != nil {
+			return nil, err
+		}
+		if maxInFlight <= 0 {
+			return nil, errors.New("max_in_flight must be positive")
+		}
+	}
+	return &ExecFilter{
+		factory:         factory,
+		engine:          engine,
+		logger:          engine.Logger(),
+		next:            next,
+		command:         command,
+		env:             env,
+		inFormat:        formats["in_format"],
+		outFormat:       formats["out_format"],
+		tag:             config.Attrs["tag"],
+		restartInterval: restartInterval,
+		emitTimeout:     emitTimeout,
+		codec:           newFluentdCodec(),
+		queue:           make(chan ik.FluentRecordSet, maxInFlight),
+		shutdown:        make(chan struct{}),
+	}, nil
+}
+
+func (factory *ExecFilterFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&ExecFilterFactory{})
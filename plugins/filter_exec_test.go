@@ -0,0 +1,127 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testSyncPort struct {
+	recordSets []ik.FluentRecordSet
+	mtx        sync.Mutex
+}
+
+func (port *testSyncPort) Emit(recordSets []ik.FluentRecordSet) error {
+	port.mtx.Lock()
+	defer port.mtx.Unlock()
+	port.recordSets = append(port.recordSets, recordSets...)
+	return nil
+}
+
+func (port *testSyncPort) wait(t *testing.T, n int) []ik.FluentRecordSet {
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		port.mtx.Lock()
+		if len(port.recordSets) >= n {
+			retval := port.recordSets
+			port.mtx.Unlock()
+			return retval
+		}
+		port.mtx.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d record sets emitted, expected %d", len(port.recordSets), n)
+	return nil
+}
+
+func newTestExecFilter(t *testing.T, next ik.Port, attrs map[string]string) *ExecFilter {
+	attrs["command"] = externalHelperCommand()
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	filter, err := (&ExecFilterFactory{}).New(engine, &ik.ConfigElement{Attrs: attrs}, next)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	execFilter := filter.(*ExecFilter)
+	execFilter.restartInterval = time.Millisecond
+	return execFilter
+}
+
+func runTestExecFilter(filter *ExecFilter) chan struct{} {
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for filter.Run() == ik.Continue {
+		}
+	}()
+	return stopped
+}
+
+func Test_ExecFilter_json(t *testing.T) {
+	port := &testSyncPort{}
+	filter := newTestExecFilter(t, port, map[string]string{"mode": "filter_json", "tag": "doubled"})
+	stopped := runTestExecFilter(filter)
+	record := func(data map[string]interface{}) ik.FluentRecordSet {
+		return ik.FluentRecordSet{Tag: "in", Records: []ik.TinyFluentRecord{{Timestamp: 1400000000, Data: data}}}
+	}
+	err := filter.Emit([]ik.FluentRecordSet{record(map[string]interface{}{"x": 1}), record(map[string]interface{}{"x": 2})})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets := port.wait(t, 2)
+	for i, recordSet := range recordSets[:2] {
+		if recordSet.Tag != "doubled" || recordSet.Records[0].Timestamp != 1400000000 || recordSet.Records[0].Data["y"] != float64(2*(i+1)) {
+			t.Logf("%v", recordSet)
+			t.Fail()
+		}
+	}
+	// the command is run again once it crashes
+	filter.Emit([]ik.FluentRecordSet{record(map[string]interface{}{"crash": true})})
+	time.Sleep(100 * time.Millisecond)
+	filter.Emit([]ik.FluentRecordSet{record(map[string]interface{}{"x": 3})})
+	recordSets = port.wait(t, 3)
+	if recordSets[2].Records[0].Data["y"] != float64(6) {
+		t.Logf("%v", recordSets[2])
+		t.Fail()
+	}
+	filter.Shutdown()
+	<-stopped
+}
+
+func Test_ExecFilter_msgpack(t *testing.T) {
+	port := &testSyncPort{}
+	filter := newTestExecFilter(t, port, map[string]string{"mode": "filter_msgpack", "in_format": "msgpack", "out_format": "msgpack"})
+	stopped := runTestExecFilter(filter)
+	err := filter.Emit([]ik.FluentRecordSet{{Tag: "in", Records: []ik.TinyFluentRecord{{Timestamp: 1400000000, Data: map[string]interface{}{"x": 1}}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets := port.wait(t, 1)
+	if recordSets[0].Tag != "out.in" || recordSets[0].Records[0].Data["seen"] != true {
+		t.Logf("%v", recordSets[0])
+		t.Fail()
+	}
+	filter.Shutdown()
+	<-stopped
+}
+
+func Test_ExecFilter_Emit_full(t *testing.T) {
+	filter := &ExecFilter{
+		engine:      ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil),
+		command:     "command",
+		emitTimeout: 10 * time.Millisecond,
+		queue:       make(chan ik.FluentRecordSet, 1),
+		shutdown:    make(chan struct{}),
+	}
+	recordSet := ik.FluentRecordSet{Tag: "in", Records: []ik.TinyFluentRecord{{Data: map[string]interface{}{}}}}
+	// nothing takes the records without the command
+	if filter.Emit([]ik.FluentRecordSet{recordSet}) != nil {
+		t.Fail()
+	}
+	if filter.Emit([]ik.FluentRecordSet{recordSet}) == nil {
+		t.Fail()
+	}
+	if filter.Emit([]ik.FluentRecordSet{{Tag: "empty"}}) != nil {
+		t.Fail()
+	}
+}
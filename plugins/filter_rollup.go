@@ -0,0 +1,189 @@
+package plugins
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"reflect"
+	"sync"
+	"time"
+)
+
+type rollupRun struct {
+	record        ik.TinyFluentRecord
+	count         int64
+	lastTimestamp uint64
+}
+
+// RollupFilter collapses a run of identical consecutive records of a tag
+// into the first of them, adding how many times it was repeated and when
+// the first and the last one came, like syslog's "last message repeated N
+// times".  Records are compared by the values of keys, or by their whole
+// content if keys is not given.  A record is held until one that differs
+// comes or flush_interval passes, so it is not durable until then.
+type RollupFilter struct {
+	factory        *RollupFilterFactory
+	logger         ik.Logger
+	next           ik.Port
+	keys           []string
+	repeatCountKey string
+	firstTimeKey   string
+	lastTimeKey    string
+	runs           map[string]*rollupRun
+	mtx            sync.Mutex
+	ticker         ik.Ticker
+	cancel         chan bool
+}
+
+type RollupFilterFactory struct {
+}
+
+func (filter *RollupFilter) identical(a map[string]interface{}, b map[string]interface{}) bool {
+	if len(filter.keys) == 0 {
+		return reflect.DeepEqual(a, b)
+	}
+	for _, key := range filter.keys {
+		if !reflect.DeepEqual(a[key], b[key]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (filter *RollupFilter) collapse(run *rollupRun) ik.TinyFluentRecord {
+	if run.count > 1 && run.record.Data != nil {
+		run.record.Data[filter.repeatCountKey] = run.count
+		run.record.Data[filter.firstTimeKey] = run.record.Timestamp
+		run.record.Data[filter.lastTimeKey] = run.lastTimestamp
+	}
+	return run.record
+}
+
+func (filter *RollupFilter) Emit(recordSets []ik.FluentRecordSet) error {
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	collapsed := make([]ik.FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		records := make([]ik.TinyFluentRecord, 0)
+		run := filter.runs[recordSet.Tag]
+		for _, record := range recordSet.Records {
+			if run != nil && filter.identical(run.record.Data, record.Data) {
+				run.count += 1
+				run.lastTimestamp = record.Timestamp
+				continue
+			}
+			if run != nil {
+				records = append(records, filter.collapse(run))
+			}
+			run = &rollupRun{record, 1, record.Timestamp}
+		}
+		if run != nil {
+			filter.runs[recordSet.Tag] = run
+		}
+		if len(records) > 0 {
+			collapsed = append(collapsed, ik.FluentRecordSet{Tag: recordSet.Tag, Records: records})
+		}
+	}
+	if len(collapsed) == 0 {
+		return nil
+	}
+	return filter.next.Emit(collapsed)
+}
+
+// flush emits the runs held so far.
+func (filter *RollupFilter) flush() error {
+	filter.mtx.Lock()
+	defer filter.mtx.Unlock()
+	if len(filter.runs) == 0 {
+		return nil
+	}
+	collapsed := make([]ik.FluentRecordSet, 0, len(filter.runs))
+	for tag, run := range filter.runs {
+		collapsed = append(collapsed, ik.FluentRecordSet{Tag: tag, Records: []ik.TinyFluentRecord{filter.collapse(run)}})
+	}
+	filter.runs = make(map[string]*rollupRun)
+	return filter.next.Emit(collapsed)
+}
+
+func (filter *RollupFilter) Factory() ik.Plugin {
+	return filter.factory
+}
+
+func (filter *RollupFilter) Run() error {
+	select {
+	case <-filter.cancel:
+		return filter.flush()
+	case <-filter.ticker.C():
+	}
+	err := filter.flush()
+	if err != nil {
+		filter.logger.Error("%s", err.Error())
+	}
+	return ik.Continue
+}
+
+func (filter *RollupFilter) Shutdown() error {
+	filter.ticker.Stop()
+	filter.cancel <- true
+	return nil
+}
+
+func (filter *RollupFilter) Dispose() {
+	filter.Shutdown()
+}
+
+func (factory *RollupFilterFactory) Name() string {
+	return "rollup"
+}
+
+func (factory *RollupFilterFactory) New(engine ik.Engine, config *ik.ConfigElement, next ik.Port) (ik.Filter, error) {
+	keys := make([]string, 0)
+	keysStr, ok := config.Attrs["keys"]
+	if ok {
+		for _, key := range splitAndStrip(keysStr) {
+			if key != "" {
+				keys = append(keys, key)
+			}
+		}
+	}
+	repeatCountKey, ok := config.Attrs["repeat_count_key"]
+	if !ok {
+		repeatCountKey = "repeat_count"
+	}
+	firstTimeKey, ok := config.Attrs["first_time_key"]
+	if !ok {
+		firstTimeKey = "first_time"
+	}
+	lastTimeKey, ok := config.Attrs["last_time_key"]
+	if !ok {
+		lastTimeKey = "last_time"
+	}
+	flushInterval := 5 * time.Second
+	flushIntervalStr, ok := config.Attrs["flush_interval"]
+	if ok {
+		var err error
+		flushInterval, err = time.ParseDuration(flushIntervalStr)
+		if err != nil {
+			return nil, err
+		}
+		if flushInterval <= 0 {
+			return nil, errors.New("invalid flush_interval: " + flushIntervalStr)
+		}
+	}
+	return &RollupFilter{
+		factory:        factory,
+		logger:         engine.Logger(),
+		next:           next,
+		keys:           keys,
+		repeatCountKey: repeatCountKey,
+		firstTimeKey:   firstTimeKey,
+		lastTimeKey:    lastTimeKey,
+		runs:           make(map[string]*rollupRun),
+		ticker:         engine.Clock().NewTicker(flushInterval),
+		cancel:         make(chan bool),
+	}, nil
+}
+
+func (factory *RollupFilterFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&RollupFilterFactory{})
@@ -0,0 +1,59 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	"testing"
+	"time"
+)
+
+func Test_RollupFilter(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	filter := &RollupFilter{
+		logger:         &testLogger{t},
+		next:           port,
+		keys:           []string{"message"},
+		repeatCountKey: "repeat_count",
+		firstTimeKey:   "first_time",
+		lastTimeKey:    "last_time",
+		runs:           make(map[string]*rollupRun),
+		ticker:         ik.SystemClock.NewTicker(time.Hour),
+		cancel:         make(chan bool),
+	}
+	record := func(timestamp uint64, message string) ik.TinyFluentRecord {
+		return ik.TinyFluentRecord{Timestamp: timestamp, Data: map[string]interface{}{"message": message, "seq": timestamp}}
+	}
+	err := filter.Emit([]ik.FluentRecordSet{{Tag: "app", Records: []ik.TinyFluentRecord{
+		record(1, "a"),
+		record(2, "boom"),
+		record(3, "boom"),
+		record(4, "boom"),
+	}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets := <-port.c
+	if len(recordSets) != 1 || len(recordSets[0].Records) != 1 {
+		t.Fatalf("%v", recordSets)
+	}
+	data := recordSets[0].Records[0].Data
+	if data["message"] != "a" || data["repeat_count"] != nil {
+		t.Fatalf("%v", data)
+	}
+	// the run continues across emits until it is flushed
+	filter.Emit([]ik.FluentRecordSet{{Tag: "app", Records: []ik.TinyFluentRecord{record(5, "boom")}}})
+	err = filter.flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets = <-port.c
+	if len(recordSets) != 1 || len(recordSets[0].Records) != 1 {
+		t.Fatalf("%v", recordSets)
+	}
+	record_ := recordSets[0].Records[0]
+	if record_.Timestamp != 2 || record_.Data["seq"] != uint64(2) || record_.Data["repeat_count"] != int64(4) || record_.Data["first_time"] != uint64(2) || record_.Data["last_time"] != uint64(5) {
+		t.Fatalf("%v", record_)
+	}
+	if len(port.c) != 0 {
+		t.Fail()
+	}
+}
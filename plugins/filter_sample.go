@@ -0,0 +1,167 @@
+package plugins
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"math"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SampleFilter passes one of every `every' records of each tag, or each
+// record with the probability given by `rate'.  If key is given, the
+// decision is made on the hash of the value of the field instead, so that
+// the records sharing it, such as the ones of a request, are all passed or
+// all dropped.  The number of records each passed record stands for is put
+// in sample_rate_key unless it is empty.
+type SampleFilter struct {
+	factory  *SampleFilterFactory
+	logger   ik.Logger
+	next     ik.Port
+	every    int64 // 0 if rate is used
+	rate     float64
+	key      string
+	rateKey  string
+	counters map[string]int64
+	rand     *rand.Rand
+	mtx      sync.Mutex
+}
+
+type SampleFilterFactory struct {
+}
+
+// hash spreads the values over the range of uint64, which FNV and the
+// like fail to do for short ones that differ only in the last characters.
+func (filter *SampleFilter) hash(value interface{}) uint64 {
+	var b []byte
+	switch value_ := value.(type) {
+	case []byte:
+		b = value_
+	case string:
+		b = []byte(value_)
+	default:
+		b = []byte(fmt.Sprint(value_))
+	}
+	sum := sha1.Sum(b)
+	return binary.BigEndian.Uint64(sum[0:8])
+}
+
+func (filter *SampleFilter) keep(tag string, data map[string]interface{}) bool {
+	if filter.key != "" {
+		h := filter.hash(data[filter.key])
+		if filter.every > 0 {
+			return h%uint64(filter.every) == 0
+		}
+		return float64(h) < filter.rate*math.MaxUint64
+	}
+	if filter.every > 0 {
+		count := filter.counters[tag]
+		filter.counters[tag] = (count + 1) % filter.every
+		return count == 0
+	}
+	return filter.rand.Float64() < filter.rate
+}
+
+func (filter *SampleFilter) Emit(recordSets []ik.FluentRecordSet) error {
+	var sampleRate interface{} = filter.every
+	if filter.every == 0 {
+		sampleRate = 1 / filter.rate
+	}
+	filter.mtx.Lock()
+	sampled := make([]ik.FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		records := make([]ik.TinyFluentRecord, 0)
+		for _, record := range recordSet.Records {
+			if !filter.keep(recordSet.Tag, record.Data) {
+				continue
+			}
+			if filter.rateKey != "" && record.Data != nil {
+				record.Data[filter.rateKey] = sampleRate
+			}
+			records = append(records, record)
+		}
+		if len(records) > 0 {
+			sampled = append(sampled, ik.FluentRecordSet{Tag: recordSet.Tag, Records: records})
+		}
+	}
+	filter.mtx.Unlock()
+	if len(sampled) == 0 {
+		return nil
+	}
+	return filter.next.Emit(sampled)
+}
+
+func (filter *SampleFilter) Factory() ik.Plugin {
+	return filter.factory
+}
+
+func (filter *SampleFilter) Run() error {
+	time.Sleep(1000000000)
+	return ik.Continue
+}
+
+func (filter *SampleFilter) Shutdown() error {
+	return nil
+}
+
+func (factory *SampleFilterFactory) Name() string {
+	return "sample"
+}
+
+func (factory *SampleFilterFactory) New(engine ik.Engine, config *ik.ConfigElement, next ik.Port) (ik.Filter, error) {
+	filter := &SampleFilter{
+		factory:  factory,
+		logger:   engine.Logger(),
+		next:     next,
+		key:      config.Attrs["key"],
+		counters: make(map[string]int64),
+	}
+	everyStr, everyOk := config.Attrs["every"]
+	rateStr, rateOk := config.Attrs["rate"]
+	if everyOk == rateOk {
+		return nil, errors.New("either `every' or `rate' must be specified")
+	}
+	var err error
+	if everyOk {
+		filter.every, err = strconv.ParseInt(everyStr, 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse every: %s", err.Error()))
+		}
+		if filter.every <= 0 {
+			return nil, errors.New("invalid every: " + everyStr)
+		}
+	} else {
+		filter.rate, err = strconv.ParseFloat(rateStr, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse rate: %s", err.Error()))
+		}
+		if filter.rate <= 0 || filter.rate > 1 {
+			return nil, errors.New("invalid rate: " + rateStr)
+		}
+	}
+	rateKey, ok := config.Attrs["sample_rate_key"]
+	if !ok {
+		rateKey = "sample_rate"
+	}
+	filter.rateKey = rateKey
+	seed := time.Now().UnixNano()
+	seedStr, ok := config.Attrs["seed"]
+	if ok {
+		seed, err = strconv.ParseInt(seedStr, 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse seed: %s", err.Error()))
+		}
+	}
+	filter.rand = rand.New(rand.NewSource(seed))
+	return filter, nil
+}
+
+func (factory *SampleFilterFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&SampleFilterFactory{})
@@ -0,0 +1,119 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	"math/rand"
+	"strconv"
+	"testing"
+)
+
+func Test_SampleFilter_every(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	filter := &SampleFilter{
+		logger:   &testLogger{t},
+		next:     port,
+		every:    3,
+		rateKey:  "sample_rate",
+		counters: make(map[string]int64),
+	}
+	records := make([]ik.TinyFluentRecord, 7)
+	for i := range records {
+		records[i] = ik.TinyFluentRecord{Timestamp: uint64(i), Data: map[string]interface{}{}}
+	}
+	filter.Emit([]ik.FluentRecordSet{{Tag: "a", Records: records[0:5]}, {Tag: "b", Records: records[5:7]}})
+	recordSets := <-port.c
+	if len(recordSets) != 2 || len(recordSets[0].Records) != 2 || recordSets[0].Records[1].Timestamp != 3 || len(recordSets[1].Records) != 1 {
+		t.Fatalf("%v", recordSets)
+	}
+	if recordSets[0].Records[0].Data["sample_rate"] != int64(3) {
+		t.Fail()
+	}
+	// the count goes on across emits
+	filter.Emit([]ik.FluentRecordSet{{Tag: "a", Records: []ik.TinyFluentRecord{
+		{Timestamp: 7, Data: map[string]interface{}{}},
+		{Timestamp: 8, Data: map[string]interface{}{}},
+	}}})
+	recordSets = <-port.c
+	if len(recordSets) != 1 || len(recordSets[0].Records) != 1 || recordSets[0].Records[0].Timestamp != 8 {
+		t.Fatalf("%v", recordSets)
+	}
+}
+
+func Test_SampleFilter_key(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	filter := &SampleFilter{
+		logger:   &testLogger{t},
+		next:     port,
+		rate:     0.5,
+		key:      "session",
+		rateKey:  "sample_rate",
+		counters: make(map[string]int64),
+	}
+	// every record of a session is passed or dropped along with the rest
+	records := make([]ik.TinyFluentRecord, 0)
+	for i := 0; i < 300; i++ {
+		records = append(records, ik.TinyFluentRecord{Data: map[string]interface{}{"session": strconv.Itoa(i % 100)}})
+	}
+	filter.Emit([]ik.FluentRecordSet{{Tag: "a", Records: records}})
+	recordSets := <-port.c
+	sessions := make(map[interface{}]int)
+	for _, record := range recordSets[0].Records {
+		sessions[record.Data["session"]] += 1
+		if record.Data["sample_rate"] != float64(2) {
+			t.Fatalf("%v", record.Data)
+		}
+	}
+	if len(sessions) < 30 || len(sessions) > 70 {
+		t.Logf("%d sessions passed", len(sessions))
+		t.Fail()
+	}
+	for session, count := range sessions {
+		if count != 3 {
+			t.Logf("%v: %d", session, count)
+			t.Fail()
+		}
+	}
+}
+
+func Test_SampleFilter_rate(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	filter := &SampleFilter{
+		logger:   &testLogger{t},
+		next:     port,
+		rate:     0.1,
+		counters: make(map[string]int64),
+		rand:     rand.New(rand.NewSource(0)),
+	}
+	records := make([]ik.TinyFluentRecord, 1000)
+	for i := range records {
+		records[i] = ik.TinyFluentRecord{Data: map[string]interface{}{}}
+	}
+	filter.Emit([]ik.FluentRecordSet{{Tag: "a", Records: records}})
+	recordSets := <-port.c
+	if n := len(recordSets[0].Records); n < 50 || n > 150 {
+		t.Logf("%d records passed", n)
+		t.Fail()
+	}
+	if _, ok := recordSets[0].Records[0].Data["sample_rate"]; ok {
+		t.Fail()
+	}
+}
+
+func Test_SampleFilterFactory_New(t *testing.T) {
+	factory := &SampleFilterFactory{}
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	for _, attrs := range []map[string]string{{}, {"every": "2", "rate": "0.5"}, {"every": "0"}, {"rate": "1.5"}, {"rate": "0"}} {
+		_, err := factory.New(engine, &ik.ConfigElement{Attrs: attrs}, nil)
+		if err == nil {
+			t.Logf("%v accepted", attrs)
+			t.Fail()
+		}
+	}
+	filter, err := factory.New(engine, &ik.ConfigElement{Attrs: map[string]string{"every": "10"}}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if filter.(*SampleFilter).every != 10 || filter.(*SampleFilter).rateKey != "sample_rate" {
+		t.Fail()
+	}
+}
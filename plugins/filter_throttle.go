@@ -0,0 +1,222 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type throttleBucket struct {
+	tokens     float64
+	updatedAt  time.Time
+	suppressed int64
+	tag        string // the last one a record was suppressed under
+}
+
+// ThrottleFilter passes at most rate records a second of each tag, or of
+// each value of group_key if it is given, allowing bursts of up to burst
+// records, and drops the rest.  If summary_interval is given, a record
+// telling how many were dropped is emitted for every group that had some
+// dropped in the interval, under the tag of the last of them.
+type ThrottleFilter struct {
+	factory  *ThrottleFilterFactory
+	logger   ik.Logger
+	next     ik.Port
+	groupKey string
+	rate     float64
+	burst    float64
+	summary  bool
+	buckets  map[string]*throttleBucket
+	clock    ik.Clock
+	mtx      sync.Mutex
+	ticker   ik.Ticker
+	cancel   chan bool
+}
+
+type ThrottleFilterFactory struct {
+}
+
+func (filter *ThrottleFilter) group(tag string, data map[string]interface{}) string {
+	if filter.groupKey == "" {
+		return tag
+	}
+	value, ok := data[filter.groupKey]
+	if !ok || value == nil {
+		return ""
+	}
+	if b, ok := value.([]byte); ok {
+		return string(b)
+	}
+	return fmt.Sprint(value)
+}
+
+// take refills the bucket for the time elapsed since it was last taken
+// from, and takes a token from it if there is one.
+func (filter *ThrottleFilter) take(bucket *throttleBucket, now time.Time) bool {
+	bucket.tokens += now.Sub(bucket.updatedAt).Seconds() * filter.rate
+	if bucket.tokens > filter.burst {
+		bucket.tokens = filter.burst
+	}
+	bucket.updatedAt = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens -= 1
+	return true
+}
+
+func (filter *ThrottleFilter) Emit(recordSets []ik.FluentRecordSet) error {
+	filter.mtx.Lock()
+	now := filter.clock.Now()
+	passed := make([]ik.FluentRecordSet, 0, len(recordSets))
+	for _, recordSet := range recordSets {
+		records := make([]ik.TinyFluentRecord, 0, len(recordSet.Records))
+		for _, record := range recordSet.Records {
+			group := filter.group(recordSet.Tag, record.Data)
+			bucket, ok := filter.buckets[group]
+			if !ok {
+				bucket = &throttleBucket{tokens: filter.burst, updatedAt: now}
+				filter.buckets[group] = bucket
+			}
+			if filter.take(bucket, now) {
+				records = append(records, record)
+				continue
+			}
+			bucket.suppressed += 1
+			bucket.tag = recordSet.Tag
+		}
+		if len(records) > 0 {
+			passed = append(passed, ik.FluentRecordSet{Tag: recordSet.Tag, Records: records})
+		}
+	}
+	filter.mtx.Unlock()
+	if len(passed) == 0 {
+		return nil
+	}
+	return filter.next.Emit(passed)
+}
+
+// summarize emits the number of records dropped since the last time if
+// summary_interval is given, and forgets the groups that have been quiet
+// long enough for their buckets to fill up.
+func (filter *ThrottleFilter) summarize() error {
+	filter.mtx.Lock()
+	now := filter.clock.Now()
+	summaries := make([]ik.FluentRecordSet, 0)
+	for group, bucket := range filter.buckets {
+		if bucket.suppressed > 0 && filter.summary {
+			data := map[string]interface{}{
+				"message":    fmt.Sprintf("%d messages suppressed", bucket.suppressed),
+				"suppressed": bucket.suppressed,
+			}
+			if filter.groupKey != "" {
+				data[filter.groupKey] = group
+			}
+			summaries = append(summaries, ik.FluentRecordSet{
+				Tag:     bucket.tag,
+				Records: []ik.TinyFluentRecord{{Timestamp: uint64(now.Unix()), Data: data}},
+			})
+		}
+		bucket.suppressed = 0
+		if bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*filter.rate >= filter.burst {
+			delete(filter.buckets, group)
+		}
+	}
+	filter.mtx.Unlock()
+	if len(summaries) == 0 {
+		return nil
+	}
+	return filter.next.Emit(summaries)
+}
+
+func (filter *ThrottleFilter) Factory() ik.Plugin {
+	return filter.factory
+}
+
+func (filter *ThrottleFilter) Run() error {
+	select {
+	case <-filter.cancel:
+		return filter.summarize()
+	case <-filter.ticker.C():
+	}
+	err := filter.summarize()
+	if err != nil {
+		filter.logger.Error("%s", err.Error())
+	}
+	return ik.Continue
+}
+
+func (filter *ThrottleFilter) Shutdown() error {
+	filter.ticker.Stop()
+	filter.cancel <- true
+	return nil
+}
+
+func (filter *ThrottleFilter) Dispose() {
+	filter.Shutdown()
+}
+
+func (factory *ThrottleFilterFactory) Name() string {
+	return "throttle"
+}
+
+func (factory *ThrottleFilterFactory) New(engine ik.Engine, config *ik.ConfigElement, next ik.Port) (ik.Filter, error) {
+	rateStr, ok := config.Attrs["rate"]
+	if !ok {
+		return nil, errors.New("required attribute `rate' is not specified")
+	}
+	rate, err := strconv.ParseFloat(rateStr, 64)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to parse rate: %s", err.Error()))
+	}
+	if rate <= 0 {
+		return nil, errors.New("invalid rate: " + rateStr)
+	}
+	burst := rate
+	burstStr, ok := config.Attrs["burst"]
+	if ok {
+		burst, err = strconv.ParseFloat(burstStr, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse burst: %s", err.Error()))
+		}
+	}
+	if burst < 1 {
+		return nil, errors.New("burst must be at least 1")
+	}
+	// the buckets left idle are forgotten once a minute if no summary is
+	// wanted
+	summary := false
+	interval := time.Minute
+	intervalStr, ok := config.Attrs["summary_interval"]
+	if ok {
+		interval, err = time.ParseDuration(intervalStr)
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, errors.New("invalid summary_interval: " + intervalStr)
+		}
+		summary = true
+	}
+	return &ThrottleFilter{
+		factory:  factory,
+		logger:   engine.Logger(),
+		next:     next,
+		groupKey: config.Attrs["group_key"],
+		rate:     rate,
+		burst:    burst,
+		summary:  summary,
+		buckets:  make(map[string]*throttleBucket),
+		clock:    engine.Clock(),
+		ticker:   engine.Clock().NewTicker(interval),
+		cancel:   make(chan bool),
+	}, nil
+}
+
+func (factory *ThrottleFilterFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&ThrottleFilterFactory{})
@@ -0,0 +1,116 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	"testing"
+	"time"
+)
+
+func Test_ThrottleFilter(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	now := time.Unix(1000, 0)
+	filter := &ThrottleFilter{
+		logger:  &testLogger{t},
+		next:    port,
+		rate:    1,
+		burst:   2,
+		summary: true,
+		buckets: make(map[string]*throttleBucket),
+		clock:   newTestClock(func() time.Time { return now }),
+		ticker:  ik.SystemClock.NewTicker(time.Hour),
+		cancel:  make(chan bool),
+	}
+	records := func(n int) []ik.TinyFluentRecord {
+		retval := make([]ik.TinyFluentRecord, n)
+		for i := range retval {
+			retval[i] = ik.TinyFluentRecord{Timestamp: uint64(i), Data: map[string]interface{}{"seq": i}}
+		}
+		return retval
+	}
+	passed := func() map[string]int {
+		retval := make(map[string]int)
+		if len(port.c) == 0 {
+			return retval
+		}
+		for _, recordSet := range <-port.c {
+			retval[recordSet.Tag] += len(recordSet.Records)
+		}
+		return retval
+	}
+
+	filter.Emit([]ik.FluentRecordSet{{Tag: "a", Records: records(5)}, {Tag: "b", Records: records(1)}})
+	if counts := passed(); counts["a"] != 2 || counts["b"] != 1 {
+		t.Fatalf("%v", counts)
+	}
+	// a token a second
+	now = now.Add(1500 * time.Millisecond)
+	filter.Emit([]ik.FluentRecordSet{{Tag: "a", Records: records(3)}})
+	if counts := passed(); counts["a"] != 1 {
+		t.Fatalf("%v", counts)
+	}
+
+	err := filter.summarize()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	summaries := <-port.c
+	if len(summaries) != 1 || summaries[0].Tag != "a" || summaries[0].Records[0].Data["suppressed"] != int64(5) || summaries[0].Records[0].Data["message"] != "5 messages suppressed" {
+		t.Fatalf("%v", summaries)
+	}
+	// b has been idle long enough to be forgotten
+	if _, ok := filter.buckets["b"]; ok || len(filter.buckets) != 1 {
+		t.Fail()
+	}
+	filter.summarize()
+	if len(port.c) != 0 {
+		t.Fail()
+	}
+}
+
+func Test_ThrottleFilter_groupKey(t *testing.T) {
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	filter := &ThrottleFilter{
+		logger:   &testLogger{t},
+		next:     port,
+		groupKey: "host",
+		rate:     1,
+		burst:    1,
+		buckets:  make(map[string]*throttleBucket),
+		clock:    newTestClock(func() time.Time { return time.Unix(1000, 0) }),
+	}
+	record := func(host interface{}) ik.TinyFluentRecord {
+		return ik.TinyFluentRecord{Data: map[string]interface{}{"host": host}}
+	}
+	filter.Emit([]ik.FluentRecordSet{
+		{Tag: "a", Records: []ik.TinyFluentRecord{record("x"), record("y"), record([]byte("x"))}},
+		{Tag: "b", Records: []ik.TinyFluentRecord{record("y"), record(1), record(nil)}},
+	})
+	recordSets := <-port.c
+	if len(recordSets) != 2 || len(recordSets[0].Records) != 2 || len(recordSets[1].Records) != 2 {
+		t.Fatalf("%v", recordSets)
+	}
+	filter.summarize()
+	if len(port.c) != 0 {
+		t.Fail()
+	}
+}
+
+func Test_ThrottleFilterFactory_New(t *testing.T) {
+	factory := &ThrottleFilterFactory{}
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	for _, attrs := range []map[string]string{{}, {"rate": "0"}, {"rate": "1", "burst": "0.5"}, {"rate": "1", "summary_interval": "0s"}} {
+		_, err := factory.New(engine, &ik.ConfigElement{Attrs: attrs}, nil)
+		if err == nil {
+			t.Logf("%v accepted", attrs)
+			t.Fail()
+		}
+	}
+	filter, err := factory.New(engine, &ik.ConfigElement{Attrs: map[string]string{"rate": "10"}}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if filter.(*ThrottleFilter).burst != 10 || filter.(*ThrottleFilter).summary {
+		t.Fail()
+	}
+	filter.(*ThrottleFilter).ticker.Stop()
+}
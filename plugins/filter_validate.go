@@ -0,0 +1,401 @@
+package plugins
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// recordSchema is the subset of JSON Schema the records are validated
+// against: type, which is a name or a list of them, enum, required,
+// properties, additionalProperties and maxProperties for objects, items
+// and maxItems for arrays, minLength, maxLength and pattern for strings,
+// and minimum and maximum for numbers.
+type recordSchema struct {
+	Type                 interface{}              `json:"type"`
+	Enum                 []interface{}            `json:"enum"`
+	Required             []string                 `json:"required"`
+	Properties           map[string]*recordSchema `json:"properties"`
+	AdditionalProperties *bool                    `json:"additionalProperties"`
+	MaxProperties        *int                     `json:"maxProperties"`
+	Items                *recordSchema            `json:"items"`
+	MaxItems             *int                     `json:"maxItems"`
+	MinLength            *int                     `json:"minLength"`
+	MaxLength            *int                     `json:"maxLength"`
+	Pattern              string                   `json:"pattern"`
+	Minimum              *float64                 `json:"minimum"`
+	Maximum              *float64                 `json:"maximum"`
+	types                []string
+	pattern              *regexp.Regexp
+}
+
+var recordSchemaTypes = []string{"object", "array", "string", "number", "integer", "boolean", "null"}
+
+func (schema *recordSchema) compile(path string) error {
+	switch type_ := schema.Type.(type) {
+	case nil:
+	case string:
+		schema.types = []string{type_}
+	case []interface{}:
+		for _, v := range type_ {
+			name, ok := v.(string)
+			if !ok {
+				return errors.New(fmt.Sprintf("%s: invalid type: %v", path, v))
+			}
+			schema.types = append(schema.types, name)
+		}
+	default:
+		return errors.New(fmt.Sprintf("%s: invalid type: %v", path, type_))
+	}
+	for _, name := range schema.types {
+		if !validSchemaType(name) {
+			return errors.New(fmt.Sprintf("%s: unsupported type: %s", path, name))
+		}
+	}
+	if schema.Pattern != "" {
+		var err error
+		schema.pattern, err = regexp.Compile(schema.Pattern)
+		if err != nil {
+			return errors.New(fmt.Sprintf("%s: %s", path, err.Error()))
+		}
+	}
+	for name, property := range schema.Properties {
+		err := property.compile(path + "." + name)
+		if err != nil {
+			return err
+		}
+	}
+	if schema.Items != nil {
+		return schema.Items.compile(path + "[]")
+	}
+	return nil
+}
+
+func validSchemaType(name string) bool {
+	for _, type_ := range recordSchemaTypes {
+		if type_ == name {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaNumber is aggregateNumber but for the numeric strings, which are
+// strings to the schema.
+func schemaNumber(value interface{}) (float64, bool) {
+	switch value.(type) {
+	case string, []byte:
+		return 0, false
+	}
+	return aggregateNumber(value)
+}
+
+// schemaTypeOf names the type of a value the way the schemas do.
+func schemaTypeOf(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string, []byte:
+		return "string"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	f, ok := schemaNumber(value)
+	if ok {
+		if f == float64(int64(f)) {
+			return "integer"
+		}
+		return "number"
+	}
+	return reflect.TypeOf(value).String()
+}
+
+func schemaEqual(a interface{}, b interface{}) bool {
+	fa, ok := schemaNumber(a)
+	if ok {
+		fb, ok := schemaNumber(b)
+		return ok && fa == fb
+	}
+	if bytes, ok := a.([]byte); ok {
+		a = string(bytes)
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// validate returns the first violation of the schema by value, which is at
+// path.
+func (schema *recordSchema) validate(path string, value interface{}) error {
+	if len(schema.types) > 0 {
+		type_ := schemaTypeOf(value)
+		matched := false
+		for _, expected := range schema.types {
+			if expected == type_ || (expected == "number" && type_ == "integer") {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return errors.New(fmt.Sprintf("%s: expected %s, got %s", path, strings.Join(schema.types, " or "), type_))
+		}
+	}
+	if len(schema.Enum) > 0 {
+		matched := false
+		for _, expected := range schema.Enum {
+			if schemaEqual(value, expected) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return errors.New(fmt.Sprintf("%s: %v is not one of %v", path, value, schema.Enum))
+		}
+	}
+	switch value_ := value.(type) {
+	case string:
+		return schema.validateString(path, value_)
+	case []byte:
+		return schema.validateString(path, string(value_))
+	case map[string]interface{}:
+		return schema.validateObject(path, value_)
+	case []interface{}:
+		if schema.MaxItems != nil && len(value_) > *schema.MaxItems {
+			return errors.New(fmt.Sprintf("%s: %d items, more than %d", path, len(value_), *schema.MaxItems))
+		}
+		if schema.Items != nil {
+			for i, item := range value_ {
+				err := schema.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+	f, ok := schemaNumber(value)
+	if ok {
+		if schema.Minimum != nil && f < *schema.Minimum {
+			return errors.New(fmt.Sprintf("%s: %v is less than %v", path, value, *schema.Minimum))
+		}
+		if schema.Maximum != nil && f > *schema.Maximum {
+			return errors.New(fmt.Sprintf("%s: %v is greater than %v", path, value, *schema.Maximum))
+		}
+	}
+	return nil
+}
+
+func (schema *recordSchema) validateString(path string, s string) error {
+	length := utf8.RuneCountInString(s)
+	if schema.MinLength != nil && length < *schema.MinLength {
+		return errors.New(fmt.Sprintf("%s: %d characters, fewer than %d", path, length, *schema.MinLength))
+	}
+	if schema.MaxLength != nil && length > *schema.MaxLength {
+		return errors.New(fmt.Sprintf("%s: %d characters, more than %d", path, length, *schema.MaxLength))
+	}
+	if schema.pattern != nil && !schema.pattern.MatchString(s) {
+		return errors.New(fmt.Sprintf("%s: does not match %s", path, schema.Pattern))
+	}
+	return nil
+}
+
+func (schema *recordSchema) validateObject(path string, data map[string]interface{}) error {
+	for _, name := range schema.Required {
+		if _, ok := data[name]; !ok {
+			return errors.New(fmt.Sprintf("%s: %s is required", path, name))
+		}
+	}
+	if schema.MaxProperties != nil && len(data) > *schema.MaxProperties {
+		return errors.New(fmt.Sprintf("%s: %d properties, more than %d", path, len(data), *schema.MaxProperties))
+	}
+	// in order, so that the same record always gets the same message
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		property, ok := schema.Properties[name]
+		if !ok {
+			if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+				return errors.New(fmt.Sprintf("%s: %s is not allowed", path, name))
+			}
+			continue
+		}
+		err := property.validate(path+"."+name, data[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type validateRule struct {
+	pattern *regexp.Regexp
+	schema  *recordSchema
+}
+
+// ValidateFilter validates the records against the schema of the first
+// <schema pattern> element whose pattern matches their tag, given inline
+// by its schema attribute or in the file at its path.  The records of a
+// tag no schema is given for are passed as they are.  A record violating
+// its schema is emitted under error_tag, as {"tag", "record", "error"}
+// like a dead letter, with the violation in error; without error_tag it
+// is handed over to the dead-letter queue.
+type ValidateFilter struct {
+	factory  *ValidateFilterFactory
+	engine   ik.Engine
+	logger   ik.Logger
+	next     ik.Port
+	rules    []validateRule
+	errorTag string
+}
+
+type ValidateFilterFactory struct {
+}
+
+func (filter *ValidateFilter) schemaFor(tag string) *recordSchema {
+	for _, rule := range filter.rules {
+		if rule.pattern.MatchString(tag) {
+			return rule.schema
+		}
+	}
+	return nil
+}
+
+func (filter *ValidateFilter) Emit(recordSets []ik.FluentRecordSet) error {
+	passed := make([]ik.FluentRecordSet, 0, len(recordSets))
+	violations := make([]ik.TinyFluentRecord, 0)
+	for _, recordSet := range recordSets {
+		schema := filter.schemaFor(recordSet.Tag)
+		if schema == nil || recordSet.Tag == filter.errorTag {
+			passed = append(passed, recordSet)
+			continue
+		}
+		records := make([]ik.TinyFluentRecord, 0, len(recordSet.Records))
+		for _, record := range recordSet.Records {
+			err := schema.validate("record", record.Data)
+			if err == nil {
+				records = append(records, record)
+				continue
+			}
+			if filter.errorTag == "" {
+				filter.engine.DeadLetter(filter, err, []ik.FluentRecordSet{{Tag: recordSet.Tag, Records: []ik.TinyFluentRecord{record}}})
+				continue
+			}
+			violations = append(violations, ik.TinyFluentRecord{
+				Timestamp: record.Timestamp,
+				Data: map[string]interface{}{
+					"tag":    recordSet.Tag,
+					"record": record.Data,
+					"error":  err.Error(),
+				},
+			})
+		}
+		if len(records) > 0 {
+			passed = append(passed, ik.FluentRecordSet{Tag: recordSet.Tag, Records: records})
+		}
+	}
+	if len(violations) > 0 {
+		passed = append(passed, ik.FluentRecordSet{Tag: filter.errorTag, Records: violations})
+	}
+	if len(passed) == 0 {
+		return nil
+	}
+	return filter.next.Emit(passed)
+}
+
+func (filter *ValidateFilter) Factory() ik.Plugin {
+	return filter.factory
+}
+
+func (filter *ValidateFilter) Run() error {
+	time.Sleep(1000000000)
+	return ik.Continue
+}
+
+func (filter *ValidateFilter) Shutdown() error {
+	return nil
+}
+
+func newValidateRule(config *ik.ConfigElement) (validateRule, error) {
+	if config.Args == "" {
+		return validateRule{}, errors.New("<schema> requires a tag pattern")
+	}
+	pattern, err := ik.BuildRegexpFromGlobPattern(config.Args)
+	if err != nil {
+		return validateRule{}, err
+	}
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return validateRule{}, err
+	}
+	var b []byte
+	inline, hasInline := config.Attrs["schema"]
+	path, hasPath := config.Attrs["path"]
+	if hasInline == hasPath {
+		return validateRule{}, errors.New(fmt.Sprintf("<schema %s> requires either schema or path", config.Args))
+	}
+	if hasInline {
+		b = []byte(inline)
+	} else {
+		b, err = ioutil.ReadFile(path)
+		if err != nil {
+			return validateRule{}, err
+		}
+	}
+	schema := &recordSchema{}
+	err = json.Unmarshal(b, schema)
+	if err != nil {
+		return validateRule{}, errors.New(fmt.Sprintf("Failed to parse the schema for %s: %s", config.Args, err.Error()))
+	}
+	err = schema.compile("record")
+	if err != nil {
+		return validateRule{}, err
+	}
+	return validateRule{compiled, schema}, nil
+}
+
+func (factory *ValidateFilterFactory) Name() string {
+	return "validate"
+}
+
+func (factory *ValidateFilterFactory) New(engine ik.Engine, config *ik.ConfigElement, next ik.Port) (ik.Filter, error) {
+	rules := make([]validateRule, 0)
+	for _, elem := range config.Elems {
+		if elem.Name != "schema" {
+			continue
+		}
+		rule, err := newValidateRule(elem)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("at least one <schema> is required")
+	}
+	return &ValidateFilter{
+		factory:  factory,
+		engine:   engine,
+		logger:   engine.Logger(),
+		next:     next,
+		rules:    rules,
+		errorTag: config.Attrs["error_tag"],
+	}, nil
+}
+
+func (factory *ValidateFilterFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&ValidateFilterFactory{})
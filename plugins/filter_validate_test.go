@@ -0,0 +1,143 @@
+package plugins
+
+import (
+	"encoding/json"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+const testRecordSchema = `{
+	"type": "object",
+	"required": ["message", "level"],
+	"properties": {
+		"message": {"type": "string", "maxLength": 10},
+		"level": {"enum": ["info", "error"]},
+		"status": {"type": "integer", "minimum": 100, "maximum": 599},
+		"latency": {"type": ["number", "null"]},
+		"tags": {"type": "array", "maxItems": 2, "items": {"type": "string", "pattern": "^[a-z]+$"}},
+		"user": {"type": "object", "additionalProperties": false, "properties": {"id": {"type": "string"}}}
+	}
+}`
+
+func Test_recordSchema_validate(t *testing.T) {
+	schema := &recordSchema{}
+	err := json.Unmarshal([]byte(testRecordSchema), schema)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = schema.compile("record")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	cases := []struct {
+		data     map[string]interface{}
+		expected string // "" for valid
+	}{
+		{map[string]interface{}{"message": "hi", "level": "info"}, ""},
+		{map[string]interface{}{"message": []byte("hi"), "level": "error", "status": uint64(200), "latency": 0.5, "tags": []interface{}{"a"}}, ""},
+		{map[string]interface{}{"message": "hi", "level": "info", "latency": nil, "user": map[string]interface{}{"id": "x"}}, ""},
+		{map[string]interface{}{"message": "hi"}, "record: level is required"},
+		{map[string]interface{}{"message": 1, "level": "info"}, "record.message: expected string, got integer"},
+		{map[string]interface{}{"message": "hello world", "level": "info"}, "record.message: 11 characters, more than 10"},
+		{map[string]interface{}{"message": "hi", "level": "debug"}, "record.level: debug is not one of [info error]"},
+		{map[string]interface{}{"message": "hi", "level": "info", "status": 200.5}, "record.status: expected integer, got number"},
+		{map[string]interface{}{"message": "hi", "level": "info", "status": "200"}, "record.status: expected integer, got string"},
+		{map[string]interface{}{"message": "hi", "level": "info", "status": 600}, "record.status: 600 is greater than 599"},
+		{map[string]interface{}{"message": "hi", "level": "info", "tags": []interface{}{"a", "B"}}, "record.tags[1]: does not match ^[a-z]+$"},
+		{map[string]interface{}{"message": "hi", "level": "info", "tags": []interface{}{"a", "b", "c"}}, "record.tags: 3 items, more than 2"},
+		{map[string]interface{}{"message": "hi", "level": "info", "user": map[string]interface{}{"id": "x", "name": "y"}}, "record.user: name is not allowed"},
+	}
+	for _, case_ := range cases {
+		err := schema.validate("record", case_.data)
+		message := ""
+		if err != nil {
+			message = err.Error()
+		}
+		if message != case_.expected {
+			t.Logf("%v: expected %q, got %q", case_.data, case_.expected, message)
+			t.Fail()
+		}
+	}
+}
+
+func Test_ValidateFilter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ik")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	schemaPath := path.Join(dir, "access.json")
+	err = ioutil.WriteFile(schemaPath, []byte(`{"required": ["status"]}`), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	port := &testPort{make(chan []ik.FluentRecordSet, 10)}
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	config := &ik.ConfigElement{
+		Attrs: map[string]string{"error_tag": "invalid"},
+		Elems: []*ik.ConfigElement{
+			{Name: "schema", Args: "app.access", Attrs: map[string]string{"path": schemaPath}},
+			{Name: "schema", Args: "app.**", Attrs: map[string]string{"schema": testRecordSchema}},
+		},
+	}
+	filter, err := (&ValidateFilterFactory{}).New(engine, config, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = filter.Emit([]ik.FluentRecordSet{
+		{Tag: "app.access", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"status": 200}}, {Timestamp: 2, Data: map[string]interface{}{}}}},
+		{Tag: "app.main", Records: []ik.TinyFluentRecord{{Timestamp: 3, Data: map[string]interface{}{"status": 200}}}},
+		{Tag: "other", Records: []ik.TinyFluentRecord{{Timestamp: 4, Data: map[string]interface{}{}}}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets := <-port.c
+	if len(recordSets) != 3 || recordSets[0].Tag != "app.access" || len(recordSets[0].Records) != 1 || recordSets[1].Tag != "other" || recordSets[2].Tag != "invalid" {
+		t.Fatalf("%v", recordSets)
+	}
+	violations := recordSets[2].Records
+	if len(violations) != 2 || violations[0].Timestamp != 2 || violations[0].Data["tag"] != "app.access" || violations[0].Data["error"] != "record: status is required" {
+		t.Fatalf("%v", violations)
+	}
+	if violations[1].Data["tag"] != "app.main" || !strings.HasPrefix(violations[1].Data["error"].(string), "record: message is required") {
+		t.Fatalf("%v", violations)
+	}
+
+	// without error_tag, the violations are dead letters
+	config.Attrs = map[string]string{}
+	filter, err = (&ValidateFilterFactory{}).New(engine, config, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = filter.Emit([]ik.FluentRecordSet{{Tag: "app.access", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{}}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(port.c) != 0 {
+		t.Fatalf("%v", <-port.c)
+	}
+}
+
+func Test_ValidateFilterFactory_New(t *testing.T) {
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	for _, elems := range [][]*ik.ConfigElement{
+		{},
+		{{Name: "schema", Attrs: map[string]string{"schema": "{}"}}},
+		{{Name: "schema", Args: "a", Attrs: map[string]string{}}},
+		{{Name: "schema", Args: "a", Attrs: map[string]string{"schema": "{"}}},
+		{{Name: "schema", Args: "a", Attrs: map[string]string{"schema": `{"type": "date"}`}}},
+		{{Name: "schema", Args: "a", Attrs: map[string]string{"schema": `{"properties": {"a": {"pattern": "("}}}`}}},
+		{{Name: "schema", Args: "a", Attrs: map[string]string{"path": "/nonexistent"}}},
+	} {
+		_, err := (&ValidateFilterFactory{}).New(engine, &ik.ConfigElement{Attrs: map[string]string{}, Elems: elems}, nil)
+		if err == nil {
+			t.Logf("%v accepted", elems)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package plugins
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/ugorji/go/codec"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// fluentdBufferChunk is a chunk file left by buf_file of fluentd.  v1 names
+// a chunk by its state and id, e.g. buffer.b5a2c1d3e4f.log, and keeps the
+// tag in a .meta file next to it.  v0.12 puts the key of the chunk, which is
+// the tag unless the output slices by time, before them, e.g.
+// buffer.app.access.q5a2c1d3e4f.log.
+type fluentdBufferChunk struct {
+	path     string
+	metaPath string
+	tag      string
+	queued   bool
+	modTime  int64
+}
+
+type fluentdBufferChunks []*fluentdBufferChunk
+
+var fluentdBufferChunkRegExp = regexp.MustCompile(`^(?:(.*)\.)?([bq])[0-9a-f]+$`)
+
+// the header of the .meta files written by fluentd 1.x
+const fluentdBufferMetaHeader = "\xc1\x00"
+
+func (chunks fluentdBufferChunks) Len() int {
+	return len(chunks)
+}
+
+func (chunks fluentdBufferChunks) Less(i, j int) bool {
+	if chunks[i].queued != chunks[j].queued {
+		return chunks[i].queued
+	}
+	return chunks[i].modTime < chunks[j].modTime
+}
+
+func (chunks fluentdBufferChunks) Swap(i, j int) {
+	chunks[i], chunks[j] = chunks[j], chunks[i]
+}
+
+func newFluentdCodec() *codec.MsgpackHandle {
+	_codec := &codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
+	return _codec
+}
+
+func readFluentdBufferMeta(path string, _codec *codec.MsgpackHandle) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	header, err := reader.Peek(len(fluentdBufferMetaHeader))
+	if err == nil && string(header) == fluentdBufferMetaHeader {
+		// followed by the length of the metadata
+		_, err = reader.Discard(len(fluentdBufferMetaHeader) + 4)
+		if err != nil {
+			return "", err
+		}
+	}
+	meta := map[string]interface{}{}
+	err = codec.NewDecoder(reader, _codec).Decode(&meta)
+	if err != nil {
+		return "", err
+	}
+	switch tag := meta["tag"].(type) {
+	case []byte:
+		return string(tag), nil
+	case string:
+		return tag, nil
+	}
+	return "", nil
+}
+
+// scanFluentdBuffer lists the chunks at path, given in the same way as
+// the path of buf_file, queued ones first, each in the order written.
+func scanFluentdBuffer(path string) (fluentdBufferChunks, error) {
+	var prefix, suffix string
+	pos := strings.Index(path, "*")
+	if pos >= 0 {
+		prefix = path[0:pos]
+		suffix = path[pos+1:]
+	} else {
+		prefix = path + "."
+		suffix = ".log"
+	}
+	paths, err := filepath.Glob(prefix + "*" + suffix)
+	if err != nil {
+		return nil, err
+	}
+	retval := fluentdBufferChunks{}
+	for _, path_ := range paths {
+		if len(path_) < len(prefix)+len(suffix) {
+			continue
+		}
+		m := fluentdBufferChunkRegExp.FindStringSubmatch(path_[len(prefix) : len(path_)-len(suffix)])
+		if m == nil {
+			continue
+		}
+		info, err := os.Stat(path_)
+		if err != nil {
+			return nil, err
+		}
+		chunk := &fluentdBufferChunk{
+			path:    path_,
+			queued:  m[2] == "q",
+			modTime: info.ModTime().UnixNano(),
+		}
+		if m[1] != "" {
+			chunk.tag, err = url.QueryUnescape(m[1])
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			chunk.metaPath = path_ + ".meta"
+		}
+		retval = append(retval, chunk)
+	}
+	sort.Sort(retval)
+	return retval, nil
+}
+
+// normalizeFluentdTime turns the EventTime of fluentd, which is the
+// extension type 0 holding the seconds and the nanoseconds, into seconds.
+func normalizeFluentdTime(timestamp interface{}) interface{} {
+	switch timestamp_ := timestamp.(type) {
+	case int64:
+		return uint64(timestamp_)
+	case codec.RawExt:
+		if timestamp_.Tag == 0 && len(timestamp_.Data) == 8 {
+			return uint64(binary.BigEndian.Uint32(timestamp_.Data[0:4]))
+		}
+	}
+	return timestamp
+}
+
+// readFluentdBufferChunk reads the [time, record] entries of a chunk
+// written in msgpack.  A chunk of an output formatting records otherwise
+// cannot be read.
+func readFluentdBufferChunk(chunk *fluentdBufferChunk, _codec *codec.MsgpackHandle) (ik.FluentRecordSet, error) {
+	file, err := os.Open(chunk.path)
+	if err != nil {
+		return ik.FluentRecordSet{}, err
+	}
+	defer file.Close()
+	dec := codec.NewDecoder(bufio.NewReader(file), _codec)
+	entries := []interface{}{}
+	for {
+		entry := []interface{}{}
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return ik.FluentRecordSet{}, err
+		}
+		if len(entry) != 2 {
+			return ik.FluentRecordSet{}, errors.New("unexpected entry")
+		}
+		entry[0] = normalizeFluentdTime(entry[0])
+		entries = append(entries, entry)
+	}
+	return decodeRecordSet([]byte(chunk.tag), entries)
+}
+
+// importFluentdBuffer moves the records in the buffer of fluentd at path
+// into the journals, removing each chunk once its records are written.  A
+// chunk which cannot be read is left where it is.  The records are tagged
+// with tag if it is given.
+func (buffer *bufferedOutput) importFluentdBuffer(path string, tag string) error {
+	_codec := newFluentdCodec()
+	chunks, err := scanFluentdBuffer(path)
+	if err != nil {
+		return err
+	}
+	for _, chunk := range chunks {
+		if tag != "" {
+			chunk.tag = tag
+		} else if chunk.metaPath != "" {
+			chunk.tag, err = readFluentdBufferMeta(chunk.metaPath, _codec)
+			if err != nil {
+				buffer.logger.Error("failed to read fluentd buffer metadata %s: %s", chunk.metaPath, err.Error())
+				continue
+			}
+		}
+		recordSet, err := readFluentdBufferChunk(chunk, _codec)
+		if err != nil {
+			buffer.logger.Error("failed to read fluentd buffer chunk %s: %s", chunk.path, err.Error())
+			continue
+		}
+		err = buffer.slicer.Emit([]ik.FluentRecordSet{recordSet})
+		if err == nil {
+			err = buffer.sync()
+		}
+		if err != nil {
+			return err
+		}
+		err = os.Remove(chunk.path)
+		if err != nil {
+			return err
+		}
+		if chunk.metaPath != "" {
+			err = os.Remove(chunk.metaPath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		buffer.logger.Info("imported %d records from fluentd buffer chunk %s", len(recordSet.Records), chunk.path)
+	}
+	return nil
+}
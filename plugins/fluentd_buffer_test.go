@@ -0,0 +1,99 @@
+package plugins
+
+import (
+	"context"
+	"github.com/moriyoshi/ik"
+	"github.com/ugorji/go/codec"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+	"time"
+)
+
+func writeFluentdBufferFile(t *testing.T, path string, values ...interface{}) {
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer file.Close()
+	enc := codec.NewEncoder(file, newFluentdCodec())
+	for _, value := range values {
+		err = enc.Encode(value)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+}
+
+func Test_bufferedOutput_ImportFluentdBuffer(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	os.Mkdir(tempDir+"/fluentd", os.FileMode(0755))
+	// a chunk of v1 has its tag in the metadata, and one of v0.12 in its name
+	writeFluentdBufferFile(t, tempDir+"/fluentd/buffer.b5a2c1d3e4f.log",
+		[]interface{}{uint64(1), map[string]interface{}{"message": "a"}},
+		[]interface{}{uint64(2), map[string]interface{}{"message": "b"}},
+	)
+	writeFluentdBufferFile(t, tempDir+"/fluentd/buffer.b5a2c1d3e4f.log.meta",
+		map[string]interface{}{"tag": "app.v1", "seq": uint64(0)},
+	)
+	writeFluentdBufferFile(t, tempDir+"/fluentd/buffer.app%2Dold.q5a2c1d3e4e.log",
+		[]interface{}{uint64(3), map[string]interface{}{"message": "c"}},
+	)
+	ioutil.WriteFile(tempDir+"/fluentd/buffer.b5a2c1d3e50.log", []byte("formatted\n"), os.FileMode(0644))
+
+	delivered := make([]string, 0)
+	buffer, err := newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Minute,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+			fluentdBuffer:    tempDir + "/fluentd/buffer.*.log",
+		},
+		&testPacker{},
+		func(_ context.Context, subKey string, chunk ik.JournalChunk) error {
+			return readChunk(chunk, func(reader io.Reader) error {
+				b, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				delivered = append(delivered, subKey+":"+string(b))
+				return nil
+			})
+		},
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buffer.subKeyer = func(record ik.FluentRecord) string { return record.Tag }
+	err = buffer.importFluentdBuffer(buffer.fluentdBuffer, "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	buffer.flushExpired(time.Now().Add(time.Minute))
+	sort.Strings(delivered)
+	if len(delivered) != 2 || delivered[0] != "app-old:c" || delivered[1] != "app.v1:ab" {
+		t.Logf("%v", delivered)
+		t.Fail()
+	}
+	files, err := ioutil.ReadDir(tempDir + "/fluentd")
+	if err != nil {
+		t.FailNow()
+	}
+	// the chunk which is not in msgpack is left
+	if len(files) != 1 || files[0].Name() != "buffer.b5a2c1d3e50.log" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,30 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+)
+
+// newFormatter builds the formatter given by the <format> element of the
+// configuration.  Without one, the formatter of defaultType is configured
+// with the attributes of the configuration itself.
+func newFormatter(engine ik.Engine, config *ik.ConfigElement, defaultType string) (ik.Formatter, error) {
+	type_ := defaultType
+	formatConfig := config
+	for _, elem := range config.Elems {
+		if elem.Name == "format" {
+			type_ = elem.Attrs["type"]
+			formatConfig = elem
+		}
+	}
+	var factory ik.FormatterFactory
+	registry := engine.FormatterPluginRegistry()
+	if registry != nil {
+		factory = registry.LookupFormatterFactory(type_)
+	}
+	if factory == nil {
+		return nil, errors.New(fmt.Sprintf("Format `%s' is not supported", type_))
+	}
+	return factory(engine, formatConfig)
+}
@@ -0,0 +1,279 @@
+package plugins
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	gcpDefaultTokenURI    = "https://oauth2.googleapis.com/token"
+	gcpDefaultMetadataURL = "http://metadata.google.internal"
+)
+
+// gcpCredentialsFile is what a credentials file of either a service account
+// or a user authorized with gcloud has in it.
+type gcpCredentialsFile struct {
+	Type         string `json:"type"`
+	ProjectId    string `json:"project_id"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyId string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+	ClientId     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+	QuotaProject string `json:"quota_project_id"`
+}
+
+type gcpToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+	TokenType   string `json:"token_type"`
+}
+
+// gcpTokenSource obtains OAuth2 access tokens in one of the ways the Google
+// client libraries do, and caches them until shortly before they expire.
+type gcpTokenSource struct {
+	client     *http.Client
+	fetch      func(source *gcpTokenSource) (gcpToken, error)
+	projectId  string
+	value      string
+	expiration time.Time
+	mtx        sync.Mutex
+}
+
+func (source *gcpTokenSource) token() (string, error) {
+	source.mtx.Lock()
+	defer source.mtx.Unlock()
+	if source.value != "" && time.Now().Add(5*time.Minute).Before(source.expiration) {
+		return source.value, nil
+	}
+	token, err := source.fetch(source)
+	if err != nil {
+		return "", err
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no access token was given")
+	}
+	source.value = token.AccessToken
+	source.expiration = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	return source.value, nil
+}
+
+// project returns the project of the credentials, which the metadata server
+// tells along with the first token.
+func (source *gcpTokenSource) project() string {
+	source.mtx.Lock()
+	defer source.mtx.Unlock()
+	return source.projectId
+}
+
+func (source *gcpTokenSource) exchange(tokenURI string, form url.Values) (gcpToken, error) {
+	resp, err := source.client.PostForm(tokenURI, form)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gcpToken{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcpToken{}, errors.New(fmt.Sprintf("%s returned %s: %s", tokenURI, resp.Status, strings.TrimSpace(string(body))))
+	}
+	token := gcpToken{}
+	err = json.Unmarshal(body, &token)
+	return token, err
+}
+
+func parseGCPPrivateKey(s string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("no private key found in the credentials")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the private key of the credentials is not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// signGCPAssertion makes the JWT a service account asks for a token with.
+func signGCPAssertion(credentials *gcpCredentialsFile, key *rsa.PrivateKey, scope string, now time.Time) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": credentials.PrivateKeyId})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   credentials.ClientEmail,
+		"scope": scope,
+		"aud":   credentials.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func newGCPFileTokenSource(client *http.Client, path string, scope string) (*gcpTokenSource, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	credentials := &gcpCredentialsFile{}
+	err = json.Unmarshal(content, credentials)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("%s: %s", path, err.Error()))
+	}
+	if credentials.TokenURI == "" {
+		credentials.TokenURI = gcpDefaultTokenURI
+	}
+	source := &gcpTokenSource{client: client, projectId: credentials.ProjectId}
+	switch credentials.Type {
+	case "service_account":
+		key, err := parseGCPPrivateKey(credentials.PrivateKey)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("%s: %s", path, err.Error()))
+		}
+		source.fetch = func(source *gcpTokenSource) (gcpToken, error) {
+			assertion, err := signGCPAssertion(credentials, key, scope, time.Now())
+			if err != nil {
+				return gcpToken{}, err
+			}
+			return source.exchange(credentials.TokenURI, url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	case "authorized_user":
+		if source.projectId == "" {
+			source.projectId = credentials.QuotaProject
+		}
+		source.fetch = func(source *gcpTokenSource) (gcpToken, error) {
+			return source.exchange(credentials.TokenURI, url.Values{
+				"grant_type":    {"refresh_token"},
+				"client_id":     {credentials.ClientId},
+				"client_secret": {credentials.ClientSecret},
+				"refresh_token": {credentials.RefreshToken},
+			})
+		}
+	default:
+		return nil, errors.New(fmt.Sprintf("%s: unsupported type of credentials: %s", path, credentials.Type))
+	}
+	return source, nil
+}
+
+func gcpMetadataGet(client *http.Client, metadataURL string, path string) ([]byte, error) {
+	req, err := http.NewRequest("GET", metadataURL+"/computeMetadata/v1/"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("metadata server returned %s for %s", resp.Status, path))
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// newGCPMetadataTokenSource takes the tokens of the service account of the
+// instance from the metadata server, and the project from there too.
+func newGCPMetadataTokenSource(client *http.Client, metadataURL string) *gcpTokenSource {
+	return &gcpTokenSource{
+		client: client,
+		fetch: func(source *gcpTokenSource) (gcpToken, error) {
+			if source.projectId == "" {
+				projectId, err := gcpMetadataGet(source.client, metadataURL, "project/project-id")
+				if err != nil {
+					return gcpToken{}, err
+				}
+				source.projectId = strings.TrimSpace(string(projectId))
+			}
+			body, err := gcpMetadataGet(source.client, metadataURL, "instance/service-accounts/default/token")
+			if err != nil {
+				return gcpToken{}, err
+			}
+			token := gcpToken{}
+			err = json.Unmarshal(body, &token)
+			return token, err
+		},
+	}
+}
+
+// gcpWellKnownCredentialsPath is where gcloud auth application-default
+// login leaves the credentials.
+func gcpWellKnownCredentialsPath() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("APPDATA"), "gcloud", "application_default_credentials.json")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+}
+
+// newGCPTokenSource looks for the credentials in the order of the
+// application default credentials: credentials_file,
+// GOOGLE_APPLICATION_CREDENTIALS, the file gcloud leaves, and then the
+// metadata server, at metadata_endpoint or GCE_METADATA_HOST if given.
+func newGCPTokenSource(config *ik.ConfigElement, scope string) (*gcpTokenSource, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	path, ok := config.Attrs["credentials_file"]
+	if !ok {
+		path = os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	}
+	if path != "" {
+		return newGCPFileTokenSource(client, path, scope)
+	}
+	path = gcpWellKnownCredentialsPath()
+	if path != "" {
+		_, err := os.Stat(path)
+		if err == nil {
+			return newGCPFileTokenSource(client, path, scope)
+		}
+	}
+	metadataURL, ok := config.Attrs["metadata_endpoint"]
+	if !ok {
+		metadataURL = gcpDefaultMetadataURL
+		host := os.Getenv("GCE_METADATA_HOST")
+		if host != "" {
+			metadataURL = "http://" + host
+		}
+	}
+	return newGCPMetadataTokenSource(client, metadataURL), nil
+}
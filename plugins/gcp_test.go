@@ -0,0 +1,116 @@
+package plugins
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_newGCPFileTokenSource_serviceAccount(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	keyDER, _ := x509.MarshalPKCS8PrivateKey(key)
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests += 1
+		req.ParseForm()
+		if req.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(req.Form.Get("assertion"), ".")
+		if len(parts) != 3 {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		claims := make(map[string]interface{})
+		json.Unmarshal(claimsJSON, &claims)
+		if claims["iss"] != "ik@example.iam.gserviceaccount.com" || claims["scope"] != stackdriverScope || claims["aud"] != "http://"+req.Host+"/token" {
+			t.Errorf("unexpected claims: %v", claims)
+		}
+		resp.Write([]byte("{\"access_token\":\"token\",\"expires_in\":3600,\"token_type\":\"Bearer\"}"))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ik")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "credentials.json")
+	content, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"project_id":   "project",
+		"client_email": "ik@example.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+		"token_uri":    server.URL + "/token",
+	})
+	ioutil.WriteFile(path, content, 0600)
+	source, err := newGCPFileTokenSource(&http.Client{}, path, stackdriverScope)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if source.project() != "project" {
+		t.Fail()
+	}
+	for i := 0; i < 2; i++ {
+		token, err := source.token()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if token != "token" {
+			t.Fail()
+		}
+	}
+	if requests != 1 {
+		t.Fail()
+	}
+}
+
+func Test_newGCPMetadataTokenSource(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Metadata-Flavor") != "Google" {
+			resp.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch req.URL.Path {
+		case "/computeMetadata/v1/project/project-id":
+			resp.Write([]byte("project"))
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			resp.Write([]byte("{\"access_token\":\"token\",\"expires_in\":3600}"))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	source := newGCPMetadataTokenSource(&http.Client{Timeout: time.Second}, server.URL)
+	token, err := source.token()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if token != "token" || source.project() != "project" {
+		t.Fail()
+	}
+}
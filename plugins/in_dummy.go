@@ -0,0 +1,242 @@
+package plugins
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type DummyInput struct {
+	factory        *DummyInputFactory
+	port           ik.Port
+	logger         ik.Logger
+	tag            string
+	template       map[string]interface{}
+	rate           float64
+	rampTo         float64
+	rampDuration   time.Duration
+	sequenceKey    string
+	cardinalityKey string
+	cardinality    int64
+	payloadKey     string
+	payload        string
+	sequence       int64
+	budget         float64
+	startedAt      time.Time
+	lastRunAt      time.Time
+	clock          ik.Clock
+	ticker         ik.Ticker
+	cancel         chan bool
+}
+
+type DummyInputFactory struct {
+}
+
+func (input *DummyInput) Factory() ik.Plugin {
+	return input.factory
+}
+
+func (input *DummyInput) Port() ik.Port {
+	return input.port
+}
+
+// rateAt returns the number of records per second to generate at the given
+// time since the start, ramping linearly from rate to ramp_to over
+// ramp_duration.
+func (input *DummyInput) rateAt(elapsed time.Duration) float64 {
+	if input.rampDuration <= 0 {
+		return input.rate
+	}
+	if elapsed >= input.rampDuration {
+		return input.rampTo
+	}
+	return input.rate + (input.rampTo-input.rate)*elapsed.Seconds()/input.rampDuration.Seconds()
+}
+
+func (input *DummyInput) generate(n int, now time.Time) []ik.TinyFluentRecord {
+	records := make([]ik.TinyFluentRecord, n)
+	for i := 0; i < n; i += 1 {
+		data := make(map[string]interface{}, len(input.template)+3)
+		for k, v := range input.template {
+			data[k] = v
+		}
+		data[input.sequenceKey] = input.sequence
+		if input.cardinality > 0 {
+			data[input.cardinalityKey] = "key" + strconv.FormatInt(input.sequence%input.cardinality, 10)
+		}
+		if input.payload != "" {
+			data[input.payloadKey] = input.payload
+		}
+		input.sequence += 1
+		records[i] = ik.TinyFluentRecord{Timestamp: uint64(now.Unix()), Data: data}
+	}
+	return records
+}
+
+// runOnce emits as many records as the rate allows for the time passed
+// since the previous run, carrying the fraction over to the next one.
+func (input *DummyInput) runOnce() error {
+	now := input.clock.Now()
+	if input.startedAt.IsZero() {
+		input.startedAt = now
+		input.lastRunAt = now
+	}
+	input.budget += input.rateAt(now.Sub(input.startedAt)) * now.Sub(input.lastRunAt).Seconds()
+	input.lastRunAt = now
+	n := int(input.budget)
+	if n <= 0 {
+		return nil
+	}
+	input.budget -= float64(n)
+	return input.port.Emit([]ik.FluentRecordSet{{Tag: input.tag, Records: input.generate(n, now)}})
+}
+
+func (input *DummyInput) Run() error {
+	select {
+	case <-input.cancel:
+		return nil
+	case <-input.ticker.C():
+	}
+	err := input.runOnce()
+	if err != nil {
+		input.logger.Error("%s", err.Error())
+	}
+	return ik.Continue
+}
+
+func (input *DummyInput) Shutdown() error {
+	input.ticker.Stop()
+	input.cancel <- true
+	return nil
+}
+
+func (input *DummyInput) Dispose() {
+	input.Shutdown()
+}
+
+func (factory *DummyInputFactory) Name() string {
+	return "dummy"
+}
+
+func parseDummyRate(name string, s string) (float64, error) {
+	rate, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, err
+	}
+	if rate < 0 {
+		return 0, errors.New(fmt.Sprintf("invalid %s: %s", name, s))
+	}
+	return rate, nil
+}
+
+func (factory *DummyInputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Input, error) {
+	tag, ok := config.Attrs["tag"]
+	if !ok {
+		return nil, errors.New("required attribute `tag' is not specified")
+	}
+	template := map[string]interface{}{"message": "dummy"}
+	templateStr, ok := config.Attrs["dummy"]
+	if ok {
+		template = nil
+		err := json.Unmarshal([]byte(templateStr), &template)
+		if err != nil {
+			return nil, errors.New("invalid dummy: " + err.Error())
+		}
+	}
+	rate := float64(1)
+	rateStr, ok := config.Attrs["rate"]
+	if ok {
+		var err error
+		rate, err = parseDummyRate("rate", rateStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rampTo := rate
+	rampToStr, ok := config.Attrs["ramp_to"]
+	if ok {
+		var err error
+		rampTo, err = parseDummyRate("ramp_to", rampToStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rampDuration := time.Duration(0)
+	rampDurationStr, ok := config.Attrs["ramp_duration"]
+	if ok {
+		var err error
+		rampDuration, err = time.ParseDuration(rampDurationStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sequenceKey, ok := config.Attrs["sequence_key"]
+	if !ok {
+		sequenceKey = "seq"
+	}
+	cardinalityKey, ok := config.Attrs["cardinality_key"]
+	if !ok {
+		cardinalityKey = "key"
+	}
+	cardinality := int64(0)
+	cardinalityStr, ok := config.Attrs["cardinality"]
+	if ok {
+		var err error
+		cardinality, err = strconv.ParseInt(cardinalityStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	payloadKey, ok := config.Attrs["payload_key"]
+	if !ok {
+		payloadKey = "payload"
+	}
+	size := int64(0)
+	sizeStr, ok := config.Attrs["size"]
+	if ok {
+		var err error
+		size, err = ik.ParseCapacityString(sizeStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	interval := time.Duration(100 * time.Millisecond)
+	intervalStr, ok := config.Attrs["interval"]
+	if ok {
+		var err error
+		interval, err = time.ParseDuration(intervalStr)
+		if err != nil {
+			return nil, err
+		}
+		if interval <= 0 {
+			return nil, errors.New("invalid interval: " + intervalStr)
+		}
+	}
+	return &DummyInput{
+		factory:        factory,
+		port:           engine.DefaultPort(),
+		logger:         engine.Logger(),
+		tag:            tag,
+		template:       template,
+		rate:           rate,
+		rampTo:         rampTo,
+		rampDuration:   rampDuration,
+		sequenceKey:    sequenceKey,
+		cardinalityKey: cardinalityKey,
+		cardinality:    cardinality,
+		payloadKey:     payloadKey,
+		payload:        strings.Repeat("x", int(size)),
+		clock:          engine.Clock(),
+		ticker:         engine.Clock().NewTicker(interval),
+		cancel:         make(chan bool),
+	}, nil
+}
+
+func (factory *DummyInputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&DummyInputFactory{})
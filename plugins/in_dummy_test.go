@@ -0,0 +1,63 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/iktest"
+	"testing"
+	"time"
+)
+
+func Test_DummyInput_runOnce(t *testing.T) {
+	now := time.Unix(1000, 0)
+	port := &testPort{make(chan []ik.FluentRecordSet, 1)}
+	input := &DummyInput{
+		port:           port,
+		tag:            "dummy",
+		template:       map[string]interface{}{"message": "dummy"},
+		rate:           10,
+		rampTo:         30,
+		rampDuration:   10 * time.Second,
+		sequenceKey:    "seq",
+		cardinalityKey: "key",
+		cardinality:    3,
+		payloadKey:     "payload",
+		payload:        "xxxx",
+		clock:          newTestClock(func() time.Time { return now }),
+	}
+	input.runOnce()
+	now = now.Add(250 * time.Millisecond)
+	input.runOnce()
+	recordSets := <-port.c
+	// 10.5 records per second for a quarter of a second
+	records := recordSets[0].Records
+	if len(records) != 2 || input.budget != 0.625 {
+		t.Fatalf("%d %f", len(records), input.budget)
+	}
+	if records[1].Data["seq"] != int64(1) || records[1].Data["key"] != "key1" || records[1].Data["payload"] != "xxxx" || records[1].Data["message"] != "dummy" {
+		t.Fail()
+	}
+	if input.rateAt(5*time.Second) != 20 || input.rateAt(time.Minute) != 30 {
+		t.Fail()
+	}
+}
+
+func Test_DummyInput_clock(t *testing.T) {
+	engine := iktest.NewEngine(t)
+	input, err := (&DummyInputFactory{}).New(engine, &ik.ConfigElement{Attrs: map[string]string{"tag": "dummy", "rate": "10", "interval": "1s"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the ticker fires as the clock is moved, with nothing to sleep for
+	engine.FakeClock().Advance(time.Second)
+	if input.Run() != ik.Continue {
+		t.Fail()
+	}
+	engine.FakeClock().Advance(time.Second)
+	if input.Run() != ik.Continue {
+		t.Fail()
+	}
+	iktest.ExpectRecordCount(t, engine.Port().RecordSets(), 10)
+	if iktest.Records(engine.Port().RecordSets(), "dummy")[0].Timestamp != 2 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,360 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"github.com/pbnjay/strptime"
+	"github.com/ugorji/go/codec"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type ExecInput struct {
+	factory       *ExecInputFactory
+	port          ik.Port
+	logger        ik.Logger
+	command       string
+	format        string
+	keys          []string
+	tag           string
+	tagKey        string
+	timeKey       string
+	timeFormat    string
+	timeout       time.Duration
+	maxOutputSize int64
+	clock         ik.Clock
+	ticker        ik.Ticker
+	kick          chan bool
+	cancel        chan bool
+}
+
+type ExecInputFactory struct {
+}
+
+func (input *ExecInput) Factory() ik.Plugin {
+	return input.factory
+}
+
+func (input *ExecInput) Port() ik.Port {
+	return input.port
+}
+
+func (input *ExecInput) parseTSV(data []byte) ([]map[string]interface{}, error) {
+	retval := make([]map[string]interface{}, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		record := make(map[string]interface{}, len(input.keys))
+		for i, field := range strings.Split(line, "\t") {
+			if i >= len(input.keys) {
+				break
+			}
+			record[input.keys[i]] = field
+		}
+		retval = append(retval, record)
+	}
+	return retval, scanner.Err()
+}
+
+func (input *ExecInput) parseJSON(data []byte) ([]map[string]interface{}, error) {
+	retval := make([]map[string]interface{}, 0)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	for {
+		var record map[string]interface{}
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return retval, err
+		}
+		retval = append(retval, record)
+	}
+	return retval, nil
+}
+
+func (input *ExecInput) parseMsgpack(data []byte) ([]map[string]interface{}, error) {
+	retval := make([]map[string]interface{}, 0)
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
+	decoder := codec.NewDecoder(bytes.NewReader(data), &_codec)
+	for {
+		var record map[string]interface{}
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return retval, err
+		}
+		coerceInPlace(record)
+		retval = append(retval, record)
+	}
+	return retval, nil
+}
+
+func (input *ExecInput) parseTime(value interface{}) (time.Time, error) {
+	switch value_ := value.(type) {
+	case float64:
+		return time.Unix(int64(value_), 0), nil
+	case int64:
+		return time.Unix(value_, 0), nil
+	case uint64:
+		return time.Unix(int64(value_), 0), nil
+	case string:
+		if input.timeFormat != "" {
+			return strptime.Parse(value_, input.timeFormat)
+		}
+		seconds, err := strconv.ParseInt(value_, 10, 64)
+		if err == nil {
+			return time.Unix(seconds, 0), nil
+		}
+		return time.Parse(time.RFC3339, value_)
+	}
+	return time.Time{}, errors.New(fmt.Sprintf("unsupported time value: %v", value))
+}
+
+// buildRecordSets groups the records by tag, taking the tag and the time
+// from the fields named by tag_key and time_key if given.
+func (input *ExecInput) buildRecordSets(records []map[string]interface{}) []ik.FluentRecordSet {
+	now := input.clock.Now()
+	records_ := make([]ik.FluentRecord, 0, len(records))
+	for _, record := range records {
+		tag := input.tag
+		if input.tagKey != "" {
+			value, ok := record[input.tagKey]
+			if ok {
+				tag = fmt.Sprintf("%v", value)
+				delete(record, input.tagKey)
+			}
+		}
+		timestamp := now
+		if input.timeKey != "" {
+			value, ok := record[input.timeKey]
+			if ok {
+				timestamp_, err := input.parseTime(value)
+				if err != nil {
+					input.logger.Warning("%s", err.Error())
+				} else {
+					timestamp = timestamp_
+					delete(record, input.timeKey)
+				}
+			}
+		}
+		records_ = append(records_, ik.FluentRecord{
+			Tag:       tag,
+			Timestamp: uint64(timestamp.Unix()),
+			Data:      record,
+		})
+	}
+	return ik.GroupByTag(records_)
+}
+
+// maxStderrSize is how much of the standard error of the command is kept
+// for the error message.
+const maxStderrSize = 4096
+
+// cappedBuffer keeps the first bytes written to it up to the limit and
+// silently drops the rest.
+type cappedBuffer struct {
+	buffer bytes.Buffer
+	limit  int
+}
+
+func (buffer *cappedBuffer) Write(p []byte) (int, error) {
+	room := buffer.limit - buffer.buffer.Len()
+	if room > len(p) {
+		room = len(p)
+	}
+	if room > 0 {
+		buffer.buffer.Write(p[:room])
+	}
+	return len(p), nil
+}
+
+func (buffer *cappedBuffer) String() string {
+	return buffer.buffer.String()
+}
+
+// execute runs the command and returns its output.  The command is killed
+// when it runs longer than the timeout or writes more than max_output_size
+// bytes, in which case its output is discarded.
+func (input *ExecInput) execute() ([]byte, error) {
+	cmd := newShellCommand(input.command)
+	stderr := &cappedBuffer{limit: maxStderrSize}
+	cmd.Stderr = stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	timer := time.AfterFunc(input.timeout, func() {
+		killCommand(cmd)
+	})
+	output := &bytes.Buffer{}
+	_, err = io.Copy(output, io.LimitReader(stdout, input.maxOutputSize+1))
+	if err == nil && int64(output.Len()) > input.maxOutputSize {
+		timer.Stop()
+		killCommand(cmd)
+		cmd.Wait()
+		return nil, errors.New(fmt.Sprintf("`%s' wrote more than %d bytes", input.command, input.maxOutputSize))
+	}
+	err_ := cmd.Wait()
+	if !timer.Stop() {
+		return nil, errors.New(fmt.Sprintf("`%s' timed out after %s", input.command, input.timeout.String()))
+	}
+	if err == nil {
+		err = err_
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("`%s' failed: %s: %s", input.command, err.Error(), strings.TrimSpace(stderr.String())))
+	}
+	return output.Bytes(), nil
+}
+
+func (input *ExecInput) runOnce() error {
+	output, err := input.execute()
+	if err != nil {
+		return err
+	}
+	var records []map[string]interface{}
+	switch input.format {
+	case "json":
+		records, err = input.parseJSON(output)
+	case "msgpack":
+		records, err = input.parseMsgpack(output)
+	default:
+		records, err = input.parseTSV(output)
+	}
+	if err != nil {
+		// emit whatever has been parsed before the error
+		input.logger.Error("failed to parse the output of `%s': %s", input.command, err.Error())
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return input.port.Emit(input.buildRecordSets(records))
+}
+
+func (input *ExecInput) Run() error {
+	select {
+	case <-input.cancel:
+		return nil
+	case <-input.kick:
+	case <-input.ticker.C():
+	}
+	err := input.runOnce()
+	if err != nil {
+		input.logger.Error("%s", err.Error())
+	}
+	return ik.Continue
+}
+
+func (input *ExecInput) Shutdown() error {
+	input.ticker.Stop()
+	input.cancel <- true
+	return nil
+}
+
+func (input *ExecInput) Dispose() {
+	input.Shutdown()
+}
+
+func (factory *ExecInputFactory) Name() string {
+	return "exec"
+}
+
+func (factory *ExecInputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Input, error) {
+	command, ok := config.Attrs["command"]
+	if !ok {
+		return nil, errors.New("required attribute `command' is not specified")
+	}
+	format, ok := config.Attrs["format"]
+	if !ok {
+		format = "tsv"
+	}
+	var keys []string
+	switch format {
+	case "tsv":
+		keysStr, ok := config.Attrs["keys"]
+		if !ok {
+			return nil, errors.New("required attribute `keys' is not specified")
+		}
+		keys = splitAndStrip(keysStr)
+	case "json", "msgpack":
+	default:
+		return nil, errors.New("unsupported format: " + format)
+	}
+	tag, ok := config.Attrs["tag"]
+	tagKey := config.Attrs["tag_key"]
+	if !ok && tagKey == "" {
+		return nil, errors.New("required attribute `tag' is not specified")
+	}
+	runInterval := time.Duration(60 * time.Second)
+	runIntervalStr, ok := config.Attrs["run_interval"]
+	if ok {
+		var err error
+		runInterval, err = time.ParseDuration(runIntervalStr)
+		if err != nil {
+			return nil, err
+		}
+		if runInterval <= 0 {
+			return nil, errors.New("invalid run_interval: " + runIntervalStr)
+		}
+	}
+	timeout := runInterval
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	maxOutputSize := int64(10 * 1024 * 1024)
+	maxOutputSizeStr, ok := config.Attrs["max_output_size"]
+	if ok {
+		var err error
+		maxOutputSize, err = ik.ParseCapacityString(maxOutputSizeStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	kick := make(chan bool, 1)
+	kick <- true
+	return &ExecInput{
+		factory:       factory,
+		port:          engine.DefaultPort(),
+		logger:        engine.Logger(),
+		command:       command,
+		format:        format,
+		keys:          keys,
+		tag:           tag,
+		tagKey:        tagKey,
+		timeKey:       config.Attrs["time_key"],
+		timeFormat:    config.Attrs["time_format"],
+		timeout:       timeout,
+		maxOutputSize: maxOutputSize,
+		clock:         engine.Clock(),
+		ticker:        engine.Clock().NewTicker(runInterval),
+		kick:          kick,
+		cancel:        make(chan bool),
+	}, nil
+}
+
+func (factory *ExecInputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&ExecInputFactory{})
@@ -0,0 +1,96 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestExecInput(t *testing.T, command string, port ik.Port) *ExecInput {
+	return &ExecInput{
+		logger:        &testLogger{t},
+		port:          port,
+		command:       command,
+		format:        "tsv",
+		keys:          []string{"tag", "time", "value"},
+		tag:           "exec",
+		tagKey:        "tag",
+		timeKey:       "time",
+		timeout:       5 * time.Second,
+		maxOutputSize: 1024,
+		clock:         newTestClock(func() time.Time { return time.Unix(1000, 0) }),
+	}
+}
+
+func Test_ExecInput_runOnce(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on printf")
+	}
+	port := &testPort{make(chan []ik.FluentRecordSet, 1)}
+	input := newTestExecInput(t, "printf 'a\\t1400000000\\tx\\nb\\t\\ty\\na\\t1400000001\\tz\\n'", port)
+	err := input.runOnce()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordSets := <-port.c
+	if len(recordSets) != 2 || recordSets[0].Tag != "a" || recordSets[1].Tag != "b" {
+		t.Logf("%v", recordSets)
+		t.FailNow()
+	}
+	if len(recordSets[0].Records) != 2 || recordSets[0].Records[1].Timestamp != 1400000001 || recordSets[0].Records[1].Data["value"] != "z" {
+		t.Fail()
+	}
+	// an unparsable time falls back to the current time
+	if recordSets[1].Records[0].Timestamp != 1000 {
+		t.Fail()
+	}
+}
+
+func Test_ExecInput_execute_limits(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the unix shell")
+	}
+	input := newTestExecInput(t, "head -c 2048 /dev/zero", nil)
+	_, err := input.execute()
+	if err == nil {
+		t.Fail()
+	}
+	input = newTestExecInput(t, "exec sleep 5", nil)
+	input.timeout = 100 * time.Millisecond
+	_, err = input.execute()
+	if err == nil {
+		t.Fail()
+	}
+	// the children of the shell hold the output open until they are killed
+	input = newTestExecInput(t, "sleep 5 & sleep 5", nil)
+	input.timeout = 100 * time.Millisecond
+	start := time.Now()
+	_, err = input.execute()
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fail()
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Logf("took %s", time.Since(start))
+		t.Fail()
+	}
+}
+
+func Test_ExecInput_execute_stderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("relies on the unix shell")
+	}
+	input := newTestExecInput(t, "head -c 65536 /dev/zero | tr '\\0' x >&2; exit 1", nil)
+	_, err := input.execute()
+	if err == nil {
+		t.FailNow()
+	}
+	if len(err.Error()) > maxStderrSize+256 {
+		t.Logf("%d bytes", len(err.Error()))
+		t.Fail()
+	}
+	if !strings.Contains(err.Error(), "xxxx") {
+		t.Fail()
+	}
+}
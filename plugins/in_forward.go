@@ -9,11 +9,13 @@ import (
 	"net"
 	"reflect"
 	"strconv"
+	"strings"
 	"sync/atomic"
 )
 
 type forwardClient struct {
 	input  *ForwardInput
+	port   ik.Port
 	logger ik.Logger
 	conn   net.Conn
 	codec  *codec.MsgpackHandle
@@ -22,14 +24,17 @@ type forwardClient struct {
 }
 
 type ForwardInput struct {
-	factory  *ForwardInputFactory
-	port     ik.Port
-	logger   ik.Logger
-	bind     string
-	listener net.Listener
-	codec    *codec.MsgpackHandle
-	clients  map[net.Conn]*forwardClient
-	entries  int64
+	factory        *ForwardInputFactory
+	port           ik.Port
+	logger         ik.Logger
+	engine         ik.Engine
+	bind           string
+	listener       net.Listener
+	heartbeat      net.PacketConn
+	codec          *codec.MsgpackHandle
+	clients        map[net.Conn]*forwardClient
+	entries        int64
+	chunkSizeLimit int64
 }
 
 type EntryCountTopic struct{}
@@ -54,7 +59,7 @@ func decodeRecordSet(tag []byte, entries []interface{}) (ik.FluentRecordSet, err
 	records := make([]ik.TinyFluentRecord, len(entries))
 	for i, _entry := range entries {
 		entry, ok := _entry.([]interface{})
-		if !ok {
+		if !ok || len(entry) < 2 {
 			return ik.FluentRecordSet{}, errors.New("Failed to decode recordSet")
 		}
 		timestamp, ok := entry[0].(uint64)
@@ -77,24 +82,94 @@ func decodeRecordSet(tag []byte, entries []interface{}) (ik.FluentRecordSet, err
 	}, nil
 }
 
-func (c *forwardClient) decodeEntries() ([]ik.FluentRecordSet, error) {
-	v := []interface{}{nil, nil, nil}
+// forwardOption returns the value of the option in the option map at the
+// given position of the message, if any.
+func forwardOption(v []interface{}, i int, name string) string {
+	if len(v) <= i {
+		return ""
+	}
+	option, ok := v[i].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+	switch value := option[name].(type) {
+	case []byte:
+		return string(value)
+	case string:
+		return value
+	}
+	return ""
+}
+
+// decodeEntries decodes a message, returning the records in it and the
+// chunk id to ack if the sender asked for an ack.
+func (c *forwardClient) decodeEntries() ([]ik.FluentRecordSet, string, error) {
+	v := []interface{}{}
 	err := c.dec.Decode(&v)
 	if err != nil {
-		return nil, err
+		return nil, "", err
+	}
+	if c.input.oversized(v) {
+		return nil, forwardOption(v, 2, "chunk"), nil
+	}
+	recordSets, chunk, err := decodeForwardMessage(c.codec, v)
+	if err != nil {
+		return nil, "", err
+	}
+	atomic.AddInt64(&c.input.entries, int64(len(recordSets)))
+	return recordSets, chunk, nil
+}
+
+// oversized tells whether the packed entries of a message exceed
+// chunk_size_limit, handing a record of their size over to the dead-letter
+// queue in place of them if so.  The message is acked all the same, as
+// sending it again would not make it any smaller.
+func (input *ForwardInput) oversized(v []interface{}) bool {
+	if input.chunkSizeLimit <= 0 || len(v) < 2 {
+		return false
+	}
+	entries, ok := v[1].([]byte)
+	if !ok || int64(len(entries)) <= input.chunkSizeLimit {
+		return false
+	}
+	tag, _ := v[0].([]byte)
+	cause := errors.New(fmt.Sprintf("chunk of %d bytes exceeds chunk_size_limit of %d bytes", len(entries), input.chunkSizeLimit))
+	input.logger.Warning("dropped a chunk of %s: %s", string(tag), cause.Error())
+	if input.engine != nil {
+		input.engine.DeadLetter(input, cause, []ik.FluentRecordSet{{
+			Tag: string(tag),
+			Records: []ik.TinyFluentRecord{{
+				Timestamp: uint64(input.engine.Clock().Now().Unix()),
+				Data:      map[string]interface{}{"size": int64(len(entries))},
+			}},
+		}})
+	}
+	return true
+}
+
+// decodeForwardMessage takes the records and the chunk id out of a message
+// in any of the forms of the forward protocol.
+func decodeForwardMessage(_codec *codec.MsgpackHandle, v []interface{}) ([]ik.FluentRecordSet, string, error) {
+	if len(v) < 2 {
+		return nil, "", errors.New("Unexpected payload format")
 	}
 	tag, ok := v[0].([]byte)
 	if !ok {
-		return nil, errors.New("Failed to decode tag field")
+		return nil, "", errors.New("Failed to decode tag field")
 	}
 
 	var retval []ik.FluentRecordSet
+	chunk := ""
 	switch timestamp_or_entries := v[1].(type) {
 	case uint64:
+		if len(v) < 3 {
+			return nil, "", errors.New("Unexpected payload format")
+		}
+		chunk = forwardOption(v, 3, "chunk")
 		timestamp := timestamp_or_entries
 		data, ok := v[2].(map[string]interface{})
 		if !ok {
-			return nil, errors.New(fmt.Sprintf("Failed to decode data field (got %t)", v[2]))
+			return nil, "", errors.New(fmt.Sprintf("Failed to decode data field (got %t)", v[2]))
 		}
 		coerceInPlace(data)
 		retval = []ik.FluentRecordSet{
@@ -109,10 +184,14 @@ func (c *forwardClient) decodeEntries() ([]ik.FluentRecordSet, error) {
 			},
 		}
 	case float64:
+		if len(v) < 3 {
+			return nil, "", errors.New("Unexpected payload format")
+		}
+		chunk = forwardOption(v, 3, "chunk")
 		timestamp := uint64(timestamp_or_entries)
 		data, ok := v[2].(map[string]interface{})
 		if !ok {
-			return nil, errors.New(fmt.Sprintf("Failed to decode data field (got %t)", v[2]))
+			return nil, "", errors.New(fmt.Sprintf("Failed to decode data field (got %t)", v[2]))
 		}
 		retval = []ik.FluentRecordSet{
 			{
@@ -127,39 +206,95 @@ func (c *forwardClient) decodeEntries() ([]ik.FluentRecordSet, error) {
 		}
 	case []interface{}:
 		if !ok {
-			return nil, errors.New("Unexpected payload format")
+			return nil, "", errors.New("Unexpected payload format")
 		}
+		chunk = forwardOption(v, 2, "chunk")
 		recordSet, err := decodeRecordSet(tag, timestamp_or_entries)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 		retval = []ik.FluentRecordSet{recordSet}
 	case []byte:
+		chunk = forwardOption(v, 2, "chunk")
+		checksum := forwardOption(v, 2, "checksum")
+		if checksum != "" {
+			err := verifyChunkDigest(checksum, timestamp_or_entries)
+			if err != nil {
+				return nil, "", err
+			}
+		}
+		// CompressedPackedForward, where the checksum is that of the
+		// entries as they were sent
+		packed := timestamp_or_entries
+		compressed := forwardOption(v, 2, "compressed")
+		switch compressed {
+		case "", "text":
+		case "gzip":
+			var err error
+			packed, err = gzipDecompress(timestamp_or_entries)
+			if err != nil {
+				return nil, "", errors.New("Failed to decompress entries: " + err.Error())
+			}
+		default:
+			return nil, "", errors.New("Unsupported compression: " + compressed)
+		}
+		// the entries are packed one after another
 		entries := make([]interface{}, 0)
-		err := codec.NewDecoderBytes(timestamp_or_entries, c.codec).Decode(&entries)
-		if err != nil {
-			return nil, err
+		dec := codec.NewDecoderBytes(packed, _codec)
+		for {
+			var entry interface{}
+			err := dec.Decode(&entry)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, "", err
+			}
+			entries = append(entries, entry)
 		}
 		recordSet, err := decodeRecordSet(tag, entries)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
+		recordSet.Packed = packed
 		retval = []ik.FluentRecordSet{recordSet}
 	default:
-		return nil, errors.New(fmt.Sprintf("Unknown type: %t", timestamp_or_entries))
+		return nil, "", errors.New(fmt.Sprintf("Unknown type: %t", timestamp_or_entries))
 	}
-	atomic.AddInt64(&c.input.entries, int64(len(retval)))
-	return retval, nil
+	return retval, chunk, nil
+}
+
+// ack tells the sender the chunk has been stored durably, which it waits
+// for before it discards the chunk on its side.
+func (c *forwardClient) ack(chunk string) error {
+	return c.enc.Encode(map[string]interface{}{"ack": chunk})
 }
 
 func handleInner(c *forwardClient) bool {
-	recordSets, err := c.decodeEntries()
+	recordSets, chunk, err := c.decodeEntries()
 	defer func() {
-		if len(recordSets) > 0 {
-			err_ := c.input.Port().Emit(recordSets)
+		if len(recordSets) == 0 {
+			if err == nil && chunk != "" {
+				err_ := c.ack(chunk)
+				if err_ != nil {
+					c.logger.Error("%s", err_.Error())
+				}
+			}
+			return
+		}
+		if chunk == "" {
+			err_ := c.port.Emit(recordSets)
 			if err_ != nil {
 				c.logger.Error("%s", err_.Error())
 			}
+			return
+		}
+		// left unacked on failure for the sender to send it again
+		err_ := ik.EmitDurably(c.port, recordSets)
+		if err_ == nil {
+			err_ = c.ack(chunk)
+		}
+		if err_ != nil {
+			c.logger.Error("%s", err_.Error())
 		}
 	}()
 	if err == nil {
@@ -182,6 +317,20 @@ func handleInner(c *forwardClient) bool {
 }
 
 func (c *forwardClient) handle() {
+	// a panic on what a client sent drops the connection, not the process
+	defer func() {
+		r := recover()
+		if r != nil {
+			panicked := ik.NewPanicked(r)
+			if c.input.engine != nil {
+				c.input.engine.ReportPanic(c.input, panicked)
+			} else {
+				c.logger.Critical("%s\n%s", panicked.Error(), string(panicked.Stack()))
+			}
+			c.conn.Close()
+			c.input.markDischarged(c)
+		}
+	}()
 	for handleInner(c) {
 	}
 	err := c.conn.Close()
@@ -194,6 +343,7 @@ func (c *forwardClient) handle() {
 func newForwardClient(input *ForwardInput, logger ik.Logger, conn net.Conn, _codec *codec.MsgpackHandle) *forwardClient {
 	c := &forwardClient{
 		input:  input,
+		port:   ik.PortForSource(input.Port(), conn.RemoteAddr().String()),
 		logger: logger,
 		conn:   conn,
 		codec:  _codec,
@@ -229,6 +379,9 @@ func (input *ForwardInput) Shutdown() error {
 			input.logger.Warning("Error during closing connection: %s", err.Error())
 		}
 	}
+	if input.heartbeat != nil {
+		input.heartbeat.Close()
+	}
 	return input.listener.Close()
 }
 
@@ -244,25 +397,55 @@ func (input *ForwardInput) markDischarged(c *forwardClient) {
 	delete(input.clients, c.conn)
 }
 
-func newForwardInput(factory *ForwardInputFactory, logger ik.Logger, engine ik.Engine, bind string, port ik.Port) (*ForwardInput, error) {
+// respondHeartbeats answers the UDP heartbeats of the forward protocol on
+// the port records are accepted at, by sending every datagram back.
+func (input *ForwardInput) respondHeartbeats() {
+	b := make([]byte, 1)
+	for {
+		_, addr, err := input.heartbeat.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		_, err = input.heartbeat.WriteTo([]byte{0}, addr)
+		if err != nil {
+			input.logger.Warning("failed to respond to the heartbeat from %s: %s", addr.String(), err.Error())
+		}
+	}
+}
+
+func newForwardInput(factory *ForwardInputFactory, logger ik.Logger, engine ik.Engine, address *ik.ListenAddress, port ik.Port) (*ForwardInput, error) {
 	_codec := codec.MsgpackHandle{}
 	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
 	_codec.RawToString = false
-	listener, err := net.Listen("tcp", bind)
+	listener, err := ik.ListenAt(address)
 	if err != nil {
 		logger.Warning("%s", err.Error())
 		return nil, err
 	}
-	return &ForwardInput{
+	input := &ForwardInput{
 		factory:  factory,
 		port:     port,
 		logger:   logger,
-		bind:     bind,
+		engine:   engine,
+		bind:     address.String(),
 		listener: listener,
 		codec:    &_codec,
 		clients:  make(map[net.Conn]*forwardClient),
 		entries:  0,
-	}, nil
+	}
+	// the records are accepted without the heartbeat if it cannot bind, and
+	// a unix domain socket has none
+	if address.Network == "unix" {
+		return input, nil
+	}
+	input.heartbeat, err = net.ListenPacket(strings.Replace(address.Network, "tcp", "udp", 1), listener.Addr().String())
+	if err != nil {
+		logger.Warning("UDP heartbeat is disabled: %s", err.Error())
+		input.heartbeat = nil
+	} else {
+		go input.respondHeartbeats()
+	}
+	return input, nil
 }
 
 func (factory *ForwardInputFactory) Name() string {
@@ -270,16 +453,23 @@ func (factory *ForwardInputFactory) Name() string {
 }
 
 func (factory *ForwardInputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Input, error) {
-	listen, ok := config.Attrs["listen"]
-	if !ok {
-		listen = ""
+	address, err := ik.ParseListenAddress(config, "listen", "24224")
+	if err != nil {
+		return nil, err
 	}
-	netPort, ok := config.Attrs["port"]
-	if !ok {
-		netPort = "24224"
+	input, err := newForwardInput(factory, engine.Logger(), engine, address, engine.DefaultPort())
+	if err != nil {
+		return nil, err
+	}
+	chunkSizeLimitStr, ok := config.Attrs["chunk_size_limit"]
+	if ok {
+		input.chunkSizeLimit, err = ik.ParseCapacityString(chunkSizeLimitStr)
+		if err != nil {
+			input.Dispose()
+			return nil, err
+		}
 	}
-	bind := listen + ":" + netPort
-	return newForwardInput(factory, engine.Logger(), engine, bind, engine.DefaultPort())
+	return input, nil
 }
 
 func (factory *ForwardInputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
@@ -0,0 +1,339 @@
+package plugins
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"github.com/ugorji/go/codec"
+	"io"
+	"net"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HTTPInput struct {
+	factory       *HTTPInputFactory
+	port          ik.Port
+	logger        ik.Logger
+	bind          string
+	listener      net.Listener
+	server        http.Server
+	ack           bool
+	batchSize     int
+	bodySizeLimit int64
+	timeKey       string
+	clock         ik.Clock
+}
+
+type HTTPInputFactory struct {
+}
+
+// httpRecordReader yields the records in a request body one by one, so
+// that a large body is never held in memory as a whole.
+type httpRecordReader func() (map[string]interface{}, error)
+
+func (input *HTTPInput) Factory() ik.Plugin {
+	return input.factory
+}
+
+func (input *HTTPInput) Port() ik.Port {
+	return input.port
+}
+
+// newJSONRecordReader reads either a single object, an array of objects or
+// a stream of objects.
+func newJSONRecordReader(reader io.Reader) httpRecordReader {
+	bufReader := bufio.NewReader(reader)
+	decoder := json.NewDecoder(bufReader)
+	inArray := false
+	first := true
+	return func() (map[string]interface{}, error) {
+		if first {
+			first = false
+			for {
+				c, err := bufReader.Peek(1)
+				if err != nil {
+					return nil, err
+				}
+				if c[0] != ' ' && c[0] != '\t' && c[0] != '\r' && c[0] != '\n' {
+					inArray = c[0] == '['
+					break
+				}
+				bufReader.ReadByte()
+			}
+			if inArray {
+				_, err := decoder.Token()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if inArray && !decoder.More() {
+			return nil, io.EOF
+		}
+		var record map[string]interface{}
+		err := decoder.Decode(&record)
+		if err != nil {
+			return nil, err
+		}
+		return record, nil
+	}
+}
+
+func newMsgpackRecordReader(reader io.Reader) httpRecordReader {
+	_codec := codec.MsgpackHandle{}
+	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	_codec.RawToString = false
+	decoder := codec.NewDecoder(reader, &_codec)
+	pending := make([]interface{}, 0)
+	return func() (map[string]interface{}, error) {
+		for len(pending) == 0 {
+			var v interface{}
+			err := decoder.Decode(&v)
+			if err != nil {
+				return nil, err
+			}
+			switch v_ := v.(type) {
+			case []interface{}:
+				pending = v_
+			default:
+				pending = []interface{}{v_}
+			}
+		}
+		v := pending[0]
+		pending = pending[1:]
+		record, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("a record must be a map (got %T)", v))
+		}
+		coerceInPlace(record)
+		return record, nil
+	}
+}
+
+func (input *HTTPInput) newRecordReader(req *http.Request) (httpRecordReader, error) {
+	contentType := strings.TrimSpace(strings.SplitN(req.Header.Get("Content-Type"), ";", 2)[0])
+	switch contentType {
+	case "application/json", "application/x-ndjson":
+		return newJSONRecordReader(req.Body), nil
+	case "application/msgpack", "application/x-msgpack":
+		return newMsgpackRecordReader(req.Body), nil
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		value := req.FormValue("json")
+		if value != "" {
+			return newJSONRecordReader(strings.NewReader(value)), nil
+		}
+		value = req.FormValue("msgpack")
+		if value != "" {
+			return newMsgpackRecordReader(strings.NewReader(value)), nil
+		}
+		return nil, errors.New("either `json' or `msgpack' parameter is required")
+	}
+	return nil, errors.New("unsupported content type: " + contentType)
+}
+
+func (input *HTTPInput) emit(port ik.Port, recordSets []ik.FluentRecordSet) error {
+	if input.ack {
+		return ik.EmitDurably(port, recordSets)
+	}
+	return port.Emit(recordSets)
+}
+
+// ServeHTTP takes the tag from the path, with slashes turned into dots.
+// The records are emitted in batches of batch_size as they are read.  In
+// ack mode every batch is emitted durably; with progress=1 the number of
+// records acknowledged so far is streamed back after each batch, otherwise
+// the response is returned once all of them are.
+func (input *HTTPInput) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" && req.Method != "PUT" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	tag := strings.Replace(strings.Trim(req.URL.Path, "/"), "/", ".", -1)
+	if tag == "" {
+		http.Error(resp, "no tag is given", http.StatusBadRequest)
+		return
+	}
+	now := input.clock.Now()
+	timeStr := req.URL.Query().Get("time")
+	if timeStr != "" {
+		seconds, err := strconv.ParseFloat(timeStr, 64)
+		if err != nil {
+			http.Error(resp, "invalid time: "+timeStr, http.StatusBadRequest)
+			return
+		}
+		now = time.Unix(int64(seconds), 0)
+	}
+	if input.bodySizeLimit > 0 {
+		req.Body = http.MaxBytesReader(resp, req.Body, input.bodySizeLimit)
+	}
+	reader, err := input.newRecordReader(req)
+	if err != nil {
+		http.Error(resp, err.Error(), http.StatusBadRequest)
+		return
+	}
+	port := ik.PortForSource(input.port, req.RemoteAddr)
+	progress := input.ack && req.URL.Query().Get("progress") == "1"
+	flusher, _ := resp.(http.Flusher)
+	if progress {
+		resp.Header().Set("Content-Type", "application/x-ndjson")
+		resp.WriteHeader(http.StatusOK)
+	}
+
+	acked := 0
+	fail := func(status int, message string) {
+		if progress {
+			fmt.Fprintf(resp, "{\"acked\":%d,\"error\":%q}\n", acked, message)
+		} else {
+			http.Error(resp, message, status)
+		}
+	}
+	records := make([]ik.TinyFluentRecord, 0, input.batchSize)
+	for {
+		record, err := reader()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			fail(http.StatusBadRequest, err.Error())
+			return
+		}
+		timestamp := now
+		if input.timeKey != "" {
+			value, ok := record[input.timeKey].(float64)
+			if ok {
+				timestamp = time.Unix(int64(value), 0)
+				delete(record, input.timeKey)
+			}
+		}
+		records = append(records, ik.TinyFluentRecord{Timestamp: uint64(timestamp.Unix()), Data: record})
+		if len(records) < input.batchSize {
+			continue
+		}
+		err = input.emit(port, []ik.FluentRecordSet{{Tag: tag, Records: records}})
+		if err != nil {
+			fail(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		acked += len(records)
+		records = make([]ik.TinyFluentRecord, 0, input.batchSize)
+		if progress {
+			fmt.Fprintf(resp, "{\"acked\":%d}\n", acked)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	}
+	if len(records) > 0 {
+		err = input.emit(port, []ik.FluentRecordSet{{Tag: tag, Records: records}})
+		if err != nil {
+			fail(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		acked += len(records)
+	}
+	if progress {
+		fmt.Fprintf(resp, "{\"acked\":%d,\"done\":true}\n", acked)
+	} else {
+		resp.WriteHeader(http.StatusOK)
+	}
+}
+
+func (input *HTTPInput) Run() error {
+	err := input.server.Serve(input.listener)
+	if err != nil {
+		input.logger.Warning("%s", err.Error())
+	}
+	return err
+}
+
+func (input *HTTPInput) Shutdown() error {
+	return input.listener.Close()
+}
+
+func (input *HTTPInput) Dispose() {
+	input.Shutdown()
+}
+
+func (factory *HTTPInputFactory) Name() string {
+	return "http"
+}
+
+func (factory *HTTPInputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Input, error) {
+	address, err := ik.ParseListenAddress(config, "bind", "9880")
+	if err != nil {
+		return nil, err
+	}
+	ack := false
+	ackStr, ok := config.Attrs["ack"]
+	if ok {
+		var err error
+		ack, err = strconv.ParseBool(ackStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	batchSize := 1000
+	batchSizeStr, ok := config.Attrs["batch_size"]
+	if ok {
+		var err error
+		batchSize, err = strconv.Atoi(batchSizeStr)
+		if err != nil {
+			return nil, err
+		}
+		if batchSize <= 0 {
+			return nil, errors.New("invalid batch_size: " + batchSizeStr)
+		}
+	}
+	bodySizeLimit := int64(32 * 1024 * 1024)
+	bodySizeLimitStr, ok := config.Attrs["body_size_limit"]
+	if ok {
+		var err error
+		bodySizeLimit, err = ik.ParseCapacityString(bodySizeLimitStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	handlerOptions, err := ik.ParseHTTPHandlerOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	handlerOptions.AuthScope = "emit"
+	tlsConfig, err := ik.ParseTLSServerConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	bind := address.String()
+	listener, err := ik.ListenAt(address)
+	if err != nil {
+		engine.Logger().Warning("%s", err.Error())
+		return nil, err
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	input := &HTTPInput{
+		factory:       factory,
+		port:          engine.DefaultPort(),
+		logger:        engine.Logger(),
+		bind:          bind,
+		listener:      listener,
+		ack:           ack,
+		batchSize:     batchSize,
+		bodySizeLimit: bodySizeLimit,
+		timeKey:       config.Attrs["time_key"],
+		clock:         engine.Clock(),
+	}
+	input.server = http.Server{Addr: bind, Handler: ik.WrapHTTPHandler(input, handlerOptions)}
+	return input, nil
+}
+
+func (factory *HTTPInputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&HTTPInputFactory{})
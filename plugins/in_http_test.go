@@ -0,0 +1,92 @@
+package plugins
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testDurablePort struct {
+	recordSets []ik.FluentRecordSet
+	durable    int
+	fail       bool
+}
+
+func (port *testDurablePort) Emit(recordSets []ik.FluentRecordSet) error {
+	port.recordSets = append(port.recordSets, recordSets...)
+	return nil
+}
+
+func (port *testDurablePort) EmitDurably(recordSets []ik.FluentRecordSet) error {
+	if port.fail {
+		return errors.New("journal is not writable")
+	}
+	port.durable += 1
+	return port.Emit(recordSets)
+}
+
+func newTestHTTPInput(port ik.Port, ack bool) *HTTPInput {
+	return &HTTPInput{
+		port:      port,
+		ack:       ack,
+		batchSize: 2,
+		timeKey:   "time",
+		clock:     newTestClock(func() time.Time { return time.Unix(1000, 0) }),
+	}
+}
+
+func Test_HTTPInput_ServeHTTP(t *testing.T) {
+	port := &testDurablePort{}
+	input := newTestHTTPInput(port, true)
+	req, _ := http.NewRequest("POST", "/app/access", strings.NewReader(`[{"a":1},{"a":2,"time":1400000000},{"a":3}]`))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	input.ServeHTTP(resp, req)
+	if resp.Code != 200 {
+		t.Fatalf("%d %s", resp.Code, resp.Body.String())
+	}
+	// three records in batches of two
+	if port.durable != 2 || len(port.recordSets) != 2 || port.recordSets[0].Tag != "app.access" {
+		t.Fatalf("%v", port.recordSets)
+	}
+	records := port.recordSets[0].Records
+	if records[0].Timestamp != 1000 || records[1].Timestamp != 1400000000 || records[1].Data["time"] != nil {
+		t.Fail()
+	}
+
+	port = &testDurablePort{}
+	input = newTestHTTPInput(port, false)
+	req, _ = http.NewRequest("POST", "/app?time=1400000001", strings.NewReader("{\"a\":1}\n{\"a\":2}\n"))
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp = httptest.NewRecorder()
+	input.ServeHTTP(resp, req)
+	if resp.Code != 200 || port.durable != 0 || len(port.recordSets) != 1 || port.recordSets[0].Records[1].Timestamp != 1400000001 {
+		t.Fail()
+	}
+}
+
+func Test_HTTPInput_ServeHTTP_ack(t *testing.T) {
+	port := &testDurablePort{fail: true}
+	input := newTestHTTPInput(port, true)
+	req, _ := http.NewRequest("POST", "/app", strings.NewReader(`{"a":1}`))
+	req.Header.Set("Content-Type", "application/json")
+	resp := httptest.NewRecorder()
+	input.ServeHTTP(resp, req)
+	if resp.Code != http.StatusServiceUnavailable {
+		t.Fail()
+	}
+
+	port = &testDurablePort{}
+	input = newTestHTTPInput(port, true)
+	req, _ = http.NewRequest("POST", "/app?progress=1", strings.NewReader(`[{"a":1},{"a":2},{"a":3}]`))
+	req.Header.Set("Content-Type", "application/json")
+	resp = httptest.NewRecorder()
+	input.ServeHTTP(resp, req)
+	if resp.Body.String() != "{\"acked\":2}\n{\"acked\":3,\"done\":true}\n" {
+		t.Fatal(resp.Body.String())
+	}
+}
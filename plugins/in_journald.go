@@ -0,0 +1,571 @@
+package plugins
+
+import (
+	"bytes"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/position"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournaldInput follows the systemd journal by reading the journal files,
+// whether they are the ones of the host or those in journal_directory, and
+// merging their entries in the order journald wrote them.  The cursor of the
+// last entry read is kept in the position store, pos_file by default, in
+// the form journald gives it, and the journal is read on from it after a
+// restart; the records are then emitted durably before the cursor moves
+// past them.
+type JournaldInput struct {
+	factory          *JournaldInputFactory
+	logger           ik.Logger
+	port             ik.Port
+	directories      []string
+	units            map[string]bool
+	priorities       map[string]bool
+	matches          map[string][][]byte
+	tag              string
+	positions        position.Store
+	readFromHead     bool
+	stripUnderscores bool
+	lowercase        bool
+	batchSize        int
+	readInterval     time.Duration
+	clock            ik.Clock
+	files            map[string]*journalFile
+	position         journalPosition
+	shutdown         chan struct{}
+	shutdownOnce     sync.Once
+	mtx              sync.Mutex
+}
+
+type JournaldInputFactory struct {
+}
+
+func (input *JournaldInput) Factory() ik.Plugin {
+	return input.factory
+}
+
+func (input *JournaldInput) Port() ik.Port {
+	return input.port
+}
+
+// readCursor reads the cursor kept for the empty key, which makes the file
+// of a FileStore the cursor alone.
+func (input *JournaldInput) readCursor() (string, error) {
+	if input.positions == nil {
+		return "", nil
+	}
+	cursor, _, err := input.positions.Get("")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(cursor), nil
+}
+
+func (input *JournaldInput) writeCursor(cursor string) error {
+	err := input.positions.Set("", cursor)
+	if err != nil {
+		return err
+	}
+	return input.positions.Sync()
+}
+
+// journalPaths lists the journal files in the directories, and in those
+// right below them, for the journals of the users and of other machines.
+func (input *JournaldInput) journalPaths() ([]string, error) {
+	paths := make([]string, 0)
+	for _, directory := range input.directories {
+		for _, pattern := range []string{"*.journal", "*/*.journal"} {
+			paths_, err := filepath.Glob(filepath.Join(directory, pattern))
+			if err != nil {
+				return nil, err
+			}
+			paths = append(paths, paths_...)
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// scan opens the journal files that appeared since the last scan and closes
+// those that are gone.  A file journald renamed on rotation is read on from
+// where it was.
+func (input *JournaldInput) scan() error {
+	paths, err := input.journalPaths()
+	if err != nil {
+		return err
+	}
+	files := make(map[string]*journalFile, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		var file *journalFile
+		for path_, file_ := range input.files {
+			if os.SameFile(info, file_.info) {
+				file = file_
+				delete(input.files, path_)
+				break
+			}
+		}
+		if file == nil {
+			file, err = openJournalFile(path)
+			if err != nil {
+				input.logger.Warning("failed to open a journal file: %s", err.Error())
+				continue
+			}
+		} else {
+			err = file.readHeader()
+			if err != nil {
+				input.logger.Warning("failed to read %s: %s", path, err.Error())
+				file.Close()
+				continue
+			}
+		}
+		files[path] = file
+	}
+	input.closeFiles()
+	input.files = files
+	return nil
+}
+
+func (input *JournaldInput) closeFiles() {
+	for _, file := range input.files {
+		file.Close()
+	}
+	input.files = nil
+}
+
+// nextEntry reads the next entry of file past the position read up to.
+func (input *JournaldInput) nextEntry(file *journalFile) (*journalEntry, error) {
+	if !input.position.before(file.tail) {
+		return nil, nil
+	}
+	for {
+		offset, err := file.next()
+		if err != nil || offset == 0 {
+			return nil, err
+		}
+		entry, _, err := file.readEntry(offset, false)
+		if err != nil {
+			return nil, err
+		}
+		if !input.position.before(entry.journalPosition) {
+			continue
+		}
+		entry, skipped, err := file.readEntry(offset, true)
+		if err != nil {
+			return nil, err
+		}
+		if skipped > 0 {
+			input.logger.Warning("left out %d fields of a journal entry that could not be decompressed", skipped)
+		}
+		return entry, nil
+	}
+}
+
+func (input *JournaldInput) fields(entry *journalEntry) map[string][][]byte {
+	fields := make(map[string][][]byte, len(entry.fields))
+	for _, field := range entry.fields {
+		i := bytes.IndexByte(field, '=')
+		if i < 0 {
+			continue
+		}
+		name := string(field[:i])
+		fields[name] = append(fields[name], field[i+1:])
+	}
+	return fields
+}
+
+func journaldMatchAny(values [][]byte, wanted [][]byte) bool {
+	for _, value := range values {
+		for _, wanted_ := range wanted {
+			if bytes.Equal(value, wanted_) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// match tells whether the fields of an entry pass the filters: the unit
+// must be one of units, the priority one of those priority allows, and the
+// matches of a field must have one of them hold, as those of journalctl.
+func (input *JournaldInput) match(fields map[string][][]byte) bool {
+	if input.units != nil {
+		ok := false
+		for _, unit := range fields["_SYSTEMD_UNIT"] {
+			ok = ok || input.units[string(unit)]
+		}
+		if !ok {
+			return false
+		}
+	}
+	if input.priorities != nil {
+		ok := false
+		for _, priority := range fields["PRIORITY"] {
+			ok = ok || input.priorities[string(priority)]
+		}
+		if !ok {
+			return false
+		}
+	}
+	for name, wanted := range input.matches {
+		if !journaldMatchAny(fields[name], wanted) {
+			return false
+		}
+	}
+	return true
+}
+
+// record makes a record of an entry, timed by the wallclock time journald
+// wrote it at.  A field the entry has more than once is made an array.
+func (input *JournaldInput) record(entry *journalEntry, fields map[string][][]byte) ik.TinyFluentRecord {
+	data := make(map[string]interface{}, len(fields))
+	for name, values := range fields {
+		if input.stripUnderscores {
+			name = strings.TrimLeft(name, "_")
+		}
+		if input.lowercase {
+			name = strings.ToLower(name)
+		}
+		if len(values) == 1 {
+			data[name] = string(values[0])
+			continue
+		}
+		values_ := make([]interface{}, len(values))
+		for i, value := range values {
+			values_[i] = string(value)
+		}
+		data[name] = values_
+	}
+	return ik.TinyFluentRecord{Timestamp: entry.realtime / 1000000, Data: data}
+}
+
+// emit emits the records and moves the cursor past them, or only moves the
+// cursor if the entries read were all filtered out.
+func (input *JournaldInput) emit(records []ik.TinyFluentRecord, cursor string) error {
+	recordSets := []ik.FluentRecordSet{{Tag: input.tag, Records: records}}
+	if input.positions == nil {
+		if len(records) == 0 {
+			return nil
+		}
+		return input.port.Emit(recordSets)
+	}
+	if len(records) > 0 {
+		err := ik.EmitDurably(input.port, recordSets)
+		if err != nil {
+			return err
+		}
+	}
+	return input.writeCursor(cursor)
+}
+
+// start goes to the entry of the cursor saved, or to the head or the tail
+// of the journal if there is none.
+func (input *JournaldInput) start() error {
+	cursor, err := input.readCursor()
+	if err != nil {
+		return err
+	}
+	input.position = journalPosition{}
+	if cursor != "" {
+		input.position, err = parseJournalCursor(cursor)
+		if err != nil {
+			input.logger.Warning("the cursor saved is ignored: %s", err.Error())
+			input.position = journalPosition{}
+		}
+	}
+	err = input.scan()
+	if err != nil {
+		return err
+	}
+	if !input.position.valid && !input.readFromHead {
+		for _, file := range input.files {
+			if input.position.before(file.tail) {
+				input.position = file.tail
+			}
+		}
+	}
+	return nil
+}
+
+// read emits the entries appended since it last ran, batch_size at most at
+// a time, merging the files by the order of the entries.
+func (input *JournaldInput) read() error {
+	input.mtx.Lock()
+	defer input.mtx.Unlock()
+	var err error
+	if input.files == nil {
+		err = input.start()
+	} else {
+		err = input.scan()
+	}
+	if err != nil {
+		return err
+	}
+	records := make([]ik.TinyFluentRecord, 0, input.batchSize)
+	cursor := ""
+	for {
+		select {
+		case <-input.shutdown:
+			return nil
+		default:
+		}
+		var next *journalFile
+		for _, file := range input.files {
+			if file.head == nil {
+				file.head, err = input.nextEntry(file)
+				if err != nil {
+					return err
+				}
+			}
+			if file.head != nil && (next == nil || file.head.before(next.head.journalPosition)) {
+				next = file
+			}
+		}
+		if next == nil {
+			break
+		}
+		entry := next.head
+		next.head = nil
+		input.position = entry.journalPosition
+		cursor = entry.cursor()
+		fields := input.fields(entry)
+		if !input.match(fields) {
+			continue
+		}
+		records = append(records, input.record(entry, fields))
+		if len(records) >= input.batchSize {
+			err = input.emit(records, cursor)
+			if err != nil {
+				return err
+			}
+			records = make([]ik.TinyFluentRecord, 0, input.batchSize)
+			cursor = ""
+		}
+	}
+	if cursor == "" {
+		return nil
+	}
+	return input.emit(records, cursor)
+}
+
+// Run reads the entries appended to the journal every read_interval until
+// the input is shut down.  If they fail to be read or emitted, the journal
+// is read again from the cursor saved.
+func (input *JournaldInput) Run() error {
+	select {
+	case <-input.shutdown:
+		return nil
+	default:
+	}
+	err := input.read()
+	if err != nil {
+		input.logger.Error("%s", err.Error())
+		input.mtx.Lock()
+		input.closeFiles()
+		input.mtx.Unlock()
+	}
+	select {
+	case <-input.shutdown:
+		return nil
+	case <-ik.After(input.clock, input.readInterval):
+	}
+	return ik.Continue
+}
+
+func (input *JournaldInput) Shutdown() error {
+	input.shutdownOnce.Do(func() {
+		close(input.shutdown)
+		input.mtx.Lock()
+		defer input.mtx.Unlock()
+		input.closeFiles()
+		if input.positions != nil {
+			err := input.positions.Close()
+			if err != nil {
+				input.logger.Error("%s", err.Error())
+			}
+		}
+	})
+	return nil
+}
+
+func (input *JournaldInput) Dispose() {
+	input.Shutdown()
+}
+
+func (factory *JournaldInputFactory) Name() string {
+	return "journald"
+}
+
+func parseJournaldBool(config *ik.ConfigElement, name string) (bool, error) {
+	valueStr, ok := config.Attrs[name]
+	if !ok {
+		return false, nil
+	}
+	return strconv.ParseBool(valueStr)
+}
+
+var journaldPriorityNames = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+func parseJournaldPriority(s string) (int, error) {
+	for i, name := range journaldPriorityNames {
+		if s == name {
+			return i, nil
+		}
+	}
+	priority, err := strconv.Atoi(s)
+	if err != nil || priority < 0 || priority >= len(journaldPriorityNames) {
+		return 0, errors.New("invalid priority: " + s)
+	}
+	return priority, nil
+}
+
+// parseJournaldPriorities reads the priorities a priority such as "err",
+// which stands for those up to it, or "crit..warning" allows.
+func parseJournaldPriorities(s string) (map[string]bool, error) {
+	bounds := strings.SplitN(s, "..", 2)
+	min := 0
+	max, err := parseJournaldPriority(bounds[len(bounds)-1])
+	if err != nil {
+		return nil, err
+	}
+	if len(bounds) == 2 {
+		min, err = parseJournaldPriority(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+	priorities := make(map[string]bool)
+	for i := min; i <= max; i++ {
+		priorities[strconv.Itoa(i)] = true
+	}
+	return priorities, nil
+}
+
+// journaldDirectories returns the directories journald keeps the journal
+// of the host in, that of the machine ID under /var/log/journal, where it
+// is kept persistently, and that under /run/log/journal otherwise.
+func journaldDirectories() []string {
+	machineID, err := ioutil.ReadFile("/etc/machine-id")
+	if err != nil {
+		return []string{"/var/log/journal", "/run/log/journal"}
+	}
+	id := strings.TrimSpace(string(machineID))
+	return []string{filepath.Join("/var/log/journal", id), filepath.Join("/run/log/journal", id)}
+}
+
+// New reads the filters from units, a list of the units to read the entries
+// of, priority, the least important priority to read or a range of them,
+// and matches, a list of FIELD=VALUE matches.
+func (factory *JournaldInputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Input, error) {
+	tag, ok := config.Attrs["tag"]
+	if !ok {
+		return nil, errors.New("required attribute `tag' is not specified")
+	}
+	directories := journaldDirectories()
+	directory, ok := config.Attrs["journal_directory"]
+	if ok {
+		directories = []string{directory}
+	}
+	var units map[string]bool
+	unitsStr, ok := config.Attrs["units"]
+	if ok {
+		units = make(map[string]bool)
+		for _, unit := range splitAndStrip(unitsStr) {
+			if unit == "" {
+				continue
+			}
+			if !strings.Contains(unit, ".") {
+				unit += ".service"
+			}
+			units[unit] = true
+		}
+	}
+	var priorities map[string]bool
+	priority, ok := config.Attrs["priority"]
+	if ok {
+		var err error
+		priorities, err = parseJournaldPriorities(priority)
+		if err != nil {
+			return nil, err
+		}
+	}
+	matches := make(map[string][][]byte)
+	matchesStr, ok := config.Attrs["matches"]
+	if ok {
+		for _, match := range splitAndStrip(matchesStr) {
+			if match == "" {
+				continue
+			}
+			kv := strings.SplitN(match, "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, errors.New("invalid match: " + match)
+			}
+			matches[kv[0]] = append(matches[kv[0]], []byte(kv[1]))
+		}
+	}
+	readFromHead, err := parseJournaldBool(config, "read_from_head")
+	if err != nil {
+		return nil, err
+	}
+	stripUnderscores, err := parseJournaldBool(config, "strip_underscores")
+	if err != nil {
+		return nil, err
+	}
+	lowercase, err := parseJournaldBool(config, "lowercase")
+	if err != nil {
+		return nil, err
+	}
+	batchSize := 100
+	batchSizeStr, ok := config.Attrs["batch_size"]
+	if ok {
+		batchSize, err = strconv.Atoi(batchSizeStr)
+		if err != nil {
+			return nil, err
+		}
+		if batchSize <= 0 {
+			return nil, errors.New("invalid batch_size: " + batchSizeStr)
+		}
+	}
+	readInterval, err := parseForwardDuration(config, "read_interval", time.Second)
+	if err != nil {
+		return nil, err
+	}
+	positions, err := openPositionStore(config)
+	if err != nil {
+		return nil, err
+	}
+	return &JournaldInput{
+		factory:          factory,
+		logger:           engine.Logger(),
+		clock:            engine.Clock(),
+		port:             engine.DefaultPort(),
+		directories:      directories,
+		units:            units,
+		priorities:       priorities,
+		matches:          matches,
+		tag:              tag,
+		positions:        positions,
+		readFromHead:     readFromHead,
+		stripUnderscores: stripUnderscores,
+		lowercase:        lowercase,
+		batchSize:        batchSize,
+		readInterval:     readInterval,
+		shutdown:         make(chan struct{}),
+	}, nil
+}
+
+func (factory *JournaldInputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&JournaldInputFactory{})
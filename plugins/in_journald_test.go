@@ -0,0 +1,328 @@
+package plugins
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/position"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testJournalEntry struct {
+	seqnum   uint64
+	realtime uint64
+	fields   []string
+}
+
+// writeTestJournal writes a journal file of the entries with room for six
+// of them in two entry arrays, so that entries are appended by writing it
+// again.  The hash tables are left out, as they are not read.
+func writeTestJournal(path string, seqnumID byte, flags uint32, compress func([]byte) ([]byte, byte), entries []testJournalEntry) error {
+	le := binary.LittleEndian
+	compact := flags&journalIncompatibleCompact != 0
+	itemSize, entryItemSize, payloadOffset := 8, 16, 64
+	if compact {
+		itemSize, entryItemSize, payloadOffset = 4, 4, 72
+	}
+	object := func(type_ byte, flags byte, size int) []byte {
+		b := make([]byte, size)
+		b[0] = type_
+		b[1] = flags
+		le.PutUint64(b[8:], uint64(size))
+		return b
+	}
+	b := make([]byte, journalHeaderSize)
+	append_ := func(object []byte) uint64 {
+		offset := uint64(len(b))
+		b = append(b, object...)
+		for len(b)%8 != 0 {
+			b = append(b, 0)
+		}
+		return offset
+	}
+	arrays := []uint64{
+		append_(object(journalObjectEntryArray, 0, journalEntryArrayObjectSize+2*itemSize)),
+		append_(object(journalObjectEntryArray, 0, journalEntryArrayObjectSize+4*itemSize)),
+	}
+	if len(entries) > 2 {
+		le.PutUint64(b[arrays[0]+16:], arrays[1])
+	}
+	for i, entry := range entries {
+		items := make([]uint64, 0)
+		for _, field := range entry.fields {
+			payload, objectFlags := []byte(field), byte(0)
+			if compress != nil {
+				payload, objectFlags = compress(payload)
+			}
+			data := object(journalObjectData, objectFlags, payloadOffset+len(payload))
+			copy(data[payloadOffset:], payload)
+			items = append(items, append_(data))
+		}
+		entry_ := object(journalObjectEntry, 0, journalEntryObjectSize+len(items)*entryItemSize)
+		le.PutUint64(entry_[16:], entry.seqnum)
+		le.PutUint64(entry_[24:], entry.realtime)
+		entry_[40] = 0xbb
+		for j, item := range items {
+			if compact {
+				le.PutUint32(entry_[journalEntryObjectSize+j*4:], uint32(item))
+			} else {
+				le.PutUint64(entry_[journalEntryObjectSize+j*16:], item)
+			}
+		}
+		offset := append_(entry_)
+		array, index := arrays[0], i
+		if i >= 2 {
+			array, index = arrays[1], i-2
+		}
+		item := b[array+uint64(journalEntryArrayObjectSize+index*itemSize):]
+		if compact {
+			le.PutUint32(item, uint32(offset))
+		} else {
+			le.PutUint64(item, offset)
+		}
+	}
+	copy(b, journalSignature)
+	le.PutUint32(b[12:], flags)
+	b[24] = seqnumID
+	b[72] = seqnumID
+	le.PutUint64(b[88:], journalHeaderSize)
+	le.PutUint64(b[152:], uint64(len(entries)))
+	le.PutUint64(b[176:], arrays[0])
+	if len(entries) > 0 {
+		le.PutUint64(b[160:], entries[len(entries)-1].seqnum)
+		le.PutUint64(b[192:], entries[len(entries)-1].realtime)
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
+
+// compressTestLZ4 makes an LZ4 block of literals alone.
+func compressTestLZ4(data []byte) ([]byte, byte) {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, uint64(len(data)))
+	if len(data) < 15 {
+		b = append(b, byte(len(data)<<4))
+	} else {
+		b = append(b, 0xf0)
+		n := len(data) - 15
+		for ; n >= 255; n -= 255 {
+			b = append(b, 255)
+		}
+		b = append(b, byte(n))
+	}
+	return append(b, data...), journalObjectCompressedLZ4
+}
+
+func compressTestZstd(data []byte) ([]byte, byte) {
+	encoder, _ := zstd.NewWriter(nil)
+	defer encoder.Close()
+	return encoder.EncodeAll(data, nil), journalObjectCompressedZSTD
+}
+
+var testJournalEntries = []testJournalEntry{
+	{1, 1400000000123456, []string{"MESSAGE=hello", "_SYSTEMD_UNIT=test.service", "PRIORITY=3", "TAGS=x", "TAGS=y", "_TRANSPORT=journal"}},
+	{3, 1400000002000000, []string{"MESSAGE=a\x00b", "_SYSTEMD_UNIT=test.service", "PRIORITY=2", "_TRANSPORT=stdout"}},
+	{4, 1400000003000000, []string{"MESSAGE=other", "_SYSTEMD_UNIT=other.service", "PRIORITY=0", "_TRANSPORT=stdout"}},
+	{5, 1400000004000000, []string{"MESSAGE=appended", "_SYSTEMD_UNIT=test.service", "PRIORITY=1", "_TRANSPORT=journal"}},
+	{6, 1400000005000000, []string{"MESSAGE=tail", "_SYSTEMD_UNIT=test.service", "PRIORITY=1", "_TRANSPORT=journal"}},
+}
+
+// writeTestJournals writes the first n entries of testJournalEntries to
+// system.journal, along with an entry in a compact journal of a user
+// compressed with LZ4 and one of another machine compressed with zstd.
+func writeTestJournals(t *testing.T, dir string, n int) {
+	err := writeTestJournal(path.Join(dir, "system.journal"), 1, 0, nil, testJournalEntries[:n])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = writeTestJournal(path.Join(dir, "user-1000.journal"), 1, journalIncompatibleCompact|journalIncompatibleCompressedLZ4, compressTestLZ4, []testJournalEntry{
+		{2, 1400000001000000, []string{"MESSAGE=" + strings.Repeat("lz4", 10), "_SYSTEMD_UNIT=test.service", "PRIORITY=3", "_TRANSPORT=journal"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	os.Mkdir(path.Join(dir, "remote"), 0755)
+	err = writeTestJournal(path.Join(dir, "remote", "system.journal"), 2, journalIncompatibleCompressedZSTD, compressTestZstd, []testJournalEntry{
+		{1, 1400000001500000, []string{"MESSAGE=zstd", "_SYSTEMD_UNIT=test.service", "PRIORITY=3", "_TRANSPORT=journal"}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+}
+
+func newTestJournaldInput(t *testing.T, engine ik.Engine, attrs map[string]string) (*JournaldInput, *testDurablePort) {
+	input, err := (&JournaldInputFactory{}).New(engine, &ik.ConfigElement{Attrs: attrs})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	port := &testDurablePort{}
+	input.(*JournaldInput).port = port
+	return input.(*JournaldInput), port
+}
+
+func journaldMessages(recordSets []ik.FluentRecordSet) []interface{} {
+	messages := make([]interface{}, 0)
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			messages = append(messages, record.Data["message"])
+		}
+	}
+	return messages
+}
+
+func Test_JournaldInput_Run(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ik-journald")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	writeTestJournals(t, dir, 3)
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	defer engine.Dispose()
+	posFile := path.Join(dir, "journal.pos")
+	attrs := map[string]string{
+		"tag":               "journal",
+		"journal_directory": dir,
+		"pos_file":          posFile,
+		"units":             "test, b.service",
+		"priority":          "err",
+		"matches":           "_TRANSPORT=journal, _TRANSPORT=stdout",
+		"read_from_head":    "true",
+		"strip_underscores": "true",
+		"lowercase":         "true",
+		"batch_size":        "2",
+		"read_interval":     "1ms",
+	}
+	input, port := newTestJournaldInput(t, engine, attrs)
+	if input.Run() != ik.Continue {
+		t.Fail()
+	}
+	if port.durable != 2 || len(port.recordSets) != 2 || port.recordSets[0].Tag != "journal" {
+		t.Fatalf("%v", port.recordSets)
+	}
+	// merged by the sequence numbers, or the time for another sequence
+	messages := journaldMessages(port.recordSets)
+	if fmt.Sprintf("%q", messages) != fmt.Sprintf("%q", []string{"hello", strings.Repeat("lz4", 10), "zstd", "a\x00b"}) {
+		t.Fatalf("%q", messages)
+	}
+	record := port.recordSets[0].Records[0]
+	if record.Timestamp != 1400000000 || record.Data["systemd_unit"] != "test.service" || fmt.Sprintf("%v", record.Data["tags"]) != "[x y]" || len(record.Data) != 5 {
+		t.Logf("%v", record)
+		t.Fail()
+	}
+	// the cursor moves past the entry filtered out
+	b, _ := ioutil.ReadFile(posFile)
+	if !strings.HasPrefix(string(b), "s=01000000000000000000000000000000;i=4;b=bb000000000000000000000000000000;m=0;t=") {
+		t.Logf("%q", b)
+		t.Fail()
+	}
+
+	// read on as entries are appended
+	writeTestJournals(t, dir, 4)
+	port.recordSets = nil
+	if input.Run() != ik.Continue {
+		t.Fail()
+	}
+	messages = journaldMessages(port.recordSets)
+	if len(messages) != 1 || messages[0] != "appended" {
+		t.Fatalf("%q", messages)
+	}
+	input.Shutdown()
+	if input.Run() != nil {
+		t.Fail()
+	}
+
+	// read on from the cursor saved
+	writeTestJournals(t, dir, 5)
+	input, port = newTestJournaldInput(t, engine, attrs)
+	defer input.Shutdown()
+	input.Run()
+	messages = journaldMessages(port.recordSets)
+	if len(messages) != 1 || messages[0] != "tail" {
+		t.Fatalf("%q", messages)
+	}
+}
+
+func Test_JournaldInput_tail(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ik-journald")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	writeTestJournals(t, dir, 3)
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), nil)
+	defer engine.Dispose()
+	input, port := newTestJournaldInput(t, engine, map[string]string{
+		"tag":               "journal",
+		"journal_directory": dir,
+		"lowercase":         "true",
+		"read_interval":     "1ms",
+	})
+	defer input.Shutdown()
+	input.Run()
+	if len(port.recordSets) != 0 {
+		t.Fatalf("%v", port.recordSets)
+	}
+	writeTestJournals(t, dir, 5)
+	input.Run()
+	messages := journaldMessages(port.recordSets)
+	if len(messages) != 2 || messages[0] != "appended" || messages[1] != "tail" {
+		t.Fatalf("%q", messages)
+	}
+}
+
+func Test_JournaldInput_emitFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ik-journald")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	writeTestJournals(t, dir, 3)
+	port := &testDurablePort{fail: true}
+	posFile := path.Join(dir, "journal.pos")
+	positions, err := position.OpenFileStore(posFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input := &JournaldInput{
+		logger:       &testLogger{t},
+		port:         port,
+		directories:  []string{dir},
+		matches:      map[string][][]byte{},
+		tag:          "journal",
+		positions:    positions,
+		readFromHead: true,
+		batchSize:    100,
+		readInterval: time.Millisecond,
+		clock:        ik.SystemClock,
+		shutdown:     make(chan struct{}),
+	}
+	defer input.Shutdown()
+	input.Run()
+	// the cursor stays where it was for the entries to be read again
+	if _, err := os.Stat(posFile); !os.IsNotExist(err) {
+		t.Fail()
+	}
+	port.fail = false
+	input.Run()
+	if len(journaldMessages(port.recordSets)) != 5 {
+		t.Fatalf("%v", port.recordSets)
+	}
+}
+
+func Test_decompressLZ4Block(t *testing.T) {
+	// "abc", then 9 bytes from 3 bytes back, then "d"
+	b, err := decompressLZ4Block([]byte{0x35, 'a', 'b', 'c', 3, 0, 0x10, 'd'}, 13)
+	if err != nil || string(b) != "abcabcabcabcd" {
+		t.Fatalf("%q %v", b, err)
+	}
+	_, err = decompressLZ4Block([]byte{0x35, 'a', 'b', 'c', 4, 0}, 13)
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,362 @@
+package plugins
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type statsdMetric struct {
+	name   string
+	type_  string
+	tags   map[string]interface{}
+	value  float64
+	values []float64
+	set    map[string]bool
+	// updated tells if a gauge has been set since the last flush
+	updated bool
+}
+
+// StatsdInput receives metrics in the statsd line protocol over UDP and
+// emits what they add up to every flush_interval, a record a metric.
+// Counters and sets start over at every flush, while gauges keep their
+// value until they are deleted by delete_idle_gauges.
+type StatsdInput struct {
+	factory          *StatsdInputFactory
+	port             ik.Port
+	logger           ik.Logger
+	conn             net.PacketConn
+	tag              string
+	flushInterval    time.Duration
+	percentiles      []float64
+	deleteIdleGauges bool
+	clock            ik.Clock
+	metrics          map[string]*statsdMetric
+	nextFlush        time.Time
+	buf              []byte
+	shutdown         int32
+}
+
+type StatsdInputFactory struct {
+}
+
+func (input *StatsdInput) Factory() ik.Plugin {
+	return input.factory
+}
+
+func (input *StatsdInput) Port() ik.Port {
+	return input.port
+}
+
+// parseStatsdTags reads the tags DogStatsD appends to a metric after #, as
+// name:value pairs or bare names.
+func parseStatsdTags(s string) map[string]interface{} {
+	tags := make(map[string]interface{})
+	for _, tag := range strings.Split(s, ",") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = kv[1]
+		} else {
+			tags[kv[0]] = true
+		}
+	}
+	return tags
+}
+
+// statsdKey identifies a metric by its name, type and tags.
+func statsdKey(name string, type_ string, tags string) string {
+	if tags == "" {
+		return name + "|" + type_
+	}
+	sorted := strings.Split(tags, ",")
+	sort.Strings(sorted)
+	return name + "|" + type_ + "|" + strings.Join(sorted, ",")
+}
+
+// feedLine adds a line of name:value|type[|@rate][|#tags] to the metrics.
+func (input *StatsdInput) feedLine(line string) error {
+	fields := strings.Split(line, "|")
+	i := strings.LastIndex(fields[0], ":")
+	if i <= 0 || len(fields) < 2 {
+		return errors.New("malformed metric: " + line)
+	}
+	name := fields[0][:i]
+	fields[0] = fields[0][i+1:]
+	valueStr := fields[0]
+	type_ := fields[1]
+	rate := 1.0
+	tagsStr := ""
+	for _, field := range fields[2:] {
+		if strings.HasPrefix(field, "@") {
+			var err error
+			rate, err = strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return errors.New("invalid sample rate: " + line)
+			}
+		} else if strings.HasPrefix(field, "#") {
+			tagsStr = field[1:]
+		}
+	}
+	switch type_ {
+	case "c", "g", "ms", "h", "s":
+	default:
+		return errors.New("unsupported metric type: " + line)
+	}
+	if type_ == "h" {
+		type_ = "ms"
+	}
+	key := statsdKey(name, type_, tagsStr)
+	metric, ok := input.metrics[key]
+	if !ok {
+		metric = &statsdMetric{name: name, type_: type_, tags: parseStatsdTags(tagsStr)}
+	}
+	if type_ == "s" {
+		if metric.set == nil {
+			metric.set = make(map[string]bool)
+		}
+		metric.set[valueStr] = true
+		input.metrics[key] = metric
+		return nil
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil {
+		return errors.New("invalid value: " + line)
+	}
+	switch type_ {
+	case "c":
+		metric.value += value / rate
+	case "g":
+		metric.updated = true
+		// a sign makes it a change of the gauge
+		if strings.HasPrefix(valueStr, "+") || strings.HasPrefix(valueStr, "-") {
+			metric.value += value
+		} else {
+			metric.value = value
+		}
+	case "ms":
+		metric.values = append(metric.values, value)
+	}
+	input.metrics[key] = metric
+	return nil
+}
+
+func (input *StatsdInput) feed(packet []byte) {
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		err := input.feedLine(line)
+		if err != nil {
+			input.logger.Warning("%s", err.Error())
+		}
+	}
+}
+
+// parsePercentiles reads a comma-separated list of percentiles.
+func parsePercentiles(s string) ([]float64, error) {
+	retval := make([]float64, 0)
+	for _, comp := range splitAndStrip(s) {
+		if comp == "" {
+			continue
+		}
+		percentile, err := strconv.ParseFloat(comp, 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, errors.New("invalid percentile: " + comp)
+		}
+		retval = append(retval, percentile)
+	}
+	return retval, nil
+}
+
+func statsdPercentileKey(percentile float64) string {
+	return "upper_" + strings.Replace(strconv.FormatFloat(percentile, 'f', -1, 64), ".", "_", -1)
+}
+
+// timerData sums up the values of a timer the way statsd does, taking the
+// upper bound of a percentile to be the largest of the values within it.
+func (input *StatsdInput) timerData(values []float64) map[string]interface{} {
+	sort.Float64s(values)
+	sum := 0.0
+	for _, value := range values {
+		sum += value
+	}
+	data := map[string]interface{}{
+		"count": len(values),
+		"min":   values[0],
+		"max":   values[len(values)-1],
+		"sum":   sum,
+		"mean":  sum / float64(len(values)),
+	}
+	for _, percentile := range input.percentiles {
+		n := int(math.Floor(percentile/100*float64(len(values)) + 0.5))
+		if n < 1 {
+			n = 1
+		}
+		data[statsdPercentileKey(percentile)] = values[n-1]
+	}
+	return data
+}
+
+var statsdTypeNames = map[string]string{"c": "counter", "g": "gauge", "ms": "timer", "s": "set"}
+
+// flush emits the metrics received since the last flush.
+func (input *StatsdInput) flush() error {
+	now := input.clock.Now()
+	records := make([]ik.TinyFluentRecord, 0, len(input.metrics))
+	keys := make([]string, 0, len(input.metrics))
+	for key := range input.metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		metric := input.metrics[key]
+		var data map[string]interface{}
+		switch metric.type_ {
+		case "c":
+			data = map[string]interface{}{
+				"value": metric.value,
+				"rate":  metric.value / input.flushInterval.Seconds(),
+			}
+			delete(input.metrics, key)
+		case "g":
+			if !metric.updated && input.deleteIdleGauges {
+				delete(input.metrics, key)
+				continue
+			}
+			data = map[string]interface{}{"value": metric.value}
+			metric.updated = false
+		case "ms":
+			data = input.timerData(metric.values)
+			delete(input.metrics, key)
+		case "s":
+			data = map[string]interface{}{"count": len(metric.set)}
+			delete(input.metrics, key)
+		}
+		data["name"] = metric.name
+		data["type"] = statsdTypeNames[metric.type_]
+		if len(metric.tags) > 0 {
+			data["tags"] = metric.tags
+		}
+		records = append(records, ik.TinyFluentRecord{Timestamp: uint64(now.Unix()), Data: data})
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return input.port.Emit([]ik.FluentRecordSet{{Tag: input.tag, Records: records}})
+}
+
+// Run reads a packet, or flushes the metrics once the flush interval has
+// passed.  The metrics are only touched from here, and are flushed once
+// more when the input is shut down.
+func (input *StatsdInput) Run() error {
+	now := input.clock.Now()
+	if !now.Before(input.nextFlush) {
+		err := input.flush()
+		if err != nil {
+			input.logger.Error("%s", err.Error())
+		}
+		input.nextFlush = now.Add(input.flushInterval)
+	}
+	input.conn.SetReadDeadline(input.nextFlush)
+	n, _, err := input.conn.ReadFrom(input.buf)
+	if err != nil {
+		if atomic.LoadInt32(&input.shutdown) != 0 {
+			err := input.flush()
+			if err != nil {
+				input.logger.Error("%s", err.Error())
+			}
+			return nil
+		}
+		netErr, ok := err.(net.Error)
+		if !ok || !netErr.Timeout() {
+			input.logger.Warning("%s", err.Error())
+		}
+		return ik.Continue
+	}
+	input.feed(input.buf[:n])
+	return ik.Continue
+}
+
+func (input *StatsdInput) Shutdown() error {
+	atomic.StoreInt32(&input.shutdown, 1)
+	return input.conn.Close()
+}
+
+func (input *StatsdInput) Dispose() {
+	input.Shutdown()
+}
+
+func (factory *StatsdInputFactory) Name() string {
+	return "statsd"
+}
+
+func (factory *StatsdInputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Input, error) {
+	listen := config.Attrs["bind"]
+	netPort, ok := config.Attrs["port"]
+	if !ok {
+		netPort = "8125"
+	}
+	tag, ok := config.Attrs["tag"]
+	if !ok {
+		tag = "statsd"
+	}
+	flushInterval, err := parseForwardDuration(config, "flush_interval", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	if flushInterval <= 0 {
+		return nil, errors.New(fmt.Sprintf("invalid flush_interval: %s", flushInterval.String()))
+	}
+	percentiles := []float64{90}
+	percentilesStr, ok := config.Attrs["percentiles"]
+	if ok {
+		percentiles, err = parsePercentiles(percentilesStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	deleteIdleGauges := false
+	deleteIdleGaugesStr, ok := config.Attrs["delete_idle_gauges"]
+	if ok {
+		deleteIdleGauges, err = strconv.ParseBool(deleteIdleGaugesStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	conn, err := net.ListenPacket("udp", listen+":"+netPort)
+	if err != nil {
+		engine.Logger().Warning("%s", err.Error())
+		return nil, err
+	}
+	clock := engine.Clock()
+	return &StatsdInput{
+		factory:          factory,
+		port:             engine.DefaultPort(),
+		logger:           engine.Logger(),
+		conn:             conn,
+		tag:              tag,
+		flushInterval:    flushInterval,
+		percentiles:      percentiles,
+		deleteIdleGauges: deleteIdleGauges,
+		clock:            clock,
+		metrics:          make(map[string]*statsdMetric),
+		nextFlush:        clock.Now().Add(flushInterval),
+		buf:              make([]byte, 65536),
+	}, nil
+}
+
+func (factory *StatsdInputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&StatsdInputFactory{})
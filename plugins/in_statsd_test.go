@@ -0,0 +1,119 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestStatsdInput(t *testing.T, port ik.Port, config map[string]string) *StatsdInput {
+	engine := ik.NewEngine(&testLogger{t}, nil, nil, nil, ik.NewScorekeeper(&testLogger{t}), port)
+	config["bind"] = "127.0.0.1"
+	config["port"] = "0"
+	input, err := (&StatsdInputFactory{}).New(engine, &ik.ConfigElement{Attrs: config})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	input_ := input.(*StatsdInput)
+	input_.port = port
+	input_.clock = newTestClock(func() time.Time { return time.Unix(1400000000, 0) })
+	return input_
+}
+
+func statsdRecords(port *testDurablePort) map[string]map[string]interface{} {
+	retval := make(map[string]map[string]interface{})
+	for _, recordSet := range port.recordSets {
+		for _, record := range recordSet.Records {
+			retval[record.Data["name"].(string)] = record.Data
+		}
+	}
+	return retval
+}
+
+func Test_StatsdInput_flush(t *testing.T) {
+	port := &testDurablePort{}
+	input := newTestStatsdInput(t, port, map[string]string{
+		"flush_interval":     "10s",
+		"percentiles":        "50, 90",
+		"delete_idle_gauges": "true",
+	})
+	defer input.Shutdown()
+	input.feed([]byte("hits:1|c\nhits:2|c|@0.5\nload:5|g\nload:-2|g\nlatency:10|ms\nlatency:30|ms\nlatency:20|h\nusers:a|s\nusers:b|s\nusers:a|s\n" +
+		"tagged:1|c|#env:prod,canary\nbogus\nbad:x|c\nodd:1|q\n"))
+	err := input.flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(port.recordSets) != 1 || port.recordSets[0].Tag != "statsd" || port.recordSets[0].Records[0].Timestamp != 1400000000 {
+		t.Fatalf("%v", port.recordSets)
+	}
+	records := statsdRecords(port)
+	if len(records) != 5 {
+		t.Fatalf("%v", records)
+	}
+	if hits := records["hits"]; hits["type"] != "counter" || hits["value"] != 5.0 || hits["rate"] != 0.5 {
+		t.Logf("%v", hits)
+		t.Fail()
+	}
+	if load := records["load"]; load["type"] != "gauge" || load["value"] != 3.0 {
+		t.Logf("%v", load)
+		t.Fail()
+	}
+	latency := records["latency"]
+	if latency["type"] != "timer" || latency["count"] != 3 || latency["min"] != 10.0 || latency["max"] != 30.0 || latency["mean"] != 20.0 || latency["upper_50"] != 20.0 || latency["upper_90"] != 30.0 {
+		t.Logf("%v", latency)
+		t.Fail()
+	}
+	if users := records["users"]; users["type"] != "set" || users["count"] != 2 {
+		t.Logf("%v", users)
+		t.Fail()
+	}
+	if tags, ok := records["tagged"]["tags"].(map[string]interface{}); !ok || tags["env"] != "prod" || tags["canary"] != true {
+		t.Logf("%v", records["tagged"])
+		t.Fail()
+	}
+
+	// the gauge is not updated since, and then goes
+	port.recordSets = nil
+	input.flush()
+	if len(port.recordSets) != 0 {
+		t.Fatalf("%v", port.recordSets)
+	}
+
+	// gauges are kept otherwise
+	port = &testDurablePort{}
+	input = newTestStatsdInput(t, port, map[string]string{})
+	defer input.Shutdown()
+	input.feed([]byte("load:5|g"))
+	input.flush()
+	input.flush()
+	if len(port.recordSets) != 2 || port.recordSets[1].Records[0].Data["value"] != 5.0 {
+		t.Fatalf("%v", port.recordSets)
+	}
+}
+
+func Test_StatsdInput_Run(t *testing.T) {
+	port := &testDurablePort{}
+	input := newTestStatsdInput(t, port, map[string]string{})
+	conn, err := net.Dial("udp", input.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hits:1|c"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if input.Run() != ik.Continue {
+		t.Fail()
+	}
+	// what is left is flushed on shutdown
+	input.Shutdown()
+	if input.Run() != nil {
+		t.Fail()
+	}
+	if records := statsdRecords(port); len(records) != 1 || records["hits"]["value"] != 1.0 {
+		t.Fatalf("%v", records)
+	}
+}
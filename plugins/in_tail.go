@@ -8,6 +8,7 @@ import (
 	"github.com/howeyc/fsnotify"
 	fileid "github.com/moriyoshi/go-fileid"
 	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/position"
 	"io"
 	"net/http"
 	"os"
@@ -413,20 +414,21 @@ type tailPositionFileData struct {
 
 type TailPositionFileEntry struct {
 	positionFile *TailPositionFile
-	offset       int
 	isNew        bool
 	data         tailPositionFileData
 }
 
+// TailPositionFile keeps the positions of the files tailed in a position
+// store, the path of a file being its key.  A position saved is synced by
+// a goroutine of its own, so that the lines are not held up by the writes.
 type TailPositionFile struct {
-	logger      ik.Logger
-	refcount    int64
-	path        string
-	f           *os.File
-	view        []byte
-	entries     map[string]*TailPositionFileEntry
-	controlChan chan bool
-	mtx         sync.Mutex
+	logger   ik.Logger
+	refcount int64
+	store    position.Store
+	entries  map[string]*TailPositionFileEntry
+	syncChan chan struct{}
+	done     chan struct{}
+	mtx      sync.Mutex
 }
 
 type concreateTailFileInfo struct {
@@ -657,32 +659,32 @@ func (entry *TailPositionFileEntry) deleteRef() error {
 	return entry.positionFile.deleteRef()
 }
 
+// scheduleUpdate sets the position of the entry in the store, which is
+// then synced unless a sync is already pending.  In the store a position
+// is the line of the entry without the path.
 func (positionFile *TailPositionFile) scheduleUpdate(entry *TailPositionFileEntry) error {
 	blob := marshalPositionFileData(&entry.data)
-	offset := entry.offset
-	copy(positionFile.view[offset:offset+len(blob)], blob)
-	positionFile.controlChan <- false
+	err := positionFile.store.Set(entry.data.Path, string(blob[len(entry.data.Path)+1:len(blob)-1]))
+	if err != nil {
+		return err
+	}
+	select {
+	case positionFile.syncChan <- struct{}{}:
+	default:
+	}
 	return nil
 }
 
 func (positionFile *TailPositionFile) doUpdate() {
-	for needsToBeStopped := range positionFile.controlChan {
-		if needsToBeStopped {
-			break
-		}
-		_, err := positionFile.f.Seek(0, os.SEEK_SET)
-		if err != nil {
-			positionFile.logger.Error("%s", err.Error())
-			continue
-		}
-		n, err := positionFile.f.Write(positionFile.view)
-		if err != nil {
-			positionFile.logger.Error("%s", err.Error())
-			continue
-		}
-		if n != len(positionFile.view) {
-			positionFile.logger.Error("failed to update position file: %s", positionFile.path)
-			continue
+	for {
+		select {
+		case <-positionFile.done:
+			return
+		case <-positionFile.syncChan:
+			err := positionFile.store.Sync()
+			if err != nil {
+				positionFile.logger.Error("%s", err.Error())
+			}
 		}
 	}
 }
@@ -692,10 +694,8 @@ func (positionFile *TailPositionFile) Get(path string) TailFileInfo {
 	defer positionFile.mtx.Unlock()
 	entry, ok := positionFile.entries[path]
 	if !ok {
-		offset := len(positionFile.view)
 		entry = &TailPositionFileEntry{
 			positionFile: positionFile,
-			offset:       offset,
 			isNew:        true,
 			data: tailPositionFileData{
 				Path:     path,
@@ -703,11 +703,18 @@ func (positionFile *TailPositionFile) Get(path string) TailFileInfo {
 				Id:       fileid.FileId{},
 			},
 		}
-		blob := marshalPositionFileData(&entry.data)
-		newView := make([]byte, offset+len(blob))
-		copy(newView, positionFile.view)
-		copy(newView[offset:], blob)
-		positionFile.view = newView
+		saved, ok, err := positionFile.store.Get(path)
+		if err == nil && ok {
+			data := tailPositionFileData{}
+			_, err = unmarshalPositionFileData(&data, []byte(path+"\t"+saved+"\n"))
+			if err == nil {
+				entry.isNew = false
+				entry.data = data
+			}
+		}
+		if err != nil {
+			positionFile.logger.Warning("ignoring the position of %s: %s", path, err.Error())
+		}
 		positionFile.entries[path] = entry
 	}
 
@@ -718,93 +725,18 @@ func (positionFile *TailPositionFile) Dispose() error {
 	return positionFile.deleteRef()
 }
 
-func readTailPositionFileEntries(positionFile *TailPositionFile, f *os.File) (map[string]*TailPositionFileEntry, error) {
-	retval := make(map[string]*TailPositionFileEntry)
-	_, err := f.Seek(0, os.SEEK_SET)
-	if err != nil {
-		return nil, err
-	}
-	info, err := f.Stat()
-	if err != nil {
-		return nil, err
-	}
-	blob := make([]byte, int(info.Size()))
-	n, err := f.Read(blob)
-	if err != nil {
-		return nil, err
-	}
-	if n != len(blob) {
-		return nil, errors.New("unexpected EOF")
-	}
-	consumed := 0
-	for offset := 0; offset < len(blob); offset += consumed {
-		entry := &TailPositionFileEntry{
-			positionFile: positionFile,
-			offset:       offset,
-			isNew:        false,
-			data:         tailPositionFileData{},
-		}
-		consumed, err = unmarshalPositionFileData(&entry.data, blob[offset:])
-		if err != nil {
-			return nil, err
-		}
-		retval[entry.data.Path] = entry
-	}
-	positionFile.view = blob
-	return retval, nil
-}
-
-func openPositionFile(logger ik.Logger, path string) (*TailPositionFile, error) {
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666) // FIXME
-	failed := true
-	defer func() {
-		if failed && f != nil {
-			f.Close()
-		}
-	}()
-	var entries map[string]*TailPositionFileEntry
+func newTailPositionFile(logger ik.Logger, store position.Store) *TailPositionFile {
 	retval := &TailPositionFile{
-		logger:      logger,
-		refcount:    1,
-		path:        path,
-		controlChan: make(chan bool),
-		mtx:         sync.Mutex{},
+		logger:   logger,
+		refcount: 1,
+		store:    store,
+		entries:  make(map[string]*TailPositionFileEntry),
+		syncChan: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		mtx:      sync.Mutex{},
 	}
-	if err != nil {
-		if !os.IsExist(err) {
-			return nil, err
-		}
-		f, err = os.OpenFile(path, os.O_RDWR, 0666)
-		if err != nil {
-			return nil, err
-		}
-		entries, err = readTailPositionFileEntries(retval, f)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		entries = make(map[string]*TailPositionFileEntry)
-	}
-	retval.f = f
-	retval.entries = entries
-	failed = false
 	go retval.doUpdate()
-	return retval, nil
-}
-
-func (positionFile *TailPositionFile) save() error {
-	_, err := positionFile.f.Seek(0, os.SEEK_SET)
-	if err != nil {
-		return err
-	}
-	l, err := positionFile.f.Write(positionFile.view)
-	if err != nil {
-		return err
-	}
-	if l != len(positionFile.view) {
-		return errors.New("marshalled data not fully written")
-	}
-	return nil
+	return retval
 }
 
 func (positionFile *TailPositionFile) addRef() {
@@ -814,14 +746,8 @@ func (positionFile *TailPositionFile) addRef() {
 func (positionFile *TailPositionFile) deleteRef() error {
 	positionFile.refcount -= 1
 	if positionFile.refcount == 0 {
-		err := positionFile.f.Close()
-		if err != nil {
-			positionFile.refcount += 1 // undo the change
-			return err
-		}
-		positionFile.f = nil
-		positionFile.controlChan <- true
-		close(positionFile.controlChan)
+		close(positionFile.done)
+		return positionFile.store.Close()
 	} else if positionFile.refcount < 0 {
 		panic("refcount < 0!")
 	}
@@ -839,7 +765,7 @@ type TailWatcher struct {
 	lineParser     ik.LineParser
 	handler        *TailEventHandler
 	statWatcher    *fsnotify.Watcher
-	timer          *time.Ticker
+	timer          ik.Ticker
 	controlChan    chan bool
 }
 
@@ -864,14 +790,14 @@ func (watcher *TailWatcher) Run() error {
 		case err := <-watcher.statWatcher.Error:
 			watcher.input.logger.Error("%s", err.Error())
 		case <-watcher.statWatcher.Event:
-			now := time.Now()
+			now := watcher.input.engine.Clock().Now()
 			err := watcher.handler.OnChange(now)
 			if err != nil {
 				watcher.input.logger.Error("%s", err.Error())
 				return err
 			}
 			return ik.Continue
-		case now := <-watcher.timer.C:
+		case now := <-watcher.timer.C():
 			err := watcher.handler.OnChange(now)
 			if err != nil {
 				watcher.input.logger.Error("%s", err.Error())
@@ -882,7 +808,7 @@ func (watcher *TailWatcher) Run() error {
 			if needsToBeStopped {
 				break
 			}
-			now := time.Now()
+			now := watcher.input.engine.Clock().Now()
 			err := watcher.handler.OnChange(now)
 			if err != nil {
 				watcher.input.logger.Error("%s", err.Error())
@@ -978,11 +904,18 @@ func (input *TailInput) openTailWatcher(path string) (*TailWatcher, error) {
 	if err != nil {
 		return nil, err
 	}
-	lineParser, err := input.lineParserFactory.New(func(record ik.FluentRecord) error {
+	receiver := func(record ik.FluentRecord) error {
 		record.Tag = input.tagPrefix
 		input.pump.EmitOne(record)
 		return nil
-	})
+	}
+	var lineParser ik.LineParser
+	pathLineParserFactory, ok := input.lineParserFactory.(ik.PathLineParserFactory)
+	if ok {
+		lineParser, err = pathLineParserFactory.NewForPath(path, receiver)
+	} else {
+		lineParser, err = input.lineParserFactory.New(receiver)
+	}
 	if err != nil {
 		handler.Dispose()
 		return nil, err
@@ -1004,7 +937,7 @@ func (input *TailInput) openTailWatcher(path string) (*TailWatcher, error) {
 	watcher.handler = handler
 	watcher.statWatcher = newStatWatcher
 	watcher.lineParser = lineParser
-	watcher.timer = time.NewTicker(time.Duration(1000000000)) // XXX
+	watcher.timer = input.engine.Clock().NewTicker(time.Duration(1000000000)) // XXX
 	watcher.controlChan = make(chan bool, 1)
 
 	err = input.engine.Spawn(watcher)
@@ -1032,7 +965,7 @@ type TailInput struct {
 	positionFile      *TailPositionFile
 	pump              *ik.RecordPump
 	watchers          map[string]*TailWatcher
-	refreshTimer      *time.Ticker
+	refreshTimer      ik.Ticker
 	controlChan       chan struct{}
 }
 
@@ -1047,7 +980,7 @@ func (input *TailInput) Port() ik.Port {
 func (input *TailInput) Run() error {
 	for {
 		select {
-		case <-input.refreshTimer.C:
+		case <-input.refreshTimer.C():
 			err := input.refreshWatchers()
 			if err != nil {
 				return err
@@ -1141,22 +1074,19 @@ func newTailInput(
 	tagPrefix string,
 	tagSuffix string,
 	rotateWait time.Duration,
-	positionFilePath string,
+	store position.Store,
 	readFromHead bool,
 	refreshInterval time.Duration,
 	readBufferSize int,
 ) (*TailInput, error) {
 	failed := true
-	positionFile, err := openPositionFile(logger, positionFilePath)
-	if err != nil {
-		return nil, err
-	}
+	positionFile := newTailPositionFile(logger, store)
 	defer func() {
 		if failed {
 			positionFile.Dispose()
 		}
 	}()
-	pump := ik.NewRecordPump(port, DefaultBacklogSize)
+	pump := ik.NewRecordPump(port, DefaultBacklogSize, engine.Clock())
 	defer func() {
 		if failed {
 			pump.Shutdown()
@@ -1180,7 +1110,7 @@ func newTailInput(
 		watchers:          make(map[string]*TailWatcher),
 		controlChan:       make(chan struct{}, 1),
 	}
-	err = engine.Spawn(pump)
+	err := engine.Spawn(pump)
 	if err != nil {
 		return nil, err
 	}
@@ -1189,7 +1119,7 @@ func newTailInput(
 		return nil, err
 	}
 	failed = false
-	input.refreshTimer = time.NewTicker(refreshInterval)
+	input.refreshTimer = engine.Clock().NewTicker(refreshInterval)
 	return input, nil
 }
 
@@ -1238,7 +1168,6 @@ func (factory *TailInputFactory) New(engine ik.Engine, config *ik.ConfigElement)
 	tagPrefix := ""
 	tagSuffix := ""
 	rotateWait, _ := time.ParseDuration("5s")
-	positionFilePath := ""
 	readFromHead := false
 	refreshInterval, _ := time.ParseDuration("1m")
 	readBufferSize := 4096
@@ -1267,10 +1196,6 @@ func (factory *TailInputFactory) New(engine ik.Engine, config *ik.ConfigElement)
 			return nil, err
 		}
 	}
-	positionFilePath, ok = config.Attrs["pos_file"]
-	if !ok {
-		return nil, errors.New("requires attribute `pos_file' is not specified")
-	}
 	readFromHeadStr, ok := config.Attrs["read_from_head"]
 	if ok {
 		var err error
@@ -1309,6 +1234,13 @@ func (factory *TailInputFactory) New(engine ik.Engine, config *ik.ConfigElement)
 	if err != nil {
 		return nil, err
 	}
+	store, err := openPositionStore(config)
+	if err != nil {
+		return nil, err
+	}
+	if store == nil {
+		return nil, errors.New("requires attribute `pos_file' is not specified")
+	}
 
 	return newTailInput(
 		factory,
@@ -1320,7 +1252,7 @@ func (factory *TailInputFactory) New(engine ik.Engine, config *ik.ConfigElement)
 		tagPrefix,
 		tagSuffix,
 		rotateWait,
-		positionFilePath,
+		store,
 		readFromHead,
 		refreshInterval,
 		readBufferSize,
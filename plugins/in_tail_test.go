@@ -2,8 +2,11 @@ package plugins
 
 import (
 	fileid "github.com/moriyoshi/go-fileid"
+	"github.com/moriyoshi/ik/position"
 	"io"
 	"io/ioutil"
+	"os"
+	"path"
 	"strings"
 	"testing"
 )
@@ -422,3 +425,43 @@ func Test_buildTagFromPath(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func Test_TailPositionFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "in_tail")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	store, err := position.OpenFileStore(path.Join(dir, "test.pos"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	positionFile := newTailPositionFile(&testLogger{t}, store)
+	info := positionFile.Get("/var/log/test")
+	if !info.IsNew() {
+		t.Fail()
+	}
+	info.SetPosition(1000)
+	err = info.Save()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	info.Dispose()
+	err = positionFile.Dispose()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the position is read back after a restart
+	store, err = position.OpenFileStore(path.Join(dir, "test.pos"))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	positionFile = newTailPositionFile(&testLogger{t}, store)
+	defer positionFile.Dispose()
+	info = positionFile.Get("/var/log/test")
+	defer info.Dispose()
+	if info.IsNew() || info.GetPosition() != 1000 {
+		t.Fatalf("%v %d", info.IsNew(), info.GetPosition())
+	}
+}
@@ -0,0 +1,392 @@
+package plugins
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/klauspost/compress/zstd"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// The layout of the journal files journald writes, as described in
+// https://systemd.io/JOURNAL_FILE_FORMAT/.
+const (
+	journalHeaderSize = 208
+
+	journalIncompatibleCompressedXZ   = 1
+	journalIncompatibleCompressedLZ4  = 2
+	journalIncompatibleKeyedHash      = 4
+	journalIncompatibleCompressedZSTD = 8
+	journalIncompatibleCompact        = 16
+	journalIncompatibleSupported      = journalIncompatibleCompressedXZ | journalIncompatibleCompressedLZ4 | journalIncompatibleKeyedHash | journalIncompatibleCompressedZSTD | journalIncompatibleCompact
+
+	journalObjectData       = 1
+	journalObjectEntry      = 3
+	journalObjectEntryArray = 6
+
+	journalObjectCompressedXZ   = 1
+	journalObjectCompressedLZ4  = 2
+	journalObjectCompressedZSTD = 4
+
+	journalObjectHeaderSize     = 16
+	journalEntryObjectSize      = 64
+	journalEntryArrayObjectSize = 24
+)
+
+var journalSignature = []byte("LPKSHHRH")
+
+var errJournalCompression = errors.New("the field is compressed with xz, which is not supported")
+
+// journalPosition is where an entry stands in the journal: journald counts
+// the entries by the sequence seqnumID, and those of different sequences
+// are ordered by the wallclock time they were written at.
+type journalPosition struct {
+	valid    bool
+	seqnumID [16]byte
+	seqnum   uint64
+	realtime uint64
+}
+
+// before tells whether the entry at position comes before that at other.
+func (position journalPosition) before(other journalPosition) bool {
+	if !position.valid {
+		return other.valid
+	}
+	if position.seqnumID == other.seqnumID {
+		return position.seqnum < other.seqnum
+	}
+	return position.realtime < other.realtime
+}
+
+// parseJournalCursor reads the position out of a cursor as journald makes
+// it, such as "s=...;i=...;b=...;m=...;t=...;x=...".
+func parseJournalCursor(cursor string) (journalPosition, error) {
+	position := journalPosition{}
+	seen := 0
+	for _, item := range strings.Split(cursor, ";") {
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return position, errors.New("invalid cursor: " + cursor)
+		}
+		var err error
+		switch kv[0] {
+		case "s":
+			var b []byte
+			b, err = hex.DecodeString(kv[1])
+			if err == nil && len(b) != len(position.seqnumID) {
+				err = errors.New("invalid cursor: " + cursor)
+			}
+			copy(position.seqnumID[:], b)
+		case "i":
+			position.seqnum, err = strconv.ParseUint(kv[1], 16, 64)
+		case "t":
+			position.realtime, err = strconv.ParseUint(kv[1], 16, 64)
+		default:
+			continue
+		}
+		if err != nil {
+			return position, err
+		}
+		seen += 1
+	}
+	if seen != 3 {
+		return position, errors.New("invalid cursor: " + cursor)
+	}
+	position.valid = true
+	return position, nil
+}
+
+type journalEntry struct {
+	journalPosition
+	monotonic uint64
+	bootID    [16]byte
+	xorHash   uint64
+	// the fields in the form of NAME=value
+	fields [][]byte
+}
+
+// cursor makes the cursor of the entry the way journald does, so that
+// journalctl --after-cursor takes it as well.
+func (entry *journalEntry) cursor() string {
+	return fmt.Sprintf("s=%x;i=%x;b=%x;m=%x;t=%x;x=%x", entry.seqnumID[:], entry.seqnum, entry.bootID[:], entry.monotonic, entry.realtime, entry.xorHash)
+}
+
+// journalFile reads the entries of a journal file in the order they were
+// appended, going on from where it stopped as journald appends more.
+type journalFile struct {
+	file     *os.File
+	info     os.FileInfo
+	fileID   [16]byte
+	seqnumID [16]byte
+	flags    uint32
+	nEntries uint64
+	tail     journalPosition
+	first    uint64
+	// the entry array read and the index of the next item in it
+	array uint64
+	index uint64
+	read  uint64
+	// the next entry, read ahead to be merged with the other files
+	head *journalEntry
+}
+
+func openJournalFile(path string) (*journalFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	journal := &journalFile{file: file}
+	err = journal.readHeader()
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return journal, nil
+}
+
+func (journal *journalFile) Close() error {
+	return journal.file.Close()
+}
+
+func (journal *journalFile) compact() bool {
+	return journal.flags&journalIncompatibleCompact != 0
+}
+
+// readHeader reads the header again for the entries appended since.
+func (journal *journalFile) readHeader() error {
+	info, err := journal.file.Stat()
+	if err != nil {
+		return err
+	}
+	journal.info = info
+	header := make([]byte, journalHeaderSize)
+	_, err = journal.file.ReadAt(header, 0)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(header[0:8], journalSignature) {
+		return errors.New("not a journal file")
+	}
+	journal.flags = binary.LittleEndian.Uint32(header[12:16])
+	if journal.flags&^journalIncompatibleSupported != 0 {
+		return fmt.Errorf("unsupported incompatible flags: %#x", journal.flags)
+	}
+	copy(journal.fileID[:], header[24:40])
+	copy(journal.seqnumID[:], header[72:88])
+	journal.nEntries = binary.LittleEndian.Uint64(header[152:160])
+	journal.first = binary.LittleEndian.Uint64(header[176:184])
+	journal.tail = journalPosition{
+		valid:    journal.nEntries > 0,
+		seqnumID: journal.seqnumID,
+		seqnum:   binary.LittleEndian.Uint64(header[160:168]),
+		realtime: binary.LittleEndian.Uint64(header[192:200]),
+	}
+	return nil
+}
+
+func (journal *journalFile) readObject(offset uint64, type_ byte, minSize uint64) ([]byte, byte, error) {
+	header := make([]byte, journalObjectHeaderSize)
+	_, err := journal.file.ReadAt(header, int64(offset))
+	if err != nil {
+		return nil, 0, err
+	}
+	size := binary.LittleEndian.Uint64(header[8:16])
+	if header[0] != type_ || size < minSize || size > uint64(journal.info.Size()) {
+		return nil, 0, fmt.Errorf("invalid object at %d", offset)
+	}
+	object := make([]byte, size)
+	_, err = journal.file.ReadAt(object, int64(offset))
+	if err != nil {
+		return nil, 0, err
+	}
+	return object, header[1], nil
+}
+
+func (journal *journalFile) item(b []byte, i uint64) uint64 {
+	if journal.compact() {
+		return uint64(binary.LittleEndian.Uint32(b[i*4:]))
+	}
+	return binary.LittleEndian.Uint64(b[i*8:])
+}
+
+// next returns the offset of the entry that follows the last one, or zero
+// if there is none yet.
+func (journal *journalFile) next() (uint64, error) {
+	if journal.read >= journal.nEntries {
+		return 0, nil
+	}
+	if journal.array == 0 {
+		if journal.first == 0 {
+			return 0, nil
+		}
+		journal.array = journal.first
+		journal.index = 0
+	}
+	itemSize := uint64(8)
+	if journal.compact() {
+		itemSize = 4
+	}
+	for {
+		object, _, err := journal.readObject(journal.array, journalObjectEntryArray, journalEntryArrayObjectSize)
+		if err != nil {
+			return 0, err
+		}
+		items := object[journalEntryArrayObjectSize:]
+		if journal.index < uint64(len(items))/itemSize {
+			offset := journal.item(items, journal.index)
+			if offset == 0 {
+				return 0, nil
+			}
+			journal.index += 1
+			journal.read += 1
+			return offset, nil
+		}
+		nextArray := binary.LittleEndian.Uint64(object[16:24])
+		if nextArray == 0 {
+			return 0, nil
+		}
+		journal.array = nextArray
+		journal.index = 0
+	}
+}
+
+// readEntry reads the entry at offset, without the fields unless withFields
+// is true.  The fields that cannot be decompressed are left out, and their
+// number is returned along with the entry.
+func (journal *journalFile) readEntry(offset uint64, withFields bool) (*journalEntry, int, error) {
+	object, _, err := journal.readObject(offset, journalObjectEntry, journalEntryObjectSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	entry := &journalEntry{
+		journalPosition: journalPosition{
+			valid:    true,
+			seqnumID: journal.seqnumID,
+			seqnum:   binary.LittleEndian.Uint64(object[16:24]),
+			realtime: binary.LittleEndian.Uint64(object[24:32]),
+		},
+		monotonic: binary.LittleEndian.Uint64(object[32:40]),
+		xorHash:   binary.LittleEndian.Uint64(object[56:64]),
+	}
+	copy(entry.bootID[:], object[40:56])
+	if !withFields {
+		return entry, 0, nil
+	}
+	itemSize := uint64(16)
+	if journal.compact() {
+		itemSize = 4
+	}
+	items := object[journalEntryObjectSize:]
+	skipped := 0
+	for i := uint64(0); i < uint64(len(items))/itemSize; i++ {
+		field, err := journal.readData(journal.item(items[i*itemSize:], 0))
+		if err == errJournalCompression {
+			skipped += 1
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		entry.fields = append(entry.fields, field)
+	}
+	return entry, skipped, nil
+}
+
+func (journal *journalFile) readData(offset uint64) ([]byte, error) {
+	payloadOffset := uint64(64)
+	if journal.compact() {
+		payloadOffset = 72
+	}
+	object, flags, err := journal.readObject(offset, journalObjectData, payloadOffset)
+	if err != nil {
+		return nil, err
+	}
+	payload := object[payloadOffset:]
+	switch {
+	case flags&journalObjectCompressedXZ != 0:
+		return nil, errJournalCompression
+	case flags&journalObjectCompressedLZ4 != 0:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("invalid object at %d", offset)
+		}
+		return decompressLZ4Block(payload[8:], binary.LittleEndian.Uint64(payload[0:8]))
+	case flags&journalObjectCompressedZSTD != 0:
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(payload, nil)
+	}
+	return payload, nil
+}
+
+// decompressLZ4Block decompresses a block of LZ4, of size bytes once
+// decompressed.
+func decompressLZ4Block(src []byte, size uint64) ([]byte, error) {
+	errCorrupt := errors.New("corrupt LZ4 block")
+	dst := make([]byte, 0, size)
+	length := func(i int, n int) (int, int, error) {
+		if n != 15 {
+			return i, n, nil
+		}
+		for {
+			if i >= len(src) {
+				return 0, 0, errCorrupt
+			}
+			b := src[i]
+			i += 1
+			n += int(b)
+			if b != 255 {
+				return i, n, nil
+			}
+		}
+	}
+	i := 0
+	for i < len(src) {
+		token := src[i]
+		i += 1
+		var n int
+		var err error
+		i, n, err = length(i, int(token>>4))
+		if err != nil {
+			return nil, err
+		}
+		if i+n > len(src) {
+			return nil, errCorrupt
+		}
+		dst = append(dst, src[i:i+n]...)
+		i += n
+		if i == len(src) {
+			break
+		}
+		if i+2 > len(src) {
+			return nil, errCorrupt
+		}
+		distance := int(src[i]) | int(src[i+1])<<8
+		i += 2
+		i, n, err = length(i, int(token&15))
+		if err != nil {
+			return nil, err
+		}
+		n += 4
+		if distance == 0 || distance > len(dst) {
+			return nil, errCorrupt
+		}
+		start := len(dst) - distance
+		for j := 0; j < n; j++ {
+			dst = append(dst, dst[start+j])
+		}
+		if uint64(len(dst)) > size {
+			return nil, errCorrupt
+		}
+	}
+	if uint64(len(dst)) != size {
+		return nil, errCorrupt
+	}
+	return dst, nil
+}
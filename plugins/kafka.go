@@ -0,0 +1,611 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// A minimal Kafka producer speaking Metadata v4 and Produce v3, the oldest
+// versions still accepted by current brokers, with v2 record batches.
+// Produce v7 is used instead for zstd, which brokers refuse on earlier
+// versions (KIP-110).
+
+const (
+	kafkaProduceKey         = 0
+	kafkaMetadataKey        = 3
+	kafkaProduceVersion     = 3
+	kafkaProduceZstdVersion = 7
+	kafkaMetadataVersion    = 4
+	kafkaCompressionNone    = 0
+	kafkaCompressionGzip    = 1
+	kafkaCompressionZstd    = 4
+	kafkaMaxResponseSize    = 64 * 1024 * 1024
+	kafkaRecordBatchMagic   = 2
+)
+
+var kafkaCastagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+type kafkaMessage struct {
+	key       []byte
+	value     []byte
+	timestamp int64 // milliseconds
+}
+
+type kafkaBroker struct {
+	id   int32
+	addr string
+}
+
+type kafkaPartition struct {
+	id     int32
+	leader int32
+}
+
+type kafkaTopicMetadata struct {
+	partitions []kafkaPartition
+}
+
+type kafkaMetadata struct {
+	brokers map[int32]kafkaBroker
+	topics  map[string]kafkaTopicMetadata
+}
+
+type kafkaConn struct {
+	conn          net.Conn
+	reader        *bufio.Reader
+	correlationId int32
+}
+
+type kafkaClient struct {
+	bootstrap     []string
+	clientId      string
+	timeout       time.Duration
+	conns         map[string]*kafkaConn
+	metadata      *kafkaMetadata
+	compression   int16
+	compress      func(data []byte) ([]byte, error)
+	version       int16 // of the produce requests
+	socketOptions *ik.SocketOptions
+	mtx           sync.Mutex
+}
+
+type kafkaEncoder struct {
+	bytes.Buffer
+}
+
+type kafkaDecoder struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (encoder *kafkaEncoder) putInt8(v int8) {
+	encoder.WriteByte(byte(v))
+}
+
+func (encoder *kafkaEncoder) putInt16(v int16) {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], uint16(v))
+	encoder.Write(b[:])
+}
+
+func (encoder *kafkaEncoder) putInt32(v int32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], uint32(v))
+	encoder.Write(b[:])
+}
+
+func (encoder *kafkaEncoder) putInt64(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	encoder.Write(b[:])
+}
+
+func (encoder *kafkaEncoder) putVarint(v int64) {
+	var b [binary.MaxVarintLen64]byte
+	encoder.Write(b[0:binary.PutVarint(b[:], v)])
+}
+
+func (encoder *kafkaEncoder) putString(v string) {
+	encoder.putInt16(int16(len(v)))
+	encoder.WriteString(v)
+}
+
+func (encoder *kafkaEncoder) putNullableString(v *string) {
+	if v == nil {
+		encoder.putInt16(-1)
+		return
+	}
+	encoder.putString(*v)
+}
+
+func (encoder *kafkaEncoder) putBytes(v []byte) {
+	encoder.putInt32(int32(len(v)))
+	encoder.Write(v)
+}
+
+func (decoder *kafkaDecoder) take(n int) []byte {
+	if decoder.err != nil {
+		return nil
+	}
+	if n < 0 || decoder.offset+n > len(decoder.data) {
+		decoder.err = errors.New("malformed response from the broker")
+		return nil
+	}
+	retval := decoder.data[decoder.offset : decoder.offset+n]
+	decoder.offset += n
+	return retval
+}
+
+func (decoder *kafkaDecoder) int8() int8 {
+	b := decoder.take(1)
+	if b == nil {
+		return 0
+	}
+	return int8(b[0])
+}
+
+func (decoder *kafkaDecoder) int16() int16 {
+	b := decoder.take(2)
+	if b == nil {
+		return 0
+	}
+	return int16(binary.BigEndian.Uint16(b))
+}
+
+func (decoder *kafkaDecoder) int32() int32 {
+	b := decoder.take(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.BigEndian.Uint32(b))
+}
+
+func (decoder *kafkaDecoder) int64() int64 {
+	b := decoder.take(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (decoder *kafkaDecoder) nullableString() *string {
+	n := decoder.int16()
+	if n < 0 {
+		return nil
+	}
+	retval := string(decoder.take(int(n)))
+	return &retval
+}
+
+func (decoder *kafkaDecoder) string() string {
+	v := decoder.nullableString()
+	if v == nil {
+		return ""
+	}
+	return *v
+}
+
+func (decoder *kafkaDecoder) arrayLen() int {
+	n := int(decoder.int32())
+	if n > len(decoder.data)-decoder.offset {
+		decoder.err = errors.New("malformed response from the broker")
+		return 0
+	}
+	return n
+}
+
+// kafkaMurmur2 is the hash the Java client partitions keys with, so that
+// records with the same key end up in the same partitions as theirs.
+func kafkaMurmur2(data []byte) int32 {
+	const m = uint32(0x5bd1e995)
+	const r = 24
+	length := len(data)
+	h := uint32(0x9747b28c) ^ uint32(length)
+	for i := 0; i+4 <= length; i += 4 {
+		k := binary.LittleEndian.Uint32(data[i : i+4])
+		k *= m
+		k ^= k >> r
+		k *= m
+		h *= m
+		h ^= k
+	}
+	tail := length &^ 3
+	switch length & 3 {
+	case 3:
+		h ^= uint32(data[tail+2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[tail+1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[tail])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return int32(h)
+}
+
+func kafkaPartitionForKey(key []byte, numPartitions int) int {
+	return int(uint32(kafkaMurmur2(key))&0x7fffffff) % numPartitions
+}
+
+func encodeKafkaRecord(encoder *kafkaEncoder, message kafkaMessage, offsetDelta int, firstTimestamp int64) {
+	record := &kafkaEncoder{}
+	record.putInt8(0) // attributes
+	record.putVarint(message.timestamp - firstTimestamp)
+	record.putVarint(int64(offsetDelta))
+	if message.key == nil {
+		record.putVarint(-1)
+	} else {
+		record.putVarint(int64(len(message.key)))
+		record.Write(message.key)
+	}
+	record.putVarint(int64(len(message.value)))
+	record.Write(message.value)
+	record.putVarint(0) // headers
+	encoder.putVarint(int64(record.Len()))
+	encoder.Write(record.Bytes())
+}
+
+// encodeKafkaRecordBatch builds a v2 record batch.  When compressed, the
+// records following the record count are compressed as a whole.
+func encodeKafkaRecordBatch(messages []kafkaMessage, compression int16, compress func([]byte) ([]byte, error)) ([]byte, error) {
+	if len(messages) == 0 {
+		return nil, errors.New("empty record batch")
+	}
+	firstTimestamp, maxTimestamp := messages[0].timestamp, messages[0].timestamp
+	records := &kafkaEncoder{}
+	for i, message := range messages {
+		if message.timestamp > maxTimestamp {
+			maxTimestamp = message.timestamp
+		}
+		encodeKafkaRecord(records, message, i, firstTimestamp)
+	}
+	recordsBytes := records.Bytes()
+	if compression != kafkaCompressionNone {
+		var err error
+		recordsBytes, err = compress(recordsBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	body := &kafkaEncoder{}
+	body.putInt16(compression) // attributes
+	body.putInt32(int32(len(messages) - 1))
+	body.putInt64(firstTimestamp)
+	body.putInt64(maxTimestamp)
+	body.putInt64(-1) // producer id
+	body.putInt16(-1) // producer epoch
+	body.putInt32(-1) // base sequence
+	body.putInt32(int32(len(messages)))
+	body.Write(recordsBytes)
+
+	batch := &kafkaEncoder{}
+	batch.putInt64(0) // base offset
+	batch.putInt32(int32(4 + 1 + 4 + body.Len()))
+	batch.putInt32(-1) // partition leader epoch
+	batch.putInt8(kafkaRecordBatchMagic)
+	batch.putInt32(int32(crc32.Checksum(body.Bytes(), kafkaCastagnoli)))
+	batch.Write(body.Bytes())
+	return batch.Bytes(), nil
+}
+
+func kafkaErrorCode(code int16) error {
+	switch code {
+	case 0:
+		return nil
+	case 2:
+		return errors.New("CORRUPT_MESSAGE")
+	case 3:
+		return errors.New("UNKNOWN_TOPIC_OR_PARTITION")
+	case 5:
+		return errors.New("LEADER_NOT_AVAILABLE")
+	case 6:
+		return errors.New("NOT_LEADER_OR_FOLLOWER")
+	case 7:
+		return errors.New("REQUEST_TIMED_OUT")
+	case 10:
+		return errors.New("MESSAGE_TOO_LARGE")
+	case 19:
+		return errors.New("NOT_ENOUGH_REPLICAS")
+	case 20:
+		return errors.New("NOT_ENOUGH_REPLICAS_AFTER_APPEND")
+	case 29:
+		return errors.New("TOPIC_AUTHORIZATION_FAILED")
+	}
+	return errors.New("error code " + strconv.Itoa(int(code)))
+}
+
+func (conn *kafkaConn) roundTrip(apiKey int16, apiVersion int16, clientId string, body []byte, expectResponse bool, timeout time.Duration) ([]byte, error) {
+	conn.correlationId += 1
+	request := &kafkaEncoder{}
+	request.putInt32(0) // filled below
+	request.putInt16(apiKey)
+	request.putInt16(apiVersion)
+	request.putInt32(conn.correlationId)
+	request.putNullableString(&clientId)
+	request.Write(body)
+	requestBytes := request.Bytes()
+	binary.BigEndian.PutUint32(requestBytes[0:4], uint32(len(requestBytes)-4))
+	conn.conn.SetDeadline(time.Now().Add(timeout))
+	_, err := conn.conn.Write(requestBytes)
+	if err != nil {
+		return nil, err
+	}
+	if !expectResponse {
+		return nil, nil
+	}
+	var sizeBytes [4]byte
+	_, err = io.ReadFull(conn.reader, sizeBytes[:])
+	if err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(sizeBytes[:])
+	if size < 4 || size > kafkaMaxResponseSize {
+		return nil, errors.New(fmt.Sprintf("invalid response size: %d", size))
+	}
+	response := make([]byte, size)
+	_, err = io.ReadFull(conn.reader, response)
+	if err != nil {
+		return nil, err
+	}
+	correlationId := int32(binary.BigEndian.Uint32(response[0:4]))
+	if correlationId != conn.correlationId {
+		return nil, errors.New(fmt.Sprintf("correlation id mismatch: expected %d, got %d", conn.correlationId, correlationId))
+	}
+	return response[4:], nil
+}
+
+func (client *kafkaClient) conn(addr string) (*kafkaConn, error) {
+	conn, ok := client.conns[addr]
+	if ok {
+		return conn, nil
+	}
+	netConn, err := client.socketOptions.Dial("tcp", addr, client.timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn = &kafkaConn{conn: netConn, reader: bufio.NewReader(netConn)}
+	client.conns[addr] = conn
+	return conn, nil
+}
+
+func (client *kafkaClient) closeConn(addr string) {
+	conn, ok := client.conns[addr]
+	if ok {
+		conn.conn.Close()
+		delete(client.conns, addr)
+	}
+}
+
+func decodeKafkaMetadata(data []byte) (*kafkaMetadata, error) {
+	decoder := &kafkaDecoder{data: data}
+	decoder.int32() // throttle time
+	retval := &kafkaMetadata{
+		brokers: make(map[int32]kafkaBroker),
+		topics:  make(map[string]kafkaTopicMetadata),
+	}
+	n := decoder.arrayLen()
+	for i := 0; i < n && decoder.err == nil; i++ {
+		id := decoder.int32()
+		host := decoder.string()
+		port := decoder.int32()
+		decoder.nullableString() // rack
+		retval.brokers[id] = kafkaBroker{id, net.JoinHostPort(host, strconv.Itoa(int(port)))}
+	}
+	decoder.nullableString() // cluster id
+	decoder.int32()          // controller id
+	n = decoder.arrayLen()
+	for i := 0; i < n && decoder.err == nil; i++ {
+		errorCode := decoder.int16()
+		name := decoder.string()
+		decoder.int8() // is internal
+		m := decoder.arrayLen()
+		topic := kafkaTopicMetadata{make([]kafkaPartition, 0, m)}
+		for j := 0; j < m && decoder.err == nil; j++ {
+			decoder.int16() // error code
+			partition := kafkaPartition{}
+			partition.id = decoder.int32()
+			partition.leader = decoder.int32()
+			for k, l := 0, decoder.arrayLen(); k < l; k++ {
+				decoder.int32() // replicas
+			}
+			for k, l := 0, decoder.arrayLen(); k < l; k++ {
+				decoder.int32() // in-sync replicas
+			}
+			topic.partitions = append(topic.partitions, partition)
+		}
+		if errorCode == 0 {
+			retval.topics[name] = topic
+		}
+	}
+	if decoder.err != nil {
+		return nil, decoder.err
+	}
+	return retval, nil
+}
+
+func (client *kafkaClient) refreshMetadata(topics []string) error {
+	request := &kafkaEncoder{}
+	request.putInt32(int32(len(topics)))
+	for _, topic := range topics {
+		request.putString(topic)
+	}
+	request.putInt8(1) // allow auto topic creation
+	var lastErr error
+	for _, addr := range client.bootstrap {
+		conn, err := client.conn(addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		response, err := conn.roundTrip(kafkaMetadataKey, kafkaMetadataVersion, client.clientId, request.Bytes(), true, client.timeout)
+		if err != nil {
+			client.closeConn(addr)
+			lastErr = err
+			continue
+		}
+		metadata, err := decodeKafkaMetadata(response)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		client.metadata = metadata
+		return nil
+	}
+	return errors.New("failed to fetch metadata from any of the brokers: " + lastErr.Error())
+}
+
+func decodeKafkaProduceResponse(data []byte, version int16) error {
+	decoder := &kafkaDecoder{data: data}
+	var retval error
+	for i, n := 0, decoder.arrayLen(); i < n && decoder.err == nil; i++ {
+		topic := decoder.string()
+		for j, m := 0, decoder.arrayLen(); j < m && decoder.err == nil; j++ {
+			partition := decoder.int32()
+			errorCode := decoder.int16()
+			decoder.int64() // base offset
+			decoder.int64() // log append time
+			if version >= 5 {
+				decoder.int64() // log start offset
+			}
+			if errorCode != 0 && retval == nil {
+				retval = errors.New(fmt.Sprintf("failed to produce to %s/%d: %s", topic, partition, kafkaErrorCode(errorCode).Error()))
+			}
+		}
+	}
+	if decoder.err != nil {
+		return decoder.err
+	}
+	return retval
+}
+
+func (client *kafkaClient) partitions(topic string) ([]kafkaPartition, error) {
+	if client.metadata != nil {
+		topicMetadata, ok := client.metadata.topics[topic]
+		if ok && len(topicMetadata.partitions) > 0 {
+			return topicMetadata.partitions, nil
+		}
+	}
+	err := client.refreshMetadata([]string{topic})
+	if err != nil {
+		return nil, err
+	}
+	topicMetadata, ok := client.metadata.topics[topic]
+	if !ok || len(topicMetadata.partitions) == 0 {
+		return nil, errors.New("no partitions available for topic " + topic)
+	}
+	return topicMetadata.partitions, nil
+}
+
+// produce sends the messages to the topic in a single request per partition
+// leader.  Messages without a key go to the partition given by
+// partitionForNilKey, so that a chunk is not scattered across partitions.
+func (client *kafkaClient) produce(topic string, messages []kafkaMessage, requiredAcks int16, ackTimeout time.Duration, partitionForNilKey int) error {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	partitions, err := client.partitions(topic)
+	if err != nil {
+		return err
+	}
+	byPartition := make(map[int][]kafkaMessage)
+	for _, message := range messages {
+		var i int
+		if message.key == nil {
+			i = partitionForNilKey % len(partitions)
+		} else {
+			i = kafkaPartitionForKey(message.key, len(partitions))
+		}
+		byPartition[i] = append(byPartition[i], message)
+	}
+	byLeader := make(map[int32][]int)
+	for i, _ := range byPartition {
+		leader := partitions[i].leader
+		byLeader[leader] = append(byLeader[leader], i)
+	}
+	for leader, indices := range byLeader {
+		broker, ok := client.metadata.brokers[leader]
+		if !ok {
+			client.metadata = nil
+			return errors.New(fmt.Sprintf("leader %d of topic %s is not available", leader, topic))
+		}
+		request := &kafkaEncoder{}
+		request.putNullableString(nil) // transactional id
+		request.putInt16(requiredAcks)
+		request.putInt32(int32(ackTimeout / time.Millisecond))
+		request.putInt32(1)
+		request.putString(topic)
+		request.putInt32(int32(len(indices)))
+		for _, i := range indices {
+			batch, err := encodeKafkaRecordBatch(byPartition[i], client.compression, client.compress)
+			if err != nil {
+				return err
+			}
+			request.putInt32(partitions[i].id)
+			request.putBytes(batch)
+		}
+		err := client.send(broker.addr, request.Bytes(), requiredAcks != 0, ackTimeout)
+		if err != nil {
+			// the leadership may have moved; look it up again on retry
+			client.metadata = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (client *kafkaClient) send(addr string, request []byte, expectResponse bool, ackTimeout time.Duration) error {
+	conn, err := client.conn(addr)
+	if err != nil {
+		return err
+	}
+	response, err := conn.roundTrip(kafkaProduceKey, client.version, client.clientId, request, expectResponse, client.timeout+ackTimeout)
+	if err != nil {
+		client.closeConn(addr)
+		return err
+	}
+	if !expectResponse {
+		return nil
+	}
+	return decodeKafkaProduceResponse(response, client.version)
+}
+
+func (client *kafkaClient) close() {
+	client.mtx.Lock()
+	defer client.mtx.Unlock()
+	for addr, _ := range client.conns {
+		client.closeConn(addr)
+	}
+}
+
+func newKafkaClient(bootstrap []string, clientId string, timeout time.Duration, compression int16, compress func(data []byte) ([]byte, error)) *kafkaClient {
+	version := int16(kafkaProduceVersion)
+	if compression == kafkaCompressionZstd {
+		version = kafkaProduceZstdVersion
+	}
+	return &kafkaClient{
+		bootstrap:   bootstrap,
+		clientId:    clientId,
+		timeout:     timeout,
+		conns:       make(map[string]*kafkaConn),
+		metadata:    nil,
+		compression: compression,
+		compress:    compress,
+		version:     version,
+		mtx:         sync.Mutex{},
+	}
+}
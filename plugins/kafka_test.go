@@ -0,0 +1,194 @@
+package plugins
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func Test_kafkaMurmur2(t *testing.T) {
+	// taken from the tests of the Java client
+	cases := map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	}
+	for key, expected := range cases {
+		actual := kafkaMurmur2([]byte(key))
+		if actual != expected {
+			t.Logf("%s: expected %d, got %d", key, expected, actual)
+			t.Fail()
+		}
+	}
+}
+
+func readKafkaRequest(t *testing.T, conn net.Conn) (int16, int32, *kafkaDecoder) {
+	var sizeBytes [4]byte
+	_, err := io.ReadFull(conn, sizeBytes[:])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	request := make([]byte, binary.BigEndian.Uint32(sizeBytes[:]))
+	_, err = io.ReadFull(conn, request)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decoder := &kafkaDecoder{data: request}
+	apiKey := decoder.int16()
+	decoder.int16() // api version
+	correlationId := decoder.int32()
+	decoder.nullableString() // client id
+	return apiKey, correlationId, decoder
+}
+
+func writeKafkaResponse(conn net.Conn, correlationId int32, body *kafkaEncoder) {
+	response := &kafkaEncoder{}
+	response.putInt32(int32(4 + body.Len()))
+	response.putInt32(correlationId)
+	response.Write(body.Bytes())
+	conn.Write(response.Bytes())
+}
+
+// writeKafkaMetadata answers a metadata request with a single broker leading
+// the only partition of the topic.
+func writeKafkaMetadata(conn net.Conn, correlationId int32, host string, port int, topic string) {
+	metadata := &kafkaEncoder{}
+	metadata.putInt32(0) // throttle time
+	metadata.putInt32(1)
+	metadata.putInt32(1)
+	metadata.putString(host)
+	metadata.putInt32(int32(port))
+	metadata.putNullableString(nil)
+	metadata.putNullableString(nil)
+	metadata.putInt32(1)
+	metadata.putInt32(1)
+	metadata.putInt16(0)
+	metadata.putString(topic)
+	metadata.putInt8(0)
+	metadata.putInt32(1)
+	metadata.putInt16(0)
+	metadata.putInt32(0)
+	metadata.putInt32(1)
+	metadata.putInt32(0)
+	metadata.putInt32(0)
+	writeKafkaResponse(conn, correlationId, metadata)
+}
+
+func Test_kafkaClient_produce(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	host, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	records := make(chan int32, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		apiKey, correlationId, _ := readKafkaRequest(t, conn)
+		if apiKey != kafkaMetadataKey {
+			t.Errorf("unexpected api key %d", apiKey)
+			return
+		}
+		writeKafkaMetadata(conn, correlationId, host, port, "test")
+
+		apiKey, correlationId, decoder := readKafkaRequest(t, conn)
+		if apiKey != kafkaProduceKey {
+			t.Errorf("unexpected api key %d", apiKey)
+			return
+		}
+		decoder.nullableString() // transactional id
+		decoder.int16()          // acks
+		decoder.int32()          // timeout
+		decoder.int32()          // topics
+		topic := decoder.string()
+		decoder.int32() // partitions
+		decoder.int32() // partition
+		batch := decoder.take(int(decoder.int32()))
+		if decoder.err != nil || topic != "test" {
+			t.Errorf("malformed produce request")
+			return
+		}
+		batchDecoder := &kafkaDecoder{data: batch}
+		batchDecoder.int64() // base offset
+		batchDecoder.int32() // length
+		batchDecoder.int32() // partition leader epoch
+		if batchDecoder.int8() != kafkaRecordBatchMagic {
+			t.Errorf("unexpected magic")
+		}
+		crc := uint32(batchDecoder.int32())
+		if crc != crc32.Checksum(batch[batchDecoder.offset:], kafkaCastagnoli) {
+			t.Errorf("checksum mismatch")
+		}
+		batchDecoder.take(2 + 4 + 8 + 8 + 8 + 2 + 4)
+		records <- batchDecoder.int32()
+
+		produce := &kafkaEncoder{}
+		produce.putInt32(1)
+		produce.putString("test")
+		produce.putInt32(1)
+		produce.putInt32(0)
+		produce.putInt16(0)
+		produce.putInt64(0)
+		produce.putInt64(-1)
+		produce.putInt32(0) // throttle time
+		writeKafkaResponse(conn, correlationId, produce)
+	}()
+
+	client := newKafkaClient([]string{listener.Addr().String()}, "ik", 5*time.Second, kafkaCompressionNone, nil)
+	defer client.close()
+	messages := []kafkaMessage{
+		{key: []byte("a"), value: []byte("{\"x\":1}"), timestamp: 1000},
+		{key: nil, value: []byte("{\"x\":2}"), timestamp: 2000},
+		{key: []byte("b"), value: []byte("{\"x\":3}"), timestamp: 3000},
+	}
+	err = client.produce("test", messages, -1, time.Second, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if n := <-records; n != 3 {
+		t.Logf("%d records in the batch", n)
+		t.Fail()
+	}
+}
+
+func Test_decodeKafkaProduceResponse_v7(t *testing.T) {
+	response := &kafkaEncoder{}
+	response.putInt32(1)
+	response.putString("test")
+	response.putInt32(2)
+	for i, errorCode := range []int16{0, 29} {
+		response.putInt32(int32(i))
+		response.putInt16(errorCode)
+		response.putInt64(0)
+		response.putInt64(-1)
+		response.putInt64(0) // log start offset
+	}
+	response.putInt32(0) // throttle time
+	err := decodeKafkaProduceResponse(response.Bytes(), kafkaProduceZstdVersion)
+	if err == nil || err.Error() != "failed to produce to test/1: TOPIC_AUTHORIZATION_FAILED" {
+		t.Logf("%v", err)
+		t.Fail()
+	}
+}
+
+func Test_newKafkaClient_zstdVersion(t *testing.T) {
+	if client := newKafkaClient(nil, "ik", time.Second, kafkaCompressionGzip, gzipCompress); client.version != kafkaProduceVersion {
+		t.Fail()
+	}
+	if client := newKafkaClient(nil, "ik", time.Second, kafkaCompressionZstd, nil); client.version != kafkaProduceZstdVersion {
+		t.Fail()
+	}
+}
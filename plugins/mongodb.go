@@ -0,0 +1,648 @@
+package plugins
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A minimal MongoDB client speaking OP_MSG, which servers have accepted
+// since 3.6, with the subset of BSON the records and the replies to insert
+// and SCRAM-SHA-256 authentication need.
+
+const (
+	mongoOpMsg          = 2013
+	mongoMaxMessageSize = 48000000
+	mongoMaxBatchBytes  = 16 * 1024 * 1024
+	mongoDuplicateKey   = 11000
+)
+
+// bsonElement is an element of a document whose elements are kept in
+// order, as the command name has to come first.
+type bsonElement struct {
+	name  string
+	value interface{}
+}
+
+type bsonDocument []bsonElement
+
+type bsonObjectId [12]byte
+
+type bsonBinary []byte
+
+type bsonEncoder struct {
+	buf []byte
+}
+
+func (encoder *bsonEncoder) putInt32(v int32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], uint32(v))
+	encoder.buf = append(encoder.buf, b[:]...)
+}
+
+func (encoder *bsonEncoder) putInt64(v int64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], uint64(v))
+	encoder.buf = append(encoder.buf, b[:]...)
+}
+
+func (encoder *bsonEncoder) putCString(s string) error {
+	if strings.IndexByte(s, 0) >= 0 {
+		return errors.New(fmt.Sprintf("NUL in a BSON key: %q", s))
+	}
+	encoder.buf = append(append(encoder.buf, s...), 0)
+	return nil
+}
+
+// putDocument encodes a bsonDocument, or a map with its keys sorted.
+func (encoder *bsonEncoder) putDocument(doc interface{}) error {
+	start := len(encoder.buf)
+	encoder.putInt32(0)
+	var err error
+	switch doc := doc.(type) {
+	case bsonDocument:
+		for _, element := range doc {
+			err = encoder.putElement(element.name, element.value)
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		names := make([]string, 0, len(doc))
+		for name := range doc {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			err = encoder.putElement(name, doc[name])
+			if err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for i, value := range doc {
+			err = encoder.putElement(strconv.Itoa(i), value)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	encoder.buf = append(encoder.buf, 0)
+	binary.LittleEndian.PutUint32(encoder.buf[start:], uint32(len(encoder.buf)-start))
+	return nil
+}
+
+func (encoder *bsonEncoder) putElement(name string, value interface{}) error {
+	typeAt := len(encoder.buf)
+	encoder.buf = append(encoder.buf, 0)
+	err := encoder.putCString(name)
+	if err != nil {
+		return err
+	}
+	var type_ byte
+	switch value := value.(type) {
+	case nil:
+		type_ = 0x0a
+	case float64:
+		type_ = 0x01
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], math.Float64bits(value))
+		encoder.buf = append(encoder.buf, b[:]...)
+	case float32:
+		return encoder.putValue(typeAt, name, float64(value))
+	case string:
+		type_ = 0x02
+		encoder.putInt32(int32(len(value) + 1))
+		encoder.buf = append(append(encoder.buf, value...), 0)
+	case []byte:
+		return encoder.putValue(typeAt, name, string(value))
+	case bsonDocument, map[string]interface{}:
+		type_ = 0x03
+		err = encoder.putDocument(value)
+	case []interface{}:
+		type_ = 0x04
+		err = encoder.putDocument(value)
+	case bsonBinary:
+		type_ = 0x05
+		encoder.putInt32(int32(len(value)))
+		encoder.buf = append(append(encoder.buf, 0), value...)
+	case bsonObjectId:
+		type_ = 0x07
+		encoder.buf = append(encoder.buf, value[:]...)
+	case bool:
+		type_ = 0x08
+		if value {
+			encoder.buf = append(encoder.buf, 1)
+		} else {
+			encoder.buf = append(encoder.buf, 0)
+		}
+	case time.Time:
+		type_ = 0x09
+		encoder.putInt64(value.UnixNano() / int64(time.Millisecond))
+	case int32:
+		type_ = 0x10
+		encoder.putInt32(value)
+	case int:
+		type_ = 0x12
+		encoder.putInt64(int64(value))
+	case int8:
+		return encoder.putValue(typeAt, name, int32(value))
+	case int16:
+		return encoder.putValue(typeAt, name, int32(value))
+	case int64:
+		type_ = 0x12
+		encoder.putInt64(value)
+	case uint8:
+		return encoder.putValue(typeAt, name, int32(value))
+	case uint16:
+		return encoder.putValue(typeAt, name, int32(value))
+	case uint32:
+		return encoder.putValue(typeAt, name, int64(value))
+	case uint64:
+		if value > math.MaxInt64 {
+			return encoder.putValue(typeAt, name, float64(value))
+		}
+		return encoder.putValue(typeAt, name, int64(value))
+	default:
+		return encoder.putValue(typeAt, name, fmt.Sprintf("%v", value))
+	}
+	encoder.buf[typeAt] = type_
+	return err
+}
+
+// putValue encodes the value in place of the element started at typeAt.
+func (encoder *bsonEncoder) putValue(typeAt int, name string, value interface{}) error {
+	encoder.buf = encoder.buf[:typeAt]
+	return encoder.putElement(name, value)
+}
+
+type bsonDecoder struct {
+	data   []byte
+	offset int
+	err    error
+}
+
+func (decoder *bsonDecoder) take(n int) []byte {
+	if decoder.err != nil {
+		return nil
+	}
+	if n < 0 || decoder.offset+n > len(decoder.data) {
+		decoder.err = errors.New("malformed BSON")
+		return nil
+	}
+	retval := decoder.data[decoder.offset : decoder.offset+n]
+	decoder.offset += n
+	return retval
+}
+
+func (decoder *bsonDecoder) int32() int32 {
+	b := decoder.take(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.LittleEndian.Uint32(b))
+}
+
+func (decoder *bsonDecoder) int64() int64 {
+	b := decoder.take(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (decoder *bsonDecoder) cstring() string {
+	if decoder.err != nil {
+		return ""
+	}
+	i := decoder.offset
+	for i < len(decoder.data) && decoder.data[i] != 0 {
+		i += 1
+	}
+	b := decoder.take(i - decoder.offset + 1)
+	if b == nil {
+		return ""
+	}
+	return string(b[:len(b)-1])
+}
+
+func (decoder *bsonDecoder) document() map[string]interface{} {
+	start := decoder.offset
+	n := int(decoder.int32())
+	if decoder.err != nil || n < 5 || start+n > len(decoder.data) {
+		decoder.err = errors.New("malformed BSON")
+		return nil
+	}
+	end := start + n - 1
+	doc := make(map[string]interface{})
+	for decoder.err == nil && decoder.offset < end {
+		type_ := decoder.take(1)[0]
+		name := decoder.cstring()
+		doc[name] = decoder.value(type_)
+	}
+	decoder.take(1)
+	return doc
+}
+
+func (decoder *bsonDecoder) value(type_ byte) interface{} {
+	switch type_ {
+	case 0x01:
+		return math.Float64frombits(uint64(decoder.int64()))
+	case 0x02:
+		b := decoder.take(int(decoder.int32()))
+		if len(b) == 0 {
+			return ""
+		}
+		return string(b[:len(b)-1])
+	case 0x03:
+		return decoder.document()
+	case 0x04:
+		doc := decoder.document()
+		array := make([]interface{}, len(doc))
+		for i := range array {
+			array[i] = doc[strconv.Itoa(i)]
+		}
+		return array
+	case 0x05:
+		n := int(decoder.int32())
+		decoder.take(1)
+		return bsonBinary(decoder.take(n))
+	case 0x07:
+		id := bsonObjectId{}
+		copy(id[:], decoder.take(12))
+		return id
+	case 0x08:
+		b := decoder.take(1)
+		return b != nil && b[0] != 0
+	case 0x09:
+		ms := decoder.int64()
+		return time.Unix(ms/1000, (ms%1000)*int64(time.Millisecond))
+	case 0x0a:
+		return nil
+	case 0x10:
+		return decoder.int32()
+	case 0x11:
+		return uint64(decoder.int64())
+	case 0x12:
+		return decoder.int64()
+	case 0x13:
+		decoder.take(16)
+		return nil
+	}
+	decoder.err = errors.New(fmt.Sprintf("unsupported BSON type: 0x%02x", type_))
+	return nil
+}
+
+func decodeBSON(data []byte) (map[string]interface{}, error) {
+	decoder := &bsonDecoder{data: data}
+	doc := decoder.document()
+	return doc, decoder.err
+}
+
+var mongoObjectIdProcess = func() [5]byte {
+	b := [5]byte{}
+	rand.Read(b[:])
+	return b
+}()
+
+var mongoObjectIdCounter = func() uint32 {
+	b := [4]byte{}
+	rand.Read(b[:])
+	return binary.LittleEndian.Uint32(b[:])
+}()
+
+func newMongoObjectId(now time.Time) bsonObjectId {
+	id := bsonObjectId{}
+	binary.BigEndian.PutUint32(id[0:4], uint32(now.Unix()))
+	copy(id[4:9], mongoObjectIdProcess[:])
+	counter := atomic.AddUint32(&mongoObjectIdCounter, 1)
+	id[9] = byte(counter >> 16)
+	id[10] = byte(counter >> 8)
+	id[11] = byte(counter)
+	return id
+}
+
+// mongoNumber reads the numbers of replies, which may be of any of the
+// numeric types.
+func mongoNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	}
+	return 0, false
+}
+
+// mongoError tells the error a reply reports, if any.
+func mongoError(reply map[string]interface{}) error {
+	ok, _ := mongoNumber(reply["ok"])
+	if ok == 1 {
+		return nil
+	}
+	code, _ := mongoNumber(reply["code"])
+	message, _ := reply["errmsg"].(string)
+	return errors.New(fmt.Sprintf("MongoDB error %d: %s", int(code), message))
+}
+
+type mongoSequence struct {
+	identifier string
+	documents  [][]byte
+}
+
+type mongoClient struct {
+	address       string
+	tlsConfig     *tls.Config
+	socketOptions *ik.SocketOptions
+	timeout       time.Duration
+	username      string
+	password      string
+	authSource    string
+	conn          net.Conn
+	reader        *bufio.Reader
+	requestId     int32
+}
+
+func (client *mongoClient) close() {
+	if client.conn != nil {
+		client.conn.Close()
+		client.conn = nil
+	}
+}
+
+// roundTrip sends a command with the document sequences given, and reads
+// the reply.  The connection is dropped on an error of the connection.
+func (client *mongoClient) roundTrip(command bsonDocument, sequences ...mongoSequence) (map[string]interface{}, error) {
+	encoder := &bsonEncoder{}
+	encoder.putInt32(0) // length
+	client.requestId += 1
+	encoder.putInt32(client.requestId)
+	encoder.putInt32(0)
+	encoder.putInt32(mongoOpMsg)
+	encoder.putInt32(0) // flag bits
+	encoder.buf = append(encoder.buf, 0)
+	err := encoder.putDocument(command)
+	if err != nil {
+		return nil, err
+	}
+	for _, sequence := range sequences {
+		encoder.buf = append(encoder.buf, 1)
+		start := len(encoder.buf)
+		encoder.putInt32(0)
+		encoder.putCString(sequence.identifier)
+		for _, document := range sequence.documents {
+			encoder.buf = append(encoder.buf, document...)
+		}
+		binary.LittleEndian.PutUint32(encoder.buf[start:], uint32(len(encoder.buf)-start))
+	}
+	binary.LittleEndian.PutUint32(encoder.buf[0:], uint32(len(encoder.buf)))
+
+	client.conn.SetDeadline(time.Now().Add(client.timeout))
+	_, err = client.conn.Write(encoder.buf)
+	if err != nil {
+		client.close()
+		return nil, err
+	}
+	header := make([]byte, 16)
+	_, err = io.ReadFull(client.reader, header)
+	if err != nil {
+		client.close()
+		return nil, err
+	}
+	n := int(binary.LittleEndian.Uint32(header[0:4]))
+	if n < 21 || n > mongoMaxMessageSize {
+		client.close()
+		return nil, errors.New("malformed reply from MongoDB")
+	}
+	body := make([]byte, n-16)
+	_, err = io.ReadFull(client.reader, body)
+	if err != nil {
+		client.close()
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(header[12:16]) != mongoOpMsg || body[4] != 0 {
+		client.close()
+		return nil, errors.New("unexpected reply from MongoDB")
+	}
+	reply, err := decodeBSON(body[5:])
+	if err != nil {
+		client.close()
+		return nil, err
+	}
+	return reply, nil
+}
+
+func mongoSaslName(s string) string {
+	return strings.Replace(strings.Replace(s, "=", "=3D", -1), ",", "=2C", -1)
+}
+
+func mongoHMAC(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// mongoPBKDF2 derives the salted password of SCRAM, which needs no more
+// than one block of PBKDF2-HMAC-SHA-256.
+func mongoPBKDF2(password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	retval := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range retval {
+			retval[j] ^= u[j]
+		}
+	}
+	return retval
+}
+
+func parseScramMessage(message string) map[string]string {
+	retval := make(map[string]string)
+	for _, field := range strings.Split(message, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			retval[field[0:1]] = field[2:]
+		}
+	}
+	return retval
+}
+
+// mongoScramFinal answers the first message of the server with the final
+// message of the client, and tells the signature the server has to prove
+// itself with.
+func mongoScramFinal(password string, nonce string, clientFirstBare string, serverFirst string) (string, string, error) {
+	fields := parseScramMessage(serverFirst)
+	if !strings.HasPrefix(fields["r"], nonce) {
+		return "", "", errors.New("the server nonce of SCRAM does not extend the client nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(fields["s"])
+	if err != nil {
+		return "", "", err
+	}
+	iterations, err := strconv.Atoi(fields["i"])
+	if err != nil || iterations < 4096 {
+		return "", "", errors.New("invalid SCRAM iteration count: " + fields["i"])
+	}
+	saltedPassword := mongoPBKDF2([]byte(password), salt, iterations)
+	clientKey := mongoHMAC(saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientFinal := "c=biws,r=" + fields["r"]
+	authMessage := clientFirstBare + "," + serverFirst + "," + clientFinal
+	signature := mongoHMAC(storedKey[:], authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ signature[i]
+	}
+	serverSignature := mongoHMAC(mongoHMAC(saltedPassword, "Server Key"), authMessage)
+	return clientFinal + ",p=" + base64.StdEncoding.EncodeToString(proof), base64.StdEncoding.EncodeToString(serverSignature), nil
+}
+
+// authenticate runs SCRAM-SHA-256.  The password is used as it is, without
+// the SASLprep normalization that only matters for non-ASCII passwords.
+func (client *mongoClient) authenticate() error {
+	nonceBytes := make([]byte, 24)
+	_, err := rand.Read(nonceBytes)
+	if err != nil {
+		return err
+	}
+	nonce := base64.StdEncoding.EncodeToString(nonceBytes)
+	clientFirstBare := "n=" + mongoSaslName(client.username) + ",r=" + nonce
+	reply, err := client.roundTrip(bsonDocument{
+		{"saslStart", int32(1)},
+		{"mechanism", "SCRAM-SHA-256"},
+		{"payload", bsonBinary("n,," + clientFirstBare)},
+		{"options", bsonDocument{{"skipEmptyExchange", true}}},
+		{"$db", client.authSource},
+	})
+	if err != nil {
+		return err
+	}
+	err = mongoError(reply)
+	if err != nil {
+		return err
+	}
+	serverFirst, _ := reply["payload"].(bsonBinary)
+	clientFinal, serverSignature, err := mongoScramFinal(client.password, nonce, clientFirstBare, string(serverFirst))
+	if err != nil {
+		return err
+	}
+	reply, err = client.roundTrip(bsonDocument{
+		{"saslContinue", int32(1)},
+		{"conversationId", reply["conversationId"]},
+		{"payload", bsonBinary(clientFinal)},
+		{"$db", client.authSource},
+	})
+	if err != nil {
+		return err
+	}
+	err = mongoError(reply)
+	if err != nil {
+		return err
+	}
+	payload, _ := reply["payload"].(bsonBinary)
+	if parseScramMessage(string(payload))["v"] != serverSignature {
+		return errors.New("the server signature of SCRAM does not match")
+	}
+	if done, _ := reply["done"].(bool); !done {
+		return errors.New("SCRAM did not complete")
+	}
+	return nil
+}
+
+func (client *mongoClient) connect() error {
+	if client.conn != nil {
+		return nil
+	}
+	conn, err := client.socketOptions.Dial("tcp", client.address, client.timeout)
+	if err != nil {
+		return err
+	}
+	if client.tlsConfig != nil {
+		conn = tls.Client(conn, client.tlsConfig)
+	}
+	client.conn = conn
+	client.reader = bufio.NewReader(conn)
+	if client.username == "" {
+		return nil
+	}
+	err = client.authenticate()
+	if err != nil {
+		client.close()
+		return err
+	}
+	return nil
+}
+
+// insert inserts the encoded documents into the collection in batches of
+// batchSize at most.  The inserts are unordered, and the documents that
+// are already there are taken to have been inserted by an earlier attempt,
+// since each document has an _id of its own.
+func (client *mongoClient) insert(database string, collection string, documents [][]byte, batchSize int, writeConcern bsonDocument) (int, error) {
+	err := client.connect()
+	if err != nil {
+		return 0, err
+	}
+	inserted := 0
+	for len(documents) > 0 {
+		n := 0
+		size := 0
+		for n < len(documents) && n < batchSize && (n == 0 || size+len(documents[n]) <= mongoMaxBatchBytes) {
+			size += len(documents[n])
+			n += 1
+		}
+		command := bsonDocument{
+			{"insert", collection},
+			{"ordered", false},
+			{"$db", database},
+		}
+		if writeConcern != nil {
+			command = append(command, bsonElement{"writeConcern", writeConcern})
+		}
+		reply, err := client.roundTrip(command, mongoSequence{"documents", documents[:n]})
+		if err != nil {
+			return inserted, err
+		}
+		err = mongoError(reply)
+		if err != nil {
+			return inserted, err
+		}
+		writeErrors, _ := reply["writeErrors"].([]interface{})
+		for _, writeError := range writeErrors {
+			writeError_, _ := writeError.(map[string]interface{})
+			code, _ := mongoNumber(writeError_["code"])
+			if code != mongoDuplicateKey {
+				message, _ := writeError_["errmsg"].(string)
+				return inserted, errors.New(fmt.Sprintf("MongoDB write error %d: %s", int(code), message))
+			}
+		}
+		if writeConcernError, ok := reply["writeConcernError"].(map[string]interface{}); ok {
+			message, _ := writeConcernError["errmsg"].(string)
+			return inserted, errors.New("MongoDB write concern error: " + message)
+		}
+		count, _ := mongoNumber(reply["n"])
+		inserted += int(count)
+		documents = documents[n:]
+	}
+	return inserted, nil
+}
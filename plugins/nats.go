@@ -0,0 +1,323 @@
+package plugins
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type natsInfo struct {
+	TLSRequired bool  `json:"tls_required"`
+	Headers     bool  `json:"headers"`
+	MaxPayload  int64 `json:"max_payload"`
+}
+
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	Protocol  int    `json:"protocol"`
+	Headers   bool   `json:"headers"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+	AuthToken string `json:"auth_token,omitempty"`
+}
+
+type natsPublishAck struct {
+	Stream    string `json:"stream"`
+	Sequence  uint64 `json:"seq"`
+	Duplicate bool   `json:"duplicate"`
+	Error     *struct {
+		Code        int    `json:"code"`
+		Description string `json:"description"`
+	} `json:"error"`
+}
+
+type natsMessage struct {
+	id      string
+	payload []byte
+}
+
+// A minimal NATS client speaking the text protocol, publishing with or
+// without waiting for the acknowledgements of JetStream.
+type natsClient struct {
+	address       string
+	tlsConfig     *tls.Config
+	socketOptions *ik.SocketOptions
+	timeout       time.Duration
+	user          string
+	password      string
+	token         string
+	conn          net.Conn
+	reader        *bufio.Reader
+	writer        *bufio.Writer
+	info          natsInfo
+	inbox         string
+}
+
+func (client *natsClient) close() {
+	if client.conn != nil {
+		client.conn.Close()
+		client.conn = nil
+	}
+}
+
+func (client *natsClient) readLine() (string, error) {
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// readOp reads the next operation from the server, answering PINGs and
+// skipping what does not matter to publishing on the way.  The payload of
+// a message, headers included, is returned with it.
+func (client *natsClient) readOp() (string, []string, []byte, error) {
+	for {
+		line, err := client.readLine()
+		if err != nil {
+			return "", nil, nil, err
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		op := strings.ToUpper(fields[0])
+		switch op {
+		case "PING":
+			client.writer.WriteString("PONG\r\n")
+			client.writer.Flush()
+		case "+OK", "INFO":
+		case "-ERR":
+			return "", nil, nil, errors.New("NATS error: " + strings.TrimSpace(line[4:]))
+		case "MSG", "HMSG":
+			if len(fields) < 4 {
+				return "", nil, nil, errors.New("malformed message from NATS: " + line)
+			}
+			size, err := strconv.Atoi(fields[len(fields)-1])
+			if err != nil {
+				return "", nil, nil, err
+			}
+			payload := make([]byte, size+2)
+			_, err = io.ReadFull(client.reader, payload)
+			if err != nil {
+				return "", nil, nil, err
+			}
+			return op, fields[1:], payload[:size], nil
+		default:
+			return op, fields[1:], nil, nil
+		}
+	}
+}
+
+// waitPong sends a PING and waits for the PONG, by which time the server
+// has processed everything sent before.
+func (client *natsClient) waitPong() error {
+	client.writer.WriteString("PING\r\n")
+	err := client.writer.Flush()
+	if err != nil {
+		return err
+	}
+	for {
+		op, _, _, err := client.readOp()
+		if err != nil {
+			return err
+		}
+		if op == "PONG" {
+			return nil
+		}
+	}
+}
+
+func (client *natsClient) connect() error {
+	if client.conn != nil {
+		return nil
+	}
+	conn, err := client.socketOptions.Dial("tcp", client.address, client.timeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(client.timeout))
+	client.conn = conn
+	client.reader = bufio.NewReader(conn)
+	line, err := client.readLine()
+	if err != nil || !strings.HasPrefix(line, "INFO ") {
+		client.close()
+		return errors.New(fmt.Sprintf("unexpected greeting from NATS: %q", line))
+	}
+	err = json.Unmarshal([]byte(line[5:]), &client.info)
+	if err != nil {
+		client.close()
+		return err
+	}
+	if client.info.TLSRequired || client.tlsConfig != nil {
+		tlsConfig := client.tlsConfig
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		conn = tls.Client(conn, tlsConfig)
+		client.conn = conn
+		client.reader = bufio.NewReader(conn)
+	}
+	client.writer = bufio.NewWriter(conn)
+	connect, err := json.Marshal(natsConnect{
+		Name:      "ik",
+		Lang:      "go",
+		Version:   "0.0.0",
+		Protocol:  1,
+		Headers:   client.info.Headers,
+		User:      client.user,
+		Pass:      client.password,
+		AuthToken: client.token,
+	})
+	if err != nil {
+		client.close()
+		return err
+	}
+	client.writer.WriteString("CONNECT " + string(connect) + "\r\n")
+	err = client.waitPong()
+	if err != nil {
+		client.close()
+		return err
+	}
+	client.inbox = ""
+	return nil
+}
+
+// checkPayloads checks the messages against max_payload of the server
+// before any of them is written.
+func (client *natsClient) checkPayloads(messages []natsMessage) error {
+	for _, message := range messages {
+		if client.info.MaxPayload > 0 && int64(len(message.payload)) > client.info.MaxPayload {
+			return errors.New(fmt.Sprintf("the message of %d bytes exceeds max_payload of the server", len(message.payload)))
+		}
+	}
+	return nil
+}
+
+// publish publishes the messages, and waits for the server to have taken
+// them.
+func (client *natsClient) publish(subject string, messages []natsMessage) error {
+	err := client.connect()
+	if err != nil {
+		return err
+	}
+	err = client.checkPayloads(messages)
+	if err != nil {
+		return err
+	}
+	client.conn.SetDeadline(time.Now().Add(client.timeout))
+	for _, message := range messages {
+		client.writer.WriteString("PUB " + subject + " " + strconv.Itoa(len(message.payload)) + "\r\n")
+		client.writer.Write(message.payload)
+		client.writer.WriteString("\r\n")
+	}
+	err = client.waitPong()
+	if err != nil {
+		client.close()
+		return err
+	}
+	return nil
+}
+
+// publishJetStream publishes the messages to a subject a stream captures,
+// each with its id in Nats-Msg-Id so that the stream drops the ones it has
+// from an earlier attempt, and waits for every acknowledgement.
+func (client *natsClient) publishJetStream(subject string, messages []natsMessage, ackTimeout time.Duration) error {
+	err := client.connect()
+	if err != nil {
+		return err
+	}
+	if !client.info.Headers {
+		return errors.New("the NATS server does not support headers, which JetStream needs")
+	}
+	err = client.checkPayloads(messages)
+	if err != nil {
+		return err
+	}
+	if client.inbox == "" {
+		b := make([]byte, 12)
+		_, err = rand.Read(b)
+		if err != nil {
+			return err
+		}
+		client.inbox = "_INBOX." + hex.EncodeToString(b)
+		client.writer.WriteString("SUB " + client.inbox + ".* 1\r\n")
+	}
+	client.conn.SetDeadline(time.Now().Add(client.timeout + ackTimeout))
+	for i, message := range messages {
+		header := "NATS/1.0\r\nNats-Msg-Id: " + message.id + "\r\n\r\n"
+		client.writer.WriteString("HPUB " + subject + " " + client.inbox + "." + strconv.Itoa(i) + " " + strconv.Itoa(len(header)) + " " + strconv.Itoa(len(header)+len(message.payload)) + "\r\n")
+		client.writer.WriteString(header)
+		client.writer.Write(message.payload)
+		client.writer.WriteString("\r\n")
+	}
+	err = client.writer.Flush()
+	if err == nil {
+		err = client.readAcks(subject, len(messages))
+	}
+	if err != nil {
+		// the acknowledgements still to come would be taken for those of
+		// the next messages
+		client.close()
+		return err
+	}
+	return nil
+}
+
+func (client *natsClient) readAcks(subject string, n int) error {
+	acked := make([]bool, n)
+	remaining := n
+	for remaining > 0 {
+		op, args, payload, err := client.readOp()
+		if err != nil {
+			return err
+		}
+		if op != "MSG" && op != "HMSG" {
+			continue
+		}
+		if !strings.HasPrefix(args[0], client.inbox+".") {
+			continue
+		}
+		i, err := strconv.Atoi(args[0][len(client.inbox)+1:])
+		if err != nil || i < 0 || i >= n || acked[i] {
+			continue
+		}
+		if op == "HMSG" {
+			// a status such as 503 for no stream comes in the headers
+			headerLen, _ := strconv.Atoi(args[len(args)-2])
+			if headerLen > len(payload) {
+				headerLen = len(payload)
+			}
+			status := strings.SplitN(string(payload[:headerLen]), "\r\n", 2)[0]
+			if strings.TrimSpace(status) != "NATS/1.0" {
+				return errors.New("JetStream returned " + strings.TrimSpace(strings.TrimPrefix(status, "NATS/1.0")) + " for " + subject)
+			}
+			payload = payload[headerLen:]
+		}
+		ack := natsPublishAck{}
+		err = json.Unmarshal(payload, &ack)
+		if err != nil {
+			return err
+		}
+		if ack.Error != nil {
+			return errors.New(fmt.Sprintf("JetStream error %d: %s", ack.Error.Code, ack.Error.Description))
+		}
+		acked[i] = true
+		remaining -= 1
+	}
+	return nil
+}
@@ -0,0 +1,381 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClickHouseOutput inserts the records over the HTTP interface of
+// ClickHouse, or over the native protocol with protocol native.
+type ClickHouseOutput struct {
+	*bufferedOutput
+	factory   *ClickHouseOutputFactory
+	logger    ik.Logger
+	client    *http.Client
+	endpoint  string
+	native    *clickHouseClient
+	nativeMtx sync.Mutex
+	settings  []clickHouseSetting
+	username  string
+	password  string
+	table     string
+	columns   []outputColumn
+}
+
+type clickHouseSetting struct {
+	name  string
+	value string
+}
+
+type ClickHouseOutputPacker struct {
+	output *ClickHouseOutput
+}
+
+type ClickHouseOutputFactory struct {
+}
+
+// Pack renders a record as a JSONEachRow line.  Without column_mapping every
+// field of the record is passed through under its own name.
+func (packer *ClickHouseOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	columns := packer.output.columns
+	var row map[string]interface{}
+	if columns == nil {
+		row = record.Data
+	} else {
+		row = make(map[string]interface{}, len(columns))
+		for _, column := range columns {
+			switch column.field {
+			case columnTagField:
+				row[column.name] = record.Tag
+			case columnTimeField:
+				row[column.name] = record.Timestamp
+			default:
+				value, ok := record.Data[column.field]
+				if ok {
+					row[column.name] = value
+				}
+			}
+		}
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// quoteClickHouseIdentifier quotes a name in backticks.
+func quoteClickHouseIdentifier(name string) string {
+	name = strings.Replace(name, "\\", "\\\\", -1)
+	return "`" + strings.Replace(name, "`", "\\`", -1) + "`"
+}
+
+// buildInsert builds the INSERT of the columns into the table, which is
+// qualified by the database if it has a dot.
+func (output *ClickHouseOutput) buildInsert() string {
+	parts := strings.SplitN(output.table, ".", 2)
+	for i, part := range parts {
+		parts[i] = quoteClickHouseIdentifier(part)
+	}
+	query := "INSERT INTO " + strings.Join(parts, ".")
+	if output.columns != nil {
+		names := make([]string, len(output.columns))
+		for i, column := range output.columns {
+			names[i] = quoteClickHouseIdentifier(column.name)
+		}
+		query += " (" + strings.Join(names, ", ") + ")"
+	}
+	return query
+}
+
+func (output *ClickHouseOutput) buildQuery() string {
+	return output.buildInsert() + " FORMAT JSONEachRow"
+}
+
+// buildNativeQuery builds the INSERT sent over the native protocol, which
+// carries the settings of the insertion in itself and takes the rows as a
+// block.
+func (output *ClickHouseOutput) buildNativeQuery() string {
+	query := output.buildInsert()
+	if len(output.settings) > 0 {
+		settings := make([]string, len(output.settings))
+		for i, setting := range output.settings {
+			settings[i] = setting.name + " = " + setting.value
+		}
+		query += " SETTINGS " + strings.Join(settings, ", ")
+	}
+	return query + " VALUES"
+}
+
+// deliver sends a whole chunk as a single INSERT, which ClickHouse applies
+// as one block; either every row of the chunk is inserted or none is.
+func (output *ClickHouseOutput) deliver(ctx context.Context, _ string, chunk ik.JournalChunk) error {
+	if output.native != nil {
+		return output.deliverNative(ctx, chunk)
+	}
+	return readChunk(chunk, func(reader io.Reader) error {
+		req, err := http.NewRequestWithContext(ctx, "POST", output.endpoint, reader)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		if output.username != "" {
+			req.Header.Set("X-ClickHouse-User", output.username)
+			req.Header.Set("X-ClickHouse-Key", output.password)
+		}
+		resp, err := output.client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+			return errors.New(fmt.Sprintf("ClickHouse returned %s: %s", resp.Status, strings.TrimSpace(string(message))))
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		output.logger.Debug("Inserted a chunk into %s", output.table)
+		return nil
+	})
+}
+
+// deliverNative reads the rows back from the chunk, and inserts them as a
+// single block.
+func (output *ClickHouseOutput) deliverNative(ctx context.Context, chunk ik.JournalChunk) error {
+	rows := make([]map[string]interface{}, 0)
+	err := readChunk(chunk, func(reader io.Reader) error {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(nil, 1<<30)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			row := make(map[string]interface{})
+			decoder := json.NewDecoder(bytes.NewReader(line))
+			decoder.UseNumber()
+			err := decoder.Decode(&row)
+			if err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	output.nativeMtx.Lock()
+	defer output.nativeMtx.Unlock()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	err = output.native.insert(output.buildNativeQuery(), rows)
+	if err != nil {
+		return err
+	}
+	output.logger.Debug("Inserted a chunk of %d rows into %s", len(rows), output.table)
+	return nil
+}
+
+func (output *ClickHouseOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *ClickHouseOutput) Shutdown() error {
+	return output.ShutdownContext(context.Background())
+}
+
+func (output *ClickHouseOutput) ShutdownContext(ctx context.Context) error {
+	err := output.bufferedOutput.ShutdownContext(ctx)
+	if output.native != nil {
+		output.nativeMtx.Lock()
+		output.native.close()
+		output.nativeMtx.Unlock()
+	}
+	return err
+}
+
+func (output *ClickHouseOutput) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *ClickHouseOutputFactory) Name() string {
+	return "clickhouse"
+}
+
+// clickHouseSettings reads the settings of the insertion.
+func clickHouseSettings(config *ik.ConfigElement) ([]clickHouseSetting, error) {
+	settings := make([]clickHouseSetting, 0)
+	for _, name := range []string{"async_insert", "wait_for_async_insert"} {
+		valueStr, ok := config.Attrs[name]
+		if ok {
+			value, err := strconv.ParseBool(valueStr)
+			if err != nil {
+				return nil, err
+			}
+			if value {
+				settings = append(settings, clickHouseSetting{name, "1"})
+			} else {
+				settings = append(settings, clickHouseSetting{name, "0"})
+			}
+		}
+	}
+	return settings, nil
+}
+
+func clickHouseDatabase(config *ik.ConfigElement) string {
+	database, ok := config.Attrs["database"]
+	if !ok {
+		database = "default"
+	}
+	return database
+}
+
+// clickHouseEndpoint builds the URL the INSERT query is posted to, which
+// carries the query and the settings of the insertion as parameters.
+func clickHouseEndpoint(config *ik.ConfigElement, insertQuery string) (string, error) {
+	protocol, ok := config.Attrs["protocol"]
+	if ok && protocol != "http" && protocol != "https" {
+		return "", errors.New("unsupported protocol for the HTTP interface: " + protocol)
+	}
+	if !ok {
+		protocol = "http"
+	}
+	host, ok := config.Attrs["host"]
+	if !ok {
+		host = "localhost"
+	}
+	netPort, ok := config.Attrs["port"]
+	if !ok {
+		netPort = "8123"
+	}
+	settings, err := clickHouseSettings(config)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{}
+	query.Set("database", clickHouseDatabase(config))
+	query.Set("query", insertQuery)
+	for _, setting := range settings {
+		query.Set(setting.name, setting.value)
+	}
+	return protocol + "://" + host + ":" + netPort + "/?" + query.Encode(), nil
+}
+
+// newClickHouseClient makes the client of the native protocol, on port
+// 9000 unless given.
+func newClickHouseClient(config *ik.ConfigElement, timeout time.Duration) (*clickHouseClient, error) {
+	host, ok := config.Attrs["host"]
+	if !ok {
+		host = "localhost"
+	}
+	netPort, ok := config.Attrs["port"]
+	if !ok {
+		netPort = "9000"
+	}
+	socketOptions, err := ik.ParseSocketOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	return &clickHouseClient{
+		address:       net.JoinHostPort(host, netPort),
+		socketOptions: socketOptions,
+		timeout:       timeout,
+		database:      clickHouseDatabase(config),
+		username:      config.Attrs["username"],
+		password:      config.Attrs["password"],
+	}, nil
+}
+
+func (factory *ClickHouseOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	table, ok := config.Attrs["table"]
+	if !ok {
+		return nil, errors.New("required attribute `table' is not specified")
+	}
+	timeout := time.Duration(30 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var columns []outputColumn
+	columnMappingStr, ok := config.Attrs["column_mapping"]
+	if ok {
+		var err error
+		columns, err = parseColumnMapping(columnMappingStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &ClickHouseOutput{
+		factory:  factory,
+		logger:   engine.Logger(),
+		client:   &http.Client{Timeout: timeout},
+		username: config.Attrs["username"],
+		password: config.Attrs["password"],
+		table:    table,
+		columns:  columns,
+	}
+
+	protocol, ok := config.Attrs["protocol"]
+	switch {
+	case !ok, protocol == "http", protocol == "https":
+		output.endpoint, err = clickHouseEndpoint(config, output.buildQuery())
+	case protocol == "native":
+		output.settings, err = clickHouseSettings(config)
+		if err == nil {
+			output.native, err = newClickHouseClient(config, timeout)
+		}
+	default:
+		err = errors.New("unsupported protocol: " + protocol + " (http, https and native are supported)")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&ClickHouseOutputPacker{output},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	return output, nil
+}
+
+func (factory *ClickHouseOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&ClickHouseOutputFactory{})
@@ -0,0 +1,341 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_ClickHouseOutputPacker_Pack(t *testing.T) {
+	columns, err := parseColumnMapping("tag:@tag, time:@time, message:msg, level, missing")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	record := ik.FluentRecord{
+		Tag:       "test",
+		Timestamp: 1400000000,
+		Data:      map[string]interface{}{"msg": "hello", "level": "info", "other": 1},
+	}
+	cases := []struct {
+		columns  []outputColumn
+		expected map[string]interface{}
+	}{
+		{nil, map[string]interface{}{"msg": "hello", "level": "info", "other": float64(1)}},
+		{columns, map[string]interface{}{"tag": "test", "time": float64(1400000000), "message": "hello", "level": "info"}},
+	}
+	for _, case_ := range cases {
+		packer := &ClickHouseOutputPacker{&ClickHouseOutput{columns: case_.columns}}
+		b, err := packer.Pack(record)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if b[len(b)-1] != '\n' {
+			t.Fail()
+		}
+		row := make(map[string]interface{})
+		err = json.Unmarshal(b, &row)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(row) != len(case_.expected) {
+			t.Logf("%v", row)
+			t.Fail()
+		}
+		for name, value := range case_.expected {
+			if row[name] != value {
+				t.Logf("%s: expected %v, got %v", name, value, row[name])
+				t.Fail()
+			}
+		}
+	}
+}
+
+func Test_ClickHouseOutput_buildQuery(t *testing.T) {
+	output := &ClickHouseOutput{table: "logs"}
+	if query := output.buildQuery(); query != "INSERT INTO `logs` FORMAT JSONEachRow" {
+		t.Log(query)
+		t.Fail()
+	}
+	output.table = "db.lo`gs"
+	output.columns = []outputColumn{{"tag", "@tag"}, {"message", "msg"}}
+	if query := output.buildQuery(); query != "INSERT INTO `db`.`lo\\`gs` (`tag`, `message`) FORMAT JSONEachRow" {
+		t.Log(query)
+		t.Fail()
+	}
+	output.settings = []clickHouseSetting{{"async_insert", "1"}}
+	if query := output.buildNativeQuery(); query != "INSERT INTO `db`.`lo\\`gs` (`tag`, `message`) SETTINGS async_insert = 1 VALUES" {
+		t.Log(query)
+		t.Fail()
+	}
+}
+
+func Test_clickHouseEndpoint(t *testing.T) {
+	config := &ik.ConfigElement{Attrs: map[string]string{
+		"host":                  "ch",
+		"database":              "db",
+		"async_insert":          "true",
+		"wait_for_async_insert": "false",
+	}}
+	endpoint, err := clickHouseEndpoint(config, "INSERT INTO logs FORMAT JSONEachRow")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	query := u.Query()
+	if u.Scheme != "http" || u.Host != "ch:8123" || query.Get("database") != "db" || query.Get("query") != "INSERT INTO logs FORMAT JSONEachRow" {
+		t.Log(endpoint)
+		t.Fail()
+	}
+	if query.Get("async_insert") != "1" || query.Get("wait_for_async_insert") != "0" {
+		t.Log(endpoint)
+		t.Fail()
+	}
+	endpoint, err = clickHouseEndpoint(&ik.ConfigElement{Attrs: map[string]string{}}, "q")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	u, _ = url.Parse(endpoint)
+	if _, ok := u.Query()["async_insert"]; ok || u.Query().Get("database") != "default" {
+		t.Log(endpoint)
+		t.Fail()
+	}
+	for _, attrs := range []map[string]string{{"async_insert": "maybe"}, {"protocol": "native"}} {
+		_, err = clickHouseEndpoint(&ik.ConfigElement{Attrs: attrs}, "q")
+		if err == nil {
+			t.Logf("%v accepted", attrs)
+			t.Fail()
+		}
+	}
+}
+
+func Test_ClickHouseOutput_Deliver(t *testing.T) {
+	statuses := []int{500, 200}
+	bodies := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-ClickHouse-User") != "user" || req.Header.Get("X-ClickHouse-Key") != "pass" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		bodies = append(bodies, string(body))
+		resp.WriteHeader(statuses[len(bodies)-1])
+		resp.Write([]byte("Code: 1000"))
+	}))
+	defer server.Close()
+
+	output := &ClickHouseOutput{
+		logger:   &testLogger{t},
+		client:   &http.Client{},
+		endpoint: server.URL,
+		username: "user",
+		password: "pass",
+		table:    "logs",
+	}
+	chunk := &testJournalChunk{[]byte("{\"a\":1}\n{\"a\":2}\n")}
+	err := output.deliver(context.Background(), "", chunk)
+	if err == nil {
+		t.FailNow()
+	}
+	err = output.deliver(context.Background(), "", chunk)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// the chunk is inserted as a whole every time
+	if len(bodies) != 2 || bodies[0] != string(chunk.data) || bodies[1] != string(chunk.data) {
+		t.Logf("%v", bodies)
+		t.Fail()
+	}
+}
+
+// clickHouseTestServer speaks the server side of the native protocol over
+// a connection, reusing the reading and the writing of the client.
+type clickHouseTestServer struct {
+	clickHouseClient
+}
+
+func (server *clickHouseTestServer) readStrings(n int) []string {
+	retval := make([]string, n)
+	for i := range retval {
+		retval[i], _ = server.readString()
+	}
+	return retval
+}
+
+// readBlock reads a data block of the client, giving the data of each
+// column raw for the types the test uses.
+func (server *clickHouseTestServer) readBlock() ([]clickHouseColumn, []string) {
+	server.readUvarint()
+	server.readString()
+	io.ReadFull(server.reader, make([]byte, 1+1+1+4+1))
+	numColumns, _ := server.readUvarint()
+	numRows, _ := server.readUvarint()
+	columns := make([]clickHouseColumn, numColumns)
+	data := make([]string, numColumns)
+	for i := range columns {
+		columns[i].name, _ = server.readString()
+		columns[i].type_, _ = server.readString()
+		buf := &bytes.Buffer{}
+		type_ := columns[i].type_
+		if strings.HasPrefix(type_, "Nullable(") {
+			io.CopyN(buf, server.reader, int64(numRows))
+			type_ = type_[9 : len(type_)-1]
+		}
+		type_ = strings.SplitN(type_, "(", 2)[0]
+		for j := uint64(0); j < numRows; j += 1 {
+			switch type_ {
+			case "String":
+				s, _ := server.readString()
+				buf.WriteString(s + ",")
+			case "UInt16":
+				io.CopyN(buf, server.reader, 2)
+			case "DateTime":
+				io.CopyN(buf, server.reader, 4)
+			}
+		}
+		data[i] = buf.String()
+	}
+	return columns, data
+}
+
+func Test_ClickHouseOutput_DeliverNative(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	header := []clickHouseColumn{{"message", "String"}, {"level", "Nullable(String)"}, {"code", "UInt16"}, {"time", "DateTime('UTC')"}}
+	type result struct {
+		query   string
+		columns []clickHouseColumn
+		data    []string
+	}
+	results := make(chan result, 2)
+	go func() {
+		for i := 0; ; i += 1 {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server := &clickHouseTestServer{clickHouseClient{conn: conn, reader: bufio.NewReader(conn), writer: bufio.NewWriter(conn)}}
+			// the hello of the client, and of the server
+			server.readUvarint()
+			hello := server.readStrings(1)
+			server.readUvarint()
+			server.readUvarint()
+			server.readUvarint()
+			hello = append(hello, server.readStrings(3)...)
+			server.writeUvarint(clickHouseServerHello)
+			server.writeString("ClickHouse")
+			server.writeUvarint(21)
+			server.writeUvarint(8)
+			server.writeUvarint(54449)
+			server.writeString("UTC")
+			server.writer.Flush()
+			// the query, up to the client info, the settings and the stage
+			server.readUvarint()
+			server.readString()
+			server.reader.ReadByte()
+			server.readStrings(3)
+			server.reader.ReadByte()
+			server.readStrings(3)
+			server.readUvarint()
+			server.readUvarint()
+			server.readUvarint()
+			server.readStrings(2)
+			server.readUvarint()
+			server.readUvarint()
+			query, _ := server.readString()
+			server.readBlock()
+			if i == 0 {
+				server.writeUvarint(clickHouseServerException)
+				binary.Write(server.writer, binary.LittleEndian, int32(60))
+				server.writeString("DB::Exception")
+				server.writeString("Table db.logs doesn't exist")
+				server.writeString("")
+				server.writer.WriteByte(0)
+				server.writer.Flush()
+				conn.Close()
+				continue
+			}
+			if strings.Join(hello, ",") != "ik,db,user,pass" {
+				t.Logf("%v", hello)
+				t.Fail()
+			}
+			server.writeUvarint(clickHouseServerData)
+			server.writeString("")
+			server.writeUvarint(1)
+			server.writer.WriteByte(0)
+			server.writeUvarint(2)
+			binary.Write(server.writer, binary.LittleEndian, int32(-1))
+			server.writeUvarint(0)
+			server.writeUvarint(uint64(len(header)))
+			server.writeUvarint(0)
+			for _, column := range header {
+				server.writeString(column.name)
+				server.writeString(column.type_)
+			}
+			server.writer.Flush()
+			columns, data := server.readBlock()
+			server.readBlock()
+			server.writeUvarint(clickHouseServerProgress)
+			server.writeUvarint(2)
+			server.writeUvarint(0)
+			server.writeUvarint(0)
+			server.writeUvarint(clickHouseServerEndOfStream)
+			server.writer.Flush()
+			results <- result{query, columns, data}
+			conn.Close()
+		}
+	}()
+
+	output := &ClickHouseOutput{
+		logger: &testLogger{t},
+		native: &clickHouseClient{
+			address:  listener.Addr().String(),
+			timeout:  5 * time.Second,
+			database: "db",
+			username: "user",
+			password: "pass",
+		},
+		table: "logs",
+	}
+	chunk := &testJournalChunk{[]byte("{\"message\":\"a\",\"level\":\"info\",\"code\":200,\"time\":1400000000}\n" +
+		"{\"message\":\"b\",\"code\":500,\"time\":\"2014-05-13T16:53:20Z\"}\n")}
+	err = output.deliver(context.Background(), "", chunk)
+	if err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Fatalf("%v", err)
+	}
+	err = output.deliver(context.Background(), "", chunk)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	r := <-results
+	if r.query != "INSERT INTO `logs` VALUES" || len(r.columns) != len(header) {
+		t.Fatalf("%v", r)
+	}
+	seconds := make([]byte, 4)
+	binary.LittleEndian.PutUint32(seconds, 1400000000)
+	expected := []string{"a,b,", "\x00\x01info,,", "\xc8\x00\xf4\x01", string(seconds) + string(seconds)}
+	for i, column := range header {
+		if r.columns[i] != column || r.data[i] != expected[i] {
+			t.Logf("%v: %q", r.columns[i], r.data[i])
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,415 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	cloudWatchLogsMaxBatchEvents = 10000
+	cloudWatchLogsMaxBatchSize   = 1048576
+	cloudWatchLogsEventOverhead  = 26
+	cloudWatchLogsMaxEventSize   = 262144
+	cloudWatchLogsMaxBatchSpan   = 24 * time.Hour
+	cloudWatchLogsSubKeySep      = "\x1f"
+)
+
+type cloudWatchLogsEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Message   string `json:"message"`
+}
+
+func (event cloudWatchLogsEvent) size() int {
+	return len(event.Message) + cloudWatchLogsEventOverhead
+}
+
+type cloudWatchLogsError struct {
+	Type                  string `json:"__type"`
+	Message               string `json:"message"`
+	ExpectedSequenceToken string `json:"expectedSequenceToken"`
+}
+
+func (err *cloudWatchLogsError) Error() string {
+	return "CloudWatch Logs returned " + err.Type + ": " + err.Message
+}
+
+// is tells whether the error is of the type named, which comes qualified
+// with the namespace of the service at times.
+func (err *cloudWatchLogsError) is(type_ string) bool {
+	return err.Type == type_ || strings.HasSuffix(err.Type, "#"+type_)
+}
+
+type cloudWatchLogsPutResponse struct {
+	NextSequenceToken     string `json:"nextSequenceToken"`
+	RejectedLogEventsInfo *struct {
+		TooNewLogEventStartIndex *int `json:"tooNewLogEventStartIndex"`
+		TooOldLogEventEndIndex   *int `json:"tooOldLogEventEndIndex"`
+		ExpiredLogEventEndIndex  *int `json:"expiredLogEventEndIndex"`
+	} `json:"rejectedLogEventsInfo"`
+}
+
+// CloudWatchLogsOutput puts the records as log events into CloudWatch Logs,
+// the log group and the stream of each being expanded from a template with
+// ${tag} and ${hostname} in it.  Each stream has a buffer of its own.
+type CloudWatchLogsOutput struct {
+	*bufferedOutput
+	factory          *CloudWatchLogsOutputFactory
+	logger           ik.Logger
+	client           *http.Client
+	endpoint         string
+	region           string
+	credentials      awsCredentialsProvider
+	logGroupName     string
+	logStreamName    string
+	hostname         string
+	messageKey       string
+	autoCreateGroup  bool
+	autoCreateStream bool
+	sequenceTokens   map[string]string
+	sequenceTokenMtx sync.Mutex
+	clock            ik.Clock
+}
+
+type CloudWatchLogsOutputPacker struct {
+	output *CloudWatchLogsOutput
+}
+
+type CloudWatchLogsOutputFactory struct {
+}
+
+// Pack renders a record as an event, the message of which is the field
+// named by message_key, or else the whole record in JSON.
+func (packer *CloudWatchLogsOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	event := cloudWatchLogsEvent{Timestamp: int64(record.Timestamp) * 1000}
+	if packer.output.messageKey != "" {
+		switch message := record.Data[packer.output.messageKey].(type) {
+		case string:
+			event.Message = message
+		case []byte:
+			event.Message = string(message)
+		case nil:
+		default:
+			event.Message = fmt.Sprintf("%v", message)
+		}
+	} else {
+		b, err := json.Marshal(record.Data)
+		if err != nil {
+			return nil, err
+		}
+		event.Message = string(b)
+	}
+	b, err := json.Marshal(event)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (output *CloudWatchLogsOutput) expand(template string, tag string) string {
+	return strings.NewReplacer("${tag}", tag, "${hostname}", output.hostname).Replace(template)
+}
+
+func (output *CloudWatchLogsOutput) subKey(record ik.FluentRecord) string {
+	return output.expand(output.logGroupName, record.Tag) + cloudWatchLogsSubKeySep + output.expand(output.logStreamName, record.Tag)
+}
+
+// splitCloudWatchLogsBatches sorts the events by time, as PutLogEvents
+// requires, and groups them into batches within the limits on the number
+// of events, the size and the time span of a batch.
+func splitCloudWatchLogsBatches(events []cloudWatchLogsEvent, maxEvents int, maxSize int) [][]cloudWatchLogsEvent {
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Timestamp < events[j].Timestamp
+	})
+	batches := make([][]cloudWatchLogsEvent, 0)
+	batch := make([]cloudWatchLogsEvent, 0)
+	batchSize := 0
+	for _, event := range events {
+		if len(batch) > 0 && (len(batch) >= maxEvents || batchSize+event.size() > maxSize || time.Duration(event.Timestamp-batch[0].Timestamp)*time.Millisecond >= cloudWatchLogsMaxBatchSpan) {
+			batches = append(batches, batch)
+			batch = make([]cloudWatchLogsEvent, 0)
+			batchSize = 0
+		}
+		batch = append(batch, event)
+		batchSize += event.size()
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+func (output *CloudWatchLogsOutput) call(ctx context.Context, action string, request interface{}, response interface{}) error {
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", output.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "Logs_20140328."+action)
+	credentials, err := output.credentials.credentials()
+	if err != nil {
+		return err
+	}
+	signAWSRequest(req, payload, credentials, output.region, "logs", output.clock.Now())
+	resp, err := output.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		errorResponse := &cloudWatchLogsError{}
+		if json.Unmarshal(body, errorResponse) == nil && errorResponse.Type != "" {
+			return errorResponse
+		}
+		return errors.New(fmt.Sprintf("CloudWatch Logs returned %s", resp.Status))
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(body, response)
+}
+
+// create creates the stream, and the group first if auto_create_group is
+// set, either of which may be there already.
+func (output *CloudWatchLogsOutput) create(ctx context.Context, group string, stream string) error {
+	if output.autoCreateGroup {
+		err := output.call(ctx, "CreateLogGroup", map[string]string{"logGroupName": group}, nil)
+		cwErr, ok := err.(*cloudWatchLogsError)
+		if err != nil && !(ok && cwErr.is("ResourceAlreadyExistsException")) {
+			return err
+		}
+	}
+	err := output.call(ctx, "CreateLogStream", map[string]string{"logGroupName": group, "logStreamName": stream}, nil)
+	cwErr, ok := err.(*cloudWatchLogsError)
+	if err != nil && !(ok && cwErr.is("ResourceAlreadyExistsException")) {
+		return err
+	}
+	output.logger.Notice("Created the log stream %s of %s", stream, group)
+	return nil
+}
+
+// putBatch puts a batch, taking the sequence token the stream expects from
+// the error if the one it was given was stale, and creating the stream if
+// it is not there yet and auto_create_stream is set.  A batch the stream
+// has already taken counts as put.
+func (output *CloudWatchLogsOutput) putBatch(ctx context.Context, subKey string, group string, stream string, batch []cloudWatchLogsEvent) error {
+	created := false
+	for attempt := 0; attempt < 3; attempt++ {
+		request := map[string]interface{}{
+			"logGroupName":  group,
+			"logStreamName": stream,
+			"logEvents":     batch,
+		}
+		output.sequenceTokenMtx.Lock()
+		sequenceToken, ok := output.sequenceTokens[subKey]
+		output.sequenceTokenMtx.Unlock()
+		if ok && sequenceToken != "" {
+			request["sequenceToken"] = sequenceToken
+		}
+		response := cloudWatchLogsPutResponse{}
+		err := output.call(ctx, "PutLogEvents", request, &response)
+		if err == nil {
+			output.sequenceTokenMtx.Lock()
+			output.sequenceTokens[subKey] = response.NextSequenceToken
+			output.sequenceTokenMtx.Unlock()
+			if response.RejectedLogEventsInfo != nil {
+				output.logger.Warning("CloudWatch Logs rejected some of the events put into %s of %s as too old or too new", stream, group)
+			}
+			return nil
+		}
+		cwErr, ok := err.(*cloudWatchLogsError)
+		if !ok {
+			return err
+		}
+		switch {
+		case cwErr.is("DataAlreadyAcceptedException"):
+			output.sequenceTokenMtx.Lock()
+			output.sequenceTokens[subKey] = cwErr.ExpectedSequenceToken
+			output.sequenceTokenMtx.Unlock()
+			return nil
+		case cwErr.is("InvalidSequenceTokenException"):
+			output.sequenceTokenMtx.Lock()
+			output.sequenceTokens[subKey] = cwErr.ExpectedSequenceToken
+			output.sequenceTokenMtx.Unlock()
+		case cwErr.is("ResourceNotFoundException") && output.autoCreateStream && !created:
+			err = output.create(ctx, group, stream)
+			if err != nil {
+				return err
+			}
+			created = true
+		default:
+			return err
+		}
+	}
+	return errors.New("failed to put the events into " + stream + " of " + group + " with a valid sequence token")
+}
+
+// deliver puts the events of a chunk in as many batches as the limits of
+// PutLogEvents ask for.  The chunk is retried as a whole if any batch
+// fails.
+func (output *CloudWatchLogsOutput) deliver(ctx context.Context, subKey string, chunk ik.JournalChunk) error {
+	pair := strings.SplitN(subKey, cloudWatchLogsSubKeySep, 2)
+	if len(pair) != 2 {
+		return errors.New("invalid key: " + subKey)
+	}
+	group, stream := pair[0], pair[1]
+	var data []byte
+	err := readChunk(chunk, func(reader io.Reader) error {
+		var err error
+		data, err = ioutil.ReadAll(reader)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	events := make([]cloudWatchLogsEvent, 0)
+	oversized := make([]string, 0)
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		event := cloudWatchLogsEvent{}
+		err := json.Unmarshal(line, &event)
+		if err != nil {
+			return err
+		}
+		if event.Message == "" {
+			continue
+		}
+		if event.size() > cloudWatchLogsMaxEventSize {
+			oversized = append(oversized, string(line))
+			continue
+		}
+		events = append(events, event)
+	}
+	if len(oversized) > 0 {
+		output.logger.Error("dropping %d events exceeding the size limit of %d bytes", len(oversized), cloudWatchLogsMaxEventSize)
+		output.bufferedOutput.deadLetter(errors.New(fmt.Sprintf("the event exceeds the size limit of %d bytes", cloudWatchLogsMaxEventSize)), oversized)
+	}
+	batches := splitCloudWatchLogsBatches(events, cloudWatchLogsMaxBatchEvents, cloudWatchLogsMaxBatchSize)
+	for _, batch := range batches {
+		err := output.putBatch(ctx, subKey, group, stream, batch)
+		if err != nil {
+			return err
+		}
+	}
+	output.logger.Info("Put %d events into %s of %s", len(events), stream, group)
+	return nil
+}
+
+func (output *CloudWatchLogsOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *CloudWatchLogsOutput) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *CloudWatchLogsOutputFactory) Name() string {
+	return "cloudwatch_logs"
+}
+
+func (factory *CloudWatchLogsOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	logGroupName, ok := config.Attrs["log_group_name"]
+	if !ok {
+		return nil, errors.New("required attribute `log_group_name' is not specified")
+	}
+	logStreamName, ok := config.Attrs["log_stream_name"]
+	if !ok {
+		return nil, errors.New("required attribute `log_stream_name' is not specified")
+	}
+	region := awsRegion(config)
+	if region == "" {
+		return nil, errors.New("required attribute `region' is not specified")
+	}
+	endpoint, ok := config.Attrs["endpoint"]
+	if !ok {
+		endpoint = "https://logs." + region + ".amazonaws.com/"
+	}
+	credentials, err := newAWSCredentialsProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(30 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	autoCreateGroup := false
+	autoCreateStream := false
+	for name, value := range map[string]*bool{"auto_create_group": &autoCreateGroup, "auto_create_stream": &autoCreateStream} {
+		valueStr, ok := config.Attrs[name]
+		if ok {
+			*value, err = strconv.ParseBool(valueStr)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	hostname, _ := os.Hostname()
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &CloudWatchLogsOutput{
+		factory:          factory,
+		logger:           engine.Logger(),
+		client:           &http.Client{Timeout: timeout},
+		endpoint:         endpoint,
+		region:           region,
+		credentials:      credentials,
+		logGroupName:     logGroupName,
+		logStreamName:    logStreamName,
+		hostname:         hostname,
+		messageKey:       config.Attrs["message_key"],
+		autoCreateGroup:  autoCreateGroup,
+		autoCreateStream: autoCreateStream || autoCreateGroup,
+		sequenceTokens:   make(map[string]string),
+		clock:            engine.Clock(),
+	}
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&CloudWatchLogsOutputPacker{output},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	output.bufferedOutput.subKeyer = output.subKey
+	return output, nil
+}
+
+func (factory *CloudWatchLogsOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&CloudWatchLogsOutputFactory{})
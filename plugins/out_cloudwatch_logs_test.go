@@ -0,0 +1,131 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/moriyoshi/ik"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_CloudWatchLogsOutputPacker_Pack(t *testing.T) {
+	cases := []struct {
+		messageKey string
+		data       map[string]interface{}
+		expected   string
+	}{
+		{"", map[string]interface{}{"a": 1}, "{\"a\":1}"},
+		{"message", map[string]interface{}{"message": "hello", "a": 1}, "hello"},
+		{"message", map[string]interface{}{"message": []byte("bytes")}, "bytes"},
+		{"message", map[string]interface{}{"a": 1}, ""},
+	}
+	for _, case_ := range cases {
+		packer := &CloudWatchLogsOutputPacker{&CloudWatchLogsOutput{messageKey: case_.messageKey}}
+		b, err := packer.Pack(ik.FluentRecord{Tag: "test", Timestamp: 1400000000, Data: case_.data})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		event := cloudWatchLogsEvent{}
+		err = json.Unmarshal(b, &event)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if event.Timestamp != 1400000000000 || event.Message != case_.expected {
+			t.Logf("%v: %v", case_.data, event)
+			t.Fail()
+		}
+	}
+}
+
+func Test_splitCloudWatchLogsBatches(t *testing.T) {
+	day := int64(24 * time.Hour / time.Millisecond)
+	events := []cloudWatchLogsEvent{
+		{3, "ccccc"},
+		{1, "aaaaa"},
+		{2, "bbbbb"},
+		{4, "ddddd"},
+		{4 + day, "eeeee"},
+	}
+	batches := splitCloudWatchLogsBatches(events, 2, 1000)
+	if len(batches) != 3 || len(batches[0]) != 2 || len(batches[1]) != 2 || len(batches[2]) != 1 {
+		t.Fatalf("%v", batches)
+	}
+	if batches[0][0].Message != "aaaaa" || batches[0][1].Message != "bbbbb" || batches[1][0].Message != "ccccc" {
+		t.Logf("%v", batches)
+		t.Fail()
+	}
+	// each event counts 26 bytes on top of the message
+	batches = splitCloudWatchLogsBatches(events[:4], 10, 2*(5+cloudWatchLogsEventOverhead))
+	if len(batches) != 2 {
+		t.Logf("%v", batches)
+		t.Fail()
+	}
+	// the events of a batch span less than a day
+	batches = splitCloudWatchLogsBatches(events, 10, 1000)
+	if len(batches) != 2 || len(batches[1]) != 1 {
+		t.Logf("%v", batches)
+		t.Fail()
+	}
+}
+
+func Test_CloudWatchLogsOutput_deliver(t *testing.T) {
+	actions := make([]string, 0)
+	created := false
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		action := strings.TrimPrefix(req.Header.Get("X-Amz-Target"), "Logs_20140328.")
+		request := make(map[string]interface{})
+		json.NewDecoder(req.Body).Decode(&request)
+		if request["logGroupName"] != "group" || (action != "CreateLogGroup" && request["logStreamName"] != "host-test") {
+			t.Errorf("unexpected request: %v", request)
+		}
+		actions = append(actions, action)
+		switch {
+		case action == "CreateLogStream":
+			created = true
+			return
+		case !created:
+			resp.WriteHeader(http.StatusBadRequest)
+			resp.Write([]byte("{\"__type\":\"com.amazonaws.logs#ResourceNotFoundException\",\"message\":\"no stream\"}"))
+			return
+		case request["sequenceToken"] != "expected":
+			resp.WriteHeader(http.StatusBadRequest)
+			resp.Write([]byte("{\"__type\":\"InvalidSequenceTokenException\",\"message\":\"stale\",\"expectedSequenceToken\":\"expected\"}"))
+			return
+		}
+		if events := request["logEvents"].([]interface{}); len(events) != 2 {
+			t.Errorf("%v", events)
+		}
+		resp.Write([]byte("{\"nextSequenceToken\":\"next\"}"))
+	}))
+	defer server.Close()
+
+	output := &CloudWatchLogsOutput{
+		logger:           &testLogger{t},
+		client:           &http.Client{},
+		endpoint:         server.URL,
+		region:           "us-east-1",
+		credentials:      &staticAWSCredentialsProvider{awsCredentials{accessKeyId: "AKID", secretAccessKey: "SECRET"}},
+		logGroupName:     "group",
+		logStreamName:    "${hostname}-${tag}",
+		hostname:         "host",
+		autoCreateStream: true,
+		sequenceTokens:   make(map[string]string),
+		clock:            ik.SystemClock,
+	}
+	subKey := output.subKey(ik.FluentRecord{Tag: "test"})
+	chunk := &testJournalChunk{[]byte("{\"timestamp\":2000,\"message\":\"b\"}\n{\"timestamp\":1000,\"message\":\"a\"}\n{\"timestamp\":1000,\"message\":\"\"}\n")}
+	err := output.deliver(context.Background(), subKey, chunk)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if strings.Join(actions, ",") != "PutLogEvents,CreateLogStream,PutLogEvents,PutLogEvents" {
+		t.Log(actions)
+		t.Fail()
+	}
+	if output.sequenceTokens[subKey] != "next" {
+		t.Fail()
+	}
+}
@@ -0,0 +1,416 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	strftime "github.com/jehiah/go-strftime"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// elasticsearchEntry is what gets buffered for each record; the id is
+// generated when the record is buffered so that it stays the same across
+// retries.
+type elasticsearchEntry struct {
+	Tag       string                 `json:"tag"`
+	Timestamp uint64                 `json:"time"`
+	Data      map[string]interface{} `json:"record"`
+	Id        string                 `json:"id,omitempty"`
+}
+
+type elasticsearchBulkItem struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+type elasticsearchBulkResponse struct {
+	Errors bool                               `json:"errors"`
+	Items  []map[string]elasticsearchBulkItem `json:"items"`
+}
+
+type ElasticsearchOutput struct {
+	*bufferedOutput
+	factory        *ElasticsearchOutputFactory
+	logger         ik.Logger
+	client         *http.Client
+	endpoint       string
+	user           string
+	password       string
+	indexName      string
+	typeName       string
+	location       *time.Location
+	writeOperation string
+	idKey          string
+	generateId     bool
+	deadLetterTag  string
+	rand           *rand.Rand
+	// chunks partially accepted so far, keyed by their UniqueId, along with
+	// the entries already settled; forgotten once the chunk is taken off
+	// the buffer, delivered or given up on
+	settled    map[string][]bool
+	settledMtx sync.Mutex
+}
+
+type ElasticsearchOutputPacker struct {
+	output *ElasticsearchOutput
+}
+
+type ElasticsearchOutputFactory struct {
+}
+
+func (packer *ElasticsearchOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	output := packer.output
+	entry := elasticsearchEntry{
+		Tag:       record.Tag,
+		Timestamp: record.Timestamp,
+		Data:      record.Data,
+	}
+	if output.generateId {
+		var id [16]byte
+		for i := 0; i < len(id); i += 8 {
+			v := output.rand.Int63()
+			for j := 0; j < 8; j++ {
+				id[i+j] = byte(v >> uint(j*8))
+			}
+		}
+		entry.Id = hex.EncodeToString(id[:])
+	}
+	b, err := json.Marshal(&entry)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (output *ElasticsearchOutput) buildIndexName(entry *elasticsearchEntry) string {
+	name := strings.Replace(output.indexName, "${tag}", entry.Tag, -1)
+	if strings.Contains(name, "%") {
+		name = strftime.Format(name, time.Unix(int64(entry.Timestamp), 0).In(output.location))
+	}
+	return strings.ToLower(name)
+}
+
+func (output *ElasticsearchOutput) buildAction(entry *elasticsearchEntry) ([]byte, error) {
+	meta := map[string]interface{}{
+		"_index": output.buildIndexName(entry),
+	}
+	if output.typeName != "" {
+		meta["_type"] = output.typeName
+	}
+	if output.idKey != "" {
+		id, ok := entry.Data[output.idKey]
+		if ok && id != nil {
+			meta["_id"] = fmt.Sprint(id)
+		}
+	} else if entry.Id != "" {
+		meta["_id"] = entry.Id
+	}
+	return json.Marshal(map[string]interface{}{output.writeOperation: meta})
+}
+
+func (output *ElasticsearchOutput) sendBulk(ctx context.Context, body []byte) (*elasticsearchBulkResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", output.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if output.user != "" {
+		req.SetBasicAuth(output.user, output.password)
+	}
+	resp, err := output.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, errors.New(fmt.Sprintf("Elasticsearch returned %s: %s", resp.Status, strings.TrimSpace(string(message))))
+	}
+	response := &elasticsearchBulkResponse{}
+	err = json.NewDecoder(resp.Body).Decode(response)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func (output *ElasticsearchOutput) forgetSettled(chunk ik.JournalChunk) {
+	output.settledMtx.Lock()
+	defer output.settledMtx.Unlock()
+	delete(output.settled, chunk.UniqueId())
+}
+
+// deliver sends a chunk as a single bulk request.  Documents rejected by
+// Elasticsearch are handed to the dead-letter queue before the chunk is
+// committed, under dead_letter_tag if given, while those that failed for a
+// temporary reason (429 or 5xx) make the chunk retried.  A retry only sends
+// the documents that have not been settled yet.
+func (output *ElasticsearchOutput) deliver(ctx context.Context, _ string, chunk ik.JournalChunk) error {
+	var data []byte
+	err := readChunk(chunk, func(reader io.Reader) error {
+		var err error
+		data, err = ioutil.ReadAll(reader)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte{'\n'})
+	output.settledMtx.Lock()
+	settled, ok := output.settled[chunk.UniqueId()]
+	output.settledMtx.Unlock()
+	if !ok || len(settled) != len(lines) {
+		// the chunk may have been merged with others since
+		settled = make([]bool, len(lines))
+	}
+
+	entries := make([]*elasticsearchEntry, 0, len(lines))
+	indices := make([]int, 0, len(lines))
+	body := &bytes.Buffer{}
+	for i, line := range lines {
+		if settled[i] {
+			continue
+		}
+		entry := &elasticsearchEntry{}
+		err := json.Unmarshal(line, entry)
+		if err != nil {
+			output.logger.Error("failed to decode a buffered record: %s", err.Error())
+			settled[i] = true
+			continue
+		}
+		action, err := output.buildAction(entry)
+		if err != nil {
+			return err
+		}
+		source, err := json.Marshal(entry.Data)
+		if err != nil {
+			output.logger.Error("failed to encode a record: %s", err.Error())
+			settled[i] = true
+			continue
+		}
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(source)
+		body.WriteByte('\n')
+		entries = append(entries, entry)
+		indices = append(indices, i)
+	}
+	if len(entries) == 0 {
+		output.forgetSettled(chunk)
+		return nil
+	}
+
+	response, err := output.sendBulk(ctx, body.Bytes())
+	if err != nil {
+		return err
+	}
+	if len(response.Items) != len(entries) {
+		return errors.New(fmt.Sprintf("Elasticsearch returned %d items for %d documents", len(response.Items), len(entries)))
+	}
+	deadLetters := make([]ik.FluentRecord, 0)
+	pending := 0
+	for j, item_ := range response.Items {
+		var item elasticsearchBulkItem
+		for _, v := range item_ {
+			item = v
+		}
+		i := indices[j]
+		switch {
+		case item.Status < 300 || (item.Status == 409 && output.writeOperation == "create"):
+			// a conflict on create means the document has been indexed by
+			// an earlier attempt
+			settled[i] = true
+		case item.Status == 429 || item.Status >= 500:
+			pending += 1
+		default:
+			entry := entries[j]
+			record := make(map[string]interface{}, len(entry.Data)+1)
+			for k, v := range entry.Data {
+				record[k] = v
+			}
+			record["error"] = string(item.Error)
+			tag := entry.Tag
+			if output.deadLetterTag != "" {
+				tag = output.deadLetterTag
+			}
+			deadLetters = append(deadLetters, ik.FluentRecord{Tag: tag, Timestamp: entry.Timestamp, Data: record})
+			settled[i] = true
+		}
+	}
+	if len(deadLetters) > 0 {
+		output.logger.Error("%d of %d documents were rejected", len(deadLetters), len(entries))
+		output.deadLetterSets(errors.New("rejected by Elasticsearch"), ik.GroupByTag(deadLetters))
+	}
+	if pending > 0 {
+		output.settledMtx.Lock()
+		output.settled[chunk.UniqueId()] = settled
+		output.settledMtx.Unlock()
+		return errors.New(fmt.Sprintf("%d of %d documents were not accepted temporarily", pending, len(entries)))
+	}
+	output.forgetSettled(chunk)
+	output.logger.Notice("Indexed %d documents", len(entries))
+	return nil
+}
+
+func (output *ElasticsearchOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *ElasticsearchOutput) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *ElasticsearchOutputFactory) Name() string {
+	return "elasticsearch"
+}
+
+func (factory *ElasticsearchOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	scheme, ok := config.Attrs["scheme"]
+	if !ok {
+		scheme = "http"
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, errors.New("unsupported scheme: " + scheme)
+	}
+	host, ok := config.Attrs["host"]
+	if !ok {
+		host = "localhost"
+	}
+	netPort, ok := config.Attrs["port"]
+	if !ok {
+		netPort = "9200"
+	}
+	path := strings.TrimRight(config.Attrs["path"], "/")
+	timeout := time.Duration(30 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig, err := newTLSClientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	indexName, ok := config.Attrs["index_name"]
+	if !ok {
+		indexName = "fluentd"
+	}
+	logstashFormat := false
+	logstashFormatStr, ok := config.Attrs["logstash_format"]
+	if ok {
+		logstashFormat, err = strconv.ParseBool(logstashFormatStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if logstashFormat {
+		prefix, ok := config.Attrs["logstash_prefix"]
+		if !ok {
+			prefix = "logstash"
+		}
+		separator, ok := config.Attrs["logstash_prefix_separator"]
+		if !ok {
+			separator = "-"
+		}
+		dateFormat, ok := config.Attrs["logstash_dateformat"]
+		if !ok {
+			dateFormat = "%Y.%m.%d"
+		}
+		indexName = prefix + separator + dateFormat
+	}
+	location := time.UTC
+	utcIndexStr, ok := config.Attrs["utc_index"]
+	if ok {
+		utcIndex, err := strconv.ParseBool(utcIndexStr)
+		if err != nil {
+			return nil, err
+		}
+		if !utcIndex {
+			location = time.Local
+		}
+	}
+	location, err = ik.LocationFromConfig(config, location)
+	if err != nil {
+		return nil, err
+	}
+	writeOperation, ok := config.Attrs["write_operation"]
+	if !ok {
+		writeOperation = "index"
+	}
+	if writeOperation != "index" && writeOperation != "create" {
+		return nil, errors.New("unsupported write_operation: " + writeOperation)
+	}
+	generateId := false
+	generateIdStr, ok := config.Attrs["generate_id"]
+	if ok {
+		generateId, err = strconv.ParseBool(generateIdStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+	params.location = location
+
+	output := &ElasticsearchOutput{
+		factory:  factory,
+		logger:   engine.Logger(),
+		endpoint: scheme + "://" + host + ":" + netPort + path + "/_bulk",
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		user:           config.Attrs["user"],
+		password:       config.Attrs["password"],
+		indexName:      indexName,
+		typeName:       config.Attrs["type_name"],
+		location:       location,
+		writeOperation: writeOperation,
+		idKey:          config.Attrs["id_key"],
+		generateId:     generateId,
+		deadLetterTag:  config.Attrs["dead_letter_tag"],
+		rand:           rand.New(engine.RandSource()),
+		settled:        make(map[string][]bool),
+	}
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&ElasticsearchOutputPacker{output},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	output.bufferedOutput.forget = output.forgetSettled
+	return output, nil
+}
+
+func (factory *ElasticsearchOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&ElasticsearchOutputFactory{})
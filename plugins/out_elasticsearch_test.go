@@ -0,0 +1,179 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+type testJournalChunk struct {
+	data []byte
+}
+
+func (chunk *testJournalChunk) Dispose() error { return nil }
+func (chunk *testJournalChunk) GetReader() (io.Reader, error) {
+	return bytes.NewReader(chunk.data), nil
+}
+func (chunk *testJournalChunk) GetNextChunk() ik.JournalChunk { return nil }
+func (chunk *testJournalChunk) TakeOwnership() bool           { return true }
+func (chunk *testJournalChunk) UniqueId() string              { return "0123456789abcdef" }
+
+type testPort struct {
+	c chan []ik.FluentRecordSet
+}
+
+func (port *testPort) Emit(recordSets []ik.FluentRecordSet) error {
+	port.c <- recordSets
+	return nil
+}
+
+func Test_ElasticsearchOutput_Deliver(t *testing.T) {
+	responses := []string{
+		`{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":400,"error":{"type":"mapper_parsing_exception"}}},{"index":{"status":429}}]}`,
+		`{"errors":false,"items":[{"index":{"status":201}}]}`,
+	}
+	requests := make([]int, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lines := 0
+		scanner := bufio.NewScanner(req.Body)
+		for scanner.Scan() {
+			lines += 1
+		}
+		requests = append(requests, lines/2)
+		resp.Write([]byte(responses[len(requests)-1]))
+	}))
+	defer server.Close()
+
+	var deadLetters []ik.FluentRecordSet
+	output := &ElasticsearchOutput{
+		bufferedOutput: &bufferedOutput{
+			deadLetterSets: func(cause error, recordSets []ik.FluentRecordSet) {
+				deadLetters = append(deadLetters, recordSets...)
+			},
+		},
+		logger:         &testLogger{t},
+		client:         &http.Client{},
+		endpoint:       server.URL + "/_bulk",
+		indexName:      "logstash-%Y.%m.%d",
+		location:       time.UTC,
+		writeOperation: "index",
+		generateId:     true,
+		deadLetterTag:  "error",
+		rand:           rand.New(rand.NewSource(0)),
+		settled:        make(map[string][]bool),
+	}
+	packer := &ElasticsearchOutputPacker{output}
+	chunk := &testJournalChunk{}
+	for _, message := range []string{"a", "b", "c"} {
+		b, err := packer.Pack(ik.FluentRecord{Tag: "test", Timestamp: 0, Data: map[string]interface{}{"message": message}})
+		if err != nil {
+			t.FailNow()
+		}
+		chunk.data = append(chunk.data, b...)
+	}
+	if output.deliver(context.Background(), "", chunk) == nil {
+		t.Fail()
+	}
+	// the rejected document is dead-lettered before the delivery returns
+	if len(deadLetters) != 1 || deadLetters[0].Tag != "error" || deadLetters[0].Records[0].Data["message"] != "b" {
+		t.Fatalf("%v", deadLetters)
+	}
+	if output.deliver(context.Background(), "", chunk) != nil {
+		t.Fail()
+	}
+	if len(requests) != 2 || requests[0] != 3 || requests[1] != 1 {
+		t.Logf("%v", requests)
+		t.Fail()
+	}
+	if len(output.settled) != 0 || len(deadLetters) != 1 {
+		t.Fail()
+	}
+}
+
+func Test_ElasticsearchOutput_GiveUp(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests += 1
+		if requests == 1 {
+			resp.Write([]byte(`{"errors":true,"items":[{"index":{"status":201}},{"index":{"status":429}}]}`))
+		} else {
+			resp.Write([]byte(`{"errors":true,"items":[{"index":{"status":429}}]}`))
+		}
+	}))
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "ik.plugins")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	output := &ElasticsearchOutput{
+		logger:         &testLogger{t},
+		client:         &http.Client{},
+		endpoint:       server.URL + "/_bulk",
+		indexName:      "fluentd",
+		location:       time.UTC,
+		writeOperation: "index",
+		rand:           rand.New(rand.NewSource(0)),
+		settled:        make(map[string][]bool),
+	}
+	output.bufferedOutput, err = newBufferedOutput(
+		&testLogger{t},
+		rand.NewSource(0),
+		nil,
+		&testPluginInstance{},
+		bufferedOutputParams{
+			bufferPath:       tempDir + "/buffer",
+			bufferChunkLimit: 1024,
+			flushInterval:    time.Minute,
+			location:         time.UTC,
+			permission:       os.FileMode(0644),
+			retryLimit:       1,
+		},
+		&ElasticsearchOutputPacker{output},
+		output.deliver,
+	)
+	if err != nil {
+		t.FailNow()
+	}
+	output.bufferedOutput.forget = output.forgetSettled
+	var deadLetters []string
+	output.bufferedOutput.deadLetter = func(cause error, lines []string) {
+		deadLetters = append(deadLetters, lines...)
+	}
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	output.bufferedOutput.clock = newTestClock(func() time.Time { return now })
+	err = output.bufferedOutput.slicer.Emit([]ik.FluentRecordSet{
+		{
+			Tag: "test",
+			Records: []ik.TinyFluentRecord{
+				{Timestamp: 0, Data: map[string]interface{}{"message": "a"}},
+				{Timestamp: 0, Data: map[string]interface{}{"message": "b"}},
+			},
+		},
+	})
+	if err != nil {
+		t.FailNow()
+	}
+	output.bufferedOutput.flushExpired(now.Add(time.Minute))
+	if requests != 1 || len(output.settled) != 1 {
+		t.Fatalf("%d requests, %v", requests, output.settled)
+	}
+	// the chunk failing once more is given up on, and forgotten
+	output.bufferedOutput.flushExpired(now.Add(time.Minute))
+	if requests != 2 || len(deadLetters) != 2 {
+		t.Fatalf("%d requests, %v", requests, deadLetters)
+	}
+	if len(output.settled) != 0 {
+		t.Fatalf("%v", output.settled)
+	}
+}
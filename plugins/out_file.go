@@ -1,8 +1,8 @@
 package plugins
 
 import (
+	"bytes"
 	"compress/gzip"
-	"encoding/json"
 	"errors"
 	"fmt"
 	strftime "github.com/jehiah/go-strftime"
@@ -27,7 +27,7 @@ type FileOutput struct {
 	compressionFormat int
 	journalGroup      ik.JournalGroup
 	slicer            *ik.Slicer
-	timeFormat        string
+	formatter         ik.Formatter
 	timeSliceFormat   string
 	location          *time.Location
 	c                 chan []ik.FluentRecordSet
@@ -48,33 +48,11 @@ const (
 )
 
 func (packer *FileOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
-	formattedData, err := packer.output.formatData(record.Data)
-	if err != nil {
-		return nil, err
-	}
-	return ([]byte)(fmt.Sprintf(
-		"%s\t%s\t%s\n",
-		packer.output.formatTime(record.Timestamp),
-		record.Tag,
-		formattedData,
-	)), nil
-}
-
-func (output *FileOutput) formatTime(timestamp uint64) string {
-	timestamp_ := time.Unix(int64(timestamp), 0)
-	if output.timeFormat == "" {
-		return timestamp_.Format(time.RFC3339)
-	} else {
-		return strftime.Format(output.timeFormat, timestamp_)
-	}
+	return packer.output.formatter.Format(record.Tag, record)
 }
 
-func (output *FileOutput) formatData(data map[string]interface{}) (string, error) {
-	b, err := json.Marshal(data)
-	if err != nil {
-		return "", err
-	}
-	return string(b), nil // XXX: byte => rune
+func (packer *FileOutputPacker) PackTo(buf *bytes.Buffer, record ik.FluentRecord) error {
+	return ik.FormatTo(packer.output.formatter, buf, record.Tag, record)
 }
 
 func (output *FileOutput) Emit(recordSets []ik.FluentRecordSet) error {
@@ -207,18 +185,19 @@ func (output *FileOutput) attachListeners(journal ik.Journal) {
 	})
 }
 
-func newFileOutput(factory *FileOutputFactory, logger ik.Logger, randSource rand.Source, pathPrefix string, pathSuffix string, timeFormat string, compressionFormat int, symlinkPath string, permission os.FileMode, bufferChunkLimit int64, timeSliceFormat string, disableDraining bool) (*FileOutput, error) {
+func newFileOutput(factory *FileOutputFactory, logger ik.Logger, randSource rand.Source, scorekeeper *ik.Scorekeeper, clock ik.Clock, pathPrefix string, pathSuffix string, formatter ik.Formatter, compressionFormat int, symlinkPath string, permission os.FileMode, bufferChunkLimit int64, timeSliceFormat string, location *time.Location, disableDraining bool) (*FileOutput, error) {
 	if timeSliceFormat == "" {
 		timeSliceFormat = "%Y%m%d"
 	}
 	journalGroupFactory := jnl.NewFileJournalGroupFactory(
 		logger,
 		randSource,
-		func() time.Time { return time.Now() },
+		clock,
 		pathSuffix,
 		permission,
 		bufferChunkLimit,
 	)
+	journalGroupFactory.BindScorekeeper(scorekeeper)
 	retval := &FileOutput{
 		factory:           factory,
 		logger:            logger,
@@ -227,9 +206,9 @@ func newFileOutput(factory *FileOutputFactory, logger ik.Logger, randSource rand
 		symlinkPath:       symlinkPath,
 		permission:        permission,
 		compressionFormat: compressionFormat,
-		timeFormat:        timeFormat,
+		formatter:         formatter,
 		timeSliceFormat:   timeSliceFormat,
-		location:          time.UTC,
+		location:          location,
 		c:                 make(chan []ik.FluentRecordSet, 100 /* FIXME */),
 		cancel:            make(chan bool),
 		disableDraining:   disableDraining,
@@ -242,7 +221,7 @@ func newFileOutput(factory *FileOutputFactory, logger ik.Logger, randSource rand
 	slicer := ik.NewSlicer(
 		journalGroup,
 		func(record ik.FluentRecord) string {
-			timestamp_ := time.Unix(int64(record.Timestamp), 0)
+			timestamp_ := time.Unix(int64(record.Timestamp), 0).In(retval.location)
 			return strftime.Format(retval.timeSliceFormat, timestamp_)
 		},
 		&FileOutputPacker{retval},
@@ -267,7 +246,7 @@ func newFileOutput(factory *FileOutputFactory, logger ik.Logger, randSource rand
 	retval.journalGroup = journalGroup
 	retval.slicer = slicer
 	if !disableDraining {
-		currentKey := strftime.Format(timeSliceFormat, time.Now())
+		currentKey := strftime.Format(timeSliceFormat, clock.Now().In(location))
 		for _, key := range journalGroup.GetJournalKeys() {
 			if key == currentKey {
 				journal := journalGroup.GetJournal(key)
@@ -286,7 +265,6 @@ func (factory *FileOutputFactory) Name() string {
 func (factory *FileOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
 	pathPrefix := ""
 	pathSuffix := ""
-	timeFormat := ""
 	compressionFormat := compressionNone
 	symlinkPath := ""
 	permission := 0666
@@ -298,7 +276,6 @@ func (factory *FileOutputFactory) New(engine ik.Engine, config *ik.ConfigElement
 	if !ok {
 		return nil, errors.New("'path' parameter is required on file output")
 	}
-	timeFormat, _ = config.Attrs["time_format"]
 	compressionFormatStr, ok := config.Attrs["compress"]
 	if ok {
 		if compressionFormatStr == "gz" || compressionFormatStr == "gzip" {
@@ -325,6 +302,21 @@ func (factory *FileOutputFactory) New(engine ik.Engine, config *ik.ConfigElement
 		pathSuffix = ".log"
 	}
 	timeSliceFormat, _ = config.Attrs["time_slice_format"]
+	location := time.UTC
+	localtimeStr, ok := config.Attrs["localtime"]
+	if ok {
+		localtime, err := strconv.ParseBool(localtimeStr)
+		if err != nil {
+			return nil, err
+		}
+		if localtime {
+			location = time.Local
+		}
+	}
+	location, err := ik.LocationFromConfig(config, location)
+	if err != nil {
+		return nil, err
+	}
 
 	bufferChunkLimitStr, ok := config.Attrs["buffer_chunk_limit"]
 	if ok {
@@ -344,18 +336,26 @@ func (factory *FileOutputFactory) New(engine ik.Engine, config *ik.ConfigElement
 		}
 	}
 
+	formatter, err := newFormatter(engine, config, "out_file")
+	if err != nil {
+		return nil, err
+	}
+
 	return newFileOutput(
 		factory,
 		engine.Logger(),
 		engine.RandSource(),
+		engine.Scorekeeper(),
+		engine.Clock(),
 		pathPrefix,
 		pathSuffix,
-		timeFormat,
+		formatter,
 		compressionFormat,
 		symlinkPath,
 		os.FileMode(permission),
 		bufferChunkLimit,
 		timeSliceFormat,
+		location,
 		disableDraining,
 	)
 }
@@ -2,24 +2,71 @@ package plugins
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"github.com/moriyoshi/ik"
 	"github.com/ugorji/go/codec"
+	"io"
 	"net"
 	"reflect"
 	"strconv"
+	"sync"
 	"time"
 )
 
+// forwardNode is a server records are forwarded to.  A node found failing
+// is ejected until a heartbeat reaches it again after recover_wait.
+type forwardNode struct {
+	name     string
+	address  string
+	weight   int
+	standby  bool
+	healthy  bool
+	failedAt time.Time
+	current  int
+	idle     []*forwardConn
+}
+
+// forwardConn is a connection kept open for the later flushes.
+type forwardConn struct {
+	conn      net.Conn
+	createdAt time.Time
+	usedAt    time.Time
+}
+
 type ForwardOutput struct {
-	factory *ForwardOutputFactory
-	logger  ik.Logger
-	codec   *codec.MsgpackHandle
-	bind    string
-	enc     *codec.Encoder
-	conn    net.Conn
-	buffer  bytes.Buffer
+	factory           *ForwardOutputFactory
+	logger            ik.Logger
+	codec             *codec.MsgpackHandle
+	nodes             []*forwardNode
+	heartbeatType     string
+	connectTimeout    time.Duration
+	recoverWait       time.Duration
+	clock             ik.Clock
+	dial              func(address string, timeout time.Duration) (net.Conn, error)
+	enc               *codec.Encoder
+	buffer            bytes.Buffer
+	mtx               sync.Mutex
+	nodesMtx          sync.Mutex
+	flushInterval     time.Duration
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+	keepalive         bool
+	keepaliveTimeout  time.Duration
+	maxIdleConns      int
+	connMaxAge        time.Duration
+	requireAck        bool
+	ackTimeout        time.Duration
+	chunks            []string
+	sendChecksum      bool
+	compressGzip      bool
+	udpConn           net.PacketConn
+	lastReplies       map[*forwardNode]time.Time
+	emitLatency       *ik.LatencyWindow
+	flushLatency      *ik.LatencyWindow
+	cancel            chan bool
 }
 
 func (output *ForwardOutput) encodeEntry(tag string, record ik.TinyFluentRecord) error {
@@ -34,8 +81,75 @@ func (output *ForwardOutput) encodeEntry(tag string, record ik.TinyFluentRecord)
 	return err
 }
 
+func newForwardChunkId() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// packEntries encodes the records in the PackedForward form, computing the
+// checksum of the packed entries as they are encoded.  The entries the
+// records came in are taken as they are.
+func (output *ForwardOutput) packEntries(recordSet ik.FluentRecordSet) ([]byte, string, error) {
+	if recordSet.Packed != nil {
+		return recordSet.Packed, chunkDigestOf(recordSet.Packed), nil
+	}
+	entries := &bytes.Buffer{}
+	digest := newChunkDigest()
+	enc := codec.NewEncoder(io.MultiWriter(entries, digest), output.codec)
+	for _, record := range recordSet.Records {
+		err := enc.Encode([]interface{}{record.Timestamp, record.Data})
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	return entries.Bytes(), formatChunkDigest(digest), nil
+}
+
+// encodeRecordSet encodes the record set as a message of its own, which
+// carries a chunk id for the receiver to ack in require_ack_response mode,
+// and the checksum of the entries for the receiver to verify if
+// send_checksum is set.  With compress gzip the entries are sent gzipped
+// in the CompressedPackedForward form, the checksum being that of the
+// compressed entries.
 func (output *ForwardOutput) encodeRecordSet(recordSet ik.FluentRecordSet) error {
 	v := []interface{}{recordSet.Tag, recordSet.Records}
+	if recordSet.Packed != nil {
+		v[1] = recordSet.Packed
+	}
+	option := map[string]interface{}{}
+	if output.sendChecksum || output.compressGzip {
+		entries, checksum, err := output.packEntries(recordSet)
+		if err != nil {
+			return err
+		}
+		if output.compressGzip {
+			entries, err = gzipCompress(entries)
+			if err != nil {
+				return err
+			}
+			checksum = chunkDigestOf(entries)
+			option["compressed"] = "gzip"
+		}
+		v[1] = entries
+		if output.sendChecksum {
+			option["checksum"] = checksum
+		}
+	}
+	if output.requireAck {
+		chunk, err := newForwardChunkId()
+		if err != nil {
+			return err
+		}
+		option["chunk"] = chunk
+		output.chunks = append(output.chunks, chunk)
+	}
+	if len(option) > 0 {
+		v = append(v, option)
+	}
 	if output.enc == nil {
 		output.enc = codec.NewEncoder(&output.buffer, output.codec)
 	}
@@ -46,43 +160,322 @@ func (output *ForwardOutput) encodeRecordSet(recordSet ik.FluentRecordSet) error
 	return err
 }
 
-func (output *ForwardOutput) flush() error {
-	if output.conn == nil {
-		conn, err := net.Dial("tcp", output.bind)
+// available tells whether the node may be picked.  Without heartbeats an
+// ejected node is tried again once recover_wait has passed.
+func (output *ForwardOutput) available(node *forwardNode, now time.Time) bool {
+	if node.healthy {
+		return true
+	}
+	return output.heartbeatType == "none" && now.Sub(node.failedAt) >= output.recoverWait
+}
+
+// pick chooses the next node by smooth weighted round-robin among the
+// available nodes not in tried, falling back to the standby nodes only when
+// none of the others is available.
+func (output *ForwardOutput) pick(tried map[*forwardNode]bool) *forwardNode {
+	output.nodesMtx.Lock()
+	defer output.nodesMtx.Unlock()
+	now := output.clock.Now()
+	for _, standby := range []bool{false, true} {
+		var best *forwardNode
+		total := 0
+		for _, node := range output.nodes {
+			if node.standby != standby || node.weight <= 0 || tried[node] || !output.available(node, now) {
+				continue
+			}
+			node.current += node.weight
+			total += node.weight
+			if best == nil || node.current > best.current {
+				best = node
+			}
+		}
+		if best != nil {
+			best.current -= total
+			return best
+		}
+	}
+	return nil
+}
+
+func (output *ForwardOutput) markFailed(node *forwardNode, err error) {
+	output.nodesMtx.Lock()
+	defer output.nodesMtx.Unlock()
+	if node.healthy {
+		output.logger.Warning("Ejecting %s: %s", node.name, err.Error())
+	}
+	node.healthy = false
+	node.failedAt = output.clock.Now()
+	output.closeIdle(node)
+}
+
+func (output *ForwardOutput) markAlive(node *forwardNode) {
+	output.nodesMtx.Lock()
+	defer output.nodesMtx.Unlock()
+	if node.healthy || output.clock.Now().Sub(node.failedAt) < output.recoverWait {
+		return
+	}
+	output.logger.Notice("%s recovered", node.name)
+	node.healthy = true
+	node.current = 0
+}
+
+func (output *ForwardOutput) heartbeat() {
+	if output.heartbeatType == "udp" {
+		output.heartbeatUDP()
+	} else {
+		output.heartbeatTCP()
+	}
+}
+
+// heartbeatTCP probes every node by opening a TCP connection to it.
+func (output *ForwardOutput) heartbeatTCP() {
+	for _, node := range output.nodes {
+		conn, err := output.dial(node.address, output.connectTimeout)
 		if err != nil {
-			output.logger.Error("%#v", err.Error())
-			return err
-		} else {
-			output.conn = conn
+			output.markFailed(node, err)
+			continue
+		}
+		conn.Close()
+		output.markAlive(node)
+	}
+}
+
+// heartbeatUDP sends a datagram to every node, and ejects the nodes that
+// have not replied to any within heartbeat_timeout.  The replies are read
+// by receiveHeartbeats.
+func (output *ForwardOutput) heartbeatUDP() {
+	now := output.clock.Now()
+	for _, node := range output.nodes {
+		addr, err := net.ResolveUDPAddr("udp", node.address)
+		if err == nil {
+			_, err = output.udpConn.WriteTo([]byte{0}, addr)
+		}
+		if err != nil {
+			output.markFailed(node, err)
+			continue
+		}
+		output.nodesMtx.Lock()
+		lastReply := output.lastReplies[node]
+		output.nodesMtx.Unlock()
+		if now.Sub(lastReply) > output.heartbeatTimeout {
+			output.markFailed(node, errors.New("no reply to the heartbeat"))
+		}
+	}
+}
+
+func (output *ForwardOutput) receiveHeartbeats() {
+	b := make([]byte, 1)
+	for {
+		_, addr, err := output.udpConn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		for _, node := range output.nodes {
+			nodeAddr, err := net.ResolveUDPAddr("udp", node.address)
+			if err != nil || nodeAddr.String() != addr.String() {
+				continue
+			}
+			output.nodesMtx.Lock()
+			output.lastReplies[node] = output.clock.Now()
+			output.nodesMtx.Unlock()
+			output.markAlive(node)
+		}
+	}
+}
+
+// closeIdle closes the idle connections to the node.  nodesMtx must be held.
+func (output *ForwardOutput) closeIdle(node *forwardNode) {
+	for _, conn := range node.idle {
+		conn.conn.Close()
+	}
+	node.idle = nil
+}
+
+// acquire takes an idle connection to the node that is neither older than
+// connection_max_age nor idle for longer than keepalive_timeout, or dials
+// a new one.
+func (output *ForwardOutput) acquire(node *forwardNode) (*forwardConn, bool, error) {
+	now := output.clock.Now()
+	output.nodesMtx.Lock()
+	for len(node.idle) > 0 {
+		conn := node.idle[len(node.idle)-1]
+		node.idle = node.idle[0 : len(node.idle)-1]
+		if (output.connMaxAge > 0 && now.Sub(conn.createdAt) >= output.connMaxAge) || (output.keepaliveTimeout > 0 && now.Sub(conn.usedAt) >= output.keepaliveTimeout) {
+			conn.conn.Close()
+			continue
 		}
+		output.nodesMtx.Unlock()
+		return conn, true, nil
 	}
-	n, err := output.buffer.WriteTo(output.conn)
+	output.nodesMtx.Unlock()
+	conn, err := output.dial(node.address, output.connectTimeout)
 	if err != nil {
-		output.logger.Error("Write failed. size: %d, buf size: %d, error: %#v", n, output.buffer.Len(), err.Error())
-		output.conn = nil
-		return err
+		return nil, false, err
 	}
-	if n > 0 {
-		output.logger.Notice("Forwarded: %d bytes (left: %d bytes)\n", n, output.buffer.Len())
+	if tcpConn, ok := conn.(*net.TCPConn); ok && output.keepalive {
+		tcpConn.SetKeepAlive(true)
 	}
-	output.conn.Close()
-	output.conn = nil
-	return nil
+	return &forwardConn{conn: conn, createdAt: now, usedAt: now}, false, nil
+}
+
+// release keeps the connection for the later flushes if keepalive is
+// enabled and the node has room for another idle connection.
+func (output *ForwardOutput) release(node *forwardNode, conn *forwardConn) {
+	output.nodesMtx.Lock()
+	defer output.nodesMtx.Unlock()
+	if !output.keepalive || len(node.idle) >= output.maxIdleConns {
+		conn.conn.Close()
+		return
+	}
+	conn.usedAt = output.clock.Now()
+	node.idle = append(node.idle, conn)
 }
 
-func (output *ForwardOutput) run_flush(flush_interval int) {
-	ticker := time.NewTicker(time.Duration(flush_interval) * time.Second)
+// waitForAcks reads the acks of the chunks from the connection, failing if
+// any of them does not arrive within ack_response_timeout on the clock of
+// the output, which cuts the read short by a deadline in the past.
+func (output *ForwardOutput) waitForAcks(conn net.Conn, chunks []string) error {
+	pending := make(map[string]bool)
+	for _, chunk := range chunks {
+		pending[chunk] = true
+	}
+	timer := output.clock.NewTimer(output.ackTimeout)
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
 	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				output.flush()
-			}
+		defer close(stopped)
+		select {
+		case <-timer.C():
+			conn.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
 		}
 	}()
+	defer func() {
+		timer.Stop()
+		close(stop)
+		<-stopped
+		conn.SetReadDeadline(time.Time{})
+	}()
+	dec := codec.NewDecoder(conn, output.codec)
+	for len(pending) > 0 {
+		response := map[string]interface{}{}
+		err := dec.Decode(&response)
+		if err != nil {
+			return errors.New(fmt.Sprintf("no ack received: %s", err.Error()))
+		}
+		var chunk string
+		switch ack := response["ack"].(type) {
+		case []byte:
+			chunk = string(ack)
+		case string:
+			chunk = ack
+		}
+		if !pending[chunk] {
+			return errors.New(fmt.Sprintf("unexpected ack: %s", chunk))
+		}
+		delete(pending, chunk)
+	}
+	return nil
+}
+
+// send writes the data to the node and waits for the acks of the chunks in
+// it, if any.  A connection taken from the pool may have been closed by the
+// peer in the meantime, so the write is retried once on a new connection if
+// it fails.
+func (output *ForwardOutput) send(node *forwardNode, data []byte, chunks []string) error {
+	for {
+		conn, reused, err := output.acquire(node)
+		if err != nil {
+			return err
+		}
+		_, err = conn.conn.Write(data)
+		if err == nil && len(chunks) > 0 {
+			err = output.waitForAcks(conn.conn, chunks)
+			if err != nil {
+				// not retried here, as the chunks may have arrived
+				conn.conn.Close()
+				return err
+			}
+		}
+		if err != nil {
+			conn.conn.Close()
+			if reused {
+				continue
+			}
+			return err
+		}
+		output.release(node, conn)
+		return nil
+	}
+}
+
+// flush sends the buffered entries to a node, trying the others in turn as
+// long as it fails.  The entries are kept for the next flush if no node
+// takes them.
+func (output *ForwardOutput) flush() error {
+	output.mtx.Lock()
+	data := append([]byte(nil), output.buffer.Bytes()...)
+	chunks := output.chunks
+	output.buffer.Reset()
+	output.chunks = nil
+	output.mtx.Unlock()
+	if len(data) == 0 {
+		return nil
+	}
+	defer output.flushLatency.Since(output.clock.Now())
+	tried := make(map[*forwardNode]bool)
+	for {
+		node := output.pick(tried)
+		if node == nil {
+			break
+		}
+		tried[node] = true
+		err := output.send(node, data, chunks)
+		if err != nil {
+			output.logger.Error("Write to %s failed. size: %d, error: %s", node.name, len(data), err.Error())
+			output.markFailed(node, err)
+			continue
+		}
+		output.markAlive(node)
+		output.logger.Notice("Forwarded: %d bytes to %s\n", len(data), node.name)
+		return nil
+	}
+	output.mtx.Lock()
+	rest := append(data, output.buffer.Bytes()...)
+	output.buffer.Reset()
+	output.buffer.Write(rest)
+	output.chunks = append(chunks, output.chunks...)
+	output.mtx.Unlock()
+	err := errors.New("no server is available")
+	output.logger.Error("%s", err.Error())
+	return err
+}
+
+func (output *ForwardOutput) run_flush() {
+	ticker := output.clock.NewTicker(output.flushInterval)
+	var heartbeat <-chan time.Time
+	if output.heartbeatType != "none" {
+		heartbeatTicker := output.clock.NewTicker(output.heartbeatInterval)
+		defer heartbeatTicker.Stop()
+		heartbeat = heartbeatTicker.C()
+	}
+	defer ticker.Stop()
+	for {
+		select {
+		case <-output.cancel:
+			return
+		case <-ticker.C():
+			output.flush()
+		case <-heartbeat:
+			output.heartbeat()
+		}
+	}
 }
 
 func (output *ForwardOutput) Emit(recordSet []ik.FluentRecordSet) error {
+	defer output.emitLatency.Since(output.clock.Now())
+	output.mtx.Lock()
+	defer output.mtx.Unlock()
 	for _, recordSet := range recordSet {
 		err := output.encodeRecordSet(recordSet)
 		if err != nil {
@@ -93,32 +486,77 @@ func (output *ForwardOutput) Emit(recordSet []ik.FluentRecordSet) error {
 	return nil
 }
 
+func (output *ForwardOutput) EmitLatency() *ik.LatencyWindow {
+	return output.emitLatency
+}
+
+func (output *ForwardOutput) FlushLatency() *ik.LatencyWindow {
+	return output.flushLatency
+}
+
 func (output *ForwardOutput) Factory() ik.Plugin {
 	return output.factory
 }
 
 func (output *ForwardOutput) Run() error {
-	time.Sleep(1000000000)
+	select {
+	case <-output.cancel:
+	case <-ik.After(output.clock, time.Second):
+	}
 	return ik.Continue
 }
 
 func (output *ForwardOutput) Shutdown() error {
+	close(output.cancel)
+	if output.udpConn != nil {
+		output.udpConn.Close()
+	}
+	output.nodesMtx.Lock()
+	defer output.nodesMtx.Unlock()
+	for _, node := range output.nodes {
+		output.closeIdle(node)
+	}
 	return nil
 }
 
 type ForwardOutputFactory struct {
 }
 
-func newForwardOutput(factory *ForwardOutputFactory, logger ik.Logger, bind string) (*ForwardOutput, error) {
+func dialForwardNode(address string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+func newForwardOutput(factory *ForwardOutputFactory, logger ik.Logger, clock ik.Clock, nodes []*forwardNode) (*ForwardOutput, error) {
 	_codec := codec.MsgpackHandle{}
 	_codec.MapType = reflect.TypeOf(map[string]interface{}(nil))
 	_codec.RawToString = false
 	_codec.StructToArray = true
+	lastReplies := make(map[*forwardNode]time.Time)
+	now := clock.Now()
+	for _, node := range nodes {
+		lastReplies[node] = now
+	}
 	return &ForwardOutput{
-		factory: factory,
-		logger:  logger,
-		codec:   &_codec,
-		bind:    bind,
+		factory:           factory,
+		logger:            logger,
+		codec:             &_codec,
+		nodes:             nodes,
+		heartbeatType:     "tcp",
+		connectTimeout:    5 * time.Second,
+		recoverWait:       10 * time.Second,
+		clock:             clock,
+		dial:              dialForwardNode,
+		flushInterval:     60 * time.Second,
+		heartbeatInterval: time.Second,
+		heartbeatTimeout:  3 * time.Second,
+		keepaliveTimeout:  30 * time.Second,
+		maxIdleConns:      2,
+		connMaxAge:        10 * time.Minute,
+		ackTimeout:        190 * time.Second,
+		lastReplies:       lastReplies,
+		emitLatency:       ik.NewDefaultLatencyWindow(clock),
+		flushLatency:      ik.NewDefaultLatencyWindow(clock),
+		cancel:            make(chan bool),
 	}, nil
 }
 
@@ -126,7 +564,7 @@ func (factory *ForwardOutputFactory) Name() string {
 	return "forward"
 }
 
-func (factory *ForwardOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+func newForwardNode(config *ik.ConfigElement) (*forwardNode, error) {
 	host, ok := config.Attrs["host"]
 	if !ok {
 		host = "localhost"
@@ -135,18 +573,175 @@ func (factory *ForwardOutputFactory) New(engine ik.Engine, config *ik.ConfigElem
 	if !ok {
 		netPort = "24224"
 	}
+	address := net.JoinHostPort(host, netPort)
+	name, ok := config.Attrs["name"]
+	if !ok {
+		name = address
+	}
+	weight := 60
+	weightStr, ok := config.Attrs["weight"]
+	if ok {
+		var err error
+		weight, err = strconv.Atoi(weightStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse weight: %s", err.Error()))
+		}
+	}
+	standby := false
+	standbyStr, ok := config.Attrs["standby"]
+	if ok {
+		var err error
+		standby, err = strconv.ParseBool(standbyStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse standby: %s", err.Error()))
+		}
+	}
+	return &forwardNode{
+		name:    name,
+		address: address,
+		weight:  weight,
+		standby: standby,
+		healthy: true,
+	}, nil
+}
+
+func parseForwardDuration(config *ik.ConfigElement, name string, defaultValue time.Duration) (time.Duration, error) {
+	valueStr, ok := config.Attrs[name]
+	if !ok {
+		return defaultValue, nil
+	}
+	value, err := time.ParseDuration(valueStr)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Failed to parse %s: %s", name, err.Error()))
+	}
+	return value, nil
+}
+
+// New reads the servers from the <server> elements, or from host and port
+// if there are none.
+func (factory *ForwardOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	nodes := make([]*forwardNode, 0)
+	for _, elem := range config.Elems {
+		if elem.Name != "server" {
+			continue
+		}
+		node, err := newForwardNode(elem)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	if len(nodes) == 0 {
+		node, err := newForwardNode(config)
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
 	flush_interval_str, ok := config.Attrs["flush_interval"]
 	if !ok {
 		flush_interval_str = "60"
 	}
 	flush_interval, err := strconv.Atoi(flush_interval_str)
 	if err != nil {
-		return nil, errors.New(fmt.Sprintf("Failed to parse flush_interval_str: #v", err))
+		return nil, errors.New(fmt.Sprintf("Failed to parse flush_interval_str: %s", err.Error()))
+	}
+	output, err := newForwardOutput(factory, engine.Logger(), engine.Clock(), nodes)
+	if err != nil {
+		return nil, err
+	}
+	socketOptions, err := ik.ParseSocketOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	if socketOptions != nil {
+		output.dial = func(address string, timeout time.Duration) (net.Conn, error) {
+			return socketOptions.Dial("tcp", address, timeout)
+		}
+	}
+	output.flushInterval = time.Duration(flush_interval) * time.Second
+	heartbeatType, ok := config.Attrs["heartbeat_type"]
+	if ok {
+		if heartbeatType != "tcp" && heartbeatType != "udp" && heartbeatType != "none" {
+			return nil, errors.New("unsupported heartbeat_type: " + heartbeatType)
+		}
+		output.heartbeatType = heartbeatType
+	}
+	output.heartbeatInterval, err = parseForwardDuration(config, "heartbeat_interval", output.heartbeatInterval)
+	if err != nil {
+		return nil, err
+	}
+	output.heartbeatTimeout, err = parseForwardDuration(config, "heartbeat_timeout", output.heartbeatTimeout)
+	if err != nil {
+		return nil, err
+	}
+	output.recoverWait, err = parseForwardDuration(config, "recover_wait", output.recoverWait)
+	if err != nil {
+		return nil, err
+	}
+	output.connectTimeout, err = parseForwardDuration(config, "connect_timeout", output.connectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if output.heartbeatType == "udp" {
+		output.udpConn, err = net.ListenPacket("udp", ":0")
+		if err != nil {
+			return nil, err
+		}
+		go output.receiveHeartbeats()
+	}
+	keepaliveStr, ok := config.Attrs["keepalive"]
+	if ok {
+		output.keepalive, err = strconv.ParseBool(keepaliveStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse keepalive: %s", err.Error()))
+		}
+	}
+	output.keepaliveTimeout, err = parseForwardDuration(config, "keepalive_timeout", output.keepaliveTimeout)
+	if err != nil {
+		return nil, err
+	}
+	output.connMaxAge, err = parseForwardDuration(config, "connection_max_age", output.connMaxAge)
+	if err != nil {
+		return nil, err
+	}
+	maxIdleConnsStr, ok := config.Attrs["max_idle_connections"]
+	if ok {
+		output.maxIdleConns, err = strconv.Atoi(maxIdleConnsStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse max_idle_connections: %s", err.Error()))
+		}
+	}
+	requireAckStr, ok := config.Attrs["require_ack_response"]
+	if ok {
+		output.requireAck, err = strconv.ParseBool(requireAckStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse require_ack_response: %s", err.Error()))
+		}
+	}
+	output.ackTimeout, err = parseForwardDuration(config, "ack_response_timeout", output.ackTimeout)
+	if err != nil {
+		return nil, err
+	}
+	sendChecksumStr, ok := config.Attrs["send_checksum"]
+	if ok {
+		output.sendChecksum, err = strconv.ParseBool(sendChecksumStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Failed to parse send_checksum: %s", err.Error()))
+		}
+	}
+	compress, ok := config.Attrs["compress"]
+	if ok {
+		switch compress {
+		case "text":
+		case "gzip":
+			output.compressGzip = true
+		default:
+			return nil, errors.New("unknown compress: " + compress)
+		}
 	}
-	bind := host + ":" + netPort
-	output, err := newForwardOutput(factory, engine.Logger(), bind)
-	output.run_flush(flush_interval)
-	return output, err
+	go output.run_flush()
+	return output, nil
 }
 
 func (factory *ForwardOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
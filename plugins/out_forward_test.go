@@ -0,0 +1,401 @@
+package plugins
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/bench"
+	"github.com/op/go-logging"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func newTestForwardOutput(t *testing.T, nodes ...*forwardNode) *ForwardOutput {
+	output, _ := newForwardOutput(nil, &testLogger{t}, ik.SystemClock, nodes)
+	return output
+}
+
+func Test_ForwardOutput_pick(t *testing.T) {
+	a := &forwardNode{name: "a", weight: 2, healthy: true}
+	b := &forwardNode{name: "b", weight: 1, healthy: true}
+	c := &forwardNode{name: "c", weight: 1, healthy: true, standby: true}
+	output := newTestForwardOutput(t, a, b, c)
+	counts := make(map[string]int)
+	for i := 0; i < 6; i += 1 {
+		counts[output.pick(nil).name] += 1
+	}
+	if counts["a"] != 4 || counts["b"] != 2 || counts["c"] != 0 {
+		t.Fatalf("%v", counts)
+	}
+
+	now := time.Unix(1000, 0)
+	output.clock = newTestClock(func() time.Time { return now })
+	output.markFailed(a, errors.New("down"))
+	output.markFailed(b, errors.New("down"))
+	if node := output.pick(nil); node != c {
+		t.Fatalf("%v", node)
+	}
+	// not until recover_wait has passed
+	output.markAlive(a)
+	if a.healthy {
+		t.Fail()
+	}
+	now = now.Add(output.recoverWait)
+	output.markAlive(a)
+	if !a.healthy || output.pick(nil) != a {
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_flush(t *testing.T) {
+	down, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	down.Close()
+	up, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer up.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := up.Accept()
+		if err != nil {
+			return
+		}
+		b, _ := ioutil.ReadAll(conn)
+		received <- b
+	}()
+	a := &forwardNode{name: "a", address: down.Addr().String(), weight: 2, healthy: true}
+	b := &forwardNode{name: "b", address: up.Addr().String(), weight: 1, healthy: true}
+	output := newTestForwardOutput(t, a, b)
+	output.Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}}})
+	err = output.flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if a.healthy || len(<-received) == 0 {
+		t.Fail()
+	}
+
+	// kept for the next flush when no node takes it
+	b.healthy = false
+	output.Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 2, Data: map[string]interface{}{"a": 2}}}}})
+	if output.flush() == nil || output.buffer.Len() == 0 {
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_heartbeatUDP(t *testing.T) {
+	input, err := newForwardInput(nil, &testLogger{t}, nil, &ik.ListenAddress{Network: "tcp", Address: "127.0.0.1:0"}, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer input.Shutdown()
+	silent, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer silent.Close()
+	a := &forwardNode{name: "a", address: input.listener.Addr().String(), weight: 1}
+	b := &forwardNode{name: "b", address: silent.LocalAddr().String(), weight: 1, healthy: true}
+	output := newTestForwardOutput(t, a, b)
+	output.heartbeatType = "udp"
+	output.recoverWait = 0
+	output.lastReplies[b] = time.Now().Add(-time.Minute)
+	output.udpConn, err = net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer output.Shutdown()
+	go output.receiveHeartbeats()
+	output.heartbeat()
+	for i := 0; i < 100; i += 1 {
+		output.nodesMtx.Lock()
+		healthy := a.healthy
+		output.nodesMtx.Unlock()
+		if healthy {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !a.healthy || b.healthy {
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_keepalive(t *testing.T) {
+	server, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer server.Close()
+	accepted := make(chan net.Conn, 3)
+	go func() {
+		for {
+			conn, err := server.Accept()
+			if err != nil {
+				return
+			}
+			go ioutil.ReadAll(conn)
+			accepted <- conn
+		}
+	}()
+	a := &forwardNode{name: "a", address: server.Addr().String(), weight: 1, healthy: true}
+	output := newTestForwardOutput(t, a)
+	defer output.Shutdown()
+	output.keepalive = true
+	now := time.Unix(1000, 0)
+	output.clock = newTestClock(func() time.Time { return now })
+	for i := 0; i < 2; i += 1 {
+		output.Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": i}}}}})
+		err = output.flush()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	<-accepted
+	if len(accepted) != 0 || len(a.idle) != 1 {
+		t.Fatalf("%d", len(accepted))
+	}
+
+	// recycled once older than connection_max_age
+	now = now.Add(output.connMaxAge)
+	output.Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 2, Data: map[string]interface{}{"a": 2}}}}})
+	err = output.flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	<-accepted
+	if len(a.idle) != 1 || a.idle[0].createdAt != now {
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_requireAck(t *testing.T) {
+	port := &testDurablePort{}
+	input, err := newForwardInput(nil, &testLogger{t}, nil, &ik.ListenAddress{Network: "tcp", Address: "127.0.0.1:0"}, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer input.Shutdown()
+	a := &forwardNode{name: "a", address: input.listener.Addr().String(), weight: 1, healthy: true}
+	output := newTestForwardOutput(t, a)
+	output.requireAck = true
+	output.ackTimeout = 200 * time.Millisecond
+	go input.Run()
+	output.Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}}})
+	err = output.flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if port.durable != 1 || len(port.recordSets) != 1 || port.recordSets[0].Tag != "test" {
+		t.Fatalf("%v", port.recordSets)
+	}
+
+	// kept until the receiver acks it
+	port.fail = true
+	go input.Run()
+	output.Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 2, Data: map[string]interface{}{"a": 2}}}}})
+	if output.flush() == nil || output.buffer.Len() == 0 || len(output.chunks) != 1 {
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_sendChecksum(t *testing.T) {
+	port := &testDurablePort{}
+	input, err := newForwardInput(nil, &testLogger{t}, nil, &ik.ListenAddress{Network: "tcp", Address: "127.0.0.1:0"}, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer input.Shutdown()
+	a := &forwardNode{name: "a", address: input.listener.Addr().String(), weight: 1, healthy: true}
+	output := newTestForwardOutput(t, a)
+	output.sendChecksum = true
+	output.requireAck = true
+	output.ackTimeout = 200 * time.Millisecond
+	go input.Run()
+	output.Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}, {Timestamp: 2, Data: map[string]interface{}{"a": 2}}}}})
+	err = output.flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(port.recordSets) != 1 || len(port.recordSets[0].Records) != 2 {
+		t.Fatalf("%v", port.recordSets)
+	}
+
+	// a corrupted message is dropped along with the connection
+	go input.Run()
+	conn, err := net.Dial("tcp", a.address)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	entries, _, err := output.packEntries(ik.FluentRecordSet{Records: []ik.TinyFluentRecord{{Timestamp: 3, Data: map[string]interface{}{"a": 3}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = codec.NewEncoder(conn, output.codec).Encode([]interface{}{"test", entries, map[string]interface{}{"checksum": chunkDigestOf([]byte("other"))}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	ioutil.ReadAll(conn)
+	if len(port.recordSets) != 1 {
+		t.Fail()
+	}
+}
+
+func Test_decodeRecordSet_ShortEntry(t *testing.T) {
+	_, err := decodeRecordSet([]byte("test"), []interface{}{[]interface{}{}})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func Test_ForwardOutput_Packed(t *testing.T) {
+	for _, sendChecksum := range []bool{false, true} {
+		port := &testDurablePort{}
+		input, err := newForwardInput(nil, &testLogger{t}, nil, &ik.ListenAddress{Network: "tcp", Address: "127.0.0.1:0"}, port)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		a := &forwardNode{name: "a", address: input.listener.Addr().String(), weight: 1, healthy: true}
+		output := newTestForwardOutput(t, a)
+		output.sendChecksum = sendChecksum
+		output.requireAck = true
+		output.ackTimeout = 200 * time.Millisecond
+		go input.Run()
+		packed, _, err := output.packEntries(ik.FluentRecordSet{Records: []ik.TinyFluentRecord{{Timestamp: 2, Data: map[string]interface{}{"a": 2}}}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		// the entries are sent as they are, not the records
+		output.Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}, Packed: packed}})
+		err = output.flush()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(port.recordSets) != 1 || len(port.recordSets[0].Records) != 1 || port.recordSets[0].Records[0].Timestamp != 2 {
+			t.Fatalf("%v", port.recordSets)
+		}
+		if string(port.recordSets[0].Packed) != string(packed) {
+			t.Fail()
+		}
+		input.Shutdown()
+	}
+}
+
+func Test_ForwardOutput_compressGzip(t *testing.T) {
+	port := &testDurablePort{}
+	input, err := newForwardInput(nil, &testLogger{t}, nil, &ik.ListenAddress{Network: "tcp", Address: "127.0.0.1:0"}, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer input.Shutdown()
+	a := &forwardNode{name: "a", address: input.listener.Addr().String(), weight: 1, healthy: true}
+	output := newTestForwardOutput(t, a)
+	output.compressGzip = true
+	output.sendChecksum = true
+	output.requireAck = true
+	output.ackTimeout = 200 * time.Millisecond
+	go input.Run()
+	recordSet := ik.FluentRecordSet{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}, {Timestamp: 2, Data: map[string]interface{}{"a": 2}}}}
+	packed, _, err := output.packEntries(recordSet)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output.Emit([]ik.FluentRecordSet{recordSet})
+	err = output.flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(port.recordSets) != 1 || len(port.recordSets[0].Records) != 2 || port.recordSets[0].Records[1].Timestamp != 2 {
+		t.Fatalf("%v", port.recordSets)
+	}
+	// the entries are kept decompressed
+	if string(port.recordSets[0].Packed) != string(packed) {
+		t.Fail()
+	}
+
+	compressed, err := gzipCompress(packed)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// concatenated members are read through
+	recordSets, _, err := decodeForwardMessage(output.codec, []interface{}{[]byte("test"), append(compressed, compressed...), map[string]interface{}{"compressed": []byte("gzip")}})
+	if err != nil || len(recordSets) != 1 || len(recordSets[0].Records) != 4 {
+		t.Fatalf("%v %v", recordSets, err)
+	}
+	_, _, err = decodeForwardMessage(output.codec, []interface{}{[]byte("test"), compressed, map[string]interface{}{"compressed": []byte("lz4")}})
+	if err == nil {
+		t.Fail()
+	}
+	_, _, err = decodeForwardMessage(output.codec, []interface{}{[]byte("test"), packed, map[string]interface{}{"compressed": []byte("gzip")}})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func Test_ForwardInput_chunkSizeLimit(t *testing.T) {
+	port := &testDurablePort{}
+	input, err := newForwardInput(nil, &testLogger{t}, nil, &ik.ListenAddress{Network: "tcp", Address: "127.0.0.1:0"}, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer input.Shutdown()
+	input.chunkSizeLimit = 64
+	a := &forwardNode{name: "a", address: input.listener.Addr().String(), weight: 1, healthy: true}
+	output := newTestForwardOutput(t, a)
+	output.sendChecksum = true
+	output.requireAck = true
+	output.ackTimeout = 200 * time.Millisecond
+	go input.Run()
+	// acked though dropped
+	output.Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"message": string(make([]byte, 100))}}}}})
+	output.Emit([]ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 2, Data: map[string]interface{}{"a": 2}}}}})
+	err = output.flush()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(port.recordSets) != 1 || port.recordSets[0].Records[0].Timestamp != 2 {
+		t.Fatalf("%v", port.recordSets)
+	}
+}
+
+// each op is a record set of 100 records sent and acked
+func BenchmarkForwardOutput_RoundTrip(b *testing.B) {
+	logger := logging.MustGetLogger("ik")
+	sink := bench.NewSink()
+	input, err := newForwardInput(nil, logger, nil, &ik.ListenAddress{Network: "tcp", Address: "127.0.0.1:0"}, sink)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	defer input.Shutdown()
+	go func() {
+		for input.Run() == ik.Continue {
+		}
+	}()
+	a := &forwardNode{name: "a", address: input.listener.Addr().String(), weight: 1, healthy: true}
+	output, _ := newForwardOutput(nil, logger, ik.SystemClock, []*forwardNode{a})
+	output.requireAck = true
+	output.ackTimeout = 10 * time.Second
+	generator := bench.NewGenerator(0, nil, 8, 16)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		output.Emit(generator.RecordSets(100))
+		err = output.flush()
+		if err != nil {
+			b.Fatal(err.Error())
+		}
+	}
+	b.StopTimer()
+	err = sink.Wait(int64(b.N)*100, 10*time.Second)
+	if err != nil {
+		b.Fatal(err.Error())
+	}
+	b.Log(sink.Latencies.String())
+}
@@ -0,0 +1,381 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type HTTPOutput struct {
+	*bufferedOutput
+	factory        *HTTPOutputFactory
+	logger         ik.Logger
+	client         *http.Client
+	endpoint       string
+	method         string
+	format         string
+	headers        map[string]string
+	chunkIdHeader  string
+	authorization  string
+	gzip           bool
+	tagKey         string
+	timeKey        string
+	formatter      ik.Formatter
+	retryableCodes map[int]bool
+	maxRecords     int
+	sent           map[string]int
+	sentMtx        sync.Mutex
+}
+
+type HTTPOutputPacker struct {
+	output *HTTPOutput
+}
+
+type HTTPOutputFactory struct {
+}
+
+func (packer *HTTPOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	err := packer.PackTo(buf, record)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (packer *HTTPOutputPacker) PackTo(buf *bytes.Buffer, record ik.FluentRecord) error {
+	output := packer.output
+	data := record.Data
+	if output.tagKey != "" || output.timeKey != "" {
+		data = ik.AcquireRecordData()
+		defer ik.ReleaseRecordData(data)
+		for k, v := range record.Data {
+			data[k] = v
+		}
+		if output.tagKey != "" {
+			data[output.tagKey] = record.Tag
+		}
+		if output.timeKey != "" {
+			data[output.timeKey] = record.Timestamp
+		}
+	}
+	record.Data = data
+	return ik.FormatTo(output.formatter, buf, record.Tag, record)
+}
+
+func (output *HTTPOutput) buildBody(lines [][]byte) []byte {
+	body := &bytes.Buffer{}
+	if output.format == "json_array" {
+		body.WriteByte('[')
+		for i, line := range lines {
+			if i > 0 {
+				body.WriteByte(',')
+			}
+			body.Write(line)
+		}
+		body.WriteByte(']')
+		return body.Bytes()
+	}
+	for _, line := range lines {
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+	return body.Bytes()
+}
+
+// post sends a single request, identified by key.  The returned bool tells
+// whether the request is worth retrying when it fails.
+func (output *HTTPOutput) post(ctx context.Context, key string, lines [][]byte) (bool, error) {
+	body := output.buildBody(lines)
+	var err error
+	if output.gzip {
+		body, err = gzipCompress(body)
+		if err != nil {
+			return false, err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, output.method, output.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	if output.format == "json_array" {
+		req.Header.Set("Content-Type", "application/json")
+	} else {
+		req.Header.Set("Content-Type", "application/x-ndjson")
+	}
+	if output.gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	req.Header.Set("Digest", chunkDigestOf(body))
+	if output.chunkIdHeader != "" && key != "" {
+		req.Header.Set(output.chunkIdHeader, key)
+	}
+	if output.authorization != "" {
+		req.Header.Set("Authorization", output.authorization)
+	}
+	for name, value := range output.headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := output.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return output.retryableCodes[resp.StatusCode], errors.New(fmt.Sprintf("%s returned %s: %s", output.endpoint, resp.Status, strings.TrimSpace(string(message))))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return false, nil
+}
+
+// deliver sends a chunk in requests of at most max_records_per_request
+// records each.  A chunk failing with a retryable status is retried from the
+// first request that failed; any other failure drops the rest of it.  Each
+// request carries the unique id of the chunk, followed by the offset of its
+// first record if the chunk takes more than one, for the receiver to
+// deduplicate on.
+func (output *HTTPOutput) deliver(ctx context.Context, _ string, chunk ik.JournalChunk) error {
+	var data []byte
+	err := readChunk(chunk, func(reader io.Reader) error {
+		var err error
+		data, err = ioutil.ReadAll(reader)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	digest_ := sha256.Sum256(data)
+	digest := string(digest_[:])
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte{'\n'})
+	step := output.maxRecords
+	if step <= 0 {
+		step = len(lines)
+	}
+	output.sentMtx.Lock()
+	offset := output.sent[digest]
+	output.sentMtx.Unlock()
+	for ; offset < len(lines); offset += step {
+		end := offset + step
+		if end > len(lines) {
+			end = len(lines)
+		}
+		key := chunk.UniqueId()
+		if key != "" && step < len(lines) {
+			key = fmt.Sprintf("%s-%d", key, offset)
+		}
+		retryable, err := output.post(ctx, key, lines[offset:end])
+		if err != nil {
+			if retryable {
+				output.sentMtx.Lock()
+				output.sent[digest] = offset
+				output.sentMtx.Unlock()
+				return err
+			}
+			output.logger.Error("dropping %d records: %s", len(lines)-offset, err.Error())
+			dropped := make([]string, 0, len(lines)-offset)
+			for _, line := range lines[offset:] {
+				dropped = append(dropped, string(line))
+			}
+			output.bufferedOutput.deadLetter(err, dropped)
+			break
+		}
+	}
+	output.sentMtx.Lock()
+	delete(output.sent, digest)
+	output.sentMtx.Unlock()
+	output.logger.Notice("Posted %d records to %s", len(lines), output.endpoint)
+	return nil
+}
+
+func (output *HTTPOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *HTTPOutput) Dispose() {
+	output.Shutdown()
+}
+
+func parseHTTPStatusCodes(s string) (map[int]bool, error) {
+	retval := make(map[int]bool)
+	for _, code := range splitAndStrip(s) {
+		if code == "" {
+			continue
+		}
+		code_, err := strconv.Atoi(code)
+		if err != nil {
+			return nil, errors.New("invalid status code: " + code)
+		}
+		retval[code_] = true
+	}
+	return retval, nil
+}
+
+func newHTTPAuthorization(config *ik.ConfigElement) (string, error) {
+	auth, ok := config.Attrs["auth"]
+	if !ok {
+		auth = "none"
+	}
+	switch auth {
+	case "none":
+		return "", nil
+	case "basic":
+		username, ok := config.Attrs["username"]
+		if !ok {
+			return "", errors.New("required attribute `username' is not specified")
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(username, config.Attrs["password"])
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+		token, ok := config.Attrs["token"]
+		if !ok {
+			return "", errors.New("required attribute `token' is not specified")
+		}
+		return "Bearer " + token, nil
+	}
+	return "", errors.New("unsupported auth: " + auth)
+}
+
+func (factory *HTTPOutputFactory) Name() string {
+	return "http"
+}
+
+func (factory *HTTPOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	endpoint, ok := config.Attrs["endpoint"]
+	if !ok {
+		return nil, errors.New("required attribute `endpoint' is not specified")
+	}
+	method, ok := config.Attrs["http_method"]
+	if !ok {
+		method = "POST"
+	}
+	method = strings.ToUpper(method)
+	if method != "POST" && method != "PUT" {
+		return nil, errors.New("unsupported http_method: " + method)
+	}
+	format, ok := config.Attrs["format"]
+	if !ok {
+		format = "ndjson"
+	}
+	if format != "ndjson" && format != "json_array" {
+		return nil, errors.New("unsupported format: " + format)
+	}
+	authorization, err := newHTTPAuthorization(config)
+	if err != nil {
+		return nil, err
+	}
+	headers := make(map[string]string)
+	for _, elem := range config.Elems {
+		if elem.Name == "headers" {
+			for name, value := range elem.Attrs {
+				headers[name] = value
+			}
+		}
+	}
+	chunkIdHeader, ok := config.Attrs["chunk_id_header"]
+	if !ok {
+		chunkIdHeader = "Idempotency-Key"
+	}
+	retryableCodesStr, ok := config.Attrs["retryable_response_codes"]
+	if !ok {
+		retryableCodesStr = "429,500,502,503,504"
+	}
+	retryableCodes, err := parseHTTPStatusCodes(retryableCodesStr)
+	if err != nil {
+		return nil, err
+	}
+	maxRecords := 0
+	maxRecordsStr, ok := config.Attrs["max_records_per_request"]
+	if ok {
+		maxRecords, err = strconv.Atoi(maxRecordsStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	compress, ok := config.Attrs["compress"]
+	if !ok {
+		compress = "text"
+	}
+	if compress != "text" && compress != "gzip" {
+		return nil, errors.New("unsupported compress: " + compress)
+	}
+	timeout := time.Duration(30 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tlsConfig, err := newTLSClientConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the lines of a chunk make the records of a request, so the format
+	// has to give one line per record
+	formatter, err := newFormatter(engine, config, "json")
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &HTTPOutput{
+		factory:  factory,
+		logger:   engine.Logger(),
+		endpoint: endpoint,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+		},
+		method:         method,
+		format:         format,
+		headers:        headers,
+		chunkIdHeader:  chunkIdHeader,
+		authorization:  authorization,
+		gzip:           compress == "gzip",
+		tagKey:         config.Attrs["tag_key"],
+		timeKey:        config.Attrs["time_key"],
+		formatter:      formatter,
+		retryableCodes: retryableCodes,
+		maxRecords:     maxRecords,
+		sent:           make(map[string]int),
+	}
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&HTTPOutputPacker{output},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	return output, nil
+}
+
+func (factory *HTTPOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&HTTPOutputFactory{})
@@ -0,0 +1,97 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/conformance"
+	"github.com/moriyoshi/ik/formatters"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_HTTPOutput_Deliver(t *testing.T) {
+	statuses := []int{200, 503, 200, 200}
+	requests := make([]int, 0)
+	keys := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" || req.Header.Get("X-Test") != "1" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		if verifyChunkDigest(req.Header.Get("Digest"), body) != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		records := make([]map[string]interface{}, 0)
+		err := json.Unmarshal(body, &records)
+		if err != nil {
+			resp.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, len(records))
+		keys = append(keys, req.Header.Get("Idempotency-Key"))
+		resp.WriteHeader(statuses[len(requests)-1])
+	}))
+	defer server.Close()
+
+	output := &HTTPOutput{
+		logger:         &testLogger{t},
+		client:         &http.Client{},
+		endpoint:       server.URL,
+		method:         "POST",
+		format:         "json_array",
+		headers:        map[string]string{"X-Test": "1"},
+		chunkIdHeader:  "Idempotency-Key",
+		authorization:  "Bearer token",
+		retryableCodes: map[int]bool{503: true},
+		maxRecords:     2,
+		sent:           make(map[string]int),
+	}
+	chunk := &testJournalChunk{[]byte("{\"a\":1}\n{\"a\":2}\n{\"a\":3}\n{\"a\":4}\n{\"a\":5}\n")}
+	err := output.deliver(context.Background(), "", chunk)
+	if err == nil {
+		t.FailNow()
+	}
+	err = output.deliver(context.Background(), "", chunk)
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	// the retry resumes from the request that failed
+	expected := []int{2, 2, 2, 1}
+	if len(requests) != len(expected) {
+		t.Logf("%v", requests)
+		t.FailNow()
+	}
+	for i, n := range expected {
+		if requests[i] != n {
+			t.Logf("%v", requests)
+			t.Fail()
+		}
+	}
+	// the request retried goes with the same key
+	expectedKeys := []string{"0123456789abcdef-0", "0123456789abcdef-2", "0123456789abcdef-2", "0123456789abcdef-4"}
+	for i, key := range expectedKeys {
+		if keys[i] != key {
+			t.Logf("%v", keys)
+			t.Fail()
+		}
+	}
+	if len(output.sent) != 0 {
+		t.Fail()
+	}
+}
+
+func Test_HTTPOutputPacker_conformance(t *testing.T) {
+	conformance.RunPackerSuite(t, func(config *ik.ConfigElement) (ik.RecordPacker, error) {
+		formatter, err := (&formatters.JSONFormatterPlugin{}).New(nil, config)
+		if err != nil {
+			return nil, err
+		}
+		return &HTTPOutputPacker{&HTTPOutput{tagKey: config.Attrs["tag_key"], timeKey: config.Attrs["time_key"], formatter: formatter}}, nil
+	}, "testdata/out_http.json")
+}
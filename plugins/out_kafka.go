@@ -0,0 +1,311 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// kafkaBufferedMessage is what gets buffered for each record.  The topic is
+// kept in the sub key of the buffer so a chunk always goes to a single topic.
+// The value is the record in JSON, or in Raw what the formatter made of it.
+type kafkaBufferedMessage struct {
+	Key   *string         `json:"k"`
+	Time  int64           `json:"t"`
+	Value json.RawMessage `json:"v,omitempty"`
+	Raw   []byte          `json:"r,omitempty"`
+}
+
+type KafkaOutput struct {
+	*bufferedOutput
+	factory       *KafkaOutputFactory
+	logger        ik.Logger
+	client        *kafkaClient
+	brokers       []string
+	defaultTopic  string
+	topicKey      string
+	messageKeyKey string
+	requiredAcks  int16
+	ackTimeout    time.Duration
+	nextPartition int64
+	formatter     ik.Formatter // nil for JSON
+}
+
+type KafkaOutputPacker struct {
+	output *KafkaOutput
+}
+
+type KafkaOutputFactory struct {
+}
+
+func kafkaFieldString(value interface{}) string {
+	switch value_ := value.(type) {
+	case string:
+		return value_
+	case []byte:
+		return string(value_)
+	default:
+		b, _ := json.Marshal(value_)
+		return string(b)
+	}
+}
+
+// topic returns the topic in the topic_key field of the record, falling back
+// to default_topic and then to the tag.
+func (output *KafkaOutput) topic(record ik.FluentRecord) string {
+	if output.topicKey != "" {
+		value, ok := record.Data[output.topicKey]
+		if ok && value != nil {
+			topic := kafkaFieldString(value)
+			if topic != "" {
+				return topic
+			}
+		}
+	}
+	if output.defaultTopic != "" {
+		return output.defaultTopic
+	}
+	return record.Tag
+}
+
+func (packer *KafkaOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	output := packer.output
+	message := kafkaBufferedMessage{
+		Key:  nil,
+		Time: int64(record.Timestamp) * 1000,
+	}
+	var err error
+	if output.formatter != nil {
+		message.Raw, err = output.formatter.Format(record.Tag, record)
+	} else {
+		message.Value, err = json.Marshal(record.Data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if output.messageKeyKey != "" {
+		key, ok := record.Data[output.messageKeyKey]
+		if ok && key != nil {
+			keyStr := kafkaFieldString(key)
+			message.Key = &keyStr
+		}
+	}
+	b, err := json.Marshal(&message)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// deliver produces the chunk as one batch per partition.  Records without a
+// key are sent to the same partition, which moves on with every chunk.
+func (output *KafkaOutput) deliver(ctx context.Context, topic string, chunk ik.JournalChunk) error {
+	var data []byte
+	err := readChunk(chunk, func(reader io.Reader) error {
+		var err error
+		data, err = ioutil.ReadAll(reader)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte{'\n'})
+	messages := make([]kafkaMessage, 0, len(lines))
+	for _, line := range lines {
+		bufferedMessage := kafkaBufferedMessage{}
+		err := json.Unmarshal(line, &bufferedMessage)
+		if err != nil {
+			output.logger.Error("failed to decode a buffered record: %s", err.Error())
+			continue
+		}
+		message := kafkaMessage{
+			key:       nil,
+			value:     []byte(bufferedMessage.Value),
+			timestamp: bufferedMessage.Time,
+		}
+		if bufferedMessage.Raw != nil {
+			message.value = bufferedMessage.Raw
+		}
+		if bufferedMessage.Key != nil {
+			message.key = []byte(*bufferedMessage.Key)
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	// a produce request is bounded by ack_timeout rather than by ctx
+	err = ctx.Err()
+	if err != nil {
+		return err
+	}
+	// the chunks delivered at once by the flush threads go to partitions
+	// of their own
+	partition := atomic.AddInt64(&output.nextPartition, 1) - 1
+	err = output.client.produce(topic, messages, output.requiredAcks, output.ackTimeout, int(partition))
+	if err != nil {
+		return err
+	}
+	output.logger.Notice("Produced %d records to %s", len(messages), topic)
+	return nil
+}
+
+func (output *KafkaOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *KafkaOutput) Shutdown() error {
+	return output.ShutdownContext(context.Background())
+}
+
+func (output *KafkaOutput) ShutdownContext(ctx context.Context) error {
+	err := output.bufferedOutput.ShutdownContext(ctx)
+	output.client.close()
+	return err
+}
+
+func (output *KafkaOutput) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *KafkaOutputFactory) Name() string {
+	return "kafka"
+}
+
+func newKafkaCompression(codec string) (int16, func(data []byte) ([]byte, error), error) {
+	switch codec {
+	case "none":
+		return kafkaCompressionNone, nil, nil
+	case "gzip":
+		return kafkaCompressionGzip, gzipCompress, nil
+	case "zstd":
+		compress, err := newZstdCompressFunc()
+		if err != nil {
+			return 0, nil, err
+		}
+		return kafkaCompressionZstd, compress, nil
+	}
+	return 0, nil, errors.New("unsupported compression_codec: " + codec)
+}
+
+func (factory *KafkaOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	brokersStr, ok := config.Attrs["brokers"]
+	if !ok {
+		return nil, errors.New("required attribute `brokers' is not specified")
+	}
+	brokers := make([]string, 0)
+	for _, broker := range splitAndStrip(brokersStr) {
+		if broker != "" {
+			brokers = append(brokers, broker)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, errors.New("no brokers are specified")
+	}
+	requiredAcks := int16(-1)
+	requiredAcksStr, ok := config.Attrs["required_acks"]
+	if ok {
+		requiredAcks_, err := strconv.Atoi(requiredAcksStr)
+		if err != nil {
+			return nil, err
+		}
+		if requiredAcks_ < -1 || requiredAcks_ > 1 {
+			return nil, errors.New(fmt.Sprintf("invalid required_acks: %s", requiredAcksStr))
+		}
+		requiredAcks = int16(requiredAcks_)
+	}
+	ackTimeout := time.Duration(10 * time.Second)
+	ackTimeoutStr, ok := config.Attrs["ack_timeout"]
+	if ok {
+		var err error
+		ackTimeout, err = time.ParseDuration(ackTimeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	timeout := time.Duration(10 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	codec, ok := config.Attrs["compression_codec"]
+	if !ok {
+		codec = "none"
+	}
+	compression, compress, err := newKafkaCompression(codec)
+	if err != nil {
+		return nil, err
+	}
+	clientId, ok := config.Attrs["client_id"]
+	if !ok {
+		clientId = "ik"
+	}
+
+	var formatter ik.Formatter
+	for _, elem := range config.Elems {
+		if elem.Name == "format" {
+			formatter, err = newFormatter(engine, config, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &KafkaOutput{
+		factory:       factory,
+		logger:        engine.Logger(),
+		client:        newKafkaClient(brokers, clientId, timeout, compression, compress),
+		brokers:       brokers,
+		defaultTopic:  config.Attrs["default_topic"],
+		topicKey:      config.Attrs["topic_key"],
+		messageKeyKey: config.Attrs["message_key_key"],
+		requiredAcks:  requiredAcks,
+		ackTimeout:    ackTimeout,
+		nextPartition: engine.RandSource().Int63() % 1024,
+		formatter:     formatter,
+	}
+	output.client.socketOptions, err = ik.ParseSocketOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&KafkaOutputPacker{output},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	output.bufferedOutput.subKeyer = output.topic
+	return output, nil
+}
+
+func (factory *KafkaOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&KafkaOutputFactory{})
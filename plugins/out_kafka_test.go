@@ -0,0 +1,219 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_KafkaOutput_topic(t *testing.T) {
+	output := &KafkaOutput{topicKey: "topic"}
+	cases := []struct {
+		defaultTopic string
+		data         map[string]interface{}
+		expected     string
+	}{
+		{"", map[string]interface{}{"topic": "a"}, "a"},
+		{"default", map[string]interface{}{"topic": "a"}, "a"},
+		{"default", map[string]interface{}{"topic": ""}, "default"},
+		{"default", map[string]interface{}{"topic": nil}, "default"},
+		{"default", map[string]interface{}{}, "default"},
+		{"", map[string]interface{}{}, "tag"},
+		{"", map[string]interface{}{"topic": 1}, "1"},
+	}
+	for _, case_ := range cases {
+		output.defaultTopic = case_.defaultTopic
+		topic := output.topic(ik.FluentRecord{Tag: "tag", Data: case_.data})
+		if topic != case_.expected {
+			t.Logf("%v: expected %s, got %s", case_.data, case_.expected, topic)
+			t.Fail()
+		}
+	}
+}
+
+func Test_KafkaOutputPacker_Pack(t *testing.T) {
+	packer := &KafkaOutputPacker{&KafkaOutput{messageKeyKey: "id"}}
+	cases := []struct {
+		data     map[string]interface{}
+		expected string // "" for no key
+	}{
+		{map[string]interface{}{"id": "a", "x": 1}, "a"},
+		{map[string]interface{}{"id": []byte("b")}, "b"},
+		{map[string]interface{}{"id": 3}, "3"},
+		{map[string]interface{}{"id": nil}, ""},
+		{map[string]interface{}{"x": 1}, ""},
+	}
+	for _, case_ := range cases {
+		b, err := packer.Pack(ik.FluentRecord{Tag: "tag", Timestamp: 1400000000, Data: case_.data})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if b[len(b)-1] != '\n' {
+			t.Fail()
+		}
+		message := kafkaBufferedMessage{}
+		err = json.Unmarshal(b, &message)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if message.Time != 1400000000000 {
+			t.Fail()
+		}
+		key := ""
+		if message.Key != nil {
+			key = *message.Key
+		}
+		if key != case_.expected {
+			t.Logf("%v: unexpected key %q", case_.data, key)
+			t.Fail()
+		}
+	}
+}
+
+type testKafkaFormatter struct{}
+
+func (*testKafkaFormatter) Format(tag string, record ik.FluentRecord) ([]byte, error) {
+	return []byte{0, 1, '\n'}, nil
+}
+
+func Test_KafkaOutputPacker_Pack_formatter(t *testing.T) {
+	packer := &KafkaOutputPacker{&KafkaOutput{formatter: &testKafkaFormatter{}}}
+	b, err := packer.Pack(ik.FluentRecord{Tag: "tag", Timestamp: 1400000000, Data: map[string]interface{}{"x": 1}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	// the value is kept out of the line, which delimits the messages
+	if bytes.Count(b, []byte{'\n'}) != 1 {
+		t.Fatalf("%q", b)
+	}
+	message := kafkaBufferedMessage{}
+	err = json.Unmarshal(b, &message)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if message.Value != nil || !bytes.Equal(message.Raw, []byte{0, 1, '\n'}) {
+		t.Fatalf("%q", b)
+	}
+}
+
+func Test_KafkaOutput_Deliver_acks(t *testing.T) {
+	for _, requiredAcks := range []int16{0, 1, -1} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		host, portStr, _ := net.SplitHostPort(listener.Addr().String())
+		port, _ := strconv.Atoi(portStr)
+
+		acks := make(chan int16, 1)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			_, correlationId, _ := readKafkaRequest(t, conn)
+			writeKafkaMetadata(conn, correlationId, host, port, "test")
+			_, correlationId, decoder := readKafkaRequest(t, conn)
+			decoder.nullableString() // transactional id
+			acks_ := decoder.int16()
+			acks <- acks_
+			if acks_ == 0 {
+				return
+			}
+			produce := &kafkaEncoder{}
+			produce.putInt32(1)
+			produce.putString("test")
+			produce.putInt32(1)
+			produce.putInt32(0)
+			produce.putInt16(0)
+			produce.putInt64(0)
+			produce.putInt64(-1)
+			produce.putInt32(0) // throttle time
+			writeKafkaResponse(conn, correlationId, produce)
+		}()
+
+		output := &KafkaOutput{
+			logger:       &testLogger{t},
+			client:       newKafkaClient([]string{listener.Addr().String()}, "ik", 5*time.Second, kafkaCompressionNone, nil),
+			requiredAcks: requiredAcks,
+			ackTimeout:   time.Second,
+		}
+		chunk := &testJournalChunk{[]byte("{\"k\":\"a\",\"t\":1000,\"v\":{\"x\":1}}\n{\"t\":2000,\"v\":{\"x\":2}}\n")}
+		err = output.deliver(context.Background(), "test", chunk)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if acks_ := <-acks; acks_ != requiredAcks {
+			t.Logf("expected acks %d, got %d", requiredAcks, acks_)
+			t.Fail()
+		}
+		// records without a key go to another partition with the next chunk
+		if output.nextPartition != 1 {
+			t.Fail()
+		}
+		output.client.close()
+		listener.Close()
+	}
+}
+
+func Test_KafkaOutput_Deliver_concurrent(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	host, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, correlationId, _ := readKafkaRequest(t, conn)
+		writeKafkaMetadata(conn, correlationId, host, port, "test")
+		// the produce requests are not answered with acks 0
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	output := &KafkaOutput{
+		logger:       &testLogger{t},
+		client:       newKafkaClient([]string{listener.Addr().String()}, "ik", 5*time.Second, kafkaCompressionNone, nil),
+		requiredAcks: 0,
+		ackTimeout:   time.Second,
+	}
+	defer output.client.close()
+	// the flush threads deliver chunks at once, which -race checks
+	errs := make(chan error, 20)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				chunk := &testJournalChunk{[]byte("{\"t\":1000,\"v\":{\"x\":1}}\n")}
+				errs <- output.deliver(context.Background(), "test", chunk)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// each of the deliveries took a partition of its own
+	if output.nextPartition != 20 {
+		t.Fatalf("%d", output.nextPartition)
+	}
+}
@@ -0,0 +1,330 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MongoDBOutput inserts the records as documents into the collection named
+// after the tag, or the one collection templates into.  Each collection has
+// a buffer of its own.
+type MongoDBOutput struct {
+	*bufferedOutput
+	factory      *MongoDBOutputFactory
+	logger       ik.Logger
+	client       *mongoClient
+	clientMtx    sync.Mutex
+	database     string
+	collection   string
+	timeKey      string
+	tagKey       string
+	batchSize    int
+	writeConcern bsonDocument
+}
+
+// mongoBufferedDocument is how a record sits in the buffer.  The _id is
+// given when the record is packed, so that a chunk inserted again after a
+// failure does not duplicate the documents inserted the first time.
+type mongoBufferedDocument struct {
+	Id   string                 `json:"i"`
+	Tag  string                 `json:"g"`
+	Time uint64                 `json:"t"`
+	Data map[string]interface{} `json:"d"`
+}
+
+type MongoDBOutputPacker struct {
+	output *MongoDBOutput
+}
+
+type MongoDBOutputFactory struct {
+}
+
+func (packer *MongoDBOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	id := newMongoObjectId(time.Now())
+	b, err := json.Marshal(mongoBufferedDocument{
+		Id:   hex.EncodeToString(id[:]),
+		Tag:  record.Tag,
+		Time: record.Timestamp,
+		Data: record.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (output *MongoDBOutput) collectionOf(record ik.FluentRecord) string {
+	return strings.Replace(output.collection, "${tag}", record.Tag, -1)
+}
+
+// mongoValue turns the numbers of a record read back from the buffer into
+// integers wherever they have no fraction.
+func mongoValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		i, err := value.Int64()
+		if err == nil {
+			return i
+		}
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		for k, v := range value {
+			value[k] = mongoValue(v)
+		}
+	case []interface{}:
+		for i, v := range value {
+			value[i] = mongoValue(v)
+		}
+	}
+	return value
+}
+
+func (output *MongoDBOutput) encodeDocument(line []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	buffered := mongoBufferedDocument{}
+	err := decoder.Decode(&buffered)
+	if err != nil {
+		return nil, err
+	}
+	idBytes, err := hex.DecodeString(buffered.Id)
+	if err != nil || len(idBytes) != 12 {
+		return nil, errors.New("invalid _id in the buffer: " + buffered.Id)
+	}
+	id := bsonObjectId{}
+	copy(id[:], idBytes)
+	document := bsonDocument{{"_id", id}}
+	data := mongoValue(buffered.Data).(map[string]interface{})
+	delete(data, "_id")
+	if output.timeKey != "" {
+		delete(data, output.timeKey)
+	}
+	if output.tagKey != "" {
+		delete(data, output.tagKey)
+	}
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		document = append(document, bsonElement{name, data[name]})
+	}
+	if output.timeKey != "" {
+		document = append(document, bsonElement{output.timeKey, time.Unix(int64(buffered.Time), 0)})
+	}
+	if output.tagKey != "" {
+		document = append(document, bsonElement{output.tagKey, buffered.Tag})
+	}
+	encoder := &bsonEncoder{}
+	err = encoder.putDocument(document)
+	if err != nil {
+		return nil, err
+	}
+	return encoder.buf, nil
+}
+
+// deliver inserts the documents of a chunk into the collection, in as many
+// insert commands as batch_size asks for.
+func (output *MongoDBOutput) deliver(ctx context.Context, collection string, chunk ik.JournalChunk) error {
+	documents := make([][]byte, 0)
+	err := readChunk(chunk, func(reader io.Reader) error {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(nil, mongoMaxBatchBytes)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			document, err := output.encodeDocument(line)
+			if err != nil {
+				return err
+			}
+			documents = append(documents, document)
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return err
+	}
+	output.clientMtx.Lock()
+	defer output.clientMtx.Unlock()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	n, err := output.client.insert(output.database, collection, documents, output.batchSize, output.writeConcern)
+	if err != nil {
+		return err
+	}
+	output.logger.Info("Inserted %d documents into %s.%s", n, output.database, collection)
+	return nil
+}
+
+func (output *MongoDBOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *MongoDBOutput) Shutdown() error {
+	return output.ShutdownContext(context.Background())
+}
+
+func (output *MongoDBOutput) ShutdownContext(ctx context.Context) error {
+	err := output.bufferedOutput.ShutdownContext(ctx)
+	output.clientMtx.Lock()
+	output.client.close()
+	output.clientMtx.Unlock()
+	return err
+}
+
+func (output *MongoDBOutput) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *MongoDBOutputFactory) Name() string {
+	return "mongodb"
+}
+
+// parseMongoWriteConcern reads w, which is either a number of nodes or the
+// name of a write concern such as "majority".
+func parseMongoWriteConcern(config *ik.ConfigElement) (bsonDocument, error) {
+	w, ok := config.Attrs["write_concern"]
+	if !ok {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(w)
+	if err == nil {
+		if n < 0 {
+			return nil, errors.New("invalid write_concern: " + w)
+		}
+		return bsonDocument{{"w", int32(n)}}, nil
+	}
+	return bsonDocument{{"w", w}}, nil
+}
+
+func (factory *MongoDBOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	database, ok := config.Attrs["database"]
+	if !ok {
+		return nil, errors.New("required attribute `database' is not specified")
+	}
+	collection, ok := config.Attrs["collection"]
+	if !ok {
+		collection = "${tag}"
+	}
+	host, ok := config.Attrs["host"]
+	if !ok {
+		host = "localhost"
+	}
+	netPort, ok := config.Attrs["port"]
+	if !ok {
+		netPort = "27017"
+	}
+	timeout := time.Duration(30 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	batchSize := 1000
+	batchSizeStr, ok := config.Attrs["batch_size"]
+	if ok {
+		var err error
+		batchSize, err = strconv.Atoi(batchSizeStr)
+		if err != nil {
+			return nil, err
+		}
+		if batchSize <= 0 {
+			return nil, errors.New("batch_size must be positive")
+		}
+	}
+	timeKey, ok := config.Attrs["time_key"]
+	if !ok {
+		timeKey = "time"
+	}
+	authSource, ok := config.Attrs["auth_source"]
+	if !ok {
+		authSource = "admin"
+	}
+	writeConcern, err := parseMongoWriteConcern(config)
+	if err != nil {
+		return nil, err
+	}
+	client := &mongoClient{
+		address:    net.JoinHostPort(host, netPort),
+		timeout:    timeout,
+		username:   config.Attrs["username"],
+		password:   config.Attrs["password"],
+		authSource: authSource,
+	}
+	client.socketOptions, err = ik.ParseSocketOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsStr, ok := config.Attrs["tls"]
+	if ok {
+		tls_, err := strconv.ParseBool(tlsStr)
+		if err != nil {
+			return nil, err
+		}
+		if tls_ {
+			client.tlsConfig, err = newTLSClientConfig(config)
+			if err != nil {
+				return nil, err
+			}
+			client.tlsConfig.ServerName = host
+		}
+	}
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &MongoDBOutput{
+		factory:      factory,
+		logger:       engine.Logger(),
+		client:       client,
+		database:     database,
+		collection:   collection,
+		timeKey:      timeKey,
+		tagKey:       config.Attrs["tag_key"],
+		batchSize:    batchSize,
+		writeConcern: writeConcern,
+	}
+
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&MongoDBOutputPacker{output},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	output.bufferedOutput.subKeyer = output.collectionOf
+	return output, nil
+}
+
+func (factory *MongoDBOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&MongoDBOutputFactory{})
@@ -0,0 +1,249 @@
+package plugins
+
+import (
+	"context"
+	"encoding/binary"
+	"github.com/moriyoshi/ik"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_bsonEncoder_roundTrip(t *testing.T) {
+	now := time.Unix(1400000000, 123000000)
+	encoder := &bsonEncoder{}
+	err := encoder.putDocument(bsonDocument{
+		{"s", "text"},
+		{"b", []byte("bytes")},
+		{"i", 1},
+		{"i32", int32(2)},
+		{"u", uint64(3)},
+		{"f", 1.5},
+		{"t", true},
+		{"n", nil},
+		{"d", now},
+		{"o", map[string]interface{}{"x": "y"}},
+		{"a", []interface{}{"p", int64(4)}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	doc, err := decodeBSON(encoder.buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := map[string]interface{}{
+		"s":   "text",
+		"b":   "bytes",
+		"i":   int64(1),
+		"i32": int32(2),
+		"u":   int64(3),
+		"f":   1.5,
+		"t":   true,
+		"n":   nil,
+	}
+	for name, value := range expected {
+		if doc[name] != value {
+			t.Logf("%s: expected %#v, got %#v", name, value, doc[name])
+			t.Fail()
+		}
+	}
+	if !doc["d"].(time.Time).Equal(now) {
+		t.Logf("%v", doc["d"])
+		t.Fail()
+	}
+	if doc["o"].(map[string]interface{})["x"] != "y" {
+		t.Fail()
+	}
+	if a := doc["a"].([]interface{}); len(a) != 2 || a[0] != "p" || a[1] != int64(4) {
+		t.Logf("%v", a)
+		t.Fail()
+	}
+	if len(doc) != 11 {
+		t.Fail()
+	}
+	_, err = decodeBSON(encoder.buf[:len(encoder.buf)-3])
+	if err == nil {
+		t.Fail()
+	}
+	if err = (&bsonEncoder{}).putDocument(bsonDocument{{"a\x00b", 1}}); err == nil {
+		t.Fail()
+	}
+}
+
+// The example exchange of RFC 7677.
+func Test_mongoScramFinal(t *testing.T) {
+	clientFinal, serverSignature, err := mongoScramFinal(
+		"pencil",
+		"rOprNGfwEbeRWgbNEkqO",
+		"n=user,r=rOprNGfwEbeRWgbNEkqO",
+		"r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+	)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if clientFinal != "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=" {
+		t.Log(clientFinal)
+		t.Fail()
+	}
+	if serverSignature != "6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=" {
+		t.Log(serverSignature)
+		t.Fail()
+	}
+	_, _, err = mongoScramFinal("pencil", "other", "n=user,r=other", "r=rOprNGfwEbeRWgbNEkqO,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func Test_MongoDBOutput_encodeDocument(t *testing.T) {
+	output := &MongoDBOutput{timeKey: "time", tagKey: "tag", collection: "logs.${tag}"}
+	packer := &MongoDBOutputPacker{output}
+	record := ik.FluentRecord{Tag: "test", Timestamp: 1400000000, Data: map[string]interface{}{"n": 1, "f": 1.5, "m": "x", "time": "dropped"}}
+	b, err := packer.Pack(record)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if output.collectionOf(record) != "logs.test" {
+		t.Fail()
+	}
+	// the _id is the one given at packing, however many times it is encoded
+	first, err := output.encodeDocument(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	second, _ := output.encodeDocument(b)
+	if string(first) != string(second) {
+		t.Fail()
+	}
+	doc, err := decodeBSON(first)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, ok := doc["_id"].(bsonObjectId); !ok {
+		t.Fail()
+	}
+	if doc["n"] != int64(1) || doc["f"] != 1.5 || doc["m"] != "x" || doc["tag"] != "test" {
+		t.Logf("%v", doc)
+		t.Fail()
+	}
+	if !doc["time"].(time.Time).Equal(time.Unix(1400000000, 0)) {
+		t.Logf("%v", doc["time"])
+		t.Fail()
+	}
+}
+
+func readMongoMessage(t *testing.T, conn net.Conn) (int32, map[string]interface{}, [][]byte) {
+	header := make([]byte, 16)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return 0, nil, nil
+	}
+	body := make([]byte, binary.LittleEndian.Uint32(header)-16)
+	_, err = io.ReadFull(conn, body)
+	if err != nil {
+		t.Error(err.Error())
+		return 0, nil, nil
+	}
+	decoder := &bsonDecoder{data: body, offset: 5}
+	command := decoder.document()
+	documents := make([][]byte, 0)
+	for decoder.err == nil && decoder.offset < len(body) {
+		decoder.take(1)
+		end := decoder.offset
+		end += int(decoder.int32())
+		decoder.cstring()
+		for decoder.offset < end {
+			start := decoder.offset
+			decoder.document()
+			documents = append(documents, body[start:decoder.offset])
+		}
+	}
+	if decoder.err != nil {
+		t.Error(decoder.err.Error())
+	}
+	return int32(binary.LittleEndian.Uint32(header[4:8])), command, documents
+}
+
+func writeMongoReply(conn net.Conn, responseTo int32, reply bsonDocument) {
+	encoder := &bsonEncoder{}
+	encoder.putInt32(0)
+	encoder.putInt32(0)
+	encoder.putInt32(responseTo)
+	encoder.putInt32(mongoOpMsg)
+	encoder.putInt32(0)
+	encoder.buf = append(encoder.buf, 0)
+	encoder.putDocument(reply)
+	binary.LittleEndian.PutUint32(encoder.buf, uint32(len(encoder.buf)))
+	conn.Write(encoder.buf)
+}
+
+func Test_MongoDBOutput_deliver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+
+	batches := make(chan int, 4)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for i := 0; ; i++ {
+			requestId, command, documents := readMongoMessage(t, conn)
+			if command == nil {
+				return
+			}
+			if command["insert"] != "logs" || command["$db"] != "db" || command["ordered"] != false {
+				t.Errorf("unexpected command: %v", command)
+			}
+			batches <- len(documents)
+			reply := bsonDocument{{"ok", 1.0}, {"n", int32(len(documents))}}
+			if i == 1 {
+				// one of the documents was inserted by an earlier attempt
+				reply = bsonDocument{
+					{"ok", 1.0},
+					{"n", int32(len(documents) - 1)},
+					{"writeErrors", []interface{}{bsonDocument{{"index", int32(0)}, {"code", int32(mongoDuplicateKey)}, {"errmsg", "E11000"}}}},
+				}
+			} else if i == 2 {
+				reply = bsonDocument{
+					{"ok", 1.0},
+					{"n", int32(0)},
+					{"writeErrors", []interface{}{bsonDocument{{"index", int32(0)}, {"code", int32(2)}, {"errmsg", "bad"}}}},
+				}
+			}
+			writeMongoReply(conn, requestId, reply)
+		}
+	}()
+
+	output := &MongoDBOutput{
+		logger:    &testLogger{t},
+		client:    &mongoClient{address: listener.Addr().String(), timeout: 5 * time.Second},
+		database:  "db",
+		timeKey:   "time",
+		batchSize: 2,
+	}
+	packer := &MongoDBOutputPacker{output}
+	data := make([]byte, 0)
+	for i := 0; i < 3; i++ {
+		b, _ := packer.Pack(ik.FluentRecord{Tag: "test", Timestamp: 1400000000, Data: map[string]interface{}{"i": i}})
+		data = append(data, b...)
+	}
+	err = output.deliver(context.Background(), "logs", &testJournalChunk{data})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if <-batches != 2 || <-batches != 1 {
+		t.Fail()
+	}
+	err = output.deliver(context.Background(), "logs", &testJournalChunk{data[:len(data)/3]})
+	if err == nil {
+		t.Fail()
+	}
+	output.client.close()
+}
@@ -0,0 +1,232 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NATSOutput publishes the records in JSON to the subject templated from
+// subject, each key having a buffer of its own.  With jetstream set, every
+// message waits for the acknowledgement of the stream capturing the
+// subject, and carries an id the stream deduplicates the retries of a
+// chunk by.
+type NATSOutput struct {
+	*bufferedOutput
+	factory    *NATSOutputFactory
+	logger     ik.Logger
+	client     *natsClient
+	clientMtx  sync.Mutex
+	subject    string
+	jetStream  bool
+	ackTimeout time.Duration
+}
+
+// natsBufferedMessage is how a record sits in the buffer, with the id
+// given when it is packed.
+type natsBufferedMessage struct {
+	Id   string          `json:"i"`
+	Data json.RawMessage `json:"d"`
+}
+
+type NATSOutputPacker struct{}
+
+type NATSOutputFactory struct {
+}
+
+func (packer *NATSOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	data, err := json.Marshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(natsBufferedMessage{Id: hex.EncodeToString(id), Data: data})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (output *NATSOutput) subjectOf(record ik.FluentRecord) string {
+	return strings.Replace(output.subject, "${tag}", record.Tag, -1)
+}
+
+func (output *NATSOutput) deliver(ctx context.Context, subject string, chunk ik.JournalChunk) error {
+	messages := make([]natsMessage, 0)
+	err := readChunk(chunk, func(reader io.Reader) error {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(nil, 1<<30)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			buffered := natsBufferedMessage{}
+			err := json.Unmarshal(line, &buffered)
+			if err != nil {
+				return err
+			}
+			messages = append(messages, natsMessage{id: buffered.Id, payload: []byte(buffered.Data)})
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return err
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	output.clientMtx.Lock()
+	defer output.clientMtx.Unlock()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if output.jetStream {
+		err = output.client.publishJetStream(subject, messages, output.ackTimeout)
+	} else {
+		err = output.client.publish(subject, messages)
+	}
+	if err != nil {
+		return err
+	}
+	output.logger.Info("Published %d messages to %s", len(messages), subject)
+	return nil
+}
+
+func (output *NATSOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *NATSOutput) Shutdown() error {
+	return output.ShutdownContext(context.Background())
+}
+
+func (output *NATSOutput) ShutdownContext(ctx context.Context) error {
+	err := output.bufferedOutput.ShutdownContext(ctx)
+	output.clientMtx.Lock()
+	output.client.close()
+	output.clientMtx.Unlock()
+	return err
+}
+
+func (output *NATSOutput) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *NATSOutputFactory) Name() string {
+	return "nats"
+}
+
+func (factory *NATSOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	subject, ok := config.Attrs["subject"]
+	if !ok {
+		subject = "${tag}"
+	}
+	host, ok := config.Attrs["host"]
+	if !ok {
+		host = "localhost"
+	}
+	netPort, ok := config.Attrs["port"]
+	if !ok {
+		netPort = "4222"
+	}
+	timeout := time.Duration(30 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	jetStream := false
+	jetStreamStr, ok := config.Attrs["jetstream"]
+	if ok {
+		var err error
+		jetStream, err = strconv.ParseBool(jetStreamStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ackTimeout, err := parseForwardDuration(config, "ack_timeout", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	client := &natsClient{
+		address:  net.JoinHostPort(host, netPort),
+		timeout:  timeout,
+		user:     config.Attrs["user"],
+		password: config.Attrs["password"],
+		token:    config.Attrs["token"],
+	}
+	client.socketOptions, err = ik.ParseSocketOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	tlsStr, ok := config.Attrs["tls"]
+	if ok {
+		tls_, err := strconv.ParseBool(tlsStr)
+		if err != nil {
+			return nil, err
+		}
+		if tls_ {
+			client.tlsConfig, err = newTLSClientConfig(config)
+			if err != nil {
+				return nil, err
+			}
+			client.tlsConfig.ServerName = host
+		}
+	}
+	if strings.ContainsAny(subject, " \t\r\n") {
+		return nil, errors.New("the subject cannot have white space in it")
+	}
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &NATSOutput{
+		factory:    factory,
+		logger:     engine.Logger(),
+		client:     client,
+		subject:    subject,
+		jetStream:  jetStream,
+		ackTimeout: ackTimeout,
+	}
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&NATSOutputPacker{},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	output.bufferedOutput.subKeyer = output.subjectOf
+	return output, nil
+}
+
+func (factory *NATSOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&NATSOutputFactory{})
@@ -0,0 +1,124 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"github.com/moriyoshi/ik"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveNATS speaks enough of the protocol to take publications, acknowledging
+// those with a reply subject as a JetStream stream would, and dropping the
+// ones with an id it has seen.
+func serveNATS(t *testing.T, listener net.Listener, published chan<- string) {
+	conn, err := listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte("INFO {\"headers\":true,\"max_payload\":1024}\r\n"))
+	reader := bufio.NewReader(conn)
+	seen := make(map[string]bool)
+	seq := 0
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "CONNECT":
+			connect := natsConnect{}
+			json.Unmarshal([]byte(line[8:]), &connect)
+			if connect.User != "user" || connect.Pass != "pass" || !connect.Headers {
+				conn.Write([]byte("-ERR 'Authorization Violation'\r\n"))
+				return
+			}
+		case "PING":
+			conn.Write([]byte("PONG\r\n"))
+		case "SUB":
+		case "PUB", "HPUB":
+			size, _ := strconv.Atoi(fields[len(fields)-1])
+			payload := make([]byte, size+2)
+			io.ReadFull(reader, payload)
+			payload = payload[:size]
+			if fields[0] == "PUB" {
+				published <- fields[1] + " " + string(payload)
+				continue
+			}
+			headerLen, _ := strconv.Atoi(fields[len(fields)-2])
+			id := strings.TrimSpace(strings.SplitN(string(payload[:headerLen]), "Nats-Msg-Id:", 2)[1])
+			ack := "{\"stream\":\"S\",\"seq\":" + strconv.Itoa(seq) + ",\"duplicate\":true}"
+			if !seen[id] {
+				seen[id] = true
+				seq += 1
+				ack = "{\"stream\":\"S\",\"seq\":" + strconv.Itoa(seq) + "}"
+				published <- fields[1] + " " + string(payload[headerLen:])
+			}
+			conn.Write([]byte("MSG " + fields[2] + " 1 " + strconv.Itoa(len(ack)) + "\r\n" + ack + "\r\n"))
+		}
+	}
+}
+
+func Test_NATSOutput_deliver(t *testing.T) {
+	for _, jetStream := range []bool{false, true} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		published := make(chan string, 16)
+		go serveNATS(t, listener, published)
+
+		output := &NATSOutput{
+			logger:     &testLogger{t},
+			client:     &natsClient{address: listener.Addr().String(), timeout: 5 * time.Second, user: "user", password: "pass"},
+			subject:    "logs.${tag}",
+			jetStream:  jetStream,
+			ackTimeout: time.Second,
+		}
+		packer := &NATSOutputPacker{}
+		data := make([]byte, 0)
+		for i := 0; i < 2; i++ {
+			b, _ := packer.Pack(ik.FluentRecord{Tag: "test", Data: map[string]interface{}{"i": i}})
+			data = append(data, b...)
+		}
+		subject := output.subjectOf(ik.FluentRecord{Tag: "test"})
+		for i := 0; i < 2; i++ {
+			err = output.deliver(context.Background(), subject, &testJournalChunk{data})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+		expected := []string{"logs.test {\"i\":0}", "logs.test {\"i\":1}"}
+		if !jetStream {
+			// without JetStream a retried chunk is published again
+			expected = append(expected, expected...)
+		}
+		for _, message := range expected {
+			if got := <-published; got != message {
+				t.Logf("jetstream %v: expected %s, got %s", jetStream, message, got)
+				t.Fail()
+			}
+		}
+		select {
+		case message := <-published:
+			t.Logf("jetstream %v: unexpected %s", jetStream, message)
+			t.Fail()
+		default:
+		}
+		// a message exceeding max_payload is refused before anything is sent
+		big, _ := packer.Pack(ik.FluentRecord{Tag: "test", Data: map[string]interface{}{"s": strings.Repeat("x", 2048)}})
+		err = output.deliver(context.Background(), subject, &testJournalChunk{big})
+		if err == nil {
+			t.Fail()
+		}
+		output.client.close()
+		listener.Close()
+	}
+}
@@ -0,0 +1,302 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisMaxValuesPerCommand = 1000
+
+// RedisOutput pushes the records in JSON onto a list with LPUSH or RPUSH,
+// or adds them to a stream with XADD, under the key templated from key.
+// Each key has a buffer of its own.  A chunk that failed halfway is pushed
+// again as a whole, so a record may be pushed more than once.
+type RedisOutput struct {
+	*bufferedOutput
+	factory   *RedisOutputFactory
+	logger    ik.Logger
+	client    *redisClient
+	clientMtx sync.Mutex
+	key       string
+	command   string
+	maxLen    int64
+}
+
+type RedisOutputPacker struct{}
+
+type RedisOutputFactory struct {
+}
+
+func (packer *RedisOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	b, err := json.Marshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (output *RedisOutput) keyOf(record ik.FluentRecord) string {
+	return strings.Replace(output.key, "${tag}", record.Tag, -1)
+}
+
+// redisStreamFields turns a record into the field-value pairs of a stream
+// entry; the values that are not strings are kept in JSON.
+func redisStreamFields(line []byte) ([]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	data := make(map[string]interface{})
+	err := decoder.Decode(&data)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(data))
+	for name := range data {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	retval := make([]string, 0, len(data)*2)
+	for _, name := range names {
+		value, ok := data[name].(string)
+		if !ok {
+			b, err := json.Marshal(data[name])
+			if err != nil {
+				return nil, err
+			}
+			value = string(b)
+		}
+		retval = append(retval, name, value)
+	}
+	return retval, nil
+}
+
+// buildCommands makes the commands for the lines of a chunk: a push of up
+// to redisMaxValuesPerCommand values each, or an XADD for each line.
+func (output *RedisOutput) buildCommands(key string, lines [][]byte) ([][]string, error) {
+	commands := make([][]string, 0)
+	if output.command == "xadd" {
+		for _, line := range lines {
+			fields, err := redisStreamFields(line)
+			if err != nil {
+				return nil, err
+			}
+			if len(fields) == 0 {
+				continue
+			}
+			command := []string{"XADD", key}
+			if output.maxLen > 0 {
+				command = append(command, "MAXLEN", "~", strconv.FormatInt(output.maxLen, 10))
+			}
+			commands = append(commands, append(append(command, "*"), fields...))
+		}
+		return commands, nil
+	}
+	for len(lines) > 0 {
+		n := len(lines)
+		if n > redisMaxValuesPerCommand {
+			n = redisMaxValuesPerCommand
+		}
+		command := []string{strings.ToUpper(output.command), key}
+		for _, line := range lines[:n] {
+			command = append(command, string(line))
+		}
+		commands = append(commands, command)
+		lines = lines[n:]
+	}
+	if output.maxLen > 0 && len(commands) > 0 {
+		// keep the newest entries, which LPUSH puts at the head
+		if output.command == "lpush" {
+			commands = append(commands, []string{"LTRIM", key, "0", strconv.FormatInt(output.maxLen-1, 10)})
+		} else {
+			commands = append(commands, []string{"LTRIM", key, strconv.FormatInt(-output.maxLen, 10), "-1"})
+		}
+	}
+	return commands, nil
+}
+
+// deliver sends the commands for a chunk in a single pipeline.
+func (output *RedisOutput) deliver(ctx context.Context, key string, chunk ik.JournalChunk) error {
+	lines := make([][]byte, 0)
+	err := readChunk(chunk, func(reader io.Reader) error {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(nil, 1<<30)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) > 0 {
+				lines = append(lines, append([]byte{}, line...))
+			}
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return err
+	}
+	commands, err := output.buildCommands(key, lines)
+	if err != nil {
+		return err
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	output.clientMtx.Lock()
+	defer output.clientMtx.Unlock()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	_, err = output.client.do(commands)
+	if err != nil {
+		return err
+	}
+	output.logger.Info("Sent %d records to %s", len(lines), key)
+	return nil
+}
+
+func (output *RedisOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *RedisOutput) Shutdown() error {
+	return output.ShutdownContext(context.Background())
+}
+
+func (output *RedisOutput) ShutdownContext(ctx context.Context) error {
+	err := output.bufferedOutput.ShutdownContext(ctx)
+	output.clientMtx.Lock()
+	output.client.close()
+	output.clientMtx.Unlock()
+	return err
+}
+
+func (output *RedisOutput) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *RedisOutputFactory) Name() string {
+	return "redis"
+}
+
+func (factory *RedisOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	key, ok := config.Attrs["key"]
+	if !ok {
+		key = "${tag}"
+	}
+	command, ok := config.Attrs["command"]
+	if !ok {
+		command = "lpush"
+	}
+	command = strings.ToLower(command)
+	switch command {
+	case "lpush", "rpush", "xadd":
+	default:
+		return nil, errors.New("unsupported command: " + command)
+	}
+	host, ok := config.Attrs["host"]
+	if !ok {
+		host = "localhost"
+	}
+	netPort, ok := config.Attrs["port"]
+	if !ok {
+		netPort = "6379"
+	}
+	timeout := time.Duration(30 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		var err error
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	db := 0
+	dbStr, ok := config.Attrs["db"]
+	if ok {
+		var err error
+		db, err = strconv.Atoi(dbStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	maxLen := int64(0)
+	maxLenStr, ok := config.Attrs["max_length"]
+	if ok {
+		var err error
+		maxLen, err = strconv.ParseInt(maxLenStr, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if maxLen <= 0 {
+			return nil, errors.New(fmt.Sprintf("invalid max_length: %s", maxLenStr))
+		}
+	}
+	client := &redisClient{
+		address:  net.JoinHostPort(host, netPort),
+		timeout:  timeout,
+		username: config.Attrs["username"],
+		password: config.Attrs["password"],
+		db:       db,
+	}
+	socketOptions, err := ik.ParseSocketOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	client.socketOptions = socketOptions
+	tlsStr, ok := config.Attrs["tls"]
+	if ok {
+		tls_, err := strconv.ParseBool(tlsStr)
+		if err != nil {
+			return nil, err
+		}
+		if tls_ {
+			client.tlsConfig, err = newTLSClientConfig(config)
+			if err != nil {
+				return nil, err
+			}
+			client.tlsConfig.ServerName = host
+		}
+	}
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &RedisOutput{
+		factory: factory,
+		logger:  engine.Logger(),
+		client:  client,
+		key:     key,
+		command: command,
+		maxLen:  maxLen,
+	}
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&RedisOutputPacker{},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	output.bufferedOutput.subKeyer = output.keyOf
+	return output, nil
+}
+
+func (factory *RedisOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&RedisOutputFactory{})
@@ -0,0 +1,146 @@
+package plugins
+
+import (
+	"bufio"
+	"context"
+	"github.com/moriyoshi/ik"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_RedisOutput_buildCommands(t *testing.T) {
+	lines := [][]byte{[]byte("{\"b\":1,\"a\":\"x\"}"), []byte("{\"c\":{\"d\":true}}")}
+	cases := []struct {
+		command  string
+		maxLen   int64
+		expected []string
+	}{
+		{"lpush", 0, []string{"LPUSH key {\"b\":1,\"a\":\"x\"} {\"c\":{\"d\":true}}"}},
+		{"lpush", 10, []string{"LPUSH key {\"b\":1,\"a\":\"x\"} {\"c\":{\"d\":true}}", "LTRIM key 0 9"}},
+		{"rpush", 10, []string{"RPUSH key {\"b\":1,\"a\":\"x\"} {\"c\":{\"d\":true}}", "LTRIM key -10 -1"}},
+		{"xadd", 0, []string{"XADD key * a x b 1", "XADD key * c {\"d\":true}"}},
+		{"xadd", 10, []string{"XADD key MAXLEN ~ 10 * a x b 1", "XADD key MAXLEN ~ 10 * c {\"d\":true}"}},
+	}
+	for _, case_ := range cases {
+		output := &RedisOutput{command: case_.command, maxLen: case_.maxLen}
+		commands, err := output.buildCommands("key", lines)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(commands) != len(case_.expected) {
+			t.Logf("%s: %v", case_.command, commands)
+			t.Fail()
+			continue
+		}
+		for i, command := range commands {
+			if strings.Join(command, " ") != case_.expected[i] {
+				t.Logf("%s: %q", case_.command, command)
+				t.Fail()
+			}
+		}
+	}
+	// a push of many records is split
+	many := make([][]byte, redisMaxValuesPerCommand+1)
+	for i := range many {
+		many[i] = []byte("{}")
+	}
+	commands, _ := (&RedisOutput{command: "lpush"}).buildCommands("key", many)
+	if len(commands) != 2 || len(commands[0]) != redisMaxValuesPerCommand+2 || len(commands[1]) != 3 {
+		t.Fail()
+	}
+}
+
+func readRedisCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	command := make([]string, n)
+	for i := range command {
+		line, err = reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		b := make([]byte, size+2)
+		_, err = io.ReadFull(reader, b)
+		if err != nil {
+			return nil, err
+		}
+		command[i] = string(b[:size])
+	}
+	return command, nil
+}
+
+func Test_RedisOutput_deliver(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer listener.Close()
+	commands := make(chan []string, 16)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		for {
+			command, err := readRedisCommand(reader)
+			if err != nil {
+				return
+			}
+			commands <- command
+			switch command[0] {
+			case "AUTH":
+				if command[1] != "secret" {
+					conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+					continue
+				}
+				conn.Write([]byte("+OK\r\n"))
+			case "SELECT":
+				conn.Write([]byte("+OK\r\n"))
+			case "LPUSH":
+				if command[1] == "wrong" {
+					conn.Write([]byte("-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"))
+					continue
+				}
+				conn.Write([]byte(":" + strconv.Itoa(len(command)-2) + "\r\n"))
+			}
+		}
+	}()
+
+	output := &RedisOutput{
+		logger:  &testLogger{t},
+		client:  &redisClient{address: listener.Addr().String(), timeout: 5 * time.Second, password: "secret", db: 2},
+		key:     "logs:${tag}",
+		command: "lpush",
+	}
+	key := output.keyOf(ik.FluentRecord{Tag: "test"})
+	if key != "logs:test" {
+		t.Fail()
+	}
+	chunk := &testJournalChunk{[]byte("{\"a\":1}\n{\"a\":2}\n")}
+	err = output.deliver(context.Background(), key, chunk)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, expected := range []string{"AUTH secret", "SELECT 2", "LPUSH logs:test {\"a\":1} {\"a\":2}"} {
+		if command := strings.Join(<-commands, " "); command != expected {
+			t.Logf("expected %s, got %s", expected, command)
+			t.Fail()
+		}
+	}
+	// an error reply fails the chunk but leaves the connection usable
+	err = output.deliver(context.Background(), "wrong", chunk)
+	if err == nil || !strings.Contains(err.Error(), "WRONGTYPE") || output.client.conn == nil {
+		t.Fail()
+	}
+	output.client.close()
+}
@@ -0,0 +1,74 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"github.com/moriyoshi/ik"
+)
+
+// RelabelOutput sends the records it matched into the label given as its
+// @label, whose filters and outputs take them from there on.
+type RelabelOutput struct {
+	factory *RelabelOutputFactory
+	port    ik.Port
+	cancel  chan bool
+}
+
+func (output *RelabelOutput) Emit(recordSets []ik.FluentRecordSet) error {
+	return output.port.Emit(recordSets)
+}
+
+func (output *RelabelOutput) EmitContext(ctx context.Context, recordSets []ik.FluentRecordSet) error {
+	return ik.EmitContext(ctx, output.port, recordSets)
+}
+
+func (output *RelabelOutput) EmitDurably(recordSets []ik.FluentRecordSet) error {
+	return ik.EmitDurably(output.port, recordSets)
+}
+
+func (output *RelabelOutput) EmitWithResult(recordSets []ik.FluentRecordSet) []error {
+	return ik.EmitWithResult(output.port, recordSets)
+}
+
+func (output *RelabelOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *RelabelOutput) Run() error {
+	<-output.cancel
+	return nil
+}
+
+func (output *RelabelOutput) Shutdown() error {
+	output.cancel <- true
+	return nil
+}
+
+func (output *RelabelOutput) Dispose() {
+	output.Shutdown()
+}
+
+type RelabelOutputFactory struct {
+}
+
+func (factory *RelabelOutputFactory) Name() string {
+	return "relabel"
+}
+
+// New creates an output emitting at the default port of the engine, which
+// is the label of the <match> element.
+func (factory *RelabelOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	if _, ok := config.Attrs["@label"]; !ok {
+		return nil, errors.New("required attribute `@label' is not specified")
+	}
+	return &RelabelOutput{
+		factory: factory,
+		port:    engine.DefaultPort(),
+		cancel:  make(chan bool, 1),
+	}, nil
+}
+
+func (factory *RelabelOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&RelabelOutputFactory{})
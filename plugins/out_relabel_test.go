@@ -0,0 +1,25 @@
+package plugins
+
+import (
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/iktest"
+	"testing"
+)
+
+func Test_RelabelOutput(t *testing.T) {
+	engine := iktest.NewEngine(t)
+	factory := &RelabelOutputFactory{}
+	_, err := factory.New(engine, &ik.ConfigElement{Attrs: map[string]string{}})
+	if err == nil {
+		t.Fatal("no @label is accepted")
+	}
+	output, err := factory.New(engine, &ik.ConfigElement{Attrs: map[string]string{"@label": "@other"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = ik.EmitDurably(output, []ik.FluentRecordSet{{Tag: "test", Records: []ik.TinyFluentRecord{{Timestamp: 1}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	iktest.ExpectRecordCount(t, engine.Port().RecordSets(), 1)
+}
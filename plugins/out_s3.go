@@ -0,0 +1,424 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	strftime "github.com/jehiah/go-strftime"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// S3 rejects parts smaller than this except for the last one
+	s3MinPartSize = 5 * 1024 * 1024
+	// separates the time slice from the tag in the sub key of the buffer
+	s3SubKeySeparator = "\x1f"
+)
+
+type s3Compressor struct {
+	extension   string
+	contentType string
+	compress    func(data []byte) ([]byte, error)
+}
+
+type s3InitiateMultipartUploadResult struct {
+	UploadId string `xml:"UploadId"`
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type S3Output struct {
+	*bufferedOutput
+	factory            *S3OutputFactory
+	logger             ik.Logger
+	client             *http.Client
+	endpoint           string
+	bucket             string
+	forcePathStyle     bool
+	region             string
+	credentials        awsCredentialsProvider
+	path               string
+	objectKeyFormat    string
+	timeSliceFormat    string
+	timeFormat         string
+	format             string
+	location           *time.Location
+	hostname           string
+	compressor         *s3Compressor
+	multipartThreshold int64
+	partSize           int64
+	clock              ik.Clock
+}
+
+type S3OutputPacker struct {
+	output *S3Output
+}
+
+type S3OutputFactory struct {
+}
+
+func newZstdCompressor() (*s3Compressor, error) {
+	compress, err := newZstdCompressFunc()
+	if err != nil {
+		return nil, err
+	}
+	return &s3Compressor{"zst", "application/zstd", compress}, nil
+}
+
+func newS3Compressor(storeAs string) (*s3Compressor, error) {
+	switch storeAs {
+	case "gzip":
+		return &s3Compressor{"gz", "application/x-gzip", gzipCompress}, nil
+	case "zstd":
+		return newZstdCompressor()
+	case "text":
+		return &s3Compressor{"log", "text/plain", func(data []byte) ([]byte, error) { return data, nil }}, nil
+	}
+	return nil, errors.New("unsupported store_as: " + storeAs)
+}
+
+func (packer *S3OutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	output := packer.output
+	b, err := json.Marshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	if output.format == "json" {
+		return append(b, '\n'), nil
+	}
+	timestamp := time.Unix(int64(record.Timestamp), 0).In(output.location)
+	var formattedTime string
+	if output.timeFormat == "" {
+		formattedTime = timestamp.Format(time.RFC3339)
+	} else {
+		formattedTime = strftime.Format(output.timeFormat, timestamp)
+	}
+	return ([]byte)(fmt.Sprintf("%s\t%s\t%s\n", formattedTime, record.Tag, b)), nil
+}
+
+func (output *S3Output) subKey(record ik.FluentRecord) string {
+	timeSlice := strftime.Format(output.timeSliceFormat, time.Unix(int64(record.Timestamp), 0).In(output.location))
+	return timeSlice + s3SubKeySeparator + record.Tag
+}
+
+// buildObjectKey expands the placeholders of s3_object_key_format.  The
+// chunk id is derived from the content so that a retried upload overwrites
+// the object instead of leaving a duplicate.
+func (output *S3Output) buildObjectKey(subKey string, data []byte) string {
+	pair := strings.SplitN(subKey, s3SubKeySeparator, 2)
+	timeSlice, tag := pair[0], ""
+	if len(pair) == 2 {
+		tag = pair[1]
+	}
+	digest := sha256.Sum256(data)
+	return strings.NewReplacer(
+		"%{path}", output.path,
+		"%{time_slice}", timeSlice,
+		"%{tag}", tag,
+		"%{chunk_id}", hex.EncodeToString(digest[0:16]),
+		"%{hostname}", output.hostname,
+		"%{file_extension}", output.compressor.extension,
+	).Replace(output.objectKeyFormat)
+}
+
+func (output *S3Output) objectURL(key string) string {
+	if output.forcePathStyle {
+		return output.endpoint + "/" + output.bucket + "/" + awsURIEncode(key, false)
+	}
+	comps := strings.SplitN(output.endpoint, "://", 2)
+	return comps[0] + "://" + output.bucket + "." + comps[1] + "/" + awsURIEncode(key, false)
+}
+
+func (output *S3Output) do(ctx context.Context, method string, url string, payload []byte, contentType string, metadata map[string]string) ([]byte, http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for name, value := range metadata {
+		req.Header.Set("X-Amz-Meta-"+name, value)
+	}
+	req.Header.Set("X-Amz-Content-Sha256", awsHash(payload))
+	credentials, err := output.credentials.credentials()
+	if err != nil {
+		return nil, nil, err
+	}
+	signAWSRequest(req, payload, credentials, output.region, "s3", output.clock.Now())
+	resp, err := output.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		errorResponse := struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}{}
+		xml.Unmarshal(body, &errorResponse)
+		return nil, nil, errors.New(fmt.Sprintf("S3 returned %s for %s %s: %s %s", resp.Status, method, url, errorResponse.Code, errorResponse.Message))
+	}
+	return body, resp.Header, nil
+}
+
+func (output *S3Output) uploadMultipart(ctx context.Context, url string, data []byte, metadata map[string]string) error {
+	body, _, err := output.do(ctx, "POST", url+"?uploads", []byte{}, output.compressor.contentType, metadata)
+	if err != nil {
+		return err
+	}
+	result := s3InitiateMultipartUploadResult{}
+	err = xml.Unmarshal(body, &result)
+	if err != nil {
+		return err
+	}
+	uploadId := awsURIEncode(result.UploadId, true)
+	complete := s3CompleteMultipartUpload{}
+	for offset := int64(0); offset < int64(len(data)); offset += output.partSize {
+		end := offset + output.partSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		partNumber := len(complete.Parts) + 1
+		_, header, err := output.do(ctx, "PUT", url+"?partNumber="+strconv.Itoa(partNumber)+"&uploadId="+uploadId, data[offset:end], "", nil)
+		if err != nil {
+			// abort the upload even if ctx has been cancelled, lest the
+			// parts uploaded so far are kept
+			output.do(context.WithoutCancel(ctx), "DELETE", url+"?uploadId="+uploadId, []byte{}, "", nil)
+			return err
+		}
+		complete.Parts = append(complete.Parts, s3CompletedPart{partNumber, header.Get("ETag")})
+	}
+	payload, err := xml.Marshal(&complete)
+	if err != nil {
+		return err
+	}
+	// CompleteMultipartUpload may fail with a 200 response, in which case the
+	// body is an Error element
+	body, _, err = output.do(ctx, "POST", url+"?uploadId="+uploadId, payload, "application/xml", nil)
+	if err == nil && bytes.Contains(body, []byte("<Error>")) {
+		err = errors.New("failed to complete the multipart upload: " + string(body))
+	}
+	if err != nil {
+		output.do(context.WithoutCancel(ctx), "DELETE", url+"?uploadId="+uploadId, []byte{}, "", nil)
+		return err
+	}
+	return nil
+}
+
+func (output *S3Output) deliver(ctx context.Context, subKey string, chunk ik.JournalChunk) error {
+	var data []byte
+	digest := newChunkDigest()
+	err := readChunk(chunk, func(reader io.Reader) error {
+		var err error
+		data, err = ioutil.ReadAll(io.TeeReader(reader, digest))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	// the checksum of the records before compression, for the consumers
+	// of the object to verify it with
+	metadata := map[string]string{"Checksum": formatChunkDigest(digest)}
+	key := output.buildObjectKey(subKey, data)
+	compressed, err := output.compressor.compress(data)
+	if err != nil {
+		return err
+	}
+	url := output.objectURL(key)
+	if int64(len(compressed)) > output.multipartThreshold {
+		err = output.uploadMultipart(ctx, url, compressed, metadata)
+	} else {
+		_, _, err = output.do(ctx, "PUT", url, compressed, output.compressor.contentType, metadata)
+	}
+	if err != nil {
+		return err
+	}
+	output.logger.Notice("Uploaded %d bytes to s3://%s/%s", len(compressed), output.bucket, key)
+	return nil
+}
+
+func (output *S3Output) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *S3Output) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *S3OutputFactory) Name() string {
+	return "s3"
+}
+
+func (factory *S3OutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	bucket, ok := config.Attrs["s3_bucket"]
+	if !ok {
+		return nil, errors.New("required attribute `s3_bucket' is not specified")
+	}
+	region, ok := config.Attrs["s3_region"]
+	if !ok {
+		region = "us-east-1"
+	}
+	endpoint, ok := config.Attrs["s3_endpoint"]
+	if !ok {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	endpoint = strings.TrimRight(endpoint, "/")
+	if !strings.Contains(endpoint, "://") {
+		return nil, errors.New("invalid s3_endpoint: " + endpoint)
+	}
+	forcePathStyle := false
+	forcePathStyleStr, ok := config.Attrs["force_path_style"]
+	if ok {
+		var err error
+		forcePathStyle, err = strconv.ParseBool(forcePathStyleStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	credentials, err := newAWSCredentialsProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	objectKeyFormat, ok := config.Attrs["s3_object_key_format"]
+	if !ok {
+		objectKeyFormat = "%{path}%{time_slice}_%{chunk_id}.%{file_extension}"
+	}
+	timeSliceFormat, ok := config.Attrs["time_slice_format"]
+	if !ok {
+		timeSliceFormat = "%Y%m%d%H"
+	}
+	format, ok := config.Attrs["format"]
+	if !ok {
+		format = "out_file"
+	}
+	if format != "out_file" && format != "json" {
+		return nil, errors.New("unsupported format: " + format)
+	}
+	location := time.UTC
+	localtimeStr, ok := config.Attrs["localtime"]
+	if ok {
+		localtime, err := strconv.ParseBool(localtimeStr)
+		if err != nil {
+			return nil, err
+		}
+		if localtime {
+			location = time.Local
+		}
+	}
+	location, err = ik.LocationFromConfig(config, location)
+	if err != nil {
+		return nil, err
+	}
+	storeAs, ok := config.Attrs["store_as"]
+	if !ok {
+		storeAs = "gzip"
+	}
+	compressor, err := newS3Compressor(storeAs)
+	if err != nil {
+		return nil, err
+	}
+	partSize := int64(s3MinPartSize)
+	partSizeStr, ok := config.Attrs["multipart_chunk_size"]
+	if ok {
+		partSize, err = ik.ParseCapacityString(partSizeStr)
+		if err != nil {
+			return nil, err
+		}
+		if partSize < s3MinPartSize {
+			return nil, errors.New(fmt.Sprintf("multipart_chunk_size must be at least %d bytes", s3MinPartSize))
+		}
+	}
+	multipartThreshold := int64(64 * 1024 * 1024) // 64MB
+	multipartThresholdStr, ok := config.Attrs["multipart_threshold"]
+	if ok {
+		multipartThreshold, err = ik.ParseCapacityString(multipartThresholdStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	timeout := time.Duration(60 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	hostname, _ := os.Hostname()
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+	params.location = location
+
+	output := &S3Output{
+		factory:            factory,
+		logger:             engine.Logger(),
+		client:             &http.Client{Timeout: timeout},
+		endpoint:           endpoint,
+		bucket:             bucket,
+		forcePathStyle:     forcePathStyle,
+		region:             region,
+		credentials:        credentials,
+		path:               config.Attrs["path"],
+		objectKeyFormat:    objectKeyFormat,
+		timeSliceFormat:    timeSliceFormat,
+		timeFormat:         config.Attrs["time_format"],
+		format:             format,
+		location:           location,
+		hostname:           hostname,
+		compressor:         compressor,
+		multipartThreshold: multipartThreshold,
+		partSize:           partSize,
+		clock:              engine.Clock(),
+	}
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&S3OutputPacker{output},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	output.bufferedOutput.subKeyer = output.subKey
+	return output, nil
+}
+
+func (factory *S3OutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&S3OutputFactory{})
@@ -0,0 +1,78 @@
+package plugins
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_S3Output_DeliverMultipart(t *testing.T) {
+	requests := make([]string, 0)
+	uploaded := ""
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		requests = append(requests, req.Method+" "+req.URL.RequestURI())
+		if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ") {
+			resp.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch {
+		case req.Method == "POST" && req.URL.RawQuery == "uploads":
+			resp.Write([]byte("<InitiateMultipartUploadResult><UploadId>a/b</UploadId></InitiateMultipartUploadResult>"))
+		case req.Method == "PUT":
+			uploaded += string(body)
+			resp.Header().Set("ETag", "\"etag\"")
+		case req.Method == "POST":
+			if !strings.Contains(string(body), "<PartNumber>2</PartNumber>") {
+				resp.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			resp.Write([]byte("<CompleteMultipartUploadResult/>"))
+		}
+	}))
+	defer server.Close()
+
+	compressor, _ := newS3Compressor("text")
+	output := &S3Output{
+		logger:             &testLogger{t},
+		client:             &http.Client{},
+		endpoint:           server.URL,
+		bucket:             "bucket",
+		forcePathStyle:     true,
+		region:             "us-east-1",
+		credentials:        &staticAWSCredentialsProvider{awsCredentials{accessKeyId: "key", secretAccessKey: "secret"}},
+		path:               "logs/",
+		objectKeyFormat:    "%{path}%{tag}/%{time_slice}_%{chunk_id}.%{file_extension}",
+		compressor:         compressor,
+		multipartThreshold: 4,
+		partSize:           4,
+		clock:              ik.SystemClock,
+	}
+	data := "abcdefg\n"
+	err := output.deliver(context.Background(), "2014010100"+s3SubKeySeparator+"test", &testJournalChunk{[]byte(data)})
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	digest := sha256.Sum256([]byte(data))
+	key := "/bucket/logs/test/2014010100_" + hex.EncodeToString(digest[0:16]) + ".log"
+	expected := []string{
+		"POST " + key + "?uploads",
+		"PUT " + key + "?partNumber=1&uploadId=a%2Fb",
+		"PUT " + key + "?partNumber=2&uploadId=a%2Fb",
+		"POST " + key + "?uploadId=a%2Fb",
+	}
+	if strings.Join(requests, "\n") != strings.Join(expected, "\n") {
+		t.Logf("%v", requests)
+		t.Fail()
+	}
+	if uploaded != data {
+		t.Fail()
+	}
+}
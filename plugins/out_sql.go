@@ -0,0 +1,311 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// SQLOutput inserts the records into a database through database/sql.  The
+// driver named by `driver' has to be linked into the binary, which ik does
+// not do for any driver by itself.
+type SQLOutput struct {
+	*bufferedOutput
+	factory   *SQLOutputFactory
+	logger    ik.Logger
+	db        *sql.DB
+	statement string
+	columns   []outputColumn
+}
+
+type SQLOutputPacker struct {
+	output *SQLOutput
+}
+
+type SQLOutputFactory struct {
+}
+
+// Pack renders a record as a JSON array of the values of the columns, in
+// the order of the placeholders of the statement.
+func (packer *SQLOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	row := make([]interface{}, len(packer.output.columns))
+	for i, column := range packer.output.columns {
+		switch column.field {
+		case columnTagField:
+			row[i] = record.Tag
+		case columnTimeField:
+			row[i] = record.Timestamp
+		default:
+			row[i] = record.Data[column.field]
+		}
+	}
+	b, err := json.Marshal(row)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// sqlValue turns a value read back from the buffer into one every driver
+// takes; objects and arrays are stored as JSON text.
+func sqlValue(value interface{}) (interface{}, error) {
+	switch value := value.(type) {
+	case json.Number:
+		i, err := value.Int64()
+		if err == nil {
+			return i, nil
+		}
+		return value.Float64()
+	case map[string]interface{}, []interface{}:
+		b, err := json.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		return string(b), nil
+	}
+	return value, nil
+}
+
+func (output *SQLOutput) decodeRow(line []byte) ([]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(line))
+	decoder.UseNumber()
+	row := make([]interface{}, 0, len(output.columns))
+	err := decoder.Decode(&row)
+	if err != nil {
+		return nil, err
+	}
+	if len(row) != len(output.columns) {
+		return nil, errors.New(fmt.Sprintf("expected %d values, got %d", len(output.columns), len(row)))
+	}
+	for i, value := range row {
+		row[i], err = sqlValue(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return row, nil
+}
+
+// deliver inserts the rows of a chunk in a single transaction, so that a
+// chunk that failed halfway is rolled back as a whole and retried.
+func (output *SQLOutput) deliver(ctx context.Context, _ string, chunk ik.JournalChunk) error {
+	rows := make([][]interface{}, 0)
+	err := readChunk(chunk, func(reader io.Reader) error {
+		scanner := bufio.NewScanner(reader)
+		scanner.Buffer(nil, 1<<30)
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			row, err := output.decodeRow(line)
+			if err != nil {
+				return err
+			}
+			rows = append(rows, row)
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		return err
+	}
+	tx, err := output.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(ctx, output.statement)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, row := range rows {
+		_, err = stmt.ExecContext(ctx, row...)
+		if err != nil {
+			stmt.Close()
+			tx.Rollback()
+			return err
+		}
+	}
+	stmt.Close()
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+	output.logger.Info("Inserted %d rows", len(rows))
+	return nil
+}
+
+func (output *SQLOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *SQLOutput) Shutdown() error {
+	return output.ShutdownContext(context.Background())
+}
+
+func (output *SQLOutput) ShutdownContext(ctx context.Context) error {
+	err := output.bufferedOutput.ShutdownContext(ctx)
+	output.db.Close()
+	return err
+}
+
+func (output *SQLOutput) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *SQLOutputFactory) Name() string {
+	return "sql"
+}
+
+// buildSQLInsertStatement builds the INSERT for table and the columns, with
+// placeholders in the style of the driver: "?" or "$" for $1, $2 and so on.
+func buildSQLInsertStatement(table string, columns []outputColumn, placeholder string) (string, error) {
+	names := make([]string, len(columns))
+	placeholders := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.name
+		switch placeholder {
+		case "?":
+			placeholders[i] = "?"
+		case "$":
+			placeholders[i] = "$" + strconv.Itoa(i+1)
+		default:
+			return "", errors.New("unsupported placeholder: " + placeholder)
+		}
+	}
+	return "INSERT INTO " + table + " (" + strings.Join(names, ", ") + ") VALUES (" + strings.Join(placeholders, ", ") + ")", nil
+}
+
+// parseSQLStatement reads either insert_statement and the fields bound to
+// its placeholders in order, or table and column_mapping, from which the
+// statement is built.
+func parseSQLStatement(config *ik.ConfigElement) (string, []outputColumn, error) {
+	statement, ok := config.Attrs["insert_statement"]
+	if ok {
+		fieldsStr, ok := config.Attrs["fields"]
+		if !ok {
+			return "", nil, errors.New("required attribute `fields' is not specified")
+		}
+		columns := make([]outputColumn, 0)
+		for _, field := range splitAndStrip(fieldsStr) {
+			if field != "" {
+				columns = append(columns, outputColumn{name: field, field: field})
+			}
+		}
+		if len(columns) == 0 {
+			return "", nil, errors.New("no fields are specified")
+		}
+		return statement, columns, nil
+	}
+	table, ok := config.Attrs["table"]
+	if !ok {
+		return "", nil, errors.New("either `insert_statement' or `table' has to be specified")
+	}
+	columnMappingStr, ok := config.Attrs["column_mapping"]
+	if !ok {
+		return "", nil, errors.New("required attribute `column_mapping' is not specified")
+	}
+	columns, err := parseColumnMapping(columnMappingStr)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(columns) == 0 {
+		return "", nil, errors.New("no columns are specified")
+	}
+	placeholder, ok := config.Attrs["placeholder"]
+	if !ok {
+		placeholder = "?"
+	}
+	statement, err = buildSQLInsertStatement(table, columns, placeholder)
+	if err != nil {
+		return "", nil, err
+	}
+	return statement, columns, nil
+}
+
+// checkSQLDriver tells whether the database/sql driver given by the
+// attribute, or by default, is linked into the binary, for a configuration
+// naming one that is not to be turned down as it is read.
+func checkSQLDriver(attribute string, driver string) error {
+	for _, registered := range sql.Drivers() {
+		if registered == driver {
+			return nil
+		}
+	}
+	return errors.New(fmt.Sprintf("the database/sql driver `%s' given by `%s' is not linked into this binary", driver, attribute))
+}
+
+func (factory *SQLOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	driver, ok := config.Attrs["driver"]
+	if !ok {
+		return nil, errors.New("required attribute `driver' is not specified")
+	}
+	err := checkSQLDriver("driver", driver)
+	if err != nil {
+		return nil, err
+	}
+	dsn, ok := config.Attrs["dsn"]
+	if !ok {
+		return nil, errors.New("required attribute `dsn' is not specified")
+	}
+	statement, columns, err := parseSQLStatement(config)
+	if err != nil {
+		return nil, err
+	}
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	maxOpenConnectionsStr, ok := config.Attrs["max_open_connections"]
+	if ok {
+		maxOpenConnections, err := strconv.Atoi(maxOpenConnectionsStr)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		db.SetMaxOpenConns(maxOpenConnections)
+	}
+
+	output := &SQLOutput{
+		factory:   factory,
+		logger:    engine.Logger(),
+		db:        db,
+		statement: statement,
+		columns:   columns,
+	}
+
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&SQLOutputPacker{output},
+		output.deliver,
+	)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	return output, nil
+}
+
+func (factory *SQLOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&SQLOutputFactory{})
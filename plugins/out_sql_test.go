@@ -0,0 +1,217 @@
+package plugins
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/iktest"
+	"io"
+	"testing"
+)
+
+// testSQLDriver records the rows of the transactions committed, and fails
+// the statements given a value of "fail".
+type testSQLDriver struct {
+	committed [][]driver.Value
+}
+
+type testSQLConn struct {
+	driver  *testSQLDriver
+	pending [][]driver.Value
+}
+
+type testSQLStmt struct {
+	conn  *testSQLConn
+	query string
+}
+
+func (driver_ *testSQLDriver) Open(name string) (driver.Conn, error) {
+	return &testSQLConn{driver: driver_}, nil
+}
+
+func (conn *testSQLConn) Prepare(query string) (driver.Stmt, error) {
+	return &testSQLStmt{conn, query}, nil
+}
+
+func (conn *testSQLConn) Close() error {
+	return nil
+}
+
+func (conn *testSQLConn) Begin() (driver.Tx, error) {
+	conn.pending = nil
+	return conn, nil
+}
+
+func (conn *testSQLConn) Commit() error {
+	conn.driver.committed = append(conn.driver.committed, conn.pending...)
+	conn.pending = nil
+	return nil
+}
+
+func (conn *testSQLConn) Rollback() error {
+	conn.pending = nil
+	return nil
+}
+
+func (stmt *testSQLStmt) Close() error {
+	return nil
+}
+
+func (stmt *testSQLStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *testSQLStmt) Exec(args []driver.Value) (driver.Result, error) {
+	for _, arg := range args {
+		if arg == "fail" {
+			return nil, errors.New("failed")
+		}
+	}
+	stmt.conn.pending = append(stmt.conn.pending, args)
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt *testSQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return nil, io.EOF
+}
+
+var testSQL = &testSQLDriver{}
+
+func init() {
+	sql.Register("iktest", testSQL)
+}
+
+func Test_parseSQLStatement(t *testing.T) {
+	cases := []struct {
+		attrs     map[string]string
+		statement string
+		fields    []string
+	}{
+		{
+			map[string]string{"table": "logs", "column_mapping": "tag:@tag, time:@time, message:msg"},
+			"INSERT INTO logs (tag, time, message) VALUES (?, ?, ?)",
+			[]string{"@tag", "@time", "msg"},
+		},
+		{
+			map[string]string{"table": "logs", "column_mapping": "tag:@tag, message:msg", "placeholder": "$"},
+			"INSERT INTO logs (tag, message) VALUES ($1, $2)",
+			[]string{"@tag", "msg"},
+		},
+		{
+			map[string]string{"insert_statement": "INSERT INTO t VALUES (?, ?)", "fields": "@time, msg"},
+			"INSERT INTO t VALUES (?, ?)",
+			[]string{"@time", "msg"},
+		},
+	}
+	for _, case_ := range cases {
+		statement, columns, err := parseSQLStatement(&ik.ConfigElement{Attrs: case_.attrs})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if statement != case_.statement || len(columns) != len(case_.fields) {
+			t.Logf("%v: %s %v", case_.attrs, statement, columns)
+			t.Fail()
+			continue
+		}
+		for i, column := range columns {
+			if column.field != case_.fields[i] {
+				t.Logf("%v: %v", case_.attrs, columns)
+				t.Fail()
+			}
+		}
+	}
+	for _, attrs := range []map[string]string{
+		{},
+		{"table": "logs"},
+		{"table": "logs", "column_mapping": "a", "placeholder": ":"},
+		{"insert_statement": "INSERT INTO t VALUES (?)"},
+		{"insert_statement": "INSERT INTO t VALUES (?)", "fields": ","},
+	} {
+		_, _, err := parseSQLStatement(&ik.ConfigElement{Attrs: attrs})
+		if err == nil {
+			t.Logf("%v accepted", attrs)
+			t.Fail()
+		}
+	}
+}
+
+func Test_SQLOutput_deliver(t *testing.T) {
+	db, err := sql.Open("iktest", "")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer db.Close()
+	output := &SQLOutput{
+		logger:    &testLogger{t},
+		db:        db,
+		statement: "INSERT INTO logs (tag, time, message, extra) VALUES (?, ?, ?, ?)",
+		columns:   []outputColumn{{"tag", "@tag"}, {"time", "@time"}, {"message", "msg"}, {"extra", "extra"}},
+	}
+	packer := &SQLOutputPacker{output}
+	pack := func(data map[string]interface{}) []byte {
+		b, err := packer.Pack(ik.FluentRecord{Tag: "test", Timestamp: 1400000000, Data: data})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		return b
+	}
+	row := make([]interface{}, 0)
+	err = json.Unmarshal(pack(map[string]interface{}{"msg": "a"}), &row)
+	if err != nil || len(row) != 4 || row[0] != "test" || row[2] != "a" || row[3] != nil {
+		t.Logf("%v", row)
+		t.Fail()
+	}
+
+	// a chunk failing halfway inserts nothing
+	failing := append(pack(map[string]interface{}{"msg": "a"}), pack(map[string]interface{}{"msg": "fail"})...)
+	err = output.deliver(context.Background(), "", &testJournalChunk{failing})
+	if err == nil || len(testSQL.committed) != 0 {
+		t.Fatal("the failed chunk was committed")
+	}
+	chunk := append(pack(map[string]interface{}{"msg": "a", "extra": map[string]interface{}{"x": 1}}), pack(map[string]interface{}{"msg": "b", "extra": 1.5})...)
+	err = output.deliver(context.Background(), "", &testJournalChunk{chunk})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(testSQL.committed) != 2 {
+		t.Fatalf("%v", testSQL.committed)
+	}
+	first := testSQL.committed[0]
+	if first[0] != "test" || first[1] != int64(1400000000) || first[2] != "a" || first[3] != "{\"x\":1}" {
+		t.Logf("%#v", first)
+		t.Fail()
+	}
+	if second := testSQL.committed[1]; second[2] != "b" || second[3] != 1.5 {
+		t.Logf("%#v", second)
+		t.Fail()
+	}
+}
+
+func Test_checkSQLDriver(t *testing.T) {
+	engine := iktest.NewEngine(t)
+	defer engine.Dispose()
+	// no SQLite driver is linked into the tests
+	_, err := parseBufferedOutputParams(engine, &ik.ConfigElement{Attrs: map[string]string{"buffer_type": "sqlite", "buffer_path": "/tmp/ik.db"}})
+	if err == nil || err.Error() != "buffer_type sqlite is not available: the database/sql driver `sqlite3' given by `buffer_sqlite_driver' is not linked into this binary" {
+		t.Fatalf("%v", err)
+	}
+	_, err = parseBufferedOutputParams(engine, &ik.ConfigElement{Attrs: map[string]string{"buffer_type": "sqlite", "buffer_path": "/tmp/ik.db", "buffer_sqlite_driver": "iktest"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, err = parseBufferedOutputParams(engine, &ik.ConfigElement{Attrs: map[string]string{"buffer_type": "sqlite", "buffer_path": "/tmp/ik.db", "buffer_sqlite_driver": "iktest", "buffer_chunk_rest_command": "true"}})
+	if err == nil {
+		t.Fail()
+	}
+	_, err = openPositionStore(&ik.ConfigElement{Attrs: map[string]string{"pos_store": "sqlite", "pos_store_dsn": "/tmp/ik.db"}})
+	if err == nil || err.Error() != "pos_store sqlite is not available: the database/sql driver `sqlite3' given by `pos_store_driver' is not linked into this binary" {
+		t.Fatalf("%v", err)
+	}
+	_, err = (&SQLOutputFactory{}).New(engine, &ik.ConfigElement{Attrs: map[string]string{"driver": "mysql", "dsn": ""}})
+	if err == nil || err.Error() != "the database/sql driver `mysql' given by `driver' is not linked into this binary" {
+		t.Fatalf("%v", err)
+	}
+}
@@ -0,0 +1,441 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sqsMaxBatchEntries = 10
+	sqsMaxPayloadSize  = 256 * 1024
+	sqsMaxAttributes   = 10
+	sqsAPIVersion      = "2012-11-05"
+)
+
+type sqsMessageAttribute struct {
+	name     string
+	dataType string
+	value    string
+}
+
+type sqsMessage struct {
+	body            string
+	attributes      []sqsMessageAttribute
+	groupId         string
+	deduplicationId string
+}
+
+// sqsRejected is a line that can never be sent.  It is dead-lettered once
+// the rest of its chunk is sent, so that the retries of the chunk do not
+// dead-letter it again.
+type sqsRejected struct {
+	line string
+	err  error
+}
+
+type sqsBatchResultError struct {
+	Id          string `xml:"Id"`
+	Code        string `xml:"Code"`
+	Message     string `xml:"Message"`
+	SenderFault bool   `xml:"SenderFault"`
+}
+
+type sqsSendMessageBatchResponse struct {
+	Failed []sqsBatchResultError `xml:"SendMessageBatchResult>BatchResultErrorEntry"`
+}
+
+type sqsErrorResponse struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+type SQSOutput struct {
+	*bufferedOutput
+	factory            *SQSOutputFactory
+	logger             ik.Logger
+	client             *http.Client
+	queueURL           string
+	region             string
+	credentials        awsCredentialsProvider
+	attributeKeys      []string
+	fifo               bool
+	messageGroupId     string
+	messageGroupIdKey  string
+	deduplicationIdKey string
+	chunkAsMessage     bool
+	clock              ik.Clock
+}
+
+type SQSOutputPacker struct{}
+
+type SQSOutputFactory struct {
+}
+
+func (packer *SQSOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	b, err := json.Marshal(record.Data)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+// size returns the number of bytes the message counts for against the
+// payload limit, which covers the body and every attribute.
+func (message *sqsMessage) size() int {
+	retval := len(message.body)
+	for _, attribute := range message.attributes {
+		retval += len(attribute.name) + len(attribute.dataType) + len(attribute.value)
+	}
+	return retval
+}
+
+func sqsAttributeValue(value interface{}) (string, string) {
+	switch value_ := value.(type) {
+	case string:
+		return "String", value_
+	case float64:
+		return "Number", strconv.FormatFloat(value_, 'f', -1, 64)
+	case bool:
+		return "String", strconv.FormatBool(value_)
+	default:
+		b, _ := json.Marshal(value_)
+		return "String", string(b)
+	}
+}
+
+// newMessage makes a message of the body.  On a FIFO queue, the
+// deduplication id falls back to defaultDeduplicationId.
+func (output *SQSOutput) newMessage(body string, data map[string]interface{}, defaultDeduplicationId string) sqsMessage {
+	message := sqsMessage{body: body, groupId: output.messageGroupId}
+	for _, key := range output.attributeKeys {
+		value, ok := data[key]
+		if !ok || value == nil {
+			continue
+		}
+		dataType, valueStr := sqsAttributeValue(value)
+		message.attributes = append(message.attributes, sqsMessageAttribute{key, dataType, valueStr})
+	}
+	if !output.fifo {
+		return message
+	}
+	if output.messageGroupIdKey != "" {
+		value, ok := data[output.messageGroupIdKey]
+		if ok && value != nil {
+			_, message.groupId = sqsAttributeValue(value)
+		}
+	}
+	if output.deduplicationIdKey != "" {
+		value, ok := data[output.deduplicationIdKey]
+		if ok && value != nil {
+			_, message.deduplicationId = sqsAttributeValue(value)
+		}
+	}
+	if message.deduplicationId == "" {
+		message.deduplicationId = defaultDeduplicationId
+	}
+	return message
+}
+
+// sqsDeduplicationId returns the default deduplication id of the i-th
+// message of the chunk, by which a retried chunk does not end up in the
+// queue twice, while the records alike sent within the deduplication
+// interval are not taken for one another as they would be by their content.
+func sqsDeduplicationId(uniqueId string, i int) string {
+	return uniqueId + "-" + strconv.Itoa(i)
+}
+
+// buildMessages turns the lines of a chunk into messages.  With
+// chunk_as_message the lines are concatenated into as few messages as fit
+// the payload limit.  A line that cannot be decoded for the attributes or
+// the FIFO ids is rejected rather than sent without them.
+func (output *SQSOutput) buildMessages(uniqueId string, lines [][]byte) ([]sqsMessage, []sqsRejected) {
+	retval := make([]sqsMessage, 0, len(lines))
+	rejected := make([]sqsRejected, 0)
+	if output.chunkAsMessage {
+		buf := &bytes.Buffer{}
+		for _, line := range lines {
+			if buf.Len() > 0 && buf.Len()+len(line)+1 > sqsMaxPayloadSize {
+				retval = append(retval, output.newMessage(buf.String(), nil, sqsDeduplicationId(uniqueId, len(retval))))
+				buf.Reset()
+			}
+			buf.Write(line)
+			buf.WriteByte('\n')
+		}
+		if buf.Len() > 0 {
+			retval = append(retval, output.newMessage(buf.String(), nil, sqsDeduplicationId(uniqueId, len(retval))))
+		}
+		return retval, rejected
+	}
+	for i, line := range lines {
+		var data map[string]interface{}
+		if len(output.attributeKeys) > 0 || output.messageGroupIdKey != "" || output.deduplicationIdKey != "" {
+			err := json.Unmarshal(line, &data)
+			if err != nil {
+				rejected = append(rejected, sqsRejected{string(line), errors.New("failed to decode a buffered record: " + err.Error())})
+				continue
+			}
+		}
+		retval = append(retval, output.newMessage(string(line), data, sqsDeduplicationId(uniqueId, i)))
+	}
+	return retval, rejected
+}
+
+// splitSQSBatches groups messages into batches having at most maxEntries
+// entries and maxSize bytes each.  A message that alone exceeds maxSize can
+// never be accepted and is returned separately.
+func splitSQSBatches(messages []sqsMessage, maxEntries int, maxSize int) ([][]sqsMessage, []sqsMessage) {
+	batches := make([][]sqsMessage, 0)
+	oversized := make([]sqsMessage, 0)
+	batch := make([]sqsMessage, 0, maxEntries)
+	batchSize := 0
+	for _, message := range messages {
+		size := message.size()
+		if size > maxSize {
+			oversized = append(oversized, message)
+			continue
+		}
+		if len(batch) >= maxEntries || batchSize+size > maxSize {
+			batches = append(batches, batch)
+			batch = make([]sqsMessage, 0, maxEntries)
+			batchSize = 0
+		}
+		batch = append(batch, message)
+		batchSize += size
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches, oversized
+}
+
+func (output *SQSOutput) sendBatch(ctx context.Context, batch []sqsMessage) error {
+	form := url.Values{}
+	form.Set("Action", "SendMessageBatch")
+	form.Set("Version", sqsAPIVersion)
+	for i, message := range batch {
+		prefix := "SendMessageBatchRequestEntry." + strconv.Itoa(i+1) + "."
+		form.Set(prefix+"Id", strconv.Itoa(i))
+		form.Set(prefix+"MessageBody", message.body)
+		for j, attribute := range message.attributes {
+			attrPrefix := prefix + "MessageAttribute." + strconv.Itoa(j+1) + "."
+			form.Set(attrPrefix+"Name", attribute.name)
+			form.Set(attrPrefix+"Value.DataType", attribute.dataType)
+			form.Set(attrPrefix+"Value.StringValue", attribute.value)
+		}
+		if message.groupId != "" {
+			form.Set(prefix+"MessageGroupId", message.groupId)
+		}
+		if message.deduplicationId != "" {
+			form.Set(prefix+"MessageDeduplicationId", message.deduplicationId)
+		}
+	}
+	payload := []byte(form.Encode())
+	req, err := http.NewRequestWithContext(ctx, "POST", output.queueURL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	credentials, err := output.credentials.credentials()
+	if err != nil {
+		return err
+	}
+	signAWSRequest(req, payload, credentials, output.region, "sqs", output.clock.Now())
+	resp, err := output.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		errorResponse := sqsErrorResponse{}
+		if xml.Unmarshal(body, &errorResponse) == nil && errorResponse.Code != "" {
+			return errors.New(fmt.Sprintf("SQS returned %s: %s: %s", resp.Status, errorResponse.Code, errorResponse.Message))
+		}
+		return errors.New(fmt.Sprintf("SQS returned %s", resp.Status))
+	}
+	response := sqsSendMessageBatchResponse{}
+	err = xml.Unmarshal(body, &response)
+	if err != nil {
+		return err
+	}
+	if len(response.Failed) > 0 {
+		failed := response.Failed[0]
+		return errors.New(fmt.Sprintf("%d of %d entries failed (first: %s: %s)", len(response.Failed), len(batch), failed.Code, failed.Message))
+	}
+	return nil
+}
+
+// deliver sends the records of a chunk in as many batches as needed.  The
+// chunk is retried as a whole if any entry of a batch fails, the batches
+// after it being left unsent; on a FIFO queue the deduplication ids keep
+// the entries already sent from being enqueued again.  The lines that can
+// never be sent are dead-lettered once the chunk has gone through.
+func (output *SQSOutput) deliver(ctx context.Context, _ string, chunk ik.JournalChunk) error {
+	var data []byte
+	err := readChunk(chunk, func(reader io.Reader) error {
+		var err error
+		data, err = ioutil.ReadAll(reader)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	lines := bytes.Split(bytes.TrimRight(data, "\n"), []byte{'\n'})
+	messages, rejected := output.buildMessages(chunk.UniqueId(), lines)
+	batches, oversized := splitSQSBatches(messages, sqsMaxBatchEntries, sqsMaxPayloadSize)
+	for _, message := range oversized {
+		err := errors.New(fmt.Sprintf("the message of %d bytes exceeds the size limit of %d bytes", message.size(), sqsMaxPayloadSize))
+		rejected = append(rejected, sqsRejected{strings.TrimRight(message.body, "\n"), err})
+	}
+	for _, batch := range batches {
+		err := output.sendBatch(ctx, batch)
+		if err != nil {
+			return err
+		}
+	}
+	for _, rejected_ := range rejected {
+		output.logger.Error("dropping a record: %s", rejected_.err.Error())
+		output.bufferedOutput.deadLetter(rejected_.err, []string{rejected_.line})
+	}
+	output.logger.Notice("Sent %d batches to %s", len(batches), output.queueURL)
+	return nil
+}
+
+func (output *SQSOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *SQSOutput) Dispose() {
+	output.Shutdown()
+}
+
+// sqsRegionFromURL extracts the region from an endpoint of the form
+// sqs.<region>.amazonaws.com.
+func sqsRegionFromURL(queueURL *url.URL) string {
+	comps := strings.Split(queueURL.Host, ".")
+	if len(comps) >= 4 && comps[0] == "sqs" && comps[2] == "amazonaws" {
+		return comps[1]
+	}
+	return ""
+}
+
+func (factory *SQSOutputFactory) Name() string {
+	return "sqs"
+}
+
+func (factory *SQSOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	queueURLStr, ok := config.Attrs["queue_url"]
+	if !ok {
+		return nil, errors.New("required attribute `queue_url' is not specified")
+	}
+	queueURL, err := url.Parse(queueURLStr)
+	if err != nil {
+		return nil, err
+	}
+	region, ok := config.Attrs["region"]
+	if !ok {
+		region = sqsRegionFromURL(queueURL)
+		if region == "" {
+			return nil, errors.New("required attribute `region' is not specified")
+		}
+	}
+	credentials, err := newAWSCredentialsProvider(config)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(30 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	attributeKeys := make([]string, 0)
+	attributeKeysStr, ok := config.Attrs["message_attribute_keys"]
+	if ok {
+		for _, key := range splitAndStrip(attributeKeysStr) {
+			if key != "" {
+				attributeKeys = append(attributeKeys, key)
+			}
+		}
+		if len(attributeKeys) > sqsMaxAttributes {
+			return nil, errors.New(fmt.Sprintf("at most %d message attributes can be specified", sqsMaxAttributes))
+		}
+	}
+	chunkAsMessage := false
+	chunkAsMessageStr, ok := config.Attrs["chunk_as_message"]
+	if ok {
+		chunkAsMessage, err = strconv.ParseBool(chunkAsMessageStr)
+		if err != nil {
+			return nil, err
+		}
+		if chunkAsMessage && len(attributeKeys) > 0 {
+			return nil, errors.New("`message_attribute_keys' cannot be used together with `chunk_as_message'")
+		}
+	}
+	fifo := strings.HasSuffix(queueURL.Path, ".fifo")
+	messageGroupId := config.Attrs["message_group_id"]
+	messageGroupIdKey := config.Attrs["message_group_id_key"]
+	if fifo && messageGroupId == "" && (messageGroupIdKey == "" || chunkAsMessage) {
+		return nil, errors.New("required attribute `message_group_id' is not specified")
+	}
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &SQSOutput{
+		factory:            factory,
+		logger:             engine.Logger(),
+		client:             &http.Client{Timeout: timeout},
+		queueURL:           queueURLStr,
+		region:             region,
+		credentials:        credentials,
+		attributeKeys:      attributeKeys,
+		fifo:               fifo,
+		messageGroupId:     messageGroupId,
+		messageGroupIdKey:  messageGroupIdKey,
+		deduplicationIdKey: config.Attrs["deduplication_id_key"],
+		chunkAsMessage:     chunkAsMessage,
+		clock:              engine.Clock(),
+	}
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&SQSOutputPacker{},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	return output, nil
+}
+
+func (factory *SQSOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&SQSOutputFactory{})
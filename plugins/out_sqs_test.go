@@ -0,0 +1,175 @@
+package plugins
+
+import (
+	"context"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func Test_splitSQSBatches(t *testing.T) {
+	messages := make([]sqsMessage, 0)
+	for i := 0; i < 12; i++ {
+		messages = append(messages, sqsMessage{body: "abcd"})
+	}
+	messages = append(messages, sqsMessage{body: strings.Repeat("x", 20)})
+	messages = append(messages, sqsMessage{body: "ab", attributes: []sqsMessageAttribute{{"k", "String", "v"}}})
+	batches, oversized := splitSQSBatches(messages, 5, 16)
+	if len(oversized) != 1 {
+		t.Fail()
+	}
+	// 4 + 4 + 4 + 4 bytes fill a batch before the entry limit is reached
+	if len(batches) != 4 {
+		t.Logf("%d batches", len(batches))
+		t.FailNow()
+	}
+	for i, n := range []int{4, 4, 4, 1} {
+		if len(batches[i]) != n {
+			t.Logf("batch %d has %d entries", i, len(batches[i]))
+			t.Fail()
+		}
+	}
+	batches, _ = splitSQSBatches(messages[0:12], 5, 1024)
+	if len(batches) != 3 || len(batches[0]) != 5 || len(batches[2]) != 2 {
+		t.Fail()
+	}
+}
+
+func Test_SQSOutput_Deliver(t *testing.T) {
+	responses := []string{
+		`<SendMessageBatchResponse><SendMessageBatchResult><BatchResultErrorEntry><Id>3</Id><Code>InternalError</Code><Message>try again</Message><SenderFault>false</SenderFault></BatchResultErrorEntry></SendMessageBatchResult></SendMessageBatchResponse>`,
+		`<SendMessageBatchResponse><SendMessageBatchResult></SendMessageBatchResult></SendMessageBatchResponse>`,
+		`<SendMessageBatchResponse><SendMessageBatchResult></SendMessageBatchResult></SendMessageBatchResponse>`,
+	}
+	requests := make([]url.Values, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		req.ParseForm()
+		requests = append(requests, req.PostForm)
+		resp.Write([]byte(responses[len(requests)-1]))
+	}))
+	defer server.Close()
+
+	output := &SQSOutput{
+		logger:         &testLogger{t},
+		client:         &http.Client{},
+		queueURL:       server.URL + "/123456789012/test.fifo",
+		region:         "us-east-1",
+		credentials:    &staticAWSCredentialsProvider{awsCredentials{"AKID", "SECRET", ""}},
+		fifo:           true,
+		messageGroupId: "group",
+		clock:          ik.SystemClock,
+	}
+	chunk := &testJournalChunk{}
+	for i := 0; i < 12; i++ {
+		// the records come in pairs alike
+		b, _ := (&SQSOutputPacker{}).Pack(ik.FluentRecord{Data: map[string]interface{}{"n": i / 2 * 2}})
+		chunk.data = append(chunk.data, b...)
+	}
+	// an entry failing makes the chunk retried, the batches after it unsent
+	err := output.deliver(context.Background(), "", chunk)
+	if err == nil || !strings.Contains(err.Error(), "1 of 10 entries failed (first: InternalError: try again)") || len(requests) != 1 {
+		t.Fatalf("%v %d", err, len(requests))
+	}
+	err = output.deliver(context.Background(), "", chunk)
+	if err != nil || len(requests) != 3 {
+		t.Fatalf("%v %d", err, len(requests))
+	}
+	// the retry sends the same entries again, which the deduplication ids
+	// keep from being enqueued twice
+	for i, n := range []int{10, 10, 2} {
+		form := requests[i]
+		if form.Get("Action") != "SendMessageBatch" || form.Get(fmt.Sprintf("SendMessageBatchRequestEntry.%d.Id", n)) == "" || form.Get(fmt.Sprintf("SendMessageBatchRequestEntry.%d.Id", n+1)) != "" {
+			t.Fatalf("%d: %v", i, form)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		prefix := fmt.Sprintf("SendMessageBatchRequestEntry.%d.", i+1)
+		for _, key := range []string{"MessageBody", "MessageGroupId", "MessageDeduplicationId"} {
+			if requests[0].Get(prefix+key) != requests[1].Get(prefix+key) {
+				t.Fatalf("%s%s", prefix, key)
+			}
+		}
+		if requests[0].Get(prefix+"MessageGroupId") != "group" || requests[0].Get(prefix+"MessageDeduplicationId") != fmt.Sprintf("0123456789abcdef-%d", i) {
+			t.Fatalf("%v", requests[0])
+		}
+	}
+	if requests[2].Get("SendMessageBatchRequestEntry.2.MessageDeduplicationId") != "0123456789abcdef-11" {
+		t.Fatalf("%v", requests[2])
+	}
+	if requests[0].Get("SendMessageBatchRequestEntry.1.MessageBody") != requests[0].Get("SendMessageBatchRequestEntry.2.MessageBody") {
+		t.Fail()
+	}
+}
+
+func Test_SQSOutput_Deliver_deadLetter(t *testing.T) {
+	statuses := []int{http.StatusInternalServerError, http.StatusOK}
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		requests += 1
+		resp.WriteHeader(statuses[requests-1])
+		resp.Write([]byte(`<SendMessageBatchResponse><SendMessageBatchResult></SendMessageBatchResult></SendMessageBatchResponse>`))
+	}))
+	defer server.Close()
+
+	var deadLetters []string
+	output := &SQSOutput{
+		bufferedOutput: &bufferedOutput{deadLetter: func(cause error, lines []string) {
+			deadLetters = append(deadLetters, lines...)
+		}},
+		logger:        &testLogger{t},
+		client:        &http.Client{},
+		queueURL:      server.URL + "/123456789012/test",
+		region:        "us-east-1",
+		credentials:   &staticAWSCredentialsProvider{awsCredentials{"AKID", "SECRET", ""}},
+		attributeKeys: []string{"a"},
+		clock:         ik.SystemClock,
+	}
+	oversized := `{"a":"` + strings.Repeat("x", sqsMaxPayloadSize) + `"}`
+	chunk := &testJournalChunk{data: []byte("{\"a\":1}\n" + oversized + "\n{\n")}
+	// nothing is dead-lettered until the chunk goes through
+	err := output.deliver(context.Background(), "", chunk)
+	if err == nil || len(deadLetters) != 0 {
+		t.Fatalf("%v %v", err, len(deadLetters))
+	}
+	err = output.deliver(context.Background(), "", chunk)
+	if err != nil || requests != 2 || len(deadLetters) != 2 || deadLetters[0] != "{" || deadLetters[1] != oversized {
+		t.Fatalf("%v %d %d", err, requests, len(deadLetters))
+	}
+}
+
+func Test_SQSOutput_sendBatch_error(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.WriteHeader(http.StatusBadRequest)
+		resp.Write([]byte(`<ErrorResponse><Error><Code>MissingParameter</Code><Message>MessageGroupId is missing</Message></Error></ErrorResponse>`))
+	}))
+	defer server.Close()
+	output := &SQSOutput{
+		logger:      &testLogger{t},
+		client:      &http.Client{},
+		queueURL:    server.URL + "/123456789012/test.fifo",
+		region:      "us-east-1",
+		credentials: &staticAWSCredentialsProvider{awsCredentials{"AKID", "SECRET", ""}},
+		clock:       ik.SystemClock,
+	}
+	err := output.sendBatch(context.Background(), []sqsMessage{{body: "{}"}})
+	if err == nil || err.Error() != "SQS returned 400 Bad Request: MissingParameter: MessageGroupId is missing" {
+		t.Fatalf("%v", err)
+	}
+}
+
+func Test_SQSOutput_buildMessages(t *testing.T) {
+	output := &SQSOutput{logger: &testLogger{t}, fifo: true, messageGroupId: "group", messageGroupIdKey: "g", deduplicationIdKey: "d"}
+	messages, rejected := output.buildMessages("id", [][]byte{[]byte(`{"g":"a","d":"x"}`), []byte(`{}`), []byte(`{`), []byte(`{}`)})
+	if len(messages) != 3 || len(rejected) != 1 || rejected[0].line != "{" || messages[0].groupId != "a" || messages[0].deduplicationId != "x" || messages[1].groupId != "group" || messages[1].deduplicationId != "id-1" || messages[2].deduplicationId != "id-3" {
+		t.Fatalf("%v", messages)
+	}
+	output = &SQSOutput{logger: &testLogger{t}, fifo: true, messageGroupId: "group", chunkAsMessage: true}
+	messages, _ = output.buildMessages("id", [][]byte{[]byte(`{}`), []byte(`{}`)})
+	if len(messages) != 1 || messages[0].body != "{}\n{}\n" || messages[0].deduplicationId != "id-0" {
+		t.Fatalf("%v", messages)
+	}
+}
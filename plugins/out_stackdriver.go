@@ -0,0 +1,348 @@
+package plugins
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	stackdriverDefaultEndpoint = "https://logging.googleapis.com/v2/entries:write"
+	stackdriverScope           = "https://www.googleapis.com/auth/logging.write"
+	stackdriverMaxBatchEntries = 1000
+	stackdriverMaxBatchSize    = 5 * 1024 * 1024
+)
+
+var stackdriverSeverities = map[string]string{
+	"DEFAULT":   "DEFAULT",
+	"DEBUG":     "DEBUG",
+	"TRACE":     "DEBUG",
+	"INFO":      "INFO",
+	"NOTICE":    "NOTICE",
+	"WARN":      "WARNING",
+	"WARNING":   "WARNING",
+	"ERR":       "ERROR",
+	"ERROR":     "ERROR",
+	"CRIT":      "CRITICAL",
+	"CRITICAL":  "CRITICAL",
+	"FATAL":     "CRITICAL",
+	"ALERT":     "ALERT",
+	"EMERG":     "EMERGENCY",
+	"EMERGENCY": "EMERGENCY",
+}
+
+// stackdriverBufferedEntry is how a record sits in the buffer.  The insert
+// id is given when the record is packed, so that Cloud Logging drops the
+// entries of a chunk it has already written if the chunk is retried.
+type stackdriverBufferedEntry struct {
+	InsertId string                 `json:"i"`
+	Time     uint64                 `json:"t"`
+	Data     map[string]interface{} `json:"d"`
+}
+
+type stackdriverResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type stackdriverEntry struct {
+	InsertId    string                 `json:"insertId"`
+	Timestamp   string                 `json:"timestamp"`
+	Severity    string                 `json:"severity"`
+	JsonPayload map[string]interface{} `json:"jsonPayload,omitempty"`
+	TextPayload string                 `json:"textPayload,omitempty"`
+}
+
+type stackdriverWriteRequest struct {
+	LogName  string              `json:"logName"`
+	Resource stackdriverResource `json:"resource"`
+	Entries  []json.RawMessage   `json:"entries"`
+}
+
+// StackdriverOutput writes the records as entries into Google Cloud Logging,
+// into the log named after the tag or the one log_name templates into.
+// Each log has a buffer of its own.
+type StackdriverOutput struct {
+	*bufferedOutput
+	factory     *StackdriverOutputFactory
+	logger      ik.Logger
+	client      *http.Client
+	endpoint    string
+	tokenSource *gcpTokenSource
+	projectId   string
+	logName     string
+	resource    stackdriverResource
+	severityKey string
+	messageKey  string
+}
+
+type StackdriverOutputPacker struct {
+	output *StackdriverOutput
+}
+
+type StackdriverOutputFactory struct {
+}
+
+func (packer *StackdriverOutputPacker) Pack(record ik.FluentRecord) ([]byte, error) {
+	insertId := make([]byte, 12)
+	_, err := rand.Read(insertId)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(stackdriverBufferedEntry{
+		InsertId: hex.EncodeToString(insertId),
+		Time:     record.Timestamp,
+		Data:     record.Data,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
+
+func (output *StackdriverOutput) logNameOf(record ik.FluentRecord) string {
+	return strings.Replace(output.logName, "${tag}", record.Tag, -1)
+}
+
+// buildEntry makes an entry of a buffered record, the severity of which is
+// taken out of the field named by severity_key.  The field named by
+// message_key, if given, makes a text payload instead of the record.
+func (output *StackdriverOutput) buildEntry(line []byte) (json.RawMessage, error) {
+	buffered := stackdriverBufferedEntry{}
+	err := json.Unmarshal(line, &buffered)
+	if err != nil {
+		return nil, err
+	}
+	entry := stackdriverEntry{
+		InsertId:  buffered.InsertId,
+		Timestamp: time.Unix(int64(buffered.Time), 0).UTC().Format(time.RFC3339),
+		Severity:  "DEFAULT",
+	}
+	if output.severityKey != "" {
+		severity, ok := buffered.Data[output.severityKey].(string)
+		if ok {
+			severity, ok = stackdriverSeverities[strings.ToUpper(severity)]
+			if ok {
+				entry.Severity = severity
+				delete(buffered.Data, output.severityKey)
+			}
+		}
+	}
+	message, ok := buffered.Data[output.messageKey].(string)
+	if output.messageKey != "" && ok {
+		entry.TextPayload = message
+	} else {
+		entry.JsonPayload = buffered.Data
+	}
+	return json.Marshal(entry)
+}
+
+func (output *StackdriverOutput) write(ctx context.Context, request *stackdriverWriteRequest) error {
+	token, err := output.tokenSource.token()
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", output.endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := output.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New(fmt.Sprintf("Cloud Logging returned %s: %s", resp.Status, strings.TrimSpace(string(message))))
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	return nil
+}
+
+// deliver writes the entries of a chunk in as many requests as the limits
+// on the entries and the size of a request ask for.
+func (output *StackdriverOutput) deliver(ctx context.Context, logName string, chunk ik.JournalChunk) error {
+	var data []byte
+	err := readChunk(chunk, func(reader io.Reader) error {
+		var err error
+		data, err = ioutil.ReadAll(reader)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	projectId := output.projectId
+	if projectId == "" {
+		// the metadata server tells the project with the first token
+		_, err = output.tokenSource.token()
+		if err != nil {
+			return err
+		}
+		projectId = output.tokenSource.project()
+		if projectId == "" {
+			return errors.New("the project is not known; specify `project_id'")
+		}
+	}
+	request := &stackdriverWriteRequest{
+		LogName:  "projects/" + projectId + "/logs/" + url.PathEscape(logName),
+		Resource: output.resource,
+		Entries:  make([]json.RawMessage, 0),
+	}
+	size := 0
+	count := 0
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		entry, err := output.buildEntry(line)
+		if err != nil {
+			return err
+		}
+		if len(request.Entries) > 0 && (len(request.Entries) >= stackdriverMaxBatchEntries || size+len(entry) > stackdriverMaxBatchSize) {
+			err = output.write(ctx, request)
+			if err != nil {
+				return err
+			}
+			request.Entries = request.Entries[:0]
+			size = 0
+		}
+		request.Entries = append(request.Entries, entry)
+		size += len(entry)
+		count += 1
+	}
+	if len(request.Entries) > 0 {
+		err = output.write(ctx, request)
+		if err != nil {
+			return err
+		}
+	}
+	output.logger.Info("Wrote %d entries into %s", count, request.LogName)
+	return nil
+}
+
+func (output *StackdriverOutput) Factory() ik.Plugin {
+	return output.factory
+}
+
+func (output *StackdriverOutput) Dispose() {
+	output.Shutdown()
+}
+
+func (factory *StackdriverOutputFactory) Name() string {
+	return "stackdriver"
+}
+
+// parseStackdriverResource reads resource_type and resource_labels, the
+// latter being comma-separated "name:value" pairs.
+func parseStackdriverResource(config *ik.ConfigElement) (stackdriverResource, error) {
+	resource := stackdriverResource{Type: "global"}
+	type_, ok := config.Attrs["resource_type"]
+	if ok {
+		resource.Type = type_
+	}
+	labelsStr, ok := config.Attrs["resource_labels"]
+	if ok {
+		resource.Labels = make(map[string]string)
+		for _, comp := range splitAndStrip(labelsStr) {
+			if comp == "" {
+				continue
+			}
+			pair := strings.SplitN(comp, ":", 2)
+			if len(pair) != 2 || pair[0] == "" {
+				return stackdriverResource{}, errors.New("invalid resource_labels entry: " + comp)
+			}
+			resource.Labels[pair[0]] = pair[1]
+		}
+	}
+	return resource, nil
+}
+
+func (factory *StackdriverOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	logName, ok := config.Attrs["log_name"]
+	if !ok {
+		logName = "${tag}"
+	}
+	endpoint, ok := config.Attrs["endpoint"]
+	if !ok {
+		endpoint = stackdriverDefaultEndpoint
+	}
+	severityKey, ok := config.Attrs["severity_key"]
+	if !ok {
+		severityKey = "severity"
+	}
+	resource, err := parseStackdriverResource(config)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(30 * time.Second)
+	timeoutStr, ok := config.Attrs["timeout"]
+	if ok {
+		timeout, err = time.ParseDuration(timeoutStr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	tokenSource, err := newGCPTokenSource(config, stackdriverScope)
+	if err != nil {
+		return nil, err
+	}
+	projectId, ok := config.Attrs["project_id"]
+	if !ok {
+		projectId = tokenSource.projectId
+	}
+
+	params, err := parseBufferedOutputParams(engine, config)
+	if err != nil {
+		return nil, err
+	}
+
+	output := &StackdriverOutput{
+		factory:     factory,
+		logger:      engine.Logger(),
+		client:      &http.Client{Timeout: timeout},
+		endpoint:    endpoint,
+		tokenSource: tokenSource,
+		projectId:   projectId,
+		logName:     logName,
+		resource:    resource,
+		severityKey: severityKey,
+		messageKey:  config.Attrs["message_key"],
+	}
+	output.bufferedOutput, err = newBufferedOutput(
+		engine.Logger(),
+		engine.RandSource(),
+		engine.Scorekeeper(),
+		output,
+		params,
+		&StackdriverOutputPacker{output},
+		output.deliver,
+	)
+	if err != nil {
+		return nil, err
+	}
+	output.bufferedOutput.reportTo(engine, output)
+	output.bufferedOutput.subKeyer = output.logNameOf
+	return output, nil
+}
+
+func (factory *StackdriverOutputFactory) BindScorekeeper(scorekeeper *ik.Scorekeeper) {
+}
+
+var _ = AddPlugin(&StackdriverOutputFactory{})
@@ -0,0 +1,93 @@
+package plugins
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/moriyoshi/ik"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func Test_StackdriverOutput_buildEntry(t *testing.T) {
+	output := &StackdriverOutput{severityKey: "severity", messageKey: "message"}
+	packer := &StackdriverOutputPacker{output}
+	cases := []struct {
+		data     map[string]interface{}
+		severity string
+		text     string
+	}{
+		{map[string]interface{}{"severity": "warn", "a": 1}, "WARNING", ""},
+		{map[string]interface{}{"severity": "unknown", "a": 1}, "DEFAULT", ""},
+		{map[string]interface{}{"message": "hello"}, "DEFAULT", "hello"},
+	}
+	for _, case_ := range cases {
+		b, err := packer.Pack(ik.FluentRecord{Tag: "test", Timestamp: 1400000000, Data: case_.data})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		raw, err := output.buildEntry(b)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		entry := stackdriverEntry{}
+		json.Unmarshal(raw, &entry)
+		if entry.Severity != case_.severity || entry.TextPayload != case_.text || entry.Timestamp != "2014-05-13T16:53:20Z" || len(entry.InsertId) != 24 {
+			t.Logf("%v: %s", case_.data, raw)
+			t.Fail()
+		}
+		// a severity taken out of the record is not left in the payload
+		if case_.text == "" && (entry.JsonPayload["a"] != float64(1) || (case_.severity != "DEFAULT") != (entry.JsonPayload["severity"] == nil)) {
+			t.Logf("%v: %s", case_.data, raw)
+			t.Fail()
+		}
+	}
+}
+
+func Test_StackdriverOutput_deliver(t *testing.T) {
+	requests := make([]stackdriverWriteRequest, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			resp.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		request := stackdriverWriteRequest{}
+		json.NewDecoder(req.Body).Decode(&request)
+		requests = append(requests, request)
+		resp.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	output := &StackdriverOutput{
+		logger:   &testLogger{t},
+		client:   &http.Client{},
+		endpoint: server.URL,
+		tokenSource: &gcpTokenSource{
+			fetch: func(source *gcpTokenSource) (gcpToken, error) {
+				return gcpToken{AccessToken: "token", ExpiresIn: 3600}, nil
+			},
+			projectId: "project",
+		},
+		logName:  "app/${tag}",
+		resource: stackdriverResource{Type: "global"},
+	}
+	packer := &StackdriverOutputPacker{output}
+	data := make([]byte, 0)
+	for i := 0; i < stackdriverMaxBatchEntries+1; i++ {
+		b, _ := packer.Pack(ik.FluentRecord{Tag: "test", Timestamp: uint64(time.Now().Unix()), Data: map[string]interface{}{"i": i}})
+		data = append(data, b...)
+	}
+	logName := output.logNameOf(ik.FluentRecord{Tag: "test"})
+	err := output.deliver(context.Background(), logName, &testJournalChunk{data})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(requests) != 2 || len(requests[0].Entries) != stackdriverMaxBatchEntries || len(requests[1].Entries) != 1 {
+		t.Fatalf("%d requests", len(requests))
+	}
+	if requests[0].LogName != "projects/project/logs/app%2Ftest" || requests[0].Resource.Type != "global" {
+		t.Logf("%v", requests[0].LogName)
+		t.Fail()
+	}
+}
@@ -0,0 +1,55 @@
+package plugins
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/position"
+)
+
+// openPositionStore opens the store an input keeps the positions of its
+// sources in: the file named by pos_file, or with pos_store sqlite the
+// table pos_store_table ("positions" by default) of the database
+// pos_store_dsn, reached through the driver pos_store_driver ("sqlite3" by
+// default, which the ik command links in).  It returns nil if the input is
+// given neither.
+func openPositionStore(config *ik.ConfigElement) (position.Store, error) {
+	type_, ok := config.Attrs["pos_store"]
+	if !ok {
+		type_ = "file"
+	}
+	switch type_ {
+	case "file":
+		path, ok := config.Attrs["pos_file"]
+		if !ok {
+			return nil, nil
+		}
+		store, err := position.OpenFileStore(path)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	case "sqlite":
+		dsn, ok := config.Attrs["pos_store_dsn"]
+		if !ok {
+			return nil, errors.New("required attribute `pos_store_dsn' is not specified")
+		}
+		driver, ok := config.Attrs["pos_store_driver"]
+		if !ok {
+			driver = "sqlite3"
+		}
+		err := checkSQLDriver("pos_store_driver", driver)
+		if err != nil {
+			return nil, errors.New("pos_store sqlite is not available: " + err.Error())
+		}
+		table, ok := config.Attrs["pos_store_table"]
+		if !ok {
+			table = "positions"
+		}
+		store, err := position.OpenSQLiteStore(driver, dsn, table)
+		if err != nil {
+			return nil, err
+		}
+		return store, nil
+	}
+	return nil, errors.New("unsupported pos_store: " + type_)
+}
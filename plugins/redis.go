@@ -0,0 +1,185 @@
+package plugins
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// redisError is an error reply, which leaves the connection usable.
+type redisError struct {
+	message string
+}
+
+func (err *redisError) Error() string {
+	return "Redis error: " + err.message
+}
+
+// A minimal Redis client speaking RESP2, pipelining the commands it is
+// given.
+type redisClient struct {
+	address       string
+	tlsConfig     *tls.Config
+	socketOptions *ik.SocketOptions
+	timeout       time.Duration
+	username      string
+	password      string
+	db            int
+	conn          net.Conn
+	reader        *bufio.Reader
+	writer        *bufio.Writer
+}
+
+func (client *redisClient) close() {
+	if client.conn != nil {
+		client.conn.Close()
+		client.conn = nil
+	}
+}
+
+func (client *redisClient) writeCommand(args []string) {
+	client.writer.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		client.writer.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n")
+		client.writer.WriteString(arg)
+		client.writer.WriteString("\r\n")
+	}
+}
+
+func (client *redisClient) readLine() (string, error) {
+	line, err := client.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", errors.New("malformed reply from Redis")
+	}
+	return line[:len(line)-2], nil
+}
+
+// readReply reads a reply, of which only the strings, the integers and the
+// arrays of them are returned; an error reply is returned as a redisError.
+func (client *redisClient) readReply() (interface{}, error) {
+	line, err := client.readLine()
+	if err != nil {
+		return nil, err
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, &redisError{line[1:]}
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		_, err = io.ReadFull(client.reader, b)
+		if err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			array[i], err = client.readReply()
+			if _, ok := err.(*redisError); err != nil && !ok {
+				return nil, err
+			}
+		}
+		return array, nil
+	}
+	return nil, errors.New("malformed reply from Redis")
+}
+
+// do sends the commands in one go and reads as many replies.  The first
+// error reply is returned after every reply has been read; any other error
+// drops the connection.
+func (client *redisClient) do(commands [][]string) ([]interface{}, error) {
+	err := client.connect()
+	if err != nil {
+		return nil, err
+	}
+	return client.pipeline(commands)
+}
+
+func (client *redisClient) pipeline(commands [][]string) ([]interface{}, error) {
+	client.conn.SetDeadline(time.Now().Add(client.timeout))
+	for _, command := range commands {
+		client.writeCommand(command)
+	}
+	err := client.writer.Flush()
+	if err != nil {
+		client.close()
+		return nil, err
+	}
+	replies := make([]interface{}, len(commands))
+	var firstError error
+	for i := range commands {
+		replies[i], err = client.readReply()
+		if err != nil {
+			if _, ok := err.(*redisError); !ok {
+				client.close()
+				return nil, err
+			}
+			if firstError == nil {
+				firstError = err
+			}
+		}
+	}
+	return replies, firstError
+}
+
+func (client *redisClient) connect() error {
+	if client.conn != nil {
+		return nil
+	}
+	conn, err := client.socketOptions.Dial("tcp", client.address, client.timeout)
+	if err != nil {
+		return err
+	}
+	if client.tlsConfig != nil {
+		conn = tls.Client(conn, client.tlsConfig)
+	}
+	client.conn = conn
+	client.reader = bufio.NewReader(conn)
+	client.writer = bufio.NewWriter(conn)
+	commands := make([][]string, 0, 2)
+	if client.password != "" {
+		if client.username != "" {
+			commands = append(commands, []string{"AUTH", client.username, client.password})
+		} else {
+			commands = append(commands, []string{"AUTH", client.password})
+		}
+	}
+	if client.db != 0 {
+		commands = append(commands, []string{"SELECT", strconv.Itoa(client.db)})
+	}
+	if len(commands) == 0 {
+		return nil
+	}
+	_, err = client.pipeline(commands)
+	if err != nil {
+		client.close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+package plugins
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	jnl "github.com/moriyoshi/ik/journal"
+	"github.com/ugorji/go/codec"
+	"io"
+	"net"
+	"regexp"
+	"time"
+)
+
+// ReplayParams tells ReplayBuffer where the buffer is and what to take out
+// of it.  Format is the way the output packed the records: "json" for one
+// object a line, as most of the outputs do, "kafka" for the messages of
+// out_kafka, or "msgpack" for [time, record] or [tag, time, record]
+// entries.  The tag of a record is taken from TagKey if it has one, then
+// Tag, then the key of the chunk.  The time is taken from TimeKey in the
+// same way, or else is the time the chunk was made.  Pattern is a glob tags
+// are matched against, and the records out of Since and Until are skipped
+// unless they are zero.
+type ReplayParams struct {
+	BufferPath string
+	Encryption *jnl.ChunkEncryption
+	Format     string
+	Tag        string
+	TagKey     string
+	TimeKey    string
+	Pattern    string
+	Since      time.Time
+	Until      time.Time
+}
+
+type replayFilter struct {
+	params  ReplayParams
+	pattern *regexp.Regexp
+}
+
+func (filter *replayFilter) accepts(tag string, timestamp uint64) bool {
+	if filter.pattern != nil && !filter.pattern.MatchString(tag) {
+		return false
+	}
+	if !filter.params.Since.IsZero() && timestamp < uint64(filter.params.Since.Unix()) {
+		return false
+	}
+	if !filter.params.Until.IsZero() && timestamp >= uint64(filter.params.Until.Unix()) {
+		return false
+	}
+	return true
+}
+
+func (filter *replayFilter) tag(data map[string]interface{}, chunk jnl.ChunkInfo) string {
+	if filter.params.TagKey != "" {
+		switch tag := data[filter.params.TagKey].(type) {
+		case string:
+			return tag
+		case []byte:
+			return string(tag)
+		}
+	}
+	if filter.params.Tag != "" {
+		return filter.params.Tag
+	}
+	return chunk.Key
+}
+
+func (filter *replayFilter) timestamp(data map[string]interface{}, chunk jnl.ChunkInfo) uint64 {
+	if filter.params.TimeKey != "" {
+		switch value := data[filter.params.TimeKey].(type) {
+		case float64:
+			return uint64(value)
+		case uint64:
+			return value
+		case int64:
+			return uint64(value)
+		case string:
+			t, err := time.Parse(time.RFC3339Nano, value)
+			if err == nil {
+				return uint64(t.Unix())
+			}
+		}
+	}
+	return uint64(chunk.Timestamp.Unix())
+}
+
+func (filter *replayFilter) add(recordSets []ik.FluentRecordSet, tag string, timestamp uint64, data map[string]interface{}) []ik.FluentRecordSet {
+	if !filter.accepts(tag, timestamp) {
+		return recordSets
+	}
+	record := ik.TinyFluentRecord{Timestamp: timestamp, Data: data}
+	if len(recordSets) > 0 && recordSets[len(recordSets)-1].Tag == tag {
+		recordSets[len(recordSets)-1].Records = append(recordSets[len(recordSets)-1].Records, record)
+		return recordSets
+	}
+	return append(recordSets, ik.FluentRecordSet{Tag: tag, Records: []ik.TinyFluentRecord{record}})
+}
+
+func (filter *replayFilter) decodeLines(reader io.Reader, chunk jnl.ChunkInfo, kafka bool) ([]ik.FluentRecordSet, error) {
+	recordSets := make([]ik.FluentRecordSet, 0)
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(nil, 1<<30)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		data := map[string]interface{}{}
+		var timestamp uint64
+		if kafka {
+			message := kafkaBufferedMessage{}
+			err := json.Unmarshal(line, &message)
+			if err != nil {
+				return nil, err
+			}
+			if message.Value == nil {
+				return nil, errors.New("the messages were packed with a formatter")
+			}
+			err = json.Unmarshal(message.Value, &data)
+			if err != nil {
+				return nil, err
+			}
+			timestamp = uint64(message.Time / 1000)
+		} else {
+			err := json.Unmarshal(line, &data)
+			if err != nil {
+				return nil, err
+			}
+			timestamp = filter.timestamp(data, chunk)
+		}
+		recordSets = filter.add(recordSets, filter.tag(data, chunk), timestamp, data)
+	}
+	return recordSets, scanner.Err()
+}
+
+func (filter *replayFilter) decodeMsgpack(reader io.Reader, chunk jnl.ChunkInfo) ([]ik.FluentRecordSet, error) {
+	recordSets := make([]ik.FluentRecordSet, 0)
+	dec := codec.NewDecoder(bufio.NewReader(reader), newFluentdCodec())
+	for {
+		entry := []interface{}{}
+		err := dec.Decode(&entry)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		tag := ""
+		switch len(entry) {
+		case 2:
+		case 3:
+			switch tag_ := entry[0].(type) {
+			case []byte:
+				tag = string(tag_)
+			case string:
+				tag = tag_
+			}
+			entry = entry[1:]
+		default:
+			return nil, errors.New("unexpected entry")
+		}
+		timestamp, ok := normalizeFluentdTime(entry[0]).(uint64)
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("unexpected time: %v", entry[0]))
+		}
+		data, ok := entry[1].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("unexpected record")
+		}
+		if tag == "" {
+			tag = filter.tag(data, chunk)
+		}
+		recordSets = filter.add(recordSets, tag, timestamp, data)
+	}
+	return recordSets, nil
+}
+
+// ReplayBuffer reads the chunks left in the buffer of an output, by key and
+// in the order they would have been delivered, and emits the records to
+// port a chunk at a time.  The buffer is not modified, and may be the one
+// of a running output as well; the head chunk is then read as far as it
+// has been written.  It returns the number of records emitted.
+func ReplayBuffer(logger ik.Logger, params ReplayParams, port ik.Port) (int, error) {
+	filter := &replayFilter{params: params}
+	if params.Pattern != "" {
+		pattern, err := ik.BuildRegexpFromGlobPattern(params.Pattern)
+		if err != nil {
+			return 0, err
+		}
+		filter.pattern, err = regexp.Compile(pattern)
+		if err != nil {
+			return 0, err
+		}
+	}
+	switch params.Format {
+	case "", "json", "kafka", "msgpack":
+	default:
+		return 0, errors.New("unsupported format: " + params.Format)
+	}
+	chunks, err := jnl.ListChunks(logger, params.BufferPath, ".log")
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, chunk := range chunks {
+		reader, err := jnl.OpenChunkInfo(chunk, params.Encryption)
+		if err != nil {
+			return count, err
+		}
+		var recordSets []ik.FluentRecordSet
+		if params.Format == "msgpack" {
+			recordSets, err = filter.decodeMsgpack(reader, chunk)
+		} else {
+			recordSets, err = filter.decodeLines(reader, chunk, params.Format == "kafka")
+		}
+		reader.Close()
+		if err != nil {
+			return count, errors.New(fmt.Sprintf("%s: %s", chunk.Path, err.Error()))
+		}
+		if len(recordSets) == 0 {
+			continue
+		}
+		err = port.Emit(recordSets)
+		if err != nil {
+			return count, err
+		}
+		for _, recordSet := range recordSets {
+			count += len(recordSet.Records)
+		}
+		logger.Info("replayed %s", chunk.Path)
+	}
+	return count, nil
+}
+
+type replayForwardPort struct {
+	output *ForwardOutput
+}
+
+func (port *replayForwardPort) Emit(recordSets []ik.FluentRecordSet) error {
+	err := port.output.Emit(recordSets)
+	if err != nil {
+		return err
+	}
+	return port.output.flush()
+}
+
+// ReplayBufferToForward replays the buffer to the forward input at
+// address, such as the one of another ik, waiting for each chunk to be
+// acknowledged if requireAck is true.
+func ReplayBufferToForward(logger ik.Logger, params ReplayParams, address string, requireAck bool) (int, error) {
+	host, netPort, err := net.SplitHostPort(address)
+	if err != nil {
+		return 0, err
+	}
+	node, err := newForwardNode(&ik.ConfigElement{Attrs: map[string]string{"host": host, "port": netPort}})
+	if err != nil {
+		return 0, err
+	}
+	output, err := newForwardOutput(&ForwardOutputFactory{}, logger, ik.SystemClock, []*forwardNode{node})
+	if err != nil {
+		return 0, err
+	}
+	defer output.Shutdown()
+	output.requireAck = requireAck
+	return ReplayBuffer(logger, params, &replayForwardPort{output})
+}
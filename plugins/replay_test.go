@@ -0,0 +1,157 @@
+package plugins
+
+import (
+	"bytes"
+	"github.com/moriyoshi/ik"
+	"github.com/moriyoshi/ik/iktest"
+	jnl "github.com/moriyoshi/ik/journal"
+	"github.com/ugorji/go/codec"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func writeTestBuffer(t *testing.T, path string, chunks map[string][]string) {
+	factory := jnl.NewFileJournalGroupFactory(
+		&testLogger{t},
+		rand.NewSource(0),
+		iktest.NewClock(time.Unix(1400000000, 0)),
+		".log",
+		os.FileMode(0644),
+		1024,
+	)
+	journalGroup, err := factory.GetJournalGroup(path, &testPluginInstance{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer journalGroup.Dispose()
+	for key, lines := range chunks {
+		journal := journalGroup.GetFileJournal(key)
+		for _, line := range lines {
+			err = journal.Write([]byte(line))
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+		}
+	}
+}
+
+func Test_ReplayBuffer_json(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.replay")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	writeTestBuffer(t, tempDir+"/buffer", map[string][]string{
+		"app.a": {"{\"x\":1,\"time\":1400000100}\n", "{\"x\":2,\"time\":1400000200,\"tag\":\"app.b\"}\n"},
+		"db":    {"{\"x\":3}\n"},
+	})
+
+	cases := []struct {
+		params   ReplayParams
+		expected []string // the tags of the records in order
+	}{
+		{ReplayParams{}, []string{"app.a", "app.a", "db"}},
+		{ReplayParams{TagKey: "tag"}, []string{"app.a", "app.b", "db"}},
+		{ReplayParams{Tag: "t"}, []string{"t", "t", "t"}},
+		{ReplayParams{Pattern: "app.**"}, []string{"app.a", "app.a"}},
+		{ReplayParams{TimeKey: "time", Since: time.Unix(1400000150, 0)}, []string{"app.a"}},
+		{ReplayParams{TimeKey: "time", Until: time.Unix(1400000150, 0)}, []string{"app.a", "db"}},
+	}
+	for i, case_ := range cases {
+		case_.params.BufferPath = tempDir + "/buffer"
+		port := &testDurablePort{}
+		count, err := ReplayBuffer(&testLogger{t}, case_.params, port)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		tags := make([]string, 0)
+		for _, recordSet := range port.recordSets {
+			for _, _ = range recordSet.Records {
+				tags = append(tags, recordSet.Tag)
+			}
+		}
+		if count != len(case_.expected) || len(tags) != len(case_.expected) {
+			t.Logf("#%d: %d records: %v", i, count, tags)
+			t.Fail()
+			continue
+		}
+		for j, tag := range tags {
+			if tag != case_.expected[j] {
+				t.Logf("#%d: %v", i, tags)
+				t.Fail()
+				break
+			}
+		}
+	}
+}
+
+func Test_ReplayBuffer_kafkaAndMsgpack(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.replay")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	entries := &bytes.Buffer{}
+	enc := codec.NewEncoder(entries, newFluentdCodec())
+	enc.Encode([]interface{}{1400000001, map[string]interface{}{"x": 1}})
+	enc.Encode([]interface{}{"other", 1400000002, map[string]interface{}{"x": 2}})
+	writeTestBuffer(t, tempDir+"/kafka", map[string][]string{
+		"topic": {"{\"k\":\"a\",\"t\":1400000001000,\"v\":{\"x\":1}}\n"},
+	})
+	writeTestBuffer(t, tempDir+"/msgpack", map[string][]string{
+		"tag": {entries.String()},
+	})
+
+	port := &testDurablePort{}
+	_, err = ReplayBuffer(&testLogger{t}, ReplayParams{BufferPath: tempDir + "/kafka", Format: "kafka"}, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(port.recordSets) != 1 || port.recordSets[0].Tag != "topic" || port.recordSets[0].Records[0].Timestamp != 1400000001 || port.recordSets[0].Records[0].Data["x"] != float64(1) {
+		t.Logf("%v", port.recordSets)
+		t.Fail()
+	}
+
+	port = &testDurablePort{}
+	_, err = ReplayBuffer(&testLogger{t}, ReplayParams{BufferPath: tempDir + "/msgpack", Format: "msgpack"}, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(port.recordSets) != 2 || port.recordSets[0].Tag != "tag" || port.recordSets[1].Tag != "other" || port.recordSets[1].Records[0].Timestamp != 1400000002 {
+		t.Logf("%v", port.recordSets)
+		t.Fail()
+	}
+
+	_, err = ReplayBuffer(&testLogger{t}, ReplayParams{BufferPath: tempDir + "/msgpack", Format: "avro"}, port)
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func Test_ReplayBufferToForward(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "ik.replay")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+	writeTestBuffer(t, tempDir+"/buffer", map[string][]string{"test": {"{\"x\":1}\n{\"x\":2}\n"}})
+
+	port := &testDurablePort{}
+	input, err := newForwardInput(nil, &testLogger{t}, nil, &ik.ListenAddress{Network: "tcp", Address: "127.0.0.1:0"}, port)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer input.Shutdown()
+	go input.Run()
+	count, err := ReplayBufferToForward(&testLogger{t}, ReplayParams{BufferPath: tempDir + "/buffer"}, input.listener.Addr().String(), true)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != 2 || port.durable != 1 || len(port.recordSets) != 1 || len(port.recordSets[0].Records) != 2 {
+		t.Logf("%d: %v", count, port.recordSets)
+		t.Fail()
+	}
+}
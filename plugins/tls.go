@@ -0,0 +1,47 @@
+package plugins
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"io/ioutil"
+	"strconv"
+)
+
+// newTLSClientConfig reads ssl_verify, ca_file, client_cert and client_key.
+func newTLSClientConfig(config *ik.ConfigElement) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+	sslVerifyStr, ok := config.Attrs["ssl_verify"]
+	if ok {
+		sslVerify, err := strconv.ParseBool(sslVerifyStr)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.InsecureSkipVerify = !sslVerify
+	}
+	caFile, ok := config.Attrs["ca_file"]
+	if ok {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in " + caFile)
+		}
+	}
+	clientCert, ok := config.Attrs["client_cert"]
+	if ok {
+		clientKey, ok := config.Attrs["client_key"]
+		if !ok {
+			return nil, errors.New("required attribute `client_key' is not specified")
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
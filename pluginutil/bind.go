@@ -0,0 +1,140 @@
+package pluginutil
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moriyoshi/ik"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Bind sets the fields of the struct v points to from the attributes of the
+// configuration element named by their ik tags, and leaves those whose
+// attributes are not given as they are, so that they can be set to the
+// defaults beforehand.  A tag may go on with ",required" to make the
+// attribute required, or ",capacity" to read an integer such as "8m" with
+// ik.ParseCapacityString.  Durations are read with time.ParseDuration,
+// []string as values separated with commas, and the fields of embedded
+// structs such as RetryPolicy as those of v.
+func Bind(config *ik.ConfigElement, v interface{}) error {
+	value := reflect.ValueOf(v)
+	if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Struct {
+		return errors.New(fmt.Sprintf("cannot bind to %s", value.Type().String()))
+	}
+	return bindStruct(config, value.Elem())
+}
+
+func bindStruct(config *ik.ConfigElement, value reflect.Value) error {
+	type_ := value.Type()
+	for i := 0; i < type_.NumField(); i++ {
+		field := type_.Field(i)
+		tag, ok := field.Tag.Lookup("ik")
+		if !ok {
+			if field.Anonymous && field.Type.Kind() == reflect.Struct && field.PkgPath == "" {
+				err := bindStruct(config, value.Field(i))
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		options := strings.Split(tag, ",")
+		name := options[0]
+		required, capacity := false, false
+		for _, option := range options[1:] {
+			switch option {
+			case "required":
+				required = true
+			case "capacity":
+				capacity = true
+			default:
+				return errors.New(fmt.Sprintf("unknown option of %s: %s", field.Name, option))
+			}
+		}
+		if !value.Field(i).CanSet() {
+			return errors.New(fmt.Sprintf("cannot bind to the unexported field %s", field.Name))
+		}
+		s, ok := config.Attrs[name]
+		if !ok {
+			if required {
+				return errors.New(fmt.Sprintf("required attribute `%s' is not specified", name))
+			}
+			continue
+		}
+		err := setField(value.Field(i), s, capacity)
+		if err != nil {
+			return errors.New(fmt.Sprintf("invalid %s: %s", name, err.Error()))
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, s string, capacity bool) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		var err error
+		if capacity {
+			n, err = ik.ParseCapacityString(s)
+		} else {
+			n, err = strconv.ParseInt(s, 10, 64)
+		}
+		if err != nil {
+			return err
+		}
+		if field.OverflowInt(n) {
+			return errors.New("out of range: " + s)
+		}
+		field.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		if field.OverflowUint(n) {
+			return errors.New("out of range: " + s)
+		}
+		field.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return errors.New("unsupported type: " + field.Type().String())
+		}
+		values := make([]string, 0)
+		for _, value := range strings.Split(s, ",") {
+			value = strings.TrimSpace(value)
+			if value != "" {
+				values = append(values, value)
+			}
+		}
+		field.Set(reflect.ValueOf(values).Convert(field.Type()))
+	default:
+		return errors.New("unsupported type: " + field.Type().String())
+	}
+	return nil
+}
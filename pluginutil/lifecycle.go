@@ -0,0 +1,106 @@
+package pluginutil
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+type State int
+
+const (
+	Created State = iota
+	Running
+	Stopping
+	Stopped
+)
+
+var stateNames = []string{"created", "running", "stopping", "stopped"}
+
+func (state State) String() string {
+	return stateNames[state]
+}
+
+// ErrStopped is returned for what is asked of a plugin that has been shut
+// down.
+var ErrStopped = errors.New("the plugin has been shut down")
+
+// Lifecycle goes from Created to Running as the plugin is run, to Stopping
+// as it is shut down and to Stopped once it has finished.  A plugin shut
+// down before it is run goes to Stopping all the same.
+type Lifecycle struct {
+	state  State
+	ctx    context.Context
+	cancel context.CancelFunc
+	mtx    sync.Mutex
+}
+
+func (lifecycle *Lifecycle) init() {
+	if lifecycle.ctx == nil {
+		lifecycle.ctx, lifecycle.cancel = context.WithCancel(context.Background())
+	}
+}
+
+func (lifecycle *Lifecycle) State() State {
+	lifecycle.mtx.Lock()
+	defer lifecycle.mtx.Unlock()
+	return lifecycle.state
+}
+
+// Start makes it Running, and returns ErrStopped if it has been shut down.
+// It may be called on every Run.
+func (lifecycle *Lifecycle) Start() error {
+	lifecycle.mtx.Lock()
+	defer lifecycle.mtx.Unlock()
+	switch lifecycle.state {
+	case Created:
+		lifecycle.state = Running
+	case Stopping, Stopped:
+		return ErrStopped
+	}
+	return nil
+}
+
+// Stop makes it Stopping and closes Done, and returns false if it has
+// already been.
+func (lifecycle *Lifecycle) Stop() bool {
+	lifecycle.mtx.Lock()
+	defer lifecycle.mtx.Unlock()
+	if lifecycle.state >= Stopping {
+		return false
+	}
+	lifecycle.init()
+	lifecycle.state = Stopping
+	lifecycle.cancel()
+	return true
+}
+
+// Stopped makes it Stopped once it is Stopping.
+func (lifecycle *Lifecycle) Stopped() {
+	lifecycle.mtx.Lock()
+	defer lifecycle.mtx.Unlock()
+	if lifecycle.state == Stopping {
+		lifecycle.state = Stopped
+	}
+}
+
+// Context returns a context that is done once it is Stopping.
+func (lifecycle *Lifecycle) Context() context.Context {
+	lifecycle.mtx.Lock()
+	defer lifecycle.mtx.Unlock()
+	lifecycle.init()
+	return lifecycle.ctx
+}
+
+func (lifecycle *Lifecycle) Done() <-chan struct{} {
+	return lifecycle.Context().Done()
+}
+
+// Check returns ErrStopped once it is Stopping, for Emit to refuse the
+// records it would not get through.
+func (lifecycle *Lifecycle) Check() error {
+	if lifecycle.State() >= Stopping {
+		return ErrStopped
+	}
+	return nil
+}
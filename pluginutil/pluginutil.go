@@ -0,0 +1,161 @@
+// Package pluginutil has the parts every plugin would write for itself,
+// for the plugins out of this tree to embed.  An output embedding
+// BaseOutput, for one, implements Emit and the factory, and is given the
+// rest:
+//
+//	type MyOutput struct {
+//		pluginutil.BaseOutput
+//		Endpoint string `ik:"endpoint,required"`
+//	}
+//
+//	func (factory *MyOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+//		output := &MyOutput{}
+//		output.Init(factory, engine, config)
+//		return output, pluginutil.Bind(config, output)
+//	}
+package pluginutil
+
+import (
+	"context"
+	"github.com/moriyoshi/ik"
+	"sync"
+)
+
+// BasePlugin is a factory with nothing to show on the scoreboard.
+type BasePlugin struct {
+	PluginName string
+}
+
+func (plugin *BasePlugin) Name() string {
+	return plugin.PluginName
+}
+
+func (plugin *BasePlugin) BindScorekeeper(*ik.Scorekeeper) {}
+
+// Base is what BaseInput, BaseOutput and BaseFilter have in common: the
+// engine, a logger prefixed with the name of the plugin, the lifecycle and
+// the counters shown by AddCounterTopic.
+type Base struct {
+	Lifecycle
+	Engine      ik.Engine
+	Logger      ik.Logger
+	factory     ik.Plugin
+	counters    map[string]*int64
+	countersMtx sync.Mutex
+}
+
+// Init is to be called by the factory on the instance it creates.
+func (base *Base) Init(factory ik.Plugin, engine ik.Engine, config *ik.ConfigElement) {
+	base.factory = factory
+	base.Engine = engine
+	prefix := factory.Name()
+	if id, ok := config.Attrs["@id"]; ok {
+		prefix += "(" + id + ")"
+	}
+	base.Logger = NewPrefixLogger(engine.Logger(), prefix+": ")
+}
+
+func (base *Base) Factory() ik.Plugin {
+	return base.factory
+}
+
+// Counter returns the counter of the given name, to be updated with the
+// functions of sync/atomic.
+func (base *Base) Counter(name string) *int64 {
+	base.countersMtx.Lock()
+	defer base.countersMtx.Unlock()
+	if base.counters == nil {
+		base.counters = make(map[string]*int64)
+	}
+	counter, ok := base.counters[name]
+	if !ok {
+		counter = new(int64)
+		base.counters[name] = counter
+	}
+	return counter
+}
+
+// Retry calls f as retry says, giving up once the plugin is shut down.
+func (base *Base) Retry(retry RetryPolicy, f func(ctx context.Context) error) error {
+	return retry.Do(base.Context(), base.Engine.Clock(), f)
+}
+
+// Run waits for the shutdown, for the plugins doing all of their work as
+// the records are emitted.  A plugin with work of its own overrides it,
+// calling Start first and returning once Done is closed.
+func (base *Base) Run() error {
+	base.Start()
+	<-base.Done()
+	base.Stopped()
+	return nil
+}
+
+func (base *Base) Shutdown() error {
+	base.Stop()
+	return nil
+}
+
+// BaseInput emits at the default port of the engine it was created with.
+type BaseInput struct {
+	Base
+	port ik.Port
+}
+
+func (input *BaseInput) Init(factory ik.Plugin, engine ik.Engine, config *ik.ConfigElement) {
+	input.Base.Init(factory, engine, config)
+	input.port = engine.DefaultPort()
+}
+
+func (input *BaseInput) Port() ik.Port {
+	return input.port
+}
+
+type BaseOutput struct {
+	Base
+}
+
+// BaseFilter keeps the port the filter emits what it makes of the records
+// at.
+type BaseFilter struct {
+	Base
+	Next ik.Port
+}
+
+func (filter *BaseFilter) Init(factory ik.Plugin, engine ik.Engine, config *ik.ConfigElement, next ik.Port) {
+	filter.Base.Init(factory, engine, config)
+	filter.Next = next
+}
+
+type prefixLogger struct {
+	logger ik.Logger
+	prefix string
+}
+
+// NewPrefixLogger returns a logger putting prefix before every message.
+func NewPrefixLogger(logger ik.Logger, prefix string) ik.Logger {
+	return &prefixLogger{logger, prefix}
+}
+
+func (logger *prefixLogger) Critical(format string, args ...interface{}) {
+	logger.logger.Critical(logger.prefix+format, args...)
+}
+
+func (logger *prefixLogger) Error(format string, args ...interface{}) {
+	logger.logger.Error(logger.prefix+format, args...)
+}
+
+func (logger *prefixLogger) Warning(format string, args ...interface{}) {
+	logger.logger.Warning(logger.prefix+format, args...)
+}
+
+func (logger *prefixLogger) Notice(format string, args ...interface{}) {
+	logger.logger.Notice(logger.prefix+format, args...)
+}
+
+func (logger *prefixLogger) Info(format string, args ...interface{}) {
+	logger.logger.Info(logger.prefix+format, args...)
+}
+
+func (logger *prefixLogger) Debug(format string, args ...interface{}) {
+	logger.logger.Debug(logger.prefix+format, args...)
+}
@@ -0,0 +1,161 @@
+package pluginutil
+
+import (
+	"context"
+	"errors"
+	"github.com/moriyoshi/ik"
+	"github.com/op/go-logging"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testOutputFactory struct {
+	BasePlugin
+}
+
+type testOutput struct {
+	BaseOutput
+	RetryPolicy
+	Endpoint string        `ik:"endpoint,required"`
+	Limit    int64         `ik:"limit,capacity"`
+	Interval time.Duration `ik:"interval"`
+	Keys     []string      `ik:"keys"`
+	Gzip     bool          `ik:"gzip"`
+	emitted  chan []ik.FluentRecordSet
+}
+
+func (output *testOutput) Emit(recordSets []ik.FluentRecordSet) error {
+	err := output.Check()
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(output.Counter("emitted"), int64(len(recordSets)))
+	output.emitted <- recordSets
+	return nil
+}
+
+func (factory *testOutputFactory) New(engine ik.Engine, config *ik.ConfigElement) (ik.Output, error) {
+	output := &testOutput{RetryPolicy: DefaultRetryPolicy(), Interval: time.Second, emitted: make(chan []ik.FluentRecordSet, 1)}
+	output.Init(factory, engine, config)
+	return output, Bind(config, output)
+}
+
+func newTestEngine() ik.Engine {
+	logger := logging.MustGetLogger("ik")
+	return ik.NewEngine(logger, nil, nil, nil, ik.NewScorekeeper(logger), nil)
+}
+
+func TestBind(t *testing.T) {
+	engine := newTestEngine()
+	defer engine.Dispose()
+	factory := &testOutputFactory{BasePlugin{"test"}}
+	output_, err := factory.New(engine, &ik.ConfigElement{Attrs: map[string]string{
+		"endpoint":    "http://localhost/",
+		"limit":       "8k",
+		"keys":        "a, b,",
+		"gzip":        "true",
+		"retry_limit": "2",
+	}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output := output_.(*testOutput)
+	if output.Endpoint != "http://localhost/" || output.Limit != 8000 || len(output.Keys) != 2 || output.Keys[1] != "b" || !output.Gzip {
+		t.Fatalf("%v", output)
+	}
+	// the defaults are kept for what is not given
+	if output.Interval != time.Second || output.RetryPolicy.Limit != 2 || output.Wait != time.Second {
+		t.Fatalf("%v", output)
+	}
+	for _, attrs := range []map[string]string{{}, {"endpoint": "x", "interval": "1"}, {"endpoint": "x", "gzip": "maybe"}} {
+		_, err = factory.New(engine, &ik.ConfigElement{Attrs: attrs})
+		if err == nil {
+			t.Logf("%v accepted", attrs)
+			t.Fail()
+		}
+	}
+}
+
+func TestBaseOutput(t *testing.T) {
+	engine := newTestEngine()
+	defer engine.Dispose()
+	factory := &testOutputFactory{BasePlugin{"test"}}
+	output_, err := factory.New(engine, &ik.ConfigElement{Attrs: map[string]string{"endpoint": "x"}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output := output_.(*testOutput)
+	if output.Factory() != factory || output.State() != Created {
+		t.Fail()
+	}
+	err = engine.Launch(output)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output.Emit([]ik.FluentRecordSet{{Tag: "test"}})
+	<-output.emitted
+	if *output.Counter("emitted") != 1 {
+		t.Fail()
+	}
+	topic := &counterTopic{"emitted"}
+	if text, _ := topic.PlainText(output); text != "1" {
+		t.Fail()
+	}
+	err = engine.Terminate(output)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if output.State() != Stopped || output.Emit(nil) != ErrStopped {
+		t.Fail()
+	}
+}
+
+func TestLifecycle(t *testing.T) {
+	lifecycle := &Lifecycle{}
+	if !lifecycle.Stop() || lifecycle.Stop() {
+		t.Fail()
+	}
+	// shut down before it is run
+	if lifecycle.Start() != ErrStopped || lifecycle.State() != Stopping {
+		t.Fail()
+	}
+	select {
+	case <-lifecycle.Done():
+	default:
+		t.Fail()
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	policy := RetryPolicy{Limit: 2, Wait: time.Millisecond, MaxWait: 2 * time.Millisecond}
+	attempts := 0
+	err := policy.Do(context.Background(), ik.SystemClock, func(context.Context) error {
+		attempts += 1
+		return errors.New("failed")
+	})
+	if err == nil || attempts != 3 {
+		t.Fail()
+	}
+	attempts = 0
+	err = policy.Do(context.Background(), ik.SystemClock, func(context.Context) error {
+		attempts += 1
+		if attempts < 2 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Fail()
+	}
+	// given up once the context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	policy = RetryPolicy{Limit: -1, Wait: time.Hour}
+	err = policy.Do(ctx, ik.SystemClock, func(context.Context) error {
+		return errors.New("failed")
+	})
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,45 @@
+package pluginutil
+
+import (
+	"context"
+	"github.com/moriyoshi/ik"
+	"time"
+)
+
+// RetryPolicy is how many times a failed attempt is made again, and how
+// long is waited before each, doubling from Wait up to MaxWait.  A negative
+// Limit retries for good.  It is bound from the attributes in its tags
+// when a plugin embeds it.
+type RetryPolicy struct {
+	Limit   int           `ik:"retry_limit"`
+	Wait    time.Duration `ik:"retry_wait"`
+	MaxWait time.Duration `ik:"max_retry_wait"`
+}
+
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{Limit: 5, Wait: time.Second, MaxWait: time.Minute}
+}
+
+// Do calls f until it succeeds or the retries run out, and returns the
+// error of the last attempt, waiting on clock.  It stops waiting once ctx is
+// done.
+func (policy RetryPolicy) Do(ctx context.Context, clock ik.Clock, f func(ctx context.Context) error) error {
+	wait := policy.Wait
+	for i := 0; ; i++ {
+		err := f(ctx)
+		if err == nil || (policy.Limit >= 0 && i >= policy.Limit) {
+			return err
+		}
+		timer := clock.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C():
+		}
+		wait *= 2
+		if policy.MaxWait > 0 && wait > policy.MaxWait {
+			wait = policy.MaxWait
+		}
+	}
+}
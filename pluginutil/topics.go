@@ -0,0 +1,42 @@
+package pluginutil
+
+import (
+	"errors"
+	"github.com/moriyoshi/ik"
+	"strconv"
+	"sync/atomic"
+)
+
+type counterTopic struct {
+	name string
+}
+
+func (topic *counterTopic) Markup(pluginInstance ik.PluginInstance) (ik.Markup, error) {
+	text, err := topic.PlainText(pluginInstance)
+	if err != nil {
+		return ik.Markup{}, err
+	}
+	return ik.Markup{[]ik.MarkupChunk{{Text: text}}}, nil
+}
+
+func (topic *counterTopic) PlainText(pluginInstance ik.PluginInstance) (string, error) {
+	counted, ok := pluginInstance.(interface {
+		Counter(name string) *int64
+	})
+	if !ok {
+		return "", errors.New("the plugin does not embed pluginutil.Base")
+	}
+	return strconv.FormatInt(atomic.LoadInt64(counted.Counter(topic.name)), 10), nil
+}
+
+// AddCounterTopic shows the counter of the given name of each instance of
+// the plugin on the scoreboard.  It is to be called in BindScorekeeper.
+func AddCounterTopic(scorekeeper *ik.Scorekeeper, plugin ik.Plugin, name string, displayName string, description string) {
+	scorekeeper.AddTopic(ik.ScorekeeperTopic{
+		Plugin:      plugin,
+		Name:        name,
+		DisplayName: displayName,
+		Description: description,
+		Fetcher:     &counterTopic{name},
+	})
+}
@@ -0,0 +1,92 @@
+package ik
+
+import (
+	"bytes"
+	"sync"
+)
+
+// the buffers grown larger than this by an oversized record are left to
+// the GC rather than kept around
+const maxPooledBufferSize = 1 << 20
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+var recordDataPool = sync.Pool{
+	New: func() interface{} {
+		return make(map[string]interface{})
+	},
+}
+
+// BufferedRecordPacker is implemented by the packers that can pack a record
+// onto a buffer given by the caller, who is then free to reuse it once the
+// packed bytes are written.
+type BufferedRecordPacker interface {
+	PackTo(buf *bytes.Buffer, record FluentRecord) error
+}
+
+// BufferedFormatter is the counterpart of BufferedRecordPacker for the
+// formatters.
+type BufferedFormatter interface {
+	FormatTo(buf *bytes.Buffer, tag string, record FluentRecord) error
+}
+
+// AcquireBuffer returns an empty buffer, which is to be handed back with
+// ReleaseBuffer once nothing refers to its contents any longer.
+func AcquireBuffer() *bytes.Buffer {
+	if !poolingEnabled {
+		return &bytes.Buffer{}
+	}
+	buf := bufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// ReleaseBuffer puts back a buffer taken with AcquireBuffer.  Neither the
+// buffer nor the slices returned by its Bytes may be used after that.
+func ReleaseBuffer(buf *bytes.Buffer) {
+	if !poolingEnabled || buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	bufferPool.Put(buf)
+}
+
+// AcquireRecordData returns an empty map for a record that lives no longer
+// than the call it is made in, such as the copy a packer adds fields to.
+// It must not be emitted, as the ports may keep the records they are given.
+func AcquireRecordData() map[string]interface{} {
+	if !poolingEnabled {
+		return make(map[string]interface{})
+	}
+	return recordDataPool.Get().(map[string]interface{})
+}
+
+// ReleaseRecordData empties a map taken with AcquireRecordData and puts it
+// back.
+func ReleaseRecordData(data map[string]interface{}) {
+	if !poolingEnabled {
+		return
+	}
+	for k := range data {
+		delete(data, k)
+	}
+	recordDataPool.Put(data)
+}
+
+// FormatTo formats the record onto buf, without the copy Format makes if
+// the formatter is a BufferedFormatter.
+func FormatTo(formatter Formatter, buf *bytes.Buffer, tag string, record FluentRecord) error {
+	bufferedFormatter, ok := formatter.(BufferedFormatter)
+	if ok {
+		return bufferedFormatter.FormatTo(buf, tag, record)
+	}
+	b, err := formatter.Format(tag, record)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
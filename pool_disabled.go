@@ -0,0 +1,6 @@
+//go:build ik_nopool
+// +build ik_nopool
+
+package ik
+
+const poolingEnabled = false
@@ -0,0 +1,9 @@
+//go:build !ik_nopool
+// +build !ik_nopool
+
+package ik
+
+// poolingEnabled is false in the builds tagged ik_nopool, which allocate
+// afresh everything the pools would hand out; a record that comes out
+// right only in those builds points at a buffer used after its release.
+const poolingEnabled = true
@@ -0,0 +1,53 @@
+package ik
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAcquireBuffer(t *testing.T) {
+	buf := AcquireBuffer()
+	buf.WriteString("test")
+	ReleaseBuffer(buf)
+	for i := 0; i < 10; i++ {
+		buf = AcquireBuffer()
+		if buf.Len() != 0 {
+			t.Fail()
+		}
+		ReleaseBuffer(buf)
+	}
+}
+
+func TestAcquireRecordData(t *testing.T) {
+	data := AcquireRecordData()
+	data["a"] = 1
+	ReleaseRecordData(data)
+	for i := 0; i < 10; i++ {
+		data = AcquireRecordData()
+		if len(data) != 0 {
+			t.Fail()
+		}
+		ReleaseRecordData(data)
+	}
+}
+
+type testFormatter struct{}
+
+func (testFormatter) Format(tag string, record FluentRecord) ([]byte, error) {
+	return []byte(tag + "\n"), nil
+}
+
+func TestFormatTo(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := FormatTo(testFormatter{}, buf, "a", FluentRecord{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = FormatTo(testFormatter{}, buf, "b", FluentRecord{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if buf.String() != "a\nb\n" {
+		t.Fail()
+	}
+}
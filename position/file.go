@@ -0,0 +1,188 @@
+package position
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps the positions in a file of a line for each key, the key
+// and the position separated by a tab.  The position of the empty key is
+// the line alone, which is what the file of an input keeping a single
+// position, such as the cursor of in_journald, looks like.  The file is
+// replaced as a whole on Sync, so that a crash leaves either the old
+// positions or the new ones.  The inputs opening the same file share the
+// store, which is closed once all of them have closed it.
+type FileStore struct {
+	path      string
+	refcount  int
+	keys      []string
+	positions map[string]string
+	dirty     bool
+	mtx       sync.Mutex
+	syncMtx   sync.Mutex
+}
+
+func parseFile(data []byte) ([]string, map[string]string) {
+	keys := make([]string, 0)
+	positions := make(map[string]string)
+	for _, line := range bytes.Split(data, []byte{'\n'}) {
+		if len(line) == 0 {
+			continue
+		}
+		key, position := "", string(line)
+		i := bytes.IndexByte(line, '\t')
+		if i >= 0 {
+			key, position = string(line[0:i]), string(line[i+1:])
+		}
+		if _, ok := positions[key]; !ok {
+			keys = append(keys, key)
+		}
+		positions[key] = position
+	}
+	return keys, positions
+}
+
+var fileStores = make(map[string]*FileStore)
+var fileStoresMtx sync.Mutex
+
+// OpenFileStore returns the store of the file at path, reading the
+// positions from the file if it is not open yet and there is one.
+func OpenFileStore(path string) (*FileStore, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	fileStoresMtx.Lock()
+	defer fileStoresMtx.Unlock()
+	store, ok := fileStores[path]
+	if ok {
+		store.refcount += 1
+		return store, nil
+	}
+	store = &FileStore{
+		path:      path,
+		refcount:  1,
+		keys:      make([]string, 0),
+		positions: make(map[string]string),
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+	} else {
+		store.keys, store.positions = parseFile(data)
+	}
+	fileStores[path] = store
+	return store, nil
+}
+
+func (store *FileStore) Get(key string) (string, bool, error) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	position, ok := store.positions[key]
+	return position, ok, nil
+}
+
+func (store *FileStore) Set(key string, position string) error {
+	err := checkEntry(key, position)
+	if err != nil {
+		return err
+	}
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	position_, ok := store.positions[key]
+	if !ok {
+		store.keys = append(store.keys, key)
+	} else if position_ == position {
+		return nil
+	}
+	store.positions[key] = position
+	store.dirty = true
+	return nil
+}
+
+// marshal returns the contents of the file if anything was set since the
+// last time, the keys in the order they were first set.
+func (store *FileStore) marshal() []byte {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	if !store.dirty {
+		return nil
+	}
+	store.dirty = false
+	b := &bytes.Buffer{}
+	for _, key := range store.keys {
+		if key != "" {
+			b.WriteString(key)
+			b.WriteByte('\t')
+		}
+		b.WriteString(store.positions[key])
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// Sync writes the positions to a file next to the one at the path, which
+// it then replaces.
+func (store *FileStore) Sync() error {
+	store.syncMtx.Lock()
+	defer store.syncMtx.Unlock()
+	data := store.marshal()
+	if data == nil {
+		return nil
+	}
+	err := store.write(data)
+	if err != nil {
+		// to be written again by the next Sync
+		store.mtx.Lock()
+		store.dirty = true
+		store.mtx.Unlock()
+	}
+	return err
+}
+
+func (store *FileStore) write(data []byte) error {
+	tmp := store.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	err_ := file.Close()
+	if err == nil {
+		err = err_
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, store.path)
+	if err != nil {
+		return err
+	}
+	// the rename itself is made durable by syncing the directory, which
+	// some platforms do not allow
+	dir, err := os.Open(filepath.Dir(store.path))
+	if err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+func (store *FileStore) Close() error {
+	fileStoresMtx.Lock()
+	store.refcount -= 1
+	if store.refcount == 0 {
+		delete(fileStores, store.path)
+	}
+	fileStoresMtx.Unlock()
+	return store.Sync()
+}
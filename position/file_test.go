@@ -0,0 +1,71 @@
+package position
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ik-position")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	posFile := path.Join(dir, "test.pos")
+	err = ioutil.WriteFile(posFile, []byte("/var/log/a\t00000000000000000010\t1\n"), 0644)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	store, err := OpenFileStore(posFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	position, ok, err := store.Get("/var/log/a")
+	if err != nil || !ok || position != "00000000000000000010\t1" {
+		t.Fatalf("%q %v", position, ok)
+	}
+	// the inputs opening the same file share the store
+	other, err := OpenFileStore(posFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if other != store {
+		t.Fail()
+	}
+	store.Set("", "cursor")
+	other.Set("/var/log/b", "20")
+	if store.Set("a\tb", "0") == nil || store.Set("a", "0\n") == nil {
+		t.Fail()
+	}
+	err = store.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	err = other.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	b, _ := ioutil.ReadFile(posFile)
+	if string(b) != "/var/log/a\t00000000000000000010\t1\ncursor\n/var/log/b\t20\n" {
+		t.Fatalf("%q", b)
+	}
+	if _, err := os.Stat(posFile + ".tmp"); !os.IsNotExist(err) {
+		t.Fail()
+	}
+
+	store, err = OpenFileStore(posFile)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer store.Close()
+	position, ok, _ = store.Get("")
+	if !ok || position != "cursor" {
+		t.Fatalf("%q %v", position, ok)
+	}
+	_, ok, _ = store.Get("/var/log/c")
+	if ok {
+		t.Fail()
+	}
+}
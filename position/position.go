@@ -0,0 +1,32 @@
+// Package position keeps the positions the inputs have read their sources
+// up to, so that they resume from there after a restart.
+package position
+
+import (
+	"errors"
+	"strings"
+)
+
+// Store maps the keys of the sources, such as the paths of the files
+// tailed, to the positions they have been read up to, which are opaque to
+// it.  Set takes effect at once for Get, and Sync makes the positions set
+// since the last one durable; Close syncs them before closing the store.
+// A store is safe for concurrent use.
+type Store interface {
+	Get(key string) (string, bool, error)
+	Set(key string, position string) error
+	Sync() error
+	Close() error
+}
+
+// checkEntry refuses what cannot be told apart from the other entries in
+// the file of a FileStore, for the stores to take the same positions.
+func checkEntry(key string, position string) error {
+	if strings.ContainsAny(key, "\t\n") {
+		return errors.New("a key may not contain a tab or a line feed: " + key)
+	}
+	if strings.Contains(position, "\n") {
+		return errors.New("a position may not contain a line feed: " + position)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package position
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"regexp"
+	"sync"
+)
+
+var tableNamePattern = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// SQLiteStore keeps the positions in a table of a SQLite database, which
+// several inputs may share, reached through database/sql with the driver
+// of the given name.  The driver has to be linked into the binary, as the
+// ik command does with github.com/mattn/go-sqlite3 unless built with the
+// ik_nosqlite tag or without cgo, pos_store sqlite being turned down
+// otherwise.
+// Sync writes the positions set since the last one in a single transaction.
+type SQLiteStore struct {
+	db        *sql.DB
+	table     string
+	positions map[string]string
+	dirty     map[string]bool
+	mtx       sync.Mutex
+	syncMtx   sync.Mutex
+}
+
+// OpenSQLiteStore opens the database and reads the positions from the
+// table, creating it if there is none.
+func OpenSQLiteStore(driver string, dsn string, table string) (*SQLiteStore, error) {
+	if !tableNamePattern.MatchString(table) {
+		return nil, errors.New("invalid table name: " + table)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	store := &SQLiteStore{
+		db:        db,
+		table:     table,
+		positions: make(map[string]string),
+		dirty:     make(map[string]bool),
+	}
+	err = store.load()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+func (store *SQLiteStore) load() error {
+	_, err := store.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (source TEXT PRIMARY KEY, position TEXT NOT NULL)", store.table))
+	if err != nil {
+		return err
+	}
+	rows, err := store.db.Query(fmt.Sprintf("SELECT source, position FROM %s", store.table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, position string
+		err = rows.Scan(&key, &position)
+		if err != nil {
+			return err
+		}
+		store.positions[key] = position
+	}
+	return rows.Err()
+}
+
+func (store *SQLiteStore) Get(key string) (string, bool, error) {
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	position, ok := store.positions[key]
+	return position, ok, nil
+}
+
+func (store *SQLiteStore) Set(key string, position string) error {
+	err := checkEntry(key, position)
+	if err != nil {
+		return err
+	}
+	store.mtx.Lock()
+	defer store.mtx.Unlock()
+	position_, ok := store.positions[key]
+	if ok && position_ == position {
+		return nil
+	}
+	store.positions[key] = position
+	store.dirty[key] = true
+	return nil
+}
+
+func (store *SQLiteStore) Sync() error {
+	store.syncMtx.Lock()
+	defer store.syncMtx.Unlock()
+	store.mtx.Lock()
+	positions := make(map[string]string, len(store.dirty))
+	for key := range store.dirty {
+		positions[key] = store.positions[key]
+	}
+	store.dirty = make(map[string]bool)
+	store.mtx.Unlock()
+	if len(positions) == 0 {
+		return nil
+	}
+	err := store.write(positions)
+	if err != nil {
+		// to be written again by the next Sync unless set again since
+		store.mtx.Lock()
+		for key := range positions {
+			store.dirty[key] = true
+		}
+		store.mtx.Unlock()
+	}
+	return err
+}
+
+func (store *SQLiteStore) write(positions map[string]string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("INSERT OR REPLACE INTO %s (source, position) VALUES (?, ?)", store.table)
+	for key, position := range positions {
+		_, err = tx.Exec(query, key, position)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (store *SQLiteStore) Close() error {
+	err := store.Sync()
+	err_ := store.db.Close()
+	if err == nil {
+		err = err_
+	}
+	return err
+}
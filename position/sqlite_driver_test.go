@@ -0,0 +1,51 @@
+//go:build cgo && !ik_nosqlite
+// +build cgo,!ik_nosqlite
+
+package position
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestSQLiteStore_SQLite3(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ik-position")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	dsn := path.Join(dir, "positions.db")
+	store, err := OpenSQLiteStore("sqlite3", dsn, "positions")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	store.Set("/var/log/a", "10")
+	store.Set("/var/log/b", "5")
+	err = store.Sync()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	store.Set("/var/log/a", "20")
+	err = store.Close()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// the positions committed are read back by the next run
+	store, err = OpenSQLiteStore("sqlite3", dsn, "positions")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer store.Close()
+	position, ok, _ := store.Get("/var/log/a")
+	if !ok || position != "20" {
+		t.Fatalf("%q %v", position, ok)
+	}
+	position, ok, _ = store.Get("/var/log/b")
+	if !ok || position != "5" {
+		t.Fatalf("%q %v", position, ok)
+	}
+}
@@ -0,0 +1,146 @@
+package position
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testSQLiteDriver keeps a table of positions, taking the statements
+// SQLiteStore makes for what they are.
+type testSQLiteDriver struct {
+	rows    map[string]string
+	commits int
+	mtx     sync.Mutex
+}
+
+type testSQLiteConn struct {
+	driver  *testSQLiteDriver
+	pending map[string]string
+}
+
+type testSQLiteStmt struct {
+	conn  *testSQLiteConn
+	query string
+}
+
+type testSQLiteRows struct {
+	keys []string
+	rows map[string]string
+}
+
+func (driver_ *testSQLiteDriver) Open(name string) (driver.Conn, error) {
+	return &testSQLiteConn{driver: driver_}, nil
+}
+
+func (conn *testSQLiteConn) Prepare(query string) (driver.Stmt, error) {
+	return &testSQLiteStmt{conn, query}, nil
+}
+
+func (conn *testSQLiteConn) Close() error {
+	return nil
+}
+
+func (conn *testSQLiteConn) Begin() (driver.Tx, error) {
+	conn.pending = make(map[string]string)
+	return conn, nil
+}
+
+func (conn *testSQLiteConn) Commit() error {
+	conn.driver.mtx.Lock()
+	defer conn.driver.mtx.Unlock()
+	for key, position := range conn.pending {
+		conn.driver.rows[key] = position
+	}
+	conn.driver.commits += 1
+	conn.pending = nil
+	return nil
+}
+
+func (conn *testSQLiteConn) Rollback() error {
+	conn.pending = nil
+	return nil
+}
+
+func (stmt *testSQLiteStmt) Close() error {
+	return nil
+}
+
+func (stmt *testSQLiteStmt) NumInput() int {
+	return -1
+}
+
+func (stmt *testSQLiteStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if strings.HasPrefix(stmt.query, "INSERT OR REPLACE INTO positions ") {
+		stmt.conn.pending[args[0].(string)] = args[1].(string)
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (stmt *testSQLiteStmt) Query(args []driver.Value) (driver.Rows, error) {
+	stmt.conn.driver.mtx.Lock()
+	defer stmt.conn.driver.mtx.Unlock()
+	rows := &testSQLiteRows{keys: make([]string, 0), rows: make(map[string]string)}
+	for key, position := range stmt.conn.driver.rows {
+		rows.keys = append(rows.keys, key)
+		rows.rows[key] = position
+	}
+	return rows, nil
+}
+
+func (rows *testSQLiteRows) Columns() []string {
+	return []string{"source", "position"}
+}
+
+func (rows *testSQLiteRows) Close() error {
+	return nil
+}
+
+func (rows *testSQLiteRows) Next(dest []driver.Value) error {
+	if len(rows.keys) == 0 {
+		return io.EOF
+	}
+	dest[0] = rows.keys[0]
+	dest[1] = rows.rows[rows.keys[0]]
+	rows.keys = rows.keys[1:]
+	return nil
+}
+
+var testSQLite = &testSQLiteDriver{rows: make(map[string]string)}
+
+func init() {
+	sql.Register("ik-test-sqlite", testSQLite)
+}
+
+func TestSQLiteStore(t *testing.T) {
+	testSQLite.rows["/var/log/a"] = "10"
+	store, err := OpenSQLiteStore("ik-test-sqlite", "", "positions")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	position, ok, _ := store.Get("/var/log/a")
+	if !ok || position != "10" {
+		t.Fatalf("%q %v", position, ok)
+	}
+	store.Set("/var/log/a", "10")
+	err = store.Sync()
+	if err != nil || testSQLite.commits != 0 {
+		t.Fatalf("%v %d", err, testSQLite.commits)
+	}
+	store.Set("/var/log/a", "20")
+	store.Set("/var/log/b", "5")
+	err = store.Close()
+	if err != nil || testSQLite.commits != 1 {
+		t.Fatalf("%v %d", err, testSQLite.commits)
+	}
+	if testSQLite.rows["/var/log/a"] != "20" || testSQLite.rows["/var/log/b"] != "5" {
+		t.Fatalf("%v", testSQLite.rows)
+	}
+	_, err = OpenSQLiteStore("ik-test-sqlite", "", "positions; DROP TABLE x")
+	if err == nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,416 @@
+package protobuf
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+)
+
+func toFloat64(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case float32:
+		return float64(value), true
+	case int:
+		return float64(value), true
+	case int8:
+		return float64(value), true
+	case int16:
+		return float64(value), true
+	case int32:
+		return float64(value), true
+	case int64:
+		return float64(value), true
+	case uint:
+		return float64(value), true
+	case uint8:
+		return float64(value), true
+	case uint16:
+		return float64(value), true
+	case uint32:
+		return float64(value), true
+	case uint64:
+		return float64(value), true
+	case json.Number:
+		f, err := value.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// toInt64 takes the integers as they are, so that the large ones are not
+// rounded, and the floats that are integral, as JSON makes of all numbers.
+func toInt64(value interface{}) (int64, bool) {
+	switch value := value.(type) {
+	case int:
+		return int64(value), true
+	case int8:
+		return int64(value), true
+	case int16:
+		return int64(value), true
+	case int32:
+		return int64(value), true
+	case int64:
+		return value, true
+	case uint:
+		return int64(value), true
+	case uint8:
+		return int64(value), true
+	case uint16:
+		return int64(value), true
+	case uint32:
+		return int64(value), true
+	case uint64:
+		return int64(value), value <= math.MaxInt64
+	case json.Number:
+		i, err := value.Int64()
+		return i, err == nil
+	}
+	f, ok := toFloat64(value)
+	if !ok || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+func toUint64(value interface{}) (uint64, bool) {
+	switch value := value.(type) {
+	case uint64:
+		return value, true
+	case json.Number:
+		u, err := strconv.ParseUint(string(value), 10, 64)
+		return u, err == nil
+	}
+	i, ok := toInt64(value)
+	return uint64(i), ok && i >= 0
+}
+
+func fieldError(field *Field, value interface{}) error {
+	return errors.New(fmt.Sprintf("%s: unexpected value %v (%T)", field.Name, value, value))
+}
+
+func wireTypeOf(type_ int) int {
+	switch type_ {
+	case TypeDouble, TypeFixed64, TypeSfixed64:
+		return wireFixed64
+	case TypeFloat, TypeFixed32, TypeSfixed32:
+		return wireFixed32
+	case TypeString, TypeBytes, TypeMessage:
+		return wireLengthDelimited
+	}
+	return wireVarint
+}
+
+// putScalar puts the value of a field without the tag.
+func putScalar(encoder *wireEncoder, field *Field, value interface{}) error {
+	switch field.Type {
+	case TypeDouble, TypeFloat:
+		f, ok := toFloat64(value)
+		if !ok {
+			return fieldError(field, value)
+		}
+		if field.Type == TypeDouble {
+			encoder.putFixed64(math.Float64bits(f))
+		} else {
+			encoder.putFixed32(math.Float32bits(float32(f)))
+		}
+	case TypeInt64, TypeInt32, TypeSint32, TypeSint64, TypeSfixed32, TypeSfixed64:
+		i, ok := toInt64(value)
+		if !ok || (field.Type != TypeInt64 && field.Type != TypeSint64 && field.Type != TypeSfixed64 && (i < math.MinInt32 || i > math.MaxInt32)) {
+			return fieldError(field, value)
+		}
+		switch field.Type {
+		case TypeSint32:
+			encoder.putVarint(zigzag32(int32(i)))
+		case TypeSint64:
+			encoder.putVarint(zigzag64(i))
+		case TypeSfixed32:
+			encoder.putFixed32(uint32(int32(i)))
+		case TypeSfixed64:
+			encoder.putFixed64(uint64(i))
+		default:
+			// negative int32s take ten bytes as well
+			encoder.putVarint(uint64(i))
+		}
+	case TypeUint64, TypeUint32, TypeFixed64, TypeFixed32:
+		u, ok := toUint64(value)
+		if !ok || ((field.Type == TypeUint32 || field.Type == TypeFixed32) && u > math.MaxUint32) {
+			return fieldError(field, value)
+		}
+		switch field.Type {
+		case TypeFixed64:
+			encoder.putFixed64(u)
+		case TypeFixed32:
+			encoder.putFixed32(uint32(u))
+		default:
+			encoder.putVarint(u)
+		}
+	case TypeBool:
+		b, ok := value.(bool)
+		if !ok {
+			return fieldError(field, value)
+		}
+		if b {
+			encoder.putVarint(1)
+		} else {
+			encoder.putVarint(0)
+		}
+	case TypeEnum:
+		number, ok := field.enum.numbers[fmt.Sprint(value)]
+		if !ok {
+			i, ok := toInt64(value)
+			if !ok || i < math.MinInt32 || i > math.MaxInt32 {
+				return errors.New(fmt.Sprintf("%s: %v is not a value of %s", field.Name, value, field.enum.Name))
+			}
+			number = int32(i)
+		}
+		encoder.putVarint(uint64(int64(number)))
+	case TypeString, TypeBytes:
+		switch value := value.(type) {
+		case string:
+			encoder.putBytes([]byte(value))
+		case []byte:
+			encoder.putBytes(value)
+		default:
+			return fieldError(field, value)
+		}
+	case TypeMessage:
+		data, ok := value.(map[string]interface{})
+		if !ok {
+			return fieldError(field, value)
+		}
+		b, err := field.message.Marshal(data)
+		if err != nil {
+			return errors.New(field.Name + "." + err.Error())
+		}
+		encoder.putBytes(b)
+	default:
+		return errors.New(fmt.Sprintf("%s: unsupported type %d", field.Name, field.Type))
+	}
+	return nil
+}
+
+func putField(encoder *wireEncoder, field *Field, value interface{}) error {
+	encoder.putTag(field.Number, wireTypeOf(field.Type))
+	return putScalar(encoder, field, value)
+}
+
+// putMap puts a map field as the entries sorted by key, so that the same
+// record is always marshalled the same.
+func putMap(encoder *wireEncoder, field *Field, data map[string]interface{}) error {
+	keyField := field.message.byNumber[1]
+	valueField := field.message.byNumber[2]
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var k interface{} = key
+		if keyField.Type != TypeString {
+			if keyField.Type == TypeBool {
+				b, err := strconv.ParseBool(key)
+				if err != nil {
+					return fieldError(field, key)
+				}
+				k = b
+			} else {
+				k = json.Number(key)
+			}
+		}
+		entry := &wireEncoder{}
+		err := putField(entry, keyField, k)
+		if err != nil {
+			return err
+		}
+		err = putField(entry, valueField, data[key])
+		if err != nil {
+			return err
+		}
+		encoder.putTag(field.Number, wireLengthDelimited)
+		encoder.putBytes(entry.buf)
+	}
+	return nil
+}
+
+// Marshal serializes data as the message, taking each field from the value
+// of its name.  The values that are not fields of the message are ignored,
+// and so are the nil ones.
+func (message *Message) Marshal(data map[string]interface{}) ([]byte, error) {
+	encoder := &wireEncoder{}
+	for _, field := range message.Fields {
+		value, ok := data[field.Name]
+		if !ok || value == nil {
+			continue
+		}
+		var err error
+		if field.Type == TypeMessage && field.message.mapEntry {
+			entries, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fieldError(field, value)
+			}
+			err = putMap(encoder, field, entries)
+		} else if field.Repeated {
+			values, ok := value.([]interface{})
+			if !ok {
+				return nil, fieldError(field, value)
+			}
+			if field.Packed {
+				packed := &wireEncoder{}
+				for _, v := range values {
+					err = putScalar(packed, field, v)
+					if err != nil {
+						return nil, err
+					}
+				}
+				encoder.putTag(field.Number, wireLengthDelimited)
+				encoder.putBytes(packed.buf)
+			} else {
+				for _, v := range values {
+					err = putField(encoder, field, v)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		} else {
+			err = putField(encoder, field, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return encoder.buf, nil
+}
+
+// scalar reads a value of field that is of wireType.
+func scalar(decoder *wireDecoder, field *Field, wireType int) (interface{}, error) {
+	if wireType != wireTypeOf(field.Type) {
+		return nil, errors.New(fmt.Sprintf("%s: unexpected wire type %d", field.Name, wireType))
+	}
+	switch wireType {
+	case wireFixed64:
+		v, err := decoder.fixed64()
+		if err != nil {
+			return nil, err
+		}
+		switch field.Type {
+		case TypeDouble:
+			return math.Float64frombits(v), nil
+		case TypeSfixed64:
+			return int64(v), nil
+		}
+		return v, nil
+	case wireFixed32:
+		v, err := decoder.fixed32()
+		if err != nil {
+			return nil, err
+		}
+		switch field.Type {
+		case TypeFloat:
+			return float64(math.Float32frombits(v)), nil
+		case TypeSfixed32:
+			return int64(int32(v)), nil
+		}
+		return uint64(v), nil
+	case wireLengthDelimited:
+		b, err := decoder.bytes()
+		if err != nil {
+			return nil, err
+		}
+		switch field.Type {
+		case TypeString:
+			return string(b), nil
+		case TypeMessage:
+			data, err := field.message.Unmarshal(b)
+			if err != nil {
+				return nil, errors.New(field.Name + "." + err.Error())
+			}
+			return data, nil
+		}
+		return append([]byte{}, b...), nil
+	}
+	v, err := decoder.varint()
+	if err != nil {
+		return nil, err
+	}
+	switch field.Type {
+	case TypeInt64:
+		return int64(v), nil
+	case TypeInt32:
+		return int64(int32(v)), nil
+	case TypeSint32, TypeSint64:
+		return unzigzag(v), nil
+	case TypeBool:
+		return v != 0, nil
+	case TypeEnum:
+		name, ok := field.enum.names[int32(v)]
+		if ok {
+			return name, nil
+		}
+		return int64(int32(v)), nil
+	}
+	return v, nil
+}
+
+// Unmarshal deserializes the message into a record of the fields it has.
+// Signed integers are int64s, unsigned ones uint64s, enums the names of
+// their values, and map fields maps keyed by the strings of their keys.
+// Unknown fields are skipped.
+func (message *Message) Unmarshal(b []byte) (map[string]interface{}, error) {
+	data := make(map[string]interface{})
+	err := walk(b, func(number int32, wireType int, decoder *wireDecoder) error {
+		field, ok := message.byNumber[number]
+		if !ok {
+			return decoder.skip(wireType)
+		}
+		if field.Repeated && wireType == wireLengthDelimited && packable(field.Type) {
+			packed, err := decoder.bytes()
+			if err != nil {
+				return err
+			}
+			values, _ := data[field.Name].([]interface{})
+			elements := &wireDecoder{buf: packed}
+			for !elements.done() {
+				value, err := scalar(elements, field, wireTypeOf(field.Type))
+				if err != nil {
+					return err
+				}
+				values = append(values, value)
+			}
+			data[field.Name] = values
+			return nil
+		}
+		value, err := scalar(decoder, field, wireType)
+		if err != nil {
+			return err
+		}
+		if field.Type == TypeMessage && field.message.mapEntry {
+			entries, _ := data[field.Name].(map[string]interface{})
+			if entries == nil {
+				entries = make(map[string]interface{})
+				data[field.Name] = entries
+			}
+			entry := value.(map[string]interface{})
+			key := entry[field.message.byNumber[1].Name]
+			if key == nil {
+				key = ""
+			}
+			entries[fmt.Sprint(key)] = entry[field.message.byNumber[2].Name]
+		} else if field.Repeated {
+			values, _ := data[field.Name].([]interface{})
+			data[field.Name] = append(values, value)
+		} else {
+			data[field.Name] = value
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,409 @@
+package protobuf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+)
+
+// The types of the fields, as numbered in descriptor.proto.
+const (
+	TypeDouble   = 1
+	TypeFloat    = 2
+	TypeInt64    = 3
+	TypeUint64   = 4
+	TypeInt32    = 5
+	TypeFixed64  = 6
+	TypeFixed32  = 7
+	TypeBool     = 8
+	TypeString   = 9
+	TypeGroup    = 10
+	TypeMessage  = 11
+	TypeBytes    = 12
+	TypeUint32   = 13
+	TypeEnum     = 14
+	TypeSfixed32 = 15
+	TypeSfixed64 = 16
+	TypeSint32   = 17
+	TypeSint64   = 18
+)
+
+const labelRepeated = 3
+
+type Field struct {
+	Name     string
+	Number   int32
+	Type     int
+	Repeated bool
+	Packed   bool
+	typeName string
+	message  *Message
+	enum     *Enum
+}
+
+// Message is a message type of a descriptor set.  A map field is a
+// repeated field of a message type that is a map entry, whose key and value
+// are its fields 1 and 2.
+type Message struct {
+	Name     string
+	Fields   []*Field // by number
+	byName   map[string]*Field
+	byNumber map[int32]*Field
+	mapEntry bool
+}
+
+type Enum struct {
+	Name    string
+	numbers map[string]int32
+	names   map[int32]string
+}
+
+// DescriptorSet holds the message and enum types of a FileDescriptorSet
+// by their full names.
+type DescriptorSet struct {
+	messages map[string]*Message
+	enums    map[string]*Enum
+}
+
+func (set *DescriptorSet) Message(name string) *Message {
+	return set.messages[strings.TrimPrefix(name, ".")]
+}
+
+func (message *Message) Field(name string) *Field {
+	return message.byName[name]
+}
+
+type fieldVisitor func(number int32, wireType int, decoder *wireDecoder) error
+
+// walk calls visitor with each of the fields of a serialized message, which
+// has to consume the value of the ones it does not skip.
+func walk(b []byte, visitor fieldVisitor) error {
+	decoder := &wireDecoder{buf: b}
+	for !decoder.done() {
+		number, wireType, err := decoder.tag()
+		if err != nil {
+			return err
+		}
+		err = visitor(number, wireType, decoder)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func stringField(wireType int, decoder *wireDecoder) (string, error) {
+	if wireType != wireLengthDelimited {
+		return "", errors.New("unexpected wire type in the descriptor")
+	}
+	b, err := decoder.bytes()
+	return string(b), err
+}
+
+func messageField(wireType int, decoder *wireDecoder) ([]byte, error) {
+	if wireType != wireLengthDelimited {
+		return nil, errors.New("unexpected wire type in the descriptor")
+	}
+	return decoder.bytes()
+}
+
+func varintField(wireType int, decoder *wireDecoder) (uint64, error) {
+	if wireType != wireVarint {
+		return 0, errors.New("unexpected wire type in the descriptor")
+	}
+	return decoder.varint()
+}
+
+type descriptorParser struct {
+	set    *DescriptorSet
+	fields []*Field
+}
+
+func (parser *descriptorParser) parseEnum(scope string, b []byte) error {
+	enum := &Enum{numbers: make(map[string]int32), names: make(map[int32]string)}
+	err := walk(b, func(number int32, wireType int, decoder *wireDecoder) error {
+		switch number {
+		case 1:
+			name, err := stringField(wireType, decoder)
+			enum.Name = scope + name
+			return err
+		case 2:
+			value, err := messageField(wireType, decoder)
+			if err != nil {
+				return err
+			}
+			var name string
+			var n int32
+			err = walk(value, func(number int32, wireType int, decoder *wireDecoder) error {
+				switch number {
+				case 1:
+					var err error
+					name, err = stringField(wireType, decoder)
+					return err
+				case 2:
+					v, err := varintField(wireType, decoder)
+					n = int32(v)
+					return err
+				}
+				return decoder.skip(wireType)
+			})
+			if err != nil {
+				return err
+			}
+			enum.numbers[name] = n
+			if _, ok := enum.names[n]; !ok {
+				enum.names[n] = name
+			}
+			return nil
+		}
+		return decoder.skip(wireType)
+	})
+	if err != nil {
+		return err
+	}
+	parser.set.enums[enum.Name] = enum
+	return nil
+}
+
+func (parser *descriptorParser) parseField(b []byte, proto3 bool) (*Field, error) {
+	field := &Field{}
+	packedOption := -1
+	err := walk(b, func(number int32, wireType int, decoder *wireDecoder) error {
+		var err error
+		switch number {
+		case 1:
+			field.Name, err = stringField(wireType, decoder)
+		case 3:
+			var v uint64
+			v, err = varintField(wireType, decoder)
+			field.Number = int32(v)
+		case 4:
+			var v uint64
+			v, err = varintField(wireType, decoder)
+			field.Repeated = v == labelRepeated
+		case 5:
+			var v uint64
+			v, err = varintField(wireType, decoder)
+			field.Type = int(v)
+		case 6:
+			field.typeName, err = stringField(wireType, decoder)
+		case 8:
+			var options []byte
+			options, err = messageField(wireType, decoder)
+			if err != nil {
+				return err
+			}
+			err = walk(options, func(number int32, wireType int, decoder *wireDecoder) error {
+				if number == 2 {
+					v, err := varintField(wireType, decoder)
+					packedOption = int(v)
+					return err
+				}
+				return decoder.skip(wireType)
+			})
+		default:
+			err = decoder.skip(wireType)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if field.Type == TypeGroup {
+		return nil, errors.New(fmt.Sprintf("%s: groups are not supported", field.Name))
+	}
+	if field.Repeated && packable(field.Type) {
+		// the scalars of proto3 are packed unless told otherwise
+		field.Packed = packedOption == 1 || (proto3 && packedOption != 0)
+	}
+	parser.fields = append(parser.fields, field)
+	return field, nil
+}
+
+func (parser *descriptorParser) parseMessage(scope string, b []byte, proto3 bool) error {
+	message := &Message{byName: make(map[string]*Field), byNumber: make(map[int32]*Field)}
+	nested := make([][]byte, 0)
+	enums := make([][]byte, 0)
+	err := walk(b, func(number int32, wireType int, decoder *wireDecoder) error {
+		switch number {
+		case 1:
+			name, err := stringField(wireType, decoder)
+			message.Name = scope + name
+			return err
+		case 2:
+			b, err := messageField(wireType, decoder)
+			if err != nil {
+				return err
+			}
+			field, err := parser.parseField(b, proto3)
+			if err != nil {
+				return err
+			}
+			message.Fields = append(message.Fields, field)
+			return nil
+		case 3:
+			b, err := messageField(wireType, decoder)
+			nested = append(nested, b)
+			return err
+		case 4:
+			b, err := messageField(wireType, decoder)
+			enums = append(enums, b)
+			return err
+		case 7:
+			options, err := messageField(wireType, decoder)
+			if err != nil {
+				return err
+			}
+			return walk(options, func(number int32, wireType int, decoder *wireDecoder) error {
+				if number == 7 {
+					v, err := varintField(wireType, decoder)
+					message.mapEntry = v != 0
+					return err
+				}
+				return decoder.skip(wireType)
+			})
+		}
+		return decoder.skip(wireType)
+	})
+	if err != nil {
+		return err
+	}
+	// the nested types are named after the message, which may come last
+	for _, b := range nested {
+		err = parser.parseMessage(message.Name+".", b, proto3)
+		if err != nil {
+			return err
+		}
+	}
+	for _, b := range enums {
+		err = parser.parseEnum(message.Name+".", b)
+		if err != nil {
+			return err
+		}
+	}
+	sort.Slice(message.Fields, func(i, j int) bool { return message.Fields[i].Number < message.Fields[j].Number })
+	for _, field := range message.Fields {
+		message.byName[field.Name] = field
+		message.byNumber[field.Number] = field
+	}
+	parser.set.messages[message.Name] = message
+	return nil
+}
+
+func (parser *descriptorParser) parseFile(b []byte) error {
+	var package_ string
+	proto3 := false
+	messages := make([][]byte, 0)
+	enums := make([][]byte, 0)
+	err := walk(b, func(number int32, wireType int, decoder *wireDecoder) error {
+		var err error
+		switch number {
+		case 2:
+			package_, err = stringField(wireType, decoder)
+		case 4:
+			var b []byte
+			b, err = messageField(wireType, decoder)
+			messages = append(messages, b)
+		case 5:
+			var b []byte
+			b, err = messageField(wireType, decoder)
+			enums = append(enums, b)
+		case 12:
+			var syntax string
+			syntax, err = stringField(wireType, decoder)
+			proto3 = syntax == "proto3"
+		default:
+			err = decoder.skip(wireType)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	scope := ""
+	if package_ != "" {
+		scope = package_ + "."
+	}
+	for _, b := range messages {
+		err = parser.parseMessage(scope, b, proto3)
+		if err != nil {
+			return err
+		}
+	}
+	for _, b := range enums {
+		err = parser.parseEnum(scope, b)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func packable(type_ int) bool {
+	switch type_ {
+	case TypeString, TypeBytes, TypeMessage, TypeGroup:
+		return false
+	}
+	return true
+}
+
+// ParseDescriptorSet reads a serialized FileDescriptorSet.  The types the
+// fields refer to have to be in the set, so it should be compiled with
+// --include_imports.
+func ParseDescriptorSet(b []byte) (*DescriptorSet, error) {
+	parser := &descriptorParser{set: &DescriptorSet{
+		messages: make(map[string]*Message),
+		enums:    make(map[string]*Enum),
+	}}
+	err := walk(b, func(number int32, wireType int, decoder *wireDecoder) error {
+		if number != 1 {
+			return decoder.skip(wireType)
+		}
+		file, err := messageField(wireType, decoder)
+		if err != nil {
+			return err
+		}
+		return parser.parseFile(file)
+	})
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Failed to parse the descriptor set: %s", err.Error()))
+	}
+	for _, field := range parser.fields {
+		switch field.Type {
+		case TypeMessage:
+			field.message = parser.set.messages[strings.TrimPrefix(field.typeName, ".")]
+			if field.message == nil {
+				return nil, errors.New(fmt.Sprintf("%s: unknown message type %s", field.Name, field.typeName))
+			}
+			if field.message.mapEntry && (field.message.byNumber[1] == nil || field.message.byNumber[2] == nil) {
+				return nil, errors.New(fmt.Sprintf("%s: invalid map entry %s", field.Name, field.typeName))
+			}
+		case TypeEnum:
+			field.enum = parser.set.enums[strings.TrimPrefix(field.typeName, ".")]
+			if field.enum == nil {
+				return nil, errors.New(fmt.Sprintf("%s: unknown enum type %s", field.Name, field.typeName))
+			}
+		}
+	}
+	return parser.set, nil
+}
+
+// LoadMessage looks up the message type of name in the descriptor set in
+// the file at path.
+func LoadMessage(path string, name string) (*Message, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	set, err := ParseDescriptorSet(b)
+	if err != nil {
+		return nil, err
+	}
+	message := set.Message(name)
+	if message == nil {
+		return nil, errors.New(fmt.Sprintf("no message type %s in %s", name, path))
+	}
+	return message, nil
+}
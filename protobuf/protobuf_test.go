@@ -0,0 +1,213 @@
+package protobuf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func testField(name string, number int32, label int, type_ int, typeName string) []byte {
+	field := &wireEncoder{}
+	field.putTag(1, wireLengthDelimited)
+	field.putBytes([]byte(name))
+	field.putTag(3, wireVarint)
+	field.putVarint(uint64(number))
+	field.putTag(4, wireVarint)
+	field.putVarint(uint64(label))
+	field.putTag(5, wireVarint)
+	field.putVarint(uint64(type_))
+	if typeName != "" {
+		field.putTag(6, wireLengthDelimited)
+		field.putBytes([]byte(typeName))
+	}
+	return field.buf
+}
+
+func testMessage(name string, mapEntry bool, fields [][]byte, nested [][]byte) []byte {
+	message := &wireEncoder{}
+	message.putTag(1, wireLengthDelimited)
+	message.putBytes([]byte(name))
+	for _, field := range fields {
+		message.putTag(2, wireLengthDelimited)
+		message.putBytes(field)
+	}
+	for _, b := range nested {
+		message.putTag(3, wireLengthDelimited)
+		message.putBytes(b)
+	}
+	if mapEntry {
+		options := &wireEncoder{}
+		options.putTag(7, wireVarint)
+		options.putVarint(1)
+		message.putTag(7, wireLengthDelimited)
+		message.putBytes(options.buf)
+	}
+	return message.buf
+}
+
+// testDescriptorSet is what protoc makes of
+//
+//	syntax = "proto3";
+//	package ik.test;
+//	enum Level { INFO = 0; ERROR = 1; }
+//	message Event {
+//	  message Inner { double value = 1; sint64 delta = 2; }
+//	  string message = 1;
+//	  int64 count = 2;
+//	  repeated int32 codes = 3;
+//	  Level level = 4;
+//	  map<string, string> labels = 5;
+//	  Inner inner = 6;
+//	  bytes payload = 7;
+//	  bool ok = 8;
+//	  repeated string names = 9;
+//	  map<int32, Inner> inners = 10;
+//	}
+func testDescriptorSet(t *testing.T) *DescriptorSet {
+	enumValue := func(name string, number int) []byte {
+		value := &wireEncoder{}
+		value.putTag(1, wireLengthDelimited)
+		value.putBytes([]byte(name))
+		value.putTag(2, wireVarint)
+		value.putVarint(uint64(number))
+		return value.buf
+	}
+	enum := &wireEncoder{}
+	enum.putTag(1, wireLengthDelimited)
+	enum.putBytes([]byte("Level"))
+	enum.putTag(2, wireLengthDelimited)
+	enum.putBytes(enumValue("INFO", 0))
+	enum.putTag(2, wireLengthDelimited)
+	enum.putBytes(enumValue("ERROR", 1))
+	event := testMessage("Event", false, [][]byte{
+		testField("message", 1, 1, TypeString, ""),
+		testField("count", 2, 1, TypeInt64, ""),
+		testField("codes", 3, 3, TypeInt32, ""),
+		testField("level", 4, 1, TypeEnum, ".ik.test.Level"),
+		testField("labels", 5, 3, TypeMessage, ".ik.test.Event.LabelsEntry"),
+		testField("inner", 6, 1, TypeMessage, ".ik.test.Event.Inner"),
+		testField("payload", 7, 1, TypeBytes, ""),
+		testField("ok", 8, 1, TypeBool, ""),
+		testField("names", 9, 3, TypeString, ""),
+		testField("inners", 10, 3, TypeMessage, ".ik.test.Event.InnersEntry"),
+	}, [][]byte{
+		testMessage("Inner", false, [][]byte{
+			testField("value", 1, 1, TypeDouble, ""),
+			testField("delta", 2, 1, TypeSint64, ""),
+		}, nil),
+		testMessage("LabelsEntry", true, [][]byte{
+			testField("key", 1, 1, TypeString, ""),
+			testField("value", 2, 1, TypeString, ""),
+		}, nil),
+		testMessage("InnersEntry", true, [][]byte{
+			testField("key", 1, 1, TypeInt32, ""),
+			testField("value", 2, 1, TypeMessage, ".ik.test.Event.Inner"),
+		}, nil),
+	})
+	file := &wireEncoder{}
+	file.putTag(1, wireLengthDelimited)
+	file.putBytes([]byte("test.proto"))
+	file.putTag(2, wireLengthDelimited)
+	file.putBytes([]byte("ik.test"))
+	file.putTag(4, wireLengthDelimited)
+	file.putBytes(event)
+	file.putTag(5, wireLengthDelimited)
+	file.putBytes(enum.buf)
+	file.putTag(12, wireLengthDelimited)
+	file.putBytes([]byte("proto3"))
+	set := &wireEncoder{}
+	set.putTag(1, wireLengthDelimited)
+	set.putBytes(file.buf)
+	descriptorSet, err := ParseDescriptorSet(set.buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	return descriptorSet
+}
+
+func TestMessage_Marshal(t *testing.T) {
+	message := testDescriptorSet(t).Message(".ik.test.Event")
+	if message == nil || message.Field("codes") == nil || !message.Field("codes").Packed || message.Field("names").Packed {
+		t.Fatal("unexpected descriptor")
+	}
+	b, err := message.Marshal(map[string]interface{}{"message": "hi", "count": 150.0, "codes": []interface{}{3, 270}, "other": 1})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	expected := []byte{0x0a, 0x02, 'h', 'i', 0x10, 0x96, 0x01, 0x1a, 0x03, 0x03, 0x8e, 0x02}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("%x", b)
+	}
+	for _, data := range []map[string]interface{}{
+		{"count": "1"},
+		{"count": 1.5},
+		{"codes": []interface{}{1 << 40}},
+		{"level": "DEBUG"},
+		{"ok": 1},
+		{"inner": map[string]interface{}{"value": "x"}},
+		{"inners": map[string]interface{}{"x": map[string]interface{}{}}},
+	} {
+		_, err := message.Marshal(data)
+		if err == nil {
+			t.Logf("%v accepted", data)
+			t.Fail()
+		}
+	}
+}
+
+func TestMessage_roundTrip(t *testing.T) {
+	message := testDescriptorSet(t).Message("ik.test.Event")
+	data := map[string]interface{}{
+		"message": "hello",
+		"count":   int64(-5),
+		"codes":   []interface{}{int64(1), int64(-2)},
+		"level":   "ERROR",
+		"labels":  map[string]interface{}{"b": "2", "a": "1"},
+		"inner":   map[string]interface{}{"value": 0.5, "delta": int64(-3)},
+		"payload": []byte{0, 1},
+		"ok":      true,
+		"names":   []interface{}{"x", "y"},
+		"inners":  map[string]interface{}{"7": map[string]interface{}{"delta": int64(1)}},
+	}
+	b, err := message.Marshal(data)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	decoded, err := message.Unmarshal(b)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !reflect.DeepEqual(decoded, data) {
+		t.Fatalf("%v", decoded)
+	}
+	// unknown fields are skipped and an enum value not known is kept as is
+	extra := &wireEncoder{buf: append([]byte{}, b...)}
+	extra.putTag(100, wireLengthDelimited)
+	extra.putBytes([]byte("unknown"))
+	extra.putTag(4, wireVarint)
+	extra.putVarint(5)
+	decoded, err = message.Unmarshal(extra.buf)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if decoded["level"] != int64(5) || len(decoded) != len(data) {
+		t.Fatalf("%v", decoded)
+	}
+	_, err = message.Unmarshal(b[:len(b)-1])
+	if err == nil {
+		t.Fatal("a truncated message was accepted")
+	}
+}
+
+func TestParseDescriptorSet_unknownType(t *testing.T) {
+	file := &wireEncoder{}
+	file.putTag(4, wireLengthDelimited)
+	file.putBytes(testMessage("A", false, [][]byte{testField("b", 1, 1, TypeMessage, ".B")}, nil))
+	set := &wireEncoder{}
+	set.putTag(1, wireLengthDelimited)
+	set.putBytes(file.buf)
+	_, err := ParseDescriptorSet(set.buf)
+	if err == nil {
+		t.Fatal("an unknown type was accepted")
+	}
+}
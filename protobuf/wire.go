@@ -0,0 +1,165 @@
+// Package protobuf encodes records into Protocol Buffers messages and
+// decodes them back, using the message types of a descriptor set compiled
+// by protoc --descriptor_set_out, without any generated code.
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+const (
+	wireVarint          = 0
+	wireFixed64         = 1
+	wireLengthDelimited = 2
+	wireStartGroup      = 3
+	wireEndGroup        = 4
+	wireFixed32         = 5
+)
+
+var errTruncated = errors.New("truncated message")
+
+type wireEncoder struct {
+	buf []byte
+}
+
+func (encoder *wireEncoder) putVarint(v uint64) {
+	for v >= 0x80 {
+		encoder.buf = append(encoder.buf, byte(v)|0x80)
+		v >>= 7
+	}
+	encoder.buf = append(encoder.buf, byte(v))
+}
+
+func (encoder *wireEncoder) putTag(number int32, wireType int) {
+	encoder.putVarint(uint64(number)<<3 | uint64(wireType))
+}
+
+func (encoder *wireEncoder) putFixed32(v uint32) {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], v)
+	encoder.buf = append(encoder.buf, b[:]...)
+}
+
+func (encoder *wireEncoder) putFixed64(v uint64) {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], v)
+	encoder.buf = append(encoder.buf, b[:]...)
+}
+
+func (encoder *wireEncoder) putBytes(b []byte) {
+	encoder.putVarint(uint64(len(b)))
+	encoder.buf = append(encoder.buf, b...)
+}
+
+type wireDecoder struct {
+	buf    []byte
+	offset int
+}
+
+func (decoder *wireDecoder) done() bool {
+	return decoder.offset >= len(decoder.buf)
+}
+
+func (decoder *wireDecoder) varint() (uint64, error) {
+	var v uint64
+	for shift := uint(0); shift < 64; shift += 7 {
+		if decoder.offset >= len(decoder.buf) {
+			return 0, errTruncated
+		}
+		b := decoder.buf[decoder.offset]
+		decoder.offset++
+		v |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return v, nil
+		}
+	}
+	return 0, errors.New("varint overflows")
+}
+
+func (decoder *wireDecoder) tag() (int32, int, error) {
+	v, err := decoder.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	if v>>3 == 0 || v>>3 > math.MaxInt32 {
+		return 0, 0, errors.New("invalid field number")
+	}
+	return int32(v >> 3), int(v & 7), nil
+}
+
+func (decoder *wireDecoder) fixed32() (uint32, error) {
+	if len(decoder.buf)-decoder.offset < 4 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint32(decoder.buf[decoder.offset:])
+	decoder.offset += 4
+	return v, nil
+}
+
+func (decoder *wireDecoder) fixed64() (uint64, error) {
+	if len(decoder.buf)-decoder.offset < 8 {
+		return 0, errTruncated
+	}
+	v := binary.LittleEndian.Uint64(decoder.buf[decoder.offset:])
+	decoder.offset += 8
+	return v, nil
+}
+
+func (decoder *wireDecoder) bytes() ([]byte, error) {
+	n, err := decoder.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(decoder.buf)-decoder.offset) {
+		return nil, errTruncated
+	}
+	b := decoder.buf[decoder.offset : decoder.offset+int(n)]
+	decoder.offset += int(n)
+	return b, nil
+}
+
+// skip skips the value of a field of wireType that is not known.
+func (decoder *wireDecoder) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case wireVarint:
+		_, err = decoder.varint()
+	case wireFixed64:
+		_, err = decoder.fixed64()
+	case wireLengthDelimited:
+		_, err = decoder.bytes()
+	case wireFixed32:
+		_, err = decoder.fixed32()
+	case wireStartGroup:
+		for {
+			_, type_, err := decoder.tag()
+			if err != nil {
+				return err
+			}
+			if type_ == wireEndGroup {
+				return nil
+			}
+			err = decoder.skip(type_)
+			if err != nil {
+				return err
+			}
+		}
+	default:
+		err = errors.New("unexpected wire type")
+	}
+	return err
+}
+
+func zigzag32(v int32) uint64 {
+	return uint64(uint32((v << 1) ^ (v >> 31)))
+}
+
+func zigzag64(v int64) uint64 {
+	return uint64((v << 1) ^ (v >> 63))
+}
+
+func unzigzag(v uint64) int64 {
+	return int64(v>>1) ^ -int64(v&1)
+}
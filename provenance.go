@@ -0,0 +1,120 @@
+package ik
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Provenance stamps every record emitted by an input with where and when it
+// was collected, under Key.  It is enabled by a <provenance> element at the
+// top level of the configuration.
+type Provenance struct {
+	Key             string
+	CollectorId     string
+	PipelineVersion string
+	clock           Clock
+}
+
+type provenancePort struct {
+	port       Port
+	provenance *Provenance
+	inputId    string
+}
+
+// portEngine hands an input a default port of its own.
+type portEngine struct {
+	Engine
+	port Port
+}
+
+func (port *provenancePort) stamp(recordSets []FluentRecordSet) {
+	provenance := port.provenance
+	// every record of a call shares the same value; nothing downstream
+	// modifies records in place
+	value := map[string]interface{}{
+		"collector_id":     provenance.CollectorId,
+		"pipeline_version": provenance.PipelineVersion,
+		"input_id":         port.inputId,
+		"received_at":      provenance.clock.Now().UTC().Format(time.RFC3339Nano),
+	}
+	for i, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			if record.Data != nil {
+				record.Data[provenance.Key] = value
+			}
+		}
+		recordSets[i].Packed = nil
+	}
+}
+
+func (port *provenancePort) Emit(recordSets []FluentRecordSet) error {
+	port.stamp(recordSets)
+	return port.port.Emit(recordSets)
+}
+
+func (port *provenancePort) EmitContext(ctx context.Context, recordSets []FluentRecordSet) error {
+	port.stamp(recordSets)
+	return EmitContext(ctx, port.port, recordSets)
+}
+
+func (port *provenancePort) EmitDurably(recordSets []FluentRecordSet) error {
+	port.stamp(recordSets)
+	return EmitDurably(port.port, recordSets)
+}
+
+func (port *provenancePort) EmitWithResult(recordSets []FluentRecordSet) []error {
+	port.stamp(recordSets)
+	return EmitWithResult(port.port, recordSets)
+}
+
+func (port *provenancePort) ForSource(address string) Port {
+	return &provenancePort{PortForSource(port.port, address), port.provenance, port.inputId}
+}
+
+func (engine *portEngine) DefaultPort() Port {
+	return engine.port
+}
+
+// wrapEngine returns the engine to create the input with the given id with.
+func (provenance *Provenance) wrapEngine(engine Engine, inputId string) Engine {
+	return &portEngine{
+		Engine: engine,
+		port:   &provenancePort{engine.DefaultPort(), provenance, inputId},
+	}
+}
+
+// ParseProvenance reads the <provenance> element of the configuration, and
+// returns nil if there is none.  The collector id defaults to the hostname
+// and the pipeline version to the digest of the configuration.  The time
+// the records are received at is told by the clock.
+func ParseProvenance(config *Config, clock Clock) (*Provenance, error) {
+	for _, v := range config.Root.Elems {
+		if v.Name != "provenance" {
+			continue
+		}
+		key, ok := v.Attrs["key"]
+		if !ok {
+			key = "_provenance"
+		}
+		collectorId, ok := v.Attrs["collector_id"]
+		if !ok {
+			var err error
+			collectorId, err = os.Hostname()
+			if err != nil {
+				return nil, err
+			}
+		}
+		pipelineVersion, ok := v.Attrs["pipeline_version"]
+		if !ok {
+			pipelineVersion = config.Digest()[0:12]
+		}
+		return &Provenance{
+			Key:             key,
+			CollectorId:     collectorId,
+			PipelineVersion: pipelineVersion,
+			clock:           clock,
+		}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,51 @@
+package ik
+
+import (
+	"testing"
+	"time"
+)
+
+type recordingPort struct {
+	recordSets []FluentRecordSet
+}
+
+func (port *recordingPort) Emit(recordSets []FluentRecordSet) error {
+	port.recordSets = append(port.recordSets, recordSets...)
+	return nil
+}
+
+func TestParseProvenance(t *testing.T) {
+	const data = "<source>\n" +
+		"@id forward_in\n" +
+		"type forward\n" +
+		"</source>\n" +
+		"<provenance>\n" +
+		"collector_id collector1\n" +
+		"</provenance>\n"
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	provenance, err := ParseProvenance(config, &tenantTestClock{now: time.Unix(1400000000, 0)})
+	if err != nil || provenance == nil {
+		t.FailNow()
+	}
+	if provenance.Key != "_provenance" || provenance.CollectorId != "collector1" || provenance.PipelineVersion != config.Digest()[0:12] {
+		t.Fail()
+	}
+	if pluginInstanceId(config.Root.Elems[0], 0) != "forward_in" {
+		t.Fail()
+	}
+
+	port := &recordingPort{}
+	provenancePort := &provenancePort{port, provenance, "forward#0"}
+	provenancePort.Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 0, Data: map[string]interface{}{"a": 1}}}}})
+	value, ok := port.recordSets[0].Records[0].Data["_provenance"].(map[string]interface{})
+	if !ok {
+		t.FailNow()
+	}
+	if value["collector_id"] != "collector1" || value["input_id"] != "forward#0" || value["received_at"] != "2014-05-13T16:53:20Z" {
+		t.Logf("%v", value)
+		t.Fail()
+	}
+}
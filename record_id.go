@@ -0,0 +1,207 @@
+package ik
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+)
+
+// RecordIdGenerator generates the id of a record.
+type RecordIdGenerator interface {
+	Generate(tag string, record TinyFluentRecord) (string, error)
+}
+
+type RecordIdGeneratorFactory func(config *ConfigElement, clock Clock) (RecordIdGenerator, error)
+
+var recordIdGeneratorFactories = map[string]RecordIdGeneratorFactory{
+	"ulid": newULIDGenerator,
+	"hash": newHashRecordIdGenerator,
+}
+
+// AddRecordIdGenerator makes a generator available as the type of the
+// <record_id> element.
+func AddRecordIdGenerator(type_ string, factory RecordIdGeneratorFactory) {
+	recordIdGeneratorFactories[type_] = factory
+}
+
+const crockfordBase32 = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ULIDGenerator generates ULIDs, which sort by the time they were
+// generated.
+type ULIDGenerator struct {
+	clock   Clock
+	entropy io.Reader
+}
+
+func (generator *ULIDGenerator) Generate(string, TinyFluentRecord) (string, error) {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[0:8], uint64(generator.clock.Now().UnixNano()/int64(time.Millisecond))<<16)
+	_, err := io.ReadFull(generator.entropy, id[6:16])
+	if err != nil {
+		return "", err
+	}
+	// 26 characters of 5 bits each, the first one having only 3
+	retval := make([]byte, 26)
+	acc, bits, j := uint(0), uint(2), 0
+	for _, b := range id {
+		acc = acc<<8 | uint(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			retval[j] = crockfordBase32[(acc>>bits)&31]
+			j += 1
+		}
+	}
+	return string(retval), nil
+}
+
+func newULIDGenerator(_ *ConfigElement, clock Clock) (RecordIdGenerator, error) {
+	return &ULIDGenerator{
+		clock:   clock,
+		entropy: rand.Reader,
+	}, nil
+}
+
+// HashRecordIdGenerator derives the id from the tag, the time and the
+// content of a record, so that a record emitted again, e.g. by a tail
+// reading a file over, gets the same id as the first time.
+type HashRecordIdGenerator struct{}
+
+func (HashRecordIdGenerator) Generate(tag string, record TinyFluentRecord) (string, error) {
+	// the keys of a map are marshalled in order
+	content, err := json.Marshal(record.Data)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	hash.Write([]byte(tag))
+	hash.Write([]byte{0})
+	hash.Write([]byte(strconv.FormatUint(record.Timestamp, 10)))
+	hash.Write([]byte{0})
+	hash.Write(content)
+	return hex.EncodeToString(hash.Sum(nil)[0:16]), nil
+}
+
+func newHashRecordIdGenerator(*ConfigElement, Clock) (RecordIdGenerator, error) {
+	return HashRecordIdGenerator{}, nil
+}
+
+// RecordIds stamps every record emitted by an input with an id under Key,
+// unless the record already has one, e.g. given by the forwarder it came
+// from.  Outputs writing to an idempotent API take the id from Key, like
+// out_elasticsearch with id_key or out_sqs with deduplication_id_key.  It
+// is enabled by a <record_id> element at the top level of the
+// configuration.
+type RecordIds struct {
+	Key       string
+	Generator RecordIdGenerator
+}
+
+type recordIdPort struct {
+	port      Port
+	recordIds *RecordIds
+}
+
+func (port *recordIdPort) stamp(recordSets []FluentRecordSet) error {
+	recordIds := port.recordIds
+	for i, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			if record.Data == nil {
+				continue
+			}
+			if _, ok := record.Data[recordIds.Key]; ok {
+				continue
+			}
+			id, err := recordIds.Generator.Generate(recordSet.Tag, record)
+			if err != nil {
+				return err
+			}
+			record.Data[recordIds.Key] = id
+			recordSets[i].Packed = nil
+		}
+	}
+	return nil
+}
+
+func (port *recordIdPort) Emit(recordSets []FluentRecordSet) error {
+	err := port.stamp(recordSets)
+	if err != nil {
+		return err
+	}
+	return port.port.Emit(recordSets)
+}
+
+func (port *recordIdPort) EmitContext(ctx context.Context, recordSets []FluentRecordSet) error {
+	err := port.stamp(recordSets)
+	if err != nil {
+		return err
+	}
+	return EmitContext(ctx, port.port, recordSets)
+}
+
+func (port *recordIdPort) EmitDurably(recordSets []FluentRecordSet) error {
+	err := port.stamp(recordSets)
+	if err != nil {
+		return err
+	}
+	return EmitDurably(port.port, recordSets)
+}
+
+func (port *recordIdPort) EmitWithResult(recordSets []FluentRecordSet) []error {
+	err := port.stamp(recordSets)
+	if err != nil {
+		return resultsOf(len(recordSets), err)
+	}
+	return EmitWithResult(port.port, recordSets)
+}
+
+func (port *recordIdPort) ForSource(address string) Port {
+	return &recordIdPort{PortForSource(port.port, address), port.recordIds}
+}
+
+// wrapEngine returns the engine to create an input with.  The ids are
+// generated before the provenance is stamped, so that it does not end up in
+// the hash.
+func (recordIds *RecordIds) wrapEngine(engine Engine) Engine {
+	return &portEngine{
+		Engine: engine,
+		port:   &recordIdPort{engine.DefaultPort(), recordIds},
+	}
+}
+
+// ParseRecordIds reads the <record_id> element of the configuration, and
+// returns nil if there is none.  The type defaults to ulid and the key to
+// _record_id, as Elasticsearch refuses documents having _id.  The
+// generators tell the time by the clock.
+func ParseRecordIds(config *Config, clock Clock) (*RecordIds, error) {
+	for _, v := range config.Root.Elems {
+		if v.Name != "record_id" {
+			continue
+		}
+		type_, ok := v.Attrs["type"]
+		if !ok {
+			type_ = "ulid"
+		}
+		factory, ok := recordIdGeneratorFactories[type_]
+		if !ok {
+			return nil, errors.New("unknown record id type: " + type_)
+		}
+		generator, err := factory(v, clock)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := v.Attrs["key"]
+		if !ok {
+			key = "_record_id"
+		}
+		return &RecordIds{Key: key, Generator: generator}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,56 @@
+package ik
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestULIDGenerator(t *testing.T) {
+	generator := &ULIDGenerator{
+		clock:   &tenantTestClock{now: time.Unix(1400000000, 0)},
+		entropy: bytes.NewReader(bytes.Repeat([]byte{0xff}, 10)),
+	}
+	id, err := generator.Generate("test", TinyFluentRecord{})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if id != "018QV81C00ZZZZZZZZZZZZZZZZ" {
+		t.Fatalf("unexpected id: %s", id)
+	}
+}
+
+func TestParseRecordIds(t *testing.T) {
+	const data = "<record_id>\n" +
+		"type hash\n" +
+		"</record_id>\n"
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	recordIds, err := ParseRecordIds(config, SystemClock)
+	if err != nil || recordIds == nil {
+		t.FailNow()
+	}
+	if recordIds.Key != "_record_id" {
+		t.Fail()
+	}
+
+	port := &recordingPort{}
+	recordIdPort := &recordIdPort{port, recordIds}
+	emit := func(data map[string]interface{}) string {
+		recordIdPort.Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 1400000000, Data: data}}}})
+		return port.recordSets[len(port.recordSets)-1].Records[0].Data["_record_id"].(string)
+	}
+	a := emit(map[string]interface{}{"a": 1, "b": "x"})
+	if a == "" || emit(map[string]interface{}{"b": "x", "a": 1}) != a {
+		t.Fail()
+	}
+	if emit(map[string]interface{}{"a": 2, "b": "x"}) == a {
+		t.Fail()
+	}
+	// an id given upstream is kept
+	if emit(map[string]interface{}{"_record_id": "upstream"}) != "upstream" {
+		t.Fail()
+	}
+}
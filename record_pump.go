@@ -9,7 +9,7 @@ type RecordPump struct {
 	ch        chan FluentRecord
 	control   chan bool
 	buffer    map[string]*FluentRecordSet
-	heartbeat *time.Ticker
+	heartbeat Ticker
 }
 
 func (pump *RecordPump) Port() Port {
@@ -47,7 +47,7 @@ func (pump *RecordPump) Run() error {
 				Data:      record.Data,
 			})
 			break
-		case <-pump.heartbeat.C:
+		case <-pump.heartbeat.C():
 			err := pump.flush()
 			if err != nil {
 				return err
@@ -69,12 +69,12 @@ func (pump *RecordPump) Shutdown() error {
 	return nil
 }
 
-func NewRecordPump(port Port, backlog int) *RecordPump {
+func NewRecordPump(port Port, backlog int, clock Clock) *RecordPump {
 	return &RecordPump{
 		port:      port,
 		ch:        make(chan FluentRecord, backlog),
 		control:   make(chan bool, 1),
 		buffer:    make(map[string]*FluentRecordSet),
-		heartbeat: time.NewTicker(time.Duration(1000000000)),
+		heartbeat: clock.NewTicker(time.Duration(1000000000)),
 	}
 }
@@ -0,0 +1,219 @@
+package ik
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MultiFactoryRegistry keeps the factories of every kind an engine looks up,
+// binding each to the scorekeeper it was created with.  Nothing in it is
+// shared with other registries, so engines built with registries of their
+// own can coexist in a process.
+type MultiFactoryRegistry struct {
+	scorekeeper                *Scorekeeper
+	inputFactories             map[string]InputFactory
+	outputFactories            map[string]OutputFactory
+	filterFactories            map[string]FilterFactory
+	scoreboardFactories        map[string]ScoreboardFactory
+	lineParserPlugins          map[string]LineParserPlugin
+	lineParserFactoryFactories map[string]LineParserFactoryFactory
+	formatterPlugins           map[string]FormatterPlugin
+	formatterFactories         map[string]FormatterFactory
+	plugins                    []Plugin
+}
+
+func (registry *MultiFactoryRegistry) RegisterInputFactory(factory InputFactory) error {
+	_, alreadyExists := registry.inputFactories[factory.Name()]
+	if alreadyExists {
+		return errors.New(fmt.Sprintf("InputFactory named %s already registered", factory.Name()))
+	}
+	registry.inputFactories[factory.Name()] = factory
+	registry.plugins = append(registry.plugins, factory)
+	factory.BindScorekeeper(registry.scorekeeper)
+	return nil
+}
+
+func (registry *MultiFactoryRegistry) LookupInputFactory(name string) InputFactory {
+	factory, ok := registry.inputFactories[name]
+	if !ok {
+		return nil
+	}
+	return factory
+}
+
+func (registry *MultiFactoryRegistry) RegisterOutputFactory(factory OutputFactory) error {
+	_, alreadyExists := registry.outputFactories[factory.Name()]
+	if alreadyExists {
+		return errors.New(fmt.Sprintf("OutputFactory named %s already registered", factory.Name()))
+	}
+	registry.outputFactories[factory.Name()] = factory
+	registry.plugins = append(registry.plugins, factory)
+	factory.BindScorekeeper(registry.scorekeeper)
+	return nil
+}
+
+func (registry *MultiFactoryRegistry) LookupOutputFactory(name string) OutputFactory {
+	factory, ok := registry.outputFactories[name]
+	if !ok {
+		return nil
+	}
+	return factory
+}
+
+func (registry *MultiFactoryRegistry) RegisterFilterFactory(factory FilterFactory) error {
+	_, alreadyExists := registry.filterFactories[factory.Name()]
+	if alreadyExists {
+		return errors.New(fmt.Sprintf("FilterFactory named %s already registered", factory.Name()))
+	}
+	registry.filterFactories[factory.Name()] = factory
+	registry.plugins = append(registry.plugins, factory)
+	factory.BindScorekeeper(registry.scorekeeper)
+	return nil
+}
+
+func (registry *MultiFactoryRegistry) LookupFilterFactory(name string) FilterFactory {
+	factory, ok := registry.filterFactories[name]
+	if !ok {
+		return nil
+	}
+	return factory
+}
+
+func (registry *MultiFactoryRegistry) RegisterScoreboardFactory(factory ScoreboardFactory) error {
+	_, alreadyExists := registry.scoreboardFactories[factory.Name()]
+	if alreadyExists {
+		return errors.New(fmt.Sprintf("ScoreboardFactory named %s already registered", factory.Name()))
+	}
+	registry.scoreboardFactories[factory.Name()] = factory
+	registry.plugins = append(registry.plugins, factory)
+	factory.BindScorekeeper(registry.scorekeeper)
+	return nil
+}
+
+func (registry *MultiFactoryRegistry) LookupScoreboardFactory(name string) ScoreboardFactory {
+	factory, ok := registry.scoreboardFactories[name]
+	if !ok {
+		return nil
+	}
+	return factory
+}
+
+func (registry *MultiFactoryRegistry) RegisterLineParserPlugin(plugin LineParserPlugin) error {
+	_, alreadyExists := registry.lineParserPlugins[plugin.Name()]
+	if alreadyExists {
+		return errors.New(fmt.Sprintf("LineParserPlugin named %s already registered", plugin.Name()))
+	}
+	err := plugin.OnRegistering(func(name string, factory LineParserFactoryFactory) error {
+		_, alreadyExists := registry.lineParserFactoryFactories[name]
+		if alreadyExists {
+			return errors.New(fmt.Sprintf("LineParserFactoryFactory named %s already registered", name))
+		}
+		registry.lineParserFactoryFactories[name] = factory
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	registry.lineParserPlugins[plugin.Name()] = plugin
+	return nil
+}
+
+func (registry *MultiFactoryRegistry) LookupLineParserFactoryFactory(name string) LineParserFactoryFactory {
+	factory, ok := registry.lineParserFactoryFactories[name]
+	if !ok {
+		return nil
+	}
+	return factory
+}
+
+func (registry *MultiFactoryRegistry) RegisterFormatterPlugin(plugin FormatterPlugin) error {
+	_, alreadyExists := registry.formatterPlugins[plugin.Name()]
+	if alreadyExists {
+		return errors.New(fmt.Sprintf("FormatterPlugin named %s already registered", plugin.Name()))
+	}
+	err := plugin.OnRegistering(func(name string, factory FormatterFactory) error {
+		_, alreadyExists := registry.formatterFactories[name]
+		if alreadyExists {
+			return errors.New(fmt.Sprintf("FormatterFactory named %s already registered", name))
+		}
+		registry.formatterFactories[name] = factory
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	registry.formatterPlugins[plugin.Name()] = plugin
+	return nil
+}
+
+func (registry *MultiFactoryRegistry) LookupFormatterFactory(name string) FormatterFactory {
+	factory, ok := registry.formatterFactories[name]
+	if !ok {
+		return nil
+	}
+	return factory
+}
+
+// RegisterPlugins registers each of the input, output, filter and
+// scoreboard factories in plugins, ignoring the rest.
+func (registry *MultiFactoryRegistry) RegisterPlugins(plugins []Plugin) error {
+	for _, plugin := range plugins {
+		var err error
+		switch factory := plugin.(type) {
+		case InputFactory:
+			err = registry.RegisterInputFactory(factory)
+		case OutputFactory:
+			err = registry.RegisterOutputFactory(factory)
+		case FilterFactory:
+			err = registry.RegisterFilterFactory(factory)
+		case ScoreboardFactory:
+			err = registry.RegisterScoreboardFactory(factory)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterLineParserPlugins registers each of the line parser plugins.
+func (registry *MultiFactoryRegistry) RegisterLineParserPlugins(plugins []LineParserPlugin) error {
+	for _, plugin := range plugins {
+		err := registry.RegisterLineParserPlugin(plugin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RegisterFormatterPlugins registers each of the formatter plugins.
+func (registry *MultiFactoryRegistry) RegisterFormatterPlugins(plugins []FormatterPlugin) error {
+	for _, plugin := range plugins {
+		err := registry.RegisterFormatterPlugin(plugin)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (registry *MultiFactoryRegistry) Plugins() []Plugin {
+	retval := make([]Plugin, len(registry.plugins))
+	copy(retval, registry.plugins)
+	return retval
+}
+
+func NewMultiFactoryRegistry(scorekeeper *Scorekeeper) *MultiFactoryRegistry {
+	return &MultiFactoryRegistry{
+		scorekeeper:                scorekeeper,
+		inputFactories:             make(map[string]InputFactory),
+		outputFactories:            make(map[string]OutputFactory),
+		filterFactories:            make(map[string]FilterFactory),
+		scoreboardFactories:        make(map[string]ScoreboardFactory),
+		lineParserPlugins:          make(map[string]LineParserPlugin),
+		lineParserFactoryFactories: make(map[string]LineParserFactoryFactory),
+		formatterPlugins:           make(map[string]FormatterPlugin),
+		formatterFactories:         make(map[string]FormatterFactory),
+	}
+}
@@ -0,0 +1,71 @@
+package ik
+
+// GroupByTag makes the least record sets of the records, which may be of
+// any tags: one for each tag, in the order the tags first appear, keeping
+// the order of the records of the tag.
+func GroupByTag(records []FluentRecord) []FluentRecordSet {
+	retval := make([]FluentRecordSet, 0)
+	indices := make(map[string]int)
+	for _, record := range records {
+		i, ok := indices[record.Tag]
+		if !ok {
+			i = len(retval)
+			indices[record.Tag] = i
+			retval = append(retval, FluentRecordSet{Tag: record.Tag, Records: make([]TinyFluentRecord, 0)})
+		}
+		retval[i].Records = append(retval[i].Records, TinyFluentRecord{
+			Timestamp: record.Timestamp,
+			Data:      record.Data,
+		})
+	}
+	return retval
+}
+
+// Regroup merges the record sets of the same tag into the first of them,
+// as GroupByTag does with the records.  The record sets are returned as
+// they are if no tag repeats; a merged record set no longer has the
+// packed entries.
+func Regroup(recordSets []FluentRecordSet) []FluentRecordSet {
+	indices := make(map[string]int, len(recordSets))
+	repeated := false
+	for _, recordSet := range recordSets {
+		if _, ok := indices[recordSet.Tag]; ok {
+			repeated = true
+			break
+		}
+		indices[recordSet.Tag] = 0
+	}
+	if !repeated {
+		return recordSets
+	}
+	retval := make([]FluentRecordSet, 0, len(indices))
+	merged := make([]bool, 0, len(indices))
+	indices = make(map[string]int, len(recordSets))
+	for _, recordSet := range recordSets {
+		i, ok := indices[recordSet.Tag]
+		if !ok {
+			indices[recordSet.Tag] = len(retval)
+			retval = append(retval, recordSet)
+			merged = append(merged, false)
+			continue
+		}
+		// the records of the first belong to the caller, so they are
+		// copied before anything is appended to them
+		if !merged[i] {
+			retval[i].Records = append(make([]TinyFluentRecord, 0, len(retval[i].Records)+len(recordSet.Records)), retval[i].Records...)
+			retval[i].Packed = nil
+			merged[i] = true
+		}
+		retval[i].Records = append(retval[i].Records, recordSet.Records...)
+	}
+	return retval
+}
+
+// EmitRecords emits the records, which may be of any tags, at the port in
+// as many record sets as there are tags.
+func EmitRecords(port Port, records []FluentRecord) error {
+	if len(records) == 0 {
+		return nil
+	}
+	return port.Emit(GroupByTag(records))
+}
@@ -0,0 +1,64 @@
+package ik
+
+import (
+	"testing"
+)
+
+func TestGroupByTag(t *testing.T) {
+	recordSets := GroupByTag([]FluentRecord{
+		{Tag: "info", Timestamp: 1},
+		{Tag: "error", Timestamp: 2},
+		{Tag: "info", Timestamp: 3},
+	})
+	if len(recordSets) != 2 || recordSets[0].Tag != "info" || recordSets[1].Tag != "error" {
+		t.Fatalf("%v", recordSets)
+	}
+	if len(recordSets[0].Records) != 2 || recordSets[0].Records[0].Timestamp != 1 || recordSets[0].Records[1].Timestamp != 3 {
+		t.Fatalf("%v", recordSets[0].Records)
+	}
+}
+
+func TestRegroup(t *testing.T) {
+	first := []TinyFluentRecord{{Timestamp: 1}}
+	recordSets := []FluentRecordSet{
+		{Tag: "a", Records: first, Packed: []byte{0x90}},
+		{Tag: "b", Records: []TinyFluentRecord{{Timestamp: 2}}, Packed: []byte{0x90}},
+		{Tag: "a", Records: []TinyFluentRecord{{Timestamp: 3}}},
+		{Tag: "a", Records: []TinyFluentRecord{{Timestamp: 4}}},
+	}
+	regrouped := Regroup(recordSets)
+	if len(regrouped) != 2 || len(regrouped[0].Records) != 3 || regrouped[0].Records[2].Timestamp != 4 {
+		t.Fatalf("%v", regrouped)
+	}
+	// the merged record set has lost its packed entries, the other has not
+	if regrouped[0].Packed != nil || regrouped[1].Packed == nil {
+		t.Fail()
+	}
+	if len(first) != 1 || len(recordSets[0].Records) != 1 {
+		t.Fail()
+	}
+	// no tag repeating, nothing changes
+	regrouped = Regroup(recordSets[0:2])
+	if len(regrouped) != 2 || &regrouped[0] != &recordSets[0] {
+		t.Fail()
+	}
+}
+
+func TestEmitRecords(t *testing.T) {
+	router := NewFluentRouter()
+	info := &recordingPort{}
+	router.AddRule("info", info)
+	all := &recordingPort{}
+	router.AddRule("**", all)
+	err := EmitRecords(router, []FluentRecord{
+		{Tag: "info", Timestamp: 1},
+		{Tag: "error", Timestamp: 2},
+		{Tag: "info", Timestamp: 3},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(info.recordSets) != 1 || len(info.recordSets[0].Records) != 2 || len(all.recordSets) != 2 {
+		t.Fatalf("%v %v", info.recordSets, all.recordSets)
+	}
+}
@@ -0,0 +1,152 @@
+package ik
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ConfigReloader applies configurations to a running engine.  Loading a
+// configuration terminates the plugin instances created from the previous
+// one, and brings the previous one back if the new one fails to start.
+type ConfigReloader struct {
+	logger          Logger
+	engine          Engine
+	configurer      *FluentConfigurer
+	router          *FluentRouter
+	config          *Config
+	pluginInstances []PluginInstance
+	mtx             sync.Mutex
+}
+
+type configDigestFetcher struct {
+	reloader *ConfigReloader
+}
+
+func (fetcher *configDigestFetcher) PlainText(_ PluginInstance) (string, error) {
+	config := fetcher.reloader.Config()
+	if config == nil {
+		return "-", nil
+	}
+	return config.Digest(), nil
+}
+
+func (fetcher *configDigestFetcher) Markup(pluginInstance PluginInstance) (Markup, error) {
+	text, err := fetcher.PlainText(pluginInstance)
+	if err != nil {
+		return Markup{}, err
+	}
+	return Markup{[]MarkupChunk{{Text: text}}}, nil
+}
+
+func (reloader *ConfigReloader) terminate(pluginInstances []PluginInstance) {
+	for _, pluginInstance := range pluginInstances {
+		// inputs are launched last; stop them first
+		_, isInput := pluginInstance.(Input)
+		if !isInput {
+			continue
+		}
+		err := reloader.engine.Terminate(pluginInstance)
+		if err != nil {
+			reloader.logger.Error("%s", err.Error())
+		}
+	}
+	for _, pluginInstance := range pluginInstances {
+		_, isInput := pluginInstance.(Input)
+		if isInput {
+			continue
+		}
+		err := reloader.engine.Terminate(pluginInstance)
+		if err != nil {
+			reloader.logger.Error("%s", err.Error())
+		}
+	}
+}
+
+func (reloader *ConfigReloader) apply(config *Config) error {
+	engine, ok := reloader.engine.(*engineImpl)
+	if ok {
+		engine.setPanicTag(ParsePanicTag(config))
+		engine.setDeadLetterTag(ParseDeadLetterTag(config))
+	}
+	tracing, err := ParseTracing(config)
+	if err != nil {
+		return err
+	}
+	reloader.engine.Tracer().setTracing(tracing)
+	limits, err := ParseLimits(config)
+	if err != nil {
+		return err
+	}
+	reloader.router.SetLimits(limits)
+	router := NewFluentRouter()
+	router.SetTracer(reloader.engine.Tracer())
+	inputs, outputs, err := reloader.configurer.build(reloader.engine, config, router)
+	if err != nil {
+		// plugins expect to be running when shut down; launch the ones
+		// already built with no route to them just to terminate them
+		launched, _ := reloader.configurer.launch(reloader.engine, inputs, outputs)
+		reloader.terminate(launched)
+		return err
+	}
+	reloader.router.Replace(router)
+	launched, err := reloader.configurer.launch(reloader.engine, inputs, outputs)
+	if err != nil {
+		reloader.router.Replace(NewFluentRouter())
+		reloader.terminate(launched)
+		return err
+	}
+	reloader.pluginInstances = launched
+	reloader.config = config
+	return nil
+}
+
+// Load replaces the running configuration with the given one.
+func (reloader *ConfigReloader) Load(config *Config) error {
+	reloader.mtx.Lock()
+	defer reloader.mtx.Unlock()
+	previous := reloader.config
+	reloader.terminate(reloader.pluginInstances)
+	reloader.pluginInstances = nil
+	reloader.router.Replace(NewFluentRouter())
+	err := reloader.apply(config)
+	if err == nil {
+		return nil
+	}
+	if previous == nil {
+		return err
+	}
+	reloader.logger.Error("failed to apply the new configuration, reverting: %s", err.Error())
+	err_ := reloader.apply(previous)
+	if err_ != nil {
+		return errors.New(fmt.Sprintf("%s (failed to revert: %s)", err.Error(), err_.Error()))
+	}
+	return err
+}
+
+// Config returns the configuration currently applied.
+func (reloader *ConfigReloader) Config() *Config {
+	reloader.mtx.Lock()
+	defer reloader.mtx.Unlock()
+	return reloader.config
+}
+
+func NewConfigReloader(logger Logger, engine Engine, inputFactoryRegistry InputFactoryRegistry, outputFactoryRegistry OutputFactoryRegistry, filterFactoryRegistry FilterFactoryRegistry, router *FluentRouter) *ConfigReloader {
+	reloader := &ConfigReloader{
+		logger:          logger,
+		engine:          engine,
+		configurer:      NewFluentConfigurer(logger, inputFactoryRegistry, outputFactoryRegistry, filterFactoryRegistry, router),
+		router:          router,
+		config:          nil,
+		pluginInstances: nil,
+		mtx:             sync.Mutex{},
+	}
+	engine.Scorekeeper().AddTopic(ScorekeeperTopic{
+		Plugin:      EnginePlugin,
+		Name:        "config_digest",
+		DisplayName: "Configuration digest",
+		Description: "SHA-256 digest of the configuration currently applied",
+		Fetcher:     &configDigestFetcher{reloader},
+	})
+	return reloader
+}
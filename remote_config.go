@@ -0,0 +1,487 @@
+package ik
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RemoteConfigFileName is the name under which a fetched configuration is
+// stored in the cache directory.  Files included by it are looked up in the
+// same directory, since only the configuration itself is fetched and
+// verified.
+const RemoteConfigFileName = "fluent.conf"
+
+// RemoteConfigSignatureSuffix is appended to the location of a
+// configuration to get the location of its detached signature.
+const RemoteConfigSignatureSuffix = ".sig"
+
+// ConfigVerifier verifies the detached signature of a configuration.
+type ConfigVerifier interface {
+	Verify(data []byte, signature []byte) error
+}
+
+// InsecureConfigVerifier accepts any configuration, signed or not.  It is
+// the explicit opt-in for a watcher to apply what it fetches unverified.
+var InsecureConfigVerifier ConfigVerifier = insecureConfigVerifier{}
+
+type insecureConfigVerifier struct{}
+
+type hmacConfigVerifier struct {
+	key []byte
+}
+
+type publicKeyConfigVerifier struct {
+	key interface{}
+}
+
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+// RemoteConfigSource fetches a configuration and its signature, along with
+// the version the source tells it by, such as the ETag or the commit.  data
+// is nil if the configuration is still of the version given, which is that
+// of the last one verified; a configuration failing the verification is
+// thus fetched again on the next poll.
+type RemoteConfigSource interface {
+	Fetch(version string) (data []byte, signature []byte, version_ string, err error)
+}
+
+type httpRemoteConfigSource struct {
+	client  *http.Client
+	url     string
+	maxSize int64
+}
+
+type gitRemoteConfigSource struct {
+	logger  Logger
+	url     string
+	ref     string
+	path    string
+	workDir string
+	maxSize int64
+}
+
+// RemoteConfigWatcher keeps the engine running the configuration found at a
+// remote location.  It polls the source on the interval and can also be
+// triggered by a POST request, for which it serves as an http.Handler.
+type RemoteConfigWatcher struct {
+	logger   Logger
+	source   RemoteConfigSource
+	verifier ConfigVerifier
+	reloader *ConfigReloader
+	cacheDir string
+	interval time.Duration
+	version  string
+	digest   [sha256.Size]byte
+	trigger  chan bool
+	cancel   chan bool
+	ticker   Ticker
+	stopOnce sync.Once
+	mtx      sync.Mutex
+}
+
+func decodeSignature(signature []byte) ([]byte, error) {
+	if signature == nil {
+		return nil, errors.New("no signature found")
+	}
+	return base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature)))
+}
+
+func (insecureConfigVerifier) Verify(data []byte, signature []byte) error {
+	return nil
+}
+
+func (verifier *hmacConfigVerifier) Verify(data []byte, signature []byte) error {
+	signature_, err := decodeSignature(signature)
+	if err != nil {
+		return err
+	}
+	mac := hmac.New(sha256.New, verifier.key)
+	mac.Write(data)
+	if !hmac.Equal(mac.Sum(nil), signature_) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+func (verifier *publicKeyConfigVerifier) Verify(data []byte, signature []byte) error {
+	signature_, err := decodeSignature(signature)
+	if err != nil {
+		return err
+	}
+	digest := sha256.Sum256(data)
+	switch key := verifier.key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature_)
+	case *ecdsa.PublicKey:
+		sig := ecdsaSignature{}
+		_, err := asn1.Unmarshal(signature_, &sig)
+		if err != nil {
+			return err
+		}
+		if !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	}
+	return errors.New("unsupported public key type")
+}
+
+// NewHMACConfigVerifier returns a verifier for base64-encoded HMAC-SHA256
+// signatures made with the shared key.
+func NewHMACConfigVerifier(key []byte) ConfigVerifier {
+	return &hmacConfigVerifier{key}
+}
+
+// NewPublicKeyConfigVerifier returns a verifier for base64-encoded RSA
+// (PKCS #1 v1.5) or ECDSA signatures over the SHA-256 digest, given the
+// PEM-encoded public key.
+func NewPublicKeyConfigVerifier(pemData []byte) (ConfigVerifier, error) {
+	block, _ := pem.Decode(pemData)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, errors.New("unsupported public key type")
+	}
+	return &publicKeyConfigVerifier{key}, nil
+}
+
+func (source *httpRemoteConfigSource) get(url string, etag string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := source.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotModified {
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("%s returned %s", url, resp.Status))
+	}
+	return resp, nil
+}
+
+func (source *httpRemoteConfigSource) Fetch(etag string) ([]byte, []byte, string, error) {
+	resp, err := source.get(source.url, etag)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, nil, etag, nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, source.maxSize+1))
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if int64(len(data)) > source.maxSize {
+		return nil, nil, "", errRemoteConfigTooLarge(source.maxSize)
+	}
+	// a missing signature is left to the verifier to reject
+	var signature []byte
+	sigResp, err := source.get(source.url+RemoteConfigSignatureSuffix, "")
+	if err == nil {
+		defer sigResp.Body.Close()
+		signature, err = ioutil.ReadAll(io.LimitReader(sigResp.Body, 65536))
+		if err != nil {
+			return nil, nil, "", err
+		}
+	}
+	return data, signature, resp.Header.Get("ETag"), nil
+}
+
+func errRemoteConfigTooLarge(maxSize int64) error {
+	return errors.New(fmt.Sprintf("the configuration exceeds %d bytes", maxSize))
+}
+
+func (source *gitRemoteConfigSource) git(args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = source.workDir
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("git %s failed: %s: %s", args[0], err.Error(), strings.TrimSpace(stderr.String())))
+	}
+	return out, nil
+}
+
+func (source *gitRemoteConfigSource) Fetch(head string) ([]byte, []byte, string, error) {
+	_, err := os.Stat(path.Join(source.workDir, ".git"))
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(source.workDir, os.FileMode(0700))
+		if err != nil {
+			return nil, nil, "", err
+		}
+		_, err = source.git("init", "-q")
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+	_, err = source.git("fetch", "-q", "--depth", "1", source.url, source.ref)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	head_, err := source.git("rev-parse", "FETCH_HEAD")
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if string(head_) == head {
+		return nil, nil, head, nil
+	}
+	size, err := source.git("cat-file", "-s", "FETCH_HEAD:"+source.path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	size_, err := strconv.ParseInt(strings.TrimSpace(string(size)), 10, 64)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if size_ > source.maxSize {
+		return nil, nil, "", errRemoteConfigTooLarge(source.maxSize)
+	}
+	data, err := source.git("show", "FETCH_HEAD:"+source.path)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	// a missing signature is left to the verifier to reject
+	signature, _ := source.git("show", "FETCH_HEAD:"+source.path+RemoteConfigSignatureSuffix)
+	return data, signature, string(head_), nil
+}
+
+// NewRemoteConfigSource returns a source for the location, which is either
+// an http(s) URL or a git repository given as git+<url>#<ref>:<path>, where
+// <ref> defaults to HEAD and <path> to fluent.conf.  The signature is looked
+// up at the same location with ".sig" appended.  A configuration larger than
+// maxSize bytes is refused.
+func NewRemoteConfigSource(logger Logger, location string, workDir string, timeout time.Duration, maxSize int64) (RemoteConfigSource, error) {
+	if strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://") {
+		return &httpRemoteConfigSource{
+			client:  &http.Client{Timeout: timeout},
+			url:     location,
+			maxSize: maxSize,
+		}, nil
+	} else if strings.HasPrefix(location, "git+") {
+		url := strings.TrimPrefix(location, "git+")
+		ref := "HEAD"
+		path_ := RemoteConfigFileName
+		i := strings.LastIndex(url, "#")
+		if i >= 0 {
+			fragment := url[i+1:]
+			url = url[0:i]
+			pair := strings.SplitN(fragment, ":", 2)
+			if pair[0] != "" {
+				ref = pair[0]
+			}
+			if len(pair) == 2 && pair[1] != "" {
+				path_ = pair[1]
+			}
+		}
+		return &gitRemoteConfigSource{
+			logger:  logger,
+			url:     url,
+			ref:     ref,
+			path:    path_,
+			workDir: workDir,
+			maxSize: maxSize,
+		}, nil
+	}
+	return nil, errors.New("unsupported remote configuration location: " + location)
+}
+
+func (watcher *RemoteConfigWatcher) cachePath() string {
+	return path.Join(watcher.cacheDir, RemoteConfigFileName)
+}
+
+func (watcher *RemoteConfigWatcher) parse() (*Config, error) {
+	return ParseConfig(DefaultOpener(watcher.cacheDir), RemoteConfigFileName)
+}
+
+// fetch fetches and verifies the configuration and stores it in the cache
+// directory, returning false if it has not changed.  The version of the
+// configuration is kept only once it is verified.
+func (watcher *RemoteConfigWatcher) fetch() (bool, error) {
+	data, signature, version, err := watcher.source.Fetch(watcher.version)
+	if err != nil {
+		return false, err
+	}
+	if data == nil {
+		return false, nil
+	}
+	err = watcher.verifier.Verify(data, signature)
+	if err != nil {
+		return false, errors.New("failed to verify the configuration: " + err.Error())
+	}
+	digest := sha256.Sum256(data)
+	if digest == watcher.digest {
+		watcher.version = version
+		return false, nil
+	}
+	tmpPath := watcher.cachePath() + ".tmp"
+	err = ioutil.WriteFile(tmpPath, data, os.FileMode(0600))
+	if err != nil {
+		return false, err
+	}
+	err = os.Rename(tmpPath, watcher.cachePath())
+	if err != nil {
+		os.Remove(tmpPath)
+		return false, err
+	}
+	watcher.digest = digest
+	watcher.version = version
+	return true, nil
+}
+
+// Initial fetches the configuration to start the engine with.  If the
+// source is unreachable, the configuration fetched by the last run is used.
+func (watcher *RemoteConfigWatcher) Initial() (*Config, error) {
+	watcher.mtx.Lock()
+	defer watcher.mtx.Unlock()
+	_, err := watcher.fetch()
+	if err != nil {
+		_, err_ := os.Stat(watcher.cachePath())
+		if err_ != nil {
+			return nil, err
+		}
+		watcher.logger.Warning("failed to fetch the configuration; using the cached one: %s", err.Error())
+	}
+	return watcher.parse()
+}
+
+// Poll fetches the configuration and applies it if it has changed.
+func (watcher *RemoteConfigWatcher) Poll() error {
+	watcher.mtx.Lock()
+	defer watcher.mtx.Unlock()
+	changed, err := watcher.fetch()
+	if err != nil || !changed {
+		return err
+	}
+	config, err := watcher.parse()
+	if err != nil {
+		return err
+	}
+	watcher.logger.Notice("Applying the updated configuration")
+	return watcher.reloader.Load(config)
+}
+
+// SetReloader sets the reloader the configuration is applied to.
+func (watcher *RemoteConfigWatcher) SetReloader(reloader *ConfigReloader) {
+	watcher.mtx.Lock()
+	defer watcher.mtx.Unlock()
+	watcher.reloader = reloader
+}
+
+func (watcher *RemoteConfigWatcher) Run() error {
+	var tick <-chan time.Time
+	if watcher.ticker != nil {
+		tick = watcher.ticker.C()
+	}
+	select {
+	case <-watcher.cancel:
+		return nil
+	case <-tick:
+	case <-watcher.trigger:
+	}
+	err := watcher.Poll()
+	if err != nil {
+		watcher.logger.Error("%s", err.Error())
+	}
+	return Continue
+}
+
+// Shutdown stops the watcher without waiting for Run to pick it up, so
+// that it returns even if Run is not being called anymore.
+func (watcher *RemoteConfigWatcher) Shutdown() error {
+	watcher.stopOnce.Do(func() {
+		if watcher.ticker != nil {
+			watcher.ticker.Stop()
+		}
+		close(watcher.cancel)
+	})
+	return nil
+}
+
+func (watcher *RemoteConfigWatcher) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		resp.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	watcher.Trigger()
+	resp.WriteHeader(http.StatusAccepted)
+}
+
+// Trigger makes the watcher fetch the configuration without waiting for
+// the interval.
+func (watcher *RemoteConfigWatcher) Trigger() {
+	select {
+	case watcher.trigger <- true:
+	default:
+		// a poll is already pending
+	}
+}
+
+// NewRemoteConfigWatcher creates a watcher that applies the configuration
+// to the reloader.  An interval of zero disables polling, which otherwise
+// goes by clock.  The verifier is required; InsecureConfigVerifier has the
+// configuration applied unverified, which is warned about.
+func NewRemoteConfigWatcher(logger Logger, source RemoteConfigSource, verifier ConfigVerifier, reloader *ConfigReloader, cacheDir string, interval time.Duration, clock Clock) (*RemoteConfigWatcher, error) {
+	if verifier == nil {
+		return nil, errors.New("the remote configuration requires a verifier")
+	}
+	if verifier == InsecureConfigVerifier {
+		logger.Warning("the signature of the remote configuration is not verified")
+	}
+	err := os.MkdirAll(cacheDir, os.FileMode(0700))
+	if err != nil {
+		return nil, err
+	}
+	var ticker Ticker
+	if interval > 0 {
+		ticker = clock.NewTicker(interval)
+	}
+	return &RemoteConfigWatcher{
+		logger:   logger,
+		source:   source,
+		verifier: verifier,
+		reloader: reloader,
+		cacheDir: cacheDir,
+		interval: interval,
+		trigger:  make(chan bool, 1),
+		cancel:   make(chan bool),
+		ticker:   ticker,
+		mtx:      sync.Mutex{},
+	}, nil
+}
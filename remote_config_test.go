@@ -0,0 +1,220 @@
+package ik
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func Test_RemoteConfigWatcher_Initial(t *testing.T) {
+	key := []byte("secret")
+	config := "<source>\n  type forward\n</source>\n"
+	signature := ""
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/fluent.conf":
+			resp.Write([]byte(config))
+		case "/fluent.conf.sig":
+			resp.Write([]byte(signature))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "ik.remote_config")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	source, err := NewRemoteConfigSource(nil, server.URL+"/fluent.conf", tempDir, 0, 1<<20)
+	if err != nil {
+		t.FailNow()
+	}
+	watcher, err := NewRemoteConfigWatcher(nil, source, NewHMACConfigVerifier(key), nil, tempDir, 0, SystemClock)
+	if err != nil {
+		t.FailNow()
+	}
+	signature = base64.StdEncoding.EncodeToString([]byte("bogus"))
+	_, err = watcher.Initial()
+	if err == nil {
+		t.Fail()
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(config))
+	signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	config_, err := watcher.Initial()
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if len(config_.Root.Elems) != 1 || config_.Root.Elems[0].Attrs["type"] != "forward" {
+		t.Fail()
+	}
+	changed, err := watcher.fetch()
+	if err != nil || changed {
+		t.Fail()
+	}
+}
+
+func Test_RemoteConfigWatcher_fetch_signedLate(t *testing.T) {
+	key := []byte("secret")
+	config := "<source>\n  type forward\n</source>\n"
+	signature := base64.StdEncoding.EncodeToString([]byte("bogus"))
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/fluent.conf":
+			if req.Header.Get("If-None-Match") == `"1"` {
+				resp.WriteHeader(http.StatusNotModified)
+				return
+			}
+			resp.Header().Set("ETag", `"1"`)
+			resp.Write([]byte(config))
+		case "/fluent.conf.sig":
+			resp.Write([]byte(signature))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "ik.remote_config")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	source, err := NewRemoteConfigSource(nil, server.URL+"/fluent.conf", tempDir, 0, 1<<20)
+	if err != nil {
+		t.FailNow()
+	}
+	watcher, err := NewRemoteConfigWatcher(nil, source, NewHMACConfigVerifier(key), nil, tempDir, 0, SystemClock)
+	if err != nil {
+		t.FailNow()
+	}
+	_, err = watcher.fetch()
+	if err == nil {
+		t.Fail()
+	}
+	// the signature is published after the configuration
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(config))
+	signature = base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	changed, err := watcher.fetch()
+	if err != nil || !changed {
+		t.Fatalf("%v %v", changed, err)
+	}
+	changed, err = watcher.fetch()
+	if err != nil || changed || watcher.version != `"1"` {
+		t.Fatalf("%v %v", changed, err)
+	}
+}
+
+func Test_RemoteConfigWatcher_fetch_signedLate_git(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+	key := []byte("secret")
+	config := "<source>\n  type forward\n</source>\n"
+	tempDir, err := ioutil.TempDir("", "ik.remote_config")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	repoDir := path.Join(tempDir, "repo")
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-c", "user.name=ik", "-c", "user.email=ik@example.com"}, args...)...)
+		cmd.Dir = repoDir
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("%s: %s", err.Error(), out)
+		}
+	}
+	commit := func(signature string) {
+		ioutil.WriteFile(path.Join(repoDir, "fluent.conf"), []byte(config), os.FileMode(0644))
+		ioutil.WriteFile(path.Join(repoDir, "fluent.conf.sig"), []byte(signature), os.FileMode(0644))
+		git("add", "-A")
+		git("commit", "-q", "-m", "config")
+	}
+	os.MkdirAll(repoDir, os.FileMode(0755))
+	git("init", "-q")
+	commit(base64.StdEncoding.EncodeToString([]byte("bogus")))
+
+	source, err := NewRemoteConfigSource(nil, "git+"+repoDir, path.Join(tempDir, "work"), 0, 1<<20)
+	if err != nil {
+		t.FailNow()
+	}
+	watcher, err := NewRemoteConfigWatcher(nil, source, NewHMACConfigVerifier(key), nil, path.Join(tempDir, "cache"), 0, SystemClock)
+	if err != nil {
+		t.FailNow()
+	}
+	_, err = watcher.fetch()
+	if err == nil {
+		t.Fail()
+	}
+	// the head failing the verification is fetched again
+	_, err = watcher.fetch()
+	if err == nil {
+		t.Fail()
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(config))
+	commit(base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+	changed, err := watcher.fetch()
+	if err != nil || !changed {
+		t.Fatalf("%v %v", changed, err)
+	}
+	changed, err = watcher.fetch()
+	if err != nil || changed {
+		t.Fatalf("%v %v", changed, err)
+	}
+}
+
+func Test_RemoteConfigWatcher_limits(t *testing.T) {
+	config := "<source>\n  type forward\n</source>\n"
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		resp.Write([]byte(config))
+	}))
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "ik.remote_config")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+
+	source, err := NewRemoteConfigSource(nil, server.URL+"/fluent.conf", tempDir, 0, 16)
+	if err != nil {
+		t.FailNow()
+	}
+	_, err = NewRemoteConfigWatcher(nil, source, nil, nil, tempDir, 0, SystemClock)
+	if err == nil {
+		t.Fail()
+	}
+	watcher, err := NewRemoteConfigWatcher(logging.MustGetLogger("ik"), source, InsecureConfigVerifier, nil, tempDir, 0, SystemClock)
+	if err != nil {
+		t.FailNow()
+	}
+	_, err = watcher.fetch()
+	if err == nil || !strings.Contains(err.Error(), "exceeds 16 bytes") {
+		t.Fatalf("%v", err)
+	}
+	watcher.source.(*httpRemoteConfigSource).maxSize = int64(len(config))
+	changed, err := watcher.fetch()
+	if err != nil || !changed {
+		t.Fatalf("%v %v", changed, err)
+	}
+	// shutting down does not wait for Run
+	watcher.Shutdown()
+	watcher.Shutdown()
+	if watcher.Run() != nil {
+		t.Fail()
+	}
+}
@@ -0,0 +1,141 @@
+package ik
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+type roundRobinPlugin struct{}
+
+func (*roundRobinPlugin) Name() string                 { return "roundrobin" }
+func (*roundRobinPlugin) BindScorekeeper(*Scorekeeper) {}
+
+// RoundRobinPlugin is the factory of the outputs built from <match>
+// elements of type roundrobin, which are built by the configurer itself as
+// the ones of type copy are.
+var RoundRobinPlugin Plugin = &roundRobinPlugin{}
+
+type roundRobinStore struct {
+	output  Output
+	weight  int
+	current int
+}
+
+// RoundRobinOutput distributes the record sets over its stores by smooth
+// weighted round-robin, a store of weight 2 being given twice as many as
+// one of weight 1.  A store of weight 0 is given none.
+type RoundRobinOutput struct {
+	stores []*roundRobinStore
+	mtx    sync.Mutex
+	cancel chan bool
+}
+
+// pick chooses the store the next record set goes to.
+func (output *RoundRobinOutput) pick() int {
+	output.mtx.Lock()
+	defer output.mtx.Unlock()
+	best := -1
+	total := 0
+	for i, store := range output.stores {
+		if store.weight <= 0 {
+			continue
+		}
+		store.current += store.weight
+		total += store.weight
+		if best < 0 || store.current > output.stores[best].current {
+			best = i
+		}
+	}
+	output.stores[best].current -= total
+	return best
+}
+
+// emit gives each store the record sets picked for it at once, and stops
+// at the first store failing.
+func (output *RoundRobinOutput) emit(recordSets []FluentRecordSet, emit func(Port, []FluentRecordSet) error) error {
+	shards := make([][]FluentRecordSet, len(output.stores))
+	for _, recordSet := range recordSets {
+		i := output.pick()
+		shards[i] = append(shards[i], recordSet)
+	}
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		err := emit(output.stores[i].output, shard)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (output *RoundRobinOutput) Emit(recordSets []FluentRecordSet) error {
+	return output.emit(recordSets, func(port Port, recordSets []FluentRecordSet) error {
+		return port.Emit(recordSets)
+	})
+}
+
+func (output *RoundRobinOutput) EmitDurably(recordSets []FluentRecordSet) error {
+	return output.emit(recordSets, EmitDurably)
+}
+
+func (output *RoundRobinOutput) Factory() Plugin {
+	return RoundRobinPlugin
+}
+
+func (output *RoundRobinOutput) Run() error {
+	<-output.cancel
+	return nil
+}
+
+func (output *RoundRobinOutput) Shutdown() error {
+	output.cancel <- true
+	return nil
+}
+
+func (output *RoundRobinOutput) Dispose() {
+	output.Shutdown()
+}
+
+// buildRoundRobinOutput builds the outputs in the <store> elements with the
+// given function, and returns them along with the round-robin output
+// emitting at them.  The weight of a store is 1 unless given.
+func buildRoundRobinOutput(config *ConfigElement, build func(*ConfigElement) ([]Output, error)) ([]Output, *RoundRobinOutput, error) {
+	outputs := make([]Output, 0)
+	stores := make([]*roundRobinStore, 0)
+	total := 0
+	for _, v := range config.Elems {
+		if v.Name != "store" {
+			continue
+		}
+		weight := 1
+		weightStr, ok := v.Attrs["weight"]
+		if ok {
+			var err error
+			weight, err = strconv.Atoi(weightStr)
+			if err != nil {
+				return outputs, nil, err
+			}
+			if weight < 0 {
+				return outputs, nil, errors.New("invalid weight: " + weightStr)
+			}
+		}
+		outputs_, err := build(v)
+		outputs = append(outputs, outputs_...)
+		if err != nil {
+			return outputs, nil, err
+		}
+		// the last one built is the store itself
+		stores = append(stores, &roundRobinStore{output: outputs_[len(outputs_)-1], weight: weight})
+		total += weight
+	}
+	if total == 0 {
+		return outputs, nil, errors.New("roundrobin requires at least one <store> of a positive weight")
+	}
+	return outputs, &RoundRobinOutput{
+		stores: stores,
+		cancel: make(chan bool, 1),
+	}, nil
+}
@@ -0,0 +1,59 @@
+package ik
+
+import (
+	"errors"
+	"testing"
+)
+
+func newRoundRobinTestOutput(t *testing.T, stores []*copyTestOutput, weights []string) ([]Output, *RoundRobinOutput, error) {
+	config := &ConfigElement{Name: "match", Attrs: map[string]string{}, Elems: []*ConfigElement{}}
+	for i, _ := range stores {
+		attrs := map[string]string{}
+		if weights[i] != "" {
+			attrs["weight"] = weights[i]
+		}
+		config.Elems = append(config.Elems, &ConfigElement{Name: "store", Attrs: attrs})
+	}
+	i := 0
+	return buildRoundRobinOutput(config, func(*ConfigElement) ([]Output, error) {
+		i += 1
+		return []Output{stores[i-1]}, nil
+	})
+}
+
+func TestRoundRobinOutput_Emit(t *testing.T) {
+	stores := []*copyTestOutput{{}, {}, {}}
+	outputs, output, err := newRoundRobinTestOutput(t, stores, []string{"2", "", "0"})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(outputs) != 3 {
+		t.Fail()
+	}
+	recordSets := make([]FluentRecordSet, 0)
+	for i := 0; i < 6; i += 1 {
+		recordSets = append(recordSets, FluentRecordSet{Tag: "test"})
+	}
+	err = output.Emit(recordSets)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(stores[0].recordSets) != 4 || len(stores[1].recordSets) != 2 || len(stores[2].recordSets) != 0 {
+		t.Fatalf("%d %d %d", len(stores[0].recordSets), len(stores[1].recordSets), len(stores[2].recordSets))
+	}
+
+	stores[1].err = errors.New("failure")
+	err = output.EmitDurably(recordSets[0:3])
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestRoundRobinOutput_weights(t *testing.T) {
+	for _, weights := range [][]string{{"0", "0"}, {"-1", "1"}, {"a", "1"}} {
+		_, _, err := newRoundRobinTestOutput(t, []*copyTestOutput{{}, {}}, weights)
+		if err == nil {
+			t.Errorf("%v is accepted", weights)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+package ik
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScoreHistoryWindows are the windows the scoreboards render the deltas
+// and the rates of the topics over.
+var ScoreHistoryWindows = []time.Duration{time.Minute, 5 * time.Minute}
+
+// ScoreSample is the value of a topic at a time.
+type ScoreSample struct {
+	Time  time.Time
+	Value float64
+}
+
+// ScoreHistory is a ring buffer of the samples taken of a topic of a plugin
+// instance, the oldest being overwritten once it is full.
+type ScoreHistory struct {
+	samples []ScoreSample
+	next    int
+	n       int
+	mtx     sync.Mutex
+}
+
+type scoreHistoryKey struct {
+	plugin         Plugin
+	name           string
+	pluginInstance PluginInstance
+}
+
+type scoreSamplerTopic struct {
+	key     scoreHistoryKey
+	fetcher ScoreValueFetcher
+}
+
+// Record adds a sample, overwriting the oldest if the history is full.
+func (history *ScoreHistory) Record(t time.Time, value float64) {
+	history.mtx.Lock()
+	defer history.mtx.Unlock()
+	history.samples[history.next] = ScoreSample{t, value}
+	history.next = (history.next + 1) % len(history.samples)
+	if history.n < len(history.samples) {
+		history.n += 1
+	}
+}
+
+// Samples returns the samples in the history, the oldest first.
+func (history *ScoreHistory) Samples() []ScoreSample {
+	history.mtx.Lock()
+	defer history.mtx.Unlock()
+	retval := make([]ScoreSample, history.n)
+	for i := 0; i < history.n; i++ {
+		retval[i] = history.samples[(history.next-history.n+i+len(history.samples))%len(history.samples)]
+	}
+	return retval
+}
+
+// Delta returns how much the value changed over the window up to the
+// latest sample and the time it took, measured from the latest sample
+// taken at least window before, or from the oldest if the history does not
+// reach that far.  It returns false while there are fewer than two
+// samples.
+func (history *ScoreHistory) Delta(window time.Duration) (float64, time.Duration, bool) {
+	samples := history.Samples()
+	if len(samples) < 2 {
+		return 0, 0, false
+	}
+	latest := samples[len(samples)-1]
+	base := samples[0]
+	for _, sample := range samples[1 : len(samples)-1] {
+		if latest.Time.Sub(sample.Time) < window {
+			break
+		}
+		base = sample
+	}
+	return latest.Value - base.Value, latest.Time.Sub(base.Time), true
+}
+
+// Rate returns the delta over the window per second.
+func (history *ScoreHistory) Rate(window time.Duration) (float64, bool) {
+	delta, elapsed, ok := history.Delta(window)
+	if !ok || elapsed <= 0 {
+		return 0, false
+	}
+	return delta / elapsed.Seconds(), true
+}
+
+func NewScoreHistory(size int) *ScoreHistory {
+	if size < 2 {
+		size = 2
+	}
+	return &ScoreHistory{samples: make([]ScoreSample, size)}
+}
+
+// SetHistorySize sets how many samples the histories created afterwards
+// keep.
+func (sk *Scorekeeper) SetHistorySize(size int) {
+	sk.mtx.Lock()
+	defer sk.mtx.Unlock()
+	sk.historySize = size
+}
+
+// History returns the history of the topic of the plugin instance, or nil
+// if none is recorded, which is the case of the topics whose values are not
+// numbers.  The topics of the engine are recorded for a nil plugin
+// instance.
+func (sk *Scorekeeper) History(plugin Plugin, name string, pluginInstance PluginInstance) *ScoreHistory {
+	sk.mtx.RLock()
+	defer sk.mtx.RUnlock()
+	return sk.histories[scoreHistoryKey{plugin, name, pluginInstance}]
+}
+
+// Sample records the values of the topics of the engine and of each of the
+// plugin instances into their histories, those not parsed as a number being
+// skipped.  The histories of the plugin instances not given any more, such
+// as those replaced by a reload, are dropped.
+func (sk *Scorekeeper) Sample(now time.Time, pluginInstances []PluginInstance) {
+	sk.mtx.RLock()
+	topics := make([]scoreSamplerTopic, 0)
+	for _, topic := range sk.topics[EnginePlugin] {
+		topics = append(topics, scoreSamplerTopic{scoreHistoryKey{EnginePlugin, topic.Name, nil}, topic.Fetcher})
+	}
+	for _, pluginInstance := range pluginInstances {
+		plugin := pluginInstance.Factory()
+		for _, topic := range sk.topics[plugin] {
+			topics = append(topics, scoreSamplerTopic{scoreHistoryKey{plugin, topic.Name, pluginInstance}, topic.Fetcher})
+		}
+	}
+	sk.mtx.RUnlock()
+
+	// the fetchers are not called with the scorekeeper locked, as some of
+	// them take a while
+	values := make(map[scoreHistoryKey]float64, len(topics))
+	for _, topic := range topics {
+		text, err := topic.fetcher.PlainText(topic.key.pluginInstance)
+		if err != nil {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(text), 64)
+		if err != nil {
+			continue
+		}
+		values[topic.key] = value
+	}
+
+	sk.mtx.Lock()
+	defer sk.mtx.Unlock()
+	live := make(map[PluginInstance]bool, len(pluginInstances)+1)
+	live[nil] = true
+	for _, pluginInstance := range pluginInstances {
+		live[pluginInstance] = true
+	}
+	for key := range sk.histories {
+		if !live[key.pluginInstance] {
+			delete(sk.histories, key)
+		}
+	}
+	for key, value := range values {
+		history, ok := sk.histories[key]
+		if !ok {
+			history = NewScoreHistory(sk.historySize)
+			sk.histories[key] = history
+		}
+		history.Record(now, value)
+	}
+}
+
+// ScoreSampler samples the topics of the engine into the histories of its
+// scorekeeper at every interval.
+type ScoreSampler struct {
+	engine Engine
+	ticker Ticker
+	cancel chan bool
+}
+
+func (sampler *ScoreSampler) Run() error {
+	select {
+	case <-sampler.cancel:
+		return nil
+	case now := <-sampler.ticker.C():
+		sampler.engine.Scorekeeper().Sample(now, sampler.engine.PluginInstances())
+	}
+	return Continue
+}
+
+func (sampler *ScoreSampler) Shutdown() error {
+	sampler.ticker.Stop()
+	sampler.cancel <- true
+	return nil
+}
+
+// NewScoreSampler makes the histories of the scorekeeper of the engine
+// hold enough samples taken at the interval to cover the longest of
+// ScoreHistoryWindows, and takes the first sample.
+func NewScoreSampler(engine Engine, interval time.Duration) *ScoreSampler {
+	longest := ScoreHistoryWindows[len(ScoreHistoryWindows)-1]
+	engine.Scorekeeper().SetHistorySize(int((longest+interval-1)/interval) + 1)
+	clock := engine.Clock()
+	engine.Scorekeeper().Sample(clock.Now(), engine.PluginInstances())
+	return &ScoreSampler{
+		engine: engine,
+		ticker: clock.NewTicker(interval),
+		cancel: make(chan bool, 1),
+	}
+}
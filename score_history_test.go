@@ -0,0 +1,80 @@
+package ik
+
+import (
+	"github.com/op/go-logging"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type valueFetcher struct {
+	value string
+}
+
+func (fetcher *valueFetcher) Markup(pluginInstance PluginInstance) (Markup, error) {
+	return Markup{[]MarkupChunk{{Text: fetcher.value}}}, nil
+}
+
+func (fetcher *valueFetcher) PlainText(pluginInstance PluginInstance) (string, error) {
+	return fetcher.value, nil
+}
+
+func TestScoreHistory(t *testing.T) {
+	history := NewScoreHistory(3)
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	history.Record(now, 1)
+	if _, ok := history.Rate(time.Minute); ok {
+		t.Fail()
+	}
+	for i := 1; i < 5; i++ {
+		history.Record(now.Add(time.Duration(i)*30*time.Second), float64(1+i*30))
+	}
+	// the oldest two are overwritten
+	samples := history.Samples()
+	if len(samples) != 3 || samples[0].Value != 61 || samples[2].Value != 121 {
+		t.Fatalf("%v", samples)
+	}
+	delta, elapsed, ok := history.Delta(30 * time.Second)
+	if !ok || delta != 30 || elapsed != 30*time.Second {
+		t.Fatalf("%v %v", delta, elapsed)
+	}
+	// the history does not reach as far as 5m
+	rate, ok := history.Rate(5 * time.Minute)
+	if !ok || rate != 1 {
+		t.Fatalf("%v", rate)
+	}
+}
+
+func TestScorekeeperSample(t *testing.T) {
+	scorekeeper := NewScorekeeper(logging.MustGetLogger("ik"))
+	scorekeeper.SetHistorySize(11)
+	factory := &panickingOutputFactory{}
+	instance := &panickingOutput{factory}
+	fetcher := &valueFetcher{"0"}
+	scorekeeper.AddTopic(ScorekeeperTopic{Plugin: factory, Name: "count", Fetcher: fetcher})
+	scorekeeper.AddTopic(ScorekeeperTopic{Plugin: factory, Name: "state", Fetcher: &valueFetcher{"running"}})
+	scorekeeper.AddTopic(ScorekeeperTopic{Plugin: EnginePlugin, Name: "goroutines", Fetcher: &valueFetcher{"10"}})
+	now := time.Date(2014, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i <= 10; i++ {
+		fetcher.value = strconv.Itoa(i * i)
+		scorekeeper.Sample(now.Add(time.Duration(i)*30*time.Second), []PluginInstance{instance})
+	}
+	history := scorekeeper.History(factory, "count", instance)
+	if history == nil {
+		t.FailNow()
+	}
+	if rate, ok := history.Rate(time.Minute); !ok || rate != float64(100-64)/60 {
+		t.Fatalf("%v", rate)
+	}
+	if delta, _, ok := history.Delta(5 * time.Minute); !ok || delta != 100 {
+		t.Fatalf("%v", delta)
+	}
+	if scorekeeper.History(factory, "state", instance) != nil || scorekeeper.History(EnginePlugin, "goroutines", nil) == nil {
+		t.Fail()
+	}
+	// the histories of the instances gone are dropped
+	scorekeeper.Sample(now.Add(time.Hour), []PluginInstance{})
+	if scorekeeper.History(factory, "count", instance) != nil || scorekeeper.History(EnginePlugin, "goroutines", nil) == nil {
+		t.Fail()
+	}
+}
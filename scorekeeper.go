@@ -3,14 +3,24 @@ package ik
 import (
 	"errors"
 	"fmt"
+	"sync"
 )
 
+// Scorekeeper may have topics added while it is being read, as plugins
+// register theirs when they are launched.  The numeric values of the
+// topics are kept in histories as they are sampled, for the rates of them
+// to be rendered besides.
 type Scorekeeper struct {
-	logger Logger
-	topics map[Plugin]map[string]ScorekeeperTopic
+	logger      Logger
+	topics      map[Plugin]map[string]ScorekeeperTopic
+	histories   map[scoreHistoryKey]*ScoreHistory
+	historySize int
+	mtx         sync.RWMutex
 }
 
 func (sk *Scorekeeper) GetPlugins() []Plugin {
+	sk.mtx.RLock()
+	defer sk.mtx.RUnlock()
 	plugins := make([]Plugin, len(sk.topics))
 	i := 0
 	for plugin, _ := range sk.topics {
@@ -21,6 +31,8 @@ func (sk *Scorekeeper) GetPlugins() []Plugin {
 }
 
 func (sk *Scorekeeper) GetTopics(plugin Plugin) []ScorekeeperTopic {
+	sk.mtx.RLock()
+	defer sk.mtx.RUnlock()
 	entries, ok := sk.topics[plugin]
 	if !ok {
 		return []ScorekeeperTopic{}
@@ -35,6 +47,24 @@ func (sk *Scorekeeper) GetTopics(plugin Plugin) []ScorekeeperTopic {
 }
 
 func (sk *Scorekeeper) AddTopic(topic ScorekeeperTopic) {
+	sk.mtx.Lock()
+	defer sk.mtx.Unlock()
+	sk.addTopic(topic)
+}
+
+// AddTopicIfAbsent adds the topic unless the plugin already has one of the
+// same name, and returns the fetcher of the topic that ends up registered.
+func (sk *Scorekeeper) AddTopicIfAbsent(topic ScorekeeperTopic) ScoreValueFetcher {
+	sk.mtx.Lock()
+	defer sk.mtx.Unlock()
+	if existing, ok := sk.topics[topic.Plugin][topic.Name]; ok {
+		return existing.Fetcher
+	}
+	sk.addTopic(topic)
+	return topic.Fetcher
+}
+
+func (sk *Scorekeeper) addTopic(topic ScorekeeperTopic) {
 	sk.logger.Info("AddTopic: plugin=%s, name=%s", topic.Plugin.Name(), topic.Name)
 	entries, ok := sk.topics[topic.Plugin]
 	if !ok {
@@ -48,6 +78,8 @@ func (sk *Scorekeeper) Fetch(plugin Plugin, name string) (ScoreValueFetcher, err
 	var ok bool
 	var entries map[string]ScorekeeperTopic
 	var entry ScorekeeperTopic
+	sk.mtx.RLock()
+	defer sk.mtx.RUnlock()
 	entries, ok = sk.topics[plugin]
 	if ok {
 		entry, ok = entries[name]
@@ -62,7 +94,9 @@ func (sk *Scorekeeper) Dispose() {}
 
 func NewScorekeeper(logger Logger) *Scorekeeper {
 	return &Scorekeeper{
-		logger: logger,
-		topics: make(map[Plugin]map[string]ScorekeeperTopic),
+		logger:      logger,
+		topics:      make(map[Plugin]map[string]ScorekeeperTopic),
+		histories:   make(map[scoreHistoryKey]*ScoreHistory),
+		historySize: 2,
 	}
 }
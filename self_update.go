@@ -0,0 +1,285 @@
+package ik
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReleaseManifest describes the latest release.  Binaries are keyed by
+// GOOS/GOARCH; their URLs may be relative to the manifest.
+type ReleaseManifest struct {
+	Version  string                   `json:"version"`
+	Binaries map[string]ReleaseBinary `json:"binaries"`
+}
+
+type ReleaseBinary struct {
+	URL    string `json:"url"`
+	SHA256 string `json:"sha256"`
+}
+
+// SelfUpdater polls a signed release manifest and installs a newer binary
+// over the running executable.  Once installed, the path is sent to the
+// channel returned by Updated and polling stops; replacing the process is
+// up to the caller.
+type SelfUpdater struct {
+	logger      Logger
+	client      *http.Client
+	manifestURL string
+	verifier    ConfigVerifier
+	executable  string
+	version     string
+	ticker      Ticker
+	kick        chan bool
+	cancel      chan bool
+	cancelOnce  sync.Once
+	updated     chan string
+}
+
+// compareVersions compares dotted version strings numerically.
+func compareVersions(a string, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// selfUpdateMaxBinarySize is the largest binary downloaded.
+const selfUpdateMaxBinarySize = 512 * 1024 * 1024
+
+func (updater *SelfUpdater) open(url string) (io.ReadCloser, error) {
+	resp, err := updater.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("%s returned %s", url, resp.Status))
+	}
+	return resp.Body, nil
+}
+
+func (updater *SelfUpdater) get(url string, limit int64) ([]byte, error) {
+	body, err := updater.open(url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return ioutil.ReadAll(io.LimitReader(body, limit))
+}
+
+// download streams the binary to a temporary file in the directory of the
+// executable, so that it can be renamed into place, checking its digest
+// as it is written.  It returns the path of the file.
+func (updater *SelfUpdater) download(url string, sha256_ string) (string, error) {
+	body, err := updater.open(url)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+	file, err := ioutil.TempFile(filepath.Dir(updater.executable), filepath.Base(updater.executable)+".new.")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(body, selfUpdateMaxBinarySize+1))
+	if err == nil && n > selfUpdateMaxBinarySize {
+		err = errors.New(fmt.Sprintf("%s exceeds %d bytes", url, selfUpdateMaxBinarySize))
+	}
+	if err == nil && !strings.EqualFold(hex.EncodeToString(hash.Sum(nil)), sha256_) {
+		err = errors.New("checksum mismatch for " + url)
+	}
+	if err == nil {
+		err = file.Chmod(os.FileMode(0755))
+	}
+	err_ := file.Close()
+	if err == nil {
+		err = err_
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+func (updater *SelfUpdater) fetchManifest() (*ReleaseManifest, error) {
+	data, err := updater.get(updater.manifestURL, 1024*1024)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := updater.get(updater.manifestURL+RemoteConfigSignatureSuffix, 65536)
+	if err != nil {
+		return nil, err
+	}
+	err = updater.verifier.Verify(data, signature)
+	if err != nil {
+		return nil, errors.New("failed to verify the release manifest: " + err.Error())
+	}
+	manifest := &ReleaseManifest{}
+	err = json.Unmarshal(data, manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// install downloads the binary next to the executable, makes sure it runs
+// and reports the expected version, and then moves it into place.  The
+// previous binary is kept with the .old suffix.
+func (updater *SelfUpdater) install(manifest *ReleaseManifest, binary ReleaseBinary) error {
+	base, err := url.Parse(updater.manifestURL)
+	if err != nil {
+		return err
+	}
+	binaryURL, err := base.Parse(binary.URL)
+	if err != nil {
+		return err
+	}
+	newPath, err := updater.download(binaryURL.String(), binary.SHA256)
+	if err != nil {
+		return err
+	}
+	out, err := exec.Command(newPath, "-version").Output()
+	if err != nil || strings.TrimSpace(string(out)) != manifest.Version {
+		os.Remove(newPath)
+		if err == nil {
+			err = errors.New("it reports version " + strings.TrimSpace(string(out)))
+		}
+		return errors.New("the downloaded binary is not usable: " + err.Error())
+	}
+	oldPath := updater.executable + ".old"
+	os.Remove(oldPath)
+	err = os.Rename(updater.executable, oldPath)
+	if err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	err = os.Rename(newPath, updater.executable)
+	if err != nil {
+		os.Rename(oldPath, updater.executable)
+		return err
+	}
+	return nil
+}
+
+// Check installs the release in the manifest if it is newer than the
+// running one, and returns true if it did.
+func (updater *SelfUpdater) Check() (bool, error) {
+	manifest, err := updater.fetchManifest()
+	if err != nil {
+		return false, err
+	}
+	if compareVersions(manifest.Version, updater.version) <= 0 {
+		return false, nil
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	binary, ok := manifest.Binaries[platform]
+	if !ok {
+		return false, errors.New(fmt.Sprintf("release %s has no binary for %s", manifest.Version, platform))
+	}
+	updater.logger.Notice("Updating from %s to %s", updater.version, manifest.Version)
+	err = updater.install(manifest, binary)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (updater *SelfUpdater) Executable() string {
+	return updater.executable
+}
+
+// Updated returns the channel the path of the installed binary is sent to.
+func (updater *SelfUpdater) Updated() <-chan string {
+	return updater.updated
+}
+
+func (updater *SelfUpdater) Run() error {
+	select {
+	case <-updater.cancel:
+		return nil
+	case <-updater.kick:
+	case <-updater.ticker.C():
+	}
+	installed, err := updater.Check()
+	if err != nil {
+		updater.logger.Error("%s", err.Error())
+		return Continue
+	}
+	if !installed {
+		return Continue
+	}
+	updater.ticker.Stop()
+	updater.updated <- updater.executable
+	return nil
+}
+
+func (updater *SelfUpdater) Shutdown() error {
+	updater.ticker.Stop()
+	// Run may have returned already once the update got installed
+	updater.cancelOnce.Do(func() { close(updater.cancel) })
+	return nil
+}
+
+// NewSelfUpdater creates an updater for the running executable.  The
+// manifest is looked up on startup and then on the interval, by clock.
+func NewSelfUpdater(logger Logger, manifestURL string, verifier ConfigVerifier, interval time.Duration, clock Clock) (*SelfUpdater, error) {
+	if verifier == nil || verifier == InsecureConfigVerifier {
+		return nil, errors.New("self-update requires a verifier")
+	}
+	if interval <= 0 {
+		return nil, errors.New("invalid interval: " + interval.String())
+	}
+	// the binary is replaced where it is, not where a symlink to it is
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return nil, err
+	}
+	kick := make(chan bool, 1)
+	kick <- true
+	return &SelfUpdater{
+		logger:      logger,
+		client:      &http.Client{Timeout: 5 * time.Minute},
+		manifestURL: manifestURL,
+		verifier:    verifier,
+		executable:  executable,
+		version:     Version,
+		ticker:      clock.NewTicker(interval),
+		kick:        kick,
+		cancel:      make(chan bool),
+		updated:     make(chan string, 1),
+	}, nil
+}
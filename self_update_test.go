@@ -0,0 +1,172 @@
+package ik
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestCompareVersions(t *testing.T) {
+	cases := []struct {
+		a        string
+		b        string
+		expected int
+	}{
+		{"0.1.0", "0.1.0", 0},
+		{"0.1", "0.1.0", 0},
+		{"0.2.0", "0.1.9", 1},
+		{"v0.10.0", "0.9.0", 1},
+		{"1.0.0", "1.0.1", -1},
+	}
+	for _, c := range cases {
+		if compareVersions(c.a, c.b) != c.expected {
+			t.Logf("%s vs %s", c.a, c.b)
+			t.Fail()
+		}
+	}
+}
+
+func TestSelfUpdater_Check(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake binary is a shell script")
+	}
+	key := []byte("secret")
+	binary := []byte("#!/bin/sh\necho 99.0.0\n")
+	digest := sha256.Sum256(binary)
+	manifest := `{"version": "99.0.0", "binaries": {"` + runtime.GOOS + "/" + runtime.GOARCH + `": {"url": "ik.bin", "sha256": "` + hex.EncodeToString(digest[:]) + `"}}}`
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(manifest))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/release/manifest.json":
+			resp.Write([]byte(manifest))
+		case "/release/manifest.json.sig":
+			resp.Write([]byte(signature))
+		case "/release/ik.bin":
+			resp.Write(binary)
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "ik.self_update")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	executable := path.Join(tempDir, "ik")
+	err = ioutil.WriteFile(executable, []byte("old"), os.FileMode(0755))
+	if err != nil {
+		t.FailNow()
+	}
+
+	updater, err := NewSelfUpdater(logging.MustGetLogger("ik"), server.URL+"/release/manifest.json", NewHMACConfigVerifier(key), time.Hour, SystemClock)
+	if err != nil {
+		t.FailNow()
+	}
+	updater.executable = executable
+	installed, err := updater.Check()
+	if err != nil {
+		t.Log(err.Error())
+		t.FailNow()
+	}
+	if !installed {
+		t.FailNow()
+	}
+	data, _ := ioutil.ReadFile(executable)
+	if string(data) != string(binary) {
+		t.Fail()
+	}
+	data, _ = ioutil.ReadFile(executable + ".old")
+	if string(data) != "old" {
+		t.Fail()
+	}
+
+	updater.version = "99.0.0"
+	installed, err = updater.Check()
+	if err != nil || installed {
+		t.Fail()
+	}
+}
+
+func TestSelfUpdater_Shutdown(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	updater, err := NewSelfUpdater(logging.MustGetLogger("ik"), server.URL+"/manifest.json", NewHMACConfigVerifier([]byte("secret")), time.Hour, SystemClock)
+	if err != nil {
+		t.FailNow()
+	}
+	// nothing runs the updater, as it has stopped after an update
+	done := make(chan bool)
+	go func() {
+		updater.Shutdown()
+		updater.Shutdown()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown blocked")
+	}
+	<-updater.kick
+	if updater.Run() != nil {
+		t.Fail()
+	}
+}
+
+func TestSelfUpdater_Check_checksumMismatch(t *testing.T) {
+	key := []byte("secret")
+	manifest := `{"version": "99.0.0", "binaries": {"` + runtime.GOOS + "/" + runtime.GOARCH + `": {"url": "ik.bin", "sha256": "00"}}}`
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(manifest))
+	signature := base64.StdEncoding.EncodeToString(mac.Sum(nil))
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/manifest.json":
+			resp.Write([]byte(manifest))
+		case "/manifest.json.sig":
+			resp.Write([]byte(signature))
+		case "/ik.bin":
+			resp.Write([]byte("tampered"))
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	tempDir, err := ioutil.TempDir("", "ik.self_update")
+	if err != nil {
+		t.FailNow()
+	}
+	defer os.RemoveAll(tempDir)
+	executable := path.Join(tempDir, "ik")
+	err = ioutil.WriteFile(executable, []byte("old"), os.FileMode(0755))
+	if err != nil {
+		t.FailNow()
+	}
+
+	updater, err := NewSelfUpdater(logging.MustGetLogger("ik"), server.URL+"/manifest.json", NewHMACConfigVerifier(key), time.Hour, SystemClock)
+	if err != nil {
+		t.FailNow()
+	}
+	updater.executable = executable
+	installed, err := updater.Check()
+	if err == nil || installed {
+		t.Fail()
+	}
+	// the download is not left behind
+	files, _ := ioutil.ReadDir(tempDir)
+	if len(files) != 1 {
+		t.Fatalf("%v", files)
+	}
+}
@@ -1,6 +1,7 @@
 package ik
 
 import (
+	"bytes"
 	"sync"
 	"unsafe"
 )
@@ -37,6 +38,8 @@ func (slicer *Slicer) AddNewKeyEventListener(listener SlicerNewKeyEventListener)
 func (slicer *Slicer) Emit(recordSets []FluentRecordSet) error {
 	journals := make(map[string]Journal)
 	lastJournal := (Journal)(nil)
+	buf := AcquireBuffer()
+	defer ReleaseBuffer(buf)
 	for _, recordSet := range recordSets {
 		tag := recordSet.Tag
 		for _, record := range recordSet.Records {
@@ -46,7 +49,7 @@ func (slicer *Slicer) Emit(recordSets []FluentRecordSet) error {
 				record.Data,
 			}
 			key := slicer.keyGetter(fullRecord)
-			data, err := slicer.packer.Pack(fullRecord)
+			data, err := slicer.pack(buf, fullRecord)
 			if err != nil {
 				return err
 			}
@@ -72,6 +75,21 @@ func (slicer *Slicer) Emit(recordSets []FluentRecordSet) error {
 	return nil
 }
 
+// pack packs the record onto buf if the packer can, as the journals are
+// done with the data once Write returns and buf is reused for the next.
+func (slicer *Slicer) pack(buf *bytes.Buffer, record FluentRecord) ([]byte, error) {
+	packer, ok := slicer.packer.(BufferedRecordPacker)
+	if !ok {
+		return slicer.packer.Pack(record)
+	}
+	buf.Reset()
+	err := packer.PackTo(buf, record)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 func NewSlicer(journalGroup JournalGroup, keyGetter func(record FluentRecord) string, packer RecordPacker, logger Logger) *Slicer {
 	keys := make(map[string]bool)
 	for _, key := range journalGroup.GetJournalKeys() {
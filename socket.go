@@ -0,0 +1,198 @@
+package ik
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// SocketOptions tune the sockets of the network inputs and outputs.  They
+// are read by ParseSocketOptions from the attributes:
+//
+//	reuse_port true              # SO_REUSEPORT, for processes sharding a port
+//	recv_buffer_size 4m          # SO_RCVBUF
+//	send_buffer_size 4m          # SO_SNDBUF
+//	tcp_keepalive true           # on by default
+//	tcp_keepalive_interval 30s   # the idle time before the probes, and between them
+//	tcp_nodelay false            # on by default
+//	linger 0                     # SO_LINGER in seconds, left to the system by default
+//
+// The connections accepted by a listening socket take over its buffer
+// sizes.  A nil SocketOptions leaves everything to the defaults.
+type SocketOptions struct {
+	ReusePort      bool
+	RecvBufferSize int
+	SendBufferSize int
+	KeepAlive      time.Duration // 0 for the default, negative to disable
+	NoDelay        bool
+	Linger         int // negative to leave it to the system
+}
+
+type socketOptionsListener struct {
+	net.Listener
+	options *SocketOptions
+}
+
+var socketOptionNames = []string{"reuse_port", "recv_buffer_size", "send_buffer_size", "tcp_keepalive", "tcp_keepalive_interval", "tcp_nodelay", "linger"}
+
+func (options *SocketOptions) listenConfig() net.ListenConfig {
+	if options == nil {
+		return net.ListenConfig{}
+	}
+	return net.ListenConfig{Control: options.control(options.ReusePort), KeepAlive: options.KeepAlive}
+}
+
+// control returns the function setting the options of a socket before it
+// binds or connects.  The sockets connecting never reuse ports, lest they
+// be bound to the port of a listener of their own.
+func (options *SocketOptions) control(reusePort bool) func(network string, address string, c syscall.RawConn) error {
+	return func(network string, address string, c syscall.RawConn) error {
+		return options.setOptions(reusePort && !strings.HasPrefix(network, "unix"), c)
+	}
+}
+
+func (options *SocketOptions) setOptions(reusePort bool, c syscall.RawConn) error {
+	var err error
+	err_ := c.Control(func(fd uintptr) {
+		if reusePort {
+			err = setReusePort(fd)
+			if err != nil {
+				return
+			}
+		}
+		if options.RecvBufferSize > 0 {
+			err = setSocketBufferSize(fd, syscall.SO_RCVBUF, options.RecvBufferSize)
+			if err != nil {
+				return
+			}
+		}
+		if options.SendBufferSize > 0 {
+			err = setSocketBufferSize(fd, syscall.SO_SNDBUF, options.SendBufferSize)
+		}
+	})
+	if err_ != nil {
+		return err_
+	}
+	return err
+}
+
+// apply sets the options of a TCP connection established.
+func (options *SocketOptions) apply(conn net.Conn) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if options == nil || !ok {
+		return nil
+	}
+	err := tcpConn.SetNoDelay(options.NoDelay)
+	if err != nil {
+		return err
+	}
+	if options.Linger >= 0 {
+		return tcpConn.SetLinger(options.Linger)
+	}
+	return nil
+}
+
+// Dial is net.DialTimeout with the options.
+func (options *SocketOptions) Dial(network string, address string, timeout time.Duration) (net.Conn, error) {
+	if options == nil {
+		return net.DialTimeout(network, address, timeout)
+	}
+	dialer := &net.Dialer{Timeout: timeout, KeepAlive: options.KeepAlive, Control: options.control(false)}
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	err = options.apply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (listener *socketOptionsListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	err = listener.options.apply(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ParseSocketOptions reads the socket options of a plugin, and returns nil
+// if it has none of them.
+func ParseSocketOptions(config *ConfigElement) (*SocketOptions, error) {
+	given := false
+	for _, name := range socketOptionNames {
+		if _, ok := config.Attrs[name]; ok {
+			given = true
+		}
+	}
+	if !given {
+		return nil, nil
+	}
+	options := &SocketOptions{NoDelay: true, Linger: -1}
+	for _, name := range []string{"reuse_port", "tcp_keepalive", "tcp_nodelay"} {
+		valueStr, ok := config.Attrs[name]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseBool(valueStr)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("invalid %s: %s", name, valueStr))
+		}
+		switch name {
+		case "reuse_port":
+			options.ReusePort = value
+		case "tcp_keepalive":
+			if !value {
+				options.KeepAlive = -1
+			}
+		case "tcp_nodelay":
+			options.NoDelay = value
+		}
+	}
+	for _, name := range []string{"recv_buffer_size", "send_buffer_size"} {
+		valueStr, ok := config.Attrs[name]
+		if !ok {
+			continue
+		}
+		value, err := ParseCapacityString(valueStr)
+		if err != nil || value <= 0 || value > int64(^uint32(0)>>1) {
+			return nil, errors.New(fmt.Sprintf("invalid %s: %s", name, valueStr))
+		}
+		if name == "recv_buffer_size" {
+			options.RecvBufferSize = int(value)
+		} else {
+			options.SendBufferSize = int(value)
+		}
+	}
+	keepAliveIntervalStr, ok := config.Attrs["tcp_keepalive_interval"]
+	if ok {
+		if options.KeepAlive < 0 {
+			return nil, errors.New("tcp_keepalive_interval is given with tcp_keepalive disabled")
+		}
+		keepAliveInterval, err := time.ParseDuration(keepAliveIntervalStr)
+		if err != nil || keepAliveInterval <= 0 {
+			return nil, errors.New("invalid tcp_keepalive_interval: " + keepAliveIntervalStr)
+		}
+		options.KeepAlive = keepAliveInterval
+	}
+	lingerStr, ok := config.Attrs["linger"]
+	if ok {
+		linger, err := strconv.Atoi(lingerStr)
+		if err != nil || linger < 0 {
+			return nil, errors.New("invalid linger: " + lingerStr)
+		}
+		options.Linger = linger
+	}
+	return options, nil
+}
@@ -0,0 +1,4 @@
+package ik
+
+// the syscall package has no SO_REUSEPORT for Linux
+const soReusePort = 0xf
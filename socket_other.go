@@ -0,0 +1,6 @@
+//go:build !windows && !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !windows,!linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package ik
+
+const soReusePort = 0
@@ -0,0 +1,72 @@
+package ik
+
+import (
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestParseSocketOptions(t *testing.T) {
+	options, err := ParseSocketOptions(&ConfigElement{Attrs: map[string]string{"port": "24224"}})
+	if err != nil || options != nil {
+		t.Fail()
+	}
+	options, err = ParseSocketOptions(&ConfigElement{Attrs: map[string]string{
+		"reuse_port":             "true",
+		"recv_buffer_size":       "1m",
+		"tcp_keepalive_interval": "30s",
+		"tcp_nodelay":            "false",
+	}})
+	if err != nil || !options.ReusePort || options.RecvBufferSize != 1000000 || options.SendBufferSize != 0 || options.KeepAlive != 30*time.Second || options.NoDelay || options.Linger != -1 {
+		t.Fatalf("%v %v", err, options)
+	}
+	for _, attrs := range []map[string]string{
+		{"recv_buffer_size": "0"},
+		{"tcp_keepalive": "false", "tcp_keepalive_interval": "30s"},
+		{"linger": "-1"},
+		{"tcp_nodelay": "maybe"},
+	} {
+		if _, err := ParseSocketOptions(&ConfigElement{Attrs: attrs}); err == nil {
+			t.Fatalf("%v", attrs)
+		}
+	}
+}
+
+func TestListenAt_reusePort(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("reuse_port is not supported on Windows")
+	}
+	options := &SocketOptions{ReusePort: true, RecvBufferSize: 65536, NoDelay: false, Linger: 0}
+	first, err := ListenAt(&ListenAddress{Network: "tcp", Address: "127.0.0.1:0", Options: options})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer first.Close()
+	// the processes sharding a port listen on it all at once
+	second, err := ListenAt(&ListenAddress{Network: "tcp", Address: first.Addr().String(), Options: options})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer second.Close()
+	accepted := make(chan net.Conn, 2)
+	for _, listener := range []net.Listener{first, second} {
+		go func(listener net.Listener) {
+			conn, err := listener.Accept()
+			if err == nil {
+				accepted <- conn
+			}
+		}(listener)
+	}
+	conn, err := options.Dial("tcp", first.Addr().String(), time.Second)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer conn.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatal("the connection is not accepted")
+	}
+}
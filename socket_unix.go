@@ -0,0 +1,20 @@
+//go:build !windows
+// +build !windows
+
+package ik
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setReusePort(fd uintptr) error {
+	if soReusePort == 0 {
+		return errors.New("reuse_port is not supported on this platform")
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+}
+
+func setSocketBufferSize(fd uintptr, option int, size int) error {
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, option, size)
+}
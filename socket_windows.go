@@ -0,0 +1,17 @@
+//go:build windows
+// +build windows
+
+package ik
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setReusePort(fd uintptr) error {
+	return errors.New("reuse_port is not supported on Windows")
+}
+
+func setSocketBufferSize(fd uintptr, option int, size int) error {
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, option, size)
+}
@@ -1,9 +1,12 @@
 package ik
 
 import (
+	"context"
 	"fmt"
 	"reflect"
+	"runtime/debug"
 	"sync"
+	"time"
 )
 
 type descriptorListHead struct {
@@ -24,14 +27,34 @@ type spawneeDescriptor struct {
 	spawnee           Spawnee
 	exitStatus        error
 	shutdownRequested bool
+	state             string
+	startedAt         time.Time
+	restarts          int
+	lastError         error
+	panics            int
+	ctx               context.Context
+	cancel            context.CancelFunc
 	mtx               sync.Mutex
 	cond              *sync.Cond
 }
 
+// SpawneeStatus tells what a spawnee is up to.  Restarts counts the times
+// the spawnee was spawned again after it stopped, and LastError is the last
+// error one of its runs ended with, if any.  Panics counts the panics of its
+// runs and of its Emit, across the restarts.  Health is what CheckHealth
+// returned if the spawnee is a HealthChecker that is running, nil
+// otherwise.
 type SpawneeStatus struct {
-	Id         int
-	Spawnee    Spawnee
-	ExitStatus error
+	Id            int
+	Spawnee       Spawnee
+	ExitStatus    error
+	State         string
+	StartedAt     time.Time
+	Restarts      int
+	LastError     error
+	Panics        int
+	HealthChecked bool
+	Health        error
 }
 
 type dispatchReturnValue struct {
@@ -52,10 +75,31 @@ const (
 	Stopped = 2
 )
 
+// The states of a spawnee.  A spawnee is draining from the time it is told
+// to shut down to the time its Run returns.
+const (
+	SpawneeStarting = "starting"
+	SpawneeRunning  = "running"
+	SpawneeDraining = "draining"
+	SpawneeStopped  = "stopped"
+)
+
 type ContinueType struct{}
 
+// Panicked is the error a panic is turned into, along with the stack trace
+// of the goroutine at the panic.
 type Panicked struct {
 	panic interface{}
+	stack []byte
+}
+
+// NewPanicked is to be called in the deferred function that recovered r.
+func NewPanicked(r interface{}) *Panicked {
+	return &Panicked{r, debug.Stack()}
+}
+
+func (panicked *Panicked) Stack() []byte {
+	return panicked.stack
 }
 
 func (_ *ContinueType) Error() string { return "" }
@@ -108,6 +152,7 @@ type Spawner struct {
 	mtx       sync.Mutex
 	cond      *sync.Cond
 	lastEvent *spawnerEvent
+	onPanic   func(Spawnee, *Panicked)
 }
 
 func newDescriptor(spawnee Spawnee, id int) *spawneeDescriptor {
@@ -118,9 +163,12 @@ func newDescriptor(spawnee Spawnee, id int) *spawneeDescriptor {
 		spawnee:           spawnee,
 		exitStatus:        Continue,
 		shutdownRequested: false,
+		state:             SpawneeStarting,
+		startedAt:         time.Now(),
 		mtx:               sync.Mutex{},
 		cond:              nil,
 	}
+	retval.ctx, retval.cancel = context.WithCancel(context.Background())
 	retval.cond = sync.NewCond(&retval.mtx)
 	return retval
 }
@@ -131,6 +179,13 @@ func (spawner *Spawner) spawn(spawnee Spawnee, retval chan dispatchReturnValue)
 		func() {
 			spawner.mtx.Lock()
 			defer spawner.mtx.Unlock()
+			previous, ok := spawner.m[spawnee]
+			if ok && previous.exitStatus != Continue {
+				descriptor.id = previous.id
+				descriptor.restarts = previous.restarts + 1
+				descriptor.lastError = previous.lastError
+				descriptor.panics = previous.panics
+			}
 			if spawner.alives.last != nil {
 				spawner.alives.last.head_alive.next = descriptor
 				descriptor.head_alive.prev = spawner.alives.last
@@ -154,18 +209,45 @@ func (spawner *Spawner) spawn(spawnee Spawnee, retval chan dispatchReturnValue)
 			defer func() {
 				r := recover()
 				if r != nil {
-					exitStatus = &Panicked{r}
+					exitStatus = NewPanicked(r)
 				}
 			}()
 			exitStatus = Continue
+			spawner.mtx.Lock()
+			if descriptor.state == SpawneeStarting {
+				descriptor.state = SpawneeRunning
+			}
+			spawner.mtx.Unlock()
+			contextSpawnee, ok := descriptor.spawnee.(ContextSpawnee)
 			for exitStatus == Continue {
-				exitStatus = descriptor.spawnee.Run()
+				if ok {
+					exitStatus = contextSpawnee.RunContext(descriptor.ctx)
+				} else {
+					exitStatus = descriptor.spawnee.Run()
+				}
 			}
 		}()
+		descriptor.cancel()
+		panicked, ok := exitStatus.(*Panicked)
+		if ok {
+			spawner.mtx.Lock()
+			onPanic := spawner.onPanic
+			spawner.mtx.Unlock()
+			if onPanic != nil {
+				onPanic(spawnee, panicked)
+			}
+		}
 		func() {
 			spawner.mtx.Lock()
 			defer spawner.mtx.Unlock()
 			descriptor.exitStatus = exitStatus
+			descriptor.state = SpawneeStopped
+			if exitStatus != nil {
+				descriptor.lastError = exitStatus
+			}
+			if ok {
+				descriptor.panics += 1
+			}
 			// remove from alive list
 			if descriptor.head_alive.prev != nil {
 				descriptor.head_alive.prev.head_alive.next = descriptor.head_alive.next
@@ -195,18 +277,40 @@ func (spawner *Spawner) spawn(spawnee Spawnee, retval chan dispatchReturnValue)
 				spawnee: spawnee,
 			}
 			spawner.cond.Broadcast()
-			descriptor.cond.Broadcast()
 		}()
+		descriptor.mtx.Lock()
+		descriptor.cond.Broadcast()
+		descriptor.mtx.Unlock()
 	}()
 }
 
-func (spawner *Spawner) kill(spawnee Spawnee, retval chan dispatchReturnValue) {
+func (spawner *Spawner) kill(ctx context.Context, spawnee Spawnee, retval chan dispatchReturnValue) {
 	spawner.mtx.Lock()
 	descriptor, ok := spawner.m[spawnee]
 	spawner.mtx.Unlock()
-	if ok && descriptor.exitStatus != Continue {
+	if ok && descriptor.exitStatus == Continue {
 		descriptor.shutdownRequested = true
-		err := spawnee.Shutdown()
+		spawner.mtx.Lock()
+		descriptor.state = SpawneeDraining
+		spawner.mtx.Unlock()
+		var err error
+		contextSpawnee, ok := spawnee.(ContextSpawnee)
+		if ok {
+			// cancel what RunContext is doing once the deadline has passed,
+			// so that it gets back to see the shutdown
+			done := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					descriptor.cancel()
+				case <-done:
+				}
+			}()
+			err = contextSpawnee.ShutdownContext(ctx)
+			close(done)
+		} else {
+			err = spawnee.Shutdown()
+		}
 		retval <- dispatchReturnValue{true, nil, err, nil}
 	} else {
 		retval <- dispatchReturnValue{false, nil, nil, nil}
@@ -258,7 +362,16 @@ func (spawner *Spawner) getSpawneeStatuses(_ Spawnee, retval chan dispatchReturn
 	spawneeStatuses := make([]SpawneeStatus, len(spawner.m))
 	i := 0
 	for spawnee, descriptor := range spawner.m {
-		spawneeStatuses[i] = SpawneeStatus{Id: descriptor.id, Spawnee: spawnee, ExitStatus: descriptor.exitStatus}
+		spawneeStatuses[i] = SpawneeStatus{
+			Id:         descriptor.id,
+			Spawnee:    spawnee,
+			ExitStatus: descriptor.exitStatus,
+			State:      descriptor.state,
+			StartedAt:  descriptor.startedAt,
+			Restarts:   descriptor.restarts,
+			LastError:  descriptor.lastError,
+			Panics:     descriptor.panics,
+		}
 		i += 1
 	}
 	retval <- dispatchReturnValue{false, nil, nil, spawneeStatuses}
@@ -272,8 +385,17 @@ func (spawner *Spawner) Spawn(spawnee Spawnee) error {
 }
 
 func (spawner *Spawner) Kill(spawnee Spawnee) (bool, error) {
+	return spawner.KillContext(context.Background(), spawnee)
+}
+
+// KillContext shuts down the spawnee, cancelling the work of a
+// ContextSpawnee once ctx is done.
+func (spawner *Spawner) KillContext(ctx context.Context, spawnee Spawnee) (bool, error) {
 	retval := make(chan dispatchReturnValue)
-	spawner.c <- dispatch{spawner.kill, spawnee, retval}
+	kill := func(spawnee Spawnee, retval chan dispatchReturnValue) {
+		spawner.kill(ctx, spawnee, retval)
+	}
+	spawner.c <- dispatch{kill, spawnee, retval}
 	retval_ := <-retval
 	return retval_.b, retval_.e
 }
@@ -299,54 +421,82 @@ func (spawner *Spawner) GetStoppedSpawnees() ([]Spawnee, error) {
 	return retval_.s, retval_.e
 }
 
+// GetSpawneeStatuses returns the statuses of the spawnees, checking the
+// health of those running that are HealthCheckers.
 func (spawner *Spawner) GetSpawneeStatuses() ([]SpawneeStatus, error) {
 	retval := make(chan dispatchReturnValue)
 	spawner.c <- dispatch{spawner.getSpawneeStatuses, nil, retval}
 	retval_ := <-retval
+	// checked outside of the supervisor, which a slow check would hold up
+	for i := range retval_.ss {
+		spawneeStatus := &retval_.ss[i]
+		checker, ok := spawneeStatus.Spawnee.(HealthChecker)
+		if ok && spawneeStatus.State == SpawneeRunning {
+			spawneeStatus.HealthChecked = true
+			spawneeStatus.Health = checker.CheckHealth()
+		}
+	}
 	return retval_.ss, retval_.e
 }
 
+// SetPanicHandler sets the function told of a spawnee whose Run panicked,
+// before the spawnee is considered stopped.
+func (spawner *Spawner) SetPanicHandler(handler func(Spawnee, *Panicked)) {
+	spawner.mtx.Lock()
+	defer spawner.mtx.Unlock()
+	spawner.onPanic = handler
+}
+
+// countPanic counts a panic of the spawnee outside of its Run, e.g. of its
+// Emit, in its status.
+func (spawner *Spawner) countPanic(spawnee Spawnee) {
+	spawner.mtx.Lock()
+	defer spawner.mtx.Unlock()
+	descriptor, ok := spawner.m[spawnee]
+	if ok {
+		descriptor.panics += 1
+	}
+}
+
 func (spawner *Spawner) Poll(spawnee Spawnee) error {
+	spawner.mtx.Lock()
 	descriptor, ok := spawner.m[spawnee]
+	spawner.mtx.Unlock()
 	if !ok {
 		return NotFound
 	}
-	if func() bool {
+	defer descriptor.mtx.Unlock()
+	descriptor.mtx.Lock()
+	for func() bool {
 		spawner.mtx.Lock()
 		defer spawner.mtx.Unlock()
-		if descriptor.exitStatus != Continue {
-			return true
-		}
-		return false
+		return descriptor.exitStatus == Continue
 	}() {
-		return nil
+		descriptor.cond.Wait()
 	}
-	defer descriptor.mtx.Unlock()
-	descriptor.mtx.Lock()
-	descriptor.cond.Wait()
 	return nil
 }
 
+// PollMultiple waits for all the spawnees to stop.  The exit statuses are
+// looked at rather than the events, which may have gone by before this is
+// called.
 func (spawner *Spawner) PollMultiple(spawnees []Spawnee) error {
-	spawnees_ := make(map[Spawnee]bool)
-	for _, spawnee := range spawnees {
-		spawnees_[spawnee] = true
-	}
-	count := len(spawnees_)
-	for count > 0 {
-		spawner.mtx.Lock()
-		spawner.cond.Wait()
-		lastEvent := spawner.lastEvent
-		spawner.mtx.Unlock()
-		if lastEvent.t == Stopped {
-			spawnee := lastEvent.spawnee
-			if alive, ok := spawnees_[spawnee]; alive && ok {
-				spawnees_[spawnee] = false
-				count -= 1
+	spawner.mtx.Lock()
+	defer spawner.mtx.Unlock()
+	for {
+		alive := false
+		for _, spawnee := range spawnees {
+			descriptor, ok := spawner.m[spawnee]
+			if ok && descriptor.exitStatus == Continue {
+				alive = true
+				break
 			}
 		}
+		if !alive {
+			return nil
+		}
+		spawner.cond.Wait()
 	}
-	return nil
 }
 
 func NewSpawner() *Spawner {
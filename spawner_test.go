@@ -1,8 +1,10 @@
 package ik
 
 import (
+	"context"
 	"errors"
 	"testing"
+	"time"
 )
 
 type Foo struct {
@@ -32,6 +34,28 @@ func (bar *Bar) Shutdown() error {
 	return nil
 }
 
+// Qux blocks in RunContext until it is cancelled.
+type Qux struct{ stopped chan bool }
+
+func (qux *Qux) Run() error {
+	return qux.RunContext(context.Background())
+}
+
+func (qux *Qux) RunContext(ctx context.Context) error {
+	<-ctx.Done()
+	close(qux.stopped)
+	return ctx.Err()
+}
+
+func (qux *Qux) Shutdown() error {
+	return qux.ShutdownContext(context.Background())
+}
+
+func (qux *Qux) ShutdownContext(ctx context.Context) error {
+	<-qux.stopped
+	return nil
+}
+
 type Baz struct{ message string }
 
 func (baz *Baz) String() string {
@@ -72,7 +96,7 @@ func TestSpawner_Panic1(t *testing.T) {
 	if !ok {
 		t.Fail()
 	}
-	if panicked.Error() != "PANIC" {
+	if panicked.Error() != "PANIC" || len(panicked.Stack()) == 0 {
 		t.Fail()
 	}
 }
@@ -96,3 +120,78 @@ func TestSpawner_Panic2(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestSpawner_KillContext(t *testing.T) {
+	spawner := NewSpawner()
+	f := &Qux{make(chan bool)}
+	spawner.Spawn(f)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	ok, err := spawner.KillContext(ctx, f)
+	if !ok || err != nil {
+		t.Fail()
+	}
+	spawner.Poll(f)
+	err = spawner.GetStatus(f)
+	if err != context.Canceled {
+		t.Fail()
+	}
+}
+
+type unhealthyFoo struct {
+	Foo
+}
+
+func (foo *unhealthyFoo) CheckHealth() error {
+	return errors.New("unreachable")
+}
+
+func spawneeStatusOf(t *testing.T, spawner *Spawner, spawnee Spawnee) SpawneeStatus {
+	spawneeStatuses, err := spawner.GetSpawneeStatuses()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	for _, spawneeStatus := range spawneeStatuses {
+		if spawneeStatus.Spawnee == spawnee {
+			return spawneeStatus
+		}
+	}
+	t.Fatal("no status of the spawnee")
+	return SpawneeStatus{}
+}
+
+func TestSpawner_GetSpawneeStatuses(t *testing.T) {
+	spawner := NewSpawner()
+	f := &unhealthyFoo{Foo{"", make(chan string)}}
+	spawner.Spawn(f)
+	deadline := time.Now().Add(time.Second)
+	for spawneeStatusOf(t, spawner, f).State != SpawneeRunning {
+		if time.Now().After(deadline) {
+			t.Fatal("the spawnee never ran")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	spawneeStatus := spawneeStatusOf(t, spawner, f)
+	if !spawneeStatus.HealthChecked || spawneeStatus.Health == nil || spawneeStatus.Health.Error() != "unreachable" || spawneeStatus.Restarts != 0 || spawneeStatus.LastError != nil || spawneeStatus.StartedAt.IsZero() {
+		t.Fatalf("%v", spawneeStatus)
+	}
+	f.c <- "first"
+	spawner.Poll(f)
+	spawneeStatus = spawneeStatusOf(t, spawner, f)
+	if spawneeStatus.State != SpawneeStopped || spawneeStatus.HealthChecked || spawneeStatus.LastError.Error() != "first" {
+		t.Fatalf("%v", spawneeStatus)
+	}
+	id := spawneeStatus.Id
+
+	// spawned again, it keeps its id and what happened before
+	spawner.Spawn(f)
+	spawneeStatus = spawneeStatusOf(t, spawner, f)
+	if spawneeStatus.Id != id || spawneeStatus.Restarts != 1 || spawneeStatus.LastError.Error() != "first" || spawneeStatus.ExitStatus != Continue {
+		t.Fatalf("%v", spawneeStatus)
+	}
+	spawner.Kill(f)
+	spawner.Poll(f)
+	if spawneeStatusOf(t, spawner, f).LastError.Error() != "ok" {
+		t.Fail()
+	}
+}
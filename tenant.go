@@ -0,0 +1,323 @@
+package ik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tenants keep apart the records of the teams an agent serves.  They are
+// configured by a <tenants> element at the top level of the configuration:
+//
+//	<tenants>
+//	  key tenant                     # the field the tenant is stamped in
+//	  <tenant team-a>
+//	    max_records_per_sec 1000     # at its inputs, 0 for no limit
+//	    max_buffered_bytes 1g        # in each buffer, 0 for no limit
+//	    overflow_action dead_letter  # or drop, or block
+//	  </tenant>
+//	</tenants>
+//
+// A <source> with @tenant stamps the records of the input with the tenant,
+// and prefixes their tags with its name and a dot, so that each tenant has
+// tags of its own.  The buffered outputs keep the records of a tenant in
+// journals of its own, and hold them to its max_buffered_bytes.  The
+// records beyond a quota of the tenant are dropped, handed over to the
+// dead-letter queue, or held back for block: an input waits for the rate to
+// allow them, and a buffer refuses them with an error for the sender to
+// retry.  A tenant without a <tenant> element has no quotas.  The zero
+// value has no tenants.
+type Tenants struct {
+	key     string
+	tenants map[string]*Tenant
+	mtx     sync.RWMutex
+}
+
+// Tenant is the quotas of a tenant, and the records it overflowed them by.
+type Tenant struct {
+	Name             string
+	MaxRecordsPerSec float64
+	MaxBufferedBytes int64
+	OverflowAction   string
+	tokens           float64
+	last             time.Time
+	overflows        int64
+	mtx              sync.Mutex
+}
+
+type tenantPort struct {
+	port    Port
+	engine  Engine
+	tenants *Tenants
+	name    string
+}
+
+type tenantFetcher struct {
+	engine *engineImpl
+}
+
+var tenantNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Key returns the field the tenant of a record is stamped in, or "" if no
+// tenants are configured.
+func (tenants *Tenants) Key() string {
+	tenants.mtx.RLock()
+	defer tenants.mtx.RUnlock()
+	return tenants.key
+}
+
+// Lookup returns the tenant of the given name, or nil if it has no quotas.
+func (tenants *Tenants) Lookup(name string) *Tenant {
+	tenants.mtx.RLock()
+	defer tenants.mtx.RUnlock()
+	return tenants.tenants[name]
+}
+
+// Names returns the names of the tenants that have quotas.
+func (tenants *Tenants) Names() []string {
+	tenants.mtx.RLock()
+	defer tenants.mtx.RUnlock()
+	retval := make([]string, 0, len(tenants.tenants))
+	for name := range tenants.tenants {
+		retval = append(retval, name)
+	}
+	sort.Strings(retval)
+	return retval
+}
+
+// Of returns the tenant a record is stamped with, or "" if it is stamped
+// with none or with something that cannot be the name of one.
+func (tenants *Tenants) Of(data map[string]interface{}) string {
+	key := tenants.Key()
+	if key == "" || data == nil {
+		return ""
+	}
+	name, ok := data[key].(string)
+	if !ok || !tenantNamePattern.MatchString(name) {
+		return ""
+	}
+	return name
+}
+
+// replace makes the tenants those of other, or none if other is nil.
+func (tenants *Tenants) replace(other *Tenants) {
+	key, tenants_ := "", map[string]*Tenant(nil)
+	if other != nil {
+		key, tenants_ = other.key, other.tenants
+	}
+	tenants.mtx.Lock()
+	defer tenants.mtx.Unlock()
+	tenants.key = key
+	tenants.tenants = tenants_
+}
+
+// take takes n records off the rate of the tenant if any is left at now,
+// letting the rate run into debt, and returns 0; otherwise it returns how
+// long it takes for some to be left.  The rate allows up to a second's worth
+// at once.
+func (tenant *Tenant) take(now time.Time, n int) time.Duration {
+	if tenant.MaxRecordsPerSec <= 0 {
+		return 0
+	}
+	tenant.mtx.Lock()
+	defer tenant.mtx.Unlock()
+	if tenant.last.IsZero() {
+		tenant.tokens = tenant.MaxRecordsPerSec
+	} else if now.After(tenant.last) {
+		tenant.tokens += now.Sub(tenant.last).Seconds() * tenant.MaxRecordsPerSec
+		if tenant.tokens > tenant.MaxRecordsPerSec {
+			tenant.tokens = tenant.MaxRecordsPerSec
+		}
+	}
+	tenant.last = now
+	if tenant.tokens > 0 {
+		tenant.tokens -= float64(n)
+		return 0
+	}
+	return time.Duration((-tenant.tokens/tenant.MaxRecordsPerSec)*float64(time.Second)) + time.Millisecond
+}
+
+// Overflow counts records the tenant went over its quotas by.
+func (tenant *Tenant) Overflow(n int) {
+	atomic.AddInt64(&tenant.overflows, int64(n))
+}
+
+// Overflows returns the number of records the tenant went over its quotas
+// by so far.
+func (tenant *Tenant) Overflows() int64 {
+	return atomic.LoadInt64(&tenant.overflows)
+}
+
+func (port *tenantPort) stamp(recordSets []FluentRecordSet) int {
+	key := port.tenants.Key()
+	count := 0
+	for i, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			if record.Data != nil {
+				record.Data[key] = port.name
+			}
+		}
+		recordSets[i].Tag = port.name + "." + recordSet.Tag
+		recordSets[i].Packed = nil
+		count += len(recordSet.Records)
+	}
+	return count
+}
+
+// admit stamps the records and holds them to the rate of the tenant, and
+// tells whether they are to be emitted.
+func (port *tenantPort) admit(ctx context.Context, recordSets []FluentRecordSet) (bool, error) {
+	count := port.stamp(recordSets)
+	tenant := port.tenants.Lookup(port.name)
+	if tenant == nil || count == 0 {
+		return true, nil
+	}
+	clock := port.engine.Clock()
+	for {
+		wait := tenant.take(clock.Now(), count)
+		if wait == 0 {
+			return true, nil
+		}
+		switch tenant.OverflowAction {
+		case "block":
+			timer := clock.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return false, ctx.Err()
+			case <-timer.C():
+			}
+			continue
+		case "dead_letter":
+			port.engine.DeadLetter(EnginePlugin, errors.New(fmt.Sprintf("tenant %s exceeds max_records_per_sec of %g", port.name, tenant.MaxRecordsPerSec)), recordSets)
+		}
+		tenant.Overflow(count)
+		return false, nil
+	}
+}
+
+func (port *tenantPort) Emit(recordSets []FluentRecordSet) error {
+	ok, err := port.admit(context.Background(), recordSets)
+	if !ok {
+		return err
+	}
+	return port.port.Emit(recordSets)
+}
+
+func (port *tenantPort) EmitContext(ctx context.Context, recordSets []FluentRecordSet) error {
+	ok, err := port.admit(ctx, recordSets)
+	if !ok {
+		return err
+	}
+	return EmitContext(ctx, port.port, recordSets)
+}
+
+func (port *tenantPort) EmitDurably(recordSets []FluentRecordSet) error {
+	ok, err := port.admit(context.Background(), recordSets)
+	if !ok {
+		return err
+	}
+	return EmitDurably(port.port, recordSets)
+}
+
+func (port *tenantPort) EmitWithResult(recordSets []FluentRecordSet) []error {
+	ok, err := port.admit(context.Background(), recordSets)
+	if !ok {
+		return resultsOf(len(recordSets), err)
+	}
+	return EmitWithResult(port.port, recordSets)
+}
+
+func (port *tenantPort) ForSource(address string) Port {
+	return &tenantPort{PortForSource(port.port, address), port.engine, port.tenants, port.name}
+}
+
+// wrapEngine returns the engine to create an input of the tenant with.
+func (tenants *Tenants) wrapEngine(engine Engine, name string) Engine {
+	return &portEngine{
+		Engine: engine,
+		port:   &tenantPort{engine.DefaultPort(), engine, tenants, name},
+	}
+}
+
+func (fetcher *tenantFetcher) Markup(pluginInstance PluginInstance) (Markup, error) {
+	text, err := fetcher.PlainText(pluginInstance)
+	if err != nil {
+		return Markup{}, err
+	}
+	return Markup{[]MarkupChunk{{Text: text}}}, nil
+}
+
+func (fetcher *tenantFetcher) PlainText(_ PluginInstance) (string, error) {
+	tenants := fetcher.engine.Tenants()
+	text := ""
+	for i, name := range tenants.Names() {
+		if i > 0 {
+			text += ", "
+		}
+		text += fmt.Sprintf("%s: %d", name, tenants.Lookup(name).Overflows())
+	}
+	return text, nil
+}
+
+// ParseTenants reads the <tenants> element of the configuration, and
+// returns nil if there is none.
+func ParseTenants(config *Config) (*Tenants, error) {
+	for _, v := range config.Root.Elems {
+		if v.Name != "tenants" {
+			continue
+		}
+		tenants := &Tenants{key: "tenant", tenants: make(map[string]*Tenant)}
+		key, ok := v.Attrs["key"]
+		if ok {
+			if key == "" {
+				return nil, errors.New("invalid key of <tenants>")
+			}
+			tenants.key = key
+		}
+		for _, w := range v.Elems {
+			if w.Name != "tenant" {
+				return nil, errors.New(fmt.Sprintf("unexpected <%s> in <tenants>", w.Name))
+			}
+			if !tenantNamePattern.MatchString(w.Args) {
+				return nil, errors.New(fmt.Sprintf("invalid tenant name: %s", w.Args))
+			}
+			if tenants.tenants[w.Args] != nil {
+				return nil, errors.New("duplicate tenant: " + w.Args)
+			}
+			tenant := &Tenant{Name: w.Args, OverflowAction: "drop"}
+			maxRecordsPerSecStr, ok := w.Attrs["max_records_per_sec"]
+			if ok {
+				var err error
+				tenant.MaxRecordsPerSec, err = strconv.ParseFloat(maxRecordsPerSecStr, 64)
+				if err != nil || tenant.MaxRecordsPerSec < 0 {
+					return nil, errors.New(fmt.Sprintf("invalid max_records_per_sec: %s", maxRecordsPerSecStr))
+				}
+			}
+			maxBufferedBytesStr, ok := w.Attrs["max_buffered_bytes"]
+			if ok {
+				var err error
+				tenant.MaxBufferedBytes, err = ParseCapacityString(maxBufferedBytesStr)
+				if err != nil || tenant.MaxBufferedBytes < 0 {
+					return nil, errors.New(fmt.Sprintf("invalid max_buffered_bytes: %s", maxBufferedBytesStr))
+				}
+			}
+			overflowAction, ok := w.Attrs["overflow_action"]
+			if ok {
+				if overflowAction != "drop" && overflowAction != "dead_letter" && overflowAction != "block" {
+					return nil, errors.New("unsupported overflow_action: " + overflowAction)
+				}
+				tenant.OverflowAction = overflowAction
+			}
+			tenants.tenants[w.Args] = tenant
+		}
+		return tenants, nil
+	}
+	return nil, nil
+}
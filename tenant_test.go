@@ -0,0 +1,141 @@
+package ik
+
+import (
+	"testing"
+	"time"
+)
+
+type tenantTestEngine struct {
+	Engine
+	clock       Clock
+	deadLetters []FluentRecordSet
+}
+
+type tenantTestClock struct {
+	Clock
+	now time.Time
+}
+
+func (clock *tenantTestClock) Now() time.Time {
+	return clock.now
+}
+
+func (engine *tenantTestEngine) Clock() Clock {
+	return engine.clock
+}
+
+func (engine *tenantTestEngine) DeadLetter(plugin interface{}, cause error, recordSets []FluentRecordSet) {
+	engine.deadLetters = append(engine.deadLetters, recordSets...)
+}
+
+func TestParseTenants(t *testing.T) {
+	const data = "<tenants>\n" +
+		"<tenant team-a>\n" +
+		"max_records_per_sec 10\n" +
+		"max_buffered_bytes 1k\n" +
+		"overflow_action dead_letter\n" +
+		"</tenant>\n" +
+		"<tenant team-b>\n" +
+		"</tenant>\n" +
+		"</tenants>\n"
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tenants, err := ParseTenants(config)
+	if err != nil || tenants == nil {
+		t.FailNow()
+	}
+	tenant := tenants.Lookup("team-a")
+	if tenants.Key() != "tenant" || tenant == nil || tenant.MaxRecordsPerSec != 10 || tenant.MaxBufferedBytes != 1000 || tenant.OverflowAction != "dead_letter" {
+		t.Fatalf("%v", tenant)
+	}
+	if tenant = tenants.Lookup("team-b"); tenant == nil || tenant.OverflowAction != "drop" || tenant.MaxRecordsPerSec != 0 {
+		t.Fatalf("%v", tenant)
+	}
+	if names := tenants.Names(); len(names) != 2 || names[0] != "team-a" {
+		t.Fatalf("%v", names)
+	}
+	if tenants.Of(map[string]interface{}{"tenant": "team-c"}) != "team-c" || tenants.Of(map[string]interface{}{"tenant": "../etc"}) != "" {
+		t.Fail()
+	}
+	for _, data := range []string{
+		"<tenants>\n<tenant a/b>\n</tenant>\n</tenants>\n",
+		"<tenants>\n<tenant a>\n</tenant>\n<tenant a>\n</tenant>\n</tenants>\n",
+		"<tenants>\n<tenant a>\noverflow_action retry\n</tenant>\n</tenants>\n",
+		"<tenants>\n<quota a>\n</quota>\n</tenants>\n",
+	} {
+		config, _ = ParseConfig(myOpener(data), "test.cfg")
+		if _, err = ParseTenants(config); err == nil {
+			t.Fatalf("%s", data)
+		}
+	}
+}
+
+func TestTenantPort(t *testing.T) {
+	tenants := &Tenants{key: "tenant", tenants: map[string]*Tenant{
+		"team-a": {Name: "team-a", MaxRecordsPerSec: 2, OverflowAction: "drop"},
+		"team-b": {Name: "team-b", MaxRecordsPerSec: 2, OverflowAction: "dead_letter"},
+	}}
+	port := &recordingPort{}
+	clock := &tenantTestClock{now: time.Unix(1000, 0)}
+	engine := &tenantTestEngine{Engine: &portEngine{port: port}, clock: clock}
+	record := func() TinyFluentRecord {
+		return TinyFluentRecord{Timestamp: 1, Data: map[string]interface{}{"a": 1}}
+	}
+	emit := func(engine Engine) error {
+		return engine.DefaultPort().Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{record(), record()}}})
+	}
+
+	// the records are stamped, and tagged by the tenant
+	a := tenants.wrapEngine(engine, "team-a")
+	if err := emit(a); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(port.recordSets) != 1 || port.recordSets[0].Tag != "team-a.test" || port.recordSets[0].Records[1].Data["tenant"] != "team-a" {
+		t.Fatalf("%v", port.recordSets)
+	}
+	// the rate is used up until a second passes
+	if err := emit(a); err != nil || len(port.recordSets) != 1 || tenants.Lookup("team-a").Overflows() != 2 {
+		t.Fatalf("%v %v", err, port.recordSets)
+	}
+	clock.now = clock.now.Add(time.Second)
+	if err := emit(a); err != nil || len(port.recordSets) != 2 {
+		t.Fatalf("%v %v", err, port.recordSets)
+	}
+	// each tenant has its own rate and overflows on its own terms
+	b := tenants.wrapEngine(engine, "team-b")
+	emit(b)
+	emit(b)
+	if len(port.recordSets) != 3 || len(engine.deadLetters) != 1 || engine.deadLetters[0].Tag != "team-b.test" {
+		t.Fatalf("%v %v", port.recordSets, engine.deadLetters)
+	}
+	// a tenant without quotas only has its records stamped
+	emit(tenants.wrapEngine(engine, "team-c"))
+	emit(tenants.wrapEngine(engine, "team-c"))
+	if len(port.recordSets) != 5 || port.recordSets[4].Tag != "team-c.test" {
+		t.Fatalf("%v", port.recordSets)
+	}
+}
+
+func TestTenantPort_Block(t *testing.T) {
+	tenants := &Tenants{key: "tenant", tenants: map[string]*Tenant{
+		"team-a": {Name: "team-a", MaxRecordsPerSec: 1000, OverflowAction: "block"},
+	}}
+	port := &recordingPort{}
+	engine := tenants.wrapEngine(&tenantTestEngine{Engine: &portEngine{port: port}, clock: SystemClock}, "team-a")
+	records := make([]TinyFluentRecord, 1000)
+	for i := range records {
+		records[i] = TinyFluentRecord{Data: map[string]interface{}{}}
+	}
+	// the second emission waits for the rate rather than overflowing
+	for i := 0; i < 2; i += 1 {
+		err := engine.DefaultPort().Emit([]FluentRecordSet{{Tag: "test", Records: records[0 : 1000-i*990]}})
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(port.recordSets) != 2 || tenants.Lookup("team-a").Overflows() != 0 {
+		t.Fatalf("%d", len(port.recordSets))
+	}
+}
@@ -0,0 +1,72 @@
+package ik
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var utcOffsetRegExp = regexp.MustCompile("^([+-])([0-9]{2}):?([0-9]{2})$")
+
+// ParseLocation reads a timezone given either by its name in the tz
+// database, like Asia/Tokyo, or as an offset from UTC, like +09:00.
+// "localtime" stands for the timezone of the host.
+func ParseLocation(s string) (*time.Location, error) {
+	if s == "localtime" {
+		return time.Local, nil
+	}
+	m := utcOffsetRegExp.FindStringSubmatch(s)
+	if m != nil {
+		hours, _ := strconv.Atoi(m[2])
+		minutes, _ := strconv.Atoi(m[3])
+		offset := hours*3600 + minutes*60
+		if m[1] == "-" {
+			offset = -offset
+		}
+		return time.FixedZone(s, offset), nil
+	}
+	location, err := time.LoadLocation(s)
+	if err != nil {
+		return nil, errors.New("unknown timezone: " + s)
+	}
+	return location, nil
+}
+
+// LocationFromConfig returns the location given by the timezone attribute,
+// or defaultLocation if there is none.
+func LocationFromConfig(config *ConfigElement, defaultLocation *time.Location) (*time.Location, error) {
+	timezone, ok := config.Attrs["timezone"]
+	if !ok {
+		return defaultLocation, nil
+	}
+	return ParseLocation(timezone)
+}
+
+// TimeSlot returns the start of the slot of the interval t falls in, in the
+// location of t.  Slots of whole days start at midnight and are counted by
+// the calendar, as a day lasts 23 or 25 hours when daylight saving time
+// begins or ends.  Slots of an interval dividing a day are counted from
+// midnight by the offset in effect at t, so that hourly slots follow the
+// clock on such days too.  Other intervals are counted from the epoch.
+func TimeSlot(t time.Time, interval time.Duration) time.Time {
+	const day = 24 * time.Hour
+	if interval <= 0 {
+		return t
+	}
+	year, month, date := t.Date()
+	if interval%day == 0 {
+		days := int(interval / day)
+		elapsedDays := int(time.Date(year, month, date, 0, 0, 0, 0, time.UTC).Unix() / 86400)
+		r := elapsedDays % days
+		if r < 0 {
+			r += days
+		}
+		return time.Date(year, month, date-r, 0, 0, 0, 0, t.Location())
+	} else if day%interval == 0 {
+		_, offset := t.Zone()
+		midnight := time.Date(year, month, date, 0, 0, 0, 0, time.FixedZone("", offset))
+		return midnight.Add(t.Sub(midnight) / interval * interval).In(t.Location())
+	}
+	return time.Unix(0, t.UnixNano()/int64(interval)*int64(interval)).In(t.Location())
+}
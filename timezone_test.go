@@ -0,0 +1,62 @@
+package ik
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseLocation(t *testing.T) {
+	location, err := ParseLocation("+09:00")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, offset := time.Unix(0, 0).In(location).Zone()
+	if offset != 9*3600 {
+		t.Errorf("%d", offset)
+	}
+	location, err = ParseLocation("-0530")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	_, offset = time.Unix(0, 0).In(location).Zone()
+	if offset != -(5*3600 + 30*60) {
+		t.Errorf("%d", offset)
+	}
+	location, err = ParseLocation("localtime")
+	if err != nil || location != time.Local {
+		t.Fail()
+	}
+	_, err = ParseLocation("Nowhere/Special")
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestTimeSlot(t *testing.T) {
+	location, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip(err.Error())
+	}
+	const layout = "2006-01-02 15:04 MST"
+	for _, case_ := range []struct {
+		time     time.Time
+		interval time.Duration
+		expected string
+	}{
+		// the day daylight saving time ends lasts 25 hours
+		{time.Date(2014, 11, 2, 23, 30, 0, 0, location), 24 * time.Hour, "2014-11-02 00:00 EDT"},
+		{time.Date(2014, 11, 3, 0, 30, 0, 0, location), 24 * time.Hour, "2014-11-03 00:00 EST"},
+		{time.Date(2014, 11, 2, 1, 30, 0, 0, location).Add(time.Hour), time.Hour, "2014-11-02 01:00 EST"},
+		{time.Date(2014, 11, 2, 13, 0, 0, 0, location), 12 * time.Hour, "2014-11-02 12:00 EST"},
+		// and the day it begins 23 hours
+		{time.Date(2014, 3, 9, 3, 30, 0, 0, location), time.Hour, "2014-03-09 03:00 EDT"},
+		{time.Date(2014, 3, 9, 23, 59, 0, 0, location), 24 * time.Hour, "2014-03-09 00:00 EST"},
+		{time.Date(2014, 3, 10, 12, 0, 0, 0, location), 48 * time.Hour, "2014-03-09 00:00 EST"},
+		{time.Date(2014, 3, 9, 7, 30, 0, 0, time.UTC), 7 * time.Hour, "2014-03-09 05:00 UTC"},
+	} {
+		slot := TimeSlot(case_.time, case_.interval).Format(layout)
+		if slot != case_.expected {
+			t.Errorf("%s / %s: %s", case_.time.Format(layout), case_.interval.String(), slot)
+		}
+	}
+}
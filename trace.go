@@ -0,0 +1,327 @@
+package ik
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The stages of the hops of a trace.
+const (
+	TraceInput        = "input"
+	TraceFilterIn     = "filter_in"
+	TraceFilterOut    = "filter_out"
+	TraceOutput       = "output"
+	TraceJournalWrite = "journal_write"
+	TraceChunkFlush   = "chunk_flush"
+	TraceDelivery     = "delivery"
+)
+
+// Tracing selects the records to trace.  It is enabled by a <trace>
+// element at the top level of the configuration:
+//
+//	<trace>
+//	  pattern app.**      # the tags to trace, ** by default
+//	  sample_rate 0.01    # the fraction of the records traced, 1 by default
+//	  key _trace_id       # where the trace id is put in the records
+//	  max_traces 1000     # the number of traces kept in memory
+//	</trace>
+type Tracing struct {
+	Pattern    *regexp.Regexp
+	SampleRate float64
+	Key        string
+	MaxTraces  int
+}
+
+// TraceHop is a point a traced record went through.  The latency is that
+// of the output emit or of the delivery, and zero for the other stages.
+type TraceHop struct {
+	Time    time.Time     `json:"time"`
+	Stage   string        `json:"stage"`
+	Plugin  string        `json:"plugin"`
+	Tag     string        `json:"tag"`
+	Latency time.Duration `json:"latency_ns,omitempty"`
+}
+
+type Trace struct {
+	Id   string     `json:"id"`
+	Hops []TraceHop `json:"hops"`
+}
+
+// Tracer stamps a trace id on the records sampled as they are emitted by
+// the inputs, and remembers the hops each of them goes through afterwards,
+// logging them as well.  Records that already carry a trace id, e.g. given
+// by the forwarder they came from, are traced further under that id.  Only
+// the last max_traces traces are kept.
+type Tracer struct {
+	logger  Logger
+	tracing *Tracing
+	traces  map[string]*Trace
+	order   []string
+	mtx     sync.Mutex
+	clock   Clock
+	sampler func() float64
+}
+
+func NewTracer(logger Logger, clock Clock) *Tracer {
+	return &Tracer{
+		logger:  logger,
+		traces:  make(map[string]*Trace),
+		order:   make([]string, 0),
+		clock:   clock,
+		sampler: randomFraction,
+	}
+}
+
+func randomFraction() float64 {
+	var b [8]byte
+	rand.Read(b[:])
+	return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53)
+}
+
+func newTraceId() string {
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func (tracer *Tracer) setTracing(tracing *Tracing) {
+	tracer.mtx.Lock()
+	defer tracer.mtx.Unlock()
+	tracer.tracing = tracing
+	if tracing == nil {
+		return
+	}
+	for len(tracer.order) > tracing.MaxTraces {
+		tracer.evict()
+	}
+}
+
+// Enabled tells whether records are being traced.
+func (tracer *Tracer) Enabled() bool {
+	tracer.mtx.Lock()
+	defer tracer.mtx.Unlock()
+	return tracer.tracing != nil
+}
+
+// evict forgets the oldest trace.  The caller holds the lock.
+func (tracer *Tracer) evict() {
+	delete(tracer.traces, tracer.order[0])
+	tracer.order = tracer.order[1:]
+}
+
+// add records a hop of the trace of id.  The caller holds the lock.
+func (tracer *Tracer) add(id string, hop TraceHop) {
+	trace, ok := tracer.traces[id]
+	if !ok {
+		if len(tracer.order) >= tracer.tracing.MaxTraces {
+			tracer.evict()
+		}
+		trace = &Trace{Id: id, Hops: make([]TraceHop, 0, 8)}
+		tracer.traces[id] = trace
+		tracer.order = append(tracer.order, id)
+	}
+	trace.Hops = append(trace.Hops, hop)
+	text := hop.Plugin + " " + hop.Stage
+	if hop.Tag != "" {
+		text += " of " + hop.Tag
+	}
+	if hop.Latency > 0 {
+		text += " (" + hop.Latency.String() + ")"
+	}
+	tracer.logger.Info("trace %s: %s", id, text)
+}
+
+// start stamps a trace id on the records sampled, and records the input
+// hop of every record traced.
+func (tracer *Tracer) start(plugin string, recordSets []FluentRecordSet) {
+	tracer.mtx.Lock()
+	defer tracer.mtx.Unlock()
+	tracing := tracer.tracing
+	if tracing == nil {
+		return
+	}
+	now := tracer.clock.Now()
+	for i, recordSet := range recordSets {
+		if !tracing.Pattern.MatchString(recordSet.Tag) {
+			continue
+		}
+		for _, record := range recordSet.Records {
+			if record.Data == nil {
+				continue
+			}
+			id, ok := record.Data[tracing.Key].(string)
+			if !ok {
+				if tracing.SampleRate < 1 && tracer.sampler() >= tracing.SampleRate {
+					continue
+				}
+				id = newTraceId()
+				record.Data[tracing.Key] = id
+				recordSets[i].Packed = nil
+			}
+			tracer.add(id, TraceHop{Time: now, Stage: TraceInput, Plugin: plugin, Tag: recordSet.Tag})
+		}
+	}
+}
+
+func (tracer *Tracer) hop(plugin string, stage string, recordSets []FluentRecordSet, latency time.Duration) {
+	tracer.mtx.Lock()
+	defer tracer.mtx.Unlock()
+	tracing := tracer.tracing
+	if tracing == nil {
+		return
+	}
+	now := tracer.clock.Now()
+	for _, recordSet := range recordSets {
+		for _, record := range recordSet.Records {
+			id, ok := record.Data[tracing.Key].(string)
+			if ok {
+				tracer.add(id, TraceHop{Time: now, Stage: stage, Plugin: plugin, Tag: recordSet.Tag, Latency: latency})
+			}
+		}
+	}
+}
+
+// Hop records that the traced records of the record sets went through the
+// stage of the plugin.
+func (tracer *Tracer) Hop(plugin interface{}, stage string, recordSets []FluentRecordSet, latency time.Duration) {
+	if !tracer.Enabled() {
+		return
+	}
+	tracer.hop(pluginName(plugin), stage, recordSets, latency)
+}
+
+// HopChunk records that the traced records found in the packed records of
+// a chunk went through the stage of the plugin.  The records are not
+// unpacked; the chunk is searched for the ids of the traces kept, which is
+// only worth it while tracing.  tag is the tag of the chunk, or "" if it
+// mixes several.
+func (tracer *Tracer) HopChunk(plugin interface{}, stage string, tag string, data []byte, latency time.Duration) {
+	if !tracer.Enabled() {
+		return
+	}
+	name := pluginName(plugin)
+	tracer.mtx.Lock()
+	defer tracer.mtx.Unlock()
+	if tracer.tracing == nil {
+		return
+	}
+	now := tracer.clock.Now()
+	for _, id := range tracer.order {
+		if bytes.Contains(data, []byte(id)) {
+			tracer.add(id, TraceHop{Time: now, Stage: stage, Plugin: name, Tag: tag, Latency: latency})
+		}
+	}
+}
+
+func copyTrace(trace *Trace) *Trace {
+	return &Trace{Id: trace.Id, Hops: append([]TraceHop{}, trace.Hops...)}
+}
+
+// Trace returns a copy of the trace of id, or nil if it is not kept.
+func (tracer *Tracer) Trace(id string) *Trace {
+	tracer.mtx.Lock()
+	defer tracer.mtx.Unlock()
+	trace, ok := tracer.traces[id]
+	if !ok {
+		return nil
+	}
+	return copyTrace(trace)
+}
+
+// Traces returns copies of the traces kept, the oldest first.
+func (tracer *Tracer) Traces() []*Trace {
+	tracer.mtx.Lock()
+	defer tracer.mtx.Unlock()
+	retval := make([]*Trace, 0, len(tracer.order))
+	for _, id := range tracer.order {
+		retval = append(retval, copyTrace(tracer.traces[id]))
+	}
+	return retval
+}
+
+type tracePort struct {
+	port    Port
+	tracer  *Tracer
+	inputId string
+}
+
+func (port *tracePort) Emit(recordSets []FluentRecordSet) error {
+	port.tracer.start(port.inputId, recordSets)
+	return port.port.Emit(recordSets)
+}
+
+func (port *tracePort) EmitContext(ctx context.Context, recordSets []FluentRecordSet) error {
+	port.tracer.start(port.inputId, recordSets)
+	return EmitContext(ctx, port.port, recordSets)
+}
+
+func (port *tracePort) EmitDurably(recordSets []FluentRecordSet) error {
+	port.tracer.start(port.inputId, recordSets)
+	return EmitDurably(port.port, recordSets)
+}
+
+func (port *tracePort) EmitWithResult(recordSets []FluentRecordSet) []error {
+	port.tracer.start(port.inputId, recordSets)
+	return EmitWithResult(port.port, recordSets)
+}
+
+func (port *tracePort) ForSource(address string) Port {
+	return &tracePort{PortForSource(port.port, address), port.tracer, port.inputId}
+}
+
+// wrapEngine returns the engine to create the input with the given id with.
+func (tracer *Tracer) wrapEngine(engine Engine, inputId string) Engine {
+	return &portEngine{
+		Engine: engine,
+		port:   &tracePort{engine.DefaultPort(), tracer, inputId},
+	}
+}
+
+// ParseTracing reads the <trace> element of the configuration, and returns
+// nil if there is none.
+func ParseTracing(config *Config) (*Tracing, error) {
+	for _, v := range config.Root.Elems {
+		if v.Name != "trace" {
+			continue
+		}
+		pattern, ok := v.Attrs["pattern"]
+		if !ok {
+			pattern = "**"
+		}
+		re, err := compileGlobPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		sampleRate := 1.
+		sampleRateStr, ok := v.Attrs["sample_rate"]
+		if ok {
+			sampleRate, err = strconv.ParseFloat(sampleRateStr, 64)
+			if err != nil || sampleRate <= 0 || sampleRate > 1 {
+				return nil, errors.New(fmt.Sprintf("invalid sample_rate: %s", sampleRateStr))
+			}
+		}
+		key, ok := v.Attrs["key"]
+		if !ok {
+			key = "_trace_id"
+		}
+		maxTraces := 1000
+		maxTracesStr, ok := v.Attrs["max_traces"]
+		if ok {
+			maxTraces, err = strconv.Atoi(maxTracesStr)
+			if err != nil || maxTraces <= 0 {
+				return nil, errors.New(fmt.Sprintf("invalid max_traces: %s", maxTracesStr))
+			}
+		}
+		return &Tracing{Pattern: re, SampleRate: sampleRate, Key: key, MaxTraces: maxTraces}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,105 @@
+package ik
+
+import (
+	"github.com/op/go-logging"
+	"testing"
+	"time"
+)
+
+func TestParseTracing(t *testing.T) {
+	const data = "<trace>\n" +
+		"pattern app.**\n" +
+		"sample_rate 0.5\n" +
+		"</trace>\n"
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	tracing, err := ParseTracing(config)
+	if err != nil || tracing == nil {
+		t.FailNow()
+	}
+	if tracing.SampleRate != 0.5 || tracing.Key != "_trace_id" || tracing.MaxTraces != 1000 || !tracing.Pattern.MatchString("app.web") || tracing.Pattern.MatchString("sys") {
+		t.Fail()
+	}
+	for _, attrs := range []string{"sample_rate 0\n", "sample_rate 2\n", "max_traces 0\n", "pattern ***\n"} {
+		config, err := ParseConfig(myOpener("<trace>\n"+attrs+"</trace>\n"), "test.cfg")
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		_, err = ParseTracing(config)
+		if err == nil {
+			t.Logf("%q accepted", attrs)
+			t.Fail()
+		}
+	}
+}
+
+func TestTracer(t *testing.T) {
+	tracer := NewTracer(logging.MustGetLogger("ik"), &tenantTestClock{now: time.Unix(1400000000, 0)})
+	re, _ := compileGlobPattern("app.**")
+	tracer.setTracing(&Tracing{Pattern: re, SampleRate: 1, Key: "_trace_id", MaxTraces: 2})
+
+	router := NewFluentRouter()
+	router.SetTracer(tracer)
+	filter, err := router.AddFilter("**", func(next Port) (Filter, error) {
+		return &appendingFilter{next, "a"}, nil
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	output := &recordingPort{}
+	router.AddRule("**", output)
+	port := &tracePort{router, tracer, "forward#0"}
+	err = port.Emit([]FluentRecordSet{
+		{Tag: "app.web", Records: []TinyFluentRecord{{Data: map[string]interface{}{"trail": ""}}}},
+		{Tag: "sys", Records: []TinyFluentRecord{{Data: map[string]interface{}{"trail": ""}}}},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	var id string
+	for _, recordSet := range output.recordSets {
+		id_, ok := recordSet.Records[0].Data["_trace_id"].(string)
+		if ok != (recordSet.Tag == "app.web") {
+			t.Fatalf("%v", recordSet)
+		}
+		if ok {
+			id = id_
+		}
+	}
+	traces := tracer.Traces()
+	if len(traces) != 1 || traces[0].Id != id {
+		t.Fatalf("%v", traces)
+	}
+	stages := make([]string, 0)
+	for _, hop := range traces[0].Hops {
+		stages = append(stages, hop.Stage)
+	}
+	if len(stages) != 4 || stages[0] != TraceInput || stages[1] != TraceFilterIn || stages[2] != TraceFilterOut || stages[3] != TraceOutput {
+		t.Fatalf("%v", stages)
+	}
+	if traces[0].Hops[0].Plugin != "forward#0" || traces[0].Hops[1].Plugin != pluginName(filter) {
+		t.Fatalf("%v", traces[0].Hops)
+	}
+
+	tracer.HopChunk(output, TraceDelivery, "", []byte(`{"_trace_id":"`+id+`"}`), time.Second)
+	trace := tracer.Trace(id)
+	if len(trace.Hops) != 5 || trace.Hops[4].Stage != TraceDelivery || trace.Hops[4].Latency != time.Second {
+		t.Fatalf("%v", trace.Hops)
+	}
+
+	// a record traced upstream keeps its id, and the oldest trace goes
+	for _, id_ := range []string{"upstream1", "upstream2"} {
+		port.Emit([]FluentRecordSet{{Tag: "app.web", Records: []TinyFluentRecord{{Data: map[string]interface{}{"trail": "", "_trace_id": id_}}}}})
+	}
+	if tracer.Trace(id) != nil || tracer.Trace("upstream1") == nil || len(tracer.Traces()) != 2 {
+		t.Fatalf("%v", tracer.Traces())
+	}
+
+	tracer.setTracing(nil)
+	port.Emit([]FluentRecordSet{{Tag: "app.web", Records: []TinyFluentRecord{{Data: map[string]interface{}{"trail": ""}}}}})
+	if _, ok := output.recordSets[len(output.recordSets)-1].Records[0].Data["_trace_id"]; ok {
+		t.Fatal("a record was traced with tracing disabled")
+	}
+}
@@ -1,7 +1,9 @@
 package ik
 
 import (
+	"context"
 	"errors"
+	"io"
 	"math/rand"
 	"regexp"
 	"strconv"
@@ -53,3 +55,71 @@ func ParseCapacityString(s string) (int64, error) {
 func NewRandSourceWithTimestampSeed() rand.Source {
 	return rand.NewSource(time.Now().UnixNano())
 }
+
+// EmitDurably emits the records through the port, waiting for them to be
+// stored if the port supports it.
+func EmitDurably(port Port, recordSets []FluentRecordSet) error {
+	durablePort, ok := port.(DurablePort)
+	if ok {
+		return durablePort.EmitDurably(recordSets)
+	}
+	return port.Emit(recordSets)
+}
+
+// GetChunkReaderAt returns a reader of the chunk starting at the latest
+// record it indexed at or before recordOffset, and the offset of that
+// record, which is 0 if the chunk cannot be read from a record on.
+func GetChunkReaderAt(chunk JournalChunk, recordOffset int64) (io.Reader, int64, error) {
+	seekableChunk, ok := chunk.(SeekableJournalChunk)
+	if ok {
+		return seekableChunk.GetReaderAt(recordOffset)
+	}
+	reader, err := chunk.GetReader()
+	return reader, 0, err
+}
+
+// EmitWithResult emits the records through the port as EmitDurably does,
+// and returns the error of each record set.  If the port cannot tell, the
+// error of the emission goes to every record set.
+func EmitWithResult(port Port, recordSets []FluentRecordSet) []error {
+	resultPort, ok := port.(ResultPort)
+	if ok {
+		return resultPort.EmitWithResult(recordSets)
+	}
+	return resultsOf(len(recordSets), EmitDurably(port, recordSets))
+}
+
+// FirstError returns the first of the errors of the record sets given by
+// EmitWithResult, or nil if every one was stored.
+func FirstError(results []error) error {
+	for _, err := range results {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func resultsOf(n int, err error) []error {
+	results := make([]error, n)
+	if err != nil {
+		for i := range results {
+			results[i] = err
+		}
+	}
+	return results
+}
+
+// EmitContext emits the records through the port, giving up once ctx is
+// done if the port supports it.
+func EmitContext(ctx context.Context, port Port, recordSets []FluentRecordSet) error {
+	contextPort, ok := port.(ContextPort)
+	if ok {
+		return contextPort.EmitContext(ctx, recordSets)
+	}
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+	return port.Emit(recordSets)
+}
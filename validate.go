@@ -0,0 +1,118 @@
+package ik
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+type validationPort struct{}
+
+func (port *validationPort) Emit(recordSets []FluentRecordSet) error {
+	return errors.New("the configuration is being validated")
+}
+
+// checkWritableDir tells if a buffer could be created in the directory the
+// buffer_path of an element points into.
+func checkWritableDir(bufferPath string) error {
+	dir := filepath.Dir(bufferPath)
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.New(dir + " is not a directory")
+	}
+	file, err := ioutil.TempFile(dir, ".ik-validate")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+func describeConfigElement(config *ConfigElement, ordinal int) string {
+	if config.Args != "" {
+		return fmt.Sprintf("<%s %s> (%s)", config.Name, config.Args, pluginInstanceId(config, ordinal))
+	}
+	return fmt.Sprintf("<%s> (%s)", config.Name, pluginInstanceId(config, ordinal))
+}
+
+// collectBufferPaths returns the buffer_path attributes of the element and
+// of the ones within it, such as the <store> elements of a copy output.
+func collectBufferPaths(config *ConfigElement, bufferPaths []string) []string {
+	bufferPath, ok := config.Attrs["buffer_path"]
+	if ok {
+		bufferPaths = append(bufferPaths, bufferPath)
+	}
+	for _, v := range config.Elems {
+		bufferPaths = collectBufferPaths(v, bufferPaths)
+	}
+	return bufferPaths
+}
+
+// ValidateOnly checks the configuration the way loading it would, short of
+// starting the ingestion, and returns all the errors found rather than the
+// first one.  Each <source>, <match> and <filter> is instantiated on an
+// engine of its own whose port refuses every record, which tells whether
+// its attributes are right and its ports can be bound, and the directories
+// of the buffer paths are checked to be writable.  The instances are then
+// disposed of.  As they are instantiated as they would be on startup,
+// buffered outputs open their buffers, recovering the chunks found there.
+func ValidateOnly(logger Logger, opener Opener, registry *MultiFactoryRegistry, config *Config) []error {
+	errs := make([]error, 0)
+	engine := NewEngine(logger, opener, registry, registry, NewScorekeeper(logger), &validationPort{})
+	globals := make([]*ConfigElement, 0)
+	elements := make([]*ConfigElement, 0)
+	for _, v := range config.Root.Elems {
+		switch v.Name {
+		case "source", "match", "filter":
+			elements = append(elements, v)
+		default:
+			globals = append(globals, v)
+		}
+	}
+	globalConfig := &Config{Root: &ConfigElement{Name: config.Root.Name, Elems: globals}}
+	for _, parse := range []func(config *Config) error{
+		func(config *Config) error { _, err := ParseProvenance(config, SystemClock); return err },
+		func(config *Config) error { _, err := ParseRecordIds(config, SystemClock); return err },
+		func(config *Config) error { _, err := ParseTenants(config); return err },
+		func(config *Config) error { _, err := ParseDebugOptions(config); return err },
+		func(config *Config) error { _, err := ParseTracing(config); return err },
+	} {
+		err := parse(globalConfig)
+		if err != nil {
+			errs = append(errs, err)
+			globals = nil
+		}
+	}
+	configurer := NewFluentConfigurer(logger, registry, registry, registry, NewFluentRouter())
+	ordinals := make(map[string]int)
+	for _, v := range elements {
+		description := describeConfigElement(v, ordinals[v.Attrs["type"]])
+		ordinals[v.Attrs["type"]] += 1
+		for _, bufferPath := range collectBufferPaths(v, nil) {
+			err := checkWritableDir(bufferPath)
+			if err != nil {
+				errs = append(errs, errors.New(fmt.Sprintf("%s: buffer_path %s: %s", description, bufferPath, err.Error())))
+			}
+		}
+		elementConfig := &Config{Root: &ConfigElement{Name: config.Root.Name, Elems: append(append([]*ConfigElement{}, globals...), v)}}
+		inputs, outputs, err := configurer.build(engine, elementConfig, NewFluentRouter())
+		if err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("%s: %s", description, err.Error())))
+		}
+		// plugins expect to be running when shut down
+		_, err = configurer.launch(engine, inputs, outputs)
+		if err != nil {
+			errs = append(errs, errors.New(fmt.Sprintf("%s: %s", description, err.Error())))
+		}
+	}
+	err := engine.Dispose()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
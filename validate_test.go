@@ -0,0 +1,62 @@
+package ik
+
+import (
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestValidateOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ik-validate")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	data := `<source>
+  type missing_input
+</source>
+<match a.**>
+  type sink
+  buffer_path ` + dir + `/buffer.*.log
+</match>
+<match b.**>
+  type sink
+  @id b
+  buffer_path ` + dir + `/missing/buffer.*.log
+</match>
+<match c.**>
+  type missing_output
+</match>`
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	sinkFactory := &testSinkFactory{}
+	registry := NewMultiFactoryRegistry(NewScorekeeper(logging.MustGetLogger("ik")))
+	err = registry.RegisterPlugins([]Plugin{sinkFactory})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	errs := ValidateOnly(logging.MustGetLogger("ik"), myOpener(data), registry, config)
+	expected := []string{"<source> (missing_input#0)", "<match b.**> (b): buffer_path", "<match c.**> (missing_output#0)"}
+	if len(errs) != len(expected) {
+		t.Fatalf("%v", errs)
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), expected[i]) {
+			t.Logf("expected %s, got %s", expected[i], err.Error())
+			t.Fail()
+		}
+	}
+	// the outputs that could be built were
+	if len(sinkFactory.outputs) != 2 {
+		t.Fail()
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Logf("%v left behind", entries)
+		t.Fail()
+	}
+}
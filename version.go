@@ -0,0 +1,4 @@
+package ik
+
+// Version is the version of ik.
+const Version = "0.1.0"
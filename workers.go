@@ -0,0 +1,208 @@
+package ik
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+type workersPlugin struct{}
+
+func (*workersPlugin) Name() string                 { return "workers" }
+func (*workersPlugin) BindScorekeeper(*Scorekeeper) {}
+
+// WorkersPlugin is the factory of the ports built for the <match> and
+// <filter> elements having a workers attribute.
+var WorkersPlugin Plugin = &workersPlugin{}
+
+type workerJob struct {
+	recordSets []FluentRecordSet
+	emit       func(Port, []FluentRecordSet) error
+	done       chan error
+}
+
+// Workers spreads the record sets over instances of the same output or
+// filter, each run by a goroutine of its own, so that the ones of
+// different tags are handled in parallel.  A tag always goes to the same
+// instance, which handles what it is given in order, so the records of a
+// tag stay in order.  Emit returns once every instance given some of the
+// records is done with them.
+type Workers struct {
+	logger Logger
+	ports  []Port
+	jobs   []chan *workerJob
+	cancel chan bool
+	once   sync.Once
+}
+
+// ParseWorkers reads the workers attribute of a <match> or <filter>
+// element, which is 1 if it is not given.
+func ParseWorkers(config *ConfigElement) (int, error) {
+	workersStr, ok := config.Attrs["workers"]
+	if !ok {
+		return 1, nil
+	}
+	workers, err := strconv.Atoi(workersStr)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Failed to parse workers: %s", err.Error()))
+	}
+	if workers < 1 {
+		return 0, errors.New("invalid workers: " + workersStr)
+	}
+	return workers, nil
+}
+
+// workerConfig returns the configuration of the instance for the worker,
+// whose buffer_path is set apart from the ones of the other workers, e.g.
+// /var/log/ik/buffer.w1.*.log for /var/log/ik/buffer.*.log.
+func workerConfig(config *ConfigElement, worker int) *ConfigElement {
+	attrs := make(map[string]string, len(config.Attrs))
+	for k, v := range config.Attrs {
+		attrs[k] = v
+	}
+	delete(attrs, "workers")
+	bufferPath, ok := attrs["buffer_path"]
+	if ok {
+		pos := strings.Index(bufferPath, "*")
+		if pos >= 0 {
+			attrs["buffer_path"] = fmt.Sprintf("%sw%d.%s", bufferPath[0:pos], worker, bufferPath[pos:])
+		} else {
+			attrs["buffer_path"] = fmt.Sprintf("%s.w%d", bufferPath, worker)
+		}
+	}
+	return &ConfigElement{Name: config.Name, Args: config.Args, Attrs: attrs, Elems: config.Elems}
+}
+
+func newWorkers(logger Logger, ports []Port) *Workers {
+	workers := &Workers{
+		logger: logger,
+		ports:  ports,
+		jobs:   make([]chan *workerJob, len(ports)),
+		cancel: make(chan bool),
+	}
+	for i, port := range ports {
+		workers.jobs[i] = make(chan *workerJob)
+		go workers.work(port, workers.jobs[i])
+	}
+	return workers
+}
+
+func (workers *Workers) work(port Port, jobs chan *workerJob) {
+	for {
+		select {
+		case <-workers.cancel:
+			return
+		case job := <-jobs:
+			job.done <- workers.run(port, job)
+		}
+	}
+}
+
+func (workers *Workers) run(port Port, job *workerJob) (err error) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			panicked := NewPanicked(r)
+			workers.logger.Critical("%s panicked: %s\n%s", pluginName(port), panicked.Error(), string(panicked.Stack()))
+			err = panicked
+		}
+	}()
+	return job.emit(port, job.recordSets)
+}
+
+func (workers *Workers) worker(tag string) int {
+	h := fnv.New32a()
+	h.Write([]byte(tag))
+	return int(h.Sum32() % uint32(len(workers.ports)))
+}
+
+func (workers *Workers) emit(ctx context.Context, recordSets []FluentRecordSet, emit func(Port, []FluentRecordSet) error) error {
+	shards := make([][]FluentRecordSet, len(workers.ports))
+	for _, recordSet := range recordSets {
+		i := workers.worker(recordSet.Tag)
+		shards[i] = append(shards[i], recordSet)
+	}
+	done := make(chan error, len(shards))
+	n := 0
+	for i, shard := range shards {
+		if len(shard) == 0 {
+			continue
+		}
+		select {
+		case workers.jobs[i] <- &workerJob{shard, emit, done}:
+			n += 1
+		case <-workers.cancel:
+			return errors.New("the workers have been shut down")
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	var retval error
+	for ; n > 0; n -= 1 {
+		select {
+		case err := <-done:
+			if err != nil && retval == nil {
+				retval = err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return retval
+}
+
+func (workers *Workers) Emit(recordSets []FluentRecordSet) error {
+	return workers.emit(context.Background(), recordSets, func(port Port, recordSets []FluentRecordSet) error {
+		return port.Emit(recordSets)
+	})
+}
+
+func (workers *Workers) EmitContext(ctx context.Context, recordSets []FluentRecordSet) error {
+	return workers.emit(ctx, recordSets, func(port Port, recordSets []FluentRecordSet) error {
+		return EmitContext(ctx, port, recordSets)
+	})
+}
+
+func (workers *Workers) EmitDurably(recordSets []FluentRecordSet) error {
+	return workers.emit(context.Background(), recordSets, EmitDurably)
+}
+
+func (workers *Workers) Factory() Plugin {
+	return WorkersPlugin
+}
+
+func (workers *Workers) Run() error {
+	<-workers.cancel
+	return nil
+}
+
+func (workers *Workers) Shutdown() error {
+	workers.once.Do(func() { close(workers.cancel) })
+	return nil
+}
+
+func (workers *Workers) Dispose() {
+	workers.Shutdown()
+}
+
+// buildWorkers builds an instance for each of the workers with the given
+// function, and returns them along with the port spreading the records over
+// them.
+func buildWorkers(logger Logger, config *ConfigElement, n int, build func(*ConfigElement) ([]Output, error)) ([]Output, *Workers, error) {
+	outputs := make([]Output, 0)
+	ports := make([]Port, 0, n)
+	for i := 0; i < n; i += 1 {
+		outputs_, err := build(workerConfig(config, i))
+		outputs = append(outputs, outputs_...)
+		if err != nil {
+			return outputs, nil, err
+		}
+		// the last one built is the instance itself
+		ports = append(ports, outputs_[len(outputs_)-1])
+	}
+	return outputs, newWorkers(logger, ports), nil
+}
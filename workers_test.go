@@ -0,0 +1,155 @@
+package ik
+
+import (
+	"errors"
+	"github.com/op/go-logging"
+	"strconv"
+	"testing"
+)
+
+func TestParseWorkers(t *testing.T) {
+	cases := []struct {
+		attrs    map[string]string
+		expected int
+	}{
+		{map[string]string{}, 1},
+		{map[string]string{"workers": "4"}, 4},
+		{map[string]string{"workers": "0"}, 0},
+		{map[string]string{"workers": "x"}, 0},
+	}
+	for _, case_ := range cases {
+		workers, err := ParseWorkers(&ConfigElement{Attrs: case_.attrs})
+		if workers != case_.expected || (err != nil) != (case_.expected == 0) {
+			t.Logf("%v: %d, %v", case_.attrs, workers, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestWorkerConfig(t *testing.T) {
+	cases := []struct {
+		bufferPath string
+		expected   string
+	}{
+		{"/var/log/ik/buffer.*.log", "/var/log/ik/buffer.w1.*.log"},
+		{"/var/log/ik/buffer", "/var/log/ik/buffer.w1"},
+	}
+	for _, case_ := range cases {
+		config := &ConfigElement{Name: "match", Args: "**", Attrs: map[string]string{"workers": "2", "buffer_path": case_.bufferPath}}
+		config_ := workerConfig(config, 1)
+		if config_.Attrs["buffer_path"] != case_.expected || config_.Args != "**" {
+			t.Logf("%v", config_)
+			t.Fail()
+		}
+		if _, ok := config_.Attrs["workers"]; ok || config.Attrs["buffer_path"] != case_.bufferPath {
+			t.Fail()
+		}
+	}
+}
+
+type panickingPort struct{}
+
+func (panickingPort) Emit([]FluentRecordSet) error { panic("boom") }
+
+func TestWorkers_Emit(t *testing.T) {
+	outputs := []*copyTestOutput{{}, {}, {}}
+	ports := make([]Port, len(outputs))
+	for i, output := range outputs {
+		ports[i] = output
+	}
+	workers := newWorkers(logging.MustGetLogger("ik"), ports)
+	defer workers.Dispose()
+	for i := 0; i < 10; i += 1 {
+		recordSets := make([]FluentRecordSet, 0)
+		for j := 0; j < 10; j += 1 {
+			recordSets = append(recordSets, FluentRecordSet{Tag: "tag" + strconv.Itoa(j), Records: []TinyFluentRecord{{Timestamp: uint64(i)}}})
+		}
+		err := workers.EmitDurably(recordSets)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// every tag goes to a single worker, in order
+	owners := make(map[string]int)
+	last := make(map[string]uint64)
+	total := 0
+	for i, output := range outputs {
+		for _, recordSet := range output.recordSets {
+			owner, ok := owners[recordSet.Tag]
+			if ok && owner != i {
+				t.Fatalf("%s went to workers %d and %d", recordSet.Tag, owner, i)
+			}
+			owners[recordSet.Tag] = i
+			if timestamp, ok := last[recordSet.Tag]; ok && recordSet.Records[0].Timestamp != timestamp+1 {
+				t.Fatalf("%s out of order", recordSet.Tag)
+			}
+			last[recordSet.Tag] = recordSet.Records[0].Timestamp
+			total += 1
+		}
+	}
+	if total != 100 || len(owners) != 10 {
+		t.Fail()
+	}
+
+	outputs[workers.worker("tag0")].err = errors.New("failure")
+	err := workers.Emit([]FluentRecordSet{{Tag: "tag0"}})
+	if err == nil || err.Error() != "failure" {
+		t.Fail()
+	}
+	workers.Shutdown()
+	err = workers.Emit([]FluentRecordSet{{Tag: "tag0"}})
+	if err == nil {
+		t.Fail()
+	}
+}
+
+func TestWorkers_Panic(t *testing.T) {
+	workers := newWorkers(logging.MustGetLogger("ik"), []Port{panickingPort{}})
+	defer workers.Dispose()
+	err := workers.Emit([]FluentRecordSet{{Tag: "test"}})
+	if _, ok := err.(*Panicked); !ok {
+		t.Fail()
+	}
+	// the worker survives the panic
+	err = workers.Emit([]FluentRecordSet{{Tag: "test"}})
+	if _, ok := err.(*Panicked); !ok {
+		t.Fail()
+	}
+}
+
+func TestWorkers_Config(t *testing.T) {
+	data := `<match **>
+  type sink
+  workers 3
+</match>`
+	config, err := ParseConfig(myOpener(data), "test.cfg")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	factory := &testSinkFactory{}
+	pipeline, err := NewPipeline(logging.MustGetLogger("ik"), myOpener(data), func(registry *MultiFactoryRegistry) error {
+		return registry.RegisterPlugins([]Plugin{factory})
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer pipeline.Dispose()
+	err = pipeline.Load(config)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(factory.outputs) != 3 {
+		t.FailNow()
+	}
+	err = pipeline.Router().Emit([]FluentRecordSet{{Tag: "test", Records: []TinyFluentRecord{{Timestamp: 1, Data: map[string]interface{}{"a": 1}}}}})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	n := 0
+	for _, output := range factory.outputs {
+		n += len(output.RecordSets())
+	}
+	if n != 1 {
+		t.Fail()
+	}
+}